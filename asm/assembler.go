@@ -0,0 +1,92 @@
+// Package asm assembles GVM assembly source into bytecode programs.
+package asm
+
+import (
+	"time"
+
+	"github.com/AndreiAlbert/gvm/bytecode"
+)
+
+// Assembler is the main struct that handles assembling source code to bytecode
+type Assembler struct {
+	source     string
+	lexer      *Lexer
+	parser     *Parser
+	generator  *CodeGenerator
+	program    *Program
+	bytecode   []byte
+	debugMode  bool
+	outputFile string
+	passes     []Pass
+	importer   Importer
+	// libraries are the sources of the imports merged into the program
+	libraries []string
+	built     time.Time
+	// keepUnused keeps the library declarations the program doesn't
+	// reach, eliminatedFunctions and eliminatedStructs list those dropped
+	keepUnused          bool
+	eliminatedFunctions []string
+	eliminatedStructs   []string
+}
+
+// NewAssembler creates a new assembler for the given source code
+func NewAssembler(source string) *Assembler {
+	return &Assembler{
+		source:    source,
+		debugMode: false,
+	}
+}
+
+// Assemble runs the lexer, parser and code generator over the source and
+// returns the program packaged as a bytecode container, with its build
+// info.
+func (a *Assembler) Assemble() (*bytecode.Program, error) {
+	program, err := a.parse()
+	if err != nil {
+		return nil, err
+	}
+	a.generator = NewCodeGenerator(program)
+	container, err := a.generator.GenerateProgram()
+	if err != nil {
+		return nil, err
+	}
+	a.bytecode = container.Code
+	container.BuildInfo = a.buildInfo()
+	return container, nil
+}
+
+// AssembleFunction assembles the source and returns the function name laid
+// out on its own at address base, see CodeGenerator.GenerateFunctionAt. The
+// result is what VM.ReplaceFunction patches into a running program.
+func (a *Assembler) AssembleFunction(name string, base uint) (*bytecode.Program, error) {
+	program, err := a.parse()
+	if err != nil {
+		return nil, err
+	}
+	a.generator = NewCodeGenerator(program)
+	patch, err := a.generator.GenerateFunctionAt(name, base)
+	if err != nil {
+		return nil, err
+	}
+	a.bytecode = patch.Code
+	return patch, nil
+}
+
+// parse parses the source, merges the libraries it imports and runs the
+// passes over the result
+func (a *Assembler) parse() (*Program, error) {
+	a.lexer = NewLexer(a.source)
+	a.parser = NewParser(a.lexer)
+	program, err := a.parser.Parse()
+	if err != nil {
+		return nil, err
+	}
+	if err := a.resolveImports(program); err != nil {
+		return nil, err
+	}
+	if err := a.runPasses(program); err != nil {
+		return nil, err
+	}
+	a.program = program
+	return program, nil
+}
@@ -0,0 +1,52 @@
+package asm
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"runtime"
+	"runtime/debug"
+	"time"
+
+	"github.com/AndreiAlbert/gvm/bytecode"
+)
+
+// modulePath is the module the assembler is part of
+const modulePath = "github.com/AndreiAlbert/gvm"
+
+// Toolchain names the assembler in the build info of the containers it
+// writes: gvm, the version of the module it was built from and the Go
+// version, such as "gvm v0.5.0 (go1.22.1)".
+func Toolchain() string {
+	version := "(devel)"
+	if info, ok := debug.ReadBuildInfo(); ok {
+		if info.Main.Path == modulePath && info.Main.Version != "" {
+			version = info.Main.Version
+		}
+		for _, dep := range info.Deps {
+			if dep.Path == modulePath {
+				version = dep.Version
+			}
+		}
+	}
+	return fmt.Sprintf("gvm %s (%s)", version, runtime.Version())
+}
+
+// SetBuildTime records t as the time the container was built. Without it
+// the build info has no time, so assembling the same source always gives
+// the same container.
+func (a *Assembler) SetBuildTime(t time.Time) {
+	a.built = t
+}
+
+// buildInfo describes the assembly of the source and the libraries merged
+// into it
+func (a *Assembler) buildInfo() *bytecode.BuildInfo {
+	h := sha256.New()
+	h.Write([]byte(a.source))
+	for _, library := range a.libraries {
+		h.Write([]byte(library))
+	}
+	info := &bytecode.BuildInfo{Toolchain: Toolchain(), Built: a.built}
+	h.Sum(info.SourceHash[:0])
+	return info
+}
@@ -0,0 +1,1095 @@
+package asm
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/AndreiAlbert/gvm/bytecode"
+	. "github.com/AndreiAlbert/gvm/common"
+	"github.com/AndreiAlbert/gvm/vm"
+	"math"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// CodeGenerator translates a parsed Program into bytecode.
+type CodeGenerator struct {
+	program       *Program
+	bytecode      []byte
+	functionTable map[string]uint
+	functionIndex map[string]uint32
+	// nativeIndex numbers the natives of the .natives section, the
+	// CALLNATIVE operand
+	nativeIndex map[string]uint32
+	structTable map[string]StructType
+	// structs is the struct table written to the program, see
+	// programStructs
+	structs         []StructType
+	fieldIDs        map[string]uint16
+	currentFunction *ParsedFunction
+	// jump patching state for the function being generated
+	currentSite  jumpSite
+	jumpFixups   []jumpFixup
+	wideJumps    map[jumpSite]bool
+	instrOffsets []uint
+	bodyStart    uint
+	lines        []bytecode.LineEntry
+	labels       []bytecode.Label
+	enumUses     []enumUse
+	// constantIndex maps the conditional jump comparands moved to the
+	// constant pool to their index in constants, see poolConstants
+	constantIndex map[uint32]byte
+	constants     []uint32
+	// workers bounds the number of functions assembled concurrently
+	workers int
+}
+
+// jumpSite identifies a jump instruction by function and instruction index.
+type jumpSite struct {
+	function    int
+	instruction int
+}
+
+// jumpFixup is a jump operand that is patched once the target label's
+// address is known.
+type jumpFixup struct {
+	site   jumpSite
+	offset uint
+	label  string
+	wide   bool
+}
+
+// enumUse is an instruction whose operand is an enum constant.
+type enumUse struct {
+	address uint
+	enum    string
+}
+
+// NewCodeGenerator creates a code generator for the parsed program.
+func NewCodeGenerator(program *Program) *CodeGenerator {
+	return &CodeGenerator{
+		program:       program,
+		bytecode:      []byte{},
+		functionTable: make(map[string]uint),
+		functionIndex: make(map[string]uint32),
+		nativeIndex:   make(map[string]uint32),
+		structTable:   make(map[string]StructType),
+		fieldIDs:      make(map[string]uint16),
+		wideJumps:     make(map[jumpSite]bool),
+		workers:       runtime.GOMAXPROCS(0),
+	}
+}
+
+// Generate assembles the program. Jumps start out with 2-byte targets; when a
+// target ends up beyond 64KB the jump is switched to its WIDE form and the
+// program is generated again, until every target fits.
+func (g *CodeGenerator) Generate() ([]byte, error) {
+	for {
+		grown, err := g.generate()
+		if err != nil {
+			return nil, err
+		}
+		if !grown {
+			return g.bytecode, nil
+		}
+	}
+}
+
+// GenerateProgram assembles the program and packages it as a container, with
+// the function and struct tables recorded in the header.
+func (g *CodeGenerator) GenerateProgram() (*bytecode.Program, error) {
+	code, err := g.Generate()
+	if err != nil {
+		return nil, err
+	}
+	program := &bytecode.Program{
+		Version: bytecode.Version,
+		Code:    code,
+		Lines:   g.lines,
+		Labels:  g.labels,
+		Enums:   g.programEnums(g.enumUses),
+	}
+	if len(g.constants) > 0 {
+		program.Constants = g.constants
+	}
+	for i := range g.program.Functions {
+		function := &g.program.Functions[i]
+		maxStack, maxLocals := g.frameSize(function)
+		program.Functions = append(program.Functions, bytecode.Function{
+			Name:             function.Name,
+			Address:          uint32(g.functionTable[function.Name]),
+			ParamCount:       uint16(len(function.Params)),
+			ReturnType:       function.ReturnType,
+			IsMain:           function.Name == "main",
+			ReturnStructName: function.ReturnStructName,
+			MaxStack:         maxStack,
+			MaxLocals:        maxLocals,
+		})
+	}
+	for _, structDef := range g.structs {
+		program.Structs = append(program.Structs, g.structTable[structDef.Name])
+	}
+	for _, native := range g.program.Natives {
+		declared := bytecode.Native{Name: native.Name, ReturnType: native.ReturnType, Async: native.Async}
+		for _, param := range native.Params {
+			declared.Params = append(declared.Params, param.Type)
+		}
+		program.Natives = append(program.Natives, declared)
+	}
+	return program, nil
+}
+
+// GenerateFunctionAt assembles the program and then lays the function name
+// out on its own at address base, for replacing the function of a program
+// that is running. Code holds the function header and body followed by a
+// HALT, to be placed at base. The function, struct and field tables are
+// those of the whole program, with the address of name moved to its new
+// body. Lines, Labels and the enum constants cover the function alone.
+func (g *CodeGenerator) GenerateFunctionAt(name string, base uint) (*bytecode.Program, error) {
+	program, err := g.GenerateProgram()
+	if err != nil {
+		return nil, err
+	}
+	index, exists := g.functionIndex[name]
+	if !exists {
+		return nil, fmt.Errorf("undefined function: %s", name)
+	}
+	// the running program keeps its constant pool, the patch carries its
+	// comparands
+	g.constantIndex = nil
+	program.Constants = nil
+	for {
+		fg, err := g.generateFunction(int(index))
+		if err != nil {
+			return nil, err
+		}
+		if g.relocateJumps(fg, fg.bytecode, base) {
+			continue
+		}
+		program.Code = append(fg.bytecode, byte(vm.HALT))
+		program.Functions[index].Address = uint32(base + fg.bodyStart)
+		program.Lines = nil
+		for _, entry := range fg.lines {
+			entry.Address += uint32(base)
+			program.Lines = append(program.Lines, entry)
+		}
+		program.Labels = fg.functionLabels(base)
+		var uses []enumUse
+		for _, use := range fg.enumUses {
+			use.address += base
+			uses = append(uses, use)
+		}
+		program.Enums = g.programEnums(uses)
+		return program, nil
+	}
+}
+
+func (g *CodeGenerator) generate() (bool, error) {
+	g.bytecode = []byte{}
+	g.functionTable = make(map[string]uint)
+	g.functionIndex = make(map[string]uint32)
+	g.nativeIndex = make(map[string]uint32)
+	g.structTable = make(map[string]StructType)
+	g.fieldIDs = make(map[string]uint16)
+	g.lines = nil
+	g.labels = nil
+	g.enumUses = nil
+	if err := g.defineStructs(); err != nil {
+		return false, err
+	}
+	if err := g.checkInterfaces(); err != nil {
+		return false, err
+	}
+	if err := g.checkEnums(); err != nil {
+		return false, err
+	}
+	if err := g.indexFunctions(); err != nil {
+		return false, err
+	}
+	if err := g.indexNatives(); err != nil {
+		return false, err
+	}
+	g.poolConstants()
+	functions, err := g.generateFunctions()
+	if err != nil {
+		return false, err
+	}
+	// relocation: lay the function buffers out one after another and turn
+	// their function-relative jump targets into absolute addresses
+	grown := false
+	for i, fg := range functions {
+		base := uint(len(g.bytecode))
+		g.functionTable[g.program.Functions[i].Name] = base + fg.bodyStart
+		g.emitBytes(fg.bytecode)
+		for _, entry := range fg.lines {
+			entry.Address += uint32(base)
+			g.lines = append(g.lines, entry)
+		}
+		g.labels = append(g.labels, fg.functionLabels(base)...)
+		for _, use := range fg.enumUses {
+			use.address += base
+			g.enumUses = append(g.enumUses, use)
+		}
+		if g.relocateJumps(fg, g.bytecode[base:], base) {
+			grown = true
+		}
+	}
+	g.emitByte(byte(vm.HALT))
+	return grown, nil
+}
+
+// generateFunctions assembles every function into its own buffer. CALL
+// operands are function indices, so bodies don't depend on each other's
+// addresses and are generated concurrently.
+func (g *CodeGenerator) generateFunctions() ([]*CodeGenerator, error) {
+	functions := make([]*CodeGenerator, len(g.program.Functions))
+	errs := make([]error, len(g.program.Functions))
+	workers := g.workers
+	if workers > len(functions) {
+		workers = len(functions)
+	}
+	if workers <= 1 {
+		for i := range functions {
+			functions[i], errs[i] = g.generateFunction(i)
+		}
+	} else {
+		next := make(chan int)
+		var wg sync.WaitGroup
+		for w := 0; w < workers; w++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := range next {
+					functions[i], errs[i] = g.generateFunction(i)
+				}
+			}()
+		}
+		for i := range functions {
+			next <- i
+		}
+		close(next)
+		wg.Wait()
+	}
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return functions, nil
+}
+
+// generateFunction assembles the header and body of one function into a
+// fresh buffer. The shared tables are only read while functions are
+// generated.
+func (g *CodeGenerator) generateFunction(index int) (*CodeGenerator, error) {
+	function := g.program.Functions[index]
+	fg := &CodeGenerator{
+		program:         g.program,
+		functionIndex:   g.functionIndex,
+		nativeIndex:     g.nativeIndex,
+		structTable:     g.structTable,
+		fieldIDs:        g.fieldIDs,
+		wideJumps:       g.wideJumps,
+		constantIndex:   g.constantIndex,
+		currentFunction: &function,
+		instrOffsets:    make([]uint, len(function.Body)+1),
+	}
+	fg.emitByte(byte(vm.FUNC))
+	if function.Name == "main" {
+		fg.emitByte(byte(vm.FUNC_MAIN))
+	} else {
+		fg.emitByte(byte(vm.FUNC_NORMAL))
+	}
+	paramCountByte := make([]byte, 2)
+	binary.BigEndian.PutUint16(paramCountByte, uint16(len(function.Params)))
+	fg.emitBytes(paramCountByte)
+	fg.emitByte(byte(function.ReturnType))
+	if function.ReturnType == ValueStruct {
+		if _, exists := g.structTable[function.ReturnStructName]; !exists {
+			return nil, fmt.Errorf("undefined struct return type: %s in function %s", function.ReturnStructName, function.Name)
+		}
+		fg.emitString(function.ReturnStructName)
+	}
+	fg.bodyStart = uint(len(fg.bytecode))
+	for j, instruction := range function.Body {
+		fg.currentSite = jumpSite{function: index, instruction: j}
+		fg.instrOffsets[j] = uint(len(fg.bytecode))
+		// instructions added by passes have no line, they map to the
+		// line before them
+		if instruction.Token.Line > 0 {
+			fg.lines = append(fg.lines, bytecode.LineEntry{
+				Address: uint32(len(fg.bytecode)),
+				Line:    uint32(instruction.Token.Line),
+			})
+		}
+		if err := fg.generateInstruction(instruction); err != nil {
+			return nil, fmt.Errorf("error generating instruction %v: %w", instruction, err)
+		}
+	}
+	fg.instrOffsets[len(function.Body)] = uint(len(fg.bytecode))
+	return fg, nil
+}
+
+// functionLabels returns the labels of a function buffer placed at base,
+// sorted by address
+func (g *CodeGenerator) functionLabels(base uint) []bytecode.Label {
+	var labels []bytecode.Label
+	for name, index := range g.currentFunction.Labels {
+		labels = append(labels, bytecode.Label{Address: uint32(base + g.instrOffsets[index]), Name: name})
+	}
+	sort.Slice(labels, func(i, j int) bool {
+		if labels[i].Address != labels[j].Address {
+			return labels[i].Address < labels[j].Address
+		}
+		return labels[i].Name < labels[j].Name
+	})
+	return labels
+}
+
+// relocateJumps patches the jumps of a function buffer, copied to code, for
+// the address base it is placed at. It reports whether a narrow jump
+// overflowed and was marked wide.
+func (g *CodeGenerator) relocateJumps(fg *CodeGenerator, code []byte, base uint) bool {
+	grown := false
+	for _, fixup := range fg.jumpFixups {
+		target := base + fg.instrOffsets[fg.currentFunction.Labels[fixup.label]]
+		if fixup.wide {
+			binary.BigEndian.PutUint32(code[fixup.offset:], uint32(target))
+		} else if target > math.MaxUint16 {
+			g.wideJumps[fixup.site] = true
+			grown = true
+		} else {
+			binary.BigEndian.PutUint16(code[fixup.offset:], uint16(target))
+		}
+	}
+	return grown
+}
+
+// indexFunctions numbers functions in declaration order. CALL operands are
+// indices into this table, so calls may target functions defined later.
+func (g *CodeGenerator) indexFunctions() error {
+	if uint64(len(g.program.Functions)) > math.MaxUint32 {
+		return fmt.Errorf("too many functions: %d", len(g.program.Functions))
+	}
+	for i, function := range g.program.Functions {
+		if _, exists := g.functionIndex[function.Name]; exists {
+			return fmt.Errorf("duplicate function: %s", function.Name)
+		}
+		g.functionIndex[function.Name] = uint32(i)
+	}
+	return nil
+}
+
+// indexNatives numbers the natives in declaration order. A call of a name
+// declared as a native is emitted as CALLNATIVE, so natives may not share
+// their names with functions.
+func (g *CodeGenerator) indexNatives() error {
+	if len(g.program.Natives) > math.MaxUint16 {
+		return fmt.Errorf("too many natives: %d", len(g.program.Natives))
+	}
+	for i, native := range g.program.Natives {
+		if _, exists := g.nativeIndex[native.Name]; exists {
+			return fmt.Errorf("duplicate native: %s", native.Name)
+		}
+		if _, exists := g.functionIndex[native.Name]; exists {
+			return fmt.Errorf("native %s is also declared as a function", native.Name)
+		}
+		if native.ReturnType == ValueStruct {
+			return fmt.Errorf("native %s returns struct %s, natives return int32, float32, string or void", native.Name, native.ReturnStructName)
+		}
+		if native.Async && native.ReturnType == ValueVoid {
+			return fmt.Errorf("async native %s returns void, an awaited call needs a result", native.Name)
+		}
+		g.nativeIndex[native.Name] = uint32(i)
+	}
+	return nil
+}
+
+// checkInterfaces rejects interfaces declared twice or clashing with a
+// struct, and methods declared twice in an interface
+func (g *CodeGenerator) checkInterfaces() error {
+	declared := make(map[string]bool)
+	for _, iface := range g.program.Interfaces {
+		if _, isStruct := g.structTable[iface.Name]; isStruct || declared[iface.Name] {
+			return fmt.Errorf("duplicate type: %s", iface.Name)
+		}
+		declared[iface.Name] = true
+		methods := make(map[string]bool)
+		for _, method := range iface.Methods {
+			if methods[method.Name] {
+				return fmt.Errorf("duplicate method %s in interface %s", method.Name, iface.Name)
+			}
+			methods[method.Name] = true
+		}
+	}
+	return nil
+}
+
+// interfaceMethod looks up the method of an Interface.method operand
+func (g *CodeGenerator) interfaceMethod(operand string) (InterfaceMethod, error) {
+	name, methodName, _ := strings.Cut(operand, ".")
+	for _, iface := range g.program.Interfaces {
+		if iface.Name != name {
+			continue
+		}
+		for _, method := range iface.Methods {
+			if method.Name == methodName {
+				return method, nil
+			}
+		}
+		return InterfaceMethod{}, fmt.Errorf("interface %s has no method %s", name, methodName)
+	}
+	return InterfaceMethod{}, fmt.Errorf("undefined interface: %s", name)
+}
+
+// checkEnums rejects enums declared twice or clashing with another type,
+// members declared twice in an enum and fields of an undefined type
+func (g *CodeGenerator) checkEnums() error {
+	types := make(map[string]bool)
+	for _, iface := range g.program.Interfaces {
+		types[iface.Name] = true
+	}
+	enums := make(map[string]bool)
+	for _, enum := range g.program.Enums {
+		if _, isStruct := g.structTable[enum.Name]; isStruct || types[enum.Name] {
+			return fmt.Errorf("duplicate type: %s", enum.Name)
+		}
+		types[enum.Name] = true
+		enums[enum.Name] = true
+		members := make(map[string]bool)
+		for _, member := range enum.Members {
+			if members[member.Name] {
+				return fmt.Errorf("duplicate member %s in enum %s", member.Name, enum.Name)
+			}
+			members[member.Name] = true
+		}
+	}
+	for _, structDef := range g.structs {
+		for _, field := range structDef.Fields {
+			if field.Enum != "" && !enums[field.Enum] {
+				return fmt.Errorf("undefined type %s of field %s.%s", field.Enum, structDef.Name, field.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// enumConstant resolves an enum constant, Enum.MEMBER or the name of a
+// member declared by a single enum, to its value and enum
+func (g *CodeGenerator) enumConstant(operand string) (int32, string, error) {
+	// member names have no dots, enum names may
+	enumName, memberName := "", operand
+	dot := strings.LastIndex(operand, ".")
+	qualified := dot >= 0
+	if qualified {
+		enumName, memberName = operand[:dot], operand[dot+1:]
+	}
+	var value int32
+	var owners []string
+	for _, enum := range g.program.Enums {
+		if qualified && enum.Name != enumName {
+			continue
+		}
+		for _, member := range enum.Members {
+			if member.Name == memberName {
+				value = member.Value
+				owners = append(owners, enum.Name)
+			}
+		}
+		if qualified && len(owners) == 0 {
+			return 0, "", fmt.Errorf("enum %s has no member %s", enumName, memberName)
+		}
+	}
+	switch len(owners) {
+	case 0:
+		return 0, "", fmt.Errorf("undefined enum constant: %s", operand)
+	case 1:
+		return value, owners[0], nil
+	default:
+		return 0, "", fmt.Errorf("enums %s declare %s, name it %s.%s", strings.Join(owners, " and "), memberName, owners[0], memberName)
+	}
+}
+
+// programEnums returns the enum table of the program, with the constants
+// used by the instructions of uses
+func (g *CodeGenerator) programEnums(uses []enumUse) []bytecode.Enum {
+	var enums []bytecode.Enum
+	for _, enum := range g.program.Enums {
+		e := bytecode.Enum{Name: enum.Name}
+		for _, member := range enum.Members {
+			e.Members = append(e.Members, bytecode.EnumMember{Name: member.Name, Value: member.Value})
+		}
+		for _, structDef := range g.structs {
+			for _, field := range structDef.Fields {
+				if field.Enum == enum.Name {
+					e.Fields = append(e.Fields, structDef.Name+"."+field.Name)
+				}
+			}
+		}
+		for _, use := range uses {
+			if use.enum == enum.Name {
+				e.Constants = append(e.Constants, uint32(use.address))
+			}
+		}
+		enums = append(enums, e)
+	}
+	return enums
+}
+
+// pooledJumps maps the conditional jumps to their form comparing against
+// a constant of the pool
+var pooledJumps = map[vm.Opcode]vm.Opcode{
+	vm.IJE:  vm.IJEC,
+	vm.IJNE: vm.IJNEC,
+	vm.FJE:  vm.FJEC,
+	vm.FJNE: vm.FJNEC,
+}
+
+// constantPoolOverhead is the size of the constant pool section without
+// its entries: the section header and the entry count
+const constantPoolOverhead = 5 + 4
+
+// comparand returns the 4-byte value operand of the conditional jump inst
+// and, when it is an enum constant, the enum
+func (g *CodeGenerator) comparand(inst Instruction) (uint32, string, error) {
+	if len(inst.Operands) != 2 {
+		return 0, "", fmt.Errorf("conditional jump requires two operands, got %d", len(inst.Operands))
+	}
+	valueToken := inst.Operands[1]
+	if valueToken.Type == IDENT && inst.Opcode != vm.FJE && inst.Opcode != vm.FJNE {
+		value, enum, err := g.enumConstant(valueToken.Literal)
+		return uint32(value), enum, err
+	} else if valueToken.Type == INT {
+		value, err := parseInt32(valueToken.Literal)
+		return uint32(value), "", err
+	} else if valueToken.Type == FLOAT {
+		value, err := parseFloat32(valueToken.Literal)
+		return math.Float32bits(value), "", err
+	}
+	return 0, "", fmt.Errorf("unsupported type in conditional jump: %v", valueToken.Type)
+}
+
+// poolConstants moves the comparands of conditional jumps into the
+// constant pool when that shrinks the program. A pooled jump refers to its
+// comparand with a 1-byte index instead of carrying the 4 bytes, so a
+// value compared against at n sites saves 3n bytes and costs a 4-byte
+// entry. The values saving the most are pooled, up to the 256 entries the
+// index reaches, unless the savings don't pay for the section.
+func (g *CodeGenerator) poolConstants() {
+	g.constantIndex = nil
+	g.constants = nil
+	uses := make(map[uint32]int)
+	var values []uint32
+	for _, function := range g.program.Functions {
+		for _, inst := range function.Body {
+			if _, ok := pooledJumps[inst.Opcode]; !ok {
+				continue
+			}
+			// invalid operands are reported when the jump is generated
+			value, _, err := g.comparand(inst)
+			if err != nil {
+				continue
+			}
+			if uses[value] == 0 {
+				values = append(values, value)
+			}
+			uses[value]++
+		}
+	}
+	saving := func(value uint32) int { return 3*uses[value] - 4 }
+	sort.SliceStable(values, func(i, j int) bool { return saving(values[i]) > saving(values[j]) })
+	total := 0
+	for _, value := range values {
+		if saving(value) <= 0 || len(g.constants) > math.MaxUint8 {
+			break
+		}
+		total += saving(value)
+		g.constants = append(g.constants, value)
+	}
+	if total <= constantPoolOverhead {
+		g.constants = nil
+		return
+	}
+	g.constantIndex = make(map[uint32]byte)
+	for i, value := range g.constants {
+		g.constantIndex[value] = byte(i)
+	}
+}
+
+func (g *CodeGenerator) defineStructs() error {
+	structs, err := programStructs(g.program)
+	if err != nil {
+		return err
+	}
+	g.structs = structs
+	for _, structDef := range g.structs {
+		g.emitByte(byte(vm.DEFSTRUCT))
+		g.emitString(structDef.Name)
+		g.emitByte(byte(len(structDef.Fields)))
+		// field ids are assigned in order of first appearance, the VM
+		// derives the same numbering when it reads the struct section
+		fields := make([]StructField, len(structDef.Fields))
+		for i, field := range structDef.Fields {
+			fieldID, ok := g.fieldIDs[field.Name]
+			if !ok {
+				fieldID = uint16(len(g.fieldIDs))
+				g.fieldIDs[field.Name] = fieldID
+			}
+			field.ID = fieldID
+			fields[i] = field
+			g.emitString(field.Name)
+			g.emitByte(byte(field.Type))
+			if field.ArrayType != nil {
+				g.emitByte(byte(*field.ArrayType))
+			}
+		}
+		structDef.Fields = fields
+		g.structTable[structDef.Name] = structDef
+	}
+	return nil
+}
+
+func (g *CodeGenerator) generateFunctionMetadata() error {
+	for _, function := range g.program.Functions {
+		// Record function header start position
+		// Emit FUNC opcode
+		g.emitByte(byte(vm.FUNC))
+
+		// Emit function type (main or normal)
+		if function.Name == "main" {
+			g.emitByte(byte(vm.FUNC_MAIN))
+		} else {
+			g.emitByte(byte(vm.FUNC_NORMAL))
+		}
+		// Emit parameter count
+		paramCountBytes := make([]byte, 2)
+		binary.BigEndian.PutUint16(paramCountBytes, uint16(len(function.Params)))
+		g.emitBytes(paramCountBytes)
+		// Emit return type
+		g.emitByte(byte(function.ReturnType))
+		// For struct returns, emit the struct name
+		if function.ReturnType == ValueStruct {
+			if _, exists := g.structTable[function.ReturnStructName]; !exists {
+				return fmt.Errorf("undefined struct return type: %s in function %s",
+					function.ReturnStructName, function.Name)
+			}
+			g.emitString(function.ReturnStructName)
+		}
+		// Record where this function's body will begin
+		bodyStart := uint(len(g.bytecode))
+		g.functionTable[function.Name] = bodyStart
+	}
+	return nil
+}
+
+// Improved method to generate all function bodies with accurate address tracking
+func (g *CodeGenerator) generateAllFunctionBodies() error {
+	for _, function := range g.program.Functions {
+		bodyAddr := g.functionTable[function.Name]
+		currentPos := uint(len(g.bytecode))
+		if currentPos != bodyAddr {
+			g.functionTable[function.Name] = currentPos
+		}
+		g.currentFunction = &function
+		for _, instruction := range function.Body {
+
+			if err := g.generateInstruction(instruction); err != nil {
+				return fmt.Errorf("error generating instruction %v: %w", instruction, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (g *CodeGenerator) generateInstruction(inst Instruction) error {
+	start := uint(len(g.bytecode))
+	if inst.Opcode == vm.CALL && len(inst.Operands) == 1 {
+		if _, ok := g.nativeIndex[inst.Operands[0].Literal]; ok {
+			inst.Opcode = vm.CALLNATIVE
+		}
+	}
+	wide, err := g.needsWide(inst)
+	if err != nil {
+		return err
+	}
+	if wide {
+		g.emitByte(byte(vm.WIDE))
+	}
+	g.emitByte(byte(inst.Opcode))
+	switch inst.Opcode {
+	case vm.PUSH:
+		if len(inst.Operands) != 2 {
+			return fmt.Errorf("push requires two operands, got %d", len(inst.Operands))
+		}
+		typeToken := inst.Operands[0]
+		valueToken := inst.Operands[1]
+		if typeToken.Type == INT32 && valueToken.Type == IDENT {
+			g.emitByte(byte(ValueInt32))
+			value, enum, err := g.enumConstant(valueToken.Literal)
+			if err != nil {
+				return err
+			}
+			g.enumUses = append(g.enumUses, enumUse{address: start, enum: enum})
+			g.emitInt32(value)
+		} else if typeToken.Type == INT32 {
+			g.emitByte(byte(ValueInt32))
+			value, err := parseInt32(valueToken.Literal)
+			if err != nil {
+				return err
+			}
+			g.emitInt32(value)
+		} else if typeToken.Type == FLOAT32 {
+			g.emitByte(byte(ValueFloat32))
+			value, err := parseFloat32(valueToken.Literal)
+			if err != nil {
+				return err
+			}
+			g.emitFloat32(value)
+		} else if typeToken.Type == BYTE_TYPE {
+			g.emitByte(byte(ValueByte))
+			value, err := parseInt32(valueToken.Literal)
+			if err != nil {
+				return err
+			}
+			if value < 0 || value > 255 {
+				return fmt.Errorf("byte value out of range: %d", value)
+			}
+			g.emitByte(byte(value))
+		} else {
+			return fmt.Errorf("unsupported type in push: %v", typeToken.Type)
+		}
+	case vm.STORE, vm.LOAD:
+		if len(inst.Operands) != 1 {
+			return fmt.Errorf("%v requires one operand, got %d", inst.Opcode, len(inst.Operands))
+		}
+		addrToken := inst.Operands[0]
+		addr, err := parseInt32(addrToken.Literal)
+		if err != nil {
+			return err
+		}
+		if addr < 0 {
+			return fmt.Errorf("negative local address: %d", addr)
+		}
+		g.emitOperand(uint32(addr), wide)
+	case vm.CALL:
+		if len(inst.Operands) != 1 {
+			return fmt.Errorf("call requires one operand, got %d", len(inst.Operands))
+		}
+		funcName := inst.Operands[0].Literal
+		funcIndex, exists := g.functionIndex[funcName]
+		if !exists {
+			return fmt.Errorf("undefined function: %s", funcName)
+		}
+		g.emitOperand(funcIndex, wide)
+	case vm.CALLNATIVE:
+		g.emitOperand(g.nativeIndex[inst.Operands[0].Literal], wide)
+	case vm.JMP, vm.IJE, vm.IJNE, vm.FJE, vm.FJNE, vm.TRY, vm.FORITER:
+		if len(inst.Operands) < 1 {
+			return fmt.Errorf("jump requires at least one operand, got %d", len(inst.Operands))
+		}
+		labelName := inst.Operands[0].Literal
+		labelPos, exists := g.currentFunction.Labels[labelName]
+		if !exists {
+			return fmt.Errorf("undefined label: %s", labelName)
+		}
+		if labelPos < 0 || labelPos >= len(g.instrOffsets) {
+			return fmt.Errorf("label %s out of range", labelName)
+		}
+		g.jumpFixups = append(g.jumpFixups, jumpFixup{
+			site:   g.currentSite,
+			offset: uint(len(g.bytecode)),
+			label:  labelName,
+			wide:   wide,
+		})
+		// placeholder, patched once the whole function body is laid out
+		g.emitOperand(0, wide)
+		if inst.Opcode != vm.JMP && inst.Opcode != vm.TRY && inst.Opcode != vm.FORITER {
+			value, enum, err := g.comparand(inst)
+			if err != nil {
+				return err
+			}
+			if enum != "" {
+				g.enumUses = append(g.enumUses, enumUse{address: start, enum: enum})
+			}
+			if index, pooled := g.constantIndex[value]; pooled {
+				// switch to the pooled form, the opcode follows the WIDE
+				// prefix if there is one
+				opcodeAt := start
+				if wide {
+					opcodeAt++
+				}
+				g.bytecode[opcodeAt] = byte(pooledJumps[inst.Opcode])
+				g.emitByte(index)
+			} else {
+				g.emitUint32(value)
+			}
+		}
+	case vm.STRALLOC:
+		if len(inst.Operands) != 1 {
+			return fmt.Errorf("stralloc requires one operand, got %d", len(inst.Operands))
+		}
+		str := inst.Operands[0]
+		g.emitUint16(uint16(len(str.Literal)))
+		g.bytecode = append(g.bytecode, []byte(str.Literal)...)
+	case vm.SYSCALL:
+		if len(inst.Operands) != 1 {
+			return fmt.Errorf("syscall requires one operand(syscall number or name), got %d", len(inst.Operands))
+		}
+		syscall, err := strconv.ParseUint(inst.Operands[0].Literal, 10, 16)
+		if err != nil {
+			return fmt.Errorf("invalid syscall number: %s", inst.Operands[0].Literal)
+		}
+		g.emitUint16(uint16(syscall))
+	case vm.NEWARR:
+		if len(inst.Operands) != 1 {
+			return fmt.Errorf("newarr requires one operand, got %d", len(inst.Operands))
+		}
+		typeToken := inst.Operands[0]
+		if typeToken.Type == INT32 {
+			g.emitByte(byte(ValueInt32))
+		} else if typeToken.Type == FLOAT32 {
+			g.emitByte(byte(ValueFloat32))
+		} else if typeToken.Type == BYTE_TYPE {
+			g.emitByte(byte(ValueByte))
+		} else {
+			return fmt.Errorf("unsupported type in newarr: %v", typeToken.Type)
+		}
+	case vm.NEWSTRUCT:
+		if len(inst.Operands) != 1 {
+			return fmt.Errorf("newstruct requires one operand, got %d", len(inst.Operands))
+		}
+		structName := inst.Operands[0].Literal
+		if _, exists := g.structTable[structName]; !exists {
+			return fmt.Errorf("undefined struct: %s", structName)
+		}
+		g.emitString(structName)
+	case vm.MAKECLOSURE:
+		if len(inst.Operands) != 2 {
+			return fmt.Errorf("makeclosure requires two operands, got %d", len(inst.Operands))
+		}
+		funcName := inst.Operands[0].Literal
+		funcIndex, exists := g.functionIndex[funcName]
+		if !exists {
+			return fmt.Errorf("undefined function: %s", funcName)
+		}
+		captures, err := parseInt32(inst.Operands[1].Literal)
+		if err != nil {
+			return err
+		}
+		if params := len(g.program.Functions[funcIndex].Params); captures < 0 || int(captures) > params || captures > math.MaxUint8 {
+			return fmt.Errorf("makeclosure captures %d values for %s, which takes %d parameters", captures, funcName, params)
+		}
+		g.emitOperand(funcIndex, wide)
+		g.emitByte(byte(captures))
+	case vm.INVOKEINTERFACE:
+		if len(inst.Operands) != 1 {
+			return fmt.Errorf("invokeinterface requires one operand, got %d", len(inst.Operands))
+		}
+		method, err := g.interfaceMethod(inst.Operands[0].Literal)
+		if err != nil {
+			return err
+		}
+		if len(method.Params) > math.MaxUint8 {
+			return fmt.Errorf("method %s has %d parameters, at most %d can be passed", method.Name, len(method.Params), math.MaxUint8)
+		}
+		g.emitString(method.Name)
+		g.emitByte(byte(len(method.Params)))
+		g.emitByte(byte(method.ReturnType))
+	case vm.CHECKCAST, vm.INSTANCEOF:
+		if len(inst.Operands) == 0 {
+			return fmt.Errorf("%v requires a type operand", inst.Opcode)
+		}
+		typeToken := inst.Operands[0]
+		if len(inst.Operands) == 2 {
+			if typeToken.Type != INT32 && typeToken.Type != FLOAT32 && typeToken.Type != STRING_TYPE {
+				return fmt.Errorf("unsupported array element type in %v: %s", inst.Opcode, typeToken.Literal)
+			}
+			g.emitByte(byte(ValueArray))
+			g.emitByte(byte(TokenTypeToValueKind(typeToken.Type)))
+		} else if typeToken.Type == STRING_TYPE {
+			g.emitByte(byte(ValueString))
+		} else {
+			if _, exists := g.structTable[typeToken.Literal]; !exists {
+				return fmt.Errorf("undefined struct: %s", typeToken.Literal)
+			}
+			g.emitByte(byte(ValueStruct))
+			g.emitString(typeToken.Literal)
+		}
+	case vm.STFIELD, vm.FLDGET:
+		if len(inst.Operands) != 1 {
+			return fmt.Errorf("field access requires one operand, got %d", len(inst.Operands))
+		}
+		fieldName := inst.Operands[0].Literal
+		fieldID, exists := g.fieldIDs[fieldName]
+		if !exists {
+			return fmt.Errorf("undefined field: %s", fieldName)
+		}
+		g.emitUint16(fieldID)
+	case vm.LDELEM, vm.STELEM, vm.SLICE, vm.ARR_CLONE:
+	case vm.ALLOC:
+		// ALLOC takes no explicit operands - it uses the value on top of the stack
+	case vm.FREE:
+		// FREE takes no explicit operands - it uses the value on top of the stack
+	case vm.LOADH:
+		// LOADH takes no explicit operands - it uses the value on top of the stack
+	case vm.STOREH:
+		// STOREH takes no explicit operands - it uses values on top of the stack
+	case vm.POP:
+		// POP takes no operands
+	case vm.DUP:
+		// DUP takes no operands
+	case vm.IADD, vm.ISUB, vm.IMUL, vm.IDIV,
+		vm.FADD, vm.FSUB, vm.FMUL, vm.FDIV:
+		// Arithmetic operations take no operands
+	case vm.EQ, vm.NE, vm.LT, vm.LE, vm.GT, vm.GE:
+		// Comparison operations take no operands
+	default:
+		if info, ok := vm.LookupOpcode(inst.Opcode); ok && inst.Opcode >= vm.FirstExtension {
+			return g.generateExtension(info, inst.Operands)
+		}
+	}
+	return nil
+}
+
+// generateExtension encodes the operands of an extension instruction in the
+// order its definition lists them
+func (g *CodeGenerator) generateExtension(info vm.OpcodeInfo, operands []Token) error {
+	if len(operands) != len(info.Operands) {
+		return fmt.Errorf("%s requires %d operands, got %d", info.Mnemonic, len(info.Operands), len(operands))
+	}
+	for i, operand := range info.Operands {
+		token := operands[i]
+		switch operand.Type {
+		case vm.OperandByte, vm.OperandU16, vm.OperandIndex:
+			limit := int64(math.MaxUint16)
+			if operand.Type == vm.OperandByte {
+				limit = math.MaxUint8
+			}
+			value, err := strconv.ParseInt(token.Literal, 10, 64)
+			if err != nil || value < 0 || value > limit {
+				return fmt.Errorf("%s: %s operand %s out of range: %s", info.Mnemonic, operand.Type, operand.Name, token.Literal)
+			}
+			if operand.Type == vm.OperandByte {
+				g.emitByte(byte(value))
+			} else {
+				g.emitUint16(uint16(value))
+			}
+		case vm.OperandInt32:
+			value, err := parseInt32(token.Literal)
+			if err != nil {
+				return err
+			}
+			g.emitInt32(value)
+		case vm.OperandFloat32:
+			value, err := parseFloat32(token.Literal)
+			if err != nil {
+				return err
+			}
+			g.emitFloat32(value)
+		case vm.OperandKind:
+			if token.Type == BYTE_TYPE {
+				g.emitByte(byte(ValueByte))
+			} else {
+				g.emitByte(byte(TokenTypeToValueKind(token.Type)))
+			}
+		case vm.OperandString:
+			if strings.IndexByte(token.Literal, 0) >= 0 {
+				return fmt.Errorf("%s: string operand %s holds a NUL byte", info.Mnemonic, operand.Name)
+			}
+			g.emitString(token.Literal)
+		}
+	}
+	return nil
+}
+
+// needsWide reports whether the instruction's address/index operand needs
+// the 4-byte WIDE encoding.
+func (g *CodeGenerator) needsWide(inst Instruction) (bool, error) {
+	switch inst.Opcode {
+	case vm.STORE, vm.LOAD:
+		if len(inst.Operands) != 1 {
+			return false, nil
+		}
+		addr, err := parseInt32(inst.Operands[0].Literal)
+		if err != nil {
+			return false, err
+		}
+		return addr > math.MaxUint16, nil
+	case vm.CALL, vm.MAKECLOSURE:
+		if len(inst.Operands) == 0 {
+			return false, nil
+		}
+		return g.functionIndex[inst.Operands[0].Literal] > math.MaxUint16, nil
+	case vm.JMP, vm.IJE, vm.IJNE, vm.FJE, vm.FJNE, vm.TRY, vm.FORITER:
+		return g.wideJumps[g.currentSite], nil
+	}
+	return false, nil
+}
+
+func (g *CodeGenerator) emitOperand(value uint32, wide bool) {
+	if wide {
+		g.emitUint32(value)
+	} else {
+		g.emitUint16(uint16(value))
+	}
+}
+
+func (g *CodeGenerator) emitUint32(value uint32) {
+	g.bytecode = binary.BigEndian.AppendUint32(g.bytecode, value)
+}
+
+func (g *CodeGenerator) emitByte(b byte) {
+	g.bytecode = append(g.bytecode, b)
+}
+
+func (g *CodeGenerator) emitBytes(b []byte) {
+	g.bytecode = append(g.bytecode, b...)
+}
+
+func (g *CodeGenerator) emitString(s string) {
+	g.bytecode = append(g.bytecode, []byte(s)...)
+	g.emitByte(0)
+}
+
+func (g *CodeGenerator) emitRawString(s string) {
+	g.bytecode = append(g.bytecode, []byte(s)...)
+}
+
+func (g *CodeGenerator) emitInt32(value int32) {
+	g.bytecode = binary.BigEndian.AppendUint32(g.bytecode, uint32(value))
+}
+
+func (g *CodeGenerator) emitFloat32(value float32) {
+	g.bytecode = binary.BigEndian.AppendUint32(g.bytecode, math.Float32bits(value))
+}
+
+func (g *CodeGenerator) emitUint16(value uint16) {
+	g.bytecode = binary.BigEndian.AppendUint16(g.bytecode, value)
+}
+
+func parseInt32(literal string) (int32, error) {
+	var i int64
+	var err error
+	if i, err = strconv.ParseInt(literal, 10, 32); err != nil {
+		return 0, fmt.Errorf("invalid integer: %s", literal)
+	}
+	return int32(i), nil
+}
+
+// parseFloat32 parses a float32 literal as strconv does, whatever the
+// locale of the host: a decimal with an optional fraction and exponent, or
+// a hex float such as 0x1.8p3. The whole literal must be a number, and
+// infinities and NaN aren't literals.
+func parseFloat32(literal string) (float32, error) {
+	value, err := strconv.ParseFloat(literal, 32)
+	if errors.Is(err, strconv.ErrRange) {
+		return 0, fmt.Errorf("float out of range: %s: %w", literal, strconv.ErrRange)
+	}
+	if err != nil || math.IsInf(value, 0) || math.IsNaN(value) {
+		return 0, fmt.Errorf("invalid float: %s", literal)
+	}
+	return float32(value), nil
+}
@@ -0,0 +1,77 @@
+package asm
+
+import (
+	"bytes"
+	"fmt"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// generatedSource builds a program with many functions that call and jump
+// around, similar in shape to the output of a code generating front-end.
+func generatedSource(functions, bodySize int) string {
+	var sb strings.Builder
+	sb.WriteString(".structs\n    struct Point {\n        x: int32\n        y: int32\n    }\n.text\n")
+	for i := 0; i < functions; i++ {
+		fmt.Fprintf(&sb, "    func f%d(a: int32) -> int32 {\n", i)
+		sb.WriteString("    top:\n")
+		for j := 0; j < bodySize; j++ {
+			sb.WriteString("        push int32 1\n        iadd\n        dup\n        ije top 100\n")
+		}
+		if i+1 < functions {
+			fmt.Fprintf(&sb, "        call f%d\n", i+1)
+		}
+		sb.WriteString("        ret\n    }\n")
+	}
+	sb.WriteString("    func main() -> void {\n        push int32 0\n        call f0\n        ret\n    }\n")
+	return sb.String()
+}
+
+func parseSource(tb testing.TB, source string) *Program {
+	tb.Helper()
+	program, err := NewParser(NewLexer(source)).Parse()
+	if err != nil {
+		tb.Fatalf("Failed to parse program: %v", err)
+	}
+	return program
+}
+
+func generateWith(tb testing.TB, program *Program, workers int) []byte {
+	tb.Helper()
+	generator := NewCodeGenerator(program)
+	generator.workers = workers
+	bytecode, err := generator.Generate()
+	if err != nil {
+		tb.Fatalf("Failed to generate bytecode: %v", err)
+	}
+	return bytecode
+}
+
+// TestParallelGenerationMatchesSequential tests that concurrent assembly
+// produces byte-identical output, including widened jumps past 64KB
+func TestParallelGenerationMatchesSequential(t *testing.T) {
+	program := parseSource(t, generatedSource(300, 20))
+
+	sequential := generateWith(t, program, 1)
+	parallel := generateWith(t, program, 8)
+
+	if len(sequential) <= 0xFFFF {
+		t.Fatalf("Expected a program larger than 64KB, got %d bytes", len(sequential))
+	}
+	if !bytes.Equal(sequential, parallel) {
+		t.Fatal("Parallel and sequential code generation differ")
+	}
+}
+
+func benchmarkGenerate(b *testing.B, workers int) {
+	program := parseSource(b, generatedSource(2000, 20))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		generateWith(b, program, workers)
+	}
+}
+
+func BenchmarkGenerateSequential(b *testing.B) { benchmarkGenerate(b, 1) }
+
+func BenchmarkGenerateParallel(b *testing.B) { benchmarkGenerate(b, runtime.GOMAXPROCS(0)) }
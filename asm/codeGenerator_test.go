@@ -0,0 +1,1224 @@
+package asm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AndreiAlbert/gvm/bytecode"
+	. "github.com/AndreiAlbert/gvm/common"
+	"github.com/AndreiAlbert/gvm/vm"
+)
+
+// Helper function to create a parsed program for testing
+func createTestProgram() *Program {
+	return &Program{
+		Structs:   []StructType{},
+		Functions: []ParsedFunction{},
+	}
+}
+
+// Helper function to add a struct to a test program
+func addTestStruct(prog *Program, name string, fields ...StructField) {
+	structType := StructType{
+		Name:    name,
+		Fields:  fields,
+		Methods: make(map[string]uint),
+	}
+	prog.Structs = append(prog.Structs, structType)
+}
+
+// Helper function to add a function to a test program
+func addTestFunction(prog *Program, name string, returnType ValueKind, params []ParsedParam,
+	instructions []Instruction, labels map[string]int) {
+	function := ParsedFunction{
+		Name:       name,
+		ReturnType: returnType,
+		Params:     params,
+		Body:       instructions,
+		Labels:     labels,
+	}
+	prog.Functions = append(prog.Functions, function)
+}
+
+// Helper to extract bytes from bytecode at a specific position
+func bytesAt(bytecode []byte, start, length int) []byte {
+	if start+length > len(bytecode) {
+		return bytecode[start:]
+	}
+	return bytecode[start : start+length]
+}
+
+// Helper to create a token for testing
+func createToken(tokenType TokenType, literal string) Token {
+	return Token{
+		Type:    tokenType,
+		Literal: literal,
+		Line:    1,
+		Column:  1,
+	}
+}
+
+// Helper to create an instruction for testing
+func createInstruction(opcode vm.Opcode, operands ...Token) Instruction {
+	return Instruction{
+		Token:    Token{Type: IDENT, Literal: "test"},
+		Opcode:   opcode,
+		Operands: operands,
+	}
+}
+
+// TestEmptyProgram tests generating bytecode for an empty program
+func TestEmptyProgram(t *testing.T) {
+	prog := createTestProgram()
+
+	generator := NewCodeGenerator(prog)
+	bytecode, err := generator.Generate()
+
+	if err != nil {
+		t.Fatalf("Expected no error for empty program, got: %v", err)
+	}
+
+	if len(bytecode) != 1 {
+		t.Fatalf("Expected empty bytecode for empty program, got %d bytes", len(bytecode))
+	}
+}
+
+// TestBasicStructDefinition tests generating bytecode for a struct definition
+func TestBasicStructDefinition(t *testing.T) {
+	prog := createTestProgram()
+
+	// Add a simple Point struct
+	addTestStruct(prog, "Point",
+		StructField{Name: "x", Type: ValueInt32, Offset: 0},
+		StructField{Name: "y", Type: ValueInt32, Offset: 4},
+	)
+
+	generator := NewCodeGenerator(prog)
+	bytecode, err := generator.Generate()
+
+	if err != nil {
+		t.Fatalf("Failed to generate bytecode: %v", err)
+	}
+
+	// Check that the bytecode begins with a DEFSTRUCT opcode
+	if len(bytecode) == 0 || bytecode[0] != byte(vm.DEFSTRUCT) {
+		t.Fatal("Expected bytecode to start with DEFSTRUCT opcode")
+	}
+
+	// Check that the struct name is encoded correctly
+	nameBytes := []byte("Point\x00") // Name followed by null terminator
+	if !bytes.Contains(bytecode, nameBytes) {
+		t.Fatalf("Expected struct name 'Point' in bytecode, not found")
+	}
+}
+
+// TestEmptyFunction tests generating bytecode for an empty function
+func TestEmptyFunction(t *testing.T) {
+	prog := createTestProgram()
+
+	// Add an empty main function
+	addTestFunction(prog, "main", ValueVoid, []ParsedParam{}, []Instruction{}, map[string]int{})
+
+	generator := NewCodeGenerator(prog)
+	bytecode, err := generator.Generate()
+
+	if err != nil {
+		t.Fatalf("Failed to generate bytecode: %v", err)
+	}
+
+	// Check that the bytecode begins with a FUNC opcode
+	if len(bytecode) == 0 || bytecode[0] != byte(vm.FUNC) {
+		t.Fatal("Expected bytecode to start with FUNC opcode")
+	}
+
+	// Check that the function is marked as MAIN
+	if len(bytecode) < 2 || bytecode[1] != byte(vm.FUNC_MAIN) {
+		t.Fatal("Expected main function marker")
+	}
+}
+
+// TestPushInstruction tests generating bytecode for push instructions
+func TestPushInstruction(t *testing.T) {
+	prog := createTestProgram()
+
+	// Create a function with push instructions
+	instructions := []Instruction{
+		createInstruction(vm.PUSH,
+			createToken(INT32, "int32"),
+			createToken(INT, "42")),
+		createInstruction(vm.PUSH,
+			createToken(FLOAT32, "float32"),
+			createToken(FLOAT, "3.14")),
+	}
+
+	addTestFunction(prog, "main", ValueVoid, []ParsedParam{}, instructions, map[string]int{})
+
+	generator := NewCodeGenerator(prog)
+	bytecode, err := generator.Generate()
+
+	if err != nil {
+		t.Fatalf("Failed to generate bytecode: %v", err)
+	}
+
+	// Find position after function header
+	funcHeaderSize := 5 // FUNC(1) + FUNC_TYPE(1) + PARAM_COUNT(2) + RETURN_TYPE(1)
+	codeStart := funcHeaderSize
+
+	// Check first push instruction
+	if bytecode[codeStart] != byte(vm.PUSH) {
+		t.Fatalf("Expected PUSH opcode at position %d, got %d", codeStart, bytecode[codeStart])
+	}
+
+	// Check that the type is int32
+	if bytecode[codeStart+1] != byte(ValueInt32) {
+		t.Fatalf("Expected int32 type after PUSH, got %d", bytecode[codeStart+1])
+	}
+
+	// Check the value 42
+	intBytes := bytesAt(bytecode, codeStart+2, 4)
+	value := binary.BigEndian.Uint32(intBytes)
+	if int32(value) != 42 {
+		t.Fatalf("Expected value 42, got %d", int32(value))
+	}
+
+	// Check second push instruction
+	pushFloatPos := codeStart + 6 // PUSH(1) + TYPE(1) + VALUE(4)
+	if bytecode[pushFloatPos] != byte(vm.PUSH) {
+		t.Fatalf("Expected second PUSH opcode at position %d, got %d",
+			pushFloatPos, bytecode[pushFloatPos])
+	}
+
+	// Check that the type is float32
+	if bytecode[pushFloatPos+1] != byte(ValueFloat32) {
+		t.Fatalf("Expected float32 type, got %d", bytecode[pushFloatPos+1])
+	}
+
+	// Check the value 3.14
+	floatBytes := bytesAt(bytecode, pushFloatPos+2, 4)
+	floatBits := binary.BigEndian.Uint32(floatBytes)
+	floatValue := math.Float32frombits(floatBits)
+	if floatValue != 3.14 {
+		t.Fatalf("Expected value 3.14, got %f", floatValue)
+	}
+}
+
+// TestArithmeticInstructions tests generating bytecode for arithmetic instructions
+func TestArithmeticInstructions(t *testing.T) {
+	prog := createTestProgram()
+
+	// Create a function with arithmetic instructions
+	instructions := []Instruction{
+		createInstruction(vm.IADD),
+		createInstruction(vm.ISUB),
+		createInstruction(vm.IMUL),
+		createInstruction(vm.IDIV),
+		createInstruction(vm.FADD),
+		createInstruction(vm.FSUB),
+		createInstruction(vm.FMUL),
+		createInstruction(vm.FDIV),
+	}
+
+	addTestFunction(prog, "main", ValueVoid, []ParsedParam{}, instructions, map[string]int{})
+
+	generator := NewCodeGenerator(prog)
+	bytecode, err := generator.Generate()
+
+	if err != nil {
+		t.Fatalf("Failed to generate bytecode: %v", err)
+	}
+
+	// Find position after function header
+	funcHeaderSize := 5 // FUNC(1) + FUNC_TYPE(1) + PARAM_COUNT(2) + RETURN_TYPE(1)
+	codeStart := funcHeaderSize
+
+	// Check that each arithmetic instruction is encoded correctly
+	expectedOpcodes := []vm.Opcode{
+		vm.IADD, vm.ISUB, vm.IMUL, vm.IDIV,
+		vm.FADD, vm.FSUB, vm.FMUL, vm.FDIV,
+	}
+
+	for i, opcode := range expectedOpcodes {
+		pos := codeStart + i
+		if pos >= len(bytecode) {
+			t.Fatalf("Bytecode too short, expected opcode at position %d", pos)
+		}
+		if bytecode[pos] != byte(opcode) {
+			t.Errorf("Expected opcode %v at position %d, got %v",
+				opcode, pos, vm.Opcode(bytecode[pos]))
+		}
+	}
+}
+
+// TestJumpInstructions tests generating bytecode for jump instructions
+func TestJumpInstructions(t *testing.T) {
+	prog := createTestProgram()
+
+	// Create a function with labels and jumps
+	labels := map[string]int{
+		"label1": 2, // Position of the third instruction
+	}
+
+	instructions := []Instruction{
+		createInstruction(vm.PUSH, createToken(INT32, "int32"), createToken(INT, "1")),
+		createInstruction(vm.JMP, createToken(IDENT, "label1")),
+		// This is where label1 points to:
+		createInstruction(vm.PUSH, createToken(INT32, "int32"), createToken(INT, "2")),
+		createInstruction(vm.IJE, createToken(IDENT, "label1"), createToken(INT, "42")),
+	}
+
+	addTestFunction(prog, "main", ValueVoid, []ParsedParam{}, instructions, labels)
+
+	generator := NewCodeGenerator(prog)
+	bytecode, err := generator.Generate()
+
+	if err != nil {
+		t.Fatalf("Failed to generate bytecode: %v", err)
+	}
+
+	// Find position after function header
+	funcHeaderSize := 5 // FUNC(1) + FUNC_TYPE(1) + PARAM_COUNT(2) + RETURN_TYPE(1)
+
+	// Skip first PUSH instruction
+	pushSize := 6 // PUSH(1) + TYPE(1) + VALUE(4)
+	jumpPos := funcHeaderSize + pushSize
+
+	// Check JMP instruction
+	if bytecode[jumpPos] != byte(vm.JMP) {
+		t.Fatalf("Expected JMP opcode, got %v", vm.Opcode(bytecode[jumpPos]))
+	}
+
+	// Check jump target (should be the address of the third instruction)
+	labelBytes := bytesAt(bytecode, jumpPos+1, 2)
+	labelAddr := binary.BigEndian.Uint16(labelBytes)
+	if int(labelAddr) != jumpPos+3 {
+		t.Fatalf("Expected jump to address %d, got %d", jumpPos+3, labelAddr)
+	}
+
+	// Find IJE instruction
+	ijePos := jumpPos + 3 + pushSize // JMP(1) + TARGET(2) + next PUSH(6)
+
+	// Check IJE instruction
+	if bytecode[ijePos] != byte(vm.IJE) {
+		t.Fatalf("Expected IJE opcode, got %v", vm.Opcode(bytecode[ijePos]))
+	}
+
+	// Check conditional jump value (should be 42)
+	valueBytes := bytesAt(bytecode, ijePos+3, 4) // IJE(1) + TARGET(2) + VALUE(4)
+	value := binary.BigEndian.Uint32(valueBytes)
+	if int32(value) != 42 {
+		t.Fatalf("Expected conditional value 42, got %d", int32(value))
+	}
+}
+
+// TestStringAllocation tests generating bytecode for string allocation
+func TestStringAllocation(t *testing.T) {
+	prog := createTestProgram()
+
+	// Create a function with string allocation
+	instructions := []Instruction{
+		createInstruction(vm.STRALLOC, createToken(STRING, "Hello, World!")),
+	}
+
+	addTestFunction(prog, "main", ValueVoid, []ParsedParam{}, instructions, map[string]int{})
+
+	generator := NewCodeGenerator(prog)
+	bytecode, err := generator.Generate()
+
+	if err != nil {
+		t.Fatalf("Failed to generate bytecode: %v", err)
+	}
+
+	// Find position after function header
+	funcHeaderSize := 5 // FUNC(1) + FUNC_TYPE(1) + PARAM_COUNT(2) + RETURN_TYPE(1)
+
+	// Check STRALLOC instruction
+	if bytecode[funcHeaderSize] != byte(vm.STRALLOC) {
+		t.Fatalf("Expected STRALLOC opcode, got %v", vm.Opcode(bytecode[funcHeaderSize]))
+	}
+
+	// Check string length (should be 13 for "Hello, World!")
+	lengthBytes := bytesAt(bytecode, funcHeaderSize+1, 2)
+	length := binary.BigEndian.Uint16(lengthBytes)
+	if int(length) != 13 {
+		t.Fatalf("Expected string length 13, got %d", length)
+	}
+
+	// Check string content
+	strStart := funcHeaderSize + 3 // STRALLOC(1) + LENGTH(2)
+	strBytes := bytesAt(bytecode, strStart, 13)
+	str := string(strBytes)
+	if str != "Hello, World!" {
+		t.Fatalf("Expected string 'Hello, World!', got '%s'", str)
+	}
+}
+
+// TestStructOperations tests generating bytecode for struct operations
+func TestStructOperations(t *testing.T) {
+	prog := createTestProgram()
+
+	// Add a Point struct
+	addTestStruct(prog, "Point",
+		StructField{Name: "x", Type: ValueInt32, Offset: 0},
+		StructField{Name: "y", Type: ValueInt32, Offset: 4},
+	)
+
+	// Create a function with struct operations
+	instructions := []Instruction{
+		createInstruction(vm.NEWSTRUCT, createToken(IDENT, "Point")),
+		createInstruction(vm.FLDGET, createToken(STRING, "x")),
+		createInstruction(vm.STFIELD, createToken(STRING, "y")),
+	}
+
+	addTestFunction(prog, "main", ValueVoid, []ParsedParam{}, instructions, map[string]int{})
+
+	generator := NewCodeGenerator(prog)
+	bytecode, err := generator.Generate()
+
+	if err != nil {
+		t.Fatalf("Failed to generate bytecode: %v", err)
+	}
+
+	// Skip struct definition and function header to find the code
+	structDefSize := 1 + len("Point") + 1 + 1 + // DEFSTRUCT(1) + "Point\0" + FIELD_COUNT(1)
+		len("x") + 1 + 1 + // "x\0" + TYPE(1)
+		len("y") + 1 + 1 // "y\0" + TYPE(1)
+
+	funcHeaderSize := 5 // FUNC(1) + FUNC_TYPE(1) + PARAM_COUNT(2) + RETURN_TYPE(1)
+	codeStart := structDefSize + funcHeaderSize
+
+	// Check NEWSTRUCT instruction
+	if bytecode[codeStart] != byte(vm.NEWSTRUCT) {
+		t.Fatalf("Expected NEWSTRUCT opcode, got %v", vm.Opcode(bytecode[codeStart]))
+	}
+
+	// Check struct name
+	pos := codeStart + 1
+	if !bytes.Contains(bytecode[pos:], []byte("Point\x00")) {
+		t.Fatalf("Expected struct name 'Point' in bytecode")
+	}
+
+	// Find remaining instructions (positions depend on string lengths)
+	bytecodeHex := hex.EncodeToString(bytecode)
+
+	// Check for FLDGET, fields are referenced by id: "x" is field 0
+	fldgetHex := hex.EncodeToString([]byte{byte(vm.FLDGET), 0x00, 0x00})
+	if !strings.Contains(bytecodeHex, fldgetHex) {
+		t.Fatalf("FLDGET instruction or field id not found in bytecode")
+	}
+
+	// Check for STFIELD, "y" is field 1
+	stfieldHex := hex.EncodeToString([]byte{byte(vm.STFIELD), 0x00, 0x01})
+	if !strings.Contains(bytecodeHex, stfieldHex) {
+		t.Fatalf("STFIELD instruction or field id not found in bytecode")
+	}
+
+	// Field names must not be inlined in the code anymore
+	if bytes.Contains(bytecode[codeStart:], []byte("x\x00")) {
+		t.Fatalf("Field name 'x' should only appear in the struct section")
+	}
+}
+
+// TestCompleteProgram tests generating bytecode for a complete program
+func TestCompleteProgram(t *testing.T) {
+	source := `.structs
+		struct Point {
+			x: int32
+			y: int32
+		}
+	.text
+		func calculateSum(a: int32, b: int32) -> int32 {
+			iadd
+			ret
+		}
+		
+		func main() -> void {
+			push int32 10
+			push int32 20
+			call calculateSum
+			ret
+		}`
+
+	lexer := NewLexer(source)
+	parser := NewParser(lexer)
+	program, err := parser.Parse()
+
+	if err != nil {
+		t.Fatalf("Failed to parse program: %v", err)
+	}
+
+	generator := NewCodeGenerator(program)
+	bytecode, err := generator.Generate()
+
+	if err != nil {
+		t.Fatalf("Failed to generate bytecode: %v", err)
+	}
+
+	// Basic validation: ensure we got some bytecode
+	if len(bytecode) == 0 {
+		t.Fatal("Generated bytecode is empty")
+	}
+
+	// Verify DEFSTRUCT is present
+	if !bytes.Contains(bytecode, []byte{byte(vm.DEFSTRUCT)}) {
+		t.Error("DEFSTRUCT opcode not found in bytecode")
+	}
+
+	// Verify both functions are present - look for their headers
+	funcCount := bytes.Count(bytecode, []byte{byte(vm.FUNC)})
+	if funcCount != 2 {
+		t.Errorf("Expected 2 function definitions, found %d", funcCount)
+	}
+
+	// Verify arithmetic, push, call, and ret instructions are present
+	opcodes := []vm.Opcode{vm.IADD, vm.PUSH, vm.CALL, vm.RET}
+	for _, op := range opcodes {
+		if !bytes.Contains(bytecode, []byte{byte(op)}) {
+			t.Errorf("Opcode %v not found in bytecode", op)
+		}
+	}
+}
+
+// TestCallEncodesFunctionIndex tests that CALL references the function table
+// by index, including calls to functions defined later in the program
+func TestCallEncodesFunctionIndex(t *testing.T) {
+	prog := createTestProgram()
+
+	addTestFunction(prog, "main", ValueVoid, []ParsedParam{},
+		[]Instruction{createInstruction(vm.CALL, createToken(IDENT, "helper"))}, map[string]int{})
+	addTestFunction(prog, "helper", ValueVoid, []ParsedParam{}, []Instruction{}, map[string]int{})
+
+	generator := NewCodeGenerator(prog)
+	bytecode, err := generator.Generate()
+
+	if err != nil {
+		t.Fatalf("Failed to generate bytecode: %v", err)
+	}
+
+	funcHeaderSize := 5 // FUNC(1) + FUNC_TYPE(1) + PARAM_COUNT(2) + RETURN_TYPE(1)
+	if bytecode[funcHeaderSize] != byte(vm.CALL) {
+		t.Fatalf("Expected CALL opcode, got %v", vm.Opcode(bytecode[funcHeaderSize]))
+	}
+
+	index := binary.BigEndian.Uint16(bytesAt(bytecode, funcHeaderSize+1, 2))
+	if index != 1 {
+		t.Fatalf("Expected call to function index 1, got %d", index)
+	}
+}
+
+// TestErrorStructAddedWhenUsed tests that the built-in Error struct is only
+// added to programs that use error values
+func TestErrorStructAddedWhenUsed(t *testing.T) {
+	plain := createTestProgram()
+	addTestFunction(plain, "main", ValueVoid, []ParsedParam{}, []Instruction{}, map[string]int{})
+	program, err := NewCodeGenerator(plain).GenerateProgram()
+	if err != nil {
+		t.Fatalf("Failed to generate program: %v", err)
+	}
+	if len(program.Structs) != 0 {
+		t.Errorf("Expected no structs, got %v", program.Structs)
+	}
+
+	throwing := createTestProgram()
+	addTestStruct(throwing, "Point", StructField{Name: "x", Type: ValueInt32})
+	addTestFunction(throwing, "main", ValueVoid, []ParsedParam{}, []Instruction{
+		createInstruction(vm.SYSCALL, createToken(INT, "6")),
+		createInstruction(vm.FLDGET, createToken(STRING, "message")),
+	}, map[string]int{})
+	program, err = NewCodeGenerator(throwing).GenerateProgram()
+	if err != nil {
+		t.Fatalf("Failed to generate program: %v", err)
+	}
+	if len(program.Structs) != 2 || program.Structs[1].Name != ErrorStructName {
+		t.Fatalf("Expected Point followed by Error, got %v", program.Structs)
+	}
+	// declared fields keep their ids, the Error fields follow
+	if id := program.Structs[1].Fields[1].ID; id != 2 {
+		t.Errorf("Expected the message field to have id 2, got %d", id)
+	}
+
+	// a struct of the program with the field names of Error is no error
+	coded := createTestProgram()
+	addTestStruct(coded, "Reply", StructField{Name: "code", Type: ValueInt32}, StructField{Name: "message", Type: ValueString})
+	addTestFunction(coded, "main", ValueVoid, []ParsedParam{}, []Instruction{
+		createInstruction(vm.NEWSTRUCT, createToken(STRING, "Reply")),
+		createInstruction(vm.FLDGET, createToken(STRING, "message")),
+	}, map[string]int{})
+	program, err = NewCodeGenerator(coded).GenerateProgram()
+	if err != nil {
+		t.Fatalf("Failed to generate program: %v", err)
+	}
+	if len(program.Structs) != 1 {
+		t.Errorf("Expected only Reply, got %v", program.Structs)
+	}
+
+	reserved := createTestProgram()
+	addTestStruct(reserved, ErrorStructName, StructField{Name: "code", Type: ValueInt32})
+	addTestFunction(reserved, "main", ValueVoid, []ParsedParam{}, []Instruction{}, map[string]int{})
+	if _, err := NewCodeGenerator(reserved).GenerateProgram(); err == nil {
+		t.Error("Expected declaring struct Error to fail")
+	}
+}
+
+// TestDateTimeStructAddedWhenUsed tests that the built-in DateTime struct is
+// added to programs that use the time system calls
+func TestDateTimeStructAddedWhenUsed(t *testing.T) {
+	dating := createTestProgram()
+	addTestFunction(dating, "main", ValueVoid, []ParsedParam{}, []Instruction{
+		createInstruction(vm.SYSCALL, createToken(INT, "33")),
+		createInstruction(vm.FLDGET, createToken(STRING, "year")),
+	}, map[string]int{})
+	program, err := NewCodeGenerator(dating).GenerateProgram()
+	if err != nil {
+		t.Fatalf("Failed to generate program: %v", err)
+	}
+	if len(program.Structs) != 1 || program.Structs[0].Name != DateTimeStructName {
+		t.Fatalf("Expected DateTime, got %v", program.Structs)
+	}
+
+	timed := createTestProgram()
+	addTestStruct(timed, "Lap", StructField{Name: "second", Type: ValueInt32})
+	addTestFunction(timed, "main", ValueVoid, []ParsedParam{}, []Instruction{
+		createInstruction(vm.NEWSTRUCT, createToken(STRING, "Lap")),
+		createInstruction(vm.FLDGET, createToken(STRING, "second")),
+	}, map[string]int{})
+	program, err = NewCodeGenerator(timed).GenerateProgram()
+	if err != nil {
+		t.Fatalf("Failed to generate program: %v", err)
+	}
+	if len(program.Structs) != 1 {
+		t.Errorf("Expected only Lap, got %v", program.Structs)
+	}
+
+	reserved := createTestProgram()
+	addTestStruct(reserved, DateTimeStructName, StructField{Name: "year", Type: ValueInt32})
+	addTestFunction(reserved, "main", ValueVoid, []ParsedParam{}, []Instruction{}, map[string]int{})
+	if _, err := NewCodeGenerator(reserved).GenerateProgram(); err == nil {
+		t.Error("Expected declaring struct DateTime to fail")
+	}
+}
+
+func TestParseFloat32(t *testing.T) {
+	tests := []struct {
+		literal string
+		want    float32
+		fails   string
+	}{
+		{"3.14", 3.14, ""},
+		{"3", 3, ""},
+		{"0.5", 0.5, ""},
+		{"2.5e-3", 0.0025, ""},
+		{"1E5", 100000, ""},
+		{"1e+2", 100, ""},
+		{"0x1p-2", 0.25, ""},
+		{"0x1.8p3", 12, ""},
+		{"3.4028235e38", math.MaxFloat32, ""},
+		{"1e-50", 0, ""},
+		{"3.14abc", 0, "invalid float"},
+		{"3,14", 0, "invalid float"},
+		{"1e", 0, "invalid float"},
+		{"0x10", 0, "invalid float"},
+		{"", 0, "invalid float"},
+		{"inf", 0, "invalid float"},
+		{"NaN", 0, "invalid float"},
+		{"1e39", 0, "out of range"},
+		{"3.5e38", 0, "out of range"},
+	}
+	for _, tt := range tests {
+		got, err := parseFloat32(tt.literal)
+		if tt.fails != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.fails) {
+				t.Errorf("Expected %q to fail with %q, got %v, %v", tt.literal, tt.fails, got, err)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("Expected %q to parse as %v, got %v, %v", tt.literal, tt.want, got, err)
+		}
+	}
+}
+
+func TestTypeCheckOperands(t *testing.T) {
+	prog := createTestProgram()
+	addTestStruct(prog, "Point", StructField{Name: "x", Type: ValueInt32})
+	addTestFunction(prog, "main", ValueVoid, []ParsedParam{}, []Instruction{
+		createInstruction(vm.CHECKCAST, createToken(IDENT, "Point")),
+		createInstruction(vm.INSTANCEOF, createToken(INT32, "int32"), createToken(LBRACKET, "[")),
+		createInstruction(vm.INSTANCEOF, createToken(STRING_TYPE, "string")),
+	}, map[string]int{})
+	program, err := NewCodeGenerator(prog).GenerateProgram()
+	if err != nil {
+		t.Fatalf("Failed to generate program: %v", err)
+	}
+	want := []byte{
+		byte(vm.CHECKCAST), byte(ValueStruct), 'P', 'o', 'i', 'n', 't', 0,
+		byte(vm.INSTANCEOF), byte(ValueArray), byte(ValueInt32),
+		byte(vm.INSTANCEOF), byte(ValueString),
+	}
+	if !bytes.Contains(program.Code, want) {
+		t.Errorf("Expected the type operands %x in the code, got %x", want, program.Code)
+	}
+}
+
+func TestInvokeInterfaceOperands(t *testing.T) {
+	prog := createTestProgram()
+	prog.Interfaces = []Interface{{Name: "Shape", Methods: []InterfaceMethod{
+		{Name: "scale", Params: []ParsedParam{{Name: "factor", Type: ValueInt32}}, ReturnType: ValueFloat32},
+	}}}
+	addTestFunction(prog, "main", ValueVoid, []ParsedParam{}, []Instruction{
+		createInstruction(vm.INVOKEINTERFACE, createToken(IDENT, "Shape.scale")),
+	}, map[string]int{})
+	program, err := NewCodeGenerator(prog).GenerateProgram()
+	if err != nil {
+		t.Fatalf("Failed to generate program: %v", err)
+	}
+	want := []byte{byte(vm.INVOKEINTERFACE), 's', 'c', 'a', 'l', 'e', 0, 1, byte(ValueFloat32)}
+	if !bytes.Contains(program.Code, want) {
+		t.Errorf("Expected %x in the code, got %x", want, program.Code)
+	}
+
+	prog.Functions[0].Body[0] = createInstruction(vm.INVOKEINTERFACE, createToken(IDENT, "Shape.area"))
+	if _, err := NewCodeGenerator(prog).GenerateProgram(); err == nil || !strings.Contains(err.Error(), "has no method area") {
+		t.Errorf("Expected calling an undeclared method to fail, got %v", err)
+	}
+}
+
+func TestEnumConstants(t *testing.T) {
+	prog := createTestProgram()
+	prog.Enums = []Enum{
+		{Name: "Color", Members: []EnumMember{{"RED", 0}, {"GREEN", 1}}},
+		{Name: "Light", Members: []EnumMember{{"RED", 7}}},
+	}
+	addTestFunction(prog, "main", ValueVoid, []ParsedParam{}, []Instruction{
+		createInstruction(vm.PUSH, createToken(INT32, "int32"), createToken(IDENT, "GREEN")),
+		createInstruction(vm.PUSH, createToken(INT32, "int32"), createToken(IDENT, "Light.RED")),
+	}, map[string]int{})
+	program, err := NewCodeGenerator(prog).GenerateProgram()
+	if err != nil {
+		t.Fatalf("Failed to generate program: %v", err)
+	}
+	want := []byte{byte(vm.PUSH), byte(ValueInt32), 0, 0, 0, 1, byte(vm.PUSH), byte(ValueInt32), 0, 0, 0, 7}
+	if !bytes.Contains(program.Code, want) {
+		t.Errorf("Expected %x in the code, got %x", want, program.Code)
+	}
+	if len(program.Enums) != 2 || len(program.Enums[0].Constants) != 1 || len(program.Enums[1].Constants) != 1 {
+		t.Fatalf("Expected each enum to record one constant, got %+v", program.Enums)
+	}
+	if push := program.Enums[1].Constants[0]; program.Code[push] != byte(vm.PUSH) || program.Enums[0].Constants[0]+6 != push {
+		t.Errorf("Expected the constants to be at the addresses of the pushes, got %+v", program.Enums)
+	}
+
+	for operand, errSubstr := range map[string]string{
+		"RED":        "name it Color.RED",
+		"BLUE":       "undefined enum constant",
+		"Color.BLUE": "enum Color has no member BLUE",
+	} {
+		prog.Functions[0].Body[0] = createInstruction(vm.PUSH, createToken(INT32, "int32"), createToken(IDENT, operand))
+		if _, err := NewCodeGenerator(prog).GenerateProgram(); err == nil || !strings.Contains(err.Error(), errSubstr) {
+			t.Errorf("Expected pushing %s to fail with %q, got %v", operand, errSubstr, err)
+		}
+	}
+}
+
+func TestMakeClosureOperands(t *testing.T) {
+	prog := createTestProgram()
+	addTestFunction(prog, "add", ValueInt32, []ParsedParam{{Name: "base", Type: ValueInt32}, {Name: "x", Type: ValueInt32}}, []Instruction{
+		createInstruction(vm.RET),
+	}, map[string]int{})
+	addTestFunction(prog, "main", ValueVoid, []ParsedParam{}, []Instruction{
+		createInstruction(vm.MAKECLOSURE, createToken(IDENT, "add"), createToken(INT, "1")),
+		createInstruction(vm.CALLCLOSURE),
+	}, map[string]int{})
+	program, err := NewCodeGenerator(prog).GenerateProgram()
+	if err != nil {
+		t.Fatalf("Failed to generate program: %v", err)
+	}
+	want := []byte{byte(vm.MAKECLOSURE), 0, 0, 1, byte(vm.CALLCLOSURE)}
+	if !bytes.Contains(program.Code, want) {
+		t.Errorf("Expected %x in the code, got %x", want, program.Code)
+	}
+
+	prog.Functions[1].Body[0] = createInstruction(vm.MAKECLOSURE, createToken(IDENT, "add"), createToken(INT, "3"))
+	if _, err := NewCodeGenerator(prog).GenerateProgram(); err == nil || !strings.Contains(err.Error(), "which takes 2 parameters") {
+		t.Errorf("Expected capturing more values than add takes to fail, got %v", err)
+	}
+}
+
+func TestNativeCalls(t *testing.T) {
+	source := `
+.natives
+    native func log(s: string, level: int32) -> void
+.text
+    func main() -> void {
+        stralloc "hi"
+        push int32 1
+        call log
+        halt
+    }
+`
+	program, err := NewParser(NewLexer(source)).Parse()
+	if err != nil {
+		t.Fatalf("Failed to parse: %v", err)
+	}
+	generated, err := NewCodeGenerator(program).GenerateProgram()
+	if err != nil {
+		t.Fatalf("Failed to generate program: %v", err)
+	}
+	want := []bytecode.Native{{Name: "log", Params: []ValueKind{ValueString, ValueInt32}, ReturnType: ValueVoid}}
+	if !reflect.DeepEqual(generated.Natives, want) {
+		t.Errorf("Expected natives %+v, got %+v", want, generated.Natives)
+	}
+	if !bytes.Contains(generated.Code, []byte{byte(vm.CALLNATIVE), 0, 0, byte(vm.HALT)}) {
+		t.Errorf("Expected a CALLNATIVE of native 0 in the code, got %x", generated.Code)
+	}
+	if maxStack := generated.Functions[0].MaxStack; maxStack != 2 {
+		t.Errorf("Expected a max stack of 2, got %d", maxStack)
+	}
+
+	program.Functions = append(program.Functions, ParsedFunction{Name: "log", ReturnType: ValueVoid})
+	if _, err := NewCodeGenerator(program).GenerateProgram(); err == nil || !strings.Contains(err.Error(), "also declared as a function") {
+		t.Errorf("Expected a native named like a function to fail, got %v", err)
+	}
+}
+
+func TestAsyncNativeCalls(t *testing.T) {
+	source := `
+.natives
+    native async func fetch(url: string) -> string
+.text
+    func main() -> void {
+        stralloc "a"
+        call fetch
+        stralloc "b"
+        call fetch
+        await
+        pop
+        await
+        pop
+        halt
+    }
+`
+	program, err := NewParser(NewLexer(source)).Parse()
+	if err != nil {
+		t.Fatalf("Failed to parse: %v", err)
+	}
+	generated, err := NewCodeGenerator(program).GenerateProgram()
+	if err != nil {
+		t.Fatalf("Failed to generate program: %v", err)
+	}
+	if len(generated.Natives) != 1 || !generated.Natives[0].Async {
+		t.Errorf("Expected an async native, got %+v", generated.Natives)
+	}
+	// a handle and a string, then both handles
+	if maxStack := generated.Functions[0].MaxStack; maxStack != 2 {
+		t.Errorf("Expected a max stack of 2, got %d", maxStack)
+	}
+
+	program.Natives[0].ReturnType = ValueVoid
+	if _, err := NewCodeGenerator(program).GenerateProgram(); err == nil || !strings.Contains(err.Error(), "an awaited call needs a result") {
+		t.Errorf("Expected a void async native to fail, got %v", err)
+	}
+}
+
+func TestForIterOperands(t *testing.T) {
+	prog := createTestProgram()
+	addTestFunction(prog, "main", ValueVoid, []ParsedParam{}, []Instruction{
+		createInstruction(vm.FORITER, createToken(IDENT, "done")),
+		createInstruction(vm.JMP, createToken(IDENT, "loop")),
+		createInstruction(vm.HALT),
+	}, map[string]int{"loop": 0, "done": 2})
+	program, err := NewCodeGenerator(prog).GenerateProgram()
+	if err != nil {
+		t.Fatalf("Failed to generate program: %v", err)
+	}
+	// the function header is 5 bytes, FORITER and JMP 3 each
+	want := []byte{byte(vm.FORITER), 0, 11, byte(vm.JMP), 0, 5, byte(vm.HALT)}
+	if !bytes.Contains(program.Code, want) {
+		t.Errorf("Expected %x in the code, got %x", want, program.Code)
+	}
+}
+
+func TestConstantPool(t *testing.T) {
+	prog := createTestProgram()
+	var body []Instruction
+	for i := 0; i < 2; i++ {
+		body = append(body, createInstruction(vm.FJE, createToken(IDENT, "done"), createToken(FLOAT, "1.5")))
+	}
+	body = append(body, createInstruction(vm.HALT))
+	addTestFunction(prog, "main", ValueVoid, []ParsedParam{}, body, map[string]int{"done": len(body) - 1})
+	program, err := NewCodeGenerator(prog).GenerateProgram()
+	if err != nil {
+		t.Fatalf("Failed to generate program: %v", err)
+	}
+	if len(program.Constants) != 0 || program.Code[5] != byte(vm.FJE) {
+		t.Errorf("Expected two comparisons to keep their immediates, got pool %v and code %x", program.Constants, program.Code)
+	}
+
+	body = body[:len(body)-1]
+	for i := 0; i < 3; i++ {
+		body = append(body, createInstruction(vm.IJNE, createToken(IDENT, "done"), createToken(INT, "7")))
+	}
+	body = append(body, createInstruction(vm.FJE, createToken(IDENT, "done"), createToken(FLOAT, "1.5")))
+	body = append(body, createInstruction(vm.IJE, createToken(IDENT, "done"), createToken(INT, "8")))
+	body = append(body, createInstruction(vm.HALT))
+	prog.Functions[0].Body = body
+	prog.Functions[0].Labels["done"] = len(body) - 1
+	program, err = NewCodeGenerator(prog).GenerateProgram()
+	if err != nil {
+		t.Fatalf("Failed to generate program: %v", err)
+	}
+	if want := []uint32{math.Float32bits(1.5), 7}; !reflect.DeepEqual(program.Constants, want) {
+		t.Fatalf("Expected the pool %v, got %v", want, program.Constants)
+	}
+	// the function header is 5 bytes and the pooled jumps 4 each, the
+	// value used once keeps its immediate
+	var want []byte
+	for _, inst := range []struct {
+		opcode vm.Opcode
+		index  byte
+	}{{vm.FJEC, 0}, {vm.FJEC, 0}, {vm.IJNEC, 1}, {vm.IJNEC, 1}, {vm.IJNEC, 1}, {vm.FJEC, 0}} {
+		want = append(want, byte(inst.opcode), 0, 36, inst.index)
+	}
+	want = append(want, byte(vm.IJE), 0, 36, 0, 0, 0, 8, byte(vm.HALT))
+	if !bytes.Contains(program.Code, want) {
+		t.Errorf("Expected %x in the code, got %x", want, program.Code)
+	}
+}
+
+// TestWideOperands tests that operands beyond the uint16 range use the WIDE prefix
+func TestWideOperands(t *testing.T) {
+	prog := createTestProgram()
+
+	instructions := []Instruction{
+		createInstruction(vm.STORE, createToken(INT, "70000")),
+		createInstruction(vm.LOAD, createToken(INT, "7")),
+	}
+	addTestFunction(prog, "main", ValueVoid, []ParsedParam{}, instructions, map[string]int{})
+
+	generator := NewCodeGenerator(prog)
+	bytecode, err := generator.Generate()
+
+	if err != nil {
+		t.Fatalf("Failed to generate bytecode: %v", err)
+	}
+
+	funcHeaderSize := 5 // FUNC(1) + FUNC_TYPE(1) + PARAM_COUNT(2) + RETURN_TYPE(1)
+	if bytecode[funcHeaderSize] != byte(vm.WIDE) || bytecode[funcHeaderSize+1] != byte(vm.STORE) {
+		t.Fatalf("Expected WIDE STORE, got %v %v",
+			vm.Opcode(bytecode[funcHeaderSize]), vm.Opcode(bytecode[funcHeaderSize+1]))
+	}
+	addr := binary.BigEndian.Uint32(bytesAt(bytecode, funcHeaderSize+2, 4))
+	if addr != 70000 {
+		t.Fatalf("Expected local address 70000, got %d", addr)
+	}
+
+	loadPos := funcHeaderSize + 6 // WIDE(1) + STORE(1) + ADDR(4)
+	if bytecode[loadPos] != byte(vm.LOAD) {
+		t.Fatalf("Expected narrow LOAD, got %v", vm.Opcode(bytecode[loadPos]))
+	}
+}
+
+// TestWideJump tests that a jump to a label past 64KB is widened
+func TestWideJump(t *testing.T) {
+	prog := createTestProgram()
+
+	instructions := []Instruction{
+		createInstruction(vm.JMP, createToken(IDENT, "end")),
+	}
+	pushCount := 11000 // 6 bytes each, pushes "end" past 0xFFFF
+	for i := 0; i < pushCount; i++ {
+		instructions = append(instructions,
+			createInstruction(vm.PUSH, createToken(INT32, "int32"), createToken(INT, "1")))
+	}
+	labels := map[string]int{"end": len(instructions)}
+	addTestFunction(prog, "main", ValueVoid, []ParsedParam{}, instructions, labels)
+
+	generator := NewCodeGenerator(prog)
+	bytecode, err := generator.Generate()
+
+	if err != nil {
+		t.Fatalf("Failed to generate bytecode: %v", err)
+	}
+
+	funcHeaderSize := 5 // FUNC(1) + FUNC_TYPE(1) + PARAM_COUNT(2) + RETURN_TYPE(1)
+	if bytecode[funcHeaderSize] != byte(vm.WIDE) || bytecode[funcHeaderSize+1] != byte(vm.JMP) {
+		t.Fatalf("Expected WIDE JMP, got %v %v",
+			vm.Opcode(bytecode[funcHeaderSize]), vm.Opcode(bytecode[funcHeaderSize+1]))
+	}
+	target := binary.BigEndian.Uint32(bytesAt(bytecode, funcHeaderSize+2, 4))
+	expected := uint32(funcHeaderSize + 6 + pushCount*6) // WIDE JMP(6) + pushes
+	if target != expected {
+		t.Fatalf("Expected jump target %d, got %d", expected, target)
+	}
+	if bytecode[target] != byte(vm.HALT) {
+		t.Fatalf("Expected jump target to be the trailing HALT, got %v", vm.Opcode(bytecode[target]))
+	}
+}
+
+// TestInvalidInstructions tests error handling for invalid instructions
+func TestInvalidInstructions(t *testing.T) {
+	tests := []struct {
+		name        string
+		instruction Instruction
+		errSubstr   string
+	}{
+		{
+			name:        "push without operands",
+			instruction: createInstruction(vm.PUSH), // Missing type and value
+			errSubstr:   "two operands",
+		},
+		{
+			name:        "call with unknown function",
+			instruction: createInstruction(vm.CALL, createToken(IDENT, "nonexistent")),
+			errSubstr:   "undefined function",
+		},
+		{
+			name:        "jump to unknown label",
+			instruction: createInstruction(vm.JMP, createToken(IDENT, "nonexistent")),
+			errSubstr:   "undefined label",
+		},
+		{
+			name:        "newstruct with unknown struct",
+			instruction: createInstruction(vm.NEWSTRUCT, createToken(IDENT, "NonexistentStruct")),
+			errSubstr:   "undefined struct",
+		},
+		{
+			name:        "field access with unknown field",
+			instruction: createInstruction(vm.FLDGET, createToken(STRING, "nonexistent")),
+			errSubstr:   "undefined field",
+		},
+		{
+			name:        "invokeinterface with unknown interface",
+			instruction: createInstruction(vm.INVOKEINTERFACE, createToken(IDENT, "Shape.area")),
+			errSubstr:   "undefined interface",
+		},
+		{
+			name:        "makeclosure of unknown function",
+			instruction: createInstruction(vm.MAKECLOSURE, createToken(IDENT, "nonexistent"), createToken(INT, "0")),
+			errSubstr:   "undefined function",
+		},
+		{
+			name:        "checkcast with unknown struct",
+			instruction: createInstruction(vm.CHECKCAST, createToken(IDENT, "NonexistentStruct")),
+			errSubstr:   "undefined struct",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			prog := createTestProgram()
+			// Add a test function with the invalid instruction
+			instructions := []Instruction{test.instruction}
+			addTestFunction(prog, "main", ValueVoid, []ParsedParam{}, instructions, map[string]int{})
+
+			generator := NewCodeGenerator(prog)
+			_, err := generator.Generate()
+
+			// Should get an error
+			if err == nil {
+				t.Fatal("Expected error for invalid instruction, got nil")
+			}
+
+			// Error message should contain the expected substring
+			if !strings.Contains(err.Error(), test.errSubstr) {
+				t.Fatalf("Expected error containing '%s', got: %v", test.errSubstr, err)
+			}
+		})
+	}
+}
+
+func TestReplaceFunctionInRunningVM(t *testing.T) {
+	source := `.text
+    func main() -> void {
+        call work
+        store 1
+        call work
+        store 2
+        push int32 0
+        ret
+    }
+    func work() -> int32 {
+        jmp compute
+    compute:
+        push int32 %s
+        ret
+    }`
+	program, err := NewAssembler(strings.Replace(source, "%s", "1", 1)).Assemble()
+	if err != nil {
+		t.Fatal(err)
+	}
+	machine, err := vm.NewVmFromProgram(program, vm.Options{Stdout: io.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer machine.Close()
+	locals := machine.CallStack[0].Locals
+	for _, ok := locals[1]; !ok; _, ok = locals[1] {
+		if err := machine.Step(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	patch, err := NewAssembler(strings.Replace(source, "%s", "100", 1)).AssembleFunction("work", uint(len(machine.Bytecode)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(patch.Labels) != 1 || patch.Labels[0].Name != "compute" || patch.Labels[0].Address < uint32(len(machine.Bytecode)) {
+		t.Errorf("Expected the label of work at its new address, got %v", patch.Labels)
+	}
+	if err := machine.ReplaceFunction("work", patch); err != nil {
+		t.Fatal(err)
+	}
+	for _, ok := locals[2]; !ok; _, ok = locals[2] {
+		if err := machine.Step(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if locals[1].AsInt32() != 1 || locals[2].AsInt32() != 100 {
+		t.Errorf("Expected the second call to run the new body, got %v and %v", locals[1], locals[2])
+	}
+
+	changed := strings.Replace(strings.Replace(source, "%s", "1", 1), "work() -> int32", "work(a: int32) -> int32", 1)
+	patch, err = NewAssembler(changed).AssembleFunction("work", uint(len(machine.Bytecode)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := machine.ReplaceFunction("work", patch); err == nil {
+		t.Error("Expected a patch changing the signature of work to be refused")
+	}
+	if _, err := NewAssembler(strings.Replace(source, "%s", "1", 1)).AssembleFunction("missing", 0); err == nil {
+		t.Error("Expected assembling an undefined function to fail")
+	}
+}
+
+func TestFrameSizes(t *testing.T) {
+	source := `.text
+    func main() -> void {
+        push int32 2
+        push int32 3
+        call add
+        store 4
+    loop:
+        load 4
+        push int32 1
+        isub
+        dup
+        store 4
+        ijne loop 0
+        try failed
+        push int32 1
+        push int32 0
+        idiv
+        pop
+        endtry
+    failed:
+        pop
+        push int32 0
+        ret
+    }
+    func add(a: int32, b: int32) -> int32 {
+        iadd
+        ret
+    }
+    func grow() -> int32 {
+    top:
+        push int32 1
+        jmp top
+    }`
+	program, err := NewAssembler(source).Assemble()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][2]uint16{
+		// the arguments of add and the operands of idiv, the handler
+		// starts with the Error alone
+		"main": {2, 5},
+		"add":  {2, 0},
+		// a stack growing around a loop has no size
+		"grow": {0, 0},
+	}
+	for _, f := range program.Functions {
+		if got := [2]uint16{f.MaxStack, f.MaxLocals}; got != want[f.Name] {
+			t.Errorf("Expected %s to have max stack and locals %v, got %v", f.Name, want[f.Name], got)
+		}
+	}
+}
+
+func TestBuildInfo(t *testing.T) {
+	source := `.import "lib"
+    .text
+    func main() -> void {
+        push int32 0
+        ret
+    }`
+	assemble := func(library string, built time.Time) *bytecode.BuildInfo {
+		t.Helper()
+		assembler := NewAssembler(source)
+		assembler.SetImporter(func(string) (string, error) { return library, nil })
+		assembler.SetBuildTime(built)
+		program, err := assembler.Assemble()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return program.BuildInfo
+	}
+	info := assemble(".text", time.Time{})
+	if !strings.HasPrefix(info.Toolchain, "gvm ") || !info.Built.IsZero() {
+		t.Errorf("Expected a gvm toolchain and no build time, got %v", info)
+	}
+	if again := assemble(".text", time.Time{}); again.SourceHash != info.SourceHash {
+		t.Error("Expected the same source to hash the same")
+	}
+	// the hash covers the imported libraries
+	if edited := assemble(".text\n; edited", time.Unix(1700000000, 0)); edited.SourceHash == info.SourceHash || edited.Built.Unix() != 1700000000 {
+		t.Errorf("Expected editing the library to change the hash, got %v", edited)
+	}
+}
+
+func TestExtensionInstructions(t *testing.T) {
+	const scale vm.Opcode = 0xF0
+	err := vm.DefineExtension(vm.OpcodeInfo{
+		Opcode:   scale,
+		Name:     "FSCALE",
+		Mnemonic: "fscale",
+		Operands: []vm.Operand{{Name: "factor", Type: vm.OperandFloat32}, {Name: "unit", Type: vm.OperandString}},
+		Pops:     []string{"x"},
+		Pushes:   []string{"scaled"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	source := `
+.text
+    func main() -> void {
+        push float32 1.5
+        fscale 2 "m"
+        pop
+        halt
+    }
+`
+	program, err := NewParser(NewLexer(source)).Parse()
+	if err != nil {
+		t.Fatalf("Failed to parse: %v", err)
+	}
+	generated, err := NewCodeGenerator(program).GenerateProgram()
+	if err != nil {
+		t.Fatalf("Failed to generate program: %v", err)
+	}
+	if !bytes.Contains(generated.Code, []byte{byte(scale), 0x40, 0, 0, 0, 'm', 0, byte(vm.POP)}) {
+		t.Errorf("Expected fscale 2 \"m\" in the code, got %x", generated.Code)
+	}
+	if maxStack := generated.Functions[0].MaxStack; maxStack != 1 {
+		t.Errorf("Expected a max stack of 1, got %d", maxStack)
+	}
+
+	_, err = NewParser(NewLexer(strings.Replace(source, `"m"`, "3", 1))).Parse()
+	if err == nil || !strings.Contains(err.Error(), "fscale requires cstring operand unit") {
+		t.Errorf("Expected an operand of the wrong type to fail, got %v", err)
+	}
+}
@@ -0,0 +1,67 @@
+package asm
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+
+	. "github.com/AndreiAlbert/gvm/common"
+	"github.com/AndreiAlbert/gvm/vm"
+)
+
+// programStructs returns the structs declared by the program followed by
+// the built-in Error and DateTime structs when the program uses error
+// values or dates. Programs that use neither keep their struct table
+// unchanged.
+func programStructs(program *Program) ([]StructType, error) {
+	for _, structDef := range program.Structs {
+		switch structDef.Name {
+		case ErrorStructName:
+			return nil, fmt.Errorf("struct name %s is reserved for error values", ErrorStructName)
+		case DateTimeStructName:
+			return nil, fmt.Errorf("struct name %s is reserved for dates", DateTimeStructName)
+		}
+	}
+	var builtins []StructType
+	if usesBuiltinStruct(program, ErrorStruct(), vm.ERR_NEW, vm.ERR_WRAP) {
+		builtins = append(builtins, ErrorStruct())
+	}
+	if usesBuiltinStruct(program, DateTimeStruct(), vm.TIME_NOW_STRUCT, vm.TIME_FORMAT, vm.TIME_PARSE) {
+		builtins = append(builtins, DateTimeStruct())
+	}
+	if len(builtins) == 0 {
+		return program.Structs, nil
+	}
+	structs := append([]StructType(nil), program.Structs...)
+	return append(structs, builtins...), nil
+}
+
+// usesBuiltinStruct reports whether any instruction creates or inspects a
+// value of the built-in struct: a system call of calls or an instruction
+// naming the struct. Every instruction throwing or catching errors uses the
+// Error struct. Field names don't count, since a struct of the program may
+// have fields of the same names.
+func usesBuiltinStruct(program *Program, builtin StructType, calls ...vm.Systemcall) bool {
+	for _, function := range program.Functions {
+		for _, inst := range function.Body {
+			switch inst.Opcode {
+			case vm.THROW, vm.TRY:
+				if builtin.Name == ErrorStructName {
+					return true
+				}
+			case vm.SYSCALL:
+				if len(inst.Operands) == 1 {
+					n, _ := strconv.ParseUint(inst.Operands[0].Literal, 10, 16)
+					if n <= 0xFF && slices.Contains(calls, vm.Systemcall(n)) {
+						return true
+					}
+				}
+			case vm.NEWSTRUCT, vm.CHECKCAST, vm.INSTANCEOF:
+				if len(inst.Operands) == 1 && inst.Operands[0].Literal == builtin.Name {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,165 @@
+package asm
+
+import (
+	"strconv"
+
+	. "github.com/AndreiAlbert/gvm/common"
+	"github.com/AndreiAlbert/gvm/vm"
+)
+
+// frameSize computes the deepest the operand stack of f gets and the
+// number of locals it uses, by simulating the stack along every path of
+// the body. Where paths meet the deeper one is kept. maxStack is 0, for
+// unknown, when the depth keeps growing around a loop.
+func (g *CodeGenerator) frameSize(f *ParsedFunction) (maxStack, maxLocals uint16) {
+	locals := 0
+	for _, inst := range f.Body {
+		if inst.Opcode == vm.LOAD || inst.Opcode == vm.STORE {
+			if len(inst.Operands) == 1 {
+				if index, err := strconv.ParseUint(inst.Operands[0].Literal, 10, 16); err == nil && int(index) >= locals {
+					locals = int(index) + 1
+				}
+			}
+		}
+	}
+
+	// depth[i] is the deepest stack seen on entry to instruction i, -1
+	// before any path reaches it
+	depth := make([]int, len(f.Body)+1)
+	for i := range depth {
+		depth[i] = -1
+	}
+	// visits bounds how often a join is revisited with a deeper stack
+	visits := make([]int, len(f.Body)+1)
+	deepest := len(f.Params)
+	work := []int{0}
+	depth[0] = len(f.Params)
+	reach := func(i, d int) bool {
+		if d <= depth[i] {
+			return true
+		}
+		if visits[i]++; visits[i] > len(f.Body)+1 {
+			return false
+		}
+		depth[i] = d
+		work = append(work, i)
+		return true
+	}
+	for len(work) > 0 {
+		i := work[len(work)-1]
+		work = work[:len(work)-1]
+		if i == len(f.Body) {
+			continue
+		}
+		inst := f.Body[i]
+		pops, pushes := g.stackEffect(inst)
+		d := depth[i] - pops
+		if d < 0 {
+			d = 0
+		}
+		after := d + pushes
+		if after > deepest {
+			deepest = after
+		}
+		if d+1 > deepest && inst.Opcode == vm.TRY {
+			deepest = d + 1
+		}
+		target, jumps := -1, false
+		if len(inst.Operands) > 0 {
+			switch inst.Opcode {
+			case vm.JMP, vm.IJE, vm.IJNE, vm.FJE, vm.FJNE, vm.TRY, vm.FORITER:
+				target, jumps = f.Labels[inst.Operands[0].Literal]
+			}
+		}
+		ok := true
+		switch inst.Opcode {
+		case vm.RET, vm.RETV, vm.HALT, vm.THROW:
+		case vm.JMP:
+			if jumps {
+				ok = reach(target, after)
+			}
+		case vm.TRY:
+			// the handler starts with the Error on the stack of the TRY
+			ok = reach(i+1, after)
+			if jumps {
+				ok = ok && reach(target, after+1)
+			}
+		case vm.FORITER:
+			// an exhausted iteration jumps with the iterable and cursor
+			// popped
+			ok = reach(i+1, after)
+			if jumps {
+				ok = ok && reach(target, d)
+			}
+		default:
+			ok = reach(i+1, after)
+			if jumps {
+				ok = ok && reach(target, after)
+			}
+		}
+		if !ok {
+			return 0, uint16(locals)
+		}
+	}
+	if deepest > 0xffff {
+		return 0, uint16(locals)
+	}
+	return uint16(deepest), uint16(locals)
+}
+
+// stackEffect returns how many values inst pops and pushes. Calls of a
+// closure count as popping the closure alone, their callee being known at
+// run time only.
+func (g *CodeGenerator) stackEffect(inst Instruction) (pops, pushes int) {
+	info, _ := vm.LookupOpcode(inst.Opcode)
+	pops, pushes = len(info.Pops), len(info.Pushes)
+	result := func(returnType ValueKind) int {
+		if returnType == ValueVoid {
+			return 0
+		}
+		return 1
+	}
+	switch inst.Opcode {
+	case vm.CALL:
+		if len(inst.Operands) == 1 {
+			if index, ok := g.functionIndex[inst.Operands[0].Literal]; ok {
+				callee := g.program.Functions[index]
+				return len(callee.Params), result(callee.ReturnType)
+			}
+			if index, ok := g.nativeIndex[inst.Operands[0].Literal]; ok {
+				native := g.program.Natives[index]
+				if native.Async {
+					// the handle of the pending call
+					return len(native.Params), 1
+				}
+				return len(native.Params), result(native.ReturnType)
+			}
+		}
+	case vm.SYSCALL:
+		if len(inst.Operands) == 1 {
+			if number, err := strconv.ParseUint(inst.Operands[0].Literal, 10, 8); err == nil {
+				if in, out, ok := vm.Systemcall(number).Arity(); ok {
+					return in, out
+				}
+			}
+		}
+		return 0, 0
+	case vm.INVOKEINTERFACE:
+		if len(inst.Operands) == 1 {
+			if method, err := g.interfaceMethod(inst.Operands[0].Literal); err == nil {
+				return len(method.Params) + 1, result(method.ReturnType)
+			}
+		}
+	case vm.MAKECLOSURE:
+		if len(inst.Operands) == 2 {
+			if captures, err := parseInt32(inst.Operands[1].Literal); err == nil && captures >= 0 {
+				return int(captures), 1
+			}
+		}
+	case vm.CALLCLOSURE:
+		return 1, 1
+	case vm.FORITER:
+		return 2, 3
+	}
+	return pops, pushes
+}
@@ -0,0 +1,81 @@
+package asm
+
+import "fmt"
+
+// Importer returns the source of the library an .import directive names.
+// Libraries are assembly without a main function, conventionally in files
+// ending in .gvmlib.
+type Importer func(name string) (string, error)
+
+// SetImporter makes the assembler resolve .import directives with importer.
+// Without one, a program that imports fails to assemble.
+func (a *Assembler) SetImporter(importer Importer) {
+	a.importer = importer
+}
+
+// Imports returns the library names of the .import directives of source,
+// without parsing the rest of it, for tools that need the files a program
+// depends on before assembling it.
+func Imports(source string) []string {
+	var names []string
+	l := NewLexer(source)
+	for tok := l.NextToken(); tok.Type != EOF; tok = l.NextToken() {
+		if tok.Type != IMPORT {
+			continue
+		}
+		if tok = l.NextToken(); tok.Type == STRING {
+			names = append(names, tok.Literal)
+		}
+	}
+	return names
+}
+
+// resolveImports merges the declarations of the libraries program imports,
+// and of those they import, into program. Each library is merged once,
+// after the declarations of the program. The source map gives the
+// instructions of a library the lines of its own file. Unless SetKeepUnused
+// says otherwise, the library declarations the program doesn't reach are
+// dropped once all are merged.
+func (a *Assembler) resolveImports(program *Program) error {
+	merged := make(map[string]bool)
+	a.libraries = nil
+	a.eliminatedFunctions, a.eliminatedStructs = nil, nil
+	own, ownStructs := len(program.Functions), len(program.Structs)
+	pending := program.Imports
+	for len(pending) > 0 {
+		imp := pending[0]
+		pending = pending[1:]
+		if merged[imp.Name] {
+			continue
+		}
+		merged[imp.Name] = true
+		if a.importer == nil {
+			return fmt.Errorf("%v: cannot import %q, the assembler has no importer", imp.Pos, imp.Name)
+		}
+		source, err := a.importer(imp.Name)
+		if err != nil {
+			return fmt.Errorf("%v: import %q: %w", imp.Pos, imp.Name, err)
+		}
+		a.libraries = append(a.libraries, source)
+		library, err := Parse(source)
+		if err != nil {
+			return fmt.Errorf("import %q: %w", imp.Name, err)
+		}
+		for _, f := range library.Functions {
+			if f.Name == "main" {
+				return fmt.Errorf("import %q: a library can't declare main", imp.Name)
+			}
+		}
+		program.Structs = append(program.Structs, library.Structs...)
+		program.StructPos = append(program.StructPos, library.StructPos...)
+		program.Interfaces = append(program.Interfaces, library.Interfaces...)
+		program.Enums = append(program.Enums, library.Enums...)
+		program.Functions = append(program.Functions, library.Functions...)
+		program.Natives = append(program.Natives, library.Natives...)
+		pending = append(pending, library.Imports...)
+	}
+	if len(a.libraries) > 0 && !a.keepUnused {
+		a.eliminateDeadCode(program, own, ownStructs)
+	}
+	return nil
+}
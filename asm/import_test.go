@@ -0,0 +1,180 @@
+package asm
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/AndreiAlbert/gvm/vm"
+)
+
+func TestImports(t *testing.T) {
+	libraries := map[string]string{
+		"greet": `.import "bytes"
+        .text
+        func greet() -> int32 {
+            push int32 104
+            call emit
+            push int32 105
+            call emit
+            push int32 0
+            ret
+        }`,
+		"bytes": `.import "greet"
+        .text
+        func emit(b: int32) -> int32 {
+            syscall write_byte
+            push int32 0
+            ret
+        }`,
+	}
+	var imported []string
+	importer := func(name string) (string, error) {
+		imported = append(imported, name)
+		source, ok := libraries[name]
+		if !ok {
+			return "", errors.New("not found")
+		}
+		return source, nil
+	}
+	source := `.import "greet"
+    .import "greet"
+    .text
+    func main() -> void {
+        call greet
+        pop
+        push int32 0
+        ret
+    }`
+	if names := Imports(source); len(names) != 2 || names[0] != "greet" {
+		t.Errorf("Expected the two imports of greet, got %v", names)
+	}
+	assembler := NewAssembler(source)
+	assembler.SetImporter(importer)
+	program, err := assembler.Assemble()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the libraries import each other, each is merged once
+	if fmt.Sprint(imported) != "[greet bytes]" || len(program.Functions) != 3 {
+		t.Errorf("Expected greet and bytes imported once, got %v and %d functions", imported, len(program.Functions))
+	}
+	var out bytes.Buffer
+	machine, err := vm.NewVmFromProgram(program, vm.Options{Stdout: &out})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer machine.Close()
+	if err := machine.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "hi" {
+		t.Errorf("Expected the library to print hi, got %q", out.String())
+	}
+
+	for _, tt := range []struct {
+		name   string
+		source string
+	}{
+		{"no importer", source},
+		{"missing library", `.import "missing"`},
+		{"library with main", `.import "app"`},
+	} {
+		assembler := NewAssembler(tt.source)
+		if tt.name != "no importer" {
+			assembler.SetImporter(func(name string) (string, error) {
+				if name == "app" {
+					return ".text\nfunc main() -> void {\npush int32 0\nret\n}", nil
+				}
+				return importer(name)
+			})
+		}
+		if _, err := assembler.Assemble(); err == nil {
+			t.Errorf("%s: expected the assembly to fail", tt.name)
+		}
+	}
+}
+
+func TestImportsDropUnreachable(t *testing.T) {
+	library := `.structs
+    struct Point {
+        x: int32
+    }
+    struct Unused {
+        y: int32
+    }
+    .text
+    func origin() -> Point {
+        newstruct Point
+        ret
+    }
+    func Point.norm() -> int32 {
+        fldget "x"
+        ret
+    }
+    func Unused.get() -> int32 {
+        fldget "y"
+        ret
+    }
+    func helper() -> int32 {
+        push int32 0
+        ret
+    }
+    func unused() -> int32 {
+        call helper
+        ret
+    }`
+	source := `.import "geometry"
+    .structs
+    interface Normed {
+        norm() -> int32
+    }
+    .text
+    func main() -> void {
+        call origin
+        invokeinterface Normed.norm
+        pop
+        push int32 0
+        ret
+    }`
+	importer := func(name string) (string, error) { return library, nil }
+	assembler := NewAssembler(source)
+	assembler.SetImporter(importer)
+	program, err := assembler.Assemble()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, f := range program.Functions {
+		names = append(names, f.Name)
+	}
+	// Unused.get has the method name of no interface call, so it and its
+	// struct go
+	if fmt.Sprint(names) != "[main origin Point.norm]" {
+		t.Errorf("Expected main, origin and Point.norm, got %v", names)
+	}
+	functions, structs := assembler.Eliminated()
+	if fmt.Sprint(functions) != "[Unused.get helper unused]" || fmt.Sprint(structs) != "[Unused]" {
+		t.Errorf("Expected Unused.get, helper, unused and Unused dropped, got %v and %v", functions, structs)
+	}
+	machine, err := vm.NewVmFromProgram(program, vm.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer machine.Close()
+	if err := machine.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	assembler = NewAssembler(source)
+	assembler.SetImporter(importer)
+	assembler.SetKeepUnused(true)
+	program, err = assembler.Assemble()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(program.Functions) != 6 || len(program.Structs) != 2 {
+		t.Errorf("Expected every declaration kept, got %d functions and %d structs", len(program.Functions), len(program.Structs))
+	}
+}
@@ -1,11 +1,13 @@
-package assembler
+package asm
 
 import (
+	"errors"
 	"strconv"
 	"strings"
 	"unicode"
 )
 
+// Lexer splits assembly source into tokens.
 type Lexer struct {
 	input        string
 	position     uint
@@ -15,16 +17,19 @@ type Lexer struct {
 	columnn      uint
 }
 
+// NewLexer creates a lexer positioned at the start of input.
 func NewLexer(input string) *Lexer {
 	l := &Lexer{
-		input:   input,
-		line:    1,
-		columnn: 1,
+		input: input,
+		line:  1,
 	}
+	// reading the first character moves to column 1
 	l.readChar()
 	return l
 }
 
+// NextToken returns the next token, skipping whitespace and comments. At the
+// end of input it keeps returning EOF.
 func (l *Lexer) NextToken() Token {
 	var tok Token
 	l.skipWhiteSpace()
@@ -157,29 +162,41 @@ func (l *Lexer) readString() string {
 	return result.String()
 }
 
+// readNumber reads an integer or a float literal. The literal runs to the
+// first character that can't be part of a number, so 3.14abc is one
+// invalid literal rather than a float followed by an identifier.
 func (l *Lexer) readNumber() Token {
-	pos := l.position
-	isFloat := false
-	for isDigit(l.ch) || l.ch == '.' {
-		if l.ch == '.' {
-			if isFloat {
-				return Token{Type: ILLEGAL, Literal: "Invalid number format"}
-			}
-			isFloat = true
-		}
+	pos, line, column := l.position, l.line, l.columnn
+	for isDigit(l.ch) || isLetter(l.ch) || l.ch == '.' || l.isExponentSign(pos) {
 		l.readChar()
 	}
 	numStr := l.input[pos:l.position]
-	if isFloat {
-		if _, err := strconv.ParseFloat(numStr, 32); err != nil {
-			return Token{Type: ILLEGAL, Literal: "Invalid float format"}
+	if strings.Trim(numStr, "0123456789") == "" {
+		if _, err := strconv.ParseInt(numStr, 10, 32); err != nil {
+			return newToken(ILLEGAL, "Invalid integer format", line, column)
+		}
+		return newToken(INT, numStr, line, column)
+	}
+	if _, err := parseFloat32(numStr); err != nil {
+		if errors.Is(err, strconv.ErrRange) {
+			return newToken(ILLEGAL, "Invalid float format", line, column)
 		}
-		return Token{Type: FLOAT, Literal: numStr}
+		return newToken(ILLEGAL, "Invalid number format", line, column)
+	}
+	return newToken(FLOAT, numStr, line, column)
+}
+
+// isExponentSign reports whether the current character is the sign of the
+// exponent of the literal starting at pos: e-3, or p-3 in a hex float
+func (l *Lexer) isExponentSign(pos uint) bool {
+	if l.ch != '+' && l.ch != '-' || l.position == pos {
+		return false
 	}
-	if _, err := strconv.ParseInt(numStr, 10, 32); err != nil {
-		return Token{Type: ILLEGAL, Literal: "Invalid integer format"}
+	prev := l.input[l.position-1] | 0x20
+	if strings.HasPrefix(strings.ToLower(l.input[pos:l.position]), "0x") {
+		return prev == 'p'
 	}
-	return Token{Type: INT, Literal: numStr}
+	return prev == 'e'
 }
 
 func isLetter(ch byte) bool {
@@ -1,6 +1,10 @@
-package assembler
+package asm
 
-import "testing"
+import (
+	"testing"
+
+	"github.com/AndreiAlbert/gvm/vm"
+)
 
 func TestNextToken(t *testing.T) {
 	input := `.structs
@@ -211,6 +215,9 @@ func TestInvalidNumbers(t *testing.T) {
 		{"42.42.42", "Invalid number format"},
 		{"3.14.15", "Invalid number format"},
 		{"999999999999999", "Invalid integer format"},
+		{"3.14abc", "Invalid number format"},
+		{"1e", "Invalid number format"},
+		{"1e39", "Invalid float format"},
 	}
 
 	for i, tt := range tests {
@@ -228,6 +235,32 @@ func TestInvalidNumbers(t *testing.T) {
 	}
 }
 
+func TestNumberLiterals(t *testing.T) {
+	tests := []struct {
+		input        string
+		expectedType TokenType
+	}{
+		{"42", INT},
+		{"3.14", FLOAT},
+		{"2.5e-3", FLOAT},
+		{"1E+5", FLOAT},
+		{"1e5", FLOAT},
+		{"0x1.8p3", FLOAT},
+		{"0x1p-2", FLOAT},
+	}
+
+	for i, tt := range tests {
+		l := NewLexer(tt.input + " pop")
+		tok := l.NextToken()
+		if tok.Type != tt.expectedType || tok.Literal != tt.input {
+			t.Errorf("tests[%d] - expected %q %q, got %q %q", i, tt.expectedType, tt.input, tok.Type, tok.Literal)
+		}
+		if next := l.NextToken(); next.Type != POP {
+			t.Errorf("tests[%d] - expected the literal to end before pop, got %q", i, next.Literal)
+		}
+	}
+}
+
 func TestComments(t *testing.T) {
 	input := `push int32 42 ; this is a comment
 ; this is a full line comment
@@ -286,3 +319,18 @@ stralloc "special chars: \n \t \\"`
 		}
 	}
 }
+
+// TestInstructionsMatchOpcodeTable keeps the mnemonics of the lexer and the
+// ones documented by the opcode table of the VM in step
+func TestInstructionsMatchOpcodeTable(t *testing.T) {
+	for mnemonic := range instructions {
+		if _, ok := vm.LookupMnemonic(mnemonic); !ok {
+			t.Errorf("%s has no entry in the opcode table", mnemonic)
+		}
+	}
+	for _, info := range vm.Opcodes() {
+		if _, ok := instructions[info.Mnemonic]; info.Mnemonic != "" && !ok {
+			t.Errorf("%s of %s is not an instruction of the lexer", info.Mnemonic, info.Name)
+		}
+	}
+}
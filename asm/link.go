@@ -0,0 +1,117 @@
+package asm
+
+import (
+	"strings"
+
+	"github.com/AndreiAlbert/gvm/vm"
+)
+
+// SetKeepUnused makes the assembler keep every declaration of the imported
+// libraries, rather than only those the program reaches. Tools calling
+// library functions from outside of the program, such as the debugger, need
+// it.
+func (a *Assembler) SetKeepUnused(keep bool) {
+	a.keepUnused = keep
+}
+
+// Eliminated returns the functions and structs of the imported libraries
+// the last assembly dropped as unreachable from the program.
+func (a *Assembler) Eliminated() (functions, structs []string) {
+	return a.eliminatedFunctions, a.eliminatedStructs
+}
+
+// eliminateDeadCode drops the library declarations the program can't reach:
+// the functions are only kept when one of the first own functions, which
+// the program declares itself, calls them directly or through others, and
+// the structs when kept code creates, checks, returns or accesses them, or
+// declares one of their methods. Interfaces and enums cost nothing at run
+// time and are kept.
+func (a *Assembler) eliminateDeadCode(program *Program, own, ownStructs int) {
+	functions := make(map[string]int)
+	methods := make(map[string][]int)
+	for i, f := range program.Functions {
+		functions[f.Name] = i
+		if _, method, ok := strings.Cut(f.Name, "."); ok {
+			methods[method] = append(methods[method], i)
+		}
+	}
+	structs := make(map[string]int)
+	fieldStructs := make(map[string][]int)
+	for i, s := range program.Structs {
+		structs[s.Name] = i
+		for _, field := range s.Fields {
+			fieldStructs[field.Name] = append(fieldStructs[field.Name], i)
+		}
+	}
+
+	liveFunctions := make([]bool, len(program.Functions))
+	liveStructs := make([]bool, len(program.Structs))
+	for i := 0; i < ownStructs; i++ {
+		liveStructs[i] = true
+	}
+	useStruct := func(name string) {
+		if i, ok := structs[name]; ok {
+			liveStructs[i] = true
+		}
+	}
+	var pending []int
+	for i := 0; i < own; i++ {
+		pending = append(pending, i)
+	}
+	for len(pending) > 0 {
+		i := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		if liveFunctions[i] {
+			continue
+		}
+		liveFunctions[i] = true
+		f := &program.Functions[i]
+		if f.ReturnStructName != "" {
+			useStruct(f.ReturnStructName)
+		}
+		if typeName, _, ok := strings.Cut(f.Name, "."); ok {
+			useStruct(typeName)
+		}
+		for _, inst := range f.Body {
+			if len(inst.Operands) == 0 {
+				continue
+			}
+			operand := inst.Operands[0].Literal
+			switch inst.Opcode {
+			case vm.CALL, vm.MAKECLOSURE:
+				if callee, ok := functions[operand]; ok {
+					pending = append(pending, callee)
+				}
+			case vm.INVOKEINTERFACE:
+				_, method, _ := strings.Cut(operand, ".")
+				pending = append(pending, methods[method]...)
+			case vm.NEWSTRUCT, vm.CHECKCAST, vm.INSTANCEOF:
+				useStruct(operand)
+			case vm.FLDGET, vm.STFIELD:
+				for _, s := range fieldStructs[operand] {
+					liveStructs[s] = true
+				}
+			}
+		}
+	}
+
+	kept := program.Functions[:0]
+	for i, f := range program.Functions {
+		if liveFunctions[i] {
+			kept = append(kept, f)
+		} else {
+			a.eliminatedFunctions = append(a.eliminatedFunctions, f.Name)
+		}
+	}
+	program.Functions = kept
+	keptStructs, keptPos := program.Structs[:0], program.StructPos[:0]
+	for i, s := range program.Structs {
+		if liveStructs[i] {
+			keptStructs = append(keptStructs, s)
+			keptPos = append(keptPos, program.StructPos[i])
+		} else {
+			a.eliminatedStructs = append(a.eliminatedStructs, s.Name)
+		}
+	}
+	program.Structs, program.StructPos = keptStructs, keptPos
+}
@@ -0,0 +1,219 @@
+package asm
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/AndreiAlbert/gvm/vm"
+)
+
+// Severity is how a lint rule reports what it finds.
+type Severity int
+
+const (
+	// SeverityOff disables the rule.
+	SeverityOff Severity = iota
+	// SeverityWarning reports findings without failing the check.
+	SeverityWarning
+	// SeverityError reports findings and fails the check.
+	SeverityError
+)
+
+func (s Severity) String() string {
+	switch s {
+	case SeverityOff:
+		return "off"
+	case SeverityWarning:
+		return "warning"
+	case SeverityError:
+		return "error"
+	default:
+		return fmt.Sprintf("Severity(%d)", int(s))
+	}
+}
+
+// ParseSeverity parses off, warning or error.
+func ParseSeverity(s string) (Severity, error) {
+	for _, severity := range []Severity{SeverityOff, SeverityWarning, SeverityError} {
+		if strings.EqualFold(s, severity.String()) {
+			return severity, nil
+		}
+	}
+	return SeverityOff, fmt.Errorf("unknown severity %q, expected off, warning or error", s)
+}
+
+// LintRule is a check of the instructions a program uses.
+type LintRule struct {
+	Name    string
+	Summary string
+	// Severity is the severity of the rule unless it is configured
+	Severity Severity
+}
+
+// Lint rules
+const (
+	RuleDeprecated          = "deprecated"
+	RuleUncheckedHeapAccess = "unchecked-heap-access"
+)
+
+// LintRules lists the rules Lint runs.
+var LintRules = []LintRule{
+	{RuleDeprecated, "instructions the instruction set marks as deprecated", SeverityWarning},
+	{RuleUncheckedHeapAccess, "loadh and storeh at a pointer that doesn't come from alloc, so the block's bounds were never set up", SeverityWarning},
+}
+
+// Finding is a use of an instruction a lint rule flags.
+type Finding struct {
+	Rule     string
+	Severity Severity
+	Function string
+	Pos      Pos
+	Message  string
+}
+
+func (f Finding) String() string {
+	return fmt.Sprintf("%v: %v: %s: %s (%s)", f.Pos, f.Severity, f.Function, f.Message, f.Rule)
+}
+
+// Lint runs the lint rules over the functions of program. severities
+// overrides the severity of the rules it names, rules set to SeverityOff
+// are skipped. The findings are in source order.
+func Lint(program *Program, severities map[string]Severity) ([]Finding, error) {
+	active := make(map[string]Severity)
+	for _, rule := range LintRules {
+		active[rule.Name] = rule.Severity
+	}
+	for name, severity := range severities {
+		if _, ok := active[name]; !ok {
+			return nil, fmt.Errorf("unknown lint rule %q", name)
+		}
+		active[name] = severity
+	}
+	g := NewCodeGenerator(program)
+	if err := g.indexFunctions(); err != nil {
+		return nil, err
+	}
+	if err := g.indexNatives(); err != nil {
+		return nil, err
+	}
+	var findings []Finding
+	report := func(rule string, f *ParsedFunction, inst *Instruction, format string, args ...any) {
+		if severity := active[rule]; severity != SeverityOff {
+			findings = append(findings, Finding{rule, severity, f.Name, inst.Pos(), fmt.Sprintf(format, args...)})
+		}
+	}
+	for i := range program.Functions {
+		f := &program.Functions[i]
+		for j := range f.Body {
+			inst := &f.Body[j]
+			if info, ok := vm.LookupOpcode(inst.Opcode); ok && info.Deprecated != "" {
+				report(RuleDeprecated, f, inst, "%s is deprecated: %s", info.Mnemonic, info.Deprecated)
+			}
+		}
+		for _, j := range g.uncheckedHeapAccesses(f) {
+			inst := &f.Body[j]
+			report(RuleUncheckedHeapAccess, f, inst, "%s at a pointer that doesn't come from alloc", inst.Token.Literal)
+		}
+	}
+	sort.SliceStable(findings, func(i, j int) bool {
+		a, b := findings[i].Pos, findings[j].Pos
+		return a.Line < b.Line || a.Line == b.Line && a.Column < b.Column
+	})
+	return findings, nil
+}
+
+// Lint parses the source, with its imports and passes, and runs the lint
+// rules over it, see Lint.
+func (a *Assembler) Lint(severities map[string]Severity) ([]Finding, error) {
+	program, err := a.parse()
+	if err != nil {
+		return nil, err
+	}
+	return Lint(program, severities)
+}
+
+// uncheckedHeapAccesses returns the indices of the LOADH and STOREH of f
+// whose pointer isn't known to come from ALLOC. Values are followed through
+// the operand stack and the locals: a local holds an allocated block if
+// every store to it does and it isn't a parameter. The stack is forgotten
+// at labels, where other paths join.
+func (g *CodeGenerator) uncheckedHeapAccesses(f *ParsedFunction) []int {
+	labelled := make(map[int]bool)
+	for _, index := range f.Labels {
+		labelled[index] = true
+	}
+	allocated := make(map[int32]bool)
+	for _, inst := range f.Body {
+		if addr, ok := localAddress(inst); ok && inst.Opcode == vm.STORE && int(addr) >= len(f.Params) {
+			allocated[addr] = true
+		}
+	}
+	for {
+		var stack []bool
+		pop := func() bool {
+			if len(stack) == 0 {
+				return false
+			}
+			top := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			return top
+		}
+		var flagged []int
+		changed := false
+		for i, inst := range f.Body {
+			if labelled[i] {
+				for j := range stack {
+					stack[j] = false
+				}
+			}
+			switch inst.Opcode {
+			case vm.ALLOC:
+				pop()
+				stack = append(stack, true)
+			case vm.DUP:
+				top := pop()
+				stack = append(stack, top, top)
+			case vm.LOAD:
+				addr, _ := localAddress(inst)
+				stack = append(stack, allocated[addr])
+			case vm.STORE:
+				addr, _ := localAddress(inst)
+				if !pop() && allocated[addr] {
+					allocated[addr] = false
+					changed = true
+				}
+			case vm.LOADH:
+				if !pop() {
+					flagged = append(flagged, i)
+				}
+				stack = append(stack, false)
+			case vm.STOREH:
+				pop()
+				if !pop() {
+					flagged = append(flagged, i)
+				}
+			default:
+				pops, pushes := g.stackEffect(inst)
+				for ; pops > 0; pops-- {
+					pop()
+				}
+				for ; pushes > 0; pushes-- {
+					stack = append(stack, false)
+				}
+			}
+		}
+		if !changed {
+			return flagged
+		}
+	}
+}
+
+// localAddress returns the address operand of a STORE or LOAD
+func localAddress(inst Instruction) (int32, bool) {
+	if len(inst.Operands) != 1 {
+		return 0, false
+	}
+	addr, err := parseInt32(inst.Operands[0].Literal)
+	return addr, err == nil
+}
@@ -0,0 +1,93 @@
+package asm
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/AndreiAlbert/gvm/vm"
+)
+
+func TestLint(t *testing.T) {
+	err := vm.DefineExtension(vm.OpcodeInfo{
+		Opcode:     0xF1,
+		Name:       "OLDNOP",
+		Mnemonic:   "oldnop",
+		Deprecated: "drop it, it does nothing",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := `.text
+    func poke(p: int32) -> void {
+        load 0
+        push int32 1
+        storeh
+        ret
+    }
+    func main() -> void {
+        push int32 8
+        alloc
+        store 1
+        load 1
+        dup
+        push int32 7
+        storeh
+        loadh
+        pop
+    again:
+        load 1
+        loadh
+        pop
+        stralloc "x"
+        loadh
+        pop
+        oldnop
+        halt
+    }`
+	program, err := Parse(input)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	findings, err := Lint(program, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, finding := range findings {
+		got = append(got, finding.String())
+	}
+	want := []string{
+		"5:9: warning: poke: storeh at a pointer that doesn't come from alloc (unchecked-heap-access)",
+		"23:9: warning: main: loadh at a pointer that doesn't come from alloc (unchecked-heap-access)",
+		"25:9: warning: main: oldnop is deprecated: drop it, it does nothing (deprecated)",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("findings:\n%q\nexpected:\n%q", got, want)
+	}
+
+	findings, err = Lint(program, map[string]Severity{RuleDeprecated: SeverityOff, RuleUncheckedHeapAccess: SeverityError})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(findings) != 2 || findings[0].Severity != SeverityError {
+		t.Errorf("expected the configured severities to apply, got %v", findings)
+	}
+
+	// the block is now stored in another local, the loads of local 1 get
+	// nothing from alloc
+	program.Functions[1].Body[2].Operands[0].Literal = "0"
+	findings, err = Lint(program, map[string]Severity{RuleDeprecated: SeverityOff})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(findings) != 5 {
+		t.Errorf("expected every access through local 1 to be flagged, got %v", findings)
+	}
+
+	if _, err := Lint(program, map[string]Severity{"nosuchrule": SeverityError}); err == nil {
+		t.Error("expected an unknown rule to be refused")
+	}
+	if _, err := ParseSeverity("loud"); err == nil {
+		t.Error("expected an unknown severity to be refused")
+	}
+}
@@ -0,0 +1,984 @@
+package asm
+
+import (
+	"fmt"
+	. "github.com/AndreiAlbert/gvm/common"
+	"github.com/AndreiAlbert/gvm/vm"
+	"strconv"
+	"strings"
+)
+
+// NodeType classifies nodes of the parsed program.
+type NodeType int
+
+const (
+	NODE_PROGRAM NodeType = iota
+	NODE_STRUCT
+	NODE_FUNCTION
+	NODE_INSTRUCTION
+	NODE_LABEL
+)
+
+// Program is the parsed form of an assembly source file. Tools can build
+// it with Parse and traverse it with Walk.
+type Program struct {
+	Structs []StructType
+	// StructPos holds where each of Structs is declared
+	StructPos  []Pos
+	Interfaces []Interface
+	Enums      []Enum
+	Functions  []ParsedFunction
+	// Natives are the host functions declared in the .natives section
+	Natives []Native
+	// Imports are the libraries named by .import directives, in the order
+	// they appear
+	Imports []Import
+}
+
+// Import is a library named by an .import directive. The assembler merges
+// its declarations into the program, see Assembler.SetImporter.
+type Import struct {
+	Name string
+	Pos  Pos
+}
+
+// Enum is a named group of int32 constants declared with .enum. Members
+// without an explicit value take the value of the previous one plus one,
+// starting at 0.
+type Enum struct {
+	Name    string
+	Members []EnumMember
+	Pos     Pos
+}
+
+// EnumMember is a constant of an enum.
+type EnumMember struct {
+	Name  string
+	Value int32
+}
+
+// Interface is a named method set declared in the structs section. A struct
+// implements a method with a function named Struct.method.
+type Interface struct {
+	Name    string
+	Methods []InterfaceMethod
+	Pos     Pos
+}
+
+// InterfaceMethod is the signature of an interface method. Params don't
+// include the receiver.
+type InterfaceMethod struct {
+	Name             string
+	Params           []ParsedParam
+	ReturnType       ValueKind
+	ReturnStructName string
+}
+
+// Native is the signature of a host function declared in the .natives
+// section as `native func name(params) -> type`. Calls of it are emitted as
+// CALLNATIVE, bound when the program is loaded to the function the host
+// registers under the name, see vm.Native.
+type Native struct {
+	Name       string
+	Params     []ParsedParam
+	ReturnType ValueKind
+	// ReturnStructName is set for a struct return type, which natives
+	// can't have
+	ReturnStructName string
+	// Async is set for `native async func`, whose calls push a handle of
+	// the pending call for AWAIT
+	Async bool
+	Pos   Pos
+}
+
+// receiverParam is the implicit first parameter of methods
+const receiverParam = "self"
+
+// ParsedFunction is a function declaration with its body. Labels map label
+// names to the index of the instruction they precede.
+type ParsedFunction struct {
+	Name             string
+	Params           []ParsedParam
+	ReturnType       ValueKind
+	Body             []Instruction
+	Labels           map[string]int
+	ReturnStructName string
+	// Pos is where the func keyword starts
+	Pos Pos
+}
+
+// ParsedParam is a declared function parameter.
+type ParsedParam struct {
+	Name string
+	Type ValueKind
+}
+
+// Instruction is a single instruction with its raw operand tokens.
+type Instruction struct {
+	Token    Token
+	Opcode   vm.Opcode
+	Operands []Token
+	isLabel  bool
+	Label    string
+}
+
+// Parser builds a Program from the tokens produced by a Lexer.
+type Parser struct {
+	lexer        *Lexer
+	currentToken Token
+	peekToken    Token
+	errors       []string
+	// constants holds the members of the enums declared so far, by name
+	// and as Enum.MEMBER
+	constants map[string]bool
+}
+
+// String method for Program
+func (p *Program) String() string {
+	var sb strings.Builder
+	sb.WriteString("Program {\n")
+
+	sb.WriteString("  Structs: [\n")
+	for _, s := range p.Structs {
+		lines := strings.Split(s.String(), "\n")
+		for _, line := range lines {
+			sb.WriteString("    " + line + "\n")
+		}
+	}
+	sb.WriteString("  ]\n")
+
+	sb.WriteString("  Functions: [\n")
+	for _, f := range p.Functions {
+		lines := strings.Split(f.String(), "\n")
+		for _, line := range lines {
+			sb.WriteString("    " + line + "\n")
+		}
+	}
+	sb.WriteString("  ]\n")
+	sb.WriteString("}")
+	return sb.String()
+}
+
+// String formats the parameter as name: type.
+func (p *ParsedParam) String() string {
+	return fmt.Sprintf("%s: %v", p.Name, p.Type)
+}
+
+// String formats the function with its labels and body.
+func (f *ParsedFunction) String() string {
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("Function %s(\n", f.Name))
+
+	// Parameters
+	for i, param := range f.Params {
+		if i > 0 {
+			sb.WriteString(", ")
+		}
+		sb.WriteString(param.String())
+	}
+	sb.WriteString(fmt.Sprintf(") -> %v {\n", f.ReturnType))
+
+	// Labels
+	if len(f.Labels) > 0 {
+		sb.WriteString("  Labels: {\n")
+		for label, pos := range f.Labels {
+			sb.WriteString(fmt.Sprintf("    %s: %d\n", label, pos))
+		}
+		sb.WriteString("  }\n")
+	}
+
+	// Instructions
+	sb.WriteString("  Body: [\n")
+	for _, instr := range f.Body {
+		lines := strings.Split(instr.String(), "\n")
+		for _, line := range lines {
+			sb.WriteString("    " + line + "\n")
+		}
+	}
+	sb.WriteString("  ]\n")
+	sb.WriteString("}")
+	return sb.String()
+}
+
+// String method for ParsedParam
+
+// String method for Instruction
+func (i *Instruction) String() string {
+	var sb strings.Builder
+	if i.isLabel {
+		sb.WriteString(fmt.Sprintf("Label(%s)", i.Label))
+	} else {
+		sb.WriteString(fmt.Sprintf("Instruction(%v", i.Opcode))
+		if len(i.Operands) > 0 {
+			sb.WriteString(" [")
+			for j, op := range i.Operands {
+				if j > 0 {
+					sb.WriteString(", ")
+				}
+				sb.WriteString(fmt.Sprintf("%v", op))
+			}
+			sb.WriteString("]")
+		}
+		sb.WriteString(")")
+	}
+	return sb.String()
+}
+
+// NewParser creates a parser reading tokens from l.
+func NewParser(l *Lexer) *Parser {
+	p := &Parser{
+		lexer:     l,
+		errors:    []string{},
+		constants: make(map[string]bool),
+	}
+	p.nextToken()
+	p.nextToken()
+	return p
+}
+
+func (p *Parser) nextToken() {
+	p.currentToken = p.peekToken
+	p.peekToken = p.lexer.NextToken()
+}
+
+func (p *Parser) expectToken(t TokenType) bool {
+	if p.peekToken.Type == t {
+		p.nextToken()
+		return true
+	}
+	return false
+}
+
+// TokenTypeToValueKind maps a type keyword to the value kind it denotes.
+// Unknown tokens map to ValueVoid.
+func TokenTypeToValueKind(t TokenType) ValueKind {
+	switch t {
+	case INT32:
+		return ValueInt32
+	case FLOAT32:
+		return ValueFloat32
+	case VOID:
+		return ValueVoid
+	case STRING_TYPE:
+		return ValueString
+	default:
+		return ValueVoid
+	}
+}
+
+// TokenTypeToOpcode maps an instruction mnemonic token to its opcode.
+func TokenTypeToOpcode(t TokenType) (vm.Opcode, error) {
+	switch t {
+	case HALT:
+		return vm.HALT, nil
+	case PUSH:
+		return vm.PUSH, nil
+	case POP:
+		return vm.POP, nil
+	case IADD:
+		return vm.IADD, nil
+	case ISUB:
+		return vm.ISUB, nil
+	case IMUL:
+		return vm.IMUL, nil
+	case IDIV:
+		return vm.IDIV, nil
+	case FADD:
+		return vm.FADD, nil
+	case FSUB:
+		return vm.FSUB, nil
+	case FMUL:
+		return vm.FMUL, nil
+	case FDIV:
+		return vm.FDIV, nil
+	case JMP:
+		return vm.JMP, nil
+	case IJNE:
+		return vm.IJNE, nil
+	case IJE:
+		return vm.IJE, nil
+	case FJNE:
+		return vm.FJNE, nil
+	case FJE:
+		return vm.FJE, nil
+	case EQ:
+		return vm.EQ, nil
+	case NE:
+		return vm.NE, nil
+	case LT:
+		return vm.LT, nil
+	case GT:
+		return vm.GT, nil
+	case GE:
+		return vm.GE, nil
+	case LE:
+		return vm.LE, nil
+	case LOAD:
+		return vm.LOAD, nil
+	case STORE:
+		return vm.STORE, nil
+	case CALL:
+		return vm.CALL, nil
+	case RET:
+		return vm.RET, nil
+	case RETV:
+		return vm.RETV, nil
+	case THROW:
+		return vm.THROW, nil
+	case TRY:
+		return vm.TRY, nil
+	case ENDTRY:
+		return vm.ENDTRY, nil
+	case ALLOC:
+		return vm.ALLOC, nil
+	case FREE:
+		return vm.FREE, nil
+	case LOADH:
+		return vm.LOADH, nil
+	case STOREH:
+		return vm.STOREH, nil
+	case DUP:
+		return vm.DUP, nil
+	case STRALLOC:
+		return vm.STRALLOC, nil
+	case SYSCALL:
+		return vm.SYSCALL, nil
+	case NEWARR:
+		return vm.NEWARR, nil
+	case LDELEM:
+		return vm.LDELEM, nil
+	case STELEM:
+		return vm.STELEM, nil
+	case SLICE:
+		return vm.SLICE, nil
+	case ARR_CLONE:
+		return vm.ARR_CLONE, nil
+	case NEWSTRUCT:
+		return vm.NEWSTRUCT, nil
+	case FLDGET:
+		return vm.FLDGET, nil
+	case STFIELD:
+		return vm.STFIELD, nil
+	case INVOKEINTERFACE:
+		return vm.INVOKEINTERFACE, nil
+	case MAKECLOSURE:
+		return vm.MAKECLOSURE, nil
+	case CALLCLOSURE:
+		return vm.CALLCLOSURE, nil
+	case FORITER:
+		return vm.FORITER, nil
+	case AWAIT:
+		return vm.AWAIT, nil
+	case CHECKCAST:
+		return vm.CHECKCAST, nil
+	case INSTANCEOF:
+		return vm.INSTANCEOF, nil
+	default:
+		return 0, fmt.Errorf("unknown opcode for token type: %v", t)
+	}
+}
+
+// Parse parses the whole input. All syntax errors found are reported
+// together in the returned error.
+func (p *Parser) Parse() (*Program, error) {
+	program := &Program{}
+	for p.currentToken.Type != EOF {
+		switch p.currentToken.Type {
+		case SECTION_STRUCTS:
+			p.nextToken()
+			for p.currentToken.Type == STRUCT || p.currentToken.Type == INTERFACE {
+				pos := tokenPos(p.currentToken)
+				if p.currentToken.Type == INTERFACE {
+					if iface := p.parseInterface(); iface != nil {
+						iface.Pos = pos
+						program.Interfaces = append(program.Interfaces, *iface)
+					}
+				} else if structDef := p.parseStructDef(); structDef != nil {
+					program.Structs = append(program.Structs, *structDef)
+					program.StructPos = append(program.StructPos, pos)
+				}
+			}
+		case ENUM:
+			pos := tokenPos(p.currentToken)
+			if enum := p.parseEnum(); enum != nil {
+				enum.Pos = pos
+				program.Enums = append(program.Enums, *enum)
+			}
+		case IMPORT:
+			pos := tokenPos(p.currentToken)
+			p.nextToken()
+			if p.currentToken.Type != STRING {
+				p.errors = append(p.errors, fmt.Sprintf("expected the library name in quotes after .import, got %v at line %d", p.currentToken.Type, p.currentToken.Line))
+				continue
+			}
+			program.Imports = append(program.Imports, Import{Name: p.currentToken.Literal, Pos: pos})
+			p.nextToken()
+		case SECTION_NATIVES:
+			p.nextToken()
+			for p.currentToken.Type == NATIVE {
+				pos := tokenPos(p.currentToken)
+				if native := p.parseNative(); native != nil {
+					native.Pos = pos
+					program.Natives = append(program.Natives, *native)
+				}
+			}
+		case SECTION_TEXT:
+			p.nextToken()
+			for p.currentToken.Type == FUNC {
+				pos := tokenPos(p.currentToken)
+				if function := p.parseFunction(); function != nil {
+					function.Pos = pos
+					program.Functions = append(program.Functions, *function)
+				}
+			}
+		default:
+			p.nextToken()
+		}
+	}
+	program.addReceivers()
+	if len(p.errors) > 0 {
+		var errMsg strings.Builder
+		errMsg.WriteString("parser encountered the following errors:\n")
+		for i, err := range p.errors {
+			errMsg.WriteString(fmt.Sprintf("  %d. %s\n", i+1, err))
+		}
+		return nil, fmt.Errorf(errMsg.String())
+	}
+	return program, nil
+}
+
+func (p *Parser) parseStructDef() *StructType {
+	structType := &StructType{
+		Methods: make(map[string]uint),
+	}
+	if !p.expectToken(IDENT) {
+		return nil
+	}
+	structType.Name = p.currentToken.Literal
+	if !p.expectToken(LBRACE) {
+		return nil
+	}
+	p.nextToken()
+	for p.currentToken.Type != RBRACE && p.currentToken.Type != EOF {
+		field := StructField{}
+		if p.currentToken.Type != IDENT {
+			p.errors = append(p.errors, fmt.Sprintf("expected field name, got %v at line %d", p.currentToken.Type, p.currentToken.Line))
+			return nil
+		}
+		field.Name = p.currentToken.Literal
+		if !p.expectToken(COLON) {
+			return nil
+		}
+
+		// An enum field holds an int32 member of the enum
+		if p.expectToken(IDENT) {
+			field.Type = ValueInt32
+			field.Enum = p.currentToken.Literal
+			structType.Fields = append(structType.Fields, field)
+			p.nextToken()
+			continue
+		}
+
+		// Parse the field type
+		if !p.expectToken(INT32) && !p.expectToken(FLOAT32) && !p.expectToken(STRING_TYPE) {
+			p.errors = append(p.errors, fmt.Sprintf("expected type, got %v at line %d", p.currentToken.Type, p.currentToken.Line))
+			return nil
+		}
+
+		// Save the type we just parsed
+		baseType := p.currentToken.Type
+		valueType := TokenTypeToValueKind(baseType)
+
+		// Check if the next token is a left bracket (array type)
+		if p.peekToken.Type == LBRACKET {
+			// This is an array type
+			field.Type = ValueArray
+			elementType := valueType
+			field.ArrayType = &elementType
+
+			// Consume the brackets
+			if !p.expectToken(LBRACKET) {
+				p.errors = append(p.errors, fmt.Sprintf("expected [, got %v at line %d", p.currentToken.Type, p.currentToken.Line))
+				return nil
+			}
+			if !p.expectToken(RBRACKET) {
+				p.errors = append(p.errors, fmt.Sprintf("expected ], got %v at line %d", p.currentToken.Type, p.currentToken.Line))
+				return nil
+			}
+		} else {
+			// Regular non-array type
+			field.Type = valueType
+		}
+
+		structType.Fields = append(structType.Fields, field)
+		p.nextToken()
+	}
+	if p.currentToken.Type != RBRACE {
+		p.errors = append(p.errors, fmt.Sprintf("expected }, got %v at line %d", p.currentToken.Type, p.currentToken.Line))
+		return nil
+	}
+	p.nextToken()
+	return structType
+}
+
+func (p *Parser) parseFunction() *ParsedFunction {
+	function := &ParsedFunction{
+		Labels:           make(map[string]int),
+		ReturnStructName: "", // Initialize the new field
+	}
+	if !p.expectToken(IDENT) {
+		return nil
+	}
+	function.Name = p.currentToken.Literal
+	params, returnType, returnStruct, ok := p.parseSignature()
+	if !ok {
+		return nil
+	}
+	function.Params = params
+	function.ReturnType = returnType
+	function.ReturnStructName = returnStruct
+
+	if !p.expectToken(LBRACE) {
+		p.errors = append(p.errors, fmt.Sprintf("expected {, got %v at line %d", p.currentToken.Type, p.currentToken.Line))
+		return nil
+	}
+	p.nextToken()
+	instIndex := 0
+	for p.currentToken.Type != RBRACE && p.currentToken.Type != EOF {
+		if p.peekToken.Type == COLON {
+			labelName := p.currentToken.Literal
+			function.Labels[labelName] = instIndex
+			p.nextToken()
+			p.nextToken()
+			continue
+		}
+		if instr := p.parseInstruction(); instr != nil {
+			function.Body = append(function.Body, *instr)
+			instIndex++
+		} else {
+			return nil
+		}
+	}
+	if p.currentToken.Type != RBRACE {
+		p.errors = append(p.errors, fmt.Sprintf("expected }, got %v at line %d", p.currentToken.Type, p.currentToken.Line))
+		return nil
+	}
+	p.nextToken()
+	return function
+}
+
+// parseNative parses a native declaration: native func, or native async
+// func, a name and a signature, without a body
+func (p *Parser) parseNative() *Native {
+	async := p.expectToken(ASYNC)
+	if !p.expectToken(FUNC) {
+		p.errors = append(p.errors, fmt.Sprintf("expected func after native, got %v at line %d", p.peekToken.Type, p.peekToken.Line))
+		p.nextToken()
+		return nil
+	}
+	if !p.expectToken(IDENT) {
+		p.errors = append(p.errors, fmt.Sprintf("expected native name, got %v at line %d", p.peekToken.Type, p.peekToken.Line))
+		p.nextToken()
+		return nil
+	}
+	native := &Native{Name: p.currentToken.Literal, Async: async}
+	params, returnType, returnStruct, ok := p.parseSignature()
+	if !ok {
+		p.nextToken()
+		return nil
+	}
+	native.Params, native.ReturnType, native.ReturnStructName = params, returnType, returnStruct
+	p.nextToken()
+	return native
+}
+
+// parseSignature parses the parameter list and return type that follow a
+// function or interface method name
+func (p *Parser) parseSignature() (params []ParsedParam, returnType ValueKind, returnStruct string, ok bool) {
+	if !p.expectToken(LPAREN) {
+		return nil, 0, "", false
+	}
+	p.nextToken()
+	for p.currentToken.Type != RPAREN && p.currentToken.Type != EOF {
+		param := ParsedParam{}
+		if p.currentToken.Type != IDENT {
+			p.errors = append(p.errors, fmt.Sprintf("expected parameter name, got %v at line %d", p.currentToken.Type, p.currentToken.Line))
+			return nil, 0, "", false
+		}
+		param.Name = p.currentToken.Literal
+		if !p.expectToken(COLON) {
+			p.errors = append(p.errors, fmt.Sprintf("expected :, got %v at line %d", p.currentToken.Type, p.currentToken.Line))
+			return nil, 0, "", false
+		}
+		if p.expectToken(IDENT) {
+			// a pointer to a struct of that name
+			param.Type = ValuePtr
+		} else if p.expectToken(INT32) || p.expectToken(FLOAT32) || p.expectToken(STRING_TYPE) {
+			param.Type = TokenTypeToValueKind(p.currentToken.Type)
+		} else {
+			p.errors = append(p.errors, fmt.Sprintf("expected type, got %v at line %d", p.currentToken.Type, p.currentToken.Line))
+			return nil, 0, "", false
+		}
+		params = append(params, param)
+		p.nextToken()
+		if p.currentToken.Type == COMMA {
+			p.nextToken()
+		}
+	}
+	if !p.expectToken(ARROW) {
+		return nil, 0, "", false
+	}
+
+	// Handle struct return types
+	if p.expectToken(INT32) || p.expectToken(FLOAT32) || p.expectToken(VOID) || p.expectToken(STRING_TYPE) {
+		returnType = TokenTypeToValueKind(p.currentToken.Type)
+	} else if p.expectToken(IDENT) {
+		returnType = ValueStruct
+		returnStruct = p.currentToken.Literal
+	} else {
+		p.errors = append(p.errors, fmt.Sprintf("expected return type, got %v at line %d",
+			p.currentToken.Type, p.currentToken.Line))
+		return nil, 0, "", false
+	}
+	return params, returnType, returnStruct, true
+}
+
+// parseInterface parses an interface declaration: a name and the signatures
+// of its methods, one per line.
+func (p *Parser) parseInterface() *Interface {
+	if !p.expectToken(IDENT) {
+		p.errors = append(p.errors, fmt.Sprintf("expected interface name, got %v at line %d", p.peekToken.Type, p.peekToken.Line))
+		p.nextToken()
+		return nil
+	}
+	iface := &Interface{Name: p.currentToken.Literal}
+	if !p.expectToken(LBRACE) {
+		p.errors = append(p.errors, fmt.Sprintf("expected {, got %v at line %d", p.peekToken.Type, p.peekToken.Line))
+		p.nextToken()
+		return nil
+	}
+	p.nextToken()
+	for p.currentToken.Type != RBRACE && p.currentToken.Type != EOF {
+		if p.currentToken.Type != IDENT {
+			p.errors = append(p.errors, fmt.Sprintf("expected method name, got %v at line %d", p.currentToken.Type, p.currentToken.Line))
+			return nil
+		}
+		method := InterfaceMethod{Name: p.currentToken.Literal}
+		if p.peekToken.Type != LPAREN {
+			p.errors = append(p.errors, fmt.Sprintf("expected ( after method %s, got %v at line %d", method.Name, p.peekToken.Type, p.peekToken.Line))
+			return nil
+		}
+		params, returnType, returnStruct, ok := p.parseSignature()
+		if !ok {
+			return nil
+		}
+		method.Params, method.ReturnType, method.ReturnStructName = params, returnType, returnStruct
+		iface.Methods = append(iface.Methods, method)
+		p.nextToken()
+	}
+	if p.currentToken.Type != RBRACE {
+		p.errors = append(p.errors, fmt.Sprintf("expected }, got %v at line %d", p.currentToken.Type, p.currentToken.Line))
+		return nil
+	}
+	p.nextToken()
+	return iface
+}
+
+// parseEnum parses an enum declaration: a name and its members, each
+// optionally followed by : and its value. Enums are declared before the
+// instructions using their members.
+func (p *Parser) parseEnum() *Enum {
+	if !p.expectToken(IDENT) {
+		p.errors = append(p.errors, fmt.Sprintf("expected enum name, got %v at line %d", p.peekToken.Type, p.peekToken.Line))
+		p.nextToken()
+		return nil
+	}
+	enum := &Enum{Name: p.currentToken.Literal}
+	if !p.expectToken(LBRACE) {
+		p.errors = append(p.errors, fmt.Sprintf("expected {, got %v at line %d", p.peekToken.Type, p.peekToken.Line))
+		p.nextToken()
+		return nil
+	}
+	p.nextToken()
+	next := int32(0)
+	for p.currentToken.Type != RBRACE && p.currentToken.Type != EOF {
+		if p.currentToken.Type == COMMA {
+			p.nextToken()
+			continue
+		}
+		if p.currentToken.Type != IDENT || strings.Contains(p.currentToken.Literal, ".") {
+			p.errors = append(p.errors, fmt.Sprintf("expected enum member name, got %v at line %d", p.currentToken.Type, p.currentToken.Line))
+			return nil
+		}
+		member := EnumMember{Name: p.currentToken.Literal, Value: next}
+		if p.expectToken(COLON) {
+			if !p.expectToken(INT) {
+				p.errors = append(p.errors, fmt.Sprintf("expected value of %s, got %v at line %d", member.Name, p.peekToken.Type, p.peekToken.Line))
+				return nil
+			}
+			value, err := strconv.ParseInt(p.currentToken.Literal, 10, 32)
+			if err != nil {
+				p.errors = append(p.errors, fmt.Sprintf("invalid value of %s at line %d", member.Name, p.currentToken.Line))
+				return nil
+			}
+			member.Value = int32(value)
+		}
+		next = member.Value + 1
+		enum.Members = append(enum.Members, member)
+		p.constants[member.Name] = true
+		p.constants[enum.Name+"."+member.Name] = true
+		p.nextToken()
+	}
+	if p.currentToken.Type != RBRACE {
+		p.errors = append(p.errors, fmt.Sprintf("expected }, got %v at line %d", p.currentToken.Type, p.currentToken.Line))
+		return nil
+	}
+	p.nextToken()
+	return enum
+}
+
+// isConstant reports whether tok names a member of an enum declared before
+func (p *Parser) isConstant(tok Token) bool {
+	return tok.Type == IDENT && p.constants[tok.Literal]
+}
+
+// addReceivers gives the methods of the structs, the functions named
+// Struct.method, the receiver as their first parameter
+func (program *Program) addReceivers() {
+	structs := make(map[string]bool)
+	for _, structType := range program.Structs {
+		structs[structType.Name] = true
+	}
+	for i := range program.Functions {
+		f := &program.Functions[i]
+		if typeName, method, ok := strings.Cut(f.Name, "."); ok && method != "" && structs[typeName] {
+			f.Params = append([]ParsedParam{{Name: receiverParam, Type: ValuePtr}}, f.Params...)
+		}
+	}
+}
+
+func (p *Parser) parseInstruction() *Instruction {
+	if p.currentToken.Type == IDENT {
+		if info, ok := vm.LookupMnemonic(p.currentToken.Literal); ok && info.Opcode >= vm.FirstExtension {
+			return p.parseExtension(info)
+		}
+	}
+	opcode, err := TokenTypeToOpcode(p.currentToken.Type)
+	if err != nil {
+		p.errors = append(p.errors, fmt.Sprintf("at line %d: %v", p.currentToken.Line, p.currentToken.Type))
+		return nil
+	}
+	instr := &Instruction{
+		Token:  p.currentToken,
+		Opcode: opcode,
+	}
+	p.nextToken()
+	switch opcode {
+	case vm.PUSH:
+		if p.currentToken.Type == STRING_TYPE {
+			// push string "hello" is written for stralloc "hello"
+			p.nextToken()
+			if p.currentToken.Type != STRING {
+				p.errors = append(p.errors, fmt.Sprintf("push string requires string literal, got %v at line %d", p.currentToken.Type, p.currentToken.Line))
+				p.nextToken()
+				return nil
+			}
+			instr.Opcode = vm.STRALLOC
+			instr.Operands = append(instr.Operands, p.currentToken)
+			p.nextToken()
+			return instr
+		}
+		if p.currentToken.Type != INT32 && p.currentToken.Type != FLOAT32 && p.currentToken.Type != BYTE_TYPE {
+			p.errors = append(p.errors, fmt.Sprintf("push requires operand type first, got %v at line %d", p.currentToken.Type, p.currentToken.Line))
+			p.nextToken()
+			return nil
+		}
+		instr.Operands = append(instr.Operands, p.currentToken)
+		p.nextToken()
+		// an int32 may be given as an enum constant
+		isConstant := p.isConstant(p.currentToken) && instr.Operands[0].Type == INT32
+		if !isConstant && p.currentToken.Type != INT && p.currentToken.Type != FLOAT {
+			p.errors = append(p.errors, fmt.Sprintf("push requires value operand, got %v at line %d", p.currentToken.Type, p.currentToken.Line))
+			p.nextToken()
+			return nil
+		}
+		instr.Operands = append(instr.Operands, p.currentToken)
+		p.nextToken()
+	case vm.STORE, vm.LOAD:
+		if p.currentToken.Type != INT {
+			p.errors = append(p.errors, fmt.Sprintf("store/load requires integer operand, got %v at line %d", p.currentToken.Type, p.currentToken.Line))
+			p.nextToken()
+			return nil
+		}
+		instr.Operands = append(instr.Operands, p.currentToken)
+		p.nextToken()
+	case vm.JMP, vm.IJE, vm.IJNE, vm.FJNE, vm.FJE, vm.TRY, vm.FORITER:
+		if p.currentToken.Type != IDENT {
+			p.errors = append(p.errors, fmt.Sprintf("jump requires label operand, got %v at line %d", p.currentToken.Type, p.currentToken.Line))
+			p.nextToken()
+			return nil
+		}
+		instr.Operands = append(instr.Operands, p.currentToken)
+		p.nextToken()
+		if opcode != vm.JMP && opcode != vm.TRY && opcode != vm.FORITER {
+			isConstant := p.isConstant(p.currentToken) && (opcode == vm.IJE || opcode == vm.IJNE)
+			if !isConstant && p.currentToken.Type != INT && p.currentToken.Type != FLOAT {
+				p.errors = append(p.errors, fmt.Sprintf("conditional jump requires value operand, got %v at line %d", p.currentToken.Type, p.currentToken.Line))
+				return nil
+			}
+			instr.Operands = append(instr.Operands, p.currentToken)
+			p.nextToken()
+		}
+	case vm.CALL:
+		if p.currentToken.Type != IDENT {
+			p.errors = append(p.errors, fmt.Sprintf("call requires function name, got %v at line %d", p.currentToken.Type, p.currentToken.Line))
+			p.nextToken()
+			return nil
+		}
+		instr.Operands = append(instr.Operands, p.currentToken)
+		p.nextToken()
+	case vm.STRALLOC:
+		if p.currentToken.Type != STRING {
+			p.errors = append(p.errors, fmt.Sprintf("stralloc requires string literla, got %v at line %d", p.currentToken.Type, p.currentToken.Line))
+			p.nextToken()
+			return nil
+		}
+		instr.Operands = append(instr.Operands, p.currentToken)
+		p.nextToken()
+	case vm.NEWSTRUCT:
+		if p.currentToken.Type != IDENT {
+			p.errors = append(p.errors, fmt.Sprintf("new struct requires struct name, got %v at line %d", p.currentToken.Type, p.currentToken.Line))
+			p.nextToken()
+			return nil
+		}
+		instr.Operands = append(instr.Operands, p.currentToken)
+		p.nextToken()
+	case vm.STFIELD, vm.FLDGET:
+		if p.currentToken.Type != STRING {
+			p.errors = append(p.errors, fmt.Sprintf("field access requires field name, got %v at line %d", p.currentToken.Type, p.currentToken.Line))
+			p.nextToken()
+			return nil
+		}
+		instr.Operands = append(instr.Operands, p.currentToken)
+		p.nextToken()
+	case vm.NEWARR:
+		if p.currentToken.Type != FLOAT32 && p.currentToken.Type != INT32 && p.currentToken.Type != BYTE_TYPE {
+			p.errors = append(p.errors, fmt.Sprintf("newarr requires type operand, got %v at line %d", p.currentToken.Type, p.currentToken.Line))
+			p.nextToken()
+			return nil
+		}
+		instr.Operands = append(instr.Operands, p.currentToken)
+		p.nextToken()
+	case vm.MAKECLOSURE:
+		if p.currentToken.Type != IDENT {
+			p.errors = append(p.errors, fmt.Sprintf("makeclosure requires function name, got %v at line %d", p.currentToken.Type, p.currentToken.Line))
+			p.nextToken()
+			return nil
+		}
+		instr.Operands = append(instr.Operands, p.currentToken)
+		p.nextToken()
+		if p.currentToken.Type != INT {
+			p.errors = append(p.errors, fmt.Sprintf("makeclosure requires the number of captured values, got %v at line %d", p.currentToken.Type, p.currentToken.Line))
+			p.nextToken()
+			return nil
+		}
+		instr.Operands = append(instr.Operands, p.currentToken)
+		p.nextToken()
+	case vm.INVOKEINTERFACE:
+		if p.currentToken.Type != IDENT || !strings.Contains(p.currentToken.Literal, ".") {
+			p.errors = append(p.errors, fmt.Sprintf("invokeinterface requires an Interface.method operand, got %v at line %d", p.currentToken.Type, p.currentToken.Line))
+			p.nextToken()
+			return nil
+		}
+		instr.Operands = append(instr.Operands, p.currentToken)
+		p.nextToken()
+	case vm.CHECKCAST, vm.INSTANCEOF:
+		// a struct name, string, or an array type such as int32[]
+		switch p.currentToken.Type {
+		case IDENT, STRING_TYPE:
+		case INT32, FLOAT32:
+			if p.peekToken.Type != LBRACKET {
+				p.errors = append(p.errors, fmt.Sprintf("%v requires a struct, string or array type, got %v at line %d", instr.Token.Literal, p.currentToken.Type, p.currentToken.Line))
+				p.nextToken()
+				return nil
+			}
+		default:
+			p.errors = append(p.errors, fmt.Sprintf("%v requires a type, got %v at line %d", instr.Token.Literal, p.currentToken.Type, p.currentToken.Line))
+			p.nextToken()
+			return nil
+		}
+		instr.Operands = append(instr.Operands, p.currentToken)
+		if p.peekToken.Type == LBRACKET {
+			p.nextToken()
+			instr.Operands = append(instr.Operands, p.currentToken)
+			if !p.expectToken(RBRACKET) {
+				p.errors = append(p.errors, fmt.Sprintf("expected ], got %v at line %d", p.peekToken.Type, p.peekToken.Line))
+				p.nextToken()
+				return nil
+			}
+		}
+		p.nextToken()
+	case vm.POP, vm.DUP, vm.IADD, vm.ISUB, vm.IMUL, vm.IDIV, vm.FADD, vm.FSUB, vm.FMUL, vm.FDIV, vm.ALLOC, vm.FREE, vm.LOADH, vm.STOREH, vm.EQ, vm.NE, vm.LT, vm.LE, vm.GT, vm.GE, vm.LDELEM, vm.STELEM, vm.SLICE, vm.ARR_CLONE:
+		return instr
+	case vm.HALT, vm.RET, vm.RETV, vm.THROW, vm.ENDTRY, vm.CALLCLOSURE, vm.AWAIT:
+		return instr
+	case vm.SYSCALL:
+		if p.currentToken.Type == INT {
+			if value, err := strconv.ParseUint(p.currentToken.Literal, 10, 16); err != nil || value > 65535 {
+				p.errors = append(p.errors, fmt.Sprintf("invalid syscall number %s at line %d", p.currentToken.Literal, p.currentToken.Line))
+				p.nextToken()
+				return nil
+			}
+			instr.Operands = append(instr.Operands, p.currentToken)
+			p.nextToken()
+		} else if value, exists := syscallValues[p.currentToken.Type]; exists {
+			token := Token{
+				Type:    INT,
+				Literal: fmt.Sprintf("%d", value),
+				Line:    p.currentToken.Line,
+				Column:  p.currentToken.Column,
+			}
+			instr.Operands = append(instr.Operands, token)
+			p.nextToken()
+		} else {
+			p.errors = append(p.errors, fmt.Sprintf("expected syscall name or number, got %v at line %d", p.currentToken.Type, p.currentToken.Line))
+			p.nextToken()
+			return nil
+		}
+	default:
+		p.errors = append(p.errors, fmt.Sprintf("unkown instruction %v at line %d", opcode, p.currentToken.Line))
+		p.nextToken()
+	}
+	return instr
+}
+
+// parseExtension parses an instruction of an extension defined with
+// vm.DefineExtension, one operand token for each operand of its definition
+func (p *Parser) parseExtension(info vm.OpcodeInfo) *Instruction {
+	instr := &Instruction{
+		Token:  p.currentToken,
+		Opcode: info.Opcode,
+	}
+	p.nextToken()
+	for _, operand := range info.Operands {
+		var ok bool
+		switch operand.Type {
+		case vm.OperandFloat32:
+			ok = p.currentToken.Type == FLOAT || p.currentToken.Type == INT
+		case vm.OperandKind:
+			ok = p.currentToken.Type == INT32 || p.currentToken.Type == FLOAT32 || p.currentToken.Type == STRING_TYPE || p.currentToken.Type == BYTE_TYPE
+		case vm.OperandString:
+			ok = p.currentToken.Type == STRING
+		default:
+			ok = p.currentToken.Type == INT
+		}
+		if !ok {
+			p.errors = append(p.errors, fmt.Sprintf("%s requires %s operand %s, got %v at line %d", info.Mnemonic, operand.Type, operand.Name, p.currentToken.Type, p.currentToken.Line))
+			p.nextToken()
+			return nil
+		}
+		instr.Operands = append(instr.Operands, p.currentToken)
+		p.nextToken()
+	}
+	return instr
+}
@@ -1,9 +1,12 @@
-package assembler
+package asm
 
 import (
-	. "stack_vm/common"
+	. "github.com/AndreiAlbert/gvm/common"
+	"reflect"
 	"strings"
 	"testing"
+
+	"github.com/AndreiAlbert/gvm/vm"
 )
 
 func TestParseStructDefinition(t *testing.T) {
@@ -66,6 +69,97 @@ func TestParseStructDefinition(t *testing.T) {
 	}
 }
 
+func TestParseInterface(t *testing.T) {
+	input := `.structs
+        struct Square {
+            side: int32
+        }
+        interface Shape {
+            area() -> int32
+            scale(factor: int32) -> int32
+        }
+    .text
+        func Square.area() -> int32 {
+            fldget "side"
+            ret
+        }
+        func main() -> void {
+            newstruct Square
+            invokeinterface Shape.area
+        }`
+	program, err := NewParser(NewLexer(input)).Parse()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(program.Interfaces) != 1 || len(program.Interfaces[0].Methods) != 2 {
+		t.Fatalf("expected interface Shape with 2 methods, got %+v", program.Interfaces)
+	}
+	if scale := program.Interfaces[0].Methods[1]; scale.Name != "scale" || len(scale.Params) != 1 || scale.ReturnType != ValueInt32 {
+		t.Errorf("unexpected method %+v", scale)
+	}
+	// methods take the receiver as an implicit first parameter
+	area := program.Functions[0]
+	if len(area.Params) != 1 || area.Params[0].Name != "self" || area.Params[0].Type != ValuePtr {
+		t.Errorf("expected Square.area to take the receiver, got %v", area.Params)
+	}
+	if len(program.Functions[1].Params) != 0 {
+		t.Errorf("expected main to take no parameters, got %v", program.Functions[1].Params)
+	}
+}
+
+func TestParseEnum(t *testing.T) {
+	input := `.enum Color { RED GREEN BLUE }
+    .enum Level { LOW: 10, HIGH }
+    .structs
+        struct Light {
+            color: Color
+        }
+    .text
+        func main() -> void {
+            push int32 Color.BLUE
+            ije done HIGH
+        done:
+        }`
+	program, err := NewParser(NewLexer(input)).Parse()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := []Enum{
+		{Name: "Color", Members: []EnumMember{{"RED", 0}, {"GREEN", 1}, {"BLUE", 2}}, Pos: Pos{1, 1}},
+		{Name: "Level", Members: []EnumMember{{"LOW", 10}, {"HIGH", 11}}, Pos: Pos{2, 5}},
+	}
+	if !reflect.DeepEqual(program.Enums, want) {
+		t.Errorf("expected enums %+v, got %+v", want, program.Enums)
+	}
+	if color := program.Structs[0].Fields[0]; color.Type != ValueInt32 || color.Enum != "Color" {
+		t.Errorf("expected an int32 field of enum Color, got %+v", color)
+	}
+	body := program.Functions[0].Body
+	if body[0].Operands[1].Literal != "Color.BLUE" || body[1].Operands[1].Literal != "HIGH" {
+		t.Errorf("expected enum constant operands, got %v and %v", body[0].Operands, body[1].Operands)
+	}
+
+	if _, err := NewParser(NewLexer(".enum Color { RED: GREEN }")).Parse(); err == nil {
+		t.Error("expected a member value that isn't an integer to fail")
+	}
+}
+
+func TestParseStructParameter(t *testing.T) {
+	input := `.text
+        func bump(counter: Counter, step: int32) -> int32 {
+            ret
+        }`
+	program, err := NewParser(NewLexer(input)).Parse()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// a parameter typed with a struct name holds a pointer
+	want := []ParsedParam{{Name: "counter", Type: ValuePtr}, {Name: "step", Type: ValueInt32}}
+	if params := program.Functions[0].Params; !reflect.DeepEqual(params, want) {
+		t.Errorf("expected parameters %v, got %v", want, params)
+	}
+}
+
 func TestParseFunctionDefinition(t *testing.T) {
 	tests := []struct {
 		name    string
@@ -210,6 +304,23 @@ func TestParseInstructions(t *testing.T) {
                     }`,
 			wantErr: false,
 		},
+		{
+			name: "valid push string",
+			input: `.text
+                    func test() -> void {
+                        push string "hello"
+                    }`,
+			wantErr: false,
+		},
+		{
+			name: "invalid push string without literal",
+			input: `.text
+                    func test() -> void {
+                        push string 42
+                    }`,
+			wantErr: true,
+			errMsg:  "push string requires string literal",
+		},
 		{
 			name: "valid array creation",
 			input: `.text
@@ -263,6 +374,20 @@ func TestParseInstructions(t *testing.T) {
 	}
 }
 
+func TestPushStringIsStralloc(t *testing.T) {
+	program, err := NewParser(NewLexer(`.text
+    func main() -> void {
+        push string "hello"
+    }`)).Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	inst := program.Functions[0].Body[0]
+	if inst.Opcode != vm.STRALLOC || len(inst.Operands) != 1 || inst.Operands[0].Literal != "hello" {
+		t.Errorf("Expected stralloc \"hello\", got %v %v", inst.Opcode, inst.Operands)
+	}
+}
+
 func TestCompleteProgramParsing(t *testing.T) {
 	input := `.structs
         struct Point {
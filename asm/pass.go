@@ -0,0 +1,81 @@
+package asm
+
+import "fmt"
+
+// Pass transforms a parsed program before code is generated for it, such
+// as a macro expander or a pass injecting instrumentation. An error stops
+// the assembly.
+type Pass func(program *Program) error
+
+// AddPass registers pass to run on the parsed program before code
+// generation. Passes run in the order they were added.
+func (a *Assembler) AddPass(pass Pass) {
+	a.passes = append(a.passes, pass)
+}
+
+// runPasses applies the registered passes to program
+func (a *Assembler) runPasses(program *Program) error {
+	for i, pass := range a.passes {
+		if err := pass(program); err != nil {
+			return fmt.Errorf("pass %d: %w", i+1, err)
+		}
+	}
+	return nil
+}
+
+// Insert adds insts to the body of f before the instruction at index, or at
+// the end for index len(f.Body). Labels of later instructions move with
+// them, a label of the instruction at index now precedes the inserted ones,
+// so jumps to it run them too.
+func (f *ParsedFunction) Insert(index int, insts ...Instruction) {
+	if index < 0 || index > len(f.Body) {
+		panic(fmt.Sprintf("asm: inserting at %d into %s, which has %d instructions", index, f.Name, len(f.Body)))
+	}
+	f.Body = append(f.Body[:index], append(append([]Instruction(nil), insts...), f.Body[index:]...)...)
+	for name, target := range f.Labels {
+		if target > index {
+			f.Labels[name] = target + len(insts)
+		}
+	}
+}
+
+// ParseInstructions parses source holding instructions only, without
+// labels, for passes that generate code. Enum constants can't be used as
+// operands. The instructions have no position, so the source map gives
+// them the line of the instruction before them.
+func ParseInstructions(source string) ([]Instruction, error) {
+	program, err := Parse(".text\nfunc instructions() -> void {\n" + source + "\n}")
+	if err != nil {
+		return nil, err
+	}
+	f := program.Functions[0]
+	if len(f.Labels) > 0 {
+		return nil, fmt.Errorf("labels are not allowed in generated instructions")
+	}
+	for i := range f.Body {
+		f.Body[i].Token.Line, f.Body[i].Token.Column = 0, 0
+		for j := range f.Body[i].Operands {
+			f.Body[i].Operands[j].Line, f.Body[i].Operands[j].Column = 0, 0
+		}
+	}
+	return f.Body, nil
+}
+
+// InstrumentCalls is a Pass counting the calls of every function. Each body
+// starts by incrementing the COUNTER_INC counter numbered by the function's
+// index in the function table, see vm.VM.Counters. Labels at the start of
+// a body move past the counter, so loops back to them don't count.
+func InstrumentCalls(program *Program) error {
+	for i := range program.Functions {
+		f := &program.Functions[i]
+		counter, err := ParseInstructions(fmt.Sprintf("push int32 %d\nsyscall counter_inc", i))
+		if err != nil {
+			return err
+		}
+		f.Body = append(counter, f.Body...)
+		for name, target := range f.Labels {
+			f.Labels[name] = target + len(counter)
+		}
+	}
+	return nil
+}
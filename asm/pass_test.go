@@ -0,0 +1,122 @@
+package asm
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/AndreiAlbert/gvm/vm"
+)
+
+func TestPasses(t *testing.T) {
+	source := `.text
+    func main() -> void {
+        push int32 2
+        store 0
+    loop:
+        call work
+        pop
+        load 0
+        push int32 1
+        isub
+        dup
+        store 0
+        ijne loop 0
+        push int32 0
+        ret
+    }
+    func work() -> int32 {
+        push int32 119
+        syscall write_byte
+        push int32 0
+        ret
+    }`
+	counter, err := ParseInstructions("push int32 99\nsyscall write_byte")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assembler := NewAssembler(source)
+	// report every call before making it
+	assembler.AddPass(func(program *Program) error {
+		for i := range program.Functions {
+			f := &program.Functions[i]
+			for j := len(f.Body) - 1; j >= 0; j-- {
+				if f.Body[j].Opcode == vm.CALL {
+					f.Insert(j, counter...)
+				}
+			}
+		}
+		return nil
+	})
+	program, err := assembler.Assemble()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	machine, err := vm.NewVmFromProgram(program, vm.Options{Stdout: &out})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer machine.Close()
+	if err := machine.Run(); err != nil {
+		t.Fatal(err)
+	}
+	// the loop label precedes the counter, so every iteration runs it
+	if out.String() != "cwcw" {
+		t.Errorf("expected the instrumented output cwcw, got %q", out.String())
+	}
+	// generated instructions take the line of the store before them
+	if line, ok := program.LineFor(uint(program.Functions[0].Address) + 9); !ok || line != 4 {
+		t.Errorf("expected the counter to map to line 4, got %d", line)
+	}
+
+	failing := NewAssembler(source)
+	errPass := errors.New("rejected")
+	failing.AddPass(func(*Program) error { return errPass })
+	if _, err := failing.Assemble(); !errors.Is(err, errPass) {
+		t.Errorf("expected the error of the pass, got %v", err)
+	}
+	if _, err := ParseInstructions("top:\njmp top"); err == nil {
+		t.Error("expected generated instructions with labels to fail")
+	}
+}
+
+func TestInstrumentCalls(t *testing.T) {
+	source := `.text
+    func main() -> void {
+        push int32 3
+        call countdown
+        pop
+        push int32 2
+        call countdown
+        pop
+        push int32 0
+        ret
+    }
+    func countdown(n: int32) -> int32 {
+    top:
+        push int32 1
+        isub
+        dup
+        ijne top 0
+        ret
+    }`
+	assembler := NewAssembler(source)
+	assembler.AddPass(InstrumentCalls)
+	program, err := assembler.Assemble()
+	if err != nil {
+		t.Fatal(err)
+	}
+	machine, err := vm.NewVmFromProgram(program, vm.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer machine.Close()
+	if err := machine.Run(); err != nil {
+		t.Fatal(err)
+	}
+	// jumping back to the label at the start of countdown doesn't count
+	if counters := machine.Counters(); counters[0] != 1 || counters[1] != 2 || len(counters) != 2 {
+		t.Errorf("expected main called once and countdown twice, got %v", counters)
+	}
+}
@@ -0,0 +1,31 @@
+package asm
+
+import "strings"
+
+// WrapMain returns the source of a program whose main runs snippet and
+// halts, leaving the values the snippet pushed on the stack of main. The
+// instructions of the snippet are separated by newlines or semicolons, so
+// it can't hold comments. Semicolons inside string literals don't
+// separate.
+func WrapMain(snippet string) string {
+	var b strings.Builder
+	b.WriteString(".text\nfunc main() -> void {\n")
+	inString := false
+	for i := 0; i < len(snippet); i++ {
+		switch c := snippet[i]; {
+		case c == '"':
+			inString = !inString
+			b.WriteByte(c)
+		case c == '\\' && inString && i+1 < len(snippet):
+			b.WriteByte(c)
+			i++
+			b.WriteByte(snippet[i])
+		case c == ';' && !inString:
+			b.WriteByte('\n')
+		default:
+			b.WriteByte(c)
+		}
+	}
+	b.WriteString("\nhalt\n}\n")
+	return b.String()
+}
@@ -0,0 +1,30 @@
+package asm
+
+import (
+	"testing"
+
+	"github.com/AndreiAlbert/gvm/vm"
+)
+
+func TestWrapMain(t *testing.T) {
+	program, err := NewAssembler(WrapMain(`push int32 2; push int32 3; iadd; stralloc "a;b"`)).Assemble()
+	if err != nil {
+		t.Fatal(err)
+	}
+	machine, err := vm.NewVmFromProgram(program, vm.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer machine.Close()
+	if err := machine.Run(); err != nil {
+		t.Fatal(err)
+	}
+	stack := machine.CallStack[len(machine.CallStack)-1].LocalStack
+	if len(stack) != 2 || stack[0].AsInt32() != 5 {
+		t.Fatalf("expected the sum and a string on the stack, got %v", stack)
+	}
+	// the semicolon in the literal doesn't end the instruction
+	if s, err := machine.Heap.LoadString(stack[1].AsPtr()); err != nil || s != "a;b" {
+		t.Errorf("expected the string a;b, got %q (%v)", s, err)
+	}
+}
@@ -0,0 +1,443 @@
+package asm
+
+import "fmt"
+
+// TokenType identifies the kind of a token.
+type TokenType int
+
+const (
+	ILLEGAL TokenType = iota
+	EOF
+
+	// Single-character tokens
+	COLON     // :
+	SEMICOLON // ;
+	LPAREN    // (
+	RPAREN    // )
+	LBRACE    // {
+	RBRACE    // }
+	COMMA     // ,
+	ARROW     // ->
+	LBRACKET  // [
+	RBRACKET  // ]
+
+	//Keywords
+	FUNC
+	STRUCT
+	INTERFACE
+	ENUM
+	INT32
+	FLOAT32
+	STRING_TYPE
+	BYTE_TYPE
+	VOID
+	RETURN
+
+	// System instructions
+	HALT
+	SYSCALL
+
+	// Stack and memory instructions
+	PUSH
+	POP
+	DUP
+	STORE
+	LOAD
+	ALLOC
+	FREE
+	LOADH
+	STOREH
+
+	// Arithmetic instructions
+	IADD
+	ISUB
+	IMUL
+	IDIV
+	FADD
+	FSUB
+	FMUL
+	FDIV
+
+	// Comparison instructions
+	EQ
+	NE
+	LT
+	LE
+	GT
+	GE
+
+	// Control flow instructions
+	JMP
+	IJE
+	IJNE
+	FJE
+	FJNE
+	CALL
+	RET
+	RETV
+	THROW
+	TRY
+	ENDTRY
+
+	// Array instructions
+	NEWARR
+	LDELEM
+	STELEM
+	SLICE
+	ARR_CLONE
+
+	// String instructions
+	STRALLOC
+	SYSCALL_STR_LEN
+	SYSCALL_STR_CAT
+	SYSCALL_STR_EQUALS
+	SYSCALL_WRITE_BYTE
+	SYSCALL_READ_BYTE
+	SYSCALL_BACKTRACE
+	SYSCALL_ERR_NEW
+	SYSCALL_ERR_WRAP
+	SYSCALL_SUBSTR_VIEW
+	SYSCALL_STR_SET_BYTE
+	SYSCALL_PRINT_FLOAT
+	SYSCALL_GC_HINT
+	SYSCALL_GET_ENV
+	SYSCALL_COUNTER_INC
+	SYSCALL_PRINT_ANY
+	SYSCALL_LOG_DEBUG
+	SYSCALL_LOG_INFO
+	SYSCALL_LOG_WARN
+	SYSCALL_LOG_ERROR
+	SYSCALL_ASSERT_EQ
+	SYSCALL_ASSERT_NEAR
+	SYSCALL_BUILD_INFO
+	SYSCALL_BUF_GET_I32
+	SYSCALL_BUF_GET_F32
+	SYSCALL_BUF_PUT_I32
+	SYSCALL_BUF_PUT_F32
+	SYSCALL_MMAP_FILE
+	SYSCALL_ON_SOFT_LIMIT
+	SYSCALL_YIELD_HOST
+	SYSCALL_ARGV
+	SYSCALL_OPT_PARSE
+	SYSCALL_CSV_PARSE
+	SYSCALL_CSV_WRITE
+	SYSCALL_TIME_NOW_STRUCT
+	SYSCALL_TIME_FORMAT
+	SYSCALL_TIME_PARSE
+
+	// Struct instructions
+	NEWSTRUCT
+	FLDGET
+	STFIELD
+
+	// Type instructions
+	CHECKCAST
+	INSTANCEOF
+	INVOKEINTERFACE
+
+	// Closure instructions
+	MAKECLOSURE
+	CALLCLOSURE
+
+	// Iteration instructions
+	FORITER
+
+	// Native instructions
+	AWAIT
+
+	// Identifiers and literals
+	IDENT  // variables, labels
+	INT    // 123
+	FLOAT  // 123.45
+	STRING // "abc"
+
+	// Sections
+	SECTION_TEXT
+	SECTION_STRUCTS // Only need text and structs sections
+	SECTION_NATIVES // native func declarations of host functions
+	NATIVE
+	ASYNC
+
+	// Directives
+	IMPORT // .import "library"
+)
+
+// Token is a lexical token with its source position.
+type Token struct {
+	Type    TokenType
+	Literal string
+	Line    uint
+	Column  uint
+}
+
+// creates new token
+func newToken(tokType TokenType, literal string, line uint, column uint) Token {
+	return Token{Type: tokType, Literal: literal, Line: line, Column: column}
+}
+
+var keywords = map[string]TokenType{
+	"func":      FUNC,
+	"struct":    STRUCT,
+	"interface": INTERFACE,
+	".enum":     ENUM,
+	"int32":     INT32,
+	"float32":   FLOAT32,
+	"void":      VOID,
+	"return":    RETURN,
+	".text":     SECTION_TEXT,
+	".structs":  SECTION_STRUCTS,
+	".import":   IMPORT,
+	".natives":  SECTION_NATIVES,
+	"native":    NATIVE,
+	"async":     ASYNC,
+	"string":    STRING_TYPE,
+	"byte":      BYTE_TYPE,
+	// Syscall keywords
+	"str_len":         SYSCALL_STR_LEN,
+	"str_cat":         SYSCALL_STR_CAT,
+	"str_equals":      SYSCALL_STR_EQUALS,
+	"write_byte":      SYSCALL_WRITE_BYTE,
+	"read_byte":       SYSCALL_READ_BYTE,
+	"backtrace":       SYSCALL_BACKTRACE,
+	"err_new":         SYSCALL_ERR_NEW,
+	"err_wrap":        SYSCALL_ERR_WRAP,
+	"substr_view":     SYSCALL_SUBSTR_VIEW,
+	"str_set_byte":    SYSCALL_STR_SET_BYTE,
+	"print_float":     SYSCALL_PRINT_FLOAT,
+	"gc_hint":         SYSCALL_GC_HINT,
+	"get_env":         SYSCALL_GET_ENV,
+	"counter_inc":     SYSCALL_COUNTER_INC,
+	"print_any":       SYSCALL_PRINT_ANY,
+	"log_debug":       SYSCALL_LOG_DEBUG,
+	"log_info":        SYSCALL_LOG_INFO,
+	"log_warn":        SYSCALL_LOG_WARN,
+	"log_error":       SYSCALL_LOG_ERROR,
+	"assert_eq":       SYSCALL_ASSERT_EQ,
+	"assert_near":     SYSCALL_ASSERT_NEAR,
+	"build_info":      SYSCALL_BUILD_INFO,
+	"buf_get_i32":     SYSCALL_BUF_GET_I32,
+	"buf_get_f32":     SYSCALL_BUF_GET_F32,
+	"buf_put_i32":     SYSCALL_BUF_PUT_I32,
+	"buf_put_f32":     SYSCALL_BUF_PUT_F32,
+	"mmap_file":       SYSCALL_MMAP_FILE,
+	"on_soft_limit":   SYSCALL_ON_SOFT_LIMIT,
+	"yield_host":      SYSCALL_YIELD_HOST,
+	"argv":            SYSCALL_ARGV,
+	"opt_parse":       SYSCALL_OPT_PARSE,
+	"csv_parse":       SYSCALL_CSV_PARSE,
+	"csv_write":       SYSCALL_CSV_WRITE,
+	"time_now_struct": SYSCALL_TIME_NOW_STRUCT,
+	"time_format":     SYSCALL_TIME_FORMAT,
+	"time_parse":      SYSCALL_TIME_PARSE,
+}
+
+var instructions = map[string]TokenType{
+	// System
+	"halt":    HALT,
+	"syscall": SYSCALL,
+
+	// Stack operations
+	"push": PUSH,
+	"pop":  POP,
+	"dup":  DUP,
+
+	// Memory operations
+	"store":  STORE,
+	"load":   LOAD,
+	"alloc":  ALLOC,
+	"free":   FREE,
+	"loadh":  LOADH,
+	"storeh": STOREH,
+
+	// Integer arithmetic
+	"iadd": IADD,
+	"isub": ISUB,
+	"imul": IMUL,
+	"idiv": IDIV,
+
+	// Float arithmetic
+	"fadd": FADD,
+	"fsub": FSUB,
+	"fmul": FMUL,
+	"fdiv": FDIV,
+
+	// Comparisons
+	"eq": EQ,
+	"ne": NE,
+	"lt": LT,
+	"le": LE,
+	"gt": GT,
+	"ge": GE,
+
+	// Control flow
+	"jmp":    JMP,
+	"ije":    IJE,
+	"ijne":   IJNE,
+	"fje":    FJE,
+	"fjne":   FJNE,
+	"call":   CALL,
+	"ret":    RET,
+	"retv":   RETV,
+	"throw":  THROW,
+	"try":    TRY,
+	"endtry": ENDTRY,
+
+	// Arrays
+	"newarr":    NEWARR,
+	"ldelem":    LDELEM,
+	"stelem":    STELEM,
+	"slice":     SLICE,
+	"arr_clone": ARR_CLONE,
+
+	// Strings
+	"stralloc": STRALLOC,
+
+	// Structs
+	"newstruct": NEWSTRUCT,
+	"fldget":    FLDGET,
+	"stfield":   STFIELD,
+
+	// Types
+	"checkcast":  CHECKCAST,
+	"instanceof": INSTANCEOF,
+
+	// Interfaces
+	"invokeinterface": INVOKEINTERFACE,
+
+	// Closures
+	"makeclosure": MAKECLOSURE,
+	"callclosure": CALLCLOSURE,
+
+	// Iteration
+	"foriter": FORITER,
+
+	// Natives
+	"await": AWAIT,
+}
+
+// Add a map to convert syscall token types to their numeric values
+var syscallValues = map[TokenType]uint16{
+	SYSCALL_STR_LEN:         0,  // STR_LEN
+	SYSCALL_STR_CAT:         1,  // STR_CAT
+	SYSCALL_STR_EQUALS:      2,  // STR_EQUALS
+	SYSCALL_WRITE_BYTE:      3,  // WRITE_BYTE
+	SYSCALL_READ_BYTE:       4,  // READ_BYTE
+	SYSCALL_BACKTRACE:       5,  // BACKTRACE
+	SYSCALL_ERR_NEW:         6,  // ERR_NEW
+	SYSCALL_ERR_WRAP:        7,  // ERR_WRAP
+	SYSCALL_SUBSTR_VIEW:     8,  // SUBSTR_VIEW
+	SYSCALL_STR_SET_BYTE:    9,  // STR_SET_BYTE
+	SYSCALL_PRINT_FLOAT:     10, // PRINT_FLOAT
+	SYSCALL_GC_HINT:         11, // GC_HINT
+	SYSCALL_GET_ENV:         12, // GET_ENV
+	SYSCALL_COUNTER_INC:     13, // COUNTER_INC
+	SYSCALL_PRINT_ANY:       14, // PRINT_ANY
+	SYSCALL_LOG_DEBUG:       15, // LOG_DEBUG
+	SYSCALL_LOG_INFO:        16, // LOG_INFO
+	SYSCALL_LOG_WARN:        17, // LOG_WARN
+	SYSCALL_LOG_ERROR:       18, // LOG_ERROR
+	SYSCALL_ASSERT_EQ:       19, // ASSERT_EQ
+	SYSCALL_ASSERT_NEAR:     20, // ASSERT_NEAR
+	SYSCALL_BUILD_INFO:      21, // BUILD_INFO
+	SYSCALL_BUF_GET_I32:     22, // BUF_GET_I32
+	SYSCALL_BUF_GET_F32:     23, // BUF_GET_F32
+	SYSCALL_BUF_PUT_I32:     24, // BUF_PUT_I32
+	SYSCALL_BUF_PUT_F32:     25, // BUF_PUT_F32
+	SYSCALL_MMAP_FILE:       26, // MMAP_FILE
+	SYSCALL_ON_SOFT_LIMIT:   27, // ON_SOFT_LIMIT
+	SYSCALL_YIELD_HOST:      28, // YIELD_HOST
+	SYSCALL_ARGV:            29, // ARGV
+	SYSCALL_OPT_PARSE:       30, // OPT_PARSE
+	SYSCALL_CSV_PARSE:       31, // CSV_PARSE
+	SYSCALL_CSV_WRITE:       32, // CSV_WRITE
+	SYSCALL_TIME_NOW_STRUCT: 33, // TIME_NOW_STRUCT
+	SYSCALL_TIME_FORMAT:     34, // TIME_FORMAT
+	SYSCALL_TIME_PARSE:      35, // TIME_PARSE
+}
+
+// String returns the mnemonic for instruction tokens and the token name
+// otherwise.
+func (t TokenType) String() string {
+	var reverseInstructions map[TokenType]string
+	reverseInstructions = make(map[TokenType]string)
+	for name, tokType := range instructions {
+		reverseInstructions[tokType] = name
+	}
+	switch t {
+	case ILLEGAL:
+		return "ILLEGAL"
+	case EOF:
+		return "EOF"
+	case IDENT:
+		return "IDENT"
+	case INT:
+		return "INT"
+	case FLOAT:
+		return "FLOAT"
+	case STRING:
+		return "STRING"
+	case COLON:
+		return "COLON"
+	case SEMICOLON:
+		return "SEMICOLON"
+	case LPAREN:
+		return "LPAREN"
+	case RPAREN:
+		return "RPAREN"
+	case LBRACE:
+		return "LBRACE"
+	case RBRACE:
+		return "RBRACE"
+	case COMMA:
+		return "COMMA"
+	case ARROW:
+		return "ARROW"
+	case FUNC:
+		return "FUNC"
+	case STRUCT:
+		return "STRUCT"
+	case INTERFACE:
+		return "INTERFACE"
+	case ENUM:
+		return "ENUM"
+	case INT32:
+		return "INT32"
+	case FLOAT32:
+		return "FLOAT32"
+	case VOID:
+		return "VOID"
+	case RETURN:
+		return "RETURN"
+	case SECTION_TEXT:
+		return "SECTION_TEXT"
+	case SECTION_STRUCTS:
+		return "SECTION_STRUCTS"
+	case SECTION_NATIVES:
+		return "SECTION_NATIVES"
+	case NATIVE:
+		return "NATIVE"
+	case ASYNC:
+		return "ASYNC"
+	case IMPORT:
+		return "IMPORT"
+	case STRING_TYPE:
+		return "STRING_TYPE"
+	case LBRACKET:
+		return "LBRACKET"
+	case RBRACKET:
+		return "RBRACKET"
+	case BYTE_TYPE:
+		return "BYTE_TYPE"
+	default:
+		if instr, exists := reverseInstructions[t]; exists {
+			return instr
+		}
+		return fmt.Sprintf("TokenType(%d)", t)
+	}
+}
+
+// String formats the token for debugging.
+func (t Token) String() string {
+	return fmt.Sprintf("{Type: %v, Literal: %q, Line: %d, Column: %d}",
+		t.Type, t.Literal, t.Line, t.Column)
+}
@@ -0,0 +1,133 @@
+package asm
+
+import (
+	"fmt"
+	"sort"
+
+	. "github.com/AndreiAlbert/gvm/common"
+)
+
+// Pos is a position in the source, lines and columns start at 1. The zero
+// Pos is unknown, as for nodes built by hand.
+type Pos struct {
+	Line   uint
+	Column uint
+}
+
+// String returns the position as line:column.
+func (pos Pos) String() string {
+	return fmt.Sprintf("%d:%d", pos.Line, pos.Column)
+}
+
+// tokenPos returns where tok starts
+func tokenPos(tok Token) Pos {
+	return Pos{Line: tok.Line, Column: tok.Column}
+}
+
+// Pos returns where the instruction's mnemonic starts.
+func (i *Instruction) Pos() Pos {
+	return tokenPos(i.Token)
+}
+
+// Parse lexes and parses source without generating code, for tools that
+// only analyze programs. Unlike Assemble it doesn't resolve labels, names
+// or types, so a program it accepts can still fail to assemble.
+func Parse(source string) (*Program, error) {
+	return NewParser(NewLexer(source)).Parse()
+}
+
+// Visitor receives the parts of a program from Walk. Nil fields are
+// skipped.
+type Visitor struct {
+	Struct    func(s *StructType, pos Pos)
+	Interface func(i *Interface)
+	Enum      func(e *Enum)
+	// Function is called before the body of f, which is skipped when it
+	// returns false.
+	Function func(f *ParsedFunction) bool
+	// Label is called for a label of f before the instruction at index it
+	// precedes, or after the body for a label at its end.
+	Label       func(f *ParsedFunction, name string, index int)
+	Instruction func(f *ParsedFunction, index int, inst *Instruction)
+}
+
+// Walk calls visitor for the declarations of program in source order,
+// visiting the labels and instructions of every function after it. The
+// callbacks may change the nodes they get, but not add or remove any.
+func Walk(program *Program, visitor Visitor) {
+	type declaration struct {
+		pos   Pos
+		visit func()
+	}
+	var declarations []declaration
+	for i := range program.Structs {
+		s, pos := &program.Structs[i], program.structPos(i)
+		declarations = append(declarations, declaration{pos, func() {
+			if visitor.Struct != nil {
+				visitor.Struct(s, pos)
+			}
+		}})
+	}
+	for i := range program.Interfaces {
+		iface := &program.Interfaces[i]
+		declarations = append(declarations, declaration{iface.Pos, func() {
+			if visitor.Interface != nil {
+				visitor.Interface(iface)
+			}
+		}})
+	}
+	for i := range program.Enums {
+		enum := &program.Enums[i]
+		declarations = append(declarations, declaration{enum.Pos, func() {
+			if visitor.Enum != nil {
+				visitor.Enum(enum)
+			}
+		}})
+	}
+	for i := range program.Functions {
+		f := &program.Functions[i]
+		declarations = append(declarations, declaration{f.Pos, func() { walkFunction(f, visitor) }})
+	}
+	sort.SliceStable(declarations, func(i, j int) bool {
+		a, b := declarations[i].pos, declarations[j].pos
+		return a.Line < b.Line || a.Line == b.Line && a.Column < b.Column
+	})
+	for _, d := range declarations {
+		d.visit()
+	}
+}
+
+func walkFunction(f *ParsedFunction, visitor Visitor) {
+	if visitor.Function != nil && !visitor.Function(f) {
+		return
+	}
+	// labels by the instruction they precede, in name order when several do
+	labels := make(map[int][]string)
+	for name, index := range f.Labels {
+		labels[index] = append(labels[index], name)
+	}
+	visitLabels := func(index int) {
+		names := labels[index]
+		sort.Strings(names)
+		for _, name := range names {
+			if visitor.Label != nil {
+				visitor.Label(f, name, index)
+			}
+		}
+	}
+	for i := range f.Body {
+		visitLabels(i)
+		if visitor.Instruction != nil {
+			visitor.Instruction(f, i, &f.Body[i])
+		}
+	}
+	visitLabels(len(f.Body))
+}
+
+// structPos returns where Structs[i] is declared
+func (program *Program) structPos(i int) Pos {
+	if i < len(program.StructPos) {
+		return program.StructPos[i]
+	}
+	return Pos{}
+}
@@ -0,0 +1,68 @@
+package asm
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	. "github.com/AndreiAlbert/gvm/common"
+)
+
+func TestWalk(t *testing.T) {
+	input := `.text
+    func helper() -> void {
+        ret
+    }
+.enum Color { RED GREEN }
+.structs
+    struct Point {
+        x: int32
+    }
+.text
+    func main() -> void {
+    top:
+        push int32 1
+        ije top 0
+    done:
+    }`
+	program, err := Parse(input)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var visited []string
+	Walk(program, Visitor{
+		Struct: func(s *StructType, pos Pos) {
+			visited = append(visited, fmt.Sprintf("struct %s at %v", s.Name, pos))
+		},
+		Enum: func(e *Enum) {
+			visited = append(visited, fmt.Sprintf("enum %s at %v", e.Name, e.Pos))
+		},
+		Function: func(f *ParsedFunction) bool {
+			visited = append(visited, fmt.Sprintf("func %s at %v", f.Name, f.Pos))
+			return f.Name == "main"
+		},
+		Label: func(f *ParsedFunction, name string, index int) {
+			visited = append(visited, fmt.Sprintf("label %s before %d", name, index))
+		},
+		Instruction: func(f *ParsedFunction, index int, inst *Instruction) {
+			visited = append(visited, fmt.Sprintf("%v at %v", inst.Token.Literal, inst.Pos()))
+		},
+	})
+	want := []string{
+		"func helper at 2:5",
+		"enum Color at 5:1",
+		"struct Point at 7:5",
+		"func main at 11:5",
+		"label top before 0",
+		"push at 13:9",
+		"ije at 14:9",
+		"label done before 2",
+	}
+	if !reflect.DeepEqual(visited, want) {
+		t.Errorf("expected the walk\n%v\ngot\n%v", want, visited)
+	}
+
+	if _, err := Parse(".text func main( {"); err == nil {
+		t.Error("expected a malformed function to fail")
+	}
+}
@@ -0,0 +1,159 @@
+// Package buildcache stores assembled programs keyed by a hash of their
+// source, so unchanged programs skip re-assembly.
+package buildcache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/AndreiAlbert/gvm/bytecode"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"sync"
+)
+
+// modulePath is the module whose build identifies the assembler
+const modulePath = "github.com/AndreiAlbert/gvm"
+
+// buildID identifies the gvm build, which is part of every key: a gvm
+// built from other sources may assemble the same source differently, so it
+// never sees the entries of another build.
+var buildID = sync.OnceValue(readBuildID)
+
+// readBuildID returns the version of the gvm module for tagged builds, the
+// commit for builds of a clean checkout, and otherwise the hash of the
+// running executable.
+func readBuildID() string {
+	if info, ok := debug.ReadBuildInfo(); ok {
+		module := &info.Main
+		for _, dep := range info.Deps {
+			if dep.Path == modulePath {
+				module = dep
+			}
+		}
+		if module.Path == modulePath && module.Version != "" && module.Version != "(devel)" {
+			return module.Version
+		}
+		var revision, modified string
+		for _, setting := range info.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				revision = setting.Value
+			case "vcs.modified":
+				modified = setting.Value
+			}
+		}
+		if revision != "" && modified == "false" {
+			return revision
+		}
+	}
+	path, err := os.Executable()
+	if err != nil {
+		return ""
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Cache is a directory of assembled containers named by their key.
+type Cache struct {
+	dir string
+}
+
+// Open returns the cache rooted at dir, creating it if needed.
+func Open(dir string) (*Cache, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create cache directory: %w", err)
+	}
+	return &Cache{dir: dir}, nil
+}
+
+// DefaultDir is $GVMCACHE when set, otherwise gvm inside the user cache
+// directory.
+func DefaultDir() (string, error) {
+	if dir := os.Getenv("GVMCACHE"); dir != "" {
+		return dir, nil
+	}
+	base, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(base, "gvm"), nil
+}
+
+// Key hashes every input that affects the assembled output: the sources and
+// the gvm build assembling them.
+func Key(sources ...[]byte) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "gvm-cache-%s-container-%d\n", buildID(), bytecode.Version)
+	for _, source := range sources {
+		fmt.Fprintf(h, "%d\n", len(source))
+		h.Write(source)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (c *Cache) path(key string) string {
+	return filepath.Join(c.dir, key[:2], key+".gvmbc")
+}
+
+// Get loads the cached program for key. A missing or unreadable entry is
+// reported as a miss; callers assemble again and overwrite it.
+func (c *Cache) Get(key string) (*bytecode.Program, bool) {
+	program, err := bytecode.Open(c.path(key))
+	if err != nil {
+		return nil, false
+	}
+	return program, true
+}
+
+// Put stores the program for key. The entry is written to a temporary file
+// and renamed, so concurrent runs never observe a partial entry.
+func (c *Cache) Put(key string, program *bytecode.Program) error {
+	path := c.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), "tmp-*")
+	if err != nil {
+		return err
+	}
+	if err := bytecode.Encode(tmp, program); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Clean removes every cached entry.
+func (c *Cache) Clean() error {
+	entries, err := os.ReadDir(c.dir)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	for _, entry := range entries {
+		if err := os.RemoveAll(filepath.Join(c.dir, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
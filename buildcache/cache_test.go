@@ -0,0 +1,78 @@
+package buildcache
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/AndreiAlbert/gvm/bytecode"
+	. "github.com/AndreiAlbert/gvm/common"
+)
+
+func TestPutGet(t *testing.T) {
+	cache, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to open cache: %v", err)
+	}
+
+	key := Key([]byte("func main() -> void {}"))
+	if _, ok := cache.Get(key); ok {
+		t.Fatal("Expected a miss on an empty cache")
+	}
+
+	program := &bytecode.Program{
+		Version:   bytecode.Version,
+		Functions: []bytecode.Function{{Address: 0, ReturnType: ValueVoid, IsMain: true}},
+		Code:      []byte{0},
+		Lines:     []bytecode.LineEntry{{Address: 0, Line: 3}},
+	}
+	if err := cache.Put(key, program); err != nil {
+		t.Fatalf("Failed to store program: %v", err)
+	}
+
+	cached, ok := cache.Get(key)
+	if !ok {
+		t.Fatal("Expected a hit after Put")
+	}
+	defer cached.Close()
+	if !bytes.Equal(cached.Code, program.Code) || len(cached.Lines) != 1 {
+		t.Errorf("Cached program differs: %+v", cached)
+	}
+
+	if err := cache.Clean(); err != nil {
+		t.Fatalf("Failed to clean cache: %v", err)
+	}
+	if _, ok := cache.Get(key); ok {
+		t.Fatal("Expected a miss after Clean")
+	}
+}
+
+func TestKeyDependsOnEverySource(t *testing.T) {
+	a := Key([]byte("main"), []byte("lib"))
+	if a != Key([]byte("main"), []byte("lib")) {
+		t.Error("Key is not deterministic")
+	}
+	if a == Key([]byte("main"), []byte("lib2")) {
+		t.Error("Key ignores an included source")
+	}
+	if a == Key([]byte("mainl"), []byte("ib")) {
+		t.Error("Key is ambiguous across source boundaries")
+	}
+}
+
+func TestKeyDependsOnBuild(t *testing.T) {
+	defer func(saved func() string) { buildID = saved }(buildID)
+	source := []byte("main")
+	buildID = func() string { return "v1.0.0" }
+	a := Key(source)
+	buildID = func() string { return "v1.1.0" }
+	if a == Key(source) {
+		t.Error("Key ignores the gvm build")
+	}
+}
+
+func TestReadBuildID(t *testing.T) {
+	// the test binary has no module version, so it is identified by its hash
+	if id := readBuildID(); len(id) != 64 {
+		t.Errorf("Expected the hash of the executable, got %q", id)
+	}
+}
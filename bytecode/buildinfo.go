@@ -0,0 +1,57 @@
+package bytecode
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"time"
+)
+
+// BuildInfo records how a container was built: the toolchain that
+// assembled it, a hash of its source and when. Containers written before
+// it was introduced have none.
+type BuildInfo struct {
+	// Toolchain names the assembler, such as "gvm v0.5.0 (go1.22.1)"
+	Toolchain string
+	// SourceHash is the SHA-256 of the source and of the libraries it
+	// imports
+	SourceHash [sha256.Size]byte
+	// Built is when the container was assembled, zero if it wasn't
+	// recorded
+	Built time.Time
+}
+
+// String formats the build info on one line.
+func (b *BuildInfo) String() string {
+	text := fmt.Sprintf("%s, source sha256:%s", b.Toolchain, hex.EncodeToString(b.SourceHash[:]))
+	if !b.Built.IsZero() {
+		text += ", built " + b.Built.UTC().Format(time.RFC3339)
+	}
+	return text
+}
+
+func encodeBuildInfo(info *BuildInfo) []byte {
+	var buf bytes.Buffer
+	writeString(&buf, info.Toolchain)
+	buf.Write(info.SourceHash[:])
+	var built int64
+	if !info.Built.IsZero() {
+		built = info.Built.Unix()
+	}
+	binary.Write(&buf, binary.BigEndian, built)
+	return buf.Bytes()
+}
+
+func decodeBuildInfo(data []byte) (*BuildInfo, error) {
+	r := &reader{data: data}
+	info := &BuildInfo{Toolchain: r.string()}
+	if r.need(len(info.SourceHash)) {
+		r.pos += copy(info.SourceHash[:], r.data[r.pos:])
+	}
+	if built := int64(r.uint64()); built != 0 {
+		info.Built = time.Unix(built, 0).UTC()
+	}
+	return info, r.err
+}
@@ -0,0 +1,685 @@
+// Package bytecode defines the on-disk container for assembled programs:
+// the code section together with the function, struct and line tables the VM
+// needs to load it.
+package bytecode
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	. "github.com/AndreiAlbert/gvm/common"
+	"hash/crc32"
+	"io"
+	"sort"
+)
+
+// Magic identifies a gvm bytecode container (.gvmbc file).
+var Magic = [4]byte{'G', 'V', 'M', 'B'}
+
+// Version is the container format version written by this package.
+// MinVersion is the oldest version Decode still reads.
+//
+// Version history:
+//   - 1: function, struct, code and source map sections
+//   - 2: function table entries carry the function name
+//   - 3: ISUB subtracts the value on top of the stack from the one below
+//   - 4: section headers carry a CRC-32 of the section
+//   - 5: function table entries carry the frame size of the function
+const (
+	Version    uint16 = 5
+	MinVersion uint16 = 1
+)
+
+// SectionKind identifies a section of the container.
+type SectionKind byte
+
+const (
+	SectionFunctions SectionKind = iota + 1
+	SectionStructs
+	SectionCode
+	SectionSourceMap
+	// SectionLabels holds the label table. Like the source map it is
+	// optional and skipped by loaders that predate it.
+	SectionLabels
+	// SectionEnums holds the enums, optional as well.
+	SectionEnums
+	// SectionConstants holds the constant pool. It is only written when
+	// the code compares against pooled constants, which needs it.
+	SectionConstants
+	// SectionBuildInfo holds the build info, optional.
+	SectionBuildInfo
+	// SectionNatives holds the signatures of the host functions the code
+	// calls, only written when it calls some.
+	SectionNatives
+)
+
+// headerSize is magic + version + section count
+const headerSize = 4 + 2 + 2
+
+// SubtractionOrderVersion is the first version whose ISUB instructions
+// subtract the value on top of the stack from the one below. Older
+// containers were assembled for the reverse order.
+const SubtractionOrderVersion = 3
+
+// ChecksumVersion is the first version whose section headers are kind +
+// length + the CRC-32 (IEEE) of the section, instead of kind + length
+const ChecksumVersion = 4
+
+// frameSizeVersion is the first version whose function table entries end
+// with MaxStack and MaxLocals
+const frameSizeVersion = 5
+
+// ErrCorrupted is the cause of the errors of Decode for a section whose
+// contents don't match its checksum.
+var ErrCorrupted = errors.New("corrupted")
+
+// Function describes one entry of the function table. Address is the offset
+// of the function body inside the code section.
+type Function struct {
+	// Name is empty only for functions decoded from containers written
+	// before version 2 that could not be named otherwise.
+	Name             string
+	Address          uint32
+	ParamCount       uint16
+	ReturnType       ValueKind
+	IsMain           bool
+	ReturnStructName string
+	// MaxStack is the deepest the operand stack of the function gets and
+	// MaxLocals the number of locals it uses, as computed by the assembler.
+	// Zero MaxStack is unknown, as in containers before version 5.
+	MaxStack  uint16
+	MaxLocals uint16
+}
+
+// LineEntry maps the instruction at Address in the code section to the
+// source line it was assembled from.
+type LineEntry struct {
+	Address uint32
+	Line    uint32
+}
+
+// Label names the instruction at Address in the code section. Label names
+// are only unique within the function that declares them.
+type Label struct {
+	Address uint32
+	Name    string
+}
+
+// Enum is a named group of int32 constants. Fields lists the struct fields
+// declared with the enum as their type, as Struct.field, and Constants the
+// addresses of the instructions whose operand is one of its members, so
+// tools can print those values by name.
+type Enum struct {
+	Name      string
+	Members   []EnumMember
+	Fields    []string
+	Constants []uint32
+}
+
+// EnumMember is a constant of an enum.
+type EnumMember struct {
+	Name  string
+	Value int32
+}
+
+// MemberName returns the name of the first member with the value.
+func (e *Enum) MemberName(value int32) (string, bool) {
+	for _, member := range e.Members {
+		if member.Value == value {
+			return member.Name, true
+		}
+	}
+	return "", false
+}
+
+// Program is a decoded container. The function and struct tables come from
+// the header, Code is the executable section. When the program was decoded
+// from a memory mapped file, Code aliases the mapping and is only valid until
+// Close is called.
+type Program struct {
+	Version   uint16
+	Functions []Function
+	Structs   []StructType
+	Code      []byte
+	// Lines is the source map, sorted by address. It is optional.
+	Lines []LineEntry
+	// Labels is the label table, sorted by address. It is optional.
+	Labels []Label
+	// Enums are the enums of the program. They are optional.
+	Enums []Enum
+	// Constants is the constant pool, the 4-byte comparands of the IJEC,
+	// IJNEC, FJEC and FJNEC instructions referring to them by index.
+	Constants []uint32
+	// BuildInfo records how the program was assembled, nil if the
+	// container doesn't say.
+	BuildInfo *BuildInfo
+	// Natives are the host functions the code calls, CALLNATIVE referring
+	// to them by index.
+	Natives []Native
+	closer  func() error
+}
+
+// String returns the section name.
+func (s SectionKind) String() string {
+	switch s {
+	case SectionFunctions:
+		return "functions"
+	case SectionStructs:
+		return "structs"
+	case SectionCode:
+		return "code"
+	case SectionSourceMap:
+		return "source map"
+	case SectionLabels:
+		return "labels"
+	case SectionEnums:
+		return "enums"
+	case SectionConstants:
+		return "constants"
+	case SectionBuildInfo:
+		return "build info"
+	case SectionNatives:
+		return "natives"
+	default:
+		return fmt.Sprintf("section(%d)", byte(s))
+	}
+}
+
+// Close releases the memory backing the program, if any.
+func (p *Program) Close() error {
+	if p.closer == nil {
+		return nil
+	}
+	closer := p.closer
+	p.closer = nil
+	return closer()
+}
+
+// Strip returns a copy of p without the sections that only describe the
+// code to people and tools: the source map, the labels and the enums. The
+// program runs the same, but errors no longer carry source lines and the
+// disassembler and debugger have no names beyond those of the functions.
+// The build info is kept.
+func (p *Program) Strip() *Program {
+	return &Program{
+		Version:   p.Version,
+		Functions: p.Functions,
+		Structs:   p.Structs,
+		Code:      append([]byte(nil), p.Code...),
+		Constants: p.Constants,
+		BuildInfo: p.BuildInfo,
+		Natives:   p.Natives,
+	}
+}
+
+// IsContainer reports whether data starts with the container magic.
+func IsContainer(data []byte) bool {
+	return len(data) >= len(Magic) && bytes.Equal(data[:len(Magic)], Magic[:])
+}
+
+// Encode writes the program as a container.
+func Encode(w io.Writer, p *Program) error {
+	sections := []struct {
+		kind SectionKind
+		data []byte
+	}{
+		{SectionFunctions, encodeFunctions(p.Functions)},
+		{SectionStructs, encodeStructs(p.Structs)},
+		{SectionCode, p.Code},
+	}
+	if len(p.Lines) > 0 {
+		sections = append(sections, struct {
+			kind SectionKind
+			data []byte
+		}{SectionSourceMap, encodeLines(p.Lines)})
+	}
+	if len(p.Labels) > 0 {
+		sections = append(sections, struct {
+			kind SectionKind
+			data []byte
+		}{SectionLabels, encodeLabels(p.Labels)})
+	}
+	if len(p.Enums) > 0 {
+		sections = append(sections, struct {
+			kind SectionKind
+			data []byte
+		}{SectionEnums, encodeEnums(p.Enums)})
+	}
+	if len(p.Constants) > 0 {
+		sections = append(sections, struct {
+			kind SectionKind
+			data []byte
+		}{SectionConstants, encodeConstants(p.Constants)})
+	}
+	if p.BuildInfo != nil {
+		sections = append(sections, struct {
+			kind SectionKind
+			data []byte
+		}{SectionBuildInfo, encodeBuildInfo(p.BuildInfo)})
+	}
+	if len(p.Natives) > 0 {
+		sections = append(sections, struct {
+			kind SectionKind
+			data []byte
+		}{SectionNatives, encodeNatives(p.Natives)})
+	}
+	var header [headerSize]byte
+	copy(header[:], Magic[:])
+	binary.BigEndian.PutUint16(header[4:], Version)
+	binary.BigEndian.PutUint16(header[6:], uint16(len(sections)))
+	if _, err := w.Write(header[:]); err != nil {
+		return err
+	}
+	for _, section := range sections {
+		var sectionHeader [9]byte
+		sectionHeader[0] = byte(section.kind)
+		binary.BigEndian.PutUint32(sectionHeader[1:], uint32(len(section.data)))
+		binary.BigEndian.PutUint32(sectionHeader[5:], crc32.ChecksumIEEE(section.data))
+		if _, err := w.Write(sectionHeader[:]); err != nil {
+			return err
+		}
+		if _, err := w.Write(section.data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Section locates a section of a container: its payload is Size bytes at
+// Offset from the start of the container. CRC is the CRC-32 of the payload
+// recorded in the header since ChecksumVersion.
+type Section struct {
+	Kind   SectionKind
+	Offset int
+	Size   int
+	CRC    uint32
+}
+
+// Sections reads the header of a container and the layout of its sections,
+// checking their checksums, without decoding them.
+func Sections(data []byte) (version uint16, sections []Section, err error) {
+	if IsSealed(data) {
+		return 0, nil, ErrSealed
+	}
+	if !IsContainer(data) {
+		return 0, nil, errors.New("not a gvm bytecode container")
+	}
+	if len(data) < headerSize {
+		return 0, nil, errors.New("truncated container header")
+	}
+	version = binary.BigEndian.Uint16(data[4:6])
+	if err := checkVersion(version); err != nil {
+		return 0, nil, err
+	}
+	sectionCount := int(binary.BigEndian.Uint16(data[6:8]))
+	sectionHeaderSize := 5
+	if version >= ChecksumVersion {
+		sectionHeaderSize = 9
+	}
+	pos := headerSize
+	for i := 0; i < sectionCount; i++ {
+		if len(data)-pos < sectionHeaderSize {
+			return 0, nil, fmt.Errorf("truncated header of section %d", i)
+		}
+		header := data[pos : pos+sectionHeaderSize]
+		section := Section{Kind: SectionKind(header[0]), Size: int(binary.BigEndian.Uint32(header[1:5]))}
+		pos += sectionHeaderSize
+		if section.Size < 0 || len(data)-pos < section.Size {
+			return 0, nil, fmt.Errorf("%v section exceeds container size", section.Kind)
+		}
+		section.Offset = pos
+		pos += section.Size
+		if sectionHeaderSize == 9 {
+			section.CRC = binary.BigEndian.Uint32(header[5:9])
+			if crc32.ChecksumIEEE(data[section.Offset:pos]) != section.CRC {
+				return 0, nil, fmt.Errorf("%v section %w: checksum mismatch", section.Kind, ErrCorrupted)
+			}
+		}
+		sections = append(sections, section)
+	}
+	return version, sections, nil
+}
+
+// Decode parses a container. The code section is not copied, the returned
+// program references data directly.
+func Decode(data []byte) (*Program, error) {
+	version, sections, err := Sections(data)
+	if err != nil {
+		return nil, err
+	}
+	p := &Program{Version: version}
+	foundCode := false
+	for _, section := range sections {
+		payload := data[section.Offset : section.Offset+section.Size]
+		var err error
+		switch section.Kind {
+		case SectionFunctions:
+			p.Functions, err = decodeFunctions(payload, p.Version)
+		case SectionStructs:
+			p.Structs, err = decodeStructs(payload)
+		case SectionCode:
+			p.Code = payload
+			foundCode = true
+		case SectionSourceMap:
+			p.Lines, err = decodeLines(payload)
+		case SectionLabels:
+			p.Labels, err = decodeLabels(payload)
+		case SectionEnums:
+			p.Enums, err = decodeEnums(payload)
+		case SectionConstants:
+			p.Constants, err = decodeConstants(payload)
+		case SectionBuildInfo:
+			p.BuildInfo, err = decodeBuildInfo(payload)
+		case SectionNatives:
+			p.Natives, err = decodeNatives(payload)
+		default:
+			// unknown sections are skipped so newer optional data doesn't
+			// break older loaders
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%v section: %w", section.Kind, err)
+		}
+	}
+	if !foundCode {
+		return nil, errors.New("container has no code section")
+	}
+	return p, nil
+}
+
+// checkVersion rejects containers this package cannot read. Newer containers
+// need a newer VM, older ones must be reassembled from source.
+func checkVersion(version uint16) error {
+	switch {
+	case version > Version:
+		return fmt.Errorf("unsupported container version %d: this VM reads versions %d to %d, upgrade gvm to run it",
+			version, MinVersion, Version)
+	case version < MinVersion:
+		return fmt.Errorf("unsupported container version %d: this VM reads versions %d to %d, reassemble the program with gvm asm",
+			version, MinVersion, Version)
+	}
+	return nil
+}
+
+func encodeFunctions(functions []Function) []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, uint32(len(functions)))
+	for _, f := range functions {
+		writeString(&buf, f.Name)
+		binary.Write(&buf, binary.BigEndian, f.Address)
+		var flags byte
+		if f.IsMain {
+			flags |= 1
+		}
+		buf.WriteByte(flags)
+		binary.Write(&buf, binary.BigEndian, f.ParamCount)
+		buf.WriteByte(byte(f.ReturnType))
+		if f.ReturnType == ValueStruct {
+			writeString(&buf, f.ReturnStructName)
+		}
+		binary.Write(&buf, binary.BigEndian, f.MaxStack)
+		binary.Write(&buf, binary.BigEndian, f.MaxLocals)
+	}
+	return buf.Bytes()
+}
+
+func decodeFunctions(data []byte, version uint16) ([]Function, error) {
+	r := &reader{data: data}
+	count := r.uint32()
+	var functions []Function
+	for i := uint32(0); i < count && r.err == nil; i++ {
+		var f Function
+		if version >= 2 {
+			f.Name = r.string()
+		}
+		f.Address = r.uint32()
+		f.IsMain = r.byte()&1 != 0
+		if version < 2 && f.IsMain {
+			f.Name = "main"
+		}
+		f.ParamCount = r.uint16()
+		f.ReturnType = ValueKind(r.byte())
+		if f.ReturnType == ValueStruct {
+			f.ReturnStructName = r.string()
+		}
+		if version >= frameSizeVersion {
+			f.MaxStack = r.uint16()
+			f.MaxLocals = r.uint16()
+		}
+		functions = append(functions, f)
+	}
+	return functions, r.err
+}
+
+// LineFor returns the source line of the instruction at addr, using the
+// closest preceding source map entry.
+func (p *Program) LineFor(addr uint) (uint32, bool) {
+	i := sort.Search(len(p.Lines), func(i int) bool {
+		return uint(p.Lines[i].Address) > addr
+	})
+	if i == 0 {
+		return 0, false
+	}
+	return p.Lines[i-1].Line, true
+}
+
+func encodeLines(lines []LineEntry) []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, uint32(len(lines)))
+	for _, entry := range lines {
+		binary.Write(&buf, binary.BigEndian, entry.Address)
+		binary.Write(&buf, binary.BigEndian, entry.Line)
+	}
+	return buf.Bytes()
+}
+
+func decodeLines(data []byte) ([]LineEntry, error) {
+	r := &reader{data: data}
+	count := r.uint32()
+	var lines []LineEntry
+	for i := uint32(0); i < count && r.err == nil; i++ {
+		lines = append(lines, LineEntry{Address: r.uint32(), Line: r.uint32()})
+	}
+	return lines, r.err
+}
+
+func encodeLabels(labels []Label) []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, uint32(len(labels)))
+	for _, label := range labels {
+		binary.Write(&buf, binary.BigEndian, label.Address)
+		writeString(&buf, label.Name)
+	}
+	return buf.Bytes()
+}
+
+func decodeLabels(data []byte) ([]Label, error) {
+	r := &reader{data: data}
+	count := r.uint32()
+	var labels []Label
+	for i := uint32(0); i < count && r.err == nil; i++ {
+		labels = append(labels, Label{Address: r.uint32(), Name: r.string()})
+	}
+	return labels, r.err
+}
+
+func encodeConstants(constants []uint32) []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, uint32(len(constants)))
+	for _, constant := range constants {
+		binary.Write(&buf, binary.BigEndian, constant)
+	}
+	return buf.Bytes()
+}
+
+func decodeConstants(data []byte) ([]uint32, error) {
+	r := &reader{data: data}
+	count := r.uint32()
+	var constants []uint32
+	for i := uint32(0); i < count && r.err == nil; i++ {
+		constants = append(constants, r.uint32())
+	}
+	return constants, r.err
+}
+
+func encodeEnums(enums []Enum) []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, uint32(len(enums)))
+	for _, enum := range enums {
+		writeString(&buf, enum.Name)
+		binary.Write(&buf, binary.BigEndian, uint32(len(enum.Members)))
+		for _, member := range enum.Members {
+			writeString(&buf, member.Name)
+			binary.Write(&buf, binary.BigEndian, member.Value)
+		}
+		binary.Write(&buf, binary.BigEndian, uint32(len(enum.Fields)))
+		for _, field := range enum.Fields {
+			writeString(&buf, field)
+		}
+		binary.Write(&buf, binary.BigEndian, uint32(len(enum.Constants)))
+		for _, address := range enum.Constants {
+			binary.Write(&buf, binary.BigEndian, address)
+		}
+	}
+	return buf.Bytes()
+}
+
+func decodeEnums(data []byte) ([]Enum, error) {
+	r := &reader{data: data}
+	count := r.uint32()
+	var enums []Enum
+	for i := uint32(0); i < count && r.err == nil; i++ {
+		enum := Enum{Name: r.string()}
+		members := r.uint32()
+		for j := uint32(0); j < members && r.err == nil; j++ {
+			enum.Members = append(enum.Members, EnumMember{Name: r.string(), Value: int32(r.uint32())})
+		}
+		fields := r.uint32()
+		for j := uint32(0); j < fields && r.err == nil; j++ {
+			enum.Fields = append(enum.Fields, r.string())
+		}
+		constants := r.uint32()
+		for j := uint32(0); j < constants && r.err == nil; j++ {
+			enum.Constants = append(enum.Constants, r.uint32())
+		}
+		enums = append(enums, enum)
+	}
+	return enums, r.err
+}
+
+func encodeStructs(structs []StructType) []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, uint16(len(structs)))
+	for _, s := range structs {
+		writeString(&buf, s.Name)
+		buf.WriteByte(byte(len(s.Fields)))
+		for _, field := range s.Fields {
+			writeString(&buf, field.Name)
+			buf.WriteByte(byte(field.Type))
+			if field.Type == ValueArray && field.ArrayType != nil {
+				buf.WriteByte(byte(*field.ArrayType))
+			}
+		}
+	}
+	return buf.Bytes()
+}
+
+func decodeStructs(data []byte) ([]StructType, error) {
+	r := &reader{data: data}
+	count := r.uint16()
+	var structs []StructType
+	for i := uint16(0); i < count && r.err == nil; i++ {
+		s := StructType{
+			Name:    r.string(),
+			Methods: make(map[string]uint),
+		}
+		fieldCount := r.byte()
+		for j := byte(0); j < fieldCount && r.err == nil; j++ {
+			field := StructField{
+				Name: r.string(),
+				Type: ValueKind(r.byte()),
+			}
+			if field.Type == ValueArray {
+				elemType := ValueKind(r.byte())
+				field.ArrayType = &elemType
+			}
+			s.Fields = append(s.Fields, field)
+		}
+		structs = append(structs, s)
+	}
+	return structs, r.err
+}
+
+func writeString(buf *bytes.Buffer, s string) {
+	buf.WriteString(s)
+	buf.WriteByte(0)
+}
+
+// reader decodes big endian values and remembers the first error so that
+// callers can check once at the end.
+type reader struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+func (r *reader) need(n int) bool {
+	if r.err != nil {
+		return false
+	}
+	if len(r.data)-r.pos < n {
+		r.err = io.ErrUnexpectedEOF
+		return false
+	}
+	return true
+}
+
+func (r *reader) byte() byte {
+	if !r.need(1) {
+		return 0
+	}
+	b := r.data[r.pos]
+	r.pos++
+	return b
+}
+
+func (r *reader) uint16() uint16 {
+	if !r.need(2) {
+		return 0
+	}
+	v := binary.BigEndian.Uint16(r.data[r.pos:])
+	r.pos += 2
+	return v
+}
+
+func (r *reader) uint32() uint32 {
+	if !r.need(4) {
+		return 0
+	}
+	v := binary.BigEndian.Uint32(r.data[r.pos:])
+	r.pos += 4
+	return v
+}
+
+func (r *reader) uint64() uint64 {
+	if !r.need(8) {
+		return 0
+	}
+	v := binary.BigEndian.Uint64(r.data[r.pos:])
+	r.pos += 8
+	return v
+}
+
+func (r *reader) string() string {
+	if r.err != nil {
+		return ""
+	}
+	end := bytes.IndexByte(r.data[r.pos:], 0)
+	if end < 0 {
+		r.err = io.ErrUnexpectedEOF
+		return ""
+	}
+	s := string(r.data[r.pos : r.pos+end])
+	r.pos += end + 1
+	return s
+}
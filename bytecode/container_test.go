@@ -0,0 +1,257 @@
+package bytecode
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/AndreiAlbert/gvm/common"
+)
+
+func testProgram() *Program {
+	elemType := ValueFloat32
+	return &Program{
+		Version: Version,
+		Functions: []Function{
+			{Name: "add", Address: 12, ParamCount: 2, ReturnType: ValueInt32, MaxStack: 2, MaxLocals: 1},
+			{Name: "origin", Address: 20, ReturnType: ValueStruct, ReturnStructName: "Point"},
+			{Name: "main", Address: 30, ReturnType: ValueVoid, IsMain: true},
+		},
+		Structs: []StructType{
+			{Name: "Point", Fields: []StructField{
+				{Name: "x", Type: ValueInt32},
+				{Name: "samples", Type: ValueArray, ArrayType: &elemType},
+			}},
+		},
+		Code:   []byte{1, 2, 3, 4, 5},
+		Lines:  []LineEntry{{Address: 0, Line: 4}, {Address: 3, Line: 7}},
+		Labels: []Label{{Address: 3, Name: "loop"}},
+		Enums: []Enum{{
+			Name:      "Color",
+			Members:   []EnumMember{{Name: "RED", Value: 0}, {Name: "BLUE", Value: -2}},
+			Fields:    []string{"Point.x"},
+			Constants: []uint32{3},
+		}},
+		Constants: []uint32{42, 0x3fc00000},
+		BuildInfo: &BuildInfo{Toolchain: "gvm v1.0.0 (go1.22.1)", SourceHash: [32]byte{1, 2, 3}, Built: time.Unix(1700000000, 0).UTC()},
+		Natives: []Native{
+			{Name: "print", Params: []ValueKind{ValueString, ValueInt32}, ReturnType: ValueVoid},
+			{Name: "fetch", Params: []ValueKind{ValueString}, ReturnType: ValueString, Async: true},
+		},
+	}
+}
+
+func TestEncodeDecodeRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	if err := Encode(&buf, testProgram()); err != nil {
+		t.Fatalf("Failed to encode: %v", err)
+	}
+
+	p, err := Decode(buf.Bytes())
+	if err != nil {
+		t.Fatalf("Failed to decode: %v", err)
+	}
+
+	if len(p.Functions) != 3 {
+		t.Fatalf("Expected 3 functions, got %d", len(p.Functions))
+	}
+	if p.Functions[1].ReturnStructName != "Point" || p.Functions[1].Address != 20 {
+		t.Errorf("Unexpected struct-returning function: %+v", p.Functions[1])
+	}
+	if p.Functions[0].Name != "add" || p.Functions[2].Name != "main" {
+		t.Errorf("Function names not preserved: %+v", p.Functions)
+	}
+	if !p.Functions[2].IsMain || p.Functions[0].IsMain {
+		t.Errorf("Main flag not preserved: %+v", p.Functions)
+	}
+	if len(p.Structs) != 1 || len(p.Structs[0].Fields) != 2 {
+		t.Fatalf("Unexpected structs: %+v", p.Structs)
+	}
+	samples := p.Structs[0].Fields[1]
+	if samples.Type != ValueArray || samples.ArrayType == nil || *samples.ArrayType != ValueFloat32 {
+		t.Errorf("Array field not preserved: %+v", samples)
+	}
+	if !bytes.Equal(p.Code, []byte{1, 2, 3, 4, 5}) {
+		t.Errorf("Unexpected code section: %v", p.Code)
+	}
+	if line, ok := p.LineFor(4); !ok || line != 7 {
+		t.Errorf("Expected address 4 to map to line 7, got %d (%v)", line, ok)
+	}
+	if line, ok := p.LineFor(2); !ok || line != 4 {
+		t.Errorf("Expected address 2 to map to line 4, got %d (%v)", line, ok)
+	}
+	if len(p.Labels) != 1 || p.Labels[0] != (Label{Address: 3, Name: "loop"}) {
+		t.Errorf("Labels not preserved: %+v", p.Labels)
+	}
+	if len(p.Enums) != 1 || len(p.Enums[0].Members) != 2 || p.Enums[0].Fields[0] != "Point.x" || p.Enums[0].Constants[0] != 3 {
+		t.Fatalf("Enums not preserved: %+v", p.Enums)
+	}
+	if name, ok := p.Enums[0].MemberName(-2); !ok || name != "BLUE" {
+		t.Errorf("Expected -2 to be BLUE, got %q (%v)", name, ok)
+	}
+	if len(p.Constants) != 2 || p.Constants[0] != 42 || p.Constants[1] != 0x3fc00000 {
+		t.Errorf("Constant pool not preserved: %v", p.Constants)
+	}
+	if p.BuildInfo == nil || *p.BuildInfo != *testProgram().BuildInfo {
+		t.Errorf("Build info not preserved: %v", p.BuildInfo)
+	}
+	if got := p.BuildInfo.String(); !strings.HasSuffix(got, "built 2023-11-14T22:13:20Z") || !strings.HasPrefix(got, "gvm v1.0.0 (go1.22.1), source sha256:010203") {
+		t.Errorf("Unexpected build info line %q", got)
+	}
+	if len(p.Natives) != 2 || p.Natives[0].Signature() != "print(string, int32) -> void" || p.Natives[1].Signature() != "async fetch(string) -> string" {
+		t.Errorf("Natives not preserved: %+v", p.Natives)
+	}
+}
+
+func TestDecodeRejectsBadInput(t *testing.T) {
+	var buf bytes.Buffer
+	if err := Encode(&buf, testProgram()); err != nil {
+		t.Fatalf("Failed to encode: %v", err)
+	}
+	valid := buf.Bytes()
+
+	tests := []struct {
+		name   string
+		data   []byte
+		errMsg string
+	}{
+		{"not a container", []byte("hello"), "not a gvm bytecode container"},
+		{"truncated header", valid[:6], "truncated container header"},
+		{"truncated section", valid[:len(valid)-2], "exceeds container size"},
+		{"future version", append([]byte{'G', 'V', 'M', 'B', 0xFF, 0xFF}, valid[6:]...), "upgrade gvm"},
+		{"ancient version", append([]byte{'G', 'V', 'M', 'B', 0x00, 0x00}, valid[6:]...), "reassemble"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Decode(tt.data)
+			if err == nil || !strings.Contains(err.Error(), tt.errMsg) {
+				t.Errorf("expected error containing %q, got %v", tt.errMsg, err)
+			}
+		})
+	}
+}
+
+func TestDecodeVersion1(t *testing.T) {
+	// version 1 function entries have no name: address, flags, param
+	// count, return type
+	functions := []byte{
+		0, 0, 0, 2,
+		0, 0, 0, 0, 0, 0, 1, byte(ValueInt32),
+		0, 0, 0, 3, 1, 0, 0, byte(ValueVoid),
+	}
+	code := []byte{1, 2, 3}
+	data := []byte{'G', 'V', 'M', 'B', 0, 1, 0, 2}
+	data = append(data, byte(SectionFunctions), 0, 0, 0, byte(len(functions)))
+	data = append(data, functions...)
+	data = append(data, byte(SectionCode), 0, 0, 0, byte(len(code)))
+	data = append(data, code...)
+
+	p, err := Decode(data)
+	if err != nil {
+		t.Fatalf("Failed to decode version 1 container: %v", err)
+	}
+	if p.Version != 1 {
+		t.Errorf("Expected version 1, got %d", p.Version)
+	}
+	if len(p.Functions) != 2 {
+		t.Fatalf("Expected 2 functions, got %d", len(p.Functions))
+	}
+	if p.Functions[0].ParamCount != 1 || p.Functions[0].Name != "" {
+		t.Errorf("Unexpected first function: %+v", p.Functions[0])
+	}
+	if !p.Functions[1].IsMain || p.Functions[1].Name != "main" || p.Functions[1].Address != 3 {
+		t.Errorf("Unexpected main function: %+v", p.Functions[1])
+	}
+}
+
+func TestDecodeDetectsCorruption(t *testing.T) {
+	data, err := EncodeBytes(testProgram())
+	if err != nil {
+		t.Fatal(err)
+	}
+	code := bytes.Index(data, testProgram().Code)
+	if code < 0 {
+		t.Fatal("code section not found")
+	}
+	data[code+2] ^= 0x10
+	_, err = Decode(data)
+	if !errors.Is(err, ErrCorrupted) || !strings.Contains(err.Error(), "code section corrupted") {
+		t.Errorf("Expected a corrupted code section, got %v", err)
+	}
+}
+
+func TestOpenMapsFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "prog.gvmbc")
+	if err := WriteFile(path, testProgram()); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+
+	p, err := Open(path)
+	if err != nil {
+		t.Fatalf("Failed to open: %v", err)
+	}
+	defer p.Close()
+
+	if !bytes.Equal(p.Code, []byte{1, 2, 3, 4, 5}) {
+		t.Errorf("Unexpected code section: %v", p.Code)
+	}
+
+	if _, err := Open(filepath.Join(t.TempDir(), "missing.gvmbc")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected not-exist error, got %v", err)
+	}
+}
+
+func TestSections(t *testing.T) {
+	data, err := EncodeBytes(testProgram())
+	if err != nil {
+		t.Fatal(err)
+	}
+	version, sections, err := Sections(data)
+	if err != nil {
+		t.Fatalf("Failed to read the sections: %v", err)
+	}
+	if version != Version {
+		t.Errorf("Expected version %d, got %d", Version, version)
+	}
+	var code *Section
+	for i := range sections {
+		if sections[i].Offset+sections[i].Size > len(data) {
+			t.Errorf("%s section exceeds the container", sections[i].Kind)
+		}
+		if sections[i].Kind == SectionCode {
+			code = &sections[i]
+		}
+	}
+	if code == nil {
+		t.Fatal("no code section")
+	}
+	if got := data[code.Offset : code.Offset+code.Size]; !bytes.Equal(got, testProgram().Code) {
+		t.Errorf("Expected the code section to hold %v, got %v", testProgram().Code, got)
+	}
+}
+
+func TestStrip(t *testing.T) {
+	stripped := testProgram().Strip()
+	if stripped.Lines != nil || stripped.Labels != nil || stripped.Enums != nil {
+		t.Errorf("Expected no source map, labels or enums, got %+v", stripped)
+	}
+	if len(stripped.Functions) != 3 || stripped.BuildInfo == nil || !bytes.Equal(stripped.Code, testProgram().Code) {
+		t.Errorf("Expected the functions, code and build info to be kept, got %+v", stripped)
+	}
+	full, err := EncodeBytes(testProgram())
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := EncodeBytes(stripped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) >= len(full) {
+		t.Errorf("Expected the stripped container to be smaller than %d bytes, got %d", len(full), len(data))
+	}
+}
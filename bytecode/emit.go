@@ -0,0 +1,84 @@
+package bytecode
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"go/token"
+	"io"
+)
+
+// bytesPerLine is the number of bytes per line in generated source files
+const bytesPerLine = 12
+
+// EncodeBytes returns the program encoded as a container.
+func EncodeBytes(p *Program) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := Encode(&buf, p); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// EmitGo writes data as a Go source file of package pkg declaring a []byte
+// variable called name, ready to be passed to Decode.
+func EmitGo(w io.Writer, data []byte, pkg, name string) error {
+	if !token.IsIdentifier(pkg) {
+		return fmt.Errorf("invalid Go package name: %q", pkg)
+	}
+	if !token.IsIdentifier(name) {
+		return fmt.Errorf("invalid Go identifier: %q", name)
+	}
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "// Code generated by gvm asm. DO NOT EDIT.\n\npackage %s\n\n", pkg)
+	fmt.Fprintf(bw, "// %s is a gvm bytecode container of %d bytes.\n", name, len(data))
+	fmt.Fprintf(bw, "var %s = []byte{\n", name)
+	writeByteLines(bw, data, "\t")
+	bw.WriteString("}\n")
+	return bw.Flush()
+}
+
+// EmitC writes data as a C header declaring an unsigned char array called
+// name and a name_len constant holding its size.
+func EmitC(w io.Writer, data []byte, name string) error {
+	if !token.IsIdentifier(name) {
+		return fmt.Errorf("invalid C identifier: %q", name)
+	}
+	bw := bufio.NewWriter(w)
+	bw.WriteString("/* Generated by gvm asm. Do not edit. */\n")
+	bw.WriteString("#include <stddef.h>\n\n")
+	fmt.Fprintf(bw, "static const unsigned char %s[] = {\n", name)
+	writeByteLines(bw, data, "    ")
+	bw.WriteString("};\n")
+	fmt.Fprintf(bw, "static const size_t %s_len = %d;\n", name, len(data))
+	return bw.Flush()
+}
+
+// EmitHex writes a hex dump of data, 16 bytes per line prefixed with the
+// offset of the first byte.
+func EmitHex(w io.Writer, data []byte) error {
+	bw := bufio.NewWriter(w)
+	for offset := 0; offset < len(data); offset += 16 {
+		end := min(offset+16, len(data))
+		fmt.Fprintf(bw, "%08x ", offset)
+		for _, b := range data[offset:end] {
+			fmt.Fprintf(bw, " %02x", b)
+		}
+		bw.WriteByte('\n')
+	}
+	return bw.Flush()
+}
+
+func writeByteLines(bw *bufio.Writer, data []byte, indent string) {
+	for offset := 0; offset < len(data); offset += bytesPerLine {
+		end := min(offset+bytesPerLine, len(data))
+		bw.WriteString(indent)
+		for i, b := range data[offset:end] {
+			if i > 0 {
+				bw.WriteByte(' ')
+			}
+			fmt.Fprintf(bw, "0x%02x,", b)
+		}
+		bw.WriteByte('\n')
+	}
+}
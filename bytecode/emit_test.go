@@ -0,0 +1,59 @@
+package bytecode
+
+import (
+	"bytes"
+	"go/format"
+	"strings"
+	"testing"
+)
+
+func TestEmitGo(t *testing.T) {
+	data, err := EncodeBytes(testProgram())
+	if err != nil {
+		t.Fatalf("Failed to encode: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := EmitGo(&buf, data, "embedded", "helloProgram"); err != nil {
+		t.Fatalf("Failed to emit Go: %v", err)
+	}
+	formatted, err := format.Source(buf.Bytes())
+	if err != nil {
+		t.Fatalf("Generated Go does not parse: %v\n%s", err, buf.String())
+	}
+	if !bytes.Equal(formatted, buf.Bytes()) {
+		t.Errorf("Generated Go is not gofmt formatted:\n%s", buf.String())
+	}
+	if !strings.Contains(buf.String(), "package embedded") || !strings.Contains(buf.String(), "var helloProgram = []byte{") {
+		t.Errorf("Unexpected Go output:\n%s", buf.String())
+	}
+	if strings.Count(buf.String(), "0x") != len(data) {
+		t.Errorf("Expected %d bytes in Go output", len(data))
+	}
+
+	if err := EmitGo(&buf, data, "main", "not-an-identifier"); err == nil {
+		t.Error("Expected an invalid identifier error")
+	}
+}
+
+func TestEmitCAndHex(t *testing.T) {
+	data := []byte("GVMB0123456789abcdef")
+
+	var c bytes.Buffer
+	if err := EmitC(&c, data, "program"); err != nil {
+		t.Fatalf("Failed to emit C: %v", err)
+	}
+	if !strings.Contains(c.String(), "static const unsigned char program[] = {") || !strings.Contains(c.String(), "program_len = 20;") {
+		t.Errorf("Unexpected C output:\n%s", c.String())
+	}
+
+	var hex bytes.Buffer
+	if err := EmitHex(&hex, data); err != nil {
+		t.Fatalf("Failed to emit hex: %v", err)
+	}
+	want := "00000000  47 56 4d 42 30 31 32 33 34 35 36 37 38 39 61 62\n" +
+		"00000010  63 64 65 66\n"
+	if hex.String() != want {
+		t.Errorf("Unexpected hex dump:\n%s", hex.String())
+	}
+}
@@ -0,0 +1,47 @@
+package bytecode
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// Open loads a container from disk. The file is memory mapped where the
+// platform supports it, so only the pages that are actually executed are
+// read. Call Close on the returned program once the VM is done with it.
+func Open(path string) (*Program, error) {
+	data, release, err := mapFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load %s: %w", path, err)
+	}
+	p, err := Decode(data)
+	if err != nil {
+		release()
+		return nil, fmt.Errorf("failed to load %s: %w", path, err)
+	}
+	p.closer = release
+	return p, nil
+}
+
+// Read loads a container from r. Unlike Open the whole container is read
+// into memory, which suits embedded files and network streams.
+func Read(r io.Reader) (*Program, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return Decode(data)
+}
+
+// WriteFile encodes the program into a container file.
+func WriteFile(path string, p *Program) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := Encode(f, p); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,77 @@
+package bytecode
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+
+	. "github.com/AndreiAlbert/gvm/common"
+)
+
+// Native is the signature of a host function a program calls with
+// CALLNATIVE, declared in its .natives section. The VM binds it by Name to
+// a function the host registers when it loads the program. Programs called
+// by no native have no natives section.
+type Native struct {
+	Name string
+	// Params are the kinds of the arguments, the first one deepest on the
+	// stack
+	Params     []ValueKind
+	ReturnType ValueKind
+	// Async natives run on their own goroutine: CALLNATIVE pushes a
+	// handle of the pending call, which AWAIT turns into the result
+	Async bool
+}
+
+// nativeAsync is the flag of async natives in the natives section
+const nativeAsync = 1
+
+// Signature formats the native as it is declared, with the kinds of its
+// parameters: print(string) -> void, or async fetch(string) -> string.
+func (n *Native) Signature() string {
+	params := make([]string, len(n.Params))
+	for i, kind := range n.Params {
+		params[i] = kind.String()
+	}
+	signature := n.Name + "(" + strings.Join(params, ", ") + ") -> " + n.ReturnType.String()
+	if n.Async {
+		return "async " + signature
+	}
+	return signature
+}
+
+func encodeNatives(natives []Native) []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, uint32(len(natives)))
+	for _, native := range natives {
+		writeString(&buf, native.Name)
+		buf.WriteByte(byte(len(native.Params)))
+		for _, kind := range native.Params {
+			buf.WriteByte(byte(kind))
+		}
+		buf.WriteByte(byte(native.ReturnType))
+		var flags byte
+		if native.Async {
+			flags |= nativeAsync
+		}
+		buf.WriteByte(flags)
+	}
+	return buf.Bytes()
+}
+
+func decodeNatives(data []byte) ([]Native, error) {
+	r := &reader{data: data}
+	count := r.uint32()
+	var natives []Native
+	for i := uint32(0); i < count && r.err == nil; i++ {
+		native := Native{Name: r.string()}
+		params := r.byte()
+		for j := byte(0); j < params && r.err == nil; j++ {
+			native.Params = append(native.Params, ValueKind(r.byte()))
+		}
+		native.ReturnType = ValueKind(r.byte())
+		native.Async = r.byte()&nativeAsync != 0
+		natives = append(natives, native)
+	}
+	return natives, r.err
+}
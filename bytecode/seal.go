@@ -0,0 +1,87 @@
+package bytecode
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+)
+
+// SealedMagic identifies a container encrypted with Seal.
+var SealedMagic = [4]byte{'G', 'V', 'M', 'X'}
+
+// KeySize is the size of the keys of Seal and Unseal, which encrypt with
+// AES-256-GCM.
+const KeySize = 32
+
+// ErrSealed is returned by Decode for a sealed container, which has to be
+// unsealed with its key first.
+var ErrSealed = errors.New("sealed container, a key is needed to load it")
+
+// IsSealed reports whether data starts with the sealed container magic.
+func IsSealed(data []byte) bool {
+	return len(data) >= len(SealedMagic) && bytes.Equal(data[:len(SealedMagic)], SealedMagic[:])
+}
+
+// Seal encrypts the encoded container data with key. The result is the
+// magic followed by a random nonce and the encrypted, authenticated
+// container. Sealing keeps the bytecode of a program shipped inside a
+// binary out of plain sight; whoever has the key, which the host needs to
+// run it, can still read it.
+func Seal(data, key []byte) ([]byte, error) {
+	aead, err := newSealCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	sealed := make([]byte, len(SealedMagic)+aead.NonceSize(), len(SealedMagic)+aead.NonceSize()+len(data)+aead.Overhead())
+	copy(sealed, SealedMagic[:])
+	nonce := sealed[len(SealedMagic):]
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(sealed, nonce, data, SealedMagic[:]), nil
+}
+
+// Unseal decrypts a container sealed with key in memory. It fails when the
+// key is not the one data was sealed with or data was altered.
+func Unseal(data, key []byte) ([]byte, error) {
+	if !IsSealed(data) {
+		return nil, errors.New("not a sealed gvm bytecode container")
+	}
+	aead, err := newSealCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	data = data[len(SealedMagic):]
+	if len(data) < aead.NonceSize()+aead.Overhead() {
+		return nil, errors.New("truncated sealed container")
+	}
+	nonce, ciphertext := data[:aead.NonceSize()], data[aead.NonceSize():]
+	plain, err := aead.Open(nil, nonce, ciphertext, SealedMagic[:])
+	if err != nil {
+		return nil, errors.New("failed to unseal container: wrong key or damaged data")
+	}
+	return plain, nil
+}
+
+// DecodeSealed unseals data with key and decodes the container.
+func DecodeSealed(data, key []byte) (*Program, error) {
+	plain, err := Unseal(data, key)
+	if err != nil {
+		return nil, err
+	}
+	return Decode(plain)
+}
+
+func newSealCipher(key []byte) (cipher.AEAD, error) {
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("sealing key of %d bytes, expected %d", len(key), KeySize)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
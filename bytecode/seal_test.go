@@ -0,0 +1,45 @@
+package bytecode
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestSeal(t *testing.T) {
+	data, err := EncodeBytes(testProgram())
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := bytes.Repeat([]byte{7}, KeySize)
+	sealed, err := Seal(data, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsSealed(sealed) || bytes.Contains(sealed, []byte("origin")) {
+		t.Fatal("expected the sealed container to hide the function names")
+	}
+	if _, err := Decode(sealed); !errors.Is(err, ErrSealed) {
+		t.Errorf("expected decoding without the key to fail with ErrSealed, got %v", err)
+	}
+	p, err := DecodeSealed(sealed, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(p.Functions, testProgram().Functions) {
+		t.Errorf("expected the functions back, got %+v", p.Functions)
+	}
+
+	wrong := bytes.Repeat([]byte{8}, KeySize)
+	if _, err := Unseal(sealed, wrong); err == nil {
+		t.Error("expected unsealing with another key to fail")
+	}
+	sealed[len(sealed)-1] ^= 1
+	if _, err := Unseal(sealed, key); err == nil {
+		t.Error("expected unsealing altered data to fail")
+	}
+	if _, err := Seal(data, key[:16]); err == nil {
+		t.Error("expected a short key to be rejected")
+	}
+}
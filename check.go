@@ -0,0 +1,56 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/AndreiAlbert/gvm/asm"
+)
+
+func checkCommand(args []string) {
+	fs := flag.NewFlagSet("check", flag.ExitOnError)
+	var rules stringList
+	fs.Var(&rules, "rule", "set the severity of a lint rule as name=off|warning|error; may be repeated")
+	listRules := fs.Bool("rules", false, "list the lint rules and their default severity")
+	fs.Parse(args)
+	if *listRules {
+		for _, rule := range asm.LintRules {
+			fmt.Printf("%-24s %-8v %s\n", rule.Name, rule.Severity, rule.Summary)
+		}
+		return
+	}
+	if fs.NArg() != 1 {
+		log.Fatal("usage: gvm check [-rule name=severity]... <file.asm>")
+	}
+	severities := make(map[string]asm.Severity)
+	for _, rule := range rules {
+		name, level, ok := strings.Cut(rule, "=")
+		if !ok {
+			log.Fatalf("Invalid -rule %q, expected name=severity", rule)
+		}
+		severity, err := asm.ParseSeverity(level)
+		if err != nil {
+			log.Fatalf("Invalid -rule %q: %v", rule, err)
+		}
+		severities[name] = severity
+	}
+	filename := fs.Arg(0)
+	content := readSource(filename)
+	// the program must assemble before its instructions are worth linting
+	assembleSource(content, filename)
+	findings, err := newAssembler(content, filename).Lint(severities)
+	if err != nil {
+		log.Fatalf("Failed to check program: %v", err)
+	}
+	failed := false
+	for _, finding := range findings {
+		fmt.Printf("%s:%v\n", filename, finding)
+		failed = failed || finding.Severity == asm.SeverityError
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
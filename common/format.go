@@ -0,0 +1,68 @@
+package common
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// FloatFormat selects how float32 values are printed by PRINT_FLOAT, traces
+// and Value.String. Output never depends on the host locale. The zero
+// value is the default format, the shortest text that parses back to the
+// same float32.
+type FloatFormat struct {
+	// Verb is a strconv.FormatFloat format: 'g', 'e' or 'f'. Zero selects
+	// the default format.
+	Verb byte
+	// Precision is the number of digits, -1 for the fewest digits that
+	// round trip.
+	Precision int
+}
+
+// ParseFloatFormat parses a spec made of a verb and an optional precision,
+// such as "g" for the default format or "f2" for two decimals.
+func ParseFloatFormat(spec string) (FloatFormat, error) {
+	if spec == "" {
+		return FloatFormat{}, nil
+	}
+	format := FloatFormat{Verb: spec[0], Precision: -1}
+	switch format.Verb {
+	case 'g', 'e', 'f':
+	default:
+		return FloatFormat{}, fmt.Errorf("invalid float format %q: verb must be g, e or f", spec)
+	}
+	if len(spec) > 1 {
+		precision, err := strconv.Atoi(spec[1:])
+		if err != nil || precision < 0 || precision > 64 {
+			return FloatFormat{}, fmt.Errorf("invalid float format %q: precision must be 0 to 64", spec)
+		}
+		format.Precision = precision
+	}
+	return format, nil
+}
+
+// Format formats f.
+func (format FloatFormat) Format(f float32) string {
+	if format.Verb == 0 {
+		return strconv.FormatFloat(float64(f), 'g', -1, 32)
+	}
+	return strconv.FormatFloat(float64(f), format.Verb, format.Precision, 32)
+}
+
+// String returns the spec ParseFloatFormat reads back.
+func (format FloatFormat) String() string {
+	if format.Verb == 0 {
+		return "g"
+	}
+	if format.Precision < 0 {
+		return string(format.Verb)
+	}
+	return fmt.Sprintf("%c%d", format.Verb, format.Precision)
+}
+
+// Format formats the payload of the value, printing floats with format.
+func (v Value) Format(format FloatFormat) string {
+	if v.Kind() == ValueFloat32 {
+		return format.Format(v.AsFloat32())
+	}
+	return v.String()
+}
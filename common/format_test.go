@@ -0,0 +1,57 @@
+package common
+
+import (
+	"math"
+	"strconv"
+	"testing"
+)
+
+func TestDefaultFloatFormatRoundTrips(t *testing.T) {
+	for _, f := range []float32{0.1, 1, 1.5, -2.25, 3.4028235e38, 1e-45, 123456.79} {
+		text := FloatFormat{}.Format(f)
+		parsed, err := strconv.ParseFloat(text, 32)
+		if err != nil || float32(parsed) != f {
+			t.Errorf("Expected %q to read back as %v, got %v, %v", text, f, parsed, err)
+		}
+	}
+	if text := Float32Value(0.1).String(); text != "0.1" {
+		t.Errorf("Expected 0.1 to print as %q, got %q", "0.1", text)
+	}
+}
+
+func TestFloatFormats(t *testing.T) {
+	for _, tc := range []struct {
+		spec string
+		f    float32
+		want string
+	}{
+		{"", 2.5, "2.5"},
+		{"g", 2.5, "2.5"},
+		{"f2", 2.5, "2.50"},
+		{"f0", 2.5, "2"},
+		{"e3", 1234.5, "1.234e+03"},
+		{"f", 0.1, "0.1"},
+		{"", float32(math.Inf(-1)), "-Inf"},
+		{"f2", float32(math.NaN()), "NaN"},
+	} {
+		format, err := ParseFloatFormat(tc.spec)
+		if err != nil {
+			t.Errorf("Failed to parse %q: %v", tc.spec, err)
+			continue
+		}
+		if got := format.Format(tc.f); got != tc.want {
+			t.Errorf("Expected %q to format %v as %q, got %q", tc.spec, tc.f, tc.want, got)
+		}
+		if again, err := ParseFloatFormat(format.String()); err != nil || again.Format(tc.f) != tc.want {
+			t.Errorf("Expected %q to read back from %q, got %v", tc.spec, format, err)
+		}
+	}
+}
+
+func TestParseFloatFormatRejectsBadSpecs(t *testing.T) {
+	for _, spec := range []string{"x", "%f", "f-1", "f65", "g2x", "F"} {
+		if _, err := ParseFloatFormat(spec); err == nil {
+			t.Errorf("Expected %q to be rejected", spec)
+		}
+	}
+}
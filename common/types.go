@@ -1,29 +1,78 @@
+// Package common holds the value and type definitions shared by the
+// assembler, the VM and the heap.
 package common
 
 import (
 	"fmt"
-	"log"
 	"math"
 	"strings"
 )
 
+// ValueKind is the runtime type tag of a Value.
 type ValueKind byte
 
+// StructField describes one field of a struct type and its offset in the
+// struct's heap layout.
 type StructField struct {
 	Name       string
 	Type       ValueKind
 	Offset     uint
 	ArrayType  *ValueKind
 	StructType string
+	ID         uint16 // program-wide field id used by FLDGET/STFIELD
+	Enum       string // enum of an int32 field, empty if it has none
 }
 
+// StructType is a user-defined struct type.
 type StructType struct {
-	Name    string
-	Fields  []StructField
-	Size    uint
+	Name   string
+	Fields []StructField
+	Size   uint
+	// Methods maps method names to the index of the function implementing
+	// them in the function table
 	Methods map[string]uint
 }
 
+// ErrorStructName is the name of the built-in struct type of error values.
+const ErrorStructName = "Error"
+
+// ErrorStruct returns the built-in struct type of error values: an int32
+// code, a pointer to the message string and a pointer to the Error that
+// caused it, 0 if none. The assembler adds it to programs that use error
+// values and the VM defines it for programs that don't.
+func ErrorStruct() StructType {
+	return StructType{
+		Name: ErrorStructName,
+		Fields: []StructField{
+			{Name: "code", Type: ValueInt32},
+			{Name: "message", Type: ValuePtr},
+			{Name: "cause", Type: ValuePtr},
+		},
+	}
+}
+
+// DateTimeStructName is the name of the built-in struct type of calendar
+// dates.
+const DateTimeStructName = "DateTime"
+
+// DateTimeStruct returns the built-in struct type of calendar dates, a
+// time in UTC as int32 fields. The assembler adds it to programs that use
+// the time system calls and the VM defines it for programs that don't.
+func DateTimeStruct() StructType {
+	return StructType{
+		Name: DateTimeStructName,
+		Fields: []StructField{
+			{Name: "year", Type: ValueInt32},
+			{Name: "month", Type: ValueInt32},
+			{Name: "day", Type: ValueInt32},
+			{Name: "hour", Type: ValueInt32},
+			{Name: "minute", Type: ValueInt32},
+			{Name: "second", Type: ValueInt32},
+			{Name: "millisecond", Type: ValueInt32},
+		},
+	}
+}
+
 const (
 	ValueInt32 ValueKind = iota
 	ValueFloat32
@@ -35,12 +84,41 @@ const (
 	ValueByte
 )
 
+// Value is a tagged value as stored on the operand stack and in locals. It
+// is a single word: the kind in the top byte and the payload, the bits of a
+// number or a heap address, in the low 56 bits. Heap addresses of the
+// supported platforms fit in the payload. The zero Value is the int32 0.
 type Value struct {
-	Kind ValueKind
-	Raw  uint32 // 4 bytes
-	Ptr  uintptr
+	word uint64
+}
+
+const (
+	kindShift   = 56
+	payloadMask = 1<<kindShift - 1
+)
+
+// NewValue creates a Value of kind with the given payload: the bits of a
+// number or a heap address.
+func NewValue(kind ValueKind, payload uint64) Value {
+	return Value{word: uint64(kind)<<kindShift | payload&payloadMask}
+}
+
+// Kind returns the type tag of the value.
+func (v Value) Kind() ValueKind {
+	return ValueKind(v.word >> kindShift)
 }
 
+// Raw returns the bits of a number value.
+func (v Value) Raw() uint32 {
+	return uint32(v.word)
+}
+
+// Ptr returns the heap address held by a pointer value of any kind.
+func (v Value) Ptr() uintptr {
+	return uintptr(v.word & payloadMask)
+}
+
+// String formats the field name, type and offset.
 func (sf StructField) String() string {
 	var sb strings.Builder
 	sb.WriteString(fmt.Sprintf("%s: ", sf.Name))
@@ -57,6 +135,7 @@ func (sf StructField) String() string {
 	return sb.String()
 }
 
+// String formats the struct definition with its layout.
 func (st StructType) String() string {
 	var sb strings.Builder
 	sb.WriteString(fmt.Sprintf("struct %s {\n", st.Name))
@@ -72,8 +151,8 @@ func (st StructType) String() string {
 	// Methods
 	if len(st.Methods) > 0 {
 		sb.WriteString("  methods: {\n")
-		for name, addr := range st.Methods {
-			sb.WriteString(fmt.Sprintf("    %s: @%d\n", name, addr))
+		for name, index := range st.Methods {
+			sb.WriteString(fmt.Sprintf("    %s: function %d\n", name, index))
 		}
 		sb.WriteString("  }\n")
 	}
@@ -82,122 +161,139 @@ func (st StructType) String() string {
 	return sb.String()
 }
 
+var kindNames = [...]string{"int32", "float32", "ptr", "string", "array", "void", "struct", "byte"}
+
+// String returns the type name.
 func (v ValueKind) String() string {
-	return [...]string{"int32", "float32", "ptr", "string", "array", "void", "struct"}[v]
+	if int(v) < len(kindNames) {
+		return kindNames[v]
+	}
+	return fmt.Sprintf("kind(%d)", byte(v))
+}
+
+// TypeError reports an operation on a value of the wrong kind. The As*
+// accessors and the comparisons panic with a *TypeError, the VM turns it
+// into a runtime error of the program.
+type TypeError struct {
+	// Want describes the accepted kinds
+	Want string
+	Got  ValueKind
+}
+
+func (e *TypeError) Error() string {
+	return fmt.Sprintf("type mismatch: expected %s, got %v", e.Want, e.Got)
 }
 
+// AsInt32 returns the value as an int32. It panics with a *TypeError if the kind differs.
 func (v Value) AsInt32() int32 {
-	if v.Kind != ValueInt32 {
-		log.Fatalf("Value is not int32, its %v\n", v.Kind)
+	if v.Kind() != ValueInt32 {
+		panic(&TypeError{Want: "int32", Got: v.Kind()})
 	}
-	return int32(v.Raw)
+	return int32(v.word)
 }
 
+// AsFloat32 returns the value as a float32. It panics with a *TypeError if the kind differs.
 func (v Value) AsFloat32() float32 {
-	if v.Kind != ValueFloat32 {
-		log.Fatalf("Value is not float32, its %v\n", v.Kind)
+	if v.Kind() != ValueFloat32 {
+		panic(&TypeError{Want: "float32", Got: v.Kind()})
 	}
-	return math.Float32frombits(v.Raw)
+	return math.Float32frombits(uint32(v.word))
 }
 
+// AsPtr returns the value as a heap pointer. It panics with a *TypeError if the kind differs.
 func (v Value) AsPtr() uintptr {
-	if v.Kind != ValuePtr {
-		log.Fatalf("Value is not ptr, its %v\n", v.Kind)
+	if v.Kind() != ValuePtr {
+		panic(&TypeError{Want: "ptr", Got: v.Kind()})
 	}
-	return v.Ptr
+	return v.Ptr()
 }
 
+// AsByte returns the value as a byte. It panics with a *TypeError if the kind differs.
 func (v Value) AsByte() byte {
-	if v.Kind != ValueByte {
-		log.Fatalf("Value is not byte, its %v\n", v.Kind)
+	if v.Kind() != ValueByte {
+		panic(&TypeError{Want: "byte", Got: v.Kind()})
 	}
-	return byte(v.Raw & 0xFF)
+	return byte(v.word)
 }
 
+// ByteValue creates a byte Value.
 func ByteValue(val byte) Value {
-	return Value{
-		Kind: ValueByte,
-		Raw:  uint32(val),
-	}
+	return NewValue(ValueByte, uint64(val))
 }
 
+// PtrValue creates a pointer Value.
 func PtrValue(ptr uintptr) Value {
-	return Value{
-		Kind: ValuePtr,
-		Ptr:  ptr,
-	}
+	return NewValue(ValuePtr, uint64(ptr))
 }
 
+// Int32Value creates an int32 Value.
 func Int32Value(val int32) Value {
-	return Value{
-		Kind: ValueInt32,
-		Raw:  uint32(val),
-	}
+	return NewValue(ValueInt32, uint64(uint32(val)))
 }
 
+// Float32Value creates a float32 Value.
 func Float32Value(val float32) Value {
-	return Value{
-		Kind: ValueFloat32,
-		Raw:  math.Float32bits(val),
-	}
+	return NewValue(ValueFloat32, uint64(math.Float32bits(val)))
 }
 
+// String formats the payload of the value.
 func (v Value) String() string {
-	switch v.Kind {
+	switch v.Kind() {
 	case ValueInt32:
 		return fmt.Sprintf("%d", v.AsInt32())
 	case ValueFloat32:
-		return fmt.Sprintf("%f", v.AsFloat32())
-	case ValuePtr, ValueString, ValueStruct:
-		return fmt.Sprintf("%d", v.AsPtr())
+		return FloatFormat{}.Format(v.AsFloat32())
+	case ValuePtr, ValueString, ValueStruct, ValueArray:
+		return fmt.Sprintf("%d", v.Ptr())
 	case ValueByte:
 		return fmt.Sprintf("%d", v.AsByte())
 	default:
-		return fmt.Sprintf("<unknown ValueKind %d: raw=0x%08X>", v.Kind, v.Raw)
+		return fmt.Sprintf("<unknown ValueKind %d: raw=0x%08X>", byte(v.Kind()), v.Raw())
 	}
 }
 
+// Equals compares two numbers of the same kind. It panics with a
+// *TypeError for other values.
 func Equals(v1, v2 Value) bool {
-	if v1.Kind != v2.Kind {
-		log.Fatal("type mismatch for comparison")
+	if v1.Kind() != v2.Kind() {
+		panic(&TypeError{Want: v1.Kind().String(), Got: v2.Kind()})
 	}
-	switch v1.Kind {
+	switch v1.Kind() {
 	case ValueFloat32:
 		return v1.AsFloat32() == v2.AsFloat32()
 	case ValueInt32:
 		return v1.AsInt32() == v2.AsInt32()
 	default:
-		log.Fatal("Unuspported types")
-		return false
+		panic(&TypeError{Want: "int32 or float32", Got: v1.Kind()})
 	}
 }
 
+// LesserOrEqual reports whether v1 <= v2 for numbers of the same kind.
 func (v1 Value) LesserOrEqual(v2 Value) bool {
-	if v1.Kind != v2.Kind {
-		log.Fatal("Type mismatch for comaprison")
+	if v1.Kind() != v2.Kind() {
+		panic(&TypeError{Want: v1.Kind().String(), Got: v2.Kind()})
 	}
-	switch v1.Kind {
+	switch v1.Kind() {
 	case ValueFloat32:
 		return v1.AsFloat32() <= v2.AsFloat32()
 	case ValueInt32:
 		return v1.AsInt32() <= v2.AsInt32()
 	default:
-		log.Fatal("Unsupported types")
-		return false
+		panic(&TypeError{Want: "int32 or float32", Got: v1.Kind()})
 	}
 }
 
+// Lesser reports whether v1 < v2 for numbers of the same kind.
 func (v1 Value) Lesser(v2 Value) bool {
-	if v1.Kind != v2.Kind {
-		log.Fatal("Type mismatch for comaprison")
+	if v1.Kind() != v2.Kind() {
+		panic(&TypeError{Want: v1.Kind().String(), Got: v2.Kind()})
 	}
-	switch v1.Kind {
+	switch v1.Kind() {
 	case ValueFloat32:
 		return v1.AsFloat32() < v2.AsFloat32()
 	case ValueInt32:
 		return v1.AsInt32() < v2.AsInt32()
 	default:
-		log.Fatal("Unsupported types")
-		return false
+		panic(&TypeError{Want: "int32 or float32", Got: v1.Kind()})
 	}
 }
@@ -0,0 +1,131 @@
+package common
+
+import (
+	"math"
+	"testing"
+	"unsafe"
+)
+
+func TestValueIsOneWord(t *testing.T) {
+	if size := unsafe.Sizeof(Value{}); size != 8 {
+		t.Errorf("Expected a Value to take 8 bytes, got %d", size)
+	}
+}
+
+func TestZeroValueIsInt32Zero(t *testing.T) {
+	var v Value
+	if v.Kind() != ValueInt32 || v.AsInt32() != 0 {
+		t.Errorf("Expected the zero Value to be int32 0, got %v %v", v.Kind(), v)
+	}
+}
+
+// TestNumberRoundTrip checks every 32-bit pattern as an int32 and as the
+// bits of a float32, NaN payloads included.
+func TestNumberRoundTrip(t *testing.T) {
+	if testing.Short() {
+		t.Skip("exhaustive round trip skipped in short mode")
+	}
+	for bits := uint64(0); bits <= math.MaxUint32; bits++ {
+		i := Int32Value(int32(bits))
+		if i.Kind() != ValueInt32 || i.AsInt32() != int32(bits) || i.Raw() != uint32(bits) {
+			t.Fatalf("int32 %d did not round trip: kind %v, got %d", int32(bits), i.Kind(), i.AsInt32())
+		}
+		f := Float32Value(math.Float32frombits(uint32(bits)))
+		if f.Kind() != ValueFloat32 || math.Float32bits(f.AsFloat32()) != uint32(bits) {
+			t.Fatalf("float32 bits 0x%08x did not round trip: kind %v, got 0x%08x", bits, f.Kind(), math.Float32bits(f.AsFloat32()))
+		}
+	}
+}
+
+func TestByteRoundTrip(t *testing.T) {
+	for b := 0; b <= math.MaxUint8; b++ {
+		v := ByteValue(byte(b))
+		if v.Kind() != ValueByte || v.AsByte() != byte(b) {
+			t.Errorf("byte %d did not round trip: kind %v, got %d", b, v.Kind(), v.AsByte())
+		}
+	}
+}
+
+func TestPtrRoundTrip(t *testing.T) {
+	var local int
+	ptrs := []uintptr{0, 1, uintptr(unsafe.Pointer(&local)), uintptr(unsafe.Pointer(new([64]byte)))}
+	if unsafe.Sizeof(uintptr(0)) == 8 {
+		// not constants, which would overflow uintptr on 32-bit hosts
+		wide := uint64(payloadMask)
+		ptrs = append(ptrs, uintptr(wide), uintptr(wide>>9+1), uintptr(wide>>9))
+	} else {
+		ptrs = append(ptrs, math.MaxUint32)
+	}
+	for _, ptr := range ptrs {
+		v := PtrValue(ptr)
+		if v.Kind() != ValuePtr || v.AsPtr() != ptr {
+			t.Errorf("pointer 0x%x did not round trip: kind %v, got 0x%x", ptr, v.Kind(), v.AsPtr())
+		}
+		for _, kind := range []ValueKind{ValueString, ValueArray, ValueStruct} {
+			v := NewValue(kind, uint64(ptr))
+			if v.Kind() != kind || v.Ptr() != ptr {
+				t.Errorf("%v pointer 0x%x did not round trip: kind %v, got 0x%x", kind, ptr, v.Kind(), v.Ptr())
+			}
+		}
+	}
+}
+
+func TestKindRoundTrip(t *testing.T) {
+	for kind := 0; kind <= math.MaxUint8; kind++ {
+		for _, payload := range []uint64{0, 1, math.MaxUint32, payloadMask} {
+			v := NewValue(ValueKind(kind), payload)
+			if v.Kind() != ValueKind(kind) || uint64(v.Ptr()) != payload&uint64(^uintptr(0)) {
+				t.Errorf("kind %d with payload 0x%x did not round trip: got %d, 0x%x", kind, payload, v.Kind(), v.Ptr())
+			}
+		}
+	}
+}
+
+func TestAccessorsRejectOtherKinds(t *testing.T) {
+	values := []Value{Int32Value(1), Float32Value(1), PtrValue(1), ByteValue(1)}
+	accessors := []func(Value){
+		func(v Value) { v.AsInt32() },
+		func(v Value) { v.AsFloat32() },
+		func(v Value) { v.AsPtr() },
+		func(v Value) { v.AsByte() },
+	}
+	for i, value := range values {
+		for j, accessor := range accessors {
+			panicked := func() (panicked bool) {
+				defer func() { panicked = recover() != nil }()
+				accessor(value)
+				return false
+			}()
+			if panicked != (i != j) {
+				t.Errorf("Accessor %d on a %v value: panicked = %v", j, value.Kind(), panicked)
+			}
+		}
+	}
+}
+
+// BenchmarkStackTraffic pushes and pops values the way the interpreter's
+// operand stack does.
+func BenchmarkStackTraffic(b *testing.B) {
+	stack := make([]Value, 0, 64)
+	for i := 0; i < b.N; i++ {
+		for j := int32(0); j < 64; j++ {
+			stack = append(stack, Int32Value(j))
+		}
+		var sum int32
+		for len(stack) > 0 {
+			sum += stack[len(stack)-1].AsInt32()
+			stack = stack[:len(stack)-1]
+		}
+		if sum != 2016 {
+			b.Fatal(sum)
+		}
+	}
+}
+
+func BenchmarkFloat32Value(b *testing.B) {
+	var sum float32
+	for i := 0; i < b.N; i++ {
+		sum += Float32Value(float32(i)).AsFloat32()
+	}
+	_ = sum
+}
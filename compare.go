@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/AndreiAlbert/gvm/vm"
+)
+
+// comparison is the outcome of running one side of gvm compare
+type comparison struct {
+	name   string
+	stdout []byte
+	err    error
+	usage  vm.Usage
+}
+
+func compareCommand(args []string) {
+	fs := flag.NewFlagSet("compare", flag.ExitOnError)
+	input := fs.String("input", "", "file fed to both programs as stdin")
+	noCache := fs.Bool("no-cache", false, "always assemble, bypassing the build cache")
+	maxInstructions := fs.Uint64("max-instructions", 0, "stop each program after this many instructions (0: no limit)")
+	files := parseInterspersed(fs, args)
+	if len(files) != 2 {
+		log.Fatal("usage: gvm compare [-input file] [-no-cache] [-max-instructions n] <a> <b>")
+	}
+	var stdin []byte
+	if *input != "" {
+		var err error
+		if stdin, err = os.ReadFile(*input); err != nil {
+			log.Fatalf("Failed to read input: %v", err)
+		}
+	}
+	opts := vm.Options{MaxInstructions: *maxInstructions}
+	a := runCompared(files[0], !*noCache, stdin, opts)
+	b := runCompared(files[1], !*noCache, stdin, opts)
+	if !writeComparison(os.Stdout, a, b) {
+		os.Exit(1)
+	}
+}
+
+// parseInterspersed parses flags that may follow the positional arguments,
+// as in gvm compare a.asm b.asm -input in.txt, and returns the positionals
+func parseInterspersed(fs *flag.FlagSet, args []string) []string {
+	var positional []string
+	for {
+		fs.Parse(args)
+		if fs.NArg() == 0 {
+			return positional
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+}
+
+func runCompared(filename string, useCache bool, stdin []byte, opts vm.Options) comparison {
+	result := comparison{name: filename}
+	program := loadProgram(filename, useCache)
+	defer program.Close()
+	var stdout bytes.Buffer
+	opts.Stdin = bytes.NewReader(stdin)
+	opts.Stdout = &stdout
+	machine, err := vm.NewVmFromProgram(program, opts)
+	if err != nil {
+		log.Fatalf("%s: %v", filename, err)
+	}
+	defer machine.Close()
+	result.err = machine.Run()
+	result.stdout = stdout.Bytes()
+	result.usage = machine.Usage()
+	return result
+}
+
+// writeComparison reports output differences and resource deltas of b
+// relative to a. It returns whether both programs behaved the same.
+func writeComparison(w io.Writer, a, b comparison) bool {
+	same := true
+	if bytes.Equal(a.stdout, b.stdout) {
+		fmt.Fprintf(w, "output: identical (%d bytes)\n", len(a.stdout))
+	} else {
+		same = false
+		line, offset := firstDifference(a.stdout, b.stdout)
+		fmt.Fprintf(w, "output: differs at line %d, byte %d\n", line, offset)
+		fmt.Fprintf(w, "  %s: %q\n", a.name, lineAt(a.stdout, line))
+		fmt.Fprintf(w, "  %s: %q\n", b.name, lineAt(b.stdout, line))
+	}
+	if errorText(a.err) != errorText(b.err) {
+		same = false
+		fmt.Fprintf(w, "errors differ\n  %s: %s\n  %s: %s\n", a.name, errorText(a.err), b.name, errorText(b.err))
+	} else if a.err != nil {
+		fmt.Fprintf(w, "both failed: %v\n", a.err)
+	}
+	fmt.Fprintln(w)
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "\t%s\t%s\tdelta\n", a.name, b.name)
+	writeDelta(tw, "instructions", a.usage.Instructions, b.usage.Instructions)
+	writeDelta(tw, "peak call depth", uint64(a.usage.PeakCallDepth), uint64(b.usage.PeakCallDepth))
+	writeDelta(tw, "peak heap bytes", a.usage.PeakHeapBytes, b.usage.PeakHeapBytes)
+	writeDelta(tw, "heap bytes allocated", a.usage.HeapBytesAllocated, b.usage.HeapBytesAllocated)
+	writeDelta(tw, "allocations", a.usage.Allocations, b.usage.Allocations)
+	for _, name := range syscallNames(a.usage, b.usage) {
+		writeDelta(tw, "syscall "+name, a.usage.Syscalls[name], b.usage.Syscalls[name])
+	}
+	fmt.Fprintf(tw, "wall time\t%v\t%v\t%+v\n", a.usage.WallTime, b.usage.WallTime, b.usage.WallTime-a.usage.WallTime)
+	tw.Flush()
+	return same
+}
+
+func writeDelta(w io.Writer, name string, a, b uint64) {
+	delta := int64(b) - int64(a)
+	if a == 0 || delta == 0 {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%+d\n", name, a, b, delta)
+		return
+	}
+	fmt.Fprintf(w, "%s\t%d\t%d\t%+d (%+.1f%%)\n", name, a, b, delta, float64(delta)*100/float64(a))
+}
+
+func syscallNames(usages ...vm.Usage) []string {
+	seen := make(map[string]bool)
+	var names []string
+	for _, usage := range usages {
+		for name := range usage.Syscalls {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// firstDifference returns the 1-based line and byte offset of the first
+// byte where a and b differ
+func firstDifference(a, b []byte) (line, offset int) {
+	line = 1
+	for offset = 0; offset < len(a) && offset < len(b) && a[offset] == b[offset]; offset++ {
+		if a[offset] == '\n' {
+			line++
+		}
+	}
+	return line, offset + 1
+}
+
+// lineAt returns the 1-based line n of out without its newline
+func lineAt(out []byte, n int) []byte {
+	lines := bytes.SplitAfter(out, []byte("\n"))
+	if n > len(lines) {
+		return nil
+	}
+	return bytes.TrimSuffix(lines[n-1], []byte("\n"))
+}
+
+func errorText(err error) string {
+	if err == nil {
+		return "none"
+	}
+	return err.Error()
+}
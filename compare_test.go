@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/AndreiAlbert/gvm/vm"
+)
+
+func TestParseInterspersed(t *testing.T) {
+	tests := []struct {
+		name       string
+		args       []string
+		positional []string
+		input      string
+	}{
+		{"flags first", []string{"-input", "in.txt", "a.asm", "b.asm"}, []string{"a.asm", "b.asm"}, "in.txt"},
+		{"flags last", []string{"a.asm", "b.asm", "-input", "in.txt"}, []string{"a.asm", "b.asm"}, "in.txt"},
+		{"flags between", []string{"a.asm", "-input=in.txt", "b.asm"}, []string{"a.asm", "b.asm"}, "in.txt"},
+		{"no flags", []string{"a.asm", "b.asm"}, []string{"a.asm", "b.asm"}, ""},
+		{"no arguments", nil, nil, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := flag.NewFlagSet("compare", flag.ContinueOnError)
+			input := fs.String("input", "", "")
+			positional := parseInterspersed(fs, tt.args)
+			if !reflect.DeepEqual(positional, tt.positional) {
+				t.Errorf("Expected positionals %q, got %q", tt.positional, positional)
+			}
+			if *input != tt.input {
+				t.Errorf("Expected -input %q, got %q", tt.input, *input)
+			}
+		})
+	}
+}
+
+func TestFirstDifference(t *testing.T) {
+	tests := []struct {
+		name         string
+		a, b         string
+		line, offset int
+		lineA, lineB string
+	}{
+		{"equal", "one\ntwo\n", "one\ntwo\n", 3, 9, "", ""},
+		{"first byte", "one\n", "One\n", 1, 1, "one", "One"},
+		{"mid-line", "one\ntwo\nsix\n", "one\ntwX\nsix\n", 2, 7, "two", "twX"},
+		{"prefix at line end", "one\n", "one\ntwo\n", 2, 5, "", "two"},
+		{"prefix mid-line", "one\ntw", "one\ntwo\n", 2, 7, "tw", "two"},
+		{"empty", "", "out", 1, 1, "", "out"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, b := []byte(tt.a), []byte(tt.b)
+			for _, order := range [][2][]byte{{a, b}, {b, a}} {
+				line, offset := firstDifference(order[0], order[1])
+				if line != tt.line || offset != tt.offset {
+					t.Errorf("Expected line %d byte %d, got line %d byte %d", tt.line, tt.offset, line, offset)
+				}
+			}
+			if got := string(lineAt(a, tt.line)); got != tt.lineA {
+				t.Errorf("Expected line %d of a to be %q, got %q", tt.line, tt.lineA, got)
+			}
+			if got := string(lineAt(b, tt.line)); got != tt.lineB {
+				t.Errorf("Expected line %d of b to be %q, got %q", tt.line, tt.lineB, got)
+			}
+		})
+	}
+}
+
+func TestLineAtPastTheEnd(t *testing.T) {
+	if line := lineAt([]byte("one\n"), 3); line != nil {
+		t.Errorf("Expected no line 3, got %q", line)
+	}
+}
+
+func TestWriteComparison(t *testing.T) {
+	a := comparison{name: "a.asm", stdout: []byte("one\ntwo\n"), usage: vm.Usage{Instructions: 100}}
+	b := comparison{name: "b.asm", stdout: []byte("one\ntwo\n"), usage: vm.Usage{Instructions: 150}}
+	var out bytes.Buffer
+	if !writeComparison(&out, a, b) {
+		t.Errorf("Expected equal outputs to compare the same:\n%s", out.String())
+	}
+	for _, want := range []string{"output: identical (8 bytes)", "+50 (+50.0%)"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("Expected %q in:\n%s", want, out.String())
+		}
+	}
+
+	b.stdout = []byte("one\ntwX\n")
+	out.Reset()
+	if writeComparison(&out, a, b) {
+		t.Error("Expected different outputs not to compare the same")
+	}
+	for _, want := range []string{"output: differs at line 2, byte 7", `a.asm: "two"`, `b.asm: "twX"`} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("Expected %q in:\n%s", want, out.String())
+		}
+	}
+}
@@ -0,0 +1,524 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/AndreiAlbert/gvm/vm"
+)
+
+const debugHelp = `Commands:
+  step [n], s      execute the next n instructions (default 1)
+  back [n], rs     step back over the last n instructions (default 1)
+  continue, c      run until a breakpoint, a watchpoint or the end
+  next [n], n      execute the next n instructions, running the functions
+                   they call to their return (default 1)
+  finish           run until the current function returns
+  until <at>, u    run until the instruction at an address, function, label
+                   or :line is next, or the current function returns
+  break <at> [if <expr>], b
+                   stop before the instruction at an address, function,
+                   label or :line, when the expression holds if one is given
+  delete <at>      remove a breakpoint
+  watch <expr>, w  stop when the value of the expression changes
+  unwatch <id>     remove a watchpoint
+  info             list the breakpoints and watchpoints
+  print <expr>, p  evaluate an expression
+  reload <func>    re-assemble the source and replace the body of a function
+  alias [name cmd] define name as a command, or list the aliases; $1..$9 in
+                   cmd are replaced by the arguments, which are appended
+                   otherwise
+  unalias <name>   remove an alias
+  source <file>    run the commands in a file
+  explain [at], x  explain the instruction at IP, or at an address
+  stack            show the operand stack of the current frame
+  locals           show the locals of the current frame
+  quit, q          leave the debugger
+
+Expressions combine numbers, locals (local0), operand stack values (stack0
+is the top), ip, depth and instructions with + - * / % == != < <= > >= &&
+|| ! and read the heap with *ptr, ptr.field and ptr[index]. f(a, b) calls
+the guest function f, which must not have side effects. Several commands
+can be given on one line, separated by ;.
+
+At startup the commands in ~/.gvmdbginit are run, to define aliases and
+breakpoints.`
+
+func debugCommand(args []string) {
+	fs := flag.NewFlagSet("debug", flag.ExitOnError)
+	noCache := fs.Bool("no-cache", false, "always assemble, bypassing the build cache")
+	history := fs.Int("history", 10000, "number of instructions back can step over")
+	initScript := fs.String("init", "", "startup script to run instead of ~/.gvmdbginit")
+	noInit := fs.Bool("no-init", false, "don't run a startup script")
+	coreFile := fs.String("core", "", "open a crash dump written by gvm run -core")
+	fs.Parse(args)
+	if fs.NArg() < 1 && *coreFile == "" {
+		log.Fatal("usage: gvm debug [-no-cache] [-history n] [-init file | -no-init] [-core dump] <file.asm|file.gvmbc>")
+	}
+	file := fs.Arg(0)
+	var core *vm.Core
+	if *coreFile != "" {
+		core = readCoreFile(*coreFile)
+		if file == "" {
+			file = core.Program
+		}
+		if file == "" {
+			log.Fatal("the crash dump doesn't name its program, pass it after the dump")
+		}
+	}
+	program := loadProgram(file, !*noCache)
+	defer program.Close()
+	var machine *vm.VM
+	var err error
+	if core != nil {
+		machine, err = vm.NewVmFromCore(program, core, vm.Options{})
+	} else {
+		machine, err = vm.NewVmFromProgram(program, vm.Options{History: *history, AllocationSites: true})
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer machine.Close()
+	d := vm.NewDebugger(machine)
+	d.AddLabels(program.Labels)
+	d.AddLines(program.Lines)
+	d.AddEnums(program.Enums)
+	s := &debugSession{d: d, out: os.Stdout, aliases: make(map[string]string)}
+	if !strings.HasSuffix(file, ".gvmbc") {
+		s.source = file
+	}
+	fmt.Fprintln(s.out, "gvm debugger, type help for the commands")
+	if !*noInit {
+		script, required := *initScript, true
+		if script == "" {
+			home, err := os.UserHomeDir()
+			script, required = filepath.Join(home, debugInitFile), false
+			if err != nil {
+				script = ""
+			}
+		}
+		if script != "" {
+			if err := s.runScript(script, required); err == errQuit {
+				return
+			} else if err != nil {
+				fmt.Fprintln(s.out, err)
+			}
+		}
+	}
+	if core != nil {
+		showCore(d, core, s.out)
+	} else {
+		showPosition(d, s.out)
+	}
+	s.loop(os.Stdin)
+}
+
+func readCoreFile(path string) *vm.Core {
+	f, err := os.Open(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+	core, err := vm.ReadCore(f)
+	if err != nil {
+		log.Fatalf("%s: %v", path, err)
+	}
+	return core
+}
+
+// showCore describes the crash of a program opened from a dump. The program
+// can be inspected but not run.
+func showCore(d *vm.Debugger, core *vm.Core, out io.Writer) {
+	fmt.Fprintf(out, "crash dump of %s after %d instructions: %s\n", core.Program, core.Instructions, core.Err)
+	for _, name := range core.Trace {
+		fmt.Fprintf(out, "\tat %s\n", name)
+	}
+	text, err := d.Instruction(d.VM().Ip)
+	if err != nil {
+		text = err.Error()
+	}
+	fmt.Fprintf(out, "%08x  %s\n", d.VM().Ip, text)
+}
+
+// debugInitFile is the startup script in the home directory
+const debugInitFile = ".gvmdbginit"
+
+// debugSession is the state of gvm debug
+type debugSession struct {
+	d   *vm.Debugger
+	out io.Writer
+	// source is the assembly file reload reads, empty when debugging a
+	// container
+	source  string
+	aliases map[string]string
+}
+
+// loop reads debugger commands from in until quit or the end of the input
+func (s *debugSession) loop(in io.Reader) {
+	scanner := bufio.NewScanner(in)
+	for {
+		fmt.Fprint(s.out, "(gvm) ")
+		if !scanner.Scan() {
+			fmt.Fprintln(s.out)
+			return
+		}
+		if err := s.exec(scanner.Text(), 0); err == errQuit {
+			return
+		} else if err != nil {
+			fmt.Fprintln(s.out, err)
+		}
+	}
+}
+
+// runScript runs the commands in a file, one per line, skipping blank lines
+// and comments starting with #. A missing file is only an error if the
+// script is required. Failing commands are reported with their line and
+// don't stop the script.
+func (s *debugSession) runScript(path string, required bool) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) && !required {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for i, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), "#") {
+			continue
+		}
+		if err := s.exec(line, 0); err == errQuit {
+			return err
+		} else if err != nil {
+			fmt.Fprintf(s.out, "%s:%d: %v\n", path, i+1, err)
+		}
+	}
+	return nil
+}
+
+// maxAliasDepth bounds the expansion of aliases defined in terms of each
+// other
+const maxAliasDepth = 16
+
+// exec runs the commands of a line, separated by ;, expanding aliases. It
+// stops at the first command that fails. An alias definition takes the rest
+// of the line, so an alias can run several commands.
+func (s *debugSession) exec(line string, depth int) error {
+	texts := strings.Split(line, ";")
+	if words := strings.Fields(line); len(words) > 0 && words[0] == "alias" {
+		texts = []string{line}
+	}
+	for _, text := range texts {
+		words := strings.Fields(text)
+		if len(words) == 0 {
+			continue
+		}
+		expansion, ok := s.aliases[words[0]]
+		if !ok {
+			if err := s.command(words[0], words[1:]); err != nil {
+				return err
+			}
+			continue
+		}
+		if depth == maxAliasDepth {
+			return fmt.Errorf("alias %s: expanded more than %d times, it may refer to itself", words[0], maxAliasDepth)
+		}
+		if err := s.exec(expandAlias(expansion, words[1:]), depth+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// expandAlias substitutes the arguments for $1 to $9 in an alias, or
+// appends them when the alias has no placeholder
+func expandAlias(expansion string, args []string) string {
+	if !strings.Contains(expansion, "$") {
+		return strings.Join(append([]string{expansion}, args...), " ")
+	}
+	for i := 9; i >= 1; i-- {
+		arg := ""
+		if i <= len(args) {
+			arg = args[i-1]
+		}
+		expansion = strings.ReplaceAll(expansion, "$"+strconv.Itoa(i), arg)
+	}
+	return expansion
+}
+
+var errQuit = errors.New("quit")
+
+func (s *debugSession) command(command string, args []string) error {
+	d, out, source := s.d, s.out, s.source
+	machine := d.VM()
+	switch command {
+	case "help", "h":
+		fmt.Fprintln(out, debugHelp)
+	case "quit", "q":
+		return errQuit
+	case "step", "s":
+		n, err := debugCount(command, args)
+		if err != nil {
+			return err
+		}
+		for ; n > 0 && machine.Running; n-- {
+			if err := d.Step(); err != nil {
+				return err
+			}
+		}
+		showPosition(d, out)
+	case "back", "rs":
+		n, err := debugCount(command, args)
+		if err != nil {
+			return err
+		}
+		for ; n > 0; n-- {
+			if err := d.StepBack(); err != nil {
+				showPosition(d, out)
+				return err
+			}
+		}
+		showPosition(d, out)
+	case "continue", "c":
+		stop, err := d.Continue()
+		if err != nil {
+			fmt.Fprintln(out, err)
+		} else if machine.Running {
+			fmt.Fprintln(out, stop)
+		}
+		showPosition(d, out)
+	case "next", "n":
+		n, err := debugCount(command, args)
+		if err != nil {
+			return err
+		}
+		for ; n > 0 && machine.Running; n-- {
+			if stop, err := d.Next(); reportStop(out, stop, err) {
+				break
+			}
+		}
+		showPosition(d, out)
+	case "finish":
+		if len(args) != 0 {
+			return errors.New("finish takes no arguments")
+		}
+		stop, err := d.Finish()
+		reportStop(out, stop, err)
+		showPosition(d, out)
+	case "until", "u":
+		if len(args) != 1 {
+			return fmt.Errorf("%s: expected an address, function, label or :line", command)
+		}
+		address, err := d.Resolve(args[0])
+		if err != nil {
+			return err
+		}
+		stop, err := d.Until(address)
+		reportStop(out, stop, err)
+		showPosition(d, out)
+	case "break", "b":
+		if len(args) != 1 && (len(args) < 3 || args[1] != "if") {
+			return fmt.Errorf("%s: expected an address, function or label and an optional if <expr>", command)
+		}
+		address, err := d.Resolve(args[0])
+		if err != nil {
+			return err
+		}
+		if len(args) == 1 {
+			d.SetBreakpoint(address)
+			fmt.Fprintf(out, "breakpoint at %08x\n", address)
+			return nil
+		}
+		condition := strings.Join(args[2:], " ")
+		if err := d.SetConditionalBreakpoint(address, condition); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "breakpoint at %08x if %s\n", address, condition)
+	case "delete":
+		if len(args) != 1 {
+			return fmt.Errorf("%s: expected an address, function or label", command)
+		}
+		address, err := d.Resolve(args[0])
+		if err != nil {
+			return err
+		}
+		d.ClearBreakpoint(address)
+	case "watch", "w":
+		if len(args) == 0 {
+			return fmt.Errorf("%s: expected an expression", command)
+		}
+		w, err := d.Watch(strings.Join(args, " "))
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "watchpoint %d on %s, now %s\n", w.ID, w.Expr, w.Value())
+	case "unwatch":
+		id := 0
+		if len(args) == 1 {
+			id, _ = strconv.Atoi(args[0])
+		}
+		if !d.Unwatch(id) {
+			return fmt.Errorf("%s: expected the id of a watchpoint", command)
+		}
+	case "info":
+		for _, b := range d.Breakpoints() {
+			fmt.Fprintf(out, "  breakpoint at %08x", b.Address)
+			if b.Condition != nil {
+				fmt.Fprintf(out, " if %s", b.Condition)
+			}
+			fmt.Fprintf(out, ", hit %d times\n", b.Hits)
+		}
+		for _, w := range d.Watchpoints() {
+			fmt.Fprintf(out, "  watchpoint %d on %s, last %s\n", w.ID, w.Expr, w.Value())
+		}
+	case "print", "p":
+		if len(args) == 0 {
+			return fmt.Errorf("%s: expected an expression", command)
+		}
+		expr, err := vm.ParseExpr(strings.Join(args, " "))
+		if err != nil {
+			return err
+		}
+		value, err := expr.Eval(machine)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(out, d.Format(expr, value))
+	case "explain", "x":
+		address := machine.Ip
+		if len(args) > 0 {
+			var err error
+			if address, err = d.Resolve(args[0]); err != nil {
+				return err
+			}
+		}
+		e, err := machine.Explain(address)
+		if err != nil {
+			return err
+		}
+		e.WriteTo(out)
+	case "stack":
+		frame := machine.CallStack[len(machine.CallStack)-1]
+		for i := len(frame.LocalStack) - 1; i >= 0; i-- {
+			value := frame.LocalStack[i]
+			fmt.Fprintf(out, "  %d  %v:%v\n", i, value.Kind(), value)
+		}
+	case "locals":
+		frame := machine.CallStack[len(machine.CallStack)-1]
+		indexes := make([]uint32, 0, len(frame.Locals))
+		for index := range frame.Locals {
+			indexes = append(indexes, index)
+		}
+		sort.Slice(indexes, func(i, j int) bool { return indexes[i] < indexes[j] })
+		for _, index := range indexes {
+			value := frame.Locals[index]
+			fmt.Fprintf(out, "  %d  %v:%v\n", index, value.Kind(), value)
+		}
+	case "reload":
+		if len(args) != 1 {
+			return fmt.Errorf("%s: expected a function name", command)
+		}
+		if source == "" {
+			return fmt.Errorf("%s: needs the assembly source, not a container", command)
+		}
+		text, err := os.ReadFile(source)
+		if err != nil {
+			return err
+		}
+		patch, err := newAssembler(text, source).AssembleFunction(args[0], uint(len(machine.Bytecode)))
+		if err != nil {
+			return err
+		}
+		if err := d.ReplaceFunction(args[0], patch); err != nil {
+			return err
+		}
+		if f, ok := machine.Program().LookupFunction(args[0]); ok {
+			fmt.Fprintf(out, "%s now starts at %08x\n", f.Name, f.Address)
+		}
+		for _, frame := range machine.CallStack {
+			if frame.Function != nil && frame.Function.Name == args[0] || frame.Function == nil && args[0] == "main" {
+				fmt.Fprintf(out, "calls already in %s finish in the old body\n", args[0])
+				break
+			}
+		}
+	case "alias":
+		if len(args) == 0 {
+			names := make([]string, 0, len(s.aliases))
+			for name := range s.aliases {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				fmt.Fprintf(out, "  %s = %s\n", name, s.aliases[name])
+			}
+			return nil
+		}
+		if len(args) > 1 && args[1] == "=" {
+			args = append(args[:1], args[2:]...)
+		}
+		if len(args) < 2 {
+			return fmt.Errorf("%s: expected a name and a command", command)
+		}
+		s.aliases[args[0]] = strings.Join(args[1:], " ")
+	case "unalias":
+		if len(args) != 1 || s.aliases[args[0]] == "" {
+			return fmt.Errorf("%s: expected the name of an alias", command)
+		}
+		delete(s.aliases, args[0])
+	case "source":
+		if len(args) != 1 {
+			return fmt.Errorf("%s: expected a file", command)
+		}
+		return s.runScript(args[0], true)
+	default:
+		return fmt.Errorf("unknown command %q, type help for the commands", command)
+	}
+	return nil
+}
+
+// debugCount parses the optional count of step and back
+func debugCount(command string, args []string) (int, error) {
+	if len(args) == 0 {
+		return 1, nil
+	}
+	n, err := strconv.Atoi(args[0])
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("%s: %q is not a count", command, args[0])
+	}
+	return n, nil
+}
+
+// reportStop prints why a run ended before reaching its target: an error,
+// a breakpoint or a watchpoint. It reports whether it did.
+func reportStop(out io.Writer, stop vm.Stop, err error) bool {
+	if err != nil {
+		fmt.Fprintln(out, err)
+		return true
+	}
+	if stop.Breakpoint != nil || stop.Watchpoint != nil {
+		fmt.Fprintln(out, stop)
+		return true
+	}
+	return false
+}
+
+func showPosition(d *vm.Debugger, out io.Writer) {
+	machine := d.VM()
+	if !machine.Running {
+		fmt.Fprintln(out, "the program has stopped")
+		return
+	}
+	text, err := d.Instruction(machine.Ip)
+	if err != nil {
+		text = err.Error()
+	}
+	fmt.Fprintf(out, "%08x  %s\n", machine.Ip, text)
+}
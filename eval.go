@@ -0,0 +1,53 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/AndreiAlbert/gvm/asm"
+	"github.com/AndreiAlbert/gvm/common"
+	"github.com/AndreiAlbert/gvm/vm"
+)
+
+// evalCommand runs a snippet of instructions in a synthesized main and
+// prints the values it leaves on the stack
+func evalCommand(args []string) {
+	fs := flag.NewFlagSet("eval", flag.ExitOnError)
+	snippet := fs.String("e", "", "instructions to run, separated by ; or newlines")
+	maxInstructions := fs.Uint64("max-instructions", 0, "stop after this many instructions (0: no limit)")
+	fs.Parse(args)
+	if *snippet == "" || fs.NArg() > 0 {
+		log.Fatal("usage: gvm eval [-max-instructions n] -e 'push int32 2; push int32 3; iadd'")
+	}
+	program, err := asm.NewAssembler(asm.WrapMain(*snippet)).Assemble()
+	if err != nil {
+		log.Fatalf("Failed to assemble snippet: %v", err)
+	}
+	defer program.Close()
+	machine, err := vm.NewVmFromProgram(program, vm.Options{MaxInstructions: *maxInstructions})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer machine.Close()
+	if err := machine.Run(); err != nil {
+		log.Print(err)
+		os.Exit(1)
+	}
+	if len(machine.CallStack) == 0 {
+		return
+	}
+	for _, value := range machine.CallStack[len(machine.CallStack)-1].LocalStack {
+		fmt.Println(formatResult(machine, value))
+	}
+}
+
+// formatResult formats a value left by a snippet as kind:value, pointers
+// as the object they point to
+func formatResult(machine *vm.VM, value common.Value) string {
+	if value.Kind() == common.ValuePtr {
+		return machine.Heap.Format(value, common.FloatFormat{})
+	}
+	return fmt.Sprintf("%v:%v", value.Kind(), value)
+}
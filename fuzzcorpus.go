@@ -0,0 +1,67 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/AndreiAlbert/gvm/bytecode"
+	"github.com/AndreiAlbert/gvm/vm"
+)
+
+func fuzzcorpusCommand(args []string) {
+	fs := flag.NewFlagSet("fuzzcorpus", flag.ExitOnError)
+	output := fs.String("o", "fuzzcorpus", "directory the variants are written to")
+	count := fs.Int("n", 100, "number of variants per program")
+	seed := fs.Int64("seed", 1, "seed of the mutations, the same seed gives the same variants")
+	check := fs.Bool("check", false, "run every variant and fail if one crashes the loader or the VM")
+	files := parseInterspersed(fs, args)
+	if len(files) == 0 {
+		log.Fatal("usage: gvm fuzzcorpus [-o dir] [-n count] [-seed n] [-check] <file.asm|file.gvmbc>...")
+	}
+	if err := os.MkdirAll(*output, 0o755); err != nil {
+		log.Fatal(err)
+	}
+	rng := rand.New(rand.NewSource(*seed))
+	outcomes := make(map[vm.ProbeOutcome]int)
+	crashed := false
+	for _, file := range files {
+		program := loadProgram(file, true)
+		data, err := bytecode.EncodeBytes(program)
+		program.Close()
+		if err != nil {
+			log.Fatalf("Failed to encode %s: %v", file, err)
+		}
+		base := strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))
+		for i := 0; i < *count; i++ {
+			variant, kind, err := vm.Mutate(data, rng)
+			if err != nil {
+				log.Fatalf("Failed to mutate %s: %v", file, err)
+			}
+			path := filepath.Join(*output, fmt.Sprintf("%s-%03d-%v.gvmbc", base, i, kind))
+			if err := os.WriteFile(path, variant, 0o644); err != nil {
+				log.Fatal(err)
+			}
+			if !*check {
+				continue
+			}
+			outcome, err := vm.Probe(variant)
+			outcomes[outcome]++
+			if outcome == vm.ProbeCrashed {
+				crashed = true
+				fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+			}
+		}
+	}
+	if *check {
+		fmt.Printf("%d rejected, %d failed, %d completed, %d crashed\n",
+			outcomes[vm.ProbeRejected], outcomes[vm.ProbeFailed], outcomes[vm.ProbeCompleted], outcomes[vm.ProbeCrashed])
+	}
+	if crashed {
+		os.Exit(1)
+	}
+}
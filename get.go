@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/AndreiAlbert/gvm/asm"
+)
+
+// modulesDir holds the libraries fetched by gvm get, next to lockFile
+const (
+	modulesDir = "gvm_modules"
+	lockFile   = "gvm.lock"
+)
+
+// maxLibrarySize bounds the download of a library
+const maxLibrarySize = 16 << 20
+
+// libraryExtensions are the file types .import resolves, in the order
+// they are tried
+var libraryExtensions = []string{".gvmlib", ".asm"}
+
+// lockEntry records where a library in modulesDir came from and the
+// SHA-256 of its content
+type lockEntry struct {
+	File string
+	URL  string
+	Hash string
+}
+
+func getCommand(args []string) {
+	fs := flag.NewFlagSet("get", flag.ExitOnError)
+	dir := fs.String("dir", ".", "directory holding gvm.lock and gvm_modules")
+	fs.Parse(args)
+	lock, err := readLock(*dir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	client := &http.Client{Timeout: time.Minute}
+	if fs.NArg() == 0 {
+		// restore the locked libraries, which must not have changed
+		if len(lock) == 0 {
+			log.Fatalf("usage: gvm get [-dir dir] <url>...; %s lists no library to restore", lockFile)
+		}
+		for _, entry := range lock {
+			data, err := fetchLibrary(client, entry.URL)
+			if err != nil {
+				log.Fatal(err)
+			}
+			if hash := contentHash(data); hash != entry.Hash {
+				log.Fatalf("%s: %s changed since it was locked, its hash is %s instead of %s", entry.File, entry.URL, hash, entry.Hash)
+			}
+			if err := writeLibrary(*dir, entry.File, data); err != nil {
+				log.Fatal(err)
+			}
+		}
+		fmt.Printf("restored %d libraries into %s\n", len(lock), filepath.Join(*dir, modulesDir))
+		return
+	}
+	for _, rawURL := range fs.Args() {
+		file, err := libraryFile(rawURL)
+		if err != nil {
+			log.Fatal(err)
+		}
+		data, err := fetchLibrary(client, rawURL)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := checkLibrary(data); err != nil {
+			log.Fatalf("%s: %v", rawURL, err)
+		}
+		if err := writeLibrary(*dir, file, data); err != nil {
+			log.Fatal(err)
+		}
+		entry := lockEntry{File: file, URL: rawURL, Hash: contentHash(data)}
+		if old, ok := lock[file]; ok && old.URL != entry.URL {
+			fmt.Printf("%s: replacing the library from %s\n", file, old.URL)
+		}
+		lock[file] = entry
+		fmt.Printf("%s %s\n", file, entry.Hash)
+	}
+	if err := writeLock(*dir, lock); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// libraryFile returns the name a library fetched from rawURL is saved as:
+// the last element of the path, which must be a .gvmlib or .asm file
+func libraryFile(rawURL string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", fmt.Errorf("%s: only http and https URLs can be fetched", rawURL)
+	}
+	file := path.Base(u.Path)
+	if err := checkLibraryName(file); err != nil {
+		return "", fmt.Errorf("%s: %w", rawURL, err)
+	}
+	for _, ext := range libraryExtensions {
+		if strings.HasSuffix(file, ext) && len(file) > len(ext) {
+			return file, nil
+		}
+	}
+	return "", fmt.Errorf("%s: a library URL must name a .gvmlib or .asm file", rawURL)
+}
+
+func fetchLibrary(client *http.Client, rawURL string) ([]byte, error) {
+	resp, err := client.Get(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", rawURL, resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxLibrarySize+1))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", rawURL, err)
+	}
+	if len(data) > maxLibrarySize {
+		return nil, fmt.Errorf("%s: larger than %d bytes", rawURL, maxLibrarySize)
+	}
+	return data, nil
+}
+
+// checkLibrary rejects downloads that can't be imported: sources that
+// don't parse or declare main
+func checkLibrary(data []byte) error {
+	program, err := asm.Parse(string(data))
+	if err != nil {
+		return err
+	}
+	for _, f := range program.Functions {
+		if f.Name == "main" {
+			return errors.New("declares main, it is a program rather than a library")
+		}
+	}
+	return nil
+}
+
+// checkLibraryName rejects the library names that aren't a file of the
+// directory they are looked up in, which would let a lockfile or an .import
+// reach files outside of it
+func checkLibraryName(name string) error {
+	if name == "" || name == "." || strings.ContainsAny(name, `/\`) || strings.Contains(name, "..") || filepath.VolumeName(name) != "" || filepath.Base(name) != name {
+		return fmt.Errorf("library name %q must be a file name without a path", name)
+	}
+	return nil
+}
+
+func writeLibrary(dir, file string, data []byte) error {
+	if err := checkLibraryName(file); err != nil {
+		return err
+	}
+	modules := filepath.Join(dir, modulesDir)
+	if err := os.MkdirAll(modules, 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(modules, file), data, 0o644)
+}
+
+func contentHash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// readLock reads the lockfile in dir, by library file. A missing lockfile
+// locks nothing.
+func readLock(dir string) (map[string]lockEntry, error) {
+	lock := make(map[string]lockEntry)
+	f, err := os.Open(filepath.Join(dir, lockFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return lock, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 3 || !strings.HasPrefix(fields[2], "sha256:") {
+			return nil, fmt.Errorf("%s:%d: expected a file, a URL and a sha256: hash", lockFile, n)
+		}
+		if err := checkLibraryName(fields[0]); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", lockFile, n, err)
+		}
+		lock[fields[0]] = lockEntry{File: fields[0], URL: fields[1], Hash: fields[2]}
+	}
+	return lock, scanner.Err()
+}
+
+// writeLock writes the lockfile sorted by file, so it diffs well under
+// version control
+func writeLock(dir string, lock map[string]lockEntry) error {
+	files := make([]string, 0, len(lock))
+	for file := range lock {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+	var b strings.Builder
+	b.WriteString("# written by gvm get: the libraries in gvm_modules, their URLs and hashes\n")
+	for _, file := range files {
+		entry := lock[file]
+		fmt.Fprintf(&b, "%s %s %s\n", entry.File, entry.URL, entry.Hash)
+	}
+	return os.WriteFile(filepath.Join(dir, lockFile), []byte(b.String()), 0o644)
+}
+
+// fileImporter resolves .import "name" for a source in dir: name.gvmlib or
+// name.asm next to it, then in its gvm_modules. A fetched library must
+// still have the hash gvm.lock records for it.
+func fileImporter(dir string) asm.Importer {
+	return func(name string) (string, error) {
+		if err := checkLibraryName(name); err != nil {
+			return "", err
+		}
+		for _, base := range []string{dir, filepath.Join(dir, modulesDir)} {
+			for _, ext := range libraryExtensions {
+				file := filepath.Join(base, name+ext)
+				data, err := os.ReadFile(file)
+				if errors.Is(err, fs.ErrNotExist) {
+					continue
+				} else if err != nil {
+					return "", err
+				}
+				if base != dir {
+					if err := checkLocked(dir, name+ext, data); err != nil {
+						return "", err
+					}
+				}
+				return string(data), nil
+			}
+		}
+		return "", fmt.Errorf("no %s.gvmlib or %s.asm in %s or its %s", name, name, dir, modulesDir)
+	}
+}
+
+// checkLocked compares a fetched library with its hash in the lockfile
+func checkLocked(dir, file string, data []byte) error {
+	lock, err := readLock(dir)
+	if err != nil {
+		return err
+	}
+	entry, ok := lock[file]
+	if !ok {
+		return nil
+	}
+	if hash := contentHash(data); hash != entry.Hash {
+		return fmt.Errorf("%s/%s was modified: its hash is %s, %s records %s; run gvm get to restore it", modulesDir, file, hash, lockFile, entry.Hash)
+	}
+	return nil
+}
+
+// importedSources returns the sources of the libraries a source in dir
+// imports, directly or through other libraries, for the build cache key.
+// Libraries that don't resolve are left to fail the assembly.
+func importedSources(dir string, source []byte) [][]byte {
+	importer := fileImporter(dir)
+	var sources [][]byte
+	seen := make(map[string]bool)
+	pending := asm.Imports(string(source))
+	for len(pending) > 0 {
+		name := pending[0]
+		pending = pending[1:]
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		library, err := importer(name)
+		if err != nil {
+			continue
+		}
+		sources = append(sources, []byte(library))
+		pending = append(pending, asm.Imports(library)...)
+	}
+	return sources
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckLibraryName(t *testing.T) {
+	for _, name := range []string{"strutil", "strutil.asm", "list.gvmlib", "a.b"} {
+		if err := checkLibraryName(name); err != nil {
+			t.Errorf("Expected %q to be a library name, got %v", name, err)
+		}
+	}
+	for _, name := range []string{"", ".", "..", "../secret", "lib/strutil", `lib\strutil`, "/etc/passwd", "a..b"} {
+		if err := checkLibraryName(name); err == nil {
+			t.Errorf("Expected %q to be refused", name)
+		}
+	}
+}
+
+func TestReadLockRefusesPaths(t *testing.T) {
+	dir := t.TempDir()
+	lock := "strutil.asm https://example.com/strutil.asm sha256:00\n../../escape.asm https://example.com/escape.asm sha256:00\n"
+	if err := os.WriteFile(filepath.Join(dir, lockFile), []byte(lock), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readLock(dir); err == nil || !strings.Contains(err.Error(), lockFile+":2:") {
+		t.Errorf("Expected line 2 of the lockfile to be refused, got %v", err)
+	}
+	if err := writeLibrary(dir, "../escape.asm", []byte("")); err == nil {
+		t.Error("Expected writing a library outside of gvm_modules to fail")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "escape.asm")); err == nil {
+		t.Error("Expected no file to be written outside of gvm_modules")
+	}
+}
+
+func TestLibraryFileRefusesPaths(t *testing.T) {
+	if file, err := libraryFile("https://example.com/libs/strutil.asm"); err != nil || file != "strutil.asm" {
+		t.Errorf("Expected strutil.asm, got %q, %v", file, err)
+	}
+	if file, err := libraryFile(`https://example.com/a\..\..\escape.asm`); err == nil {
+		t.Errorf("Expected a name with backslashes to be refused, got %q", file)
+	}
+}
+
+func TestImportRefusesPaths(t *testing.T) {
+	root := t.TempDir()
+	dir := filepath.Join(root, "project")
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "secret.asm"), []byte(".text\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	importer := fileImporter(dir)
+	if _, err := importer("../secret"); err == nil {
+		t.Error("Expected .import of a file outside of the directory to fail")
+	}
+	if err := os.WriteFile(filepath.Join(dir, "strutil.asm"), []byte(".text\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if source, err := importer("strutil"); err != nil || source != ".text\n" {
+		t.Errorf("Expected the library next to the source, got %q, %v", source, err)
+	}
+}
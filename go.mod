@@ -1,3 +1,3 @@
-module stack_vm
+module github.com/AndreiAlbert/gvm
 
 go 1.22.10
@@ -0,0 +1,41 @@
+package heap
+
+// Allocator provides the memory blocks of a Heap. A block must keep its
+// address until it is freed.
+type Allocator interface {
+	// Alloc returns a zeroed block of size bytes.
+	Alloc(size uintptr) ([]byte, error)
+	// Free releases a block returned by Alloc.
+	Free(mem []byte) error
+}
+
+// GoAllocator allocates blocks from the Go heap and works on every
+// platform. The Go collector does not move heap objects, so a block keeps
+// its address for as long as Heap.Memory references it.
+var GoAllocator Allocator = goAllocator{}
+
+// DefaultAllocator is the allocator of heaps created by NewHeap. It is
+// GoAllocator, or MmapAllocator when built with the gvm_mmap tag on unix.
+var DefaultAllocator = GoAllocator
+
+var allocators = map[string]Allocator{"go": GoAllocator}
+
+// Allocators returns the allocators available on this platform by name:
+// "go", and "mmap" on unix.
+func Allocators() map[string]Allocator {
+	all := make(map[string]Allocator, len(allocators))
+	for name, allocator := range allocators {
+		all[name] = allocator
+	}
+	return all
+}
+
+type goAllocator struct{}
+
+func (goAllocator) Alloc(size uintptr) ([]byte, error) {
+	return make([]byte, size), nil
+}
+
+func (goAllocator) Free(mem []byte) error {
+	return nil
+}
@@ -0,0 +1,46 @@
+//go:build unix
+
+package heap
+
+import (
+	"fmt"
+	"math"
+	"syscall"
+)
+
+// MmapAllocator maps anonymous pages for every block, keeping guest memory
+// outside of the Go heap.
+var MmapAllocator Allocator = mmapAllocator{}
+
+func init() {
+	allocators["mmap"] = MmapAllocator
+}
+
+type mmapAllocator struct{}
+
+// Alloc maps the pages for a block of size bytes, as one mapping however
+// many pages it spans. The returned slice is cut to size so bounds checks
+// match GoAllocator; munmap still releases the whole pages.
+func (mmapAllocator) Alloc(size uintptr) ([]byte, error) {
+	pageSize := syscall.Getpagesize()
+	if size > uintptr(math.MaxInt-pageSize) {
+		return nil, fmt.Errorf("mmap failed: a block of %d bytes is too large", size)
+	}
+	pagesRequired := (int(size) + pageSize - 1) / pageSize
+
+	mem, err := syscall.Mmap(
+		-1, 0,
+		pageSize*pagesRequired,
+		syscall.PROT_READ|syscall.PROT_WRITE,
+		syscall.MAP_ANON|syscall.MAP_PRIVATE,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("mmap failed: %w", err)
+	}
+	return mem[:size], nil
+}
+
+func (mmapAllocator) Free(mem []byte) error {
+	// munmap wants the slice as mapped
+	return syscall.Munmap(mem[:cap(mem)])
+}
@@ -0,0 +1,7 @@
+//go:build unix && gvm_mmap
+
+package heap
+
+func init() {
+	DefaultAllocator = MmapAllocator
+}
@@ -0,0 +1,186 @@
+package heap
+
+import (
+	"fmt"
+	"sort"
+	"unsafe"
+)
+
+// DefaultArenaSize is the arena size of NewArenaAllocator when given 0.
+const DefaultArenaSize = 1 << 20
+
+// largeBlockShare is the share of an arena from which blocks get memory of
+// their own, so that a large block doesn't waste most of an arena
+const largeBlockShare = 4
+
+// sparseOccupancy is the share of its memory in use below which an arena
+// other than the current one is evacuated by Compact
+const sparseOccupancy = 0.5
+
+// ArenaAllocator carves the blocks out of arenas, large chunks of memory it
+// takes from another allocator. An arena is bump allocated and not reused
+// until all of its blocks are freed, then it is given back. Freeing most of
+// the blocks of an arena leaves holes in it: Heap.Compact moves the live
+// blocks out of such arenas so that they can be released. Blocks of more than
+// a quarter of an arena get memory of their own from the backing allocator.
+//
+// An ArenaAllocator keeps track of the blocks of one heap and must not be
+// shared between heaps.
+type ArenaAllocator struct {
+	backing   Allocator
+	arenaSize uintptr
+	// arenas are sorted by address, current is the one blocks are
+	// allocated from
+	arenas  []*arena
+	current *arena
+	// released counts the arenas given back to the backing allocator
+	released uint64
+}
+
+// arena is a chunk of memory blocks are allocated from: used bytes from
+// its start are handed out, live of them in blocks that aren't freed
+type arena struct {
+	mem        []byte
+	start      uintptr
+	used, live uintptr
+	blocks     int
+	// evacuating is set on the sparse arenas Compact empties
+	evacuating bool
+}
+
+// ArenaStats describes the arenas of an ArenaAllocator.
+type ArenaStats struct {
+	// Arenas is the number of arenas held, Reserved their total size and
+	// Live the bytes of the blocks in them
+	Arenas   int     `json:"arenas"`
+	Reserved uintptr `json:"reserved_bytes"`
+	Live     uintptr `json:"live_bytes"`
+	// Released is the number of arenas given back so far
+	Released uint64 `json:"released"`
+}
+
+// NewArenaAllocator returns an allocator taking arenas of arenaSize bytes,
+// DefaultArenaSize if 0, from backing, such as GoAllocator, whose arenas
+// return to the Go heap once released, or MmapAllocator, which unmaps
+// them.
+func NewArenaAllocator(backing Allocator, arenaSize uintptr) *ArenaAllocator {
+	if arenaSize == 0 {
+		arenaSize = DefaultArenaSize
+	}
+	return &ArenaAllocator{backing: backing, arenaSize: arenaSize}
+}
+
+// Alloc returns a zeroed block of size bytes from the current arena,
+// taking a new one when it is full.
+func (a *ArenaAllocator) Alloc(size uintptr) ([]byte, error) {
+	if size > a.arenaSize/largeBlockShare {
+		return a.backing.Alloc(size)
+	}
+	if a.current == nil || a.current.used+size > uintptr(len(a.current.mem)) {
+		if err := a.grow(); err != nil {
+			return nil, err
+		}
+	}
+	arena := a.current
+	mem := arena.mem[arena.used : arena.used+size : arena.used+size]
+	arena.used += size
+	arena.live += size
+	arena.blocks++
+	return mem, nil
+}
+
+// grow makes a new arena the current one
+func (a *ArenaAllocator) grow() error {
+	mem, err := a.backing.Alloc(a.arenaSize)
+	if err != nil {
+		return fmt.Errorf("allocating an arena: %w", err)
+	}
+	arena := &arena{mem: mem, start: uintptr(unsafe.Pointer(&mem[0]))}
+	i := sort.Search(len(a.arenas), func(i int) bool { return a.arenas[i].start > arena.start })
+	a.arenas = append(a.arenas, nil)
+	copy(a.arenas[i+1:], a.arenas[i:])
+	a.arenas[i] = arena
+	a.current = arena
+	return nil
+}
+
+// Free releases a block returned by Alloc, and its arena once it holds no
+// other block.
+func (a *ArenaAllocator) Free(mem []byte) error {
+	arena := a.arenaOf(mem)
+	if arena == nil {
+		return a.backing.Free(mem)
+	}
+	arena.live -= uintptr(len(mem))
+	if arena.blocks--; arena.blocks > 0 {
+		return nil
+	}
+	if arena == a.current {
+		// keep on allocating from it rather than taking another one
+		clear(arena.mem[:arena.used])
+		arena.used = 0
+		return nil
+	}
+	return a.release(arena)
+}
+
+// arenaOf returns the arena holding mem, nil for the blocks that have
+// memory of their own
+func (a *ArenaAllocator) arenaOf(mem []byte) *arena {
+	addr := uintptr(unsafe.Pointer(&mem[0]))
+	i := sort.Search(len(a.arenas), func(i int) bool { return a.arenas[i].start > addr }) - 1
+	if i < 0 || addr >= a.arenas[i].start+uintptr(len(a.arenas[i].mem)) {
+		return nil
+	}
+	return a.arenas[i]
+}
+
+// release gives an empty arena back to the backing allocator
+func (a *ArenaAllocator) release(arena *arena) error {
+	i := sort.Search(len(a.arenas), func(i int) bool { return a.arenas[i].start >= arena.start })
+	a.arenas = append(a.arenas[:i], a.arenas[i+1:]...)
+	if arena == a.current {
+		a.current = nil
+	}
+	a.released++
+	if err := a.backing.Free(arena.mem); err != nil {
+		return fmt.Errorf("releasing an arena: %w", err)
+	}
+	return nil
+}
+
+// selectSparse marks the arenas whose occupancy is below sparseOccupancy
+// for evacuation and reports whether there are any. The current arena is
+// never evacuated, the blocks moved out of the others go there.
+func (a *ArenaAllocator) selectSparse() bool {
+	found := false
+	for _, arena := range a.arenas {
+		arena.evacuating = arena != a.current && float64(arena.live) < sparseOccupancy*float64(len(arena.mem))
+		found = found || arena.evacuating
+	}
+	return found
+}
+
+// evacuating reports whether mem is in an arena selected by selectSparse
+func (a *ArenaAllocator) evacuating(mem []byte) bool {
+	arena := a.arenaOf(mem)
+	return arena != nil && arena.evacuating
+}
+
+// releaseEmpty gives back the current arena if no block is left in it
+func (a *ArenaAllocator) releaseEmpty() error {
+	if a.current != nil && a.current.blocks == 0 {
+		return a.release(a.current)
+	}
+	return nil
+}
+
+// Stats returns the number and occupancy of the arenas.
+func (a *ArenaAllocator) Stats() ArenaStats {
+	stats := ArenaStats{Arenas: len(a.arenas), Released: a.released}
+	for _, arena := range a.arenas {
+		stats.Reserved += uintptr(len(arena.mem))
+		stats.Live += arena.live
+	}
+	return stats
+}
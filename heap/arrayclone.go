@@ -0,0 +1,155 @@
+package heap
+
+import (
+	"fmt"
+	"slices"
+
+	. "github.com/AndreiAlbert/gvm/common"
+)
+
+// arrayCloneTag is the type tag of array clones that still share the
+// elements of their array. It is not a ValueKind, ObjectKind reports clones
+// as arrays.
+const arrayCloneTag = 0x40 | byte(ValueArray)
+
+// cloneSize is the size of a clone block: the tag and the array it shares
+const cloneSize = 1 + ptrSize
+
+// CloneArray returns a copy of the array at ptr that shares its elements
+// until one of them is written to: the first write to either copies the
+// elements, so the other never sees it. A clone of a clone shares the
+// same array, a clone of a view or a mapped array is copied right away.
+func (heap *Heap) CloneArray(ptr uintptr) (uintptr, error) {
+	mem, exists := heap.Memory[ptr]
+	if !exists {
+		return 0, heap.invalidAddress(ptr)
+	}
+	switch mem[0] {
+	case arrayViewTag, mappedArrayTag:
+		return heap.copyArray(ptr)
+	case arrayCloneTag:
+		ptr = heap.cloneBase(ptr)
+	}
+	if _, err := heap.plainArrayLength(ptr); err != nil {
+		return 0, err
+	}
+	clonePtr, err := heap.Allocate(cloneSize)
+	if err != nil {
+		return 0, err
+	}
+	clone := heap.Memory[clonePtr]
+	clone[0] = arrayCloneTag
+	putPtr(clone[1:], ptr)
+	if heap.clones == nil {
+		heap.clones = make(map[uintptr][]uintptr)
+	}
+	heap.clones[ptr] = append(heap.clones[ptr], clonePtr)
+	return clonePtr, nil
+}
+
+// IsArrayClone reports whether ptr is the address of an array clone that
+// still shares the elements of its array.
+func (heap *Heap) IsArrayClone(ptr uintptr) bool {
+	mem, exists := heap.Memory[ptr]
+	return exists && mem[0] == arrayCloneTag
+}
+
+// cloneBase returns the array the clone at ptr shares
+func (heap *Heap) cloneBase(ptr uintptr) uintptr {
+	return getPtr(heap.Memory[ptr][1:])
+}
+
+// copyArray allocates a plain array holding the elements of the array,
+// view or clone at ptr
+func (heap *Heap) copyArray(ptr uintptr) (uintptr, error) {
+	base, offset, length, err := heap.arrayRange(ptr)
+	if err != nil {
+		return 0, err
+	}
+	elementKind := ValueKind(heap.Memory[base][1])
+	copyPtr, err := heap.AllocateArray(elementKind, length)
+	if err != nil {
+		return 0, err
+	}
+	size := GetElementSize(elementKind)
+	from := uintptr(offset) * size
+	copy(heap.elementBytes(copyPtr), heap.elementBytes(base)[from:from+uintptr(length)*size])
+	return copyPtr, nil
+}
+
+// detach gives the clone at ptr its own copy of the elements it shares.
+// The clone keeps its address, its block is replaced by the copy.
+func (heap *Heap) detach(ptr uintptr) error {
+	base := heap.cloneBase(ptr)
+	data := heap.Memory[base]
+	old := heap.Memory[ptr]
+	size := uintptr(len(data))
+	if heap.Limit > 0 && heap.allocated-uintptr(len(old))+size > heap.Limit {
+		return fmt.Errorf("%w: copying a shared array of %d bytes with %d of %d in use", ErrLimitExceeded, size, heap.allocated, heap.Limit)
+	}
+	mem, err := heap.allocator.Alloc(size)
+	if err != nil {
+		return err
+	}
+	copy(mem, data)
+	unlock := heap.lockMark()
+	defer unlock()
+	// the clone no longer points to the array, it holds its pointers
+	heap.dropped(base)
+	heap.Memory[ptr] = mem[:size]
+	heap.allocated += size - uintptr(len(old))
+	heap.totalAllocated += uint64(size)
+	heap.allocations++
+	heap.countFree(uintptr(len(old)))
+	heap.countAllocation(size)
+	if heap.allocated > heap.peak {
+		heap.peak = heap.allocated
+	}
+	heap.removeClone(base, ptr)
+	// the clone now holds the pointers of the array
+	heap.barrier(ptr)
+	if err := heap.allocator.Free(old); err != nil {
+		return fmt.Errorf("freeing memory failed: %w", err)
+	}
+	return nil
+}
+
+// detachClones detaches the clones sharing the array at ptr, before it is
+// written to or freed
+func (heap *Heap) detachClones(ptr uintptr) error {
+	for _, clone := range slices.Clone(heap.clones[ptr]) {
+		if err := heap.detach(clone); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (heap *Heap) removeClone(base, clone uintptr) {
+	clones := slices.DeleteFunc(heap.clones[base], func(c uintptr) bool { return c == clone })
+	if len(clones) == 0 {
+		delete(heap.clones, base)
+	} else {
+		heap.clones[base] = clones
+	}
+}
+
+// prepareWrite makes the array, view or clone at ptr safe to write to: a
+// clone gets its own elements and the clones sharing the array written to
+// get theirs
+func (heap *Heap) prepareWrite(ptr uintptr) error {
+	mem, exists := heap.Memory[ptr]
+	if !exists {
+		return heap.invalidAddress(ptr)
+	}
+	switch mem[0] {
+	case arrayCloneTag:
+		return heap.detach(ptr)
+	case arrayViewTag:
+		ptr = heap.loadView(ptr).base
+	}
+	if heap.mappings[ptr].readOnly {
+		return fmt.Errorf("%w: the array at %d is mapped read-only", ErrReadOnly, ptr)
+	}
+	return heap.detachClones(ptr)
+}
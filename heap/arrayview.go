@@ -0,0 +1,77 @@
+package heap
+
+import (
+	"fmt"
+
+	. "github.com/AndreiAlbert/gvm/common"
+)
+
+// arrayViewTag is the type tag of array views. It is not a ValueKind,
+// ObjectKind reports views as arrays.
+const arrayViewTag = 0x80 | byte(ValueArray)
+
+// AllocateArrayView creates an array that shares length elements at offset
+// of the array at ptr instead of copying them. Reads and writes through the
+// view are checked against its own bounds and reach the elements of the
+// array. A view of a view points into the underlying array. Freeing that
+// array invalidates its views.
+//
+// Views use the block layout of string views: the tag, base, offset and
+// length. Unlike strings, arrays are written in place, so the views don't
+// count as references to the array. A clone gets its own elements before a
+// view is taken of it.
+func (heap *Heap) AllocateArrayView(ptr uintptr, offset, length int32) (uintptr, error) {
+	if heap.IsArrayClone(ptr) {
+		if err := heap.detach(ptr); err != nil {
+			return 0, err
+		}
+	}
+	base, baseOffset, baseLength, err := heap.arrayRange(ptr)
+	if err != nil {
+		return 0, err
+	}
+	if offset < 0 || length < 0 || int64(offset)+int64(length) > int64(baseLength) {
+		return 0, fmt.Errorf("%w: view of %d elements at %d into an array of %d", ErrOutOfBounds, length, offset, baseLength)
+	}
+	viewPtr, err := heap.Allocate(viewSize)
+	if err != nil {
+		return 0, err
+	}
+	mem := heap.Memory[viewPtr]
+	mem[0] = arrayViewTag
+	storeView(mem, stringView{base: base, offset: baseOffset + offset, length: length})
+	return viewPtr, nil
+}
+
+// IsArrayView reports whether ptr is the address of an array view.
+func (heap *Heap) IsArrayView(ptr uintptr) bool {
+	mem, exists := heap.Memory[ptr]
+	return exists && mem[0] == arrayViewTag
+}
+
+// arrayRange resolves the array, view or clone at ptr to the plain array holding
+// its elements, the index of its first element in it and its length
+func (heap *Heap) arrayRange(ptr uintptr) (base uintptr, offset, length int32, err error) {
+	mem, exists := heap.Memory[ptr]
+	if !exists {
+		return 0, 0, 0, heap.invalidAddress(ptr)
+	}
+	if mem[0] == arrayCloneTag {
+		ptr = heap.cloneBase(ptr)
+	}
+	if mem[0] != arrayViewTag {
+		length, err := heap.plainArrayLength(ptr)
+		return ptr, 0, length, err
+	}
+	// views always point into plain arrays, the base of a view whose array
+	// was freed may have been reused by anything
+	view := heap.loadView(ptr)
+	baseLength, err := heap.plainArrayLength(view.base)
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("array view: %w", err)
+	}
+	if int64(view.offset)+int64(view.length) > int64(baseLength) {
+		return 0, 0, 0, fmt.Errorf("%w: view of %d elements at %d into an array of %d", ErrOutOfBounds, view.length, view.offset, baseLength)
+	}
+	return view.base, view.offset, view.length, nil
+}
@@ -0,0 +1,64 @@
+package heap
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	. "github.com/AndreiAlbert/gvm/common"
+)
+
+// BufferGet reads a value of kind, ValueInt32 or ValueFloat32, from the
+// four bytes at offset of the byte array, view or clone at ptr, in order.
+// Offsets count bytes and need not be aligned.
+func (heap *Heap) BufferGet(ptr uintptr, offset int32, kind ValueKind, order binary.ByteOrder) (Value, error) {
+	if kind != ValueInt32 && kind != ValueFloat32 {
+		return Value{}, fmt.Errorf("%w: buffers hold int32 or float32 values, not %v", ErrTypeMismatch, kind)
+	}
+	bytes, err := heap.bufferBytes(ptr, offset, 4)
+	if err != nil {
+		return Value{}, err
+	}
+	return NewValue(kind, uint64(order.Uint32(bytes))), nil
+}
+
+// BufferPut writes the int32 or float32 value to the four bytes at offset
+// of the byte array, view or clone at ptr, in order.
+func (heap *Heap) BufferPut(ptr uintptr, offset int32, value Value, order binary.ByteOrder) error {
+	if kind := value.Kind(); kind != ValueInt32 && kind != ValueFloat32 {
+		return fmt.Errorf("%w: buffers hold int32 or float32 values, not %v", ErrTypeMismatch, kind)
+	}
+	if _, err := heap.bufferBytes(ptr, offset, 4); err != nil {
+		return err
+	}
+	if err := heap.prepareWrite(ptr); err != nil {
+		return err
+	}
+	// the bytes of a clone moved to its own block
+	bytes, err := heap.bufferBytes(ptr, offset, 4)
+	if err != nil {
+		return err
+	}
+	order.PutUint32(bytes, value.Raw())
+	return nil
+}
+
+// bufferBytes returns the size bytes at offset of the byte array at ptr
+func (heap *Heap) bufferBytes(ptr uintptr, offset, size int32) ([]byte, error) {
+	base, start, length, err := heap.arrayRange(ptr)
+	if err != nil {
+		return nil, err
+	}
+	mem := heap.Memory[base]
+	if kind := ValueKind(mem[1]); kind != ValueByte {
+		return nil, fmt.Errorf("%w: expected a byte array, got an array of %v", ErrTypeMismatch, kind)
+	}
+	if offset < 0 || int64(offset)+int64(size) > int64(length) {
+		return nil, fmt.Errorf("%w: %d bytes at %d of a buffer of %d", ErrOutOfBounds, size, offset, length)
+	}
+	elements := heap.elementBytes(base)
+	from := int64(start) + int64(offset)
+	if from+int64(size) > int64(len(elements)) {
+		return nil, fmt.Errorf("%w: %d bytes at %d of %d bytes of elements", ErrOutOfBounds, size, from, len(elements))
+	}
+	return elements[from : from+int64(size)], nil
+}
@@ -0,0 +1,68 @@
+package heap
+
+import (
+	"fmt"
+
+	. "github.com/AndreiAlbert/gvm/common"
+)
+
+// closureTag is the type tag of closure blocks. It is not a ValueKind,
+// closures are pointers to the block.
+const closureTag = 0x80 | byte(ValuePtr)
+
+// closureHeaderSize is the size of the tag, the function index and the
+// capture count in front of the captured values
+const closureHeaderSize = 1 + 4 + 4
+
+// capturedSize is the size of a captured value: its kind and payload
+const capturedSize = 1 + 8
+
+// AllocateClosure creates a closure of the function at index function of
+// the function table, with an environment holding captured.
+func (heap *Heap) AllocateClosure(function uint32, captured []Value) (uintptr, error) {
+	ptr, err := heap.Allocate(uintptr(closureHeaderSize + capturedSize*len(captured)))
+	if err != nil {
+		return 0, err
+	}
+	mem := heap.Memory[ptr]
+	mem[0] = closureTag
+	byteOrder.PutUint32(mem[1:], function)
+	byteOrder.PutUint32(mem[5:], uint32(len(captured)))
+	for i, value := range captured {
+		slot := mem[closureHeaderSize+capturedSize*i:]
+		slot[0] = byte(value.Kind())
+		byteOrder.PutUint64(slot[1:], uint64(value.Ptr()))
+	}
+	return ptr, nil
+}
+
+// LoadClosure returns the function index and the captured values of the
+// closure at ptr.
+func (heap *Heap) LoadClosure(ptr uintptr) (uint32, []Value, error) {
+	mem, exists := heap.Memory[ptr]
+	if !exists {
+		return 0, nil, heap.invalidAddress(ptr)
+	}
+	if mem[0] != closureTag {
+		return 0, nil, fmt.Errorf("%w: expected a closure, got %v", ErrTypeMismatch, ValueKind(mem[0]))
+	}
+	if len(mem) < closureHeaderSize {
+		return 0, nil, fmt.Errorf("%w: closure header in a block of %d bytes", ErrOutOfBounds, len(mem))
+	}
+	count := byteOrder.Uint32(mem[5:])
+	if uint64(count) > uint64(len(mem)-closureHeaderSize)/capturedSize {
+		return 0, nil, fmt.Errorf("%w: %d captured values in a block of %d bytes", ErrOutOfBounds, count, len(mem))
+	}
+	captured := make([]Value, count)
+	for i := range captured {
+		slot := mem[closureHeaderSize+capturedSize*i:]
+		captured[i] = NewValue(ValueKind(slot[0]), byteOrder.Uint64(slot[1:]))
+	}
+	return byteOrder.Uint32(mem[1:]), captured, nil
+}
+
+// IsClosure reports whether ptr is the address of a closure.
+func (heap *Heap) IsClosure(ptr uintptr) bool {
+	mem, exists := heap.Memory[ptr]
+	return exists && mem[0] == closureTag
+}
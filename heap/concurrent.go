@@ -0,0 +1,135 @@
+package heap
+
+import (
+	"sync"
+	"sync/atomic"
+
+	. "github.com/AndreiAlbert/gvm/common"
+)
+
+// markBatch is the number of blocks the concurrent marker scans each time
+// it holds the lock, so that the program seldom waits for it
+const markBatch = 256
+
+// markAssist is the number of grey blocks an allocation scans while a mark
+// is in progress: a program allocating faster than the marker, or on a
+// host without a spare processor for it, finishes the mark itself
+const markAssist = 8
+
+// concurrentMark is a full mark running on a goroutine of its own, see
+// StartMark
+type concurrentMark struct {
+	// mu guards the marker, and the memory and blocks it reads against the
+	// writes of the program
+	mu     sync.Mutex
+	marker *marker
+	stop   atomic.Bool
+	done   chan struct{}
+}
+
+// StartMark starts a full collection whose marking runs on a goroutine of
+// its own, while the program goes on: the program only stops for StartMark
+// to shade the roots and the pinned blocks, and for FinishMark to sweep.
+// The mark finds the blocks reachable when it started. Pointers the
+// program overwrites or frees while it runs are shaded first, and the
+// blocks it allocates are marked at once. This keeps working as long as
+// every write goes through the methods of the heap, where it waits for a
+// batch of the marker to end. Allocations help the marker, see markAssist.
+// Collect, CollectYoung and Release abandon a
+// mark in progress, StartMark does nothing while one is.
+func (heap *Heap) StartMark(roots []Value) {
+	if heap.marking != nil {
+		return
+	}
+	m := &concurrentMark{marker: heap.newMarker(roots, false), done: make(chan struct{})}
+	heap.marking = m
+	go m.run()
+}
+
+func (m *concurrentMark) run() {
+	defer close(m.done)
+	for !m.stop.Load() {
+		m.mu.Lock()
+		empty := m.marker.drain(markBatch)
+		m.mu.Unlock()
+		if empty {
+			return
+		}
+	}
+}
+
+// Marking reports whether a mark started by StartMark is in progress.
+func (heap *Heap) Marking() bool {
+	return heap.marking != nil
+}
+
+// MarkDone reports whether the mark of StartMark has scanned every block
+// it found, so that FinishMark has little left to do.
+func (heap *Heap) MarkDone() bool {
+	m := heap.marking
+	if m == nil {
+		return false
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.marker.grey) == 0
+}
+
+// FinishMark stops the marker of StartMark, scans the blocks it didn't get
+// to, then frees the blocks that the mark didn't reach and compacts the
+// heap, as Collect does.
+func (heap *Heap) FinishMark() error {
+	m := heap.marking
+	if m == nil {
+		return nil
+	}
+	m.stop.Store(true)
+	<-m.done
+	heap.marking = nil
+	m.marker.drain(0)
+	heap.gcStats.Collections++
+	if err := heap.sweep(m.marker.marked, false); err != nil {
+		return err
+	}
+	heap.promote(m.marker.marked)
+	return heap.Compact()
+}
+
+// abandonMark stops a mark in progress without collecting anything
+func (heap *Heap) abandonMark() {
+	if m := heap.marking; m != nil {
+		m.stop.Store(true)
+		<-m.done
+		heap.marking = nil
+	}
+}
+
+// lockMark takes the lock of a mark in progress before a write to memory
+// the marker reads, and returns what releases it
+func (heap *Heap) lockMark() (unlock func()) {
+	m := heap.marking
+	if m == nil {
+		return func() {}
+	}
+	m.mu.Lock()
+	return m.mu.Unlock
+}
+
+// dropped shades the block at ptr, whose pointer a write under lockMark
+// overwrites or frees, so that the mark still finds what the heap held when
+// it started
+func (heap *Heap) dropped(ptr uintptr) {
+	if m := heap.marking; m != nil {
+		m.marker.shade(ptr)
+	}
+}
+
+// allocatedBlack marks a block allocated under lockMark, the marker never
+// scans it: whatever it points to is reachable some other way or new. The
+// allocation then scans markAssist grey blocks.
+func (heap *Heap) allocatedBlack(ptr uintptr) {
+	if m := heap.marking; m != nil {
+		m.marker.marked[ptr] = true
+		m.marker.drain(markAssist)
+	}
+}
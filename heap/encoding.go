@@ -0,0 +1,35 @@
+package heap
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+// byteOrder is the order of the numbers stored in heap blocks. It is the
+// order of the bytecode, so a block holds the same bytes on every host.
+var byteOrder = binary.BigEndian
+
+// ptrSize is the number of bytes a pointer takes in a block. It is fixed
+// rather than the size of a host pointer, so arrays and structs have the
+// same layout on 32- and 64-bit hosts.
+const ptrSize = 8
+
+func getInt32(b []byte) int32 {
+	return int32(byteOrder.Uint32(b))
+}
+
+func putInt32(b []byte, v int32) {
+	byteOrder.PutUint32(b, uint32(v))
+}
+
+func getFloat32(b []byte) float32 {
+	return math.Float32frombits(byteOrder.Uint32(b))
+}
+
+func getPtr(b []byte) uintptr {
+	return uintptr(byteOrder.Uint64(b))
+}
+
+func putPtr(b []byte, ptr uintptr) {
+	byteOrder.PutUint64(b, uint64(ptr))
+}
@@ -0,0 +1,126 @@
+package heap
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	. "github.com/AndreiAlbert/gvm/common"
+)
+
+// maxFormatDepth is how many pointers Format follows from the value it
+// prints, deeper objects print as ...
+const maxFormatDepth = 8
+
+// Format renders value for people, following pointers into the heap:
+// structs print as Point{x: 1, y: 2}, arrays as [1, 2, 3], strings quoted,
+// closures as closure(function, [captured]) and blocks from Allocate as
+// &value. The null pointer prints as nil, an address that isn't the start
+// of a block as ptr(address), and an object that contains itself as ...
+// where it repeats. Floats are printed with format.
+func (heap *Heap) Format(value Value, format FloatFormat) string {
+	f := formatter{heap: heap, format: format, open: make(map[uintptr]bool)}
+	f.value(value, 0)
+	return f.b.String()
+}
+
+// formatter is the state of a Format call. open holds the objects being
+// printed, which are cycles when met again.
+type formatter struct {
+	heap   *Heap
+	format FloatFormat
+	open   map[uintptr]bool
+	b      strings.Builder
+}
+
+func (f *formatter) value(value Value, depth int) {
+	switch value.Kind() {
+	case ValuePtr, ValueString, ValueStruct, ValueArray:
+		f.object(value.Ptr(), depth)
+	default:
+		f.b.WriteString(value.Format(f.format))
+	}
+}
+
+func (f *formatter) object(ptr uintptr, depth int) {
+	mem, exists := f.heap.Memory[ptr]
+	switch {
+	case ptr == 0:
+		f.b.WriteString("nil")
+		return
+	case !exists || len(mem) == 0:
+		fmt.Fprintf(&f.b, "ptr(%d)", ptr)
+		return
+	case f.open[ptr] || depth >= maxFormatDepth:
+		f.b.WriteString("...")
+		return
+	}
+	f.open[ptr] = true
+	defer delete(f.open, ptr)
+	kind, _ := f.heap.ObjectKind(ptr)
+	switch {
+	case kind == ValueString:
+		s, err := f.heap.LoadString(ptr)
+		if err != nil {
+			fmt.Fprintf(&f.b, "ptr(%d)", ptr)
+			return
+		}
+		f.b.WriteString(strconv.Quote(s))
+	case kind == ValueArray:
+		f.b.WriteByte('[')
+		for i := int32(0); ; i++ {
+			element, err := f.heap.GetArrayElement(ptr, i)
+			if err != nil {
+				break
+			}
+			if i > 0 {
+				f.b.WriteString(", ")
+			}
+			f.value(*element, depth+1)
+		}
+		f.b.WriteByte(']')
+	case kind == ValueStruct:
+		structType, err := f.heap.loadStructType(ptr)
+		if err != nil {
+			fmt.Fprintf(&f.b, "ptr(%d)", ptr)
+			return
+		}
+		f.b.WriteString(structType.Name)
+		f.b.WriteByte('{')
+		for i, field := range structType.Fields {
+			if i > 0 {
+				f.b.WriteString(", ")
+			}
+			f.b.WriteString(field.Name)
+			f.b.WriteString(": ")
+			if value, err := f.heap.getField(ptr, field); err == nil {
+				f.value(*value, depth+1)
+			} else {
+				f.b.WriteByte('?')
+			}
+		}
+		f.b.WriteByte('}')
+	case f.heap.IsClosure(ptr):
+		function, captured, err := f.heap.LoadClosure(ptr)
+		if err != nil {
+			fmt.Fprintf(&f.b, "ptr(%d)", ptr)
+			return
+		}
+		fmt.Fprintf(&f.b, "closure(%d, [", function)
+		for i, value := range captured {
+			if i > 0 {
+				f.b.WriteString(", ")
+			}
+			f.value(value, depth+1)
+		}
+		f.b.WriteString("])")
+	default:
+		value, err := f.heap.LoadValue(ptr)
+		if err != nil {
+			fmt.Fprintf(&f.b, "ptr(%d)", ptr)
+			return
+		}
+		f.b.WriteByte('&')
+		f.value(*value, depth+1)
+	}
+}
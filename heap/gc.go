@@ -0,0 +1,294 @@
+package heap
+
+import (
+	"fmt"
+
+	. "github.com/AndreiAlbert/gvm/common"
+)
+
+// GCStats counts the work of Collect, CollectYoung and Compact.
+type GCStats struct {
+	// Collections counts the full collections, MinorCollections those of
+	// the young generation
+	Collections      uint64 `json:"collections"`
+	MinorCollections uint64 `json:"minor_collections"`
+	// Collected is the number of unreachable blocks freed, CollectedBytes
+	// their size
+	Collected      uint64 `json:"collected"`
+	CollectedBytes uint64 `json:"collected_bytes"`
+	// Moved is the number of blocks compaction moved, MovedBytes their size
+	Moved      uint64 `json:"moved"`
+	MovedBytes uint64 `json:"moved_bytes"`
+	// PromotedBytes is the size of the young blocks that survived a
+	// collection and became old
+	PromotedBytes uint64 `json:"promoted_bytes"`
+}
+
+// GCStats returns the work of the collections so far.
+func (heap *Heap) GCStats() GCStats {
+	return heap.gcStats
+}
+
+// isPointerKind reports whether values of kind hold a heap address
+func isPointerKind(kind ValueKind) bool {
+	switch kind {
+	case ValuePtr, ValueString, ValueArray, ValueStruct:
+		return true
+	default:
+		return false
+	}
+}
+
+// Collect frees the blocks that can't be reached from roots, the values
+// the program holds, nor from the pinned blocks, then compacts the heap.
+// Values of roots that aren't pointers to live blocks are ignored. Memory
+// the host holds on to must be pinned: a collection frees what it can't
+// see. The blocks left are old, see CollectYoung.
+func (heap *Heap) Collect(roots []Value) error {
+	heap.abandonMark()
+	marked := heap.mark(roots, false)
+	heap.gcStats.Collections++
+	if err := heap.sweep(marked, false); err != nil {
+		return err
+	}
+	heap.promote(marked)
+	return heap.Compact()
+}
+
+// CollectYoung is a minor collection: it only frees the young blocks, those
+// allocated since the previous collection, that can't be reached from
+// roots, the pinned blocks and the old blocks. Old blocks aren't traced, a
+// write barrier of the heap remembers those a pointer was written to
+// since, which are. So a minor collection costs what survives of the young
+// blocks rather than the whole heap. Pointers written into blocks other
+// than through the methods of the heap are not seen. The surviving blocks
+// become old. Old blocks are only freed by Collect.
+func (heap *Heap) CollectYoung(roots []Value) error {
+	heap.abandonMark()
+	marked := heap.mark(roots, true)
+	heap.gcStats.MinorCollections++
+	if err := heap.sweep(marked, true); err != nil {
+		return err
+	}
+	heap.promote(marked)
+	return nil
+}
+
+// mark returns the blocks reachable from roots and the pinned blocks. A
+// young collection treats old blocks as reachable without tracing them,
+// and traces the remembered ones.
+func (heap *Heap) mark(roots []Value, young bool) map[uintptr]bool {
+	m := heap.newMarker(roots, young)
+	if young {
+		for ptr := range heap.remembered {
+			if _, live := heap.Memory[ptr]; live {
+				heap.pointers(ptr, m.shade)
+			}
+		}
+	}
+	m.drain(0)
+	return m.marked
+}
+
+// marker is the state of a mark: the blocks found reachable, the grey of
+// them those whose pointers are still to be scanned
+type marker struct {
+	heap   *Heap
+	marked map[uintptr]bool
+	grey   []uintptr
+	// young leaves the old blocks out
+	young bool
+}
+
+// newMarker returns a marker with the roots and the pinned blocks shaded
+func (heap *Heap) newMarker(roots []Value, young bool) *marker {
+	m := &marker{heap: heap, marked: make(map[uintptr]bool, len(heap.Memory)-len(heap.old)), young: young}
+	for _, root := range roots {
+		if isPointerKind(root.Kind()) {
+			m.shade(root.Ptr())
+		}
+	}
+	for ptr := range heap.pins {
+		m.shade(ptr)
+	}
+	return m
+}
+
+// shade marks the live block at ptr grey, unless it is marked already
+func (m *marker) shade(ptr uintptr) {
+	if _, live := m.heap.Memory[ptr]; live && !m.marked[ptr] && !(m.young && m.heap.old[ptr]) {
+		m.marked[ptr] = true
+		m.grey = append(m.grey, ptr)
+	}
+}
+
+// drain scans the pointers of n grey blocks, or all of them for 0, and
+// reports whether none is left
+func (m *marker) drain(n int) bool {
+	for i := 0; len(m.grey) > 0 && (n == 0 || i < n); i++ {
+		ptr := m.grey[len(m.grey)-1]
+		m.grey = m.grey[:len(m.grey)-1]
+		// the program may have freed it since it was shaded
+		if _, live := m.heap.Memory[ptr]; live {
+			m.heap.pointers(ptr, m.shade)
+		}
+	}
+	return len(m.grey) == 0
+}
+
+// promote makes the marked blocks old and forgets the remembered ones,
+// none of which points to a young block anymore
+func (heap *Heap) promote(marked map[uintptr]bool) {
+	if heap.old == nil {
+		heap.old = make(map[uintptr]bool, len(marked))
+	}
+	for ptr := range marked {
+		if !heap.old[ptr] {
+			heap.old[ptr] = true
+			heap.gcStats.PromotedBytes += uint64(len(heap.Memory[ptr]))
+		}
+	}
+	clear(heap.remembered)
+}
+
+// barrier is the write barrier: it runs on every pointer written into the
+// block at ptr, remembering old blocks for the next young collection
+func (heap *Heap) barrier(ptr uintptr) {
+	if !heap.old[ptr] {
+		return
+	}
+	if heap.remembered == nil {
+		heap.remembered = make(map[uintptr]bool)
+	}
+	heap.remembered[ptr] = true
+}
+
+// pointers calls visit with the address held by every pointer slot of the
+// block at ptr
+func (heap *Heap) pointers(ptr uintptr, visit func(uintptr)) {
+	mem := heap.Memory[ptr]
+	switch mem[0] {
+	case stringViewTag, arrayViewTag, arrayCloneTag:
+		if len(mem) >= 1+ptrSize {
+			visit(getPtr(mem[1:]))
+		}
+	case ropeTag:
+		if len(mem) >= ropeSize {
+			node := heap.loadRope(ptr)
+			visit(node.left)
+			visit(node.right)
+			visit(node.flat)
+		}
+	case byte(ValueArray):
+		if len(mem) < arrayHeaderSize || !isPointerKind(ValueKind(mem[1])) {
+			return
+		}
+		elements := mem[arrayHeaderSize:]
+		length := min(uintptr(max(getInt32(mem[2:]), 0)), uintptr(len(elements))/ptrSize)
+		for i := uintptr(0); i < length; i++ {
+			visit(getPtr(elements[i*ptrSize:]))
+		}
+	case byte(ValueStruct):
+		structType, err := heap.loadStructType(ptr)
+		if err != nil {
+			return
+		}
+		for _, field := range structType.Fields {
+			if isPointerKind(field.Type) {
+				if data, err := heap.fieldBytes(ptr, field); err == nil {
+					visit(getPtr(data))
+				}
+			}
+		}
+	case closureTag:
+		if len(mem) < closureHeaderSize {
+			return
+		}
+		count := min(uint64(byteOrder.Uint32(mem[5:])), uint64(len(mem)-closureHeaderSize)/capturedSize)
+		for i := uint64(0); i < count; i++ {
+			slot := mem[closureHeaderSize+capturedSize*i:]
+			if isPointerKind(ValueKind(slot[0])) {
+				visit(uintptr(byteOrder.Uint64(slot[1:])))
+			}
+		}
+	case byte(ValuePtr):
+		// a pointer stored into a block of ALLOC
+		if len(mem) >= 1+ptrSize {
+			visit(getPtr(mem[1:]))
+		}
+	}
+}
+
+// sweep frees the blocks that aren't marked, the young ones only for a
+// young collection. Views, ropes and clones go first, so that freeing what
+// they reference doesn't copy anything for them.
+func (heap *Heap) sweep(marked map[uintptr]bool, young bool) error {
+	kept := func(ptr uintptr) bool {
+		return marked[ptr] || young && heap.old[ptr]
+	}
+	var derived, plain []uintptr
+	for ptr, mem := range heap.Memory {
+		if kept(ptr) {
+			continue
+		}
+		switch mem[0] {
+		case stringViewTag, arrayCloneTag:
+			derived = append(derived, ptr)
+		case ropeTag:
+			// the flat contents of a rope are freed with it, unless a view
+			// still reaches them
+			if flat := heap.loadRope(ptr).flat; kept(flat) {
+				putPtr(mem[ropeFlat:], 0)
+			}
+			derived = append(derived, ptr)
+		default:
+			plain = append(plain, ptr)
+		}
+	}
+	for _, ptr := range append(derived, plain...) {
+		if _, live := heap.Memory[ptr]; !live {
+			// the flat contents of a rope freed with it
+			continue
+		}
+		// freeing a rope frees its flat contents too
+		blocks, size := len(heap.Memory), heap.allocated
+		if err := heap.Free(ptr); err != nil {
+			return fmt.Errorf("collecting: %w", err)
+		}
+		heap.gcStats.Collected += uint64(blocks - len(heap.Memory))
+		heap.gcStats.CollectedBytes += uint64(size - heap.allocated)
+	}
+	return nil
+}
+
+// Compact moves the live blocks out of the sparse arenas of an
+// ArenaAllocator, which releases them once empty. The blocks keep their
+// addresses: pointers are the keys of Memory, only the memory behind them
+// moves, so nothing referencing them changes. Pinned blocks stay where they
+// are. Heaps with other allocators have nothing to compact.
+func (heap *Heap) Compact() error {
+	arenas, ok := heap.allocator.(*ArenaAllocator)
+	if !ok || !arenas.selectSparse() {
+		return nil
+	}
+	for ptr, mem := range heap.Memory {
+		if heap.pins[ptr] > 0 || !arenas.evacuating(mem) {
+			continue
+		}
+		moved, err := arenas.Alloc(uintptr(len(mem)))
+		if err != nil {
+			return fmt.Errorf("compacting: %w", err)
+		}
+		copy(moved, mem)
+		unlock := heap.lockMark()
+		heap.Memory[ptr] = moved
+		err = arenas.Free(mem)
+		unlock()
+		if err != nil {
+			return fmt.Errorf("compacting: %w", err)
+		}
+		heap.gcStats.Moved++
+		heap.gcStats.MovedBytes += uint64(len(mem))
+	}
+	return nil
+}
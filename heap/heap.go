@@ -1,115 +1,288 @@
+// Package heap manages the objects (strings, arrays and structs) allocated by
+// running programs.
 package heap
 
 import (
 	"errors"
 	"fmt"
+	. "github.com/AndreiAlbert/gvm/common"
 	"log"
-	. "stack_vm/common"
-	"syscall"
 	"unsafe"
 )
 
+// Heap owns the memory blocks allocated by a guest program. Memory maps the
+// address of every live block to its backing memory, cut to the size the
+// block was allocated with. A block spanning several pages is a single
+// slice of that logical size, which bounds every access to it.
 type Heap struct {
-	Memory map[uintptr][]byte
+	Memory    map[uintptr][]byte
+	allocator Allocator
+	// Limit caps the total size of live blocks in bytes. Zero means no
+	// limit.
+	Limit uintptr
+	// CurrentSite, when set, returns where the program is, so the heap
+	// records the site that allocated every live block and the sites that
+	// allocated and freed every freed block, for leak reports and errors
+	// of accesses to freed blocks. It costs a call and a map entry per
+	// allocation, so it is meant for debugging.
+	CurrentSite func() Site
+	allocated   uintptr
+	// totalAllocated sums the size of every block ever allocated
+	totalAllocated uint64
+	// peak is the largest value allocated has reached
+	peak        uintptr
+	allocations uint64
+	// sizeClasses count the blocks by the log2 of their size class
+	sizeClasses [64]SizeClass
+	// shared counts the string views and ropes referencing each string,
+	// which is copied before being written to
+	shared map[uintptr]int
+	// clones lists the array clones still sharing each array, which are
+	// given their own elements before either side is written to
+	clones map[uintptr][]uintptr
+	// mappings hold the elements of the mapped arrays
+	mappings map[uintptr]mapping
+	// sites holds the allocation sites of the live blocks and freed those
+	// of the freed blocks, while CurrentSite is set
+	sites map[uintptr]Site
+	freed map[uintptr]freedBlock
+	// pins counts the Pin calls not undone yet of the pinned blocks
+	pins map[uintptr]int
+	// structTypes are the types of the allocated structs, whose blocks
+	// hold an index into it
+	structTypes   []StructType
+	structTypeIDs map[string]uint32
+	gcStats       GCStats
+	// old are the blocks that survived a collection, remembered those of
+	// them a pointer was written to since the last one
+	old, remembered map[uintptr]bool
+	// marking is the mark of StartMark in progress, nil without one
+	marking *concurrentMark
 }
 
+// ErrLimitExceeded is returned by allocations that would grow the heap past
+// its Limit.
+var ErrLimitExceeded = errors.New("heap limit exceeded")
+
+// Errors returned by accesses to heap objects. Failing methods wrap one of
+// them with the details, test for them with errors.Is.
+var (
+	// ErrInvalidAddress reports a pointer that is not the address of a live
+	// block.
+	ErrInvalidAddress = errors.New("invalid memory address")
+	// ErrOutOfBounds reports an index or length outside of an object.
+	ErrOutOfBounds = errors.New("out of bounds")
+	// ErrTypeMismatch reports an object or value of the wrong kind, such as
+	// a string where an array is expected or a field that doesn't exist.
+	ErrTypeMismatch = errors.New("type mismatch")
+	// ErrReadOnly reports a write to an array mapped read-only.
+	ErrReadOnly = errors.New("read-only memory")
+	// ErrPinned reports freeing a block pinned by the host.
+	ErrPinned = errors.New("pinned object")
+)
+
+// NewHeap creates an empty heap using DefaultAllocator.
 func NewHeap() *Heap {
+	return NewHeapWithAllocator(DefaultAllocator)
+}
+
+// NewHeapWithAllocator creates an empty heap whose blocks come from
+// allocator.
+func NewHeapWithAllocator(allocator Allocator) *Heap {
 	return &Heap{
-		Memory: make(map[uintptr][]byte),
+		Memory:    make(map[uintptr][]byte),
+		allocator: allocator,
 	}
 }
 
+// Allocate reserves a block of at least size bytes and returns its address.
 func (heap *Heap) Allocate(size uintptr) (uintptr, error) {
-	pageSize := syscall.Getpagesize()
-	pagesRequired := (int(size) + pageSize - 1) / pageSize
-
-	mem, err := syscall.Mmap(
-		-1, 0,
-		pageSize*pagesRequired,
-		syscall.PROT_READ|syscall.PROT_WRITE,
-		syscall.MAP_ANON|syscall.MAP_PRIVATE,
-	)
+	if size == 0 {
+		size = 1
+	}
+	if heap.Limit > 0 && heap.allocated+size > heap.Limit {
+		return 0, fmt.Errorf("%w: allocating %d bytes with %d of %d in use", ErrLimitExceeded, size, heap.allocated, heap.Limit)
+	}
+	mem, err := heap.allocator.Alloc(size)
 	if err != nil {
-		return 0, fmt.Errorf("mmap failed: %w\n", err)
+		return 0, err
 	}
 	ptr := uintptr(unsafe.Pointer(&mem[0]))
+	if _, taken := heap.Memory[ptr]; taken {
+		// blocks restored from a snapshot keep their original addresses,
+		// which the allocator may hand out again. Holding on to this memory
+		// until the retry returns makes it pick another.
+		defer heap.allocator.Free(mem)
+		return heap.Allocate(size)
+	}
+	unlock := heap.lockMark()
 	heap.Memory[ptr] = mem
+	heap.allocatedBlack(ptr)
+	unlock()
+	heap.allocated += size
+	heap.totalAllocated += uint64(size)
+	heap.allocations++
+	heap.countAllocation(size)
+	heap.recordAllocation(ptr)
+	if heap.allocated > heap.peak {
+		heap.peak = heap.allocated
+	}
 	return ptr, nil
 }
 
+// Allocated returns the total size of live blocks in bytes.
+func (heap *Heap) Allocated() uintptr {
+	return heap.allocated
+}
+
+// TotalAllocated returns the size of all blocks allocated so far, including
+// freed ones.
+func (heap *Heap) TotalAllocated() uint64 {
+	return heap.totalAllocated
+}
+
+// Peak returns the largest total size of live blocks seen so far.
+func (heap *Heap) Peak() uintptr {
+	return heap.peak
+}
+
+// Allocations returns the number of blocks allocated so far.
+func (heap *Heap) Allocations() uint64 {
+	return heap.allocations
+}
+
+// Free releases the block at ptr.
 func (heap *Heap) Free(ptr uintptr) error {
 	mem, exists := heap.Memory[ptr]
 	if !exists {
-		return fmt.Errorf(`Failed to free memory at address: %d`, ptr)
+		return fmt.Errorf("freeing: %w", heap.invalidAddress(ptr))
+	}
+	if pins := heap.pins[ptr]; pins > 0 {
+		return fmt.Errorf("%w: freeing %d, pinned %d times", ErrPinned, ptr, pins)
+	}
+	switch mem[0] {
+	case stringViewTag:
+		heap.releaseView(ptr)
+	case ropeTag:
+		heap.releaseRope(ptr)
+	case arrayCloneTag:
+		heap.removeClone(heap.cloneBase(ptr), ptr)
+	case byte(ValueArray):
+		if err := heap.detachClones(ptr); err != nil {
+			return err
+		}
+	}
+	unlock := heap.lockMark()
+	defer unlock()
+	if heap.marking != nil {
+		heap.pointers(ptr, heap.dropped)
 	}
-	if err := syscall.Munmap(mem); err != nil {
+	unmapErr := heap.unmap(ptr)
+	if err := heap.allocator.Free(mem); err != nil {
 		return fmt.Errorf("freeing memory failed: %w", err)
 	}
 	delete(heap.Memory, ptr)
-	return nil
+	delete(heap.old, ptr)
+	delete(heap.remembered, ptr)
+	heap.allocated -= uintptr(len(mem))
+	heap.countFree(uintptr(len(mem)))
+	heap.recordFree(ptr)
+	return unmapErr
+}
+
+// Release frees every live block. The heap stays usable afterwards.
+func (heap *Heap) Release() error {
+	heap.abandonMark()
+	// every clone is freed too, there is no point copying their elements
+	heap.clones = nil
+	heap.pins = nil
+	heap.old, heap.remembered = nil, nil
+	var firstErr error
+	for ptr := range heap.Memory {
+		if err := heap.Free(ptr); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	// the blocks of the next program aren't those of this one
+	heap.sites, heap.freed = nil, nil
+	if arenas, ok := heap.allocator.(*ArenaAllocator); ok {
+		if err := arenas.releaseEmpty(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
 }
 
+// StoreValue writes a tagged scalar value into the block at ptr.
 func (heap *Heap) StoreValue(ptr uintptr, value Value) error {
 	mem, exists := heap.Memory[ptr]
 	if !exists {
-		return errors.New("invalid memory address")
+		return heap.invalidAddress(ptr)
 	}
-	mem[0] = byte(value.Kind)
 	var requiredSize uintptr
-	switch value.Kind {
+	switch value.Kind() {
 	case ValueInt32, ValueFloat32:
 		requiredSize = 5 // type tag + 4 bytes
 	case ValuePtr:
-		requiredSize = 1 + unsafe.Sizeof(uintptr(0))
+		requiredSize = 1 + ptrSize
+	default:
+		// the tag of other kinds marks typed objects, storing one would
+		// let the block be read as a string, array or struct
+		return fmt.Errorf("%w: cannot store a %v value", ErrTypeMismatch, value.Kind())
 	}
 	if uintptr(len(mem)) < requiredSize {
-		return errors.New("Memory access out of bounds")
+		return fmt.Errorf("%w: storing %v into a block of %d bytes", ErrOutOfBounds, value.Kind(), len(mem))
 	}
-	switch value.Kind {
-	case ValueInt32:
-		*(*int32)(unsafe.Pointer(ptr + 1)) = value.AsInt32()
-	case ValueFloat32:
-		*(*float32)(unsafe.Pointer(ptr + 1)) = value.AsFloat32()
+	unlock := heap.lockMark()
+	defer unlock()
+	if mem[0] == byte(ValuePtr) {
+		heap.dropped(getPtr(mem[1:]))
+	}
+	mem[0] = byte(value.Kind())
+	switch value.Kind() {
+	case ValueInt32, ValueFloat32:
+		byteOrder.PutUint32(mem[1:], value.Raw())
 	case ValuePtr:
-		*(*uintptr)(unsafe.Pointer(ptr + 1)) = value.AsPtr()
+		putPtr(mem[1:], value.Ptr())
+		heap.barrier(ptr)
 	}
 	return nil
 }
 
+// LoadValue reads the tagged scalar value stored in the block at ptr.
 func (heap *Heap) LoadValue(ptr uintptr) (*Value, error) {
 	mem, exists := heap.Memory[ptr]
 	if !exists {
-		return nil, errors.New("Invalid memory address")
+		return nil, heap.invalidAddress(ptr)
 	}
 
 	if len(mem) < 1 {
-		return nil, errors.New("memory access out of bounds")
+		return nil, fmt.Errorf("%w: loading from an empty block", ErrOutOfBounds)
 	}
 
 	kind := ValueKind(mem[0])
-	var value Value
-	value.Kind = kind
+	value := NewValue(kind, 0)
 	switch kind {
 	case ValueInt32:
 		if len(mem) < 5 { // tag + int32
-			return nil, errors.New("memory access out of bounds")
+			return nil, fmt.Errorf("%w: loading %v from a block of %d bytes", ErrOutOfBounds, kind, len(mem))
 		}
-		value.Raw = uint32(*(*int32)(unsafe.Pointer(ptr + 1)))
+		value = NewValue(kind, uint64(byteOrder.Uint32(mem[1:])))
 	case ValueFloat32:
 		if len(mem) < 5 { // tag + float32
-			return nil, errors.New("memory access out of bounds")
+			return nil, fmt.Errorf("%w: loading %v from a block of %d bytes", ErrOutOfBounds, kind, len(mem))
 		}
-		value.Raw = *(*uint32)(unsafe.Pointer(ptr + 1))
+		value = NewValue(kind, uint64(byteOrder.Uint32(mem[1:])))
 	case ValuePtr:
-		ptrSize := unsafe.Sizeof(uintptr(0))
 		if uintptr(len(mem)) < 1+ptrSize {
-			return nil, errors.New("memory access out of bounds")
+			return nil, fmt.Errorf("%w: loading %v from a block of %d bytes", ErrOutOfBounds, kind, len(mem))
 		}
-		value.Ptr = *(*uintptr)(unsafe.Pointer(ptr + 1))
+		value = NewValue(kind, uint64(getPtr(mem[1:])))
 	}
 	return &value, nil
 }
 
+// AllocateString copies s into a new string object and returns its address.
 func (heap *Heap) AllocateString(s string) (uintptr, error) {
 	// type tag + length + actual string
 	totalSize := uintptr(5 + len(s))
@@ -117,43 +290,51 @@ func (heap *Heap) AllocateString(s string) (uintptr, error) {
 	if err != nil {
 		return 0, err
 	}
-	heap.Memory[ptr][0] = byte(ValueString)
-	*(*int32)(unsafe.Pointer(ptr + 1)) = int32(len(s))
-	copy(heap.Memory[ptr][5:], s)
+	mem := heap.Memory[ptr]
+	mem[0] = byte(ValueString)
+	putInt32(mem[1:], int32(len(s)))
+	copy(mem[5:], s)
 	return ptr, nil
 }
 
+// LoadString returns the contents of the string object or string view at
+// ptr.
 func (heap *Heap) LoadString(ptr uintptr) (string, error) {
-	mem, exists := heap.Memory[ptr]
-	if !exists {
-		return "", errors.New("Invalid memory address")
-	}
-	if ValueKind(mem[0]) != ValueString {
-		return "", errors.New("Not a string value")
-	}
-	length := *(*int32)(unsafe.Pointer(ptr + 1))
-	if len(mem) < 5+int(length) {
-		return "", errors.New("memory access out of bounds")
+	data, err := heap.stringBytes(ptr)
+	if err != nil {
+		return "", err
 	}
-	return string(mem[5 : 5+length]), nil
+	return string(data), nil
 }
 
+// GetElementSize returns the number of bytes a value of kind occupies inside
+// arrays and structs. It panics with a *TypeError for kinds that can't be
+// stored there.
 func GetElementSize(kind ValueKind) uintptr {
 	switch kind {
+	case ValueByte:
+		return 1
 	case ValueFloat32, ValueInt32:
 		return 4
 	case ValuePtr, ValueString, ValueArray, ValueStruct:
-		return unsafe.Sizeof(uintptr(0))
+		return ptrSize
 	default:
-		log.Fatalf("Unsupported array element type: %v\n", kind)
-		return 0
+		panic(&TypeError{Want: "a number or pointer kind", Got: kind})
 	}
 }
 
+// AllocateArray creates an array of length elements of elementKind.
 func (heap *Heap) AllocateArray(elementKind ValueKind, length int32) (uintptr, error) {
+	switch elementKind {
+	case ValueByte, ValueInt32, ValueFloat32, ValuePtr, ValueString, ValueArray, ValueStruct:
+	default:
+		return 0, fmt.Errorf("%w: unsupported array element type %v", ErrTypeMismatch, elementKind)
+	}
+	if length < 0 {
+		return 0, fmt.Errorf("%w: negative array length %d", ErrOutOfBounds, length)
+	}
 	elementSize := GetElementSize(elementKind)
-	// type tag(1) + element type (1) + size (4) + array elements
-	totalSize := uintptr(1 + 1 + 4 + (elementSize * uintptr(length)))
+	totalSize := arrayHeaderSize + elementSize*uintptr(length)
 	ptr, err := heap.Allocate(totalSize)
 	if err != nil {
 		return 0, err
@@ -161,146 +342,358 @@ func (heap *Heap) AllocateArray(elementKind ValueKind, length int32) (uintptr, e
 	mem := heap.Memory[ptr]
 	mem[0] = byte(ValueArray)
 	mem[1] = byte(elementKind)
-	*(*int32)(unsafe.Pointer(ptr + 2)) = length
+	putInt32(mem[2:], length)
 	return ptr, nil
 }
 
-func (heap *Heap) SetArrayElement(arrayPtr uintptr, index int32, value Value) error {
+// arrayElement returns the element kind of the array at arrayPtr and the
+// bytes of its element at index, checking bounds against the length and
+// the size of the block.
+func (heap *Heap) arrayElement(arrayPtr uintptr, index int32) (ValueKind, []byte, error) {
 	mem, exists := heap.Memory[arrayPtr]
 	if !exists {
-		return errors.New("Invalid memory access")
+		return 0, nil, heap.invalidAddress(arrayPtr)
+	}
+	if mem[0] == arrayViewTag {
+		base, offset, length, err := heap.arrayRange(arrayPtr)
+		if err != nil {
+			return 0, nil, err
+		}
+		if index < 0 || index >= length {
+			return 0, nil, fmt.Errorf("%w: index %d of an array view of length %d", ErrOutOfBounds, index, length)
+		}
+		arrayPtr, index, mem = base, offset+index, heap.Memory[base]
+	}
+	if mem[0] == arrayCloneTag {
+		arrayPtr = heap.cloneBase(arrayPtr)
+		mem = heap.Memory[arrayPtr]
+	}
+	if ValueKind(mem[0]) != ValueArray && mem[0] != mappedArrayTag {
+		return 0, nil, fmt.Errorf("%w: expected an array, got %v", ErrTypeMismatch, ValueKind(mem[0]))
 	}
-	if ValueKind(mem[0]) != ValueArray {
-		return errors.New("Not an array")
+	if len(mem) < arrayHeaderSize {
+		return 0, nil, fmt.Errorf("%w: array header in a block of %d bytes", ErrOutOfBounds, len(mem))
 	}
 	elementKind := ValueKind(mem[1])
-	length := *(*int32)(unsafe.Pointer(arrayPtr + 2))
-	if index < 0 || index >= length {
-		return errors.New("Array index out of bounds!")
+	switch elementKind {
+	case ValueByte, ValueInt32, ValueFloat32, ValuePtr, ValueString, ValueArray, ValueStruct:
+	default:
+		return 0, nil, fmt.Errorf("%w: unsupported element type %v", ErrTypeMismatch, elementKind)
 	}
-	if elementKind != value.Kind {
-		return fmt.Errorf("Type mismatch: expected %v, got %v\n", elementKind, value.Kind)
+	length := getInt32(mem[2:])
+	if index < 0 || index >= length {
+		return 0, nil, fmt.Errorf("%w: index %d of an array of length %d", ErrOutOfBounds, index, length)
 	}
 	elementSize := GetElementSize(elementKind)
-	elementPtr := arrayPtr + 6 + uintptr(index)*elementSize
+	elements := heap.elementBytes(arrayPtr)
+	offset := uintptr(index) * elementSize
+	if offset+elementSize > uintptr(len(elements)) {
+		return 0, nil, fmt.Errorf("%w: element %d at %d of %d bytes of elements", ErrOutOfBounds, index, offset, len(elements))
+	}
+	return elementKind, elements[offset : offset+elementSize], nil
+}
+
+// SetArrayElement stores value at index, checking bounds and element kind.
+// Byte arrays also take int32 values, truncated to their low byte. Clones
+// sharing the elements written to are copied first.
+func (heap *Heap) SetArrayElement(arrayPtr uintptr, index int32, value Value) error {
+	elementKind, element, err := heap.arrayElement(arrayPtr, index)
+	if err != nil {
+		return err
+	}
+	if elementKind != value.Kind() && (elementKind != ValueByte || value.Kind() != ValueInt32) {
+		return fmt.Errorf("%w: expected %v, got %v", ErrTypeMismatch, elementKind, value.Kind())
+	}
+	if err := heap.prepareWrite(arrayPtr); err != nil {
+		return err
+	}
+	// the elements of a clone moved to its own block
+	if _, element, err = heap.arrayElement(arrayPtr, index); err != nil {
+		return err
+	}
 	switch elementKind {
+	case ValueByte:
+		element[0] = byte(value.Raw())
 	case ValueInt32, ValueFloat32:
-		*(*uint32)(unsafe.Pointer(elementPtr)) = value.Raw
+		byteOrder.PutUint32(element, value.Raw())
 	case ValuePtr, ValueString:
-		*(*uintptr)(unsafe.Pointer(elementPtr)) = value.Ptr
+		unlock := heap.lockMark()
+		heap.dropped(getPtr(element))
+		putPtr(element, value.Ptr())
+		unlock()
+		if heap.IsArrayView(arrayPtr) {
+			// the element is in the viewed array
+			arrayPtr = heap.loadView(arrayPtr).base
+		}
+		heap.barrier(arrayPtr)
 	default:
-		return fmt.Errorf("Unsupported element type: %v\n", elementKind)
+		return fmt.Errorf("%w: unsupported element type %v", ErrTypeMismatch, elementKind)
 	}
 	return nil
 }
 
+// GetArrayElement loads the element at index, checking bounds.
 func (heap *Heap) GetArrayElement(arrayPtr uintptr, index int32) (*Value, error) {
+	elementKind, element, err := heap.arrayElement(arrayPtr, index)
+	if err != nil {
+		return nil, err
+	}
+	var value Value
+	switch elementKind {
+	case ValueByte:
+		value = ByteValue(element[0])
+	case ValueInt32, ValueFloat32:
+		value = NewValue(elementKind, uint64(byteOrder.Uint32(element)))
+	case ValuePtr, ValueString:
+		value = NewValue(elementKind, uint64(getPtr(element)))
+	default:
+		return nil, fmt.Errorf("%w: unsupported element type %v", ErrTypeMismatch, elementKind)
+	}
+	return &value, nil
+}
+
+// ArrayElementKind returns the kind of the elements of the array, view or
+// clone at arrayPtr.
+func (heap *Heap) ArrayElementKind(arrayPtr uintptr) (ValueKind, error) {
 	mem, exists := heap.Memory[arrayPtr]
 	if !exists {
-		return nil, errors.New("Invalid memory access")
+		return 0, heap.invalidAddress(arrayPtr)
 	}
-	if ValueKind(mem[0]) != ValueArray {
-		return nil, errors.New("Not an array")
+	if mem[0] == arrayViewTag {
+		base, _, _, err := heap.arrayRange(arrayPtr)
+		if err != nil {
+			return 0, err
+		}
+		mem = heap.Memory[base]
 	}
-	elementKind := ValueKind(mem[1])
-	length := *(*int32)(unsafe.Pointer(arrayPtr + 2))
-	if index < 0 || index >= length {
-		return nil, errors.New("Array index out of bounds")
+	if mem[0] == arrayCloneTag {
+		mem = heap.Memory[heap.cloneBase(arrayPtr)]
 	}
-	elementSize := GetElementSize(elementKind)
-	elementPtr := arrayPtr + 6 + uintptr(index)*elementSize
-	value := &Value{
-		Kind: elementKind,
+	if ValueKind(mem[0]) != ValueArray && mem[0] != mappedArrayTag {
+		return 0, fmt.Errorf("%w: expected an array, got %v", ErrTypeMismatch, ValueKind(mem[0]))
 	}
-	switch elementKind {
-	case ValueInt32, ValueFloat32:
-		value.Raw = *(*uint32)(unsafe.Pointer(elementPtr))
-	case ValuePtr, ValueString:
-		value.Ptr = *(*uintptr)(unsafe.Pointer(elementPtr))
+	return ValueKind(mem[1]), nil
+}
+
+// ArrayLength returns the number of elements of the array, view or clone at
+// arrayPtr.
+func (heap *Heap) ArrayLength(arrayPtr uintptr) (int32, error) {
+	_, _, length, err := heap.arrayRange(arrayPtr)
+	return length, err
+}
+
+func (heap *Heap) plainArrayLength(arrayPtr uintptr) (int32, error) {
+	mem, exists := heap.Memory[arrayPtr]
+	if !exists {
+		return 0, heap.invalidAddress(arrayPtr)
+	}
+	if ValueKind(mem[0]) != ValueArray && mem[0] != mappedArrayTag {
+		return 0, fmt.Errorf("%w: expected an array, got %v", ErrTypeMismatch, ValueKind(mem[0]))
+	}
+	if len(mem) < arrayHeaderSize {
+		return 0, fmt.Errorf("%w: array header in a block of %d bytes", ErrOutOfBounds, len(mem))
+	}
+	return getInt32(mem[2:]), nil
+}
+
+// ObjectKind returns what the block at ptr holds: ValueString for strings,
+// string views and ropes, ValueArray for arrays, array views, clones and
+// mapped arrays, ValueStruct, or ValuePtr for a
+// closure or a block allocated with Allocate.
+func (heap *Heap) ObjectKind(ptr uintptr) (ValueKind, error) {
+	mem, exists := heap.Memory[ptr]
+	if !exists {
+		return 0, heap.invalidAddress(ptr)
+	}
+	switch mem[0] {
+	case byte(ValueString), stringViewTag, ropeTag:
+		return ValueString, nil
+	case byte(ValueArray), byte(ValueStruct):
+		return ValueKind(mem[0]), nil
+	case arrayViewTag, arrayCloneTag, mappedArrayTag:
+		return ValueArray, nil
 	default:
-		return nil, fmt.Errorf("Unsupported element type: %v\n", elementKind)
+		return ValuePtr, nil
 	}
-	return value, nil
 }
 
+// structHeaderSize is the size of the kind tag and type index in front of
+// the fields of a struct
+const structHeaderSize = 5
+
+// arrayHeaderSize is the size of the kind tag, the element kind and the
+// length in front of the elements of an array. Elements and fields are
+// packed without padding, so most sit at addresses that aren't aligned for
+// their size. They are only read and written through byteOrder, which works
+// on bytes, never through pointers to wider types: the accesses are defined
+// on every host and the layout is the same on all of them.
+const arrayHeaderSize = 1 + 1 + 4
+
+// AllocateStruct creates a zeroed instance of str. Types are told apart by
+// name: the heap keeps the first type allocated under each name.
 func (heap *Heap) AllocateStruct(str StructType) (uintptr, error) {
-	// kind struct + struct itself
-	totalSize := uintptr(1 + str.Size)
-	ptr, err := heap.Allocate(totalSize)
+	id, known := heap.structTypeIDs[str.Name]
+	if !known {
+		if heap.structTypeIDs == nil {
+			heap.structTypeIDs = make(map[string]uint32)
+		}
+		id = uint32(len(heap.structTypes))
+		unlock := heap.lockMark()
+		heap.structTypes = append(heap.structTypes, str)
+		unlock()
+		heap.structTypeIDs[str.Name] = id
+	}
+	ptr, err := heap.Allocate(structHeaderSize + uintptr(heap.structTypes[id].Size))
 	if err != nil {
 		return 0, err
 	}
-	mem, ok := heap.Memory[ptr]
-	if !ok {
-		return 0, errors.New("Could not allocate memory properly")
-	}
+	mem := heap.Memory[ptr]
 	mem[0] = byte(ValueStruct)
-	*(*StructType)(unsafe.Pointer(ptr + 1)) = str
+	byteOrder.PutUint32(mem[1:], id)
 	return ptr, nil
 }
 
-func (heap *Heap) GetStructField(structPtr uintptr, fieldName string) (*Value, error) {
+// StructTypeOf returns the type of the struct at structPtr.
+func (heap *Heap) StructTypeOf(structPtr uintptr) (*StructType, error) {
+	return heap.loadStructType(structPtr)
+}
+
+func (heap *Heap) loadStructType(structPtr uintptr) (*StructType, error) {
 	mem, exists := heap.Memory[structPtr]
 	if !exists {
-		return nil, errors.New("Invalid memory address")
+		return nil, heap.invalidAddress(structPtr)
 	}
 	if ValueKind(mem[0]) != ValueStruct {
-		return nil, errors.New("Not a struct")
+		return nil, fmt.Errorf("%w: expected a struct, got %v", ErrTypeMismatch, ValueKind(mem[0]))
+	}
+	if len(mem) < structHeaderSize {
+		return nil, fmt.Errorf("%w: struct header in a block of %d bytes", ErrOutOfBounds, len(mem))
+	}
+	id := byteOrder.Uint32(mem[1:])
+	if id >= uint32(len(heap.structTypes)) {
+		return nil, fmt.Errorf("%w: unknown struct type #%d", ErrTypeMismatch, id)
+	}
+	return &heap.structTypes[id], nil
+}
+
+// GetStructField reads the field named fieldName.
+func (heap *Heap) GetStructField(structPtr uintptr, fieldName string) (*Value, error) {
+	structType, err := heap.loadStructType(structPtr)
+	if err != nil {
+		return nil, err
 	}
-	structType := *(*StructType)(unsafe.Pointer(structPtr + 1))
 	for _, field := range structType.Fields {
 		if field.Name == fieldName {
-			fieldPtr := structPtr + 1 + uintptr(unsafe.Sizeof(StructType{})) + uintptr(field.Offset)
-			switch field.Type {
-			case ValueFloat32, ValueInt32:
-				value := &Value{
-					Kind: field.Type,
-					Raw:  *(*uint32)(unsafe.Pointer(fieldPtr)),
-				}
-				return value, nil
-			case ValuePtr, ValueString, ValueStruct, ValueArray:
-				value := &Value{
-					Kind: field.Type,
-					Ptr:  *(*uintptr)(unsafe.Pointer(fieldPtr)),
-				}
-				return value, nil
-			default:
-				return nil, fmt.Errorf("Unsupported field type: %v\n", field.Type)
-			}
+			return heap.getField(structPtr, field)
 		}
 	}
-	return nil, fmt.Errorf("Field %s is not found on struct\n", fieldName)
+	return nil, fmt.Errorf("%w: struct %s has no field %s", ErrTypeMismatch, structType.Name, fieldName)
 }
 
-func (heap *Heap) SetStructureField(structPtr uintptr, fieldName string, value Value) error {
-	mem, exists := heap.Memory[structPtr]
-	if !exists {
-		return errors.New("Invalid memory address")
+// GetStructFieldByID reads a field addressed by its program-wide field id.
+func (heap *Heap) GetStructFieldByID(structPtr uintptr, fieldID uint16) (*Value, error) {
+	structType, err := heap.loadStructType(structPtr)
+	if err != nil {
+		return nil, err
 	}
-	if ValueKind(mem[0]) != ValueStruct {
-		return errors.New("Not a struct")
+	for _, field := range structType.Fields {
+		if field.ID == fieldID {
+			return heap.getField(structPtr, field)
+		}
+	}
+	return nil, fmt.Errorf("%w: struct %s has no field #%d", ErrTypeMismatch, structType.Name, fieldID)
+}
+
+// fieldBytes returns the bytes of field in the struct at structPtr
+func (heap *Heap) fieldBytes(structPtr uintptr, field StructField) ([]byte, error) {
+	mem := heap.Memory[structPtr]
+	offset := structHeaderSize + uintptr(field.Offset)
+	if offset+GetElementSize(field.Type) > uintptr(len(mem)) {
+		return nil, fmt.Errorf("%w: field %s at %d of a block of %d bytes", ErrOutOfBounds, field.Name, offset, len(mem))
+	}
+	return mem[offset:], nil
+}
+
+func (heap *Heap) getField(structPtr uintptr, field StructField) (*Value, error) {
+	switch field.Type {
+	case ValueFloat32, ValueInt32, ValuePtr, ValueString, ValueStruct, ValueArray:
+	default:
+		return nil, fmt.Errorf("%w: unsupported field type %v", ErrTypeMismatch, field.Type)
+	}
+	data, err := heap.fieldBytes(structPtr, field)
+	if err != nil {
+		return nil, err
+	}
+	switch field.Type {
+	case ValueFloat32, ValueInt32:
+		value := NewValue(field.Type, uint64(byteOrder.Uint32(data)))
+		return &value, nil
+	case ValuePtr, ValueString, ValueStruct, ValueArray:
+		value := NewValue(field.Type, uint64(getPtr(data)))
+		return &value, nil
+	default:
+		return nil, fmt.Errorf("%w: unsupported field type %v", ErrTypeMismatch, field.Type)
+	}
+}
+
+// SetStructureField writes the field named fieldName, checking its type.
+func (heap *Heap) SetStructureField(structPtr uintptr, fieldName string, value Value) error {
+	structType, err := heap.loadStructType(structPtr)
+	if err != nil {
+		return err
 	}
-	structType := *(*StructType)(unsafe.Pointer(structPtr + 1))
 	for _, field := range structType.Fields {
 		if fieldName == field.Name {
-			if field.Type != value.Kind {
-				return fmt.Errorf("Type mismatch: expected %v, got %v", field.Type, value.Kind)
-			}
-			fieldPtr := structPtr + 1 + uintptr(unsafe.Sizeof(StructType{})) + uintptr(field.Offset)
-			switch field.Type {
-			case ValueFloat32, ValueInt32:
-				*(*uint32)(unsafe.Pointer(fieldPtr)) = value.Raw
-			case ValuePtr, ValueString, ValueStruct, ValueArray:
-				*(*uintptr)(unsafe.Pointer(fieldPtr)) = value.Ptr
-			default:
-				return fmt.Errorf("Unsupported type: %v\n", field.Type)
-			}
-			return nil
+			return heap.setField(structPtr, field, value)
 		}
 	}
-	return fmt.Errorf("Field %s not found in struct\n", fieldName)
+	return fmt.Errorf("%w: struct %s has no field %s", ErrTypeMismatch, structType.Name, fieldName)
+}
+
+// SetStructFieldByID writes a field addressed by its program-wide field id.
+func (heap *Heap) SetStructFieldByID(structPtr uintptr, fieldID uint16, value Value) error {
+	structType, err := heap.loadStructType(structPtr)
+	if err != nil {
+		return err
+	}
+	for _, field := range structType.Fields {
+		if field.ID == fieldID {
+			return heap.setField(structPtr, field, value)
+		}
+	}
+	return fmt.Errorf("%w: struct %s has no field #%d", ErrTypeMismatch, structType.Name, fieldID)
+}
+
+func (heap *Heap) setField(structPtr uintptr, field StructField, value Value) error {
+	if field.Type != value.Kind() {
+		return fmt.Errorf("%w: field %s is %v, got %v", ErrTypeMismatch, field.Name, field.Type, value.Kind())
+	}
+	switch field.Type {
+	case ValueFloat32, ValueInt32, ValuePtr, ValueString, ValueStruct, ValueArray:
+	default:
+		return fmt.Errorf("%w: unsupported field type %v", ErrTypeMismatch, field.Type)
+	}
+	data, err := heap.fieldBytes(structPtr, field)
+	if err != nil {
+		return err
+	}
+	switch field.Type {
+	case ValueFloat32, ValueInt32:
+		byteOrder.PutUint32(data, value.Raw())
+	case ValuePtr, ValueString, ValueStruct, ValueArray:
+		unlock := heap.lockMark()
+		heap.dropped(getPtr(data))
+		putPtr(data, value.Ptr())
+		unlock()
+		heap.barrier(structPtr)
+	default:
+		return fmt.Errorf("%w: unsupported field type %v", ErrTypeMismatch, field.Type)
+	}
+	return nil
 }
 
+// Debug logs every live block with its decoded contents, printed by
+// Format.
 func (heap *Heap) Debug() {
 	log.Printf("[HEAP DEBUG] Current memory map:")
 	if len(heap.Memory) == 0 {
@@ -312,57 +705,22 @@ func (heap *Heap) Debug() {
 		if len(mem) <= 0 {
 			continue
 		}
-		kind := ValueKind(mem[0])
-		switch kind {
-		case ValueInt32:
-			if len(mem) >= 5 {
-				value := *(*int32)(unsafe.Pointer(ptr + 1))
-				log.Printf("Decoded int32: %d\n", value)
-			}
-		case ValueFloat32:
-			if len(mem) >= 5 {
-				value := *(*float32)(unsafe.Pointer(ptr + 1))
-				log.Printf("Decoded float32: %f\n", value)
-			}
-		case ValueString:
-			if len(mem) >= 5 {
-				length := *(*int32)(unsafe.Pointer(ptr + 1))
-				if len(mem) >= 5+int(length) {
-					log.Printf("Decoded string: %s\n", string(mem[5:5+length]))
-				}
-			}
-		case ValuePtr:
-			if len(mem) > 1 {
-				ptrValue := *(*uintptr)(unsafe.Pointer(ptr + 1))
-				log.Printf("Decoded pointer: %d\n", ptrValue)
-			}
-		case ValueArray:
-			if len(mem) >= 6 {
-				elementKind := ValueKind(mem[1])
-				length := *(*int32)(unsafe.Pointer(ptr + 2))
-				log.Printf("Decoded array: type=%v, length=%d\n", elementKind, length)
-				elementSize := GetElementSize(elementKind)
-				for i := int32(0); i < length; i++ {
-					elementPtr := ptr + 6 + uintptr(i)*elementSize
-					switch elementKind {
-					case ValueInt32:
-						value := *(*int32)(unsafe.Pointer(elementPtr))
-						log.Printf("  [%d] = %d\n", i, value)
-					case ValueFloat32:
-						value := *(*float32)(unsafe.Pointer(elementPtr))
-						log.Printf("  [%d] = %f\n", i, value)
-					case ValuePtr, ValueString:
-						value := *(*uintptr)(unsafe.Pointer(elementPtr))
-						log.Printf("  [%d] = ptr(%d)\n", i, value)
-					}
-				}
-			}
-		case ValueStruct:
-			structType := *(*StructType)(unsafe.Pointer(ptr + 1))
-			fmt.Printf("%v\n", structType)
-		default:
-			log.Printf("Unkown value: %v\n", kind)
+		switch mem[0] {
+		case stringViewTag:
+			view := heap.loadView(ptr)
+			log.Printf("String view: base=%d, offset=%d, length=%d\n", view.base, view.offset, view.length)
+		case arrayViewTag:
+			view := heap.loadView(ptr)
+			log.Printf("Array view: base=%d, offset=%d, length=%d\n", view.base, view.offset, view.length)
+		case arrayCloneTag:
+			log.Printf("Array clone: base=%d\n", heap.cloneBase(ptr))
+		case mappedArrayTag:
+			log.Printf("Mapped array: length=%d, read-only=%v\n", len(heap.mappings[ptr].data), heap.mappings[ptr].readOnly)
+		case ropeTag:
+			node := heap.loadRope(ptr)
+			log.Printf("Rope: left=%d, right=%d, length=%d, depth=%d\n", node.left, node.right, node.length, node.depth)
 		}
+		log.Printf("Decoded: %s\n", heap.Format(PtrValue(ptr), FloatFormat{}))
 	}
 	log.Println()
 }
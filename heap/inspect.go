@@ -0,0 +1,167 @@
+package heap
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	. "github.com/AndreiAlbert/gvm/common"
+)
+
+// Object describes a live block for heap inspection tools. Type is what the
+// block is guessed to hold from its header: a struct name, string, an array
+// type such as int32[], closure, or block for memory from Allocate.
+type Object struct {
+	Address uintptr
+	Size    int
+	Kind    ValueKind
+	Type    string
+}
+
+// Slot is a value held by an object, named by its Path from the object:
+// .field for struct fields, [i] for array elements and captured values,
+// * for the value of a block from Allocate.
+type Slot struct {
+	Object uintptr
+	Path   string
+	Value  Value
+}
+
+// Objects returns every live block, by address.
+func (heap *Heap) Objects() []Object {
+	objects := make([]Object, 0, len(heap.Memory))
+	for ptr, mem := range heap.Memory {
+		if len(mem) == 0 {
+			continue
+		}
+		objects = append(objects, heap.describe(ptr, len(mem)))
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Address < objects[j].Address })
+	return objects
+}
+
+func (heap *Heap) describe(ptr uintptr, size int) Object {
+	object := Object{Address: ptr, Size: size, Type: "block"}
+	object.Kind, _ = heap.ObjectKind(ptr)
+	switch {
+	case object.Kind == ValueString:
+		object.Type = "string"
+	case object.Kind == ValueArray:
+		if kind, err := heap.ArrayElementKind(ptr); err == nil {
+			object.Type = kind.String() + "[]"
+		}
+		if heap.IsArrayView(ptr) {
+			object.Type += " view"
+		} else if heap.IsArrayClone(ptr) {
+			object.Type += " clone"
+		} else if heap.IsMappedArray(ptr) {
+			object.Type += " mapped"
+		}
+	case object.Kind == ValueStruct:
+		if structType, err := heap.loadStructType(ptr); err == nil {
+			object.Type = structType.Name
+		}
+	case heap.IsClosure(ptr):
+		object.Type = "closure"
+	}
+	return object
+}
+
+// ObjectAt describes the block at ptr, ok is false when no block starts
+// there.
+func (heap *Heap) ObjectAt(ptr uintptr) (Object, bool) {
+	mem, exists := heap.Memory[ptr]
+	if !exists || len(mem) == 0 {
+		return Object{}, false
+	}
+	return heap.describe(ptr, len(mem)), true
+}
+
+// Containing returns the object whose memory holds address and the offset
+// of address in it, for pointers into the middle of a block.
+func (heap *Heap) Containing(address uintptr) (Object, uintptr, bool) {
+	for ptr, mem := range heap.Memory {
+		if address >= ptr && address < ptr+uintptr(len(mem)) {
+			return heap.describe(ptr, len(mem)), address - ptr, true
+		}
+	}
+	return Object{}, 0, false
+}
+
+// Slots returns the values held by the object at ptr, none for strings.
+func (heap *Heap) Slots(ptr uintptr) ([]Slot, error) {
+	kind, err := heap.ObjectKind(ptr)
+	if err != nil {
+		return nil, err
+	}
+	var slots []Slot
+	switch {
+	case kind == ValueString:
+	case kind == ValueArray:
+		for i := int32(0); ; i++ {
+			element, err := heap.GetArrayElement(ptr, i)
+			if err != nil {
+				break
+			}
+			slots = append(slots, Slot{ptr, fmt.Sprintf("[%d]", i), *element})
+		}
+	case kind == ValueStruct:
+		structType, err := heap.loadStructType(ptr)
+		if err != nil {
+			return nil, err
+		}
+		for _, field := range structType.Fields {
+			value, err := heap.getField(ptr, field)
+			if err != nil {
+				return nil, err
+			}
+			slots = append(slots, Slot{ptr, "." + field.Name, *value})
+		}
+	case heap.IsClosure(ptr):
+		_, captured, err := heap.LoadClosure(ptr)
+		if err != nil {
+			return nil, err
+		}
+		for i, value := range captured {
+			slots = append(slots, Slot{ptr, fmt.Sprintf("[%d]", i), value})
+		}
+	default:
+		value, err := heap.LoadValue(ptr)
+		if err != nil {
+			return nil, err
+		}
+		slots = append(slots, Slot{ptr, "*", *value})
+	}
+	return slots, nil
+}
+
+// Find returns the slots of every object whose value matches.
+func (heap *Heap) Find(match func(Value) bool) []Slot {
+	var found []Slot
+	for _, object := range heap.Objects() {
+		slots, err := heap.Slots(object.Address)
+		if err != nil {
+			continue
+		}
+		for _, slot := range slots {
+			if match(slot.Value) {
+				found = append(found, slot)
+			}
+		}
+	}
+	return found
+}
+
+// FindString returns the addresses of the strings containing text.
+func (heap *Heap) FindString(text string) []uintptr {
+	var found []uintptr
+	for _, object := range heap.Objects() {
+		if object.Kind != ValueString {
+			continue
+		}
+		if s, err := heap.LoadString(object.Address); err == nil && strings.Contains(s, text) {
+			found = append(found, object.Address)
+		}
+	}
+	return found
+}
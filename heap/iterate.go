@@ -0,0 +1,50 @@
+package heap
+
+import (
+	"fmt"
+	"unicode/utf8"
+
+	. "github.com/AndreiAlbert/gvm/common"
+)
+
+// Next returns the element of the array or string at ptr found at cursor
+// and the cursor of the element after it, or ok false when the iteration
+// is over. Cursors start at 0: an array cursor is an index and a string
+// cursor the byte offset of a rune, whose code point is the element. Bytes
+// that aren't UTF-8 are read as utf8.RuneError.
+func (heap *Heap) Next(ptr uintptr, cursor int32) (element Value, next int32, ok bool, err error) {
+	if cursor < 0 {
+		return Value{}, 0, false, fmt.Errorf("%w: iteration cursor %d", ErrOutOfBounds, cursor)
+	}
+	kind, err := heap.ObjectKind(ptr)
+	if err != nil {
+		return Value{}, 0, false, err
+	}
+	switch kind {
+	case ValueArray:
+		length, err := heap.ArrayLength(ptr)
+		if err != nil {
+			return Value{}, 0, false, err
+		}
+		if cursor >= length {
+			return Value{}, 0, false, nil
+		}
+		value, err := heap.GetArrayElement(ptr, cursor)
+		if err != nil {
+			return Value{}, 0, false, err
+		}
+		return *value, cursor + 1, true, nil
+	case ValueString:
+		data, err := heap.stringBytes(ptr)
+		if err != nil {
+			return Value{}, 0, false, err
+		}
+		if int(cursor) >= len(data) {
+			return Value{}, 0, false, nil
+		}
+		r, size := utf8.DecodeRune(data[cursor:])
+		return Int32Value(int32(r)), cursor + int32(size), true, nil
+	default:
+		return Value{}, 0, false, fmt.Errorf("%w: iterating over a %v block, expected an array or a string", ErrTypeMismatch, kind)
+	}
+}
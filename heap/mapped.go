@@ -0,0 +1,76 @@
+package heap
+
+import (
+	"fmt"
+	"math"
+
+	. "github.com/AndreiAlbert/gvm/common"
+)
+
+// mappedArrayTag is the type tag of byte arrays whose elements are memory of
+// the host, such as a mapped file. The block holds the header of a plain
+// array, the elements are in mappings. ObjectKind reports them as arrays.
+const mappedArrayTag = 0x20 | byte(ValueArray)
+
+// mapping is the memory holding the elements of a mapped array
+type mapping struct {
+	data     []byte
+	readOnly bool
+	// release gives the memory back to the host when the array is freed
+	release func() error
+}
+
+// AllocateMappedArray creates a byte array whose elements are data, which
+// the heap doesn't copy. Writes fail with ErrReadOnly if readOnly is set.
+// Freeing the array calls release, which may be nil. data doesn't count
+// against Limit: it is memory of the host, such as the pages of a mapped
+// file.
+func (heap *Heap) AllocateMappedArray(data []byte, readOnly bool, release func() error) (uintptr, error) {
+	if len(data) > math.MaxInt32 {
+		return 0, fmt.Errorf("%w: %d bytes are too many for an array", ErrOutOfBounds, len(data))
+	}
+	ptr, err := heap.Allocate(arrayHeaderSize)
+	if err != nil {
+		return 0, err
+	}
+	mem := heap.Memory[ptr]
+	mem[0] = mappedArrayTag
+	mem[1] = byte(ValueByte)
+	putInt32(mem[2:], int32(len(data)))
+	if heap.mappings == nil {
+		heap.mappings = make(map[uintptr]mapping)
+	}
+	heap.mappings[ptr] = mapping{data: data, readOnly: readOnly, release: release}
+	return ptr, nil
+}
+
+// IsMappedArray reports whether ptr is the address of a mapped array.
+func (heap *Heap) IsMappedArray(ptr uintptr) bool {
+	mem, exists := heap.Memory[ptr]
+	return exists && mem[0] == mappedArrayTag
+}
+
+// elementBytes returns the elements of the plain or mapped array at ptr.
+// A mapped array restored from a snapshot has none.
+func (heap *Heap) elementBytes(ptr uintptr) []byte {
+	if m, ok := heap.mappings[ptr]; ok {
+		return m.data
+	}
+	return heap.Memory[ptr][arrayHeaderSize:]
+}
+
+// unmap releases the memory of the mapped array at ptr
+func (heap *Heap) unmap(ptr uintptr) error {
+	m, ok := heap.mappings[ptr]
+	if !ok {
+		return nil
+	}
+	delete(heap.mappings, ptr)
+	if m.release == nil {
+		return nil
+	}
+	if err := m.release(); err != nil {
+		return fmt.Errorf("releasing a mapped array: %w", err)
+	}
+	return nil
+}
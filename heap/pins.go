@@ -0,0 +1,34 @@
+package heap
+
+import "fmt"
+
+// Pin keeps the block at ptr alive until as many Unpin calls: freeing it
+// fails with ErrPinned. Natives pin the objects they hold on to across
+// calls, so the program can't free them under their feet. Collections
+// keep pinned blocks where they are. Release frees pinned blocks too.
+func (heap *Heap) Pin(ptr uintptr) error {
+	if _, exists := heap.Memory[ptr]; !exists {
+		return fmt.Errorf("pinning: %w", heap.invalidAddress(ptr))
+	}
+	if heap.pins == nil {
+		heap.pins = make(map[uintptr]int)
+	}
+	heap.pins[ptr]++
+	return nil
+}
+
+// Unpin undoes a Pin of the block at ptr.
+func (heap *Heap) Unpin(ptr uintptr) error {
+	if heap.pins[ptr] == 0 {
+		return fmt.Errorf("%w: unpinning %d, which isn't pinned", ErrInvalidAddress, ptr)
+	}
+	if heap.pins[ptr]--; heap.pins[ptr] == 0 {
+		delete(heap.pins, ptr)
+	}
+	return nil
+}
+
+// Pins returns how many times the block at ptr is pinned.
+func (heap *Heap) Pins(ptr uintptr) int {
+	return heap.pins[ptr]
+}
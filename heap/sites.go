@@ -0,0 +1,122 @@
+package heap
+
+import (
+	"fmt"
+	"io"
+	"sort"
+)
+
+// Site is where a block was allocated or freed: the address of the
+// instruction, its function and its source line, 0 without a source map.
+type Site struct {
+	Address  uint   `json:"address"`
+	Function string `json:"function"`
+	Line     uint32 `json:"line,omitempty"`
+}
+
+func (s Site) String() string {
+	if s.Line == 0 {
+		return fmt.Sprintf("%s at %08x", s.Function, s.Address)
+	}
+	return fmt.Sprintf("%s line %d (%08x)", s.Function, s.Line, s.Address)
+}
+
+// freedBlock is where a freed block was allocated and freed
+type freedBlock struct {
+	allocated, freed Site
+}
+
+// SiteUsage counts the live blocks allocated at one site.
+type SiteUsage struct {
+	Site   Site    `json:"site"`
+	Blocks uint64  `json:"blocks"`
+	Bytes  uintptr `json:"bytes"`
+}
+
+// recordAllocation notes where the block at ptr was allocated, if the heap
+// tracks sites
+func (heap *Heap) recordAllocation(ptr uintptr) {
+	if heap.CurrentSite == nil {
+		return
+	}
+	if heap.sites == nil {
+		heap.sites = make(map[uintptr]Site)
+	}
+	heap.sites[ptr] = heap.CurrentSite()
+	delete(heap.freed, ptr)
+}
+
+// recordFree notes where the block at ptr was freed, if the heap tracks
+// sites
+func (heap *Heap) recordFree(ptr uintptr) {
+	if heap.CurrentSite == nil {
+		return
+	}
+	if heap.freed == nil {
+		heap.freed = make(map[uintptr]freedBlock)
+	}
+	heap.freed[ptr] = freedBlock{allocated: heap.sites[ptr], freed: heap.CurrentSite()}
+	delete(heap.sites, ptr)
+}
+
+// AllocationSite returns where the live block at ptr was allocated, false
+// if the heap doesn't know.
+func (heap *Heap) AllocationSite(ptr uintptr) (Site, bool) {
+	site, ok := heap.sites[ptr]
+	return site, ok
+}
+
+// invalidAddress is the error of an access to ptr, which is not the
+// address of a live block. When ptr is the address of a freed block, it
+// tells where the block was allocated and freed.
+func (heap *Heap) invalidAddress(ptr uintptr) error {
+	if block, ok := heap.freed[ptr]; ok {
+		return fmt.Errorf("%w: %d, a block allocated at %v and freed at %v", ErrInvalidAddress, ptr, block.allocated, block.freed)
+	}
+	return fmt.Errorf("%w: %d", ErrInvalidAddress, ptr)
+}
+
+// LiveSites counts the live blocks by the site that allocated them, the
+// sites holding the most bytes first. It is empty unless the heap tracks
+// sites.
+func (heap *Heap) LiveSites() []SiteUsage {
+	bySite := make(map[Site]*SiteUsage)
+	for ptr, site := range heap.sites {
+		usage := bySite[site]
+		if usage == nil {
+			usage = &SiteUsage{Site: site}
+			bySite[site] = usage
+		}
+		usage.Blocks++
+		usage.Bytes += uintptr(len(heap.Memory[ptr]))
+	}
+	usages := make([]SiteUsage, 0, len(bySite))
+	for _, usage := range bySite {
+		usages = append(usages, *usage)
+	}
+	sort.Slice(usages, func(i, j int) bool {
+		if usages[i].Bytes != usages[j].Bytes {
+			return usages[i].Bytes > usages[j].Bytes
+		}
+		return usages[i].Site.Address < usages[j].Site.Address
+	})
+	return usages
+}
+
+// writeLiveSites writes the live blocks by allocation site, the blocks the
+// program leaked if it has stopped
+func (heap *Heap) writeLiveSites(w io.Writer) error {
+	usages := heap.LiveSites()
+	if len(usages) == 0 {
+		return nil
+	}
+	if _, err := fmt.Fprintf(w, "\n%10s %12s  %s\n", "live", "live bytes", "allocated at"); err != nil {
+		return err
+	}
+	for _, usage := range usages {
+		if _, err := fmt.Fprintf(w, "%10d %12d  %v\n", usage.Blocks, usage.Bytes, usage.Site); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package heap
+
+import (
+	"fmt"
+	"sort"
+
+	. "github.com/AndreiAlbert/gvm/common"
+)
+
+// Block is a heap block saved by Snapshot.
+type Block struct {
+	Address uintptr
+	Data    []byte
+	// Site is where the block was allocated, the zero Site if the heap
+	// didn't track sites
+	Site Site
+}
+
+// Snapshot returns a copy of every live block, by address, and the names of
+// the struct types the struct blocks refer to, in the order of the indexes
+// stored in their headers.
+func (heap *Heap) Snapshot() ([]Block, []string) {
+	blocks := make([]Block, 0, len(heap.Memory))
+	for ptr, mem := range heap.Memory {
+		blocks = append(blocks, Block{Address: ptr, Data: append([]byte(nil), mem...), Site: heap.sites[ptr]})
+	}
+	sort.Slice(blocks, func(i, j int) bool { return blocks[i].Address < blocks[j].Address })
+	names := make([]string, len(heap.structTypes))
+	for i, structType := range heap.structTypes {
+		names[i] = structType.Name
+	}
+	return blocks, names
+}
+
+// Restore fills an empty heap with blocks saved by Snapshot. The blocks keep
+// their original addresses, so the pointers between them and in the saved
+// VM state stay valid, though their memory is new. structTypes are the types
+// Snapshot named, in the same order. The reference counts of shared strings,
+// the clones sharing each array and the elements of mapped arrays are not
+// saved: a restored heap is meant to be inspected, not run.
+func (heap *Heap) Restore(blocks []Block, structTypes []StructType) error {
+	if len(heap.Memory) > 0 || len(heap.structTypes) > 0 {
+		return fmt.Errorf("restoring into a heap that is in use")
+	}
+	heap.structTypeIDs = make(map[string]uint32)
+	for i, structType := range structTypes {
+		heap.structTypes = append(heap.structTypes, structType)
+		heap.structTypeIDs[structType.Name] = uint32(i)
+	}
+	for _, block := range blocks {
+		if _, exists := heap.Memory[block.Address]; exists || block.Address == 0 || len(block.Data) == 0 {
+			return fmt.Errorf("%w: block at %d is empty or saved twice", ErrInvalidAddress, block.Address)
+		}
+		mem, err := heap.allocator.Alloc(uintptr(len(block.Data)))
+		if err != nil {
+			return err
+		}
+		copy(mem, block.Data)
+		heap.Memory[block.Address] = mem[:len(block.Data)]
+		heap.allocated += uintptr(len(block.Data))
+		heap.countAllocation(uintptr(len(block.Data)))
+		if block.Site != (Site{}) {
+			if heap.sites == nil {
+				heap.sites = make(map[uintptr]Site)
+			}
+			heap.sites[block.Address] = block.Site
+		}
+	}
+	if heap.allocated > heap.peak {
+		heap.peak = heap.allocated
+	}
+	return nil
+}
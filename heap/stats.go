@@ -0,0 +1,91 @@
+package heap
+
+import (
+	"fmt"
+	"io"
+	"math/bits"
+)
+
+// minSizeClass is the log2 of the smallest size class
+const minSizeClass = 3
+
+// SizeClass counts the blocks of one size class: the blocks larger than
+// half of Size and at most Size bytes. Classes are the powers of two from 8
+// bytes.
+type SizeClass struct {
+	Size uintptr `json:"size"`
+	// Live is the number of live blocks, LiveBytes their total size
+	Live      uint64  `json:"live"`
+	LiveBytes uintptr `json:"live_bytes"`
+	// Allocations is the number of blocks ever allocated, freed ones
+	// included
+	Allocations uint64 `json:"allocations"`
+}
+
+// sizeClassIndex returns the log2 of the size class of a block of size
+// bytes
+func sizeClassIndex(size uintptr) int {
+	return min(max(minSizeClass, bits.Len(uint(size-1))), 63)
+}
+
+// countAllocation counts a new block of size bytes in its size class
+func (heap *Heap) countAllocation(size uintptr) {
+	class := &heap.sizeClasses[sizeClassIndex(size)]
+	class.Live++
+	class.LiveBytes += size
+	class.Allocations++
+}
+
+// countFree removes a freed block of size bytes from its size class
+func (heap *Heap) countFree(size uintptr) {
+	class := &heap.sizeClasses[sizeClassIndex(size)]
+	class.Live--
+	class.LiveBytes -= size
+}
+
+// SizeClasses returns the size classes that blocks were allocated in,
+// smallest first.
+func (heap *Heap) SizeClasses() []SizeClass {
+	var classes []SizeClass
+	for i, class := range heap.sizeClasses {
+		if class.Allocations > 0 {
+			class.Size = 1 << i
+			classes = append(classes, class)
+		}
+	}
+	return classes
+}
+
+// Fragmentation estimates the share of memory an allocator serving blocks
+// from size classes would waste on the live blocks: the bytes they leave
+// unused in their class, over the bytes of their classes. It is 0 for an
+// empty heap.
+func (heap *Heap) Fragmentation() float64 {
+	var used, reserved uint64
+	for i, class := range heap.sizeClasses {
+		used += uint64(class.LiveBytes)
+		reserved += class.Live << i
+	}
+	if reserved == 0 {
+		return 0
+	}
+	return float64(reserved-used) / float64(reserved)
+}
+
+// WriteReport writes the size classes and the fragmentation estimate as
+// an aligned, human readable table, followed by the live blocks by
+// allocation site if the heap tracks sites.
+func (heap *Heap) WriteReport(w io.Writer) error {
+	if _, err := fmt.Fprintf(w, "%-12s %10s %12s %12s\n", "size class", "live", "live bytes", "allocations"); err != nil {
+		return err
+	}
+	for _, class := range heap.SizeClasses() {
+		if _, err := fmt.Fprintf(w, "%-12s %10d %12d %12d\n", fmt.Sprintf("<= %d", class.Size), class.Live, class.LiveBytes, class.Allocations); err != nil {
+			return err
+		}
+	}
+	if _, err := fmt.Fprintf(w, "live %d bytes, peak %d bytes, fragmentation %.1f%%\n", heap.allocated, heap.peak, 100*heap.Fragmentation()); err != nil {
+		return err
+	}
+	return heap.writeLiveSites(w)
+}
@@ -0,0 +1,529 @@
+package heap
+
+import (
+	"fmt"
+	"math"
+
+	. "github.com/AndreiAlbert/gvm/common"
+)
+
+// Type tags of the string blocks that are not plain strings. They are not
+// ValueKinds, LoadString reads both kinds as strings.
+const (
+	stringViewTag = 0x80 | byte(ValueString)
+	ropeTag       = 0x40 | byte(ValueString)
+)
+
+// ropeThreshold is the length from which Concat links its operands in a
+// rope instead of copying them
+const ropeThreshold = 1024
+
+// maxRopeDepth bounds the nesting of ropes. Concat flattens a rope that
+// would get deeper, so reading a rope never recurses further. Balanced
+// ropes only get that deep with millions of pieces.
+const maxRopeDepth = 32
+
+// stringView is the contents of a view block after its tag: the string it
+// points into and the byte range it covers
+type stringView struct {
+	base   uintptr
+	offset int32
+	length int32
+}
+
+// viewSize is the size of a view block: the tag, base, offset and length
+const viewSize = 1 + ptrSize + 4 + 4
+
+func (heap *Heap) loadView(ptr uintptr) stringView {
+	mem := heap.Memory[ptr]
+	return stringView{
+		base:   getPtr(mem[1:]),
+		offset: getInt32(mem[1+ptrSize:]),
+		length: getInt32(mem[5+ptrSize:]),
+	}
+}
+
+func storeView(mem []byte, view stringView) {
+	putPtr(mem[1:], view.base)
+	putInt32(mem[1+ptrSize:], view.offset)
+	putInt32(mem[5+ptrSize:], view.length)
+}
+
+// ropeNode is the contents of a rope block after its tag. A rope is the
+// concatenation of left and right, each a string, a view or a shallower
+// rope. flat caches the contents once the rope has been read.
+type ropeNode struct {
+	left   uintptr
+	right  uintptr
+	flat   uintptr
+	length int32
+	depth  int32
+}
+
+// ropeSize is the size of a rope block: the tag, the three pointers, the
+// length and the depth
+const ropeSize = 1 + 3*ptrSize + 4 + 4
+
+// ropeFlat is the offset of the flat pointer in a rope block
+const ropeFlat = 1 + 2*ptrSize
+
+func (heap *Heap) loadRope(ptr uintptr) ropeNode {
+	mem := heap.Memory[ptr]
+	return ropeNode{
+		left:   getPtr(mem[1:]),
+		right:  getPtr(mem[1+ptrSize:]),
+		flat:   getPtr(mem[ropeFlat:]),
+		length: getInt32(mem[ropeFlat+ptrSize:]),
+		depth:  getInt32(mem[ropeFlat+ptrSize+4:]),
+	}
+}
+
+func storeRope(mem []byte, node ropeNode) {
+	putPtr(mem[1:], node.left)
+	putPtr(mem[1+ptrSize:], node.right)
+	putPtr(mem[ropeFlat:], node.flat)
+	putInt32(mem[ropeFlat+ptrSize:], node.length)
+	putInt32(mem[ropeFlat+ptrSize+4:], node.depth)
+}
+
+// stringBytes returns the bytes of the string, view or rope at ptr
+// without copying them, ropes are flattened on first use
+func (heap *Heap) stringBytes(ptr uintptr) ([]byte, error) {
+	mem, exists := heap.Memory[ptr]
+	if !exists {
+		return nil, heap.invalidAddress(ptr)
+	}
+	switch mem[0] {
+	case stringViewTag:
+		// views always point into plain strings, the base of a view whose
+		// string was freed may have been reused by anything
+		view := heap.loadView(ptr)
+		data, err := heap.plainStringBytes(view.base)
+		if err != nil {
+			return nil, fmt.Errorf("string view: %w", err)
+		}
+		if int(view.offset)+int(view.length) > len(data) {
+			return nil, fmt.Errorf("%w: view of %d bytes at %d into a string of %d", ErrOutOfBounds, view.length, view.offset, len(data))
+		}
+		return data[view.offset : view.offset+view.length], nil
+	case ropeTag:
+		node := heap.loadRope(ptr)
+		if node.flat == 0 {
+			flat, err := heap.flatten(ptr)
+			if err != nil {
+				return nil, err
+			}
+			node.flat = flat
+			unlock := heap.lockMark()
+			putPtr(mem[ropeFlat:], flat)
+			unlock()
+			heap.barrier(ptr)
+		}
+		return heap.plainStringBytes(node.flat)
+	default:
+		return heap.plainStringBytes(ptr)
+	}
+}
+
+func (heap *Heap) plainStringBytes(ptr uintptr) ([]byte, error) {
+	mem, exists := heap.Memory[ptr]
+	if !exists {
+		return nil, heap.invalidAddress(ptr)
+	}
+	if ValueKind(mem[0]) != ValueString {
+		return nil, fmt.Errorf("%w: expected a string, got %v", ErrTypeMismatch, ValueKind(mem[0]))
+	}
+	length := getInt32(mem[1:])
+	if length < 0 || len(mem) < 5+int(length) {
+		return nil, fmt.Errorf("%w: string of %d bytes in a block of %d bytes", ErrOutOfBounds, length, len(mem))
+	}
+	return mem[5 : 5+length], nil
+}
+
+// StringLength returns the length of the string, view or rope at ptr
+// without flattening ropes.
+func (heap *Heap) StringLength(ptr uintptr) (int32, error) {
+	if mem, exists := heap.Memory[ptr]; exists && mem[0] == ropeTag {
+		return heap.loadRope(ptr).length, nil
+	}
+	data, err := heap.stringBytes(ptr)
+	if err != nil {
+		return 0, err
+	}
+	return int32(len(data)), nil
+}
+
+// ropeDepth returns the depth of the rope at ptr, 0 for other strings
+func (heap *Heap) ropeDepth(ptr uintptr) int32 {
+	if mem, exists := heap.Memory[ptr]; exists && mem[0] == ropeTag {
+		return heap.loadRope(ptr).depth
+	}
+	return 0
+}
+
+// Concat returns a string holding the contents of left followed by those
+// of right. Long results are ropes that reference both operands instead of
+// copying them. Ropes are kept balanced as AVL trees: joining a deep rope
+// and a shallow string copies only the nodes along one edge of the deep
+// rope, so building a large string piece by piece allocates O(log n) nodes
+// per piece.
+func (heap *Heap) Concat(left, right uintptr) (uintptr, error) {
+	leftTree, err := heap.existingRope(left)
+	if err != nil {
+		return 0, err
+	}
+	rightTree, err := heap.existingRope(right)
+	if err != nil {
+		return 0, err
+	}
+	length := int64(leftTree.length) + int64(rightTree.length)
+	if length > math.MaxInt32 {
+		return 0, fmt.Errorf("%w: concatenation of %d bytes", ErrOutOfBounds, length)
+	}
+	var tree *ropeTree
+	if length >= ropeThreshold {
+		if tree, err = heap.joinRopes(leftTree, rightTree); err != nil {
+			return 0, err
+		}
+	}
+	if tree == nil || tree.depth > maxRopeDepth {
+		ptr, data, err := heap.allocateStringBlock(int32(length))
+		if err != nil {
+			return 0, err
+		}
+		n, err := heap.copyString(data, left, maxRopeDepth+1)
+		if err == nil {
+			var m int
+			m, err = heap.copyString(data[n:], right, maxRopeDepth+1)
+			n += m
+		}
+		if err == nil && int64(n) != length {
+			err = fmt.Errorf("%w: concatenation copied %d of %d bytes", ErrOutOfBounds, n, length)
+		}
+		if err != nil {
+			heap.Free(ptr)
+			return 0, err
+		}
+		return ptr, nil
+	}
+	var created []uintptr
+	ptr, err := heap.allocateRopes(tree, &created)
+	if err != nil {
+		// the newer nodes reference the older ones
+		for i := len(created) - 1; i >= 0; i-- {
+			heap.Free(created[i])
+		}
+		return 0, err
+	}
+	return ptr, nil
+}
+
+// ropeTree is a rope being joined by Concat: either an existing block, or
+// a node to allocate once its children exist
+type ropeTree struct {
+	ptr           uintptr
+	left, right   *ropeTree
+	length, depth int32
+}
+
+// existingRope describes the string, view or rope at ptr
+func (heap *Heap) existingRope(ptr uintptr) (*ropeTree, error) {
+	length, err := heap.StringLength(ptr)
+	if err != nil {
+		return nil, err
+	}
+	return &ropeTree{ptr: ptr, length: length, depth: heap.ropeDepth(ptr)}, nil
+}
+
+func newRopeNode(left, right *ropeTree) *ropeTree {
+	return &ropeTree{left: left, right: right, length: left.length + right.length, depth: max(left.depth, right.depth) + 1}
+}
+
+// children returns the two halves of the rope t, false for strings, views
+// and ropes that have been read: their children may have been freed since
+// the rope was flattened, so they are only used as a whole.
+func (heap *Heap) children(t *ropeTree) (left, right *ropeTree, ok bool, err error) {
+	if t.ptr == 0 {
+		return t.left, t.right, true, nil
+	}
+	if !heap.IsRope(t.ptr) {
+		return nil, nil, false, nil
+	}
+	node := heap.loadRope(t.ptr)
+	if node.flat != 0 {
+		return nil, nil, false, nil
+	}
+	if left, err = heap.existingRope(node.left); err != nil {
+		return nil, nil, false, err
+	}
+	if right, err = heap.existingRope(node.right); err != nil {
+		return nil, nil, false, err
+	}
+	return left, right, true, nil
+}
+
+// joinRopes returns the concatenation of left and right as a balanced tree,
+// their depths differing by at most one at every new node
+func (heap *Heap) joinRopes(left, right *ropeTree) (*ropeTree, error) {
+	switch {
+	case left.depth > right.depth+1:
+		return heap.joinRight(left, right)
+	case right.depth > left.depth+1:
+		return heap.joinLeft(left, right)
+	}
+	return newRopeNode(left, right), nil
+}
+
+// joinRight joins right to left, the deeper, along the right edge of left
+func (heap *Heap) joinRight(left, right *ropeTree) (*ropeTree, error) {
+	l, c, ok, err := heap.children(left)
+	if err != nil || !ok {
+		return newRopeNode(left, right), err
+	}
+	var t *ropeTree
+	if c.depth <= right.depth+1 {
+		t = newRopeNode(c, right)
+		if t.depth > l.depth+1 {
+			if t, err = heap.rotateRight(t); err != nil {
+				return nil, err
+			}
+		}
+	} else if t, err = heap.joinRight(c, right); err != nil {
+		return nil, err
+	}
+	if t.depth <= l.depth+1 {
+		return newRopeNode(l, t), nil
+	}
+	return heap.rotateLeft(newRopeNode(l, t))
+}
+
+// joinLeft joins left to right, the deeper, along the left edge of right
+func (heap *Heap) joinLeft(left, right *ropeTree) (*ropeTree, error) {
+	c, r, ok, err := heap.children(right)
+	if err != nil || !ok {
+		return newRopeNode(left, right), err
+	}
+	var t *ropeTree
+	if c.depth <= left.depth+1 {
+		t = newRopeNode(left, c)
+		if t.depth > r.depth+1 {
+			if t, err = heap.rotateLeft(t); err != nil {
+				return nil, err
+			}
+		}
+	} else if t, err = heap.joinLeft(left, c); err != nil {
+		return nil, err
+	}
+	if t.depth <= r.depth+1 {
+		return newRopeNode(t, r), nil
+	}
+	return heap.rotateRight(newRopeNode(t, r))
+}
+
+// rotateLeft turns a(b c) into (a b)c, t unchanged if its right half
+// can't be split
+func (heap *Heap) rotateLeft(t *ropeTree) (*ropeTree, error) {
+	b, c, ok, err := heap.children(t.right)
+	if err != nil || !ok {
+		return t, err
+	}
+	return newRopeNode(newRopeNode(t.left, b), c), nil
+}
+
+// rotateRight turns (a b)c into a(b c), t unchanged if its left half can't
+// be split
+func (heap *Heap) rotateRight(t *ropeTree) (*ropeTree, error) {
+	a, b, ok, err := heap.children(t.left)
+	if err != nil || !ok {
+		return t, err
+	}
+	return newRopeNode(a, newRopeNode(b, t.right)), nil
+}
+
+// allocateRopes allocates the new nodes of t, children first, and appends
+// their addresses to created
+func (heap *Heap) allocateRopes(t *ropeTree, created *[]uintptr) (uintptr, error) {
+	if t.ptr != 0 {
+		return t.ptr, nil
+	}
+	left, err := heap.allocateRopes(t.left, created)
+	if err != nil {
+		return 0, err
+	}
+	right, err := heap.allocateRopes(t.right, created)
+	if err != nil {
+		return 0, err
+	}
+	ptr, err := heap.Allocate(ropeSize)
+	if err != nil {
+		return 0, err
+	}
+	mem := heap.Memory[ptr]
+	mem[0] = ropeTag
+	storeRope(mem, ropeNode{left: left, right: right, length: t.length, depth: t.depth})
+	heap.share(left)
+	heap.share(right)
+	t.ptr = ptr
+	*created = append(*created, ptr)
+	return ptr, nil
+}
+
+// flatten copies the contents of the rope at ptr into a new plain string
+func (heap *Heap) flatten(ptr uintptr) (uintptr, error) {
+	node := heap.loadRope(ptr)
+	flat, data, err := heap.allocateStringBlock(node.length)
+	if err != nil {
+		return 0, err
+	}
+	n, err := heap.copyString(data, ptr, node.depth+1)
+	if err == nil && n != int(node.length) {
+		err = fmt.Errorf("%w: rope of %d bytes holds %d", ErrOutOfBounds, node.length, n)
+	}
+	if err != nil {
+		heap.Free(flat)
+		return 0, err
+	}
+	return flat, nil
+}
+
+// copyString copies the contents of the string, view or rope at ptr into
+// dst and returns the number of bytes copied. A rope must be shallower
+// than parentDepth: children are created before their parents, so a
+// deeper one is a block reused after the child was freed, and following
+// it could loop.
+func (heap *Heap) copyString(dst []byte, ptr uintptr, parentDepth int32) (int, error) {
+	mem, exists := heap.Memory[ptr]
+	if !exists {
+		return 0, heap.invalidAddress(ptr)
+	}
+	if mem[0] == ropeTag {
+		node := heap.loadRope(ptr)
+		if node.depth >= parentDepth {
+			return 0, fmt.Errorf("%w: rope of depth %d inside a rope of depth %d", ErrTypeMismatch, node.depth, parentDepth)
+		}
+		if node.flat == 0 {
+			n, err := heap.copyString(dst, node.left, node.depth)
+			if err != nil {
+				return 0, err
+			}
+			m, err := heap.copyString(dst[n:], node.right, node.depth)
+			if err != nil {
+				return 0, err
+			}
+			return n + m, nil
+		}
+		ptr = node.flat
+	}
+	data, err := heap.stringBytes(ptr)
+	if err != nil {
+		return 0, err
+	}
+	if len(data) > len(dst) {
+		return 0, fmt.Errorf("%w: string of %d bytes copied into %d", ErrOutOfBounds, len(data), len(dst))
+	}
+	return copy(dst, data), nil
+}
+
+// allocateStringBlock allocates a plain string of length bytes and
+// returns its address and contents to fill in
+func (heap *Heap) allocateStringBlock(length int32) (uintptr, []byte, error) {
+	ptr, err := heap.Allocate(uintptr(5 + int(length)))
+	if err != nil {
+		return 0, nil, err
+	}
+	mem := heap.Memory[ptr]
+	mem[0] = byte(ValueString)
+	putInt32(mem[1:], length)
+	return ptr, mem[5 : 5+length], nil
+}
+
+func (heap *Heap) releaseRope(ptr uintptr) {
+	node := heap.loadRope(ptr)
+	heap.unshare(node.left)
+	heap.unshare(node.right)
+	if node.flat != 0 {
+		heap.Free(node.flat)
+	}
+}
+
+// AllocateStringView creates a string that shares length bytes at offset
+// of the string at ptr instead of copying them. A view of a view points
+// into the underlying string, a view of a rope into its flattened
+// contents. Freeing that string invalidates its views.
+func (heap *Heap) AllocateStringView(ptr uintptr, offset, length int32) (uintptr, error) {
+	data, err := heap.stringBytes(ptr)
+	if err != nil {
+		return 0, err
+	}
+	if offset < 0 || length < 0 || int(offset)+int(length) > len(data) {
+		return 0, fmt.Errorf("%w: view of %d bytes at %d into a string of %d", ErrOutOfBounds, length, offset, len(data))
+	}
+	base := ptr
+	switch heap.Memory[ptr][0] {
+	case stringViewTag:
+		outer := heap.loadView(ptr)
+		base = outer.base
+		offset += outer.offset
+	case ropeTag:
+		base = heap.loadRope(ptr).flat
+	}
+	viewPtr, err := heap.Allocate(viewSize)
+	if err != nil {
+		return 0, err
+	}
+	mem := heap.Memory[viewPtr]
+	mem[0] = stringViewTag
+	storeView(mem, stringView{base: base, offset: offset, length: length})
+	heap.share(base)
+	return viewPtr, nil
+}
+
+// IsStringView reports whether ptr is the address of a string view.
+func (heap *Heap) IsStringView(ptr uintptr) bool {
+	mem, exists := heap.Memory[ptr]
+	return exists && mem[0] == stringViewTag
+}
+
+// IsRope reports whether ptr is the address of a rope.
+func (heap *Heap) IsRope(ptr uintptr) bool {
+	mem, exists := heap.Memory[ptr]
+	return exists && mem[0] == ropeTag
+}
+
+func (heap *Heap) releaseView(ptr uintptr) {
+	heap.unshare(heap.loadView(ptr).base)
+}
+
+func (heap *Heap) share(ptr uintptr) {
+	if heap.shared == nil {
+		heap.shared = make(map[uintptr]int)
+	}
+	heap.shared[ptr]++
+}
+
+func (heap *Heap) unshare(ptr uintptr) {
+	if heap.shared[ptr]--; heap.shared[ptr] <= 0 {
+		delete(heap.shared, ptr)
+	}
+}
+
+// SetStringByte writes b at index of the string at ptr and returns the
+// address of the written string. Views, ropes and strings referenced by
+// either are copied first so the write is not seen through other
+// references: the returned address then differs from ptr.
+func (heap *Heap) SetStringByte(ptr uintptr, index int32, b byte) (uintptr, error) {
+	data, err := heap.stringBytes(ptr)
+	if err != nil {
+		return 0, err
+	}
+	if index < 0 || int(index) >= len(data) {
+		return 0, fmt.Errorf("%w: index %d of a string of length %d", ErrOutOfBounds, index, len(data))
+	}
+	if heap.Memory[ptr][0] != byte(ValueString) || heap.shared[ptr] > 0 {
+		if ptr, err = heap.AllocateString(string(data)); err != nil {
+			return 0, err
+		}
+	}
+	heap.Memory[ptr][5+index] = b
+	return ptr, nil
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/AndreiAlbert/gvm/common"
+	"github.com/AndreiAlbert/gvm/heap"
+	"github.com/AndreiAlbert/gvm/vm"
+)
+
+const heapdumpHelp = `Commands:
+  list [type]      list the allocations, of one type if given (Point,
+                   string, int32[], closure, block)
+  show <ref>       print the object at a reference
+  slots <ref>      list the values the object holds
+  refs <ref>       list the slots pointing at the object
+  roots            list the pointers held by the locals and stacks
+  find <value>     search the slots for an int32 (42), a float32 (1.5) or
+                   a pointer (&4096), and the strings for "text"
+  quit, q          leave
+
+A reference is an address followed by the path of a slot to follow:
+4096.next.label, 8192[3], 12288* for the value of a block from alloc.`
+
+// maxListPreview is how much of an object list prints
+const maxListPreview = 60
+
+func heapdumpCommand(args []string) {
+	fs := flag.NewFlagSet("heapdump", flag.ExitOnError)
+	noCache := fs.Bool("no-cache", false, "always assemble, bypassing the build cache")
+	fs.Parse(args)
+	if fs.NArg() < 1 || fs.NArg() > 2 {
+		log.Fatal("usage: gvm heapdump [-no-cache] <dump> [file.asm|file.gvmbc]")
+	}
+	core := readCoreFile(fs.Arg(0))
+	file := fs.Arg(1)
+	if file == "" {
+		file = core.Program
+	}
+	if file == "" {
+		log.Fatal("the crash dump doesn't name its program, pass it after the dump")
+	}
+	// the program declares the struct types the heap is decoded with
+	program := loadProgram(file, !*noCache)
+	defer program.Close()
+	machine, err := vm.NewVmFromCore(program, core, vm.Options{})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer machine.Close()
+	s := &heapSession{machine: machine, heap: machine.Heap, out: os.Stdout}
+	fmt.Fprintf(s.out, "heap of %s: %d objects, %d bytes. Type help for the commands\n", core.Program, len(s.heap.Objects()), s.heap.Allocated())
+	s.loop(os.Stdin)
+}
+
+// heapSession is an interactive inspection of the heap of a crash dump
+type heapSession struct {
+	machine *vm.VM
+	heap    *heap.Heap
+	out     io.Writer
+}
+
+// loop reads commands from in until quit or the end of the input
+func (s *heapSession) loop(in io.Reader) {
+	scanner := bufio.NewScanner(in)
+	for {
+		fmt.Fprint(s.out, "heap> ")
+		if !scanner.Scan() {
+			fmt.Fprintln(s.out)
+			return
+		}
+		words := strings.Fields(scanner.Text())
+		if len(words) == 0 {
+			continue
+		}
+		// the text searched for may contain spaces
+		rest := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(scanner.Text()), words[0]))
+		if err := s.command(words[0], words[1:], rest); err == errQuit {
+			return
+		} else if err != nil {
+			fmt.Fprintln(s.out, err)
+		}
+	}
+}
+
+func (s *heapSession) command(command string, args []string, rest string) error {
+	h, out := s.heap, s.out
+	switch command {
+	case "help", "h":
+		fmt.Fprintln(out, heapdumpHelp)
+	case "quit", "q":
+		return errQuit
+	case "list", "ls":
+		objects, bytes := 0, 0
+		for _, object := range h.Objects() {
+			if len(args) > 0 && object.Type != args[0] {
+				continue
+			}
+			preview := h.Format(common.PtrValue(object.Address), common.FloatFormat{})
+			if len(preview) > maxListPreview {
+				preview = preview[:maxListPreview-3] + "..."
+			}
+			if site, ok := h.AllocationSite(object.Address); ok {
+				preview += "  @ " + site.String()
+			}
+			fmt.Fprintf(out, "%8d %6d %-10s %s\n", object.Address, object.Size, object.Type, preview)
+			objects++
+			bytes += object.Size
+		}
+		fmt.Fprintf(out, "%d objects, %d bytes\n", objects, bytes)
+	case "show", "p":
+		value, err := s.resolve(args)
+		if err != nil {
+			return err
+		}
+		if isPointer(value) && value.Ptr() != 0 {
+			if _, ok := h.ObjectAt(value.Ptr()); !ok {
+				if object, offset, ok := h.Containing(value.Ptr()); ok {
+					fmt.Fprintf(out, "%d is %d bytes into the %s at %d\n", value.Ptr(), offset, object.Type, object.Address)
+					return nil
+				}
+			}
+		}
+		fmt.Fprintln(out, h.Format(value, common.FloatFormat{}))
+		if site, ok := h.AllocationSite(value.Ptr()); ok && isPointer(value) {
+			fmt.Fprintf(out, "allocated at %v\n", site)
+		}
+	case "slots":
+		ptr, err := s.resolveObject(args)
+		if err != nil {
+			return err
+		}
+		slots, err := h.Slots(ptr)
+		if err != nil {
+			return err
+		}
+		for _, slot := range slots {
+			fmt.Fprintf(out, "  %-10s %s\n", slot.Path, s.describe(slot.Value))
+		}
+	case "refs":
+		ptr, err := s.resolveObject(args)
+		if err != nil {
+			return err
+		}
+		s.printSlots(h.Find(func(value common.Value) bool { return isPointer(value) && value.Ptr() == ptr }))
+		for _, root := range s.roots() {
+			if root.value.Ptr() == ptr {
+				fmt.Fprintf(out, "  %s\n", root.name)
+			}
+		}
+	case "roots":
+		for _, root := range s.roots() {
+			fmt.Fprintf(out, "  %-18s %s\n", root.name, s.describe(root.value))
+		}
+	case "find":
+		if rest == "" {
+			return errors.New("find needs a value")
+		}
+		if text, err := strconv.Unquote(rest); err == nil {
+			for _, ptr := range h.FindString(text) {
+				fmt.Fprintf(out, "  %d %s\n", ptr, s.describe(common.PtrValue(ptr)))
+			}
+			return nil
+		}
+		match, err := parseHeapValue(rest)
+		if err != nil {
+			return err
+		}
+		s.printSlots(h.Find(match))
+	default:
+		return fmt.Errorf("unknown command %s, type help for the commands", command)
+	}
+	return nil
+}
+
+// heapRoot is a pointer held outside of the heap: by a local or the operand
+// stack of a frame
+type heapRoot struct {
+	name  string
+	value common.Value
+}
+
+// roots returns the pointers held by the frames, outermost first
+func (s *heapSession) roots() []heapRoot {
+	var roots []heapRoot
+	for i, frame := range s.machine.CallStack {
+		indexes := make([]uint32, 0, len(frame.Locals))
+		for index := range frame.Locals {
+			indexes = append(indexes, index)
+		}
+		sort.Slice(indexes, func(a, b int) bool { return indexes[a] < indexes[b] })
+		for _, index := range indexes {
+			if value := frame.Locals[index]; isPointer(value) {
+				roots = append(roots, heapRoot{fmt.Sprintf("frame%d.local%d", i, index), value})
+			}
+		}
+		for j, value := range frame.LocalStack {
+			if isPointer(value) {
+				roots = append(roots, heapRoot{fmt.Sprintf("frame%d.stack%d", i, len(frame.LocalStack)-1-j), value})
+			}
+		}
+	}
+	return roots
+}
+
+func (s *heapSession) printSlots(slots []heap.Slot) {
+	for _, slot := range slots {
+		fmt.Fprintf(s.out, "  %d%s %s\n", slot.Object, slot.Path, s.describe(slot.Value))
+	}
+}
+
+// describe formats a value briefly: scalars as kind:value, pointers as the
+// type of the object they point to
+func (s *heapSession) describe(value common.Value) string {
+	if !isPointer(value) {
+		return fmt.Sprintf("%v:%v", value.Kind(), value)
+	}
+	if value.Ptr() == 0 {
+		return "nil"
+	}
+	if object, ok := s.heap.ObjectAt(value.Ptr()); ok {
+		return fmt.Sprintf("&%d %s", object.Address, object.Type)
+	}
+	return fmt.Sprintf("ptr(%d)", value.Ptr())
+}
+
+// resolve evaluates a reference: an address and a path of slots followed
+// from it
+func (s *heapSession) resolve(args []string) (common.Value, error) {
+	if len(args) != 1 {
+		return common.Value{}, errors.New("expected a reference such as 4096.next")
+	}
+	ref := args[0]
+	end := strings.IndexAny(ref, ".[*")
+	if end < 0 {
+		end = len(ref)
+	}
+	address, err := strconv.ParseUint(ref[:end], 10, 64)
+	if err != nil {
+		return common.Value{}, fmt.Errorf("%s doesn't start with an address", ref)
+	}
+	value := common.PtrValue(uintptr(address))
+	for path := ref[end:]; path != ""; {
+		next := strings.IndexAny(path[1:], ".[*") + 1
+		if next == 0 {
+			next = len(path)
+		}
+		segment := path[:next]
+		path = path[next:]
+		if !isPointer(value) {
+			return common.Value{}, fmt.Errorf("%s: %v isn't a pointer", segment, value.Kind())
+		}
+		slots, err := s.heap.Slots(value.Ptr())
+		if err != nil {
+			return common.Value{}, err
+		}
+		found := false
+		for _, slot := range slots {
+			if slot.Path == segment {
+				value, found = slot.Value, true
+				break
+			}
+		}
+		if !found {
+			return common.Value{}, fmt.Errorf("the object at %d has no slot %s", value.Ptr(), segment)
+		}
+	}
+	return value, nil
+}
+
+// resolveObject is resolve for references that must be live objects
+func (s *heapSession) resolveObject(args []string) (uintptr, error) {
+	value, err := s.resolve(args)
+	if err != nil {
+		return 0, err
+	}
+	if _, ok := s.heap.ObjectAt(value.Ptr()); !isPointer(value) || !ok {
+		return 0, fmt.Errorf("%s is not the address of an object", s.describe(value))
+	}
+	return value.Ptr(), nil
+}
+
+// parseHeapValue parses the value searched for by find: &address for
+// pointers, an int32 or a float32
+func parseHeapValue(text string) (func(common.Value) bool, error) {
+	if strings.HasPrefix(text, "&") {
+		address, err := strconv.ParseUint(text[1:], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address %s", text[1:])
+		}
+		return func(value common.Value) bool { return isPointer(value) && value.Ptr() == uintptr(address) }, nil
+	}
+	if n, err := strconv.ParseInt(text, 10, 32); err == nil {
+		return func(value common.Value) bool {
+			return value.Kind() == common.ValueInt32 && value.AsInt32() == int32(n)
+		}, nil
+	}
+	if f, err := strconv.ParseFloat(text, 32); err == nil {
+		return func(value common.Value) bool {
+			return value.Kind() == common.ValueFloat32 && value.AsFloat32() == float32(f)
+		}, nil
+	}
+	return nil, fmt.Errorf("can't search for %s: expected a number, &address or \"text\"", text)
+}
+
+// isPointer reports whether value refers to the heap
+func isPointer(value common.Value) bool {
+	switch value.Kind() {
+	case common.ValuePtr, common.ValueString, common.ValueArray, common.ValueStruct:
+		return true
+	}
+	return false
+}
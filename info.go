@@ -0,0 +1,213 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/AndreiAlbert/gvm/bytecode"
+	"github.com/AndreiAlbert/gvm/common"
+	"github.com/AndreiAlbert/gvm/vm"
+)
+
+// maxInfoConstants is how many entries of the constant pool gvm info lists
+const maxInfoConstants = 16
+
+func infoCommand(args []string) {
+	fs := flag.NewFlagSet("info", flag.ExitOnError)
+	noCache := fs.Bool("no-cache", false, "always assemble, bypassing the build cache")
+	keyFile := fs.String("key", "", "unseal the container with the key in this file")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		log.Fatal("usage: gvm info [-no-cache] [-key file] <file.gvmbc|file.asm>")
+	}
+	file := fs.Arg(0)
+	var data []byte
+	if strings.HasSuffix(file, ".gvmbc") {
+		var err error
+		if data, err = os.ReadFile(file); err != nil {
+			log.Fatal(err)
+		}
+		if *keyFile != "" {
+			if data, err = bytecode.Unseal(data, readKey(*keyFile)); err != nil {
+				log.Fatalf("failed to unseal %s: %v", file, err)
+			}
+		}
+	} else {
+		// a source is described as the container gvm asm would write
+		program := loadProgram(file, !*noCache)
+		var err error
+		data, err = bytecode.EncodeBytes(program)
+		program.Close()
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if err := writeInfo(os.Stdout, file, data); err != nil {
+		log.Fatalf("%s: %v", file, err)
+	}
+}
+
+// writeInfo describes the container in data: its header and sections, then
+// the tables decoded from them
+func writeInfo(out io.Writer, file string, data []byte) error {
+	version, sections, err := bytecode.Sections(data)
+	if err != nil {
+		return err
+	}
+	program, err := bytecode.Decode(data)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "%s: container version %d, %d bytes, %d sections\n", file, version, len(data), len(sections))
+	if info := program.BuildInfo; info != nil {
+		fmt.Fprintf(out, "toolchain: %s\n", info.Toolchain)
+		fmt.Fprintf(out, "source:    sha256:%x\n", info.SourceHash)
+		if info.Built.IsZero() {
+			fmt.Fprintln(out, "built:     not recorded")
+		} else {
+			fmt.Fprintf(out, "built:     %s\n", info.Built.Local().Format("2006-01-02 15:04:05 MST"))
+		}
+	} else {
+		fmt.Fprintln(out, "no build info: the container predates it")
+	}
+
+	fmt.Fprintln(out, "\nsections:")
+	for _, section := range sections {
+		fmt.Fprintf(out, "  %-11s offset %8d  size %8d", section.Kind, section.Offset, section.Size)
+		if version >= bytecode.ChecksumVersion {
+			fmt.Fprintf(out, "  crc %08x", section.CRC)
+		}
+		fmt.Fprintln(out)
+	}
+
+	fmt.Fprintf(out, "\nfunctions: %d\n", len(program.Functions))
+	fmt.Fprintf(out, "  %3s  %-8s  %6s  %6s  %-12s  %5s  %6s  %s\n", "#", "address", "size", "params", "returns", "stack", "locals", "name")
+	for i, f := range program.Functions {
+		returns := f.ReturnType.String()
+		if f.ReturnType == common.ValueStruct {
+			returns = f.ReturnStructName
+		}
+		name := f.Name
+		if f.IsMain {
+			name += " (entry)"
+		}
+		// a MaxStack of 0 is unknown: not recorded or not computable
+		stack := "?"
+		if f.MaxStack > 0 {
+			stack = fmt.Sprint(f.MaxStack)
+		}
+		fmt.Fprintf(out, "  %3d  %08x  %6d  %6d  %-12s  %5s  %6d  %s\n", i, f.Address, functionSize(program, i), f.ParamCount, returns, stack, f.MaxLocals, name)
+	}
+
+	if err := writeStructLayouts(out, program); err != nil {
+		return err
+	}
+
+	if len(program.Enums) > 0 {
+		fmt.Fprintf(out, "\nenums: %d\n", len(program.Enums))
+		for _, enum := range program.Enums {
+			members := make([]string, len(enum.Members))
+			for i, member := range enum.Members {
+				members[i] = fmt.Sprintf("%s=%d", member.Name, member.Value)
+			}
+			fmt.Fprintf(out, "  %s { %s }, used by %d instructions\n", enum.Name, strings.Join(members, " "), len(enum.Constants))
+		}
+	}
+
+	if len(program.Natives) > 0 {
+		fmt.Fprintf(out, "\nnatives: %d\n", len(program.Natives))
+		for i, native := range program.Natives {
+			fmt.Fprintf(out, "  %3d  %s\n", i, native.Signature())
+		}
+	}
+
+	fmt.Fprintf(out, "\nconstant pool: %d entries\n", len(program.Constants))
+	for i, constant := range program.Constants {
+		if i == maxInfoConstants {
+			fmt.Fprintf(out, "  ... %d more\n", len(program.Constants)-maxInfoConstants)
+			break
+		}
+		fmt.Fprintf(out, "  %3d  %08x  int32 %d  float32 %g\n", i, constant, int32(constant), math.Float32frombits(constant))
+	}
+	fmt.Fprintf(out, "\ncode: %d bytes, %d source map entries, %d labels\n", len(program.Code), len(program.Lines), len(program.Labels))
+	return nil
+}
+
+// functionSize is the size of the body of function i: the distance to the
+// next function in the code, or to its end
+func functionSize(program *bytecode.Program, i int) int {
+	start := program.Functions[i].Address
+	end := uint32(len(program.Code))
+	for _, f := range program.Functions {
+		if f.Address > start && f.Address < end {
+			end = f.Address
+		}
+	}
+	return int(end - start)
+}
+
+// writeStructLayouts lists the structs with the offsets and field ids the
+// VM lays them out with when it loads the program
+// unavailableNatives registers a native failing when called for each native
+// the program declares, so that it loads without the host that provides them
+func unavailableNatives(program *bytecode.Program) map[string]vm.Native {
+	natives := make(map[string]vm.Native)
+	for _, declared := range program.Natives {
+		natives[declared.Name] = vm.Native{
+			Params:  declared.Params,
+			Returns: declared.ReturnType,
+			Func: func(*vm.VM, []common.Value) (common.Value, error) {
+				return common.Value{}, fmt.Errorf("native %s is not available", declared.Name)
+			},
+		}
+	}
+	return natives
+}
+
+func writeStructLayouts(out io.Writer, program *bytecode.Program) error {
+	fmt.Fprintf(out, "\nstructs: %d\n", len(program.Structs))
+	if len(program.Structs) == 0 {
+		return nil
+	}
+	machine, err := vm.NewVmFromProgram(program, vm.Options{Stdin: strings.NewReader(""), Stdout: io.Discard, Natives: unavailableNatives(program)})
+	if err != nil {
+		return err
+	}
+	defer machine.Close()
+	enumFields := make(map[string]string)
+	for _, enum := range program.Enums {
+		for _, field := range enum.Fields {
+			enumFields[field] = enum.Name
+		}
+	}
+	loaded := machine.Program()
+	for _, declared := range program.Structs {
+		structType, _ := loaded.Struct(declared.Name)
+		fmt.Fprintf(out, "  %s, %d bytes\n", structType.Name, structType.Size)
+		for _, field := range structType.Fields {
+			fieldType := field.Type.String()
+			switch {
+			case field.Type == common.ValueArray && field.ArrayType != nil:
+				fieldType = field.ArrayType.String() + "[]"
+			case enumFields[structType.Name+"."+field.Name] != "":
+				fieldType = enumFields[structType.Name+"."+field.Name]
+			}
+			fmt.Fprintf(out, "    +%-3d %-12s %-10s id %d\n", field.Offset, field.Name, fieldType, field.ID)
+		}
+		if len(structType.Methods) > 0 {
+			methods := make([]string, 0, len(structType.Methods))
+			for name := range structType.Methods {
+				methods = append(methods, name)
+			}
+			sort.Strings(methods)
+			fmt.Fprintf(out, "    methods: %s\n", strings.Join(methods, ", "))
+		}
+	}
+	return nil
+}
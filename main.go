@@ -2,13 +2,29 @@ package main
 
 import (
 	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
 	"log"
+	"log/slog"
 	"math"
+	"net/http"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
-	"stack_vm/assembler"
-	"stack_vm/vm"
+	"github.com/AndreiAlbert/gvm/asm"
+	"github.com/AndreiAlbert/gvm/buildcache"
+	"github.com/AndreiAlbert/gvm/bytecode"
+	"github.com/AndreiAlbert/gvm/common"
+	"github.com/AndreiAlbert/gvm/playground"
+	"github.com/AndreiAlbert/gvm/service"
+	"github.com/AndreiAlbert/gvm/vm"
 )
 
 func to32bits(f float32) [4]byte {
@@ -17,7 +33,15 @@ func to32bits(f float32) [4]byte {
 	return buffer
 }
 
-func runFile(filename string) {
+// readSource reads the source in filename, or stdin for -
+func readSource(filename string) []byte {
+	if filename == "-" {
+		content, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			log.Fatalf("Failed to read stdin: %v", err)
+		}
+		return content
+	}
 	absPath, err := filepath.Abs(filename)
 	if err != nil {
 		log.Fatalf("Failed to get absolute path: %v", err)
@@ -26,24 +50,565 @@ func runFile(filename string) {
 	if err != nil {
 		log.Fatalf("Failed to read file: %v", err)
 	}
-	lexer := assembler.NewLexer(string(content))
-	parser := assembler.NewParser(lexer)
-	prog, err := parser.Parse()
+	return content
+}
+
+// newAssembler creates an assembler for the source read from filename,
+// resolving its imports next to the file
+func newAssembler(content []byte, filename string) *asm.Assembler {
+	assembler := asm.NewAssembler(string(content))
+	assembler.SetImporter(fileImporter(sourceDir(filename)))
+	return assembler
+}
+
+// sourceDir is the directory the imports of filename resolve in, the
+// working directory for stdin
+func sourceDir(filename string) string {
+	if filename == "-" {
+		return "."
+	}
+	return filepath.Dir(filename)
+}
+
+func assembleSource(content []byte, filename string) *bytecode.Program {
+	program, err := newAssembler(content, filename).Assemble()
+	if err != nil {
+		log.Fatalf("Failed to assemble program: %v", err)
+	}
+	return program
+}
+
+func assembleFile(filename string) *bytecode.Program {
+	return assembleSource(readSource(filename), filename)
+}
+
+// assembleCached looks the source up in the build cache and only assembles
+// it on a miss. Cache failures are not fatal, they just cost a re-assembly.
+func assembleCached(filename string) *bytecode.Program {
+	content := readSource(filename)
+	dir, err := buildcache.DefaultDir()
+	if err != nil {
+		return assembleSource(content, filename)
+	}
+	cache, err := buildcache.Open(dir)
+	if err != nil {
+		return assembleSource(content, filename)
+	}
+	// editing an imported library invalidates the programs importing it
+	key := buildcache.Key(append([][]byte{content}, importedSources(sourceDir(filename), content)...)...)
+	if program, ok := cache.Get(key); ok {
+		return program
+	}
+	program := assembleSource(content, filename)
+	if err := cache.Put(key, program); err != nil {
+		log.Printf("Failed to update build cache: %v", err)
+	}
+	return program
+}
+
+// loadProgram assembles .asm sources and memory maps compiled containers.
+func loadProgram(filename string, useCache bool) *bytecode.Program {
+	if strings.HasSuffix(filename, ".gvmbc") {
+		program, err := bytecode.Open(filename)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return program
+	}
+	if useCache {
+		return assembleCached(filename)
+	}
+	return assembleFile(filename)
+}
+
+// runReports are the reports written by runFile once the program stops,
+// whether it failed or not
+type runReports struct {
+	// usage receives the resource usage report
+	usage io.Writer
+	// heap receives the size classes and fragmentation of the heap
+	heap io.Writer
+	// profile is the pprof output file, opts.Profile must be set
+	profile string
+	// flamegraph is the folded stacks output file, opts.Profile must be
+	// set
+	flamegraph       string
+	flamegraphWeight vm.ProfileWeight
+	// core is the crash dump written when a runtime error stops the
+	// program
+	core string
+	// calls receives the call counts of a program instrumented with
+	// asm.InstrumentCalls
+	calls io.Writer
+}
+
+func runFile(filename string, useCache bool, opts vm.Options, reports runReports) {
+	runProgram(filename, loadProgram(filename, useCache), opts, reports)
+}
+
+// loadInstrumented assembles the source in filename with pass, bypassing
+// the build cache
+func loadInstrumented(filename string, pass asm.Pass) *bytecode.Program {
+	if strings.HasSuffix(filename, ".gvmbc") {
+		log.Fatal("instrumenting a program needs its .asm source")
+	}
+	assembler := newAssembler(readSource(filename), filename)
+	assembler.AddPass(pass)
+	program, err := assembler.Assemble()
+	if err != nil {
+		log.Fatalf("Failed to assemble program: %v", err)
+	}
+	return program
+}
+
+// loadSealed loads the sealed container in filename, unsealing it with key
+func loadSealed(filename string, key []byte) *bytecode.Program {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		log.Fatal(err)
+	}
+	program, err := bytecode.DecodeSealed(data, key)
+	if err != nil {
+		log.Fatalf("failed to load %s: %v", filename, err)
+	}
+	return program
+}
+
+// readKey reads a sealing key stored as hex digits
+func readKey(path string) []byte {
+	text, err := os.ReadFile(path)
+	if err != nil {
+		log.Fatalf("Failed to read key: %v", err)
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(text)))
+	if err != nil || len(key) != bytecode.KeySize {
+		log.Fatalf("%s must hold a key of %d hex digits", path, 2*bytecode.KeySize)
+	}
+	return key
+}
+
+// runProgram runs program, loaded from filename, and writes the reports
+func runProgram(filename string, program *bytecode.Program, opts vm.Options, reports runReports) {
+	defer program.Close()
+	machine, err := vm.NewVmFromProgram(program, opts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer machine.Close()
+	err = machine.Run()
+	if reports.usage != nil {
+		machine.Usage().WriteReport(reports.usage)
+	}
+	if reports.heap != nil {
+		machine.Heap.WriteReport(reports.heap)
+	}
+	if reports.calls != nil {
+		writeCallCounts(reports.calls, machine)
+	}
+	if reports.profile != "" {
+		writeReport(reports.profile, func(w io.Writer) error {
+			return machine.WriteProfile(w, filename)
+		})
+	}
+	if reports.flamegraph != "" {
+		writeReport(reports.flamegraph, func(w io.Writer) error {
+			return machine.WriteFoldedStacks(w, reports.flamegraphWeight)
+		})
+	}
+	if err != nil && reports.core != "" {
+		writeReport(reports.core, func(w io.Writer) error {
+			_, err := machine.Core(filename, err).WriteTo(w)
+			return err
+		})
+		log.Printf("crash dump written to %s, open it with gvm debug -core %s", reports.core, reports.core)
+	}
+	if err != nil {
+		log.Print(err)
+		// uncaught guest errors also show where they were thrown
+		var guestErr *vm.GuestError
+		if errors.As(err, &guestErr) {
+			for _, name := range guestErr.Backtrace {
+				fmt.Fprintf(os.Stderr, "\tat %s\n", name)
+			}
+		}
+		os.Exit(1)
+	}
+}
+
+func runCommand(args []string) {
+	fs := flag.NewFlagSet("run", flag.ExitOnError)
+	noCache := fs.Bool("no-cache", false, "always assemble, bypassing the build cache")
+	trace := fs.Bool("trace", false, "write an instruction trace to stderr")
+	maxInstructions := fs.Uint64("max-instructions", 0, "stop after this many instructions (0: no limit)")
+	softInstructions := fs.Uint64("soft-instructions", 0, "call the on_soft_limit handler of the program after this many instructions (0: no soft limit)")
+	audit := fs.String("audit", "", "append a JSON line per system call to this file, - for stderr")
+	usage := fs.Bool("usage", false, "print a resource usage report to stderr after the run")
+	heapReport := fs.Bool("heap-report", false, "print the heap blocks by size class and the fragmentation estimate to stderr after the run")
+	allocSites := fs.Bool("alloc-sites", false, "record where every heap block is allocated and freed, for the heap report, crash dumps and errors")
+	gc := fs.Bool("gc", false, "collect the heap blocks the program can no longer reach and compact the heap")
+	gcYoung := fs.Uint64("gc-young", 0, "with -gc, bytes allocated between two minor collections (0: 1 MiB)")
+	gcGrowth := fs.Float64("gc-growth", 0, "with -gc, factor the young generation grows by when most of it survives (0: 2)")
+	gcPercent := fs.Int("gc-percent", 0, "with -gc, percent the live heap grows by before a full collection (0: 100, negative: only on gc_hint)")
+	gcConcurrent := fs.Bool("gc-concurrent", false, "with -gc, mark the heap for full collections while the program runs")
+	profile := fs.String("profile", "", "write a pprof profile of the guest program to this file")
+	flamegraph := fs.String("flamegraph", "", "write folded call stacks for flamegraph tools to this file")
+	flamegraphWeight := fs.String("flamegraph-weight", "instructions", "weight of folded stacks: instructions or time")
+	core := fs.String("core", "", "write a crash dump to this file if a runtime error stops the program")
+	floatFormat := fs.String("float-format", "", "format of printed floats: g, e or f with an optional precision, e.g. f2 (default: shortest round-trip)")
+	stdin := fs.String("stdin", "", "read the program's input from this file instead of the terminal")
+	env := envFlag{}
+	fs.Var(env, "env", "set a variable read by GET_ENV, as KEY=VALUE; may be repeated")
+	mapRoot := fs.String("map-root", "", "let mmap_file map the files under this directory; mapping is disabled without it")
+	clock := fs.Bool("clock", false, "let time_now_struct read the system clock; the program sees the Unix epoch without it")
+	deterministic := fs.Bool("deterministic", false, "refuse -clock, -env and -map-root, so the output depends only on the program, its arguments and its input")
+	keyFile := fs.String("key", "", "unseal the container with the key in this file, 64 hex digits")
+	trapFloatDiv := fs.Bool("trap-float-div", false, "make fdiv by zero an error instead of giving an infinity or NaN")
+	oob := fs.String("oob", "trap", "what ldelem reads out of bounds: trap, clamp to the first or last element, or default to a zero value")
+	logLevel := fs.String("log-level", "info", "lowest level of the LOG_* records written to stderr: debug, info, warn or error")
+	instrument := fs.String("instrument", "", "instrument the program before running it: calls counts the calls of every function and reports them to stderr")
+	fs.Parse(args)
+	if fs.NArg() < 1 {
+		log.Fatal("usage: gvm run [-no-cache] [-trace] [-usage] [-heap-report] [-alloc-sites] [-gc] [-gc-young bytes] [-gc-growth factor] [-gc-percent n] [-gc-concurrent] [-profile file] [-flamegraph file] [-max-instructions n] [-soft-instructions n] [-audit file] [-float-format spec] [-trap-float-div] [-oob policy] [-core file] [-stdin file] [-env KEY=VALUE] [-map-root dir] [-clock] [-deterministic] [-log-level level] [-instrument calls] [-key file] <file.asm|file.gvmbc> [args...]")
+	}
+	opts := vm.Options{Args: fs.Args()[1:], MaxInstructions: *maxInstructions, SoftInstructions: *softInstructions, Profile: *profile != "" || *flamegraph != "", Env: env, MapRoot: *mapRoot, TrapFloatDivision: *trapFloatDiv, AllocationSites: *allocSites, GC: *gc, GCYoungBytes: uintptr(*gcYoung), GCGrowth: *gcGrowth, GCPercent: *gcPercent, GCConcurrent: *gcConcurrent, Deterministic: *deterministic}
+	if *clock {
+		opts.Clock = time.Now
+	}
+	if *stdin != "" {
+		f, err := os.Open(*stdin)
+		if err != nil {
+			log.Fatalf("Failed to open input: %v", err)
+		}
+		defer f.Close()
+		opts.Stdin = f
+	}
+	format, err := common.ParseFloatFormat(*floatFormat)
+	if err != nil {
+		log.Fatal(err)
+	}
+	opts.FloatFormat = format
+	if opts.OutOfBoundsReads, err = vm.ParseBoundsPolicy(*oob); err != nil {
+		log.Fatal(err)
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(*logLevel)); err != nil {
+		log.Fatalf("Invalid log level %q", *logLevel)
+	}
+	opts.Logger = slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level}))
+	if *trace {
+		opts.Trace = os.Stderr
+	}
+	if *audit != "" {
+		opts.AuditLog = openAuditLog(*audit)
+	}
+	reports := runReports{profile: *profile, flamegraph: *flamegraph, core: *core}
+	if *core != "" {
+		// the dump undoes the failing instruction, which takes the history
+		// of one
+		opts.History = 1
+	}
+	switch *flamegraphWeight {
+	case "instructions":
+		reports.flamegraphWeight = vm.WeightInstructions
+	case "time":
+		reports.flamegraphWeight = vm.WeightTime
+	default:
+		log.Fatalf("unknown flamegraph weight %q, expected instructions or time", *flamegraphWeight)
+	}
+	if *usage {
+		reports.usage = os.Stderr
+	}
+	if *heapReport {
+		reports.heap = os.Stderr
+	}
+	if *keyFile != "" {
+		runProgram(fs.Arg(0), loadSealed(fs.Arg(0), readKey(*keyFile)), opts, reports)
+		return
+	}
+	switch *instrument {
+	case "":
+	case "calls":
+		reports.calls = os.Stderr
+		runProgram(fs.Arg(0), loadInstrumented(fs.Arg(0), asm.InstrumentCalls), opts, reports)
+		return
+	default:
+		log.Fatalf("unknown instrumentation %q, expected calls", *instrument)
+	}
+	runFile(fs.Arg(0), !*noCache, opts, reports)
+}
+
+// writeReport creates path and fills it with write. Failures are logged,
+// they don't change the outcome of the run.
+func writeReport(path string, write func(io.Writer) error) {
+	f, err := os.Create(path)
+	if err != nil {
+		log.Printf("Failed to create %s: %v", path, err)
+		return
+	}
+	if err := write(f); err != nil {
+		log.Printf("Failed to write %s: %v", path, err)
+	}
+	if err := f.Close(); err != nil {
+		log.Printf("Failed to write %s: %v", path, err)
+	}
+}
+
+// writeCallCounts writes the counters of asm.InstrumentCalls as a table of
+// functions, most called first
+func writeCallCounts(w io.Writer, machine *vm.VM) {
+	counters := machine.Counters()
+	ids := make([]int32, 0, len(counters))
+	for id := range counters {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		if counters[ids[i]] != counters[ids[j]] {
+			return counters[ids[i]] > counters[ids[j]]
+		}
+		return ids[i] < ids[j]
+	})
+	fmt.Fprintf(w, "%-22s %s\n", "function", "calls")
+	program := machine.Program()
+	for _, id := range ids {
+		name := fmt.Sprintf("function %d", id)
+		if f, ok := program.Function(int(id)); ok && f.Name != "" {
+			name = f.Name
+		}
+		fmt.Fprintf(w, "%-22s %d\n", name, counters[id])
+	}
+}
+
+// envFlag collects repeated -env KEY=VALUE flags
+type envFlag map[string]string
+
+func (env envFlag) String() string {
+	pairs := make([]string, 0, len(env))
+	for key, value := range env {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (env envFlag) Set(pair string) error {
+	key, value, ok := strings.Cut(pair, "=")
+	if !ok || key == "" {
+		return fmt.Errorf("%q is not KEY=VALUE", pair)
+	}
+	env[key] = value
+	return nil
+}
+
+func serveCommand(args []string) {
+	limits := playground.DefaultLimits
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	addr := fs.String("addr", "localhost:8080", "address to listen on")
+	fs.Uint64Var(&limits.MaxInstructions, "max-instructions", limits.MaxInstructions, "instruction limit per run")
+	fs.DurationVar(&limits.Timeout, "timeout", limits.Timeout, "wall-clock limit per run")
+	maxHeap := fs.Uint64("max-heap", uint64(limits.MaxHeapBytes), "heap limit per run in bytes")
+	fs.IntVar(&limits.MaxConcurrent, "max-concurrent", limits.MaxConcurrent, "programs running at once")
+	fs.Parse(args)
+	limits.MaxHeapBytes = uintptr(*maxHeap)
+	log.Printf("Playground listening on http://%s", *addr)
+	log.Fatal(http.ListenAndServe(*addr, playground.NewServer(limits)))
+}
+
+func serviceCommand(args []string) {
+	limits := service.DefaultLimits
+	fs := flag.NewFlagSet("service", flag.ExitOnError)
+	addr := fs.String("addr", "localhost:8090", "address to listen on")
+	fs.Uint64Var(&limits.MaxInstructions, "max-instructions", limits.MaxInstructions, "instruction limit per execution")
+	fs.DurationVar(&limits.Timeout, "timeout", limits.Timeout, "wall-clock limit per execution")
+	maxHeap := fs.Uint64("max-heap", uint64(limits.MaxHeapBytes), "heap limit per execution in bytes")
+	fs.IntVar(&limits.MaxStdoutBytes, "max-stdout", limits.MaxStdoutBytes, "output limit per execution in bytes")
+	fs.IntVar(&limits.MaxConcurrent, "max-concurrent", limits.MaxConcurrent, "programs running at once")
+	audit := fs.String("audit", "", "append a JSON line per system call to this file, - for stderr")
+	gc := fs.Bool("gc", false, "collect the heap blocks the programs can no longer reach")
+	gcConcurrent := fs.Bool("gc-concurrent", false, "with -gc, mark the heap for full collections while the program runs")
+	fs.Parse(args)
+	limits.MaxHeapBytes = uintptr(*maxHeap)
+	srv := service.NewServer(limits)
+	if *audit != "" {
+		srv.SetAuditLog(openAuditLog(*audit))
+	}
+	if *gc {
+		srv.SetGC(*gcConcurrent)
+	}
+	log.Printf("Execution service listening on http://%s", *addr)
+	log.Fatal(http.ListenAndServe(*addr, srv))
+}
+
+// openAuditLog opens the syscall audit log for appending
+func openAuditLog(path string) io.Writer {
+	if path == "-" {
+		return os.Stderr
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
 	if err != nil {
-		log.Fatalf("Failed to parse progrmam: %v", err)
+		log.Fatalf("Failed to open audit log: %v", err)
+	}
+	return f
+}
+
+// outputExtensions is the default output extension of each asm -emit format
+var outputExtensions = map[string]string{
+	"gvmbc":   ".gvmbc",
+	"go":      ".go",
+	"c":       ".h",
+	"hex":     ".hex",
+	"listing": ".lst",
+}
+
+// emitProgram writes the program in one of the asm -emit formats. The go, c
+// and hex formats wrap the encoded container so hosts can embed it.
+// With a key the container is sealed first.
+func emitProgram(w io.Writer, format string, program *bytecode.Program, name, pkg string, key []byte) error {
+	if format == "listing" {
+		return vm.Disassemble(w, program)
 	}
-	generator := assembler.NewCodeGenerator(prog)
-	bytecode, err := generator.Generate()
+	data, err := bytecode.EncodeBytes(program)
 	if err != nil {
-		log.Fatalf("Failed to generate bytecode: %v", err)
+		return err
+	}
+	if key != nil {
+		if data, err = bytecode.Seal(data, key); err != nil {
+			return err
+		}
+	}
+	switch format {
+	case "gvmbc":
+		_, err = w.Write(data)
+		return err
+	case "go":
+		return bytecode.EmitGo(w, data, pkg, name)
+	case "c":
+		return bytecode.EmitC(w, data, name)
+	case "hex":
+		return bytecode.EmitHex(w, data)
+	default:
+		return fmt.Errorf("unknown output format: %s", format)
+	}
+}
+
+// buildTime is the time gvm asm records in the build info: now, or the
+// SOURCE_DATE_EPOCH of reproducible builds
+func buildTime() time.Time {
+	if epoch := os.Getenv("SOURCE_DATE_EPOCH"); epoch != "" {
+		seconds, err := strconv.ParseInt(epoch, 10, 64)
+		if err != nil {
+			log.Fatalf("invalid SOURCE_DATE_EPOCH %q", epoch)
+		}
+		return time.Unix(seconds, 0)
+	}
+	return time.Now()
+}
+
+func asmCommand(args []string) {
+	fs := flag.NewFlagSet("asm", flag.ExitOnError)
+	output := fs.String("o", "", "output file, - for stdout (default: source name with the format's extension)")
+	emit := fs.String("emit", "gvmbc", "output format: gvmbc, go, c, hex or listing")
+	name := fs.String("name", "program", "variable name for -emit=go and -emit=c")
+	pkg := fs.String("pkg", "main", "package name for -emit=go")
+	keyFile := fs.String("key", "", "seal the container with the key in this file, 64 hex digits")
+	keepUnused := fs.Bool("keep-unused", false, "keep the functions and structs of imported libraries the program doesn't reach")
+	printRemoved := fs.Bool("print-removed", false, "list the library functions and structs dropped as unreachable on stderr")
+	fs.Parse(args)
+	if fs.NArg() < 1 {
+		log.Fatal("usage: gvm asm [-emit format] [-o out] [-key file] [-keep-unused] [-print-removed] <file.asm>")
+	}
+	ext, ok := outputExtensions[*emit]
+	if !ok {
+		log.Fatalf("Unknown output format: %s", *emit)
+	}
+	var key []byte
+	if *keyFile != "" {
+		if *emit == "listing" {
+			log.Fatal("a listing can't be sealed")
+		}
+		key = readKey(*keyFile)
+	}
+	source := fs.Arg(0)
+	if *output == "" {
+		*output = strings.TrimSuffix(source, filepath.Ext(source)) + ext
+	}
+	assembler := newAssembler(readSource(source), source)
+	assembler.SetBuildTime(buildTime())
+	assembler.SetKeepUnused(*keepUnused)
+	program, err := assembler.Assemble()
+	if err != nil {
+		log.Fatalf("Failed to assemble program: %v", err)
+	}
+	if *printRemoved {
+		functions, structs := assembler.Eliminated()
+		for _, name := range functions {
+			fmt.Fprintf(os.Stderr, "removed func %s\n", name)
+		}
+		for _, name := range structs {
+			fmt.Fprintf(os.Stderr, "removed struct %s\n", name)
+		}
+	}
+	if *output == "-" {
+		if err := emitProgram(os.Stdout, *emit, program, *name, *pkg, key); err != nil {
+			log.Fatalf("Failed to write %s output: %v", *emit, err)
+		}
+		return
+	}
+	f, err := os.Create(*output)
+	if err != nil {
+		log.Fatalf("Failed to create output file: %v", err)
+	}
+	if err := emitProgram(f, *emit, program, *name, *pkg, key); err != nil {
+		f.Close()
+		os.Remove(*output)
+		log.Fatalf("Failed to write %s output: %v", *emit, err)
+	}
+	if err := f.Close(); err != nil {
+		log.Fatalf("Failed to write %s output: %v", *emit, err)
 	}
-	vm := vm.NewVm(bytecode)
-	vm.Run()
 }
 
 func main() {
 	if len(os.Args) < 2 {
 		log.Fatal("Not enough arguments")
 	}
-	runFile(os.Args[1])
+	switch os.Args[1] {
+	case "run":
+		runCommand(os.Args[2:])
+	case "asm":
+		asmCommand(os.Args[2:])
+	case "serve":
+		serveCommand(os.Args[2:])
+	case "service":
+		serviceCommand(os.Args[2:])
+	case "compare":
+		compareCommand(os.Args[2:])
+	case "tracediff":
+		tracediffCommand(os.Args[2:])
+	case "runall":
+		runallCommand(os.Args[2:])
+	case "eval":
+		evalCommand(os.Args[2:])
+	case "fuzzcorpus":
+		fuzzcorpusCommand(os.Args[2:])
+	case "spec":
+		specCommand(os.Args[2:])
+	case "debug":
+		debugCommand(os.Args[2:])
+	case "heapdump":
+		heapdumpCommand(os.Args[2:])
+	case "get":
+		getCommand(os.Args[2:])
+	case "info":
+		infoCommand(os.Args[2:])
+	case "strip":
+		stripCommand(os.Args[2:])
+	case "shrink":
+		shrinkCommand(os.Args[2:])
+	case "check":
+		checkCommand(os.Args[2:])
+	case "help":
+		helpCommand(os.Args[2:])
+	default:
+		runFile(os.Args[1], true, vm.Options{}, runReports{})
+	}
 }
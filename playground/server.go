@@ -0,0 +1,274 @@
+// Package playground serves a web page where gvm assembly can be edited,
+// assembled and run, streaming the program's output and trace back to the
+// browser.
+package playground
+
+import (
+	"bytes"
+	"context"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AndreiAlbert/gvm/asm"
+	"github.com/AndreiAlbert/gvm/vm"
+)
+
+//go:embed index.html
+var indexHTML []byte
+
+// Limits bound the resources a single playground run may use.
+type Limits struct {
+	MaxSourceBytes  int64
+	MaxInstructions uint64
+	MaxHeapBytes    uintptr
+	// MaxTraceLines caps the trace sent back for one run
+	MaxTraceLines int
+	Timeout       time.Duration
+	// MaxConcurrent is the number of programs running at once, further
+	// requests are rejected with 503
+	MaxConcurrent int
+}
+
+// DefaultLimits suit a demo or classroom server.
+var DefaultLimits = Limits{
+	MaxSourceBytes:  64 << 10,
+	MaxInstructions: 10_000_000,
+	MaxHeapBytes:    64 << 20,
+	MaxTraceLines:   10_000,
+	Timeout:         5 * time.Second,
+	MaxConcurrent:   8,
+}
+
+// maxStdinBytes bounds the input sent along with a program
+const maxStdinBytes = 64 << 10
+
+// flushInterval is how often buffered output is pushed to the client
+const flushInterval = 50 * time.Millisecond
+
+// RunRequest is the body of POST /run.
+type RunRequest struct {
+	Source string `json:"source"`
+	Stdin  string `json:"stdin"`
+	Trace  bool   `json:"trace"`
+}
+
+// Event is one line of the newline-delimited JSON stream returned by
+// POST /run. Type is "stdout" or "trace" with Data holding the text, the
+// last event has type "done" and carries the outcome of the run.
+type Event struct {
+	Type         string `json:"type"`
+	Data         string `json:"data,omitempty"`
+	Error        string `json:"error,omitempty"`
+	Instructions uint64 `json:"instructions,omitempty"`
+}
+
+// Server is the playground HTTP handler.
+type Server struct {
+	limits Limits
+	slots  chan struct{}
+	mux    *http.ServeMux
+}
+
+// NewServer creates a playground enforcing limits on every run.
+func NewServer(limits Limits) *Server {
+	if limits.MaxConcurrent <= 0 {
+		limits.MaxConcurrent = 1
+	}
+	s := &Server{
+		limits: limits,
+		slots:  make(chan struct{}, limits.MaxConcurrent),
+		mux:    http.NewServeMux(),
+	}
+	s.mux.HandleFunc("GET /{$}", s.handleIndex)
+	s.mux.HandleFunc("POST /run", s.handleRun)
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+func (s *Server) handleIndex(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(indexHTML)
+}
+
+func (s *Server) handleRun(w http.ResponseWriter, r *http.Request) {
+	var req RunRequest
+	// leave room for JSON escaping of the source and for stdin, the source
+	// size itself is checked after decoding
+	body := http.MaxBytesReader(w, r.Body, 2*s.limits.MaxSourceBytes+maxStdinBytes)
+	if err := json.NewDecoder(body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+	if int64(len(req.Source)) > s.limits.MaxSourceBytes {
+		http.Error(w, "source too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	select {
+	case s.slots <- struct{}{}:
+		defer func() { <-s.slots }()
+	default:
+		http.Error(w, "too many programs running, try again later", http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	out := newStream(w)
+	defer out.close()
+
+	done := Event{Type: "done"}
+	program, err := asm.NewAssembler(req.Source).Assemble()
+	if err != nil {
+		done.Error = err.Error()
+		out.send(done)
+		return
+	}
+	opts := vm.Options{
+		Stdin:           strings.NewReader(req.Stdin),
+		Stdout:          out.writer("stdout", 0),
+		MaxInstructions: s.limits.MaxInstructions,
+		MaxHeapBytes:    s.limits.MaxHeapBytes,
+	}
+	if req.Trace {
+		opts.Trace = out.writer("trace", s.limits.MaxTraceLines)
+	}
+	machine, err := vm.NewVmFromProgram(program, opts)
+	if err != nil {
+		done.Error = err.Error()
+		out.send(done)
+		return
+	}
+	defer machine.Close()
+
+	ctx := r.Context()
+	if s.limits.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.limits.Timeout)
+		defer cancel()
+	}
+	err = machine.RunContext(ctx)
+	if errors.Is(err, context.DeadlineExceeded) {
+		err = fmt.Errorf("time limit of %v exceeded: %w", s.limits.Timeout, err)
+	}
+	if err != nil {
+		done.Error = err.Error()
+	}
+	done.Instructions = machine.Instructions()
+	out.send(done)
+}
+
+// stream writes events to the client. Consecutive output of the same type
+// is coalesced and flushed periodically, so byte-sized writes don't turn
+// into one event each.
+type stream struct {
+	mu      sync.Mutex
+	enc     *json.Encoder
+	flusher http.Flusher
+	pending Event
+	buf     bytes.Buffer
+	stop    chan struct{}
+	stopped sync.WaitGroup
+}
+
+func newStream(w http.ResponseWriter) *stream {
+	s := &stream{
+		enc:  json.NewEncoder(w),
+		stop: make(chan struct{}),
+	}
+	s.flusher, _ = w.(http.Flusher)
+	s.stopped.Add(1)
+	go func() {
+		defer s.stopped.Done()
+		ticker := time.NewTicker(flushInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				s.mu.Lock()
+				s.flushLocked()
+				s.mu.Unlock()
+			case <-s.stop:
+				return
+			}
+		}
+	}()
+	return s
+}
+
+func (s *stream) write(kind string, p []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.pending.Type != kind {
+		s.flushLocked()
+		s.pending.Type = kind
+	}
+	s.buf.Write(p)
+}
+
+// send writes ev after any buffered output.
+func (s *stream) send(ev Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.flushLocked()
+	s.enc.Encode(ev)
+	if s.flusher != nil {
+		s.flusher.Flush()
+	}
+}
+
+func (s *stream) flushLocked() {
+	if s.buf.Len() == 0 {
+		return
+	}
+	s.pending.Data = s.buf.String()
+	s.enc.Encode(s.pending)
+	s.buf.Reset()
+	s.pending = Event{}
+	if s.flusher != nil {
+		s.flusher.Flush()
+	}
+}
+
+func (s *stream) close() {
+	close(s.stop)
+	s.stopped.Wait()
+}
+
+// writer returns an io.Writer emitting events of the given type. A
+// positive maxLines stops forwarding after that many writes, which for the
+// trace is one line each.
+func (s *stream) writer(kind string, maxLines int) io.Writer {
+	return &streamWriter{stream: s, kind: kind, remaining: maxLines, limited: maxLines > 0}
+}
+
+type streamWriter struct {
+	stream    *stream
+	kind      string
+	limited   bool
+	remaining int
+}
+
+func (w *streamWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	if w.limited {
+		if w.remaining == 0 {
+			return n, nil
+		}
+		w.remaining--
+		if w.remaining == 0 {
+			p = append(p[:n:n], "... trace truncated\n"...)
+		}
+	}
+	w.stream.write(w.kind, p)
+	return n, nil
+}
@@ -0,0 +1,114 @@
+package playground
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const helloSource = `.text
+    func main() -> void {
+        push byte 72
+        syscall write_byte
+        push byte 105
+        syscall write_byte
+    }`
+
+const loopSource = `.text
+    func main() -> void {
+    loop:
+        jmp loop
+    }`
+
+func run(t *testing.T, srv *Server, req RunRequest) (string, []Event) {
+	t.Helper()
+	body, err := json.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	srv.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/run", strings.NewReader(string(body))))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var stdout strings.Builder
+	var events []Event
+	scanner := bufio.NewScanner(rec.Body)
+	for scanner.Scan() {
+		var ev Event
+		if err := json.Unmarshal(scanner.Bytes(), &ev); err != nil {
+			t.Fatalf("Invalid event %q: %v", scanner.Text(), err)
+		}
+		if ev.Type == "stdout" {
+			stdout.WriteString(ev.Data)
+		}
+		events = append(events, ev)
+	}
+	if len(events) == 0 || events[len(events)-1].Type != "done" {
+		t.Fatalf("Expected the stream to end with a done event, got %+v", events)
+	}
+	return stdout.String(), events
+}
+
+func TestRunStreamsOutputAndTrace(t *testing.T) {
+	srv := NewServer(DefaultLimits)
+	stdout, events := run(t, srv, RunRequest{Source: helloSource, Trace: true})
+	if stdout != "Hi" {
+		t.Errorf("Expected output %q, got %q", "Hi", stdout)
+	}
+	done := events[len(events)-1]
+	if done.Error != "" || done.Instructions != 5 {
+		t.Errorf("Unexpected done event: %+v", done)
+	}
+	traced := false
+	for _, ev := range events {
+		if ev.Type == "trace" && strings.Contains(ev.Data, "SYSCALL") {
+			traced = true
+		}
+	}
+	if !traced {
+		t.Errorf("Expected a trace of the run, got %+v", events)
+	}
+}
+
+func TestRunReportsErrorsAndLimits(t *testing.T) {
+	limits := DefaultLimits
+	limits.MaxInstructions = 1000
+	limits.MaxTraceLines = 10
+	srv := NewServer(limits)
+
+	_, events := run(t, srv, RunRequest{Source: "func"})
+	if events[len(events)-1].Error == "" {
+		t.Error("Expected an assembly error")
+	}
+
+	_, events = run(t, srv, RunRequest{Source: loopSource, Trace: true})
+	done := events[len(events)-1]
+	if !strings.Contains(done.Error, "instruction limit exceeded") {
+		t.Errorf("Expected the instruction limit to stop the run, got %+v", done)
+	}
+	var trace strings.Builder
+	for _, ev := range events {
+		if ev.Type == "trace" {
+			trace.WriteString(ev.Data)
+		}
+	}
+	if lines := strings.Count(trace.String(), "\n"); lines != 11 || !strings.HasSuffix(trace.String(), "trace truncated\n") {
+		t.Errorf("Expected a truncated trace of 10 lines, got:\n%s", trace.String())
+	}
+}
+
+func TestRunRejectsOversizedSource(t *testing.T) {
+	limits := DefaultLimits
+	limits.MaxSourceBytes = 16
+	srv := NewServer(limits)
+	body, _ := json.Marshal(RunRequest{Source: helloSource})
+	rec := httptest.NewRecorder()
+	srv.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/run", strings.NewReader(string(body))))
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected status 413, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AndreiAlbert/gvm/bytecode"
+	"github.com/AndreiAlbert/gvm/heap"
+	"github.com/AndreiAlbert/gvm/vm"
+)
+
+// batchReport is the JSON report of gvm runall
+type batchReport struct {
+	Passed int         `json:"passed"`
+	Failed int         `json:"failed"`
+	Limits batchLimits `json:"limits"`
+	// Tripped counts the programs stopped by each limit
+	Tripped  map[string]int `json:"tripped,omitempty"`
+	Programs []batchResult  `json:"programs"`
+}
+
+// batchLimits caps every program of gvm runall. Zero fields don't limit.
+type batchLimits struct {
+	MaxInstructions uint64        `json:"max_instructions,omitempty"`
+	MaxHeapBytes    uint64        `json:"max_heap_bytes,omitempty"`
+	Timeout         time.Duration `json:"-"`
+	TimeoutMillis   int64         `json:"timeout_ms,omitempty"`
+	Deterministic   bool          `json:"deterministic,omitempty"`
+}
+
+// Limits reported in batchResult.Limit.
+const (
+	limitInstructions = "instructions"
+	limitHeap         = "heap"
+	limitTimeout      = "timeout"
+)
+
+// batchResult is the outcome of one program of gvm runall. Stage is where a
+// failed program stopped: assemble, run, output, the last when its output
+// differs from the expected one, or internal when the interpreter panicked.
+// Limit names the limit that stopped the run, if one did.
+type batchResult struct {
+	File     string    `json:"file"`
+	Passed   bool      `json:"passed"`
+	Stage    string    `json:"stage,omitempty"`
+	Limit    string    `json:"limit,omitempty"`
+	Error    string    `json:"error,omitempty"`
+	Stdout   string    `json:"stdout"`
+	Expected *string   `json:"expected,omitempty"`
+	Usage    *vm.Usage `json:"usage,omitempty"`
+}
+
+func runallCommand(args []string) {
+	fs := flag.NewFlagSet("runall", flag.ExitOnError)
+	jobs := fs.Int("jobs", runtime.NumCPU(), "programs running at once")
+	stdinFile := fs.String("stdin", "", "file fed to every program as stdin (default: the program's .in file, if any)")
+	env := envFlag{}
+	fs.Var(env, "env", "set a variable read by GET_ENV in every program, as KEY=VALUE; may be repeated")
+	manifest := fs.String("manifest", "", "JSON file with the stdin and variables of each program")
+	var limits batchLimits
+	fs.Uint64Var(&limits.MaxInstructions, "max-instructions", 0, "stop each program after this many instructions (0: no limit)")
+	fs.Uint64Var(&limits.MaxHeapBytes, "max-heap", 0, "heap limit per program in bytes (0: no limit)")
+	fs.DurationVar(&limits.Timeout, "timeout", 10*time.Second, "wall-clock limit per program (0: no limit)")
+	fs.BoolVar(&limits.Deterministic, "deterministic", false, "fail the programs given variables, so the report depends only on the programs and their input")
+	output := fs.String("o", "runall.json", "report file, - for stdout")
+	dirs := parseInterspersed(fs, args)
+	if len(dirs) != 1 || *jobs < 1 {
+		log.Fatal("usage: gvm runall [-jobs n] [-stdin file] [-env KEY=VALUE] [-manifest file] [-deterministic] [-max-instructions n] [-max-heap bytes] [-timeout d] [-o report.json] <dir>")
+	}
+	files, err := batchFiles(dirs[0])
+	if err != nil {
+		log.Fatal(err)
+	}
+	shared := batchInput{env: env}
+	if *stdinFile != "" {
+		if shared.stdin, err = os.ReadFile(*stdinFile); err != nil {
+			log.Fatalf("Failed to read input: %v", err)
+		}
+	}
+	inputs := map[string]batchInput{}
+	if *manifest != "" {
+		if inputs, err = readManifest(*manifest, shared); err != nil {
+			log.Fatal(err)
+		}
+	}
+	limits.TimeoutMillis = limits.Timeout.Milliseconds()
+	report := runBatch(files, *jobs, func(file string) batchResult {
+		input, ok := inputs[filepath.Base(file)]
+		if !ok {
+			input = shared
+		}
+		return runBatched(file, input, limits)
+	})
+	report.Limits = limits
+	if *output == "-" {
+		writeBatchReport(os.Stdout, report)
+	} else {
+		writeReport(*output, func(w io.Writer) error { return writeBatchReport(w, report) })
+	}
+	log.Printf("%d passed, %d failed", report.Passed, report.Failed)
+	for _, limit := range []string{limitInstructions, limitHeap, limitTimeout} {
+		if n := report.Tripped[limit]; n > 0 {
+			log.Printf("%d stopped by the %s limit", n, limit)
+		}
+	}
+	if report.Failed > 0 {
+		os.Exit(1)
+	}
+}
+
+// batchInput is what a program of gvm runall runs with. A nil stdin reads
+// the program's .in file, if there is one.
+type batchInput struct {
+	stdin []byte
+	env   map[string]string
+}
+
+// manifestEntry is the input of one program in a runall manifest. Stdin is
+// a file relative to the manifest, Env is added to the -env variables.
+type manifestEntry struct {
+	Stdin string            `json:"stdin"`
+	Env   map[string]string `json:"env"`
+}
+
+// readManifest reads the manifest at path, an object from program file
+// names to their manifestEntry, into the input of every listed program.
+// What an entry leaves out comes from shared.
+func readManifest(path string, shared batchInput) (map[string]batchInput, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var entries map[string]manifestEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	inputs := make(map[string]batchInput, len(entries))
+	for name, entry := range entries {
+		input := batchInput{stdin: shared.stdin, env: make(map[string]string)}
+		if entry.Stdin != "" {
+			if input.stdin, err = os.ReadFile(filepath.Join(filepath.Dir(path), entry.Stdin)); err != nil {
+				return nil, fmt.Errorf("%s: input of %s: %w", path, name, err)
+			}
+		}
+		for key, value := range shared.env {
+			input.env[key] = value
+		}
+		for key, value := range entry.Env {
+			input.env[key] = value
+		}
+		inputs[name] = input
+	}
+	return inputs, nil
+}
+
+// batchFiles returns the programs of dir, .asm sources and .gvmbc
+// containers, sorted by name
+func batchFiles(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, entry := range entries {
+		switch filepath.Ext(entry.Name()) {
+		case ".asm", ".gvmbc":
+			if !entry.IsDir() {
+				files = append(files, filepath.Join(dir, entry.Name()))
+			}
+		}
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no .asm or .gvmbc programs in %s", dir)
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// runBatch runs every file with run, at most jobs at once, and returns the
+// results in the order of files
+func runBatch(files []string, jobs int, run func(string) batchResult) batchReport {
+	results := make([]batchResult, len(files))
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < jobs && w < len(files); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				results[i] = run(files[i])
+			}
+		}()
+	}
+	for i := range files {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+	report := batchReport{Programs: results}
+	for _, result := range results {
+		if result.Passed {
+			report.Passed++
+		} else {
+			report.Failed++
+		}
+		if result.Limit != "" {
+			if report.Tripped == nil {
+				report.Tripped = make(map[string]int)
+			}
+			report.Tripped[result.Limit]++
+		}
+	}
+	return report
+}
+
+// runBatched assembles or loads the program in file and runs it in a VM of
+// its own within limits. When a .out file sits next to it the output must
+// match it to pass. A panic of the interpreter fails the program, not the
+// runner.
+func runBatched(file string, input batchInput, limits batchLimits) (result batchResult) {
+	result = batchResult{File: file}
+	defer func() {
+		if r := recover(); r != nil {
+			result.Passed = false
+			result.Stage, result.Error = "internal", fmt.Sprintf("interpreter panic: %v", r)
+		}
+	}()
+	stem := strings.TrimSuffix(file, filepath.Ext(file))
+	program, err := loadBatched(file)
+	if err != nil {
+		result.Stage, result.Error = "assemble", err.Error()
+		return result
+	}
+	defer program.Close()
+	stdin := input.stdin
+	if stdin == nil {
+		if in, err := os.ReadFile(stem + ".in"); err == nil {
+			stdin = in
+		}
+	}
+	var stdout bytes.Buffer
+	opts := vm.Options{
+		Stdin:           bytes.NewReader(stdin),
+		Stdout:          &stdout,
+		Env:             input.env,
+		MaxInstructions: limits.MaxInstructions,
+		MaxHeapBytes:    uintptr(limits.MaxHeapBytes),
+		Deterministic:   limits.Deterministic,
+	}
+	machine, err := vm.NewVmFromProgram(program, opts)
+	if err != nil {
+		result.Stage, result.Error = "run", err.Error()
+		return result
+	}
+	defer machine.Close()
+	ctx := context.Background()
+	if limits.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, limits.Timeout)
+		defer cancel()
+	}
+	err = machine.RunContext(ctx)
+	usage := machine.Usage()
+	result.Usage = &usage
+	result.Stdout = stdout.String()
+	if err != nil {
+		result.Stage, result.Limit, result.Error = "run", trippedLimit(err), err.Error()
+		return result
+	}
+	if expected, err := os.ReadFile(stem + ".out"); err == nil {
+		want := string(expected)
+		result.Expected = &want
+		if want != result.Stdout {
+			result.Stage, result.Error = "output", "the output differs from "+stem+".out"
+			return result
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		result.Stage, result.Error = "output", err.Error()
+		return result
+	}
+	result.Passed = true
+	return result
+}
+
+// trippedLimit names the limit that stopped a run with err, or is empty
+// when err is an error of the program
+func trippedLimit(err error) string {
+	switch {
+	case errors.Is(err, vm.ErrInstructionLimit):
+		return limitInstructions
+	case errors.Is(err, heap.ErrLimitExceeded):
+		return limitHeap
+	case errors.Is(err, context.DeadlineExceeded):
+		return limitTimeout
+	default:
+		return ""
+	}
+}
+
+// loadBatched is loadProgram returning the errors instead of exiting, the
+// build cache is not used
+func loadBatched(file string) (*bytecode.Program, error) {
+	if strings.HasSuffix(file, ".gvmbc") {
+		return bytecode.Open(file)
+	}
+	source, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return newAssembler(source, file).Assemble()
+}
+
+func writeBatchReport(w io.Writer, report batchReport) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(report)
+}
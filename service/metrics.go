@@ -0,0 +1,103 @@
+package service
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// metrics aggregates execution statistics across requests and renders them
+// in the Prometheus text exposition format.
+type metrics struct {
+	mu           sync.Mutex
+	executions   uint64
+	errors       map[string]uint64
+	instructions uint64
+	heapBytes    uint64
+	syscalls     map[string]uint64
+	durationSum  float64
+	inFlight     int64
+	// rejected counts requests turned away before running, by reason
+	rejected map[string]uint64
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		errors:   make(map[string]uint64),
+		syscalls: make(map[string]uint64),
+		rejected: make(map[string]uint64),
+	}
+}
+
+func (m *metrics) start() {
+	m.mu.Lock()
+	m.inFlight++
+	m.mu.Unlock()
+}
+
+// finish records a completed execution
+func (m *metrics) finish(resp *Response, heapBytes uint64, elapsed time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.inFlight--
+	m.executions++
+	if resp.ErrorKind != "" {
+		m.errors[resp.ErrorKind]++
+	}
+	m.instructions += resp.Stats.Instructions
+	m.heapBytes += heapBytes
+	for name, count := range resp.Stats.Syscalls {
+		m.syscalls[name] += count
+	}
+	m.durationSum += elapsed.Seconds()
+}
+
+func (m *metrics) reject(reason string) {
+	m.mu.Lock()
+	m.rejected[reason]++
+	m.mu.Unlock()
+}
+
+func (m *metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	bw := bufio.NewWriter(w)
+	defer bw.Flush()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	writeHeader(bw, "gvm_executions_total", "counter", "Programs executed.")
+	fmt.Fprintf(bw, "gvm_executions_total %d\n", m.executions)
+	writeLabelled(bw, "gvm_execution_errors_total", "Failed executions by error kind.", "kind", m.errors)
+	writeHeader(bw, "gvm_instructions_total", "counter", "Instructions executed by all programs.")
+	fmt.Fprintf(bw, "gvm_instructions_total %d\n", m.instructions)
+	writeHeader(bw, "gvm_heap_allocated_bytes_total", "counter", "Heap bytes allocated by all programs.")
+	fmt.Fprintf(bw, "gvm_heap_allocated_bytes_total %d\n", m.heapBytes)
+	writeLabelled(bw, "gvm_syscalls_total", "System calls executed by name.", "syscall", m.syscalls)
+	writeHeader(bw, "gvm_executions_in_flight", "gauge", "Programs currently running.")
+	fmt.Fprintf(bw, "gvm_executions_in_flight %d\n", m.inFlight)
+	writeHeader(bw, "gvm_execution_duration_seconds", "summary", "Wall-clock time of executions.")
+	fmt.Fprintf(bw, "gvm_execution_duration_seconds_sum %g\n", m.durationSum)
+	fmt.Fprintf(bw, "gvm_execution_duration_seconds_count %d\n", m.executions)
+	writeLabelled(bw, "gvm_rejected_requests_total", "Requests rejected before running.", "reason", m.rejected)
+}
+
+func writeHeader(w *bufio.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// writeLabelled writes a counter family with one sample per label value,
+// sorted so scrapes are stable
+func writeLabelled(w *bufio.Writer, name, help, label string, values map[string]uint64) {
+	writeHeader(w, name, "counter", help)
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s{%s=%q} %d\n", name, label, key, values[key])
+	}
+}
@@ -0,0 +1,343 @@
+// Package service runs gvm as a sandboxed execution backend: clients post a
+// compiled container together with its input and get back the output, the
+// exit code and resource statistics of the run.
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AndreiAlbert/gvm/bytecode"
+	"github.com/AndreiAlbert/gvm/heap"
+	"github.com/AndreiAlbert/gvm/vm"
+)
+
+// Limits bound the resources of one execution. Requests may ask for lower
+// limits, never for higher ones.
+type Limits struct {
+	MaxBytecodeBytes int64
+	MaxStdinBytes    int
+	MaxStdoutBytes   int
+	MaxInstructions  uint64
+	MaxHeapBytes     uintptr
+	Timeout          time.Duration
+	// MaxConcurrent is the number of programs running at once, further
+	// requests are rejected with 503
+	MaxConcurrent int
+}
+
+// DefaultLimits are the server-wide maximums used by gvm service.
+var DefaultLimits = Limits{
+	MaxBytecodeBytes: 4 << 20,
+	MaxStdinBytes:    1 << 20,
+	MaxStdoutBytes:   1 << 20,
+	MaxInstructions:  100_000_000,
+	MaxHeapBytes:     256 << 20,
+	Timeout:          10 * time.Second,
+	MaxConcurrent:    16,
+}
+
+// Exit codes reported in Response.ExitCode.
+const (
+	ExitOK    = 0
+	ExitError = 1
+)
+
+// Error kinds reported in Response.ErrorKind.
+const (
+	ErrorLoad             = "load"
+	ErrorRuntime          = "runtime"
+	ErrorInstructionLimit = "instruction_limit"
+	ErrorHeapLimit        = "heap_limit"
+	ErrorOutputLimit      = "output_limit"
+	ErrorTimeout          = "timeout"
+	ErrorInternal         = "internal"
+)
+
+// Request is the body of POST /v1/execute. Bytecode is a container as
+// written by gvm asm, base64 encoded in JSON.
+type Request struct {
+	Bytecode []byte        `json:"bytecode"`
+	Stdin    string        `json:"stdin,omitempty"`
+	Limits   RequestLimits `json:"limits,omitempty"`
+}
+
+// RequestLimits lowers the server limits for one request. Zero fields keep
+// the server limit.
+type RequestLimits struct {
+	MaxInstructions uint64 `json:"max_instructions,omitempty"`
+	// SoftInstructions is the soft limit of the program, see
+	// vm.Options.SoftInstructions
+	SoftInstructions uint64 `json:"soft_instructions,omitempty"`
+	MaxHeapBytes     uint64 `json:"max_heap_bytes,omitempty"`
+	MaxStdoutBytes   int    `json:"max_stdout_bytes,omitempty"`
+	TimeoutMillis    int64  `json:"timeout_ms,omitempty"`
+}
+
+// Response is the result of an execution.
+type Response struct {
+	// ID identifies the execution in the audit log
+	ID        string `json:"id"`
+	Stdout    string `json:"stdout"`
+	ExitCode  int    `json:"exit_code"`
+	Error     string `json:"error,omitempty"`
+	ErrorKind string `json:"error_kind,omitempty"`
+	Stats     Stats  `json:"stats"`
+}
+
+// Stats describes the resources an execution used.
+type Stats struct {
+	Instructions  uint64 `json:"instructions"`
+	HeapBytes     uint64 `json:"heap_bytes"`
+	PeakHeapBytes uint64 `json:"peak_heap_bytes"`
+	Allocations   uint64 `json:"allocations"`
+	PeakCallDepth int    `json:"peak_call_depth"`
+	WallMillis    int64  `json:"wall_ms"`
+	// SoftLimitReached is set when the program ran past its soft limit
+	SoftLimitReached bool `json:"soft_limit_reached,omitempty"`
+	// Syscalls counts the executed system calls by name
+	Syscalls map[string]uint64 `json:"syscalls,omitempty"`
+	// HeapSizeClasses and HeapFragmentation describe the heap blocks, see
+	// vm.Usage
+	HeapSizeClasses   []heap.SizeClass `json:"heap_size_classes,omitempty"`
+	HeapFragmentation float64          `json:"heap_fragmentation"`
+	// GCCollections counts the full and minor collections of a server with
+	// SetGC, GCPauseMaxMicros is the longest time one stopped the program
+	GCCollections    uint64 `json:"gc_collections,omitempty"`
+	GCPauseMaxMicros int64  `json:"gc_pause_max_us,omitempty"`
+}
+
+// errOutputLimit is returned by the stdout writer once the program printed
+// more than its limit
+var errOutputLimit = errors.New("output limit exceeded")
+
+// Server is the execution service HTTP handler.
+type Server struct {
+	limits  Limits
+	slots   chan struct{}
+	mux     *http.ServeMux
+	metrics *metrics
+	audit   *syncWriter
+	// gc and gcConcurrent are vm.Options.GC and GCConcurrent
+	gc, gcConcurrent bool
+}
+
+// NewServer creates a service enforcing limits on every execution.
+func NewServer(limits Limits) *Server {
+	if limits.MaxConcurrent <= 0 {
+		limits.MaxConcurrent = 1
+	}
+	s := &Server{
+		limits:  limits,
+		slots:   make(chan struct{}, limits.MaxConcurrent),
+		mux:     http.NewServeMux(),
+		metrics: newMetrics(),
+	}
+	s.mux.HandleFunc("POST /v1/execute", s.handleExecute)
+	s.mux.Handle("GET /metrics", s.metrics)
+	s.mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok\n"))
+	})
+	return s
+}
+
+// SetAuditLog makes every execution log its system calls to w as JSON
+// lines, tagged with the execution id returned in the response. Writes
+// from concurrent executions are serialized.
+func (s *Server) SetAuditLog(w io.Writer) {
+	s.audit = &syncWriter{w: w}
+}
+
+// SetGC makes every execution collect the heap blocks its program can no
+// longer reach, see vm.Options.GC. With concurrent, full collections mark
+// the heap on a goroutine of their own, so large heaps don't pause the
+// program for long, see vm.Options.GCConcurrent.
+func (s *Server) SetGC(concurrent bool) {
+	s.gc, s.gcConcurrent = true, concurrent
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+func (s *Server) handleExecute(w http.ResponseWriter, r *http.Request) {
+	var req Request
+	// base64 grows the bytecode by a third, JSON escaping can double stdin
+	maxBody := s.limits.MaxBytecodeBytes*4/3 + int64(2*s.limits.MaxStdinBytes) + 4<<10
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBody)).Decode(&req); err != nil {
+		s.metrics.reject("invalid")
+		http.Error(w, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+	if int64(len(req.Bytecode)) > s.limits.MaxBytecodeBytes || len(req.Stdin) > s.limits.MaxStdinBytes {
+		s.metrics.reject("too_large")
+		http.Error(w, "request exceeds size limits", http.StatusRequestEntityTooLarge)
+		return
+	}
+	select {
+	case s.slots <- struct{}{}:
+		defer func() { <-s.slots }()
+	default:
+		s.metrics.reject("busy")
+		http.Error(w, "too many programs running, try again later", http.StatusServiceUnavailable)
+		return
+	}
+
+	resp := s.Execute(r.Context(), &req)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// Execute runs one request within the server limits.
+func (s *Server) Execute(ctx context.Context, req *Request) (resp *Response) {
+	limits := s.effectiveLimits(req.Limits)
+	resp = &Response{ID: newExecutionID()}
+	start := time.Now()
+	stdout := &limitedWriter{limit: limits.MaxStdoutBytes}
+	var heapBytes uint64
+	s.metrics.start()
+	defer func() {
+		if r := recover(); r != nil {
+			// malformed bytecode can still trip the interpreter, it must
+			// not take the service down
+			resp.fail(ErrorInternal, fmt.Errorf("interpreter panic: %v", r))
+		}
+		elapsed := time.Since(start)
+		resp.Stats.WallMillis = elapsed.Milliseconds()
+		resp.Stdout = stdout.String()
+		s.metrics.finish(resp, heapBytes, elapsed)
+	}()
+
+	program, err := bytecode.Decode(req.Bytecode)
+	if err != nil {
+		resp.fail(ErrorLoad, err)
+		return resp
+	}
+	opts := vm.Options{
+		Stdin:            strings.NewReader(req.Stdin),
+		Stdout:           stdout,
+		MaxInstructions:  limits.MaxInstructions,
+		SoftInstructions: req.Limits.SoftInstructions,
+		MaxHeapBytes:     limits.MaxHeapBytes,
+		GC:               s.gc,
+		GCConcurrent:     s.gcConcurrent,
+		Deterministic:    true,
+	}
+	if s.audit != nil {
+		opts.AuditLog = s.audit
+		opts.AuditID = resp.ID
+	}
+	machine, err := vm.NewVmFromProgram(program, opts)
+	if err != nil {
+		resp.fail(ErrorLoad, err)
+		return resp
+	}
+	defer machine.Close()
+
+	if limits.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, limits.Timeout)
+		defer cancel()
+	}
+	defer func() {
+		usage := machine.Usage()
+		resp.Stats.Instructions = usage.Instructions
+		resp.Stats.HeapBytes = uint64(machine.Heap.Allocated())
+		resp.Stats.PeakHeapBytes = usage.PeakHeapBytes
+		resp.Stats.Allocations = usage.Allocations
+		resp.Stats.PeakCallDepth = usage.PeakCallDepth
+		resp.Stats.Syscalls = usage.Syscalls
+		resp.Stats.HeapSizeClasses = usage.HeapSizeClasses
+		resp.Stats.HeapFragmentation = usage.HeapFragmentation
+		resp.Stats.GCCollections = usage.GCCollections + usage.GCMinorCollections
+		resp.Stats.GCPauseMaxMicros = usage.GCPauseMax.Microseconds()
+		resp.Stats.SoftLimitReached = machine.SoftLimitReached()
+		heapBytes = usage.HeapBytesAllocated
+	}()
+	err = machine.RunContext(ctx)
+	if err != nil {
+		resp.fail(classify(err), err)
+	}
+	return resp
+}
+
+func (resp *Response) fail(kind string, err error) {
+	resp.ExitCode = ExitError
+	resp.ErrorKind = kind
+	resp.Error = err.Error()
+}
+
+// classify maps a run error to the kind reported to clients
+func classify(err error) string {
+	switch {
+	case errors.Is(err, vm.ErrInstructionLimit):
+		return ErrorInstructionLimit
+	case errors.Is(err, heap.ErrLimitExceeded):
+		return ErrorHeapLimit
+	case errors.Is(err, errOutputLimit):
+		return ErrorOutputLimit
+	case errors.Is(err, context.DeadlineExceeded):
+		return ErrorTimeout
+	default:
+		return ErrorRuntime
+	}
+}
+
+func (s *Server) effectiveLimits(requested RequestLimits) Limits {
+	limits := s.limits
+	if requested.MaxInstructions > 0 && (limits.MaxInstructions == 0 || requested.MaxInstructions < limits.MaxInstructions) {
+		limits.MaxInstructions = requested.MaxInstructions
+	}
+	if requested.MaxHeapBytes > 0 && (limits.MaxHeapBytes == 0 || uintptr(requested.MaxHeapBytes) < limits.MaxHeapBytes) {
+		limits.MaxHeapBytes = uintptr(requested.MaxHeapBytes)
+	}
+	if requested.MaxStdoutBytes > 0 && (limits.MaxStdoutBytes == 0 || requested.MaxStdoutBytes < limits.MaxStdoutBytes) {
+		limits.MaxStdoutBytes = requested.MaxStdoutBytes
+	}
+	if timeout := time.Duration(requested.TimeoutMillis) * time.Millisecond; timeout > 0 && (limits.Timeout == 0 || timeout < limits.Timeout) {
+		limits.Timeout = timeout
+	}
+	return limits
+}
+
+// limitedWriter collects output up to limit bytes. Zero means no limit.
+type limitedWriter struct {
+	strings.Builder
+	limit int
+}
+
+func (w *limitedWriter) Write(p []byte) (int, error) {
+	if w.limit > 0 && w.Len()+len(p) > w.limit {
+		return 0, errOutputLimit
+	}
+	return w.Builder.Write(p)
+}
+
+// newExecutionID returns a random id for correlating a response with its
+// audit entries
+func newExecutionID() string {
+	var id [8]byte
+	rand.Read(id[:])
+	return hex.EncodeToString(id[:])
+}
+
+// syncWriter serializes writes to a shared log
+type syncWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (w *syncWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.w.Write(p)
+}
@@ -0,0 +1,188 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/AndreiAlbert/gvm/asm"
+	"github.com/AndreiAlbert/gvm/bytecode"
+)
+
+func compile(t *testing.T, source string) []byte {
+	t.Helper()
+	program, err := asm.NewAssembler(source).Assemble()
+	if err != nil {
+		t.Fatalf("Failed to assemble: %v", err)
+	}
+	data, err := bytecode.EncodeBytes(program)
+	if err != nil {
+		t.Fatalf("Failed to encode: %v", err)
+	}
+	return data
+}
+
+const echoSource = `.text
+    func main() -> void {
+        syscall read_byte
+        syscall write_byte
+        syscall read_byte
+        syscall write_byte
+    }`
+
+const loopSource = `.text
+    func main() -> void {
+    loop:
+        push byte 33
+        syscall write_byte
+        jmp loop
+    }`
+
+func TestExecuteOverHTTP(t *testing.T) {
+	srv := httptest.NewServer(NewServer(DefaultLimits))
+	defer srv.Close()
+
+	body, _ := json.Marshal(Request{Bytecode: compile(t, echoSource), Stdin: "ok"})
+	httpResp, err := http.Post(srv.URL+"/v1/execute", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer httpResp.Body.Close()
+	var resp Response
+	if err := json.NewDecoder(httpResp.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Stdout != "ok" || resp.ExitCode != ExitOK || resp.Error != "" {
+		t.Errorf("Unexpected response: %+v", resp)
+	}
+	if resp.Stats.Instructions != 5 || resp.Stats.PeakCallDepth != 1 {
+		t.Errorf("Unexpected stats: %+v", resp.Stats)
+	}
+}
+
+func TestExecuteLimitsAndErrors(t *testing.T) {
+	srv := NewServer(DefaultLimits)
+	loop := compile(t, loopSource)
+
+	tests := []struct {
+		name string
+		req  Request
+		kind string
+	}{
+		{"instruction limit", Request{Bytecode: loop, Limits: RequestLimits{MaxInstructions: 30, MaxStdoutBytes: 100}}, ErrorInstructionLimit},
+		{"output limit", Request{Bytecode: loop, Limits: RequestLimits{MaxStdoutBytes: 10}}, ErrorOutputLimit},
+		{"timeout", Request{Bytecode: loop, Limits: RequestLimits{MaxInstructions: 1 << 62, MaxStdoutBytes: 1 << 30, TimeoutMillis: 20}}, ErrorTimeout},
+		{"not bytecode", Request{Bytecode: []byte("hello")}, ErrorLoad},
+		{"runtime error", Request{Bytecode: compile(t, echoSource)}, ErrorRuntime},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := srv.Execute(context.Background(), &tt.req)
+			if resp.ExitCode != ExitError || resp.ErrorKind != tt.kind {
+				t.Errorf("Expected error kind %q, got %+v", tt.kind, resp)
+			}
+		})
+	}
+}
+
+func TestExecuteSurvivesMalformedCode(t *testing.T) {
+	// a main function whose body is a truncated PUSH instruction
+	program := &bytecode.Program{
+		Functions: []bytecode.Function{{Name: "main", IsMain: true}},
+		Code:      []byte{1},
+	}
+	data, err := bytecode.EncodeBytes(program)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := NewServer(DefaultLimits).Execute(context.Background(), &Request{Bytecode: data})
+	if resp.ExitCode != ExitError || resp.Error == "" {
+		t.Errorf("Expected the run to fail, got %+v", resp)
+	}
+}
+
+func TestAuditLogTagsExecutions(t *testing.T) {
+	var audit bytes.Buffer
+	srv := NewServer(DefaultLimits)
+	srv.SetAuditLog(&audit)
+	resp := srv.Execute(context.Background(), &Request{Bytecode: compile(t, echoSource), Stdin: "ok"})
+	if resp.ID == "" || resp.ExitCode != ExitOK {
+		t.Fatalf("Unexpected response: %+v", resp)
+	}
+
+	lines := strings.Split(strings.TrimSpace(audit.String()), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("Expected 4 audit entries, got %d:\n%s", len(lines), audit.String())
+	}
+	for _, line := range lines {
+		var entry struct {
+			Execution string `json:"execution"`
+		}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("Invalid audit line %q: %v", line, err)
+		}
+		if entry.Execution != resp.ID {
+			t.Errorf("Expected execution id %q, got %q", resp.ID, entry.Execution)
+		}
+	}
+}
+
+func TestGCCollectsExecutions(t *testing.T) {
+	const source = `.text
+    func main() -> void {
+        stralloc "garbage"
+        pop
+        push int32 1
+        syscall gc_hint
+        push byte 33
+        syscall write_byte
+    }`
+	for _, concurrent := range []bool{false, true} {
+		srv := NewServer(DefaultLimits)
+		srv.SetGC(concurrent)
+		resp := srv.Execute(context.Background(), &Request{Bytecode: compile(t, source)})
+		if resp.ExitCode != ExitOK || resp.Stdout != "!" {
+			t.Fatalf("Unexpected response: %+v", resp)
+		}
+		if resp.Stats.GCCollections != 1 || resp.Stats.HeapBytes != 0 {
+			t.Errorf("Expected the hint to collect the string, got %+v", resp.Stats)
+		}
+	}
+}
+
+func TestRequestLimitsCannotRaiseServerLimits(t *testing.T) {
+	srv := NewServer(Limits{MaxInstructions: 100, MaxStdoutBytes: 10})
+	limits := srv.effectiveLimits(RequestLimits{MaxInstructions: 1000, MaxStdoutBytes: 5})
+	if limits.MaxInstructions != 100 || limits.MaxStdoutBytes != 5 {
+		t.Errorf("Unexpected effective limits: %+v", limits)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	srv := NewServer(DefaultLimits)
+	srv.Execute(context.Background(), &Request{Bytecode: compile(t, echoSource), Stdin: "ok"})
+	srv.Execute(context.Background(), &Request{Bytecode: compile(t, loopSource), Limits: RequestLimits{MaxInstructions: 30}})
+	srv.Execute(context.Background(), &Request{Bytecode: []byte("junk")})
+
+	rec := httptest.NewRecorder()
+	srv.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body := rec.Body.String()
+	for _, want := range []string{
+		"# TYPE gvm_executions_total counter\ngvm_executions_total 3\n",
+		`gvm_execution_errors_total{kind="instruction_limit"} 1`,
+		`gvm_execution_errors_total{kind="load"} 1`,
+		"gvm_instructions_total 35\n",
+		`gvm_syscalls_total{syscall="READ_BYTE"} 2`,
+		`gvm_syscalls_total{syscall="WRITE_BYTE"} 12`,
+		"gvm_executions_in_flight 0\n",
+		"gvm_execution_duration_seconds_count 3\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("Metrics are missing %q:\n%s", want, body)
+		}
+	}
+}
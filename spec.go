@@ -0,0 +1,50 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/AndreiAlbert/gvm/vm"
+)
+
+func specCommand(args []string) {
+	fs := flag.NewFlagSet("spec", flag.ExitOnError)
+	format := fs.String("format", vm.SpecMarkdown, "output format: markdown or html")
+	output := fs.String("o", "-", "output file, - for stdout")
+	fs.Parse(args)
+	w := os.Stdout
+	if *output != "-" {
+		f, err := os.Create(*output)
+		if err != nil {
+			log.Fatalf("Failed to create output file: %v", err)
+		}
+		defer f.Close()
+		w = f
+	}
+	if err := vm.WriteSpec(w, *format); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func helpCommand(args []string) {
+	if len(args) == 0 {
+		fmt.Println("usage: gvm <command> [arguments]")
+		fmt.Println()
+		fmt.Println("commands: run, asm, debug, heapdump, get, info, strip, shrink, check, eval, compare, tracediff, runall, serve, service, fuzzcorpus, spec, help")
+		fmt.Println()
+		fmt.Println("Instructions, see gvm help <mnemonic>:")
+		if err := vm.WriteHelpIndex(os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	info, ok := vm.LookupMnemonic(args[0])
+	if !ok {
+		log.Fatalf("Unknown instruction %q, gvm help lists them", args[0])
+	}
+	if err := info.WriteHelp(os.Stdout); err != nil {
+		log.Fatal(err)
+	}
+}
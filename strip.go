@@ -0,0 +1,99 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/AndreiAlbert/gvm/bytecode"
+	"github.com/AndreiAlbert/gvm/vm"
+)
+
+// stringList collects the values of a repeated flag
+type stringList []string
+
+func (l *stringList) String() string { return strings.Join(*l, ",") }
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+func stripCommand(args []string) {
+	fs := flag.NewFlagSet("strip", flag.ExitOnError)
+	output := fs.String("o", "", "output file (default: the container itself, or the source name with .gvmbc)")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		log.Fatal("usage: gvm strip [-o out] <file.gvmbc|file.asm>")
+	}
+	rewriteContainer(fs.Arg(0), *output, func(program *bytecode.Program) (*bytecode.Program, error) {
+		return program.Strip(), nil
+	})
+}
+
+func shrinkCommand(args []string) {
+	fs := flag.NewFlagSet("shrink", flag.ExitOnError)
+	output := fs.String("o", "", "output file (default: the container itself, or the source name with .gvmbc)")
+	var keep stringList
+	fs.Var(&keep, "keep", "keep this function and those it calls besides main, such as one called from the host; may be repeated")
+	strip := fs.Bool("strip", false, "also strip the debug sections, as gvm strip does")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		log.Fatal("usage: gvm shrink [-o out] [-keep function]... [-strip] <file.gvmbc|file.asm>")
+	}
+	rewriteContainer(fs.Arg(0), *output, func(program *bytecode.Program) (*bytecode.Program, error) {
+		shrunk, err := vm.Shrink(program, keep...)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range program.Functions {
+			if !hasFunction(shrunk, f.Name) {
+				fmt.Printf("removed %s\n", f.Name)
+			}
+		}
+		if *strip {
+			shrunk = shrunk.Strip()
+		}
+		return shrunk, nil
+	})
+}
+
+func hasFunction(program *bytecode.Program, name string) bool {
+	for _, f := range program.Functions {
+		if f.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// rewriteContainer loads file, transforms the program and writes it to
+// output as a container, reporting the change in size
+func rewriteContainer(file, output string, transform func(*bytecode.Program) (*bytecode.Program, error)) {
+	if output == "" {
+		output = strings.TrimSuffix(file, filepath.Ext(file)) + ".gvmbc"
+	}
+	program := loadProgram(file, false)
+	before, err := bytecode.EncodeBytes(program)
+	if err != nil {
+		log.Fatal(err)
+	}
+	transformed, err := transform(program)
+	if err != nil {
+		log.Fatalf("%s: %v", file, err)
+	}
+	data, err := bytecode.EncodeBytes(transformed)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// the container may be rewritten in place, which its mapping must not
+	// outlive
+	program.Close()
+	if err := os.WriteFile(output, data, 0o644); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("%s: %d bytes, was %d\n", output, len(data), len(before))
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/AndreiAlbert/gvm/vm"
+)
+
+// defaultTraceDiffInstructions bounds each run of gvm tracediff unless
+// -max-instructions is given, since the runs step one instruction at a time
+const defaultTraceDiffInstructions = 10_000_000
+
+func tracediffCommand(args []string) {
+	fs := flag.NewFlagSet("tracediff", flag.ExitOnError)
+	input := fs.String("input", "", "file fed to both programs as stdin")
+	noCache := fs.Bool("no-cache", false, "always assemble, bypassing the build cache")
+	maxInstructions := fs.Uint64("max-instructions", defaultTraceDiffInstructions, "stop each program after this many instructions")
+	files := parseInterspersed(fs, args)
+	if len(files) != 2 {
+		log.Fatal("usage: gvm tracediff [-input file] [-no-cache] [-max-instructions n] <old> <new>")
+	}
+	var stdin []byte
+	if *input != "" {
+		var err error
+		if stdin, err = os.ReadFile(*input); err != nil {
+			log.Fatalf("Failed to read input: %v", err)
+		}
+	}
+	var outA, outB bytes.Buffer
+	a := newTraced(files[0], !*noCache, stdin, &outA, *maxInstructions)
+	defer a.Close()
+	b := newTraced(files[1], !*noCache, stdin, &outB, *maxInstructions)
+	defer b.Close()
+	diff, err := vm.DiffExecutions(a, b)
+	if err != nil {
+		log.Fatalf("Failed to compare the runs: %v", err)
+	}
+	same := writeTraceDiff(os.Stdout, files[0], files[1], diff, a.Instructions(), b.Instructions())
+	if !bytes.Equal(outA.Bytes(), outB.Bytes()) {
+		same = false
+		line, offset := firstDifference(outA.Bytes(), outB.Bytes())
+		fmt.Printf("output: differs at line %d, byte %d\n", line, offset)
+	}
+	if !same {
+		os.Exit(1)
+	}
+}
+
+// newTraced loads filename into a VM for gvm tracediff
+func newTraced(filename string, useCache bool, stdin []byte, stdout io.Writer, maxInstructions uint64) *vm.VM {
+	program := loadProgram(filename, useCache)
+	opts := vm.Options{Stdin: bytes.NewReader(stdin), Stdout: stdout, MaxInstructions: maxInstructions}
+	machine, err := vm.NewVmFromProgram(program, opts)
+	if err != nil {
+		log.Fatalf("%s: %v", filename, err)
+	}
+	return machine
+}
+
+// writeTraceDiff reports where the runs of a and b diverged, and returns
+// whether they didn't
+func writeTraceDiff(w io.Writer, a, b string, diff *vm.Divergence, instructionsA, instructionsB uint64) bool {
+	if diff == nil {
+		fmt.Fprintf(w, "no divergence: both ran the same lines (%d and %d instructions)\n", instructionsA, instructionsB)
+		return true
+	}
+	fmt.Fprintf(w, "diverged after %d lines", diff.Lines)
+	if diff.Lines > 0 {
+		fmt.Fprintf(w, ", last common: %v", diff.Last)
+	}
+	fmt.Fprintf(w, "\n  %s: %v\n  %s: %v\n", a, diff.A, b, diff.B)
+	return false
+}
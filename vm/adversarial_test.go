@@ -0,0 +1,136 @@
+package vm
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/AndreiAlbert/gvm/bytecode"
+	. "github.com/AndreiAlbert/gvm/common"
+)
+
+// runCode runs code as the body of main with tight limits and returns the
+// error of the run
+func runCode(t *testing.T, code []byte) error {
+	t.Helper()
+	program := &bytecode.Program{
+		Functions: []bytecode.Function{{Name: "main", IsMain: true, ReturnType: ValueVoid}},
+		Code:      code,
+	}
+	machine, err := NewVmFromProgram(program, Options{
+		Stdin:           strings.NewReader("x"),
+		Stdout:          io.Discard,
+		MaxInstructions: 10_000,
+		MaxHeapBytes:    1 << 20,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create VM: %v", err)
+	}
+	defer machine.Close()
+	return machine.Run()
+}
+
+func pushInt(n int32) []byte {
+	return []byte{byte(PUSH), byte(ValueInt32), byte(n >> 24), byte(n >> 16), byte(n >> 8), byte(n)}
+}
+
+func pushFloat() []byte {
+	return []byte{byte(PUSH), byte(ValueFloat32), 0x3f, 0x80, 0, 0}
+}
+
+func join(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+func TestAdversarialCode(t *testing.T) {
+	tests := []struct {
+		name string
+		code []byte
+	}{
+		{"truncated push", []byte{byte(PUSH), byte(ValueInt32), 0}},
+		{"push of unknown kind", []byte{byte(PUSH), 99, 0, 0, 0, 0}},
+		{"run past the end", pushInt(1)},
+		{"add on empty stack", []byte{byte(IADD)}},
+		{"add int and float", join(pushInt(1), pushFloat(), []byte{byte(IADD)})},
+		{"compare int and float", join(pushInt(1), pushFloat(), []byte{byte(EQ)})},
+		{"compare bytes", join([]byte{byte(PUSH), byte(ValueByte), 1, byte(PUSH), byte(ValueByte), 1, byte(LT)})},
+		{"free an int", join(pushInt(1), []byte{byte(FREE)})},
+		{"free a wild pointer", join(pushInt(8), []byte{byte(ALLOC), byte(DUP), byte(FREE), byte(FREE)})},
+		{"negative allocation", join(pushInt(-1), []byte{byte(ALLOC)})},
+		{"array of unknown kind", join(pushInt(4), []byte{byte(NEWARR), 99})},
+		{"array of negative length", join(pushInt(-4), []byte{byte(NEWARR), byte(ValueInt32)})},
+		{"array index out of range", join(pushInt(2), []byte{byte(NEWARR), byte(ValueInt32)}, pushInt(5), []byte{byte(LDELEM)})},
+		{"element of a non-array", join(pushInt(8), []byte{byte(ALLOC)}, pushInt(0), []byte{byte(LDELEM)})},
+		{"field of a non-struct", join(pushInt(8), []byte{byte(ALLOC), byte(FLDGET), 0, 0})},
+		{"unknown struct", []byte{byte(NEWSTRUCT), 'X', 0}},
+		{"unterminated struct name", []byte{byte(NEWSTRUCT), 'X'}},
+		{"string past the end", []byte{byte(STRALLOC), 0xff, 0xff, 'a'}},
+		{"length of a non-string", join(pushInt(8), []byte{byte(ALLOC), byte(SYSCALL), 0, byte(STR_LEN)})},
+		{"unknown syscall", []byte{byte(SYSCALL), 0, 200}},
+		{"syscall number over 255", []byte{byte(SYSCALL), 1, byte(STR_LEN)}},
+		{"write a float", join(pushFloat(), []byte{byte(SYSCALL), 0, byte(WRITE_BYTE)})},
+		{"jump past the end", []byte{byte(JMP), 0xff, 0xf0}},
+		{"call of a missing function", []byte{byte(CALL), 0, 9}},
+		{"load of a missing local", []byte{byte(LOAD), 0, 1}},
+		{"wide prefix on push", []byte{byte(WIDE), byte(PUSH)}},
+		{"unknown opcode", []byte{0xee}},
+		{"throw an int", join(pushInt(1), []byte{byte(THROW)})},
+		{"error with a non-string message", join(pushInt(1), pushInt(2), []byte{byte(SYSCALL), 0, byte(ERR_NEW)})},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := runCode(t, tt.code)
+			var runtimeErr *RuntimeError
+			if !errors.As(err, &runtimeErr) {
+				t.Errorf("Expected a runtime error, got %v", err)
+			}
+		})
+	}
+}
+
+func TestTypeErrorsAreRuntimeErrors(t *testing.T) {
+	err := runCode(t, join(pushInt(1), pushFloat(), []byte{byte(EQ)}))
+	var typeErr *TypeError
+	if !errors.As(err, &typeErr) || typeErr.Want != "float32" || typeErr.Got != ValueInt32 {
+		t.Errorf("Expected a type error comparing float32 with int32, got %v", err)
+	}
+}
+
+func TestInterpreterFaultsAreRuntimeErrors(t *testing.T) {
+	err := runCode(t, []byte{byte(STRALLOC), 0xff, 0xff, 'a'})
+	if !errors.Is(err, ErrInterpreterFault) {
+		t.Errorf("Expected an interpreter fault, got %v", err)
+	}
+}
+
+// TestRandomCodeNeverPanics runs random byte sequences, which must always
+// end in a runtime error or a clean halt
+func TestRandomCodeNeverPanics(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	opcodes := byte(THROW) + 1
+	for i := 0; i < 3000; i++ {
+		code := make([]byte, 1+rng.Intn(64))
+		for j := range code {
+			// bias towards valid opcodes and small operands
+			switch rng.Intn(3) {
+			case 0:
+				code[j] = byte(rng.Intn(int(opcodes)))
+			case 1:
+				code[j] = byte(rng.Intn(8))
+			default:
+				code[j] = byte(rng.Intn(256))
+			}
+		}
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					t.Fatalf("Code %x panicked: %v", code, r)
+				}
+			}()
+			runCode(t, code)
+		}()
+	}
+}
@@ -0,0 +1,194 @@
+package vm
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/AndreiAlbert/gvm/bytecode"
+	. "github.com/AndreiAlbert/gvm/common"
+	"github.com/AndreiAlbert/gvm/heap"
+)
+
+// TestAllocatorsRunProgramsAlike runs every test program with each allocator
+// of the platform. All of them must produce the same output and errors.
+func TestAllocatorsRunProgramsAlike(t *testing.T) {
+	paths, err := filepath.Glob("testdata/*.gvmbc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range paths {
+		program, err := bytecode.Decode(mustReadTestProgram(t, path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		results := make(map[string]string)
+		for name, allocator := range heap.Allocators() {
+			var stdout bytes.Buffer
+			opts := Options{Stdin: strings.NewReader("in"), Stdout: &stdout, Allocator: allocator, MaxInstructions: 1 << 20, Natives: testNatives}
+			machine, err := NewVmFromProgram(program, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = machine.Run()
+			results[name] = fmt.Sprintf("%q, %v, %d bytes", stdout.String(), err, machine.Heap.Allocated())
+			machine.Close()
+		}
+		for name, result := range results {
+			if result != results["go"] {
+				t.Errorf("%s: the %s allocator gave %s, the go allocator %s", path, name, result, results["go"])
+			}
+		}
+	}
+}
+
+// TestAllocatorsStoreObjectsAlike checks that blocks hold the same bytes
+// whichever allocator provides them.
+func TestAllocatorsStoreObjectsAlike(t *testing.T) {
+	contents := make(map[string][]string)
+	for name, allocator := range heap.Allocators() {
+		h := heap.NewHeapWithAllocator(allocator)
+		str, err := h.AllocateString("hello")
+		if err != nil {
+			t.Fatal(err)
+		}
+		array, err := h.AllocateArray(ValueInt32, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := h.SetArrayElement(array, 2, Int32Value(-7)); err != nil {
+			t.Fatal(err)
+		}
+		if err := h.SetArrayElement(array, 3, Int32Value(1)); err == nil {
+			t.Errorf("%s: expected a write past the end of the array to fail", name)
+		}
+		large, err := h.Allocate(3 * 4096)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, ptr := range []uintptr{str, array, large} {
+			contents[name] = append(contents[name], fmt.Sprintf("% x", h.Memory[ptr]))
+		}
+		if err := h.Release(); err != nil {
+			t.Errorf("%s: failed to release the heap: %v", name, err)
+		}
+		if h.Allocated() != 0 {
+			t.Errorf("%s: expected an empty heap after Release, %d bytes left", name, h.Allocated())
+		}
+	}
+	for name, blocks := range contents {
+		if fmt.Sprint(blocks) != fmt.Sprint(contents["go"]) {
+			t.Errorf("The %s allocator stored %v, the go allocator %v", name, blocks, contents["go"])
+		}
+	}
+}
+
+// TestHeapLayoutIsPacked checks that array elements and struct fields are
+// packed at unaligned offsets and read back from there on every host, 32-bit
+// ones included.
+func TestHeapLayoutIsPacked(t *testing.T) {
+	h := heap.NewHeap()
+	defer h.Release()
+	ptrs, err := h.AllocateArray(ValuePtr, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	floats, err := h.AllocateArray(ValueFloat32, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := h.SetArrayElement(ptrs, 1, PtrValue(0x01020304)); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.SetArrayElement(floats, 1, Float32Value(1.5)); err != nil {
+		t.Fatal(err)
+	}
+	node := StructType{Name: "Node", Size: 12, Fields: []StructField{
+		{Name: "n", Type: ValueInt32, Offset: 0},
+		{Name: "next", Type: ValuePtr, Offset: 4},
+	}}
+	str, err := h.AllocateStruct(node)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := h.SetStructureField(str, "next", PtrValue(ptrs)); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.SetStructureField(str, "n", Int32Value(-2)); err != nil {
+		t.Fatal(err)
+	}
+
+	// the second pointer at 6+8, the second float at 6+4 and the pointer
+	// field at 5+4
+	if got, want := h.Memory[ptrs][14:], []byte{0, 0, 0, 0, 1, 2, 3, 4}; !bytes.Equal(got, want) {
+		t.Errorf("Expected the pointer element to be stored as % x, got % x", want, got)
+	}
+	if got, want := h.Memory[floats][10:], []byte{0x3f, 0xc0, 0, 0}; !bytes.Equal(got, want) {
+		t.Errorf("Expected the float32 element to be stored as % x, got % x", want, got)
+	}
+	if got := h.Memory[str][5:9]; !bytes.Equal(got, []byte{0xff, 0xff, 0xff, 0xfe}) {
+		t.Errorf("Expected the int32 field to be stored as ff ff ff fe, got % x", got)
+	}
+	if value, err := h.GetArrayElement(ptrs, 1); err != nil || value.Ptr() != 0x01020304 {
+		t.Errorf("Expected to read back the pointer element, got %v, %v", value, err)
+	}
+	if value, err := h.GetArrayElement(floats, 1); err != nil || value.AsFloat32() != 1.5 {
+		t.Errorf("Expected to read back the float32 element, got %v, %v", value, err)
+	}
+	if value, err := h.GetStructField(str, "next"); err != nil || value.Ptr() != ptrs {
+		t.Errorf("Expected to read back the pointer field, got %v, %v", value, err)
+	}
+}
+
+// TestAllocatorsLargeArrays checks arrays spanning several pages with each
+// allocator: elements across page boundaries and at the end are reachable,
+// the heap accounts for the requested size and accesses past the length
+// fail.
+func TestAllocatorsLargeArrays(t *testing.T) {
+	pageSize := os.Getpagesize()
+	length := int32(3*pageSize/4 + 10)
+	for name, allocator := range heap.Allocators() {
+		h := heap.NewHeapWithAllocator(allocator)
+		array, err := h.AllocateArray(ValueInt32, length)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := uintptr(6 + 4*int(length)); h.Allocated() != want || uintptr(len(h.Memory[array])) != want {
+			t.Errorf("%s: expected a block of %d bytes, allocated %d in a block of %d", name, want, h.Allocated(), len(h.Memory[array]))
+		}
+		// elements straddling the end of each page and the ones after them
+		var indexes []int32
+		for page := 1; page <= 3; page++ {
+			indexes = append(indexes, int32((page*pageSize-6)/4), int32((page*pageSize-6)/4+1))
+		}
+		indexes = append(indexes, length-1)
+		for _, index := range indexes {
+			if err := h.SetArrayElement(array, index, Int32Value(index*3)); err != nil {
+				t.Fatalf("%s: writing element %d: %v", name, index, err)
+			}
+		}
+		for _, index := range indexes {
+			if value, err := h.GetArrayElement(array, index); err != nil || value.AsInt32() != index*3 {
+				t.Errorf("%s: expected element %d to be %d, got %v, %v", name, index, index*3, value, err)
+			}
+		}
+		if _, err := h.GetArrayElement(array, length); !errors.Is(err, heap.ErrOutOfBounds) {
+			t.Errorf("%s: expected reading past the end to be out of bounds, got %v", name, err)
+		}
+		if err := h.Free(array); err != nil || h.Allocated() != 0 {
+			t.Errorf("%s: expected freeing the array to empty the heap, got %v with %d bytes left", name, err, h.Allocated())
+		}
+	}
+
+	var out bytes.Buffer
+	if err := RunEmbedded(testPrograms, "testdata/largearray.gvmbc", Options{Stdout: &out}); err != nil {
+		t.Fatal(err)
+	}
+	if want := "47"; out.String() != want {
+		t.Errorf("Expected output %q, got %q", want, out.String())
+	}
+}
@@ -0,0 +1,241 @@
+package vm
+
+import (
+	"errors"
+	"math"
+	"strings"
+	"testing"
+	"testing/quick"
+
+	"github.com/AndreiAlbert/gvm/bytecode"
+	. "github.com/AndreiAlbert/gvm/common"
+)
+
+// edgeInt32s are tried for every pair of operands on top of the random ones
+var edgeInt32s = []int32{0, 1, -1, 2, -2, math.MaxInt32, math.MinInt32, math.MaxInt32 - 1, math.MinInt32 + 1}
+
+var edgeFloat32s = []float32{
+	0, float32(math.Copysign(0, -1)), 1, -1, 0.1, math.MaxFloat32, -math.MaxFloat32,
+	math.SmallestNonzeroFloat32, float32(math.Inf(1)), float32(math.Inf(-1)), float32(math.NaN()),
+}
+
+func pushValue(value Value) []byte {
+	raw := value.Raw()
+	return []byte{byte(PUSH), byte(value.Kind()), byte(raw >> 24), byte(raw >> 16), byte(raw >> 8), byte(raw)}
+}
+
+// evalBinary pushes a then b, runs op and returns the value it leaves on
+// the stack
+func evalBinary(t *testing.T, op Opcode, a, b Value) (Value, error) {
+	t.Helper()
+	program := &bytecode.Program{
+		Functions: []bytecode.Function{{Name: "main", IsMain: true, ReturnType: ValueVoid}},
+		Code:      join(pushValue(a), pushValue(b), []byte{byte(op), byte(HALT)}),
+	}
+	machine, err := NewVmFromProgram(program, Options{MaxInstructions: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer machine.Close()
+	if err := machine.Run(); err != nil {
+		return Value{}, err
+	}
+	return machine.pop(), nil
+}
+
+// checkInt32Op asserts that op computes want, on random and edge operands.
+// want reports false for operands op must reject.
+func checkInt32Op(t *testing.T, op Opcode, want func(a, b int32) (int32, bool)) {
+	t.Helper()
+	check := func(a, b int32) bool {
+		got, err := evalBinary(t, op, Int32Value(a), Int32Value(b))
+		expected, ok := want(a, b)
+		if !ok {
+			if err == nil {
+				t.Errorf("%d %v %d: expected an error, got %v", a, op, b, got)
+			}
+			return err != nil
+		}
+		if err != nil || got.Kind() != ValueInt32 || got.AsInt32() != expected {
+			t.Errorf("%d %v %d: expected %d, got %v, %v", a, op, b, expected, got, err)
+			return false
+		}
+		return true
+	}
+	for _, a := range edgeInt32s {
+		for _, b := range edgeInt32s {
+			check(a, b)
+		}
+	}
+	if err := quick.Check(check, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func sameFloat32(a, b float32) bool {
+	return math.Float32bits(a) == math.Float32bits(b) || a != a && b != b
+}
+
+func checkFloat32Op(t *testing.T, op Opcode, want func(a, b float32) (float32, bool)) {
+	t.Helper()
+	check := func(a, b float32) bool {
+		got, err := evalBinary(t, op, Float32Value(a), Float32Value(b))
+		expected, ok := want(a, b)
+		if !ok {
+			if err == nil {
+				t.Errorf("%v %v %v: expected an error, got %v", a, op, b, got)
+			}
+			return err != nil
+		}
+		if err != nil || got.Kind() != ValueFloat32 || !sameFloat32(got.AsFloat32(), expected) {
+			t.Errorf("%v %v %v: expected %v, got %v, %v", a, op, b, expected, got, err)
+			return false
+		}
+		return true
+	}
+	for _, a := range edgeFloat32s {
+		for _, b := range edgeFloat32s {
+			check(a, b)
+		}
+	}
+	if err := quick.Check(check, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestIntegerArithmeticMatchesGo(t *testing.T) {
+	checkInt32Op(t, IADD, func(a, b int32) (int32, bool) { return a + b, true })
+	checkInt32Op(t, ISUB, func(a, b int32) (int32, bool) { return a - b, true })
+	checkInt32Op(t, IMUL, func(a, b int32) (int32, bool) { return a * b, true })
+	// MinInt32 / -1 wraps to MinInt32 as in Go, dividing by zero fails.
+	// The divisor is pushed last.
+	checkInt32Op(t, IDIV, func(a, b int32) (int32, bool) {
+		if b == 0 {
+			return 0, false
+		}
+		return a / b, true
+	})
+}
+
+func TestFloatArithmeticMatchesGo(t *testing.T) {
+	checkFloat32Op(t, FADD, func(a, b float32) (float32, bool) { return a + b, true })
+	checkFloat32Op(t, FSUB, func(a, b float32) (float32, bool) { return a - b, true })
+	checkFloat32Op(t, FMUL, func(a, b float32) (float32, bool) { return a * b, true })
+	// dividing by zero gives an infinity or NaN, as in Go
+	checkFloat32Op(t, FDIV, func(a, b float32) (float32, bool) { return a / b, true })
+}
+
+func TestDivisionOperands(t *testing.T) {
+	for _, test := range []struct{ a, b, want int32 }{
+		{7, 2, 3},
+		{0, 5, 0},
+		{-7, 2, -3},
+		{math.MinInt32, -1, math.MinInt32},
+	} {
+		got, err := evalBinary(t, IDIV, Int32Value(test.a), Int32Value(test.b))
+		if err != nil || got.AsInt32() != test.want {
+			t.Errorf("%d / %d: expected %d, got %v, %v", test.a, test.b, test.want, got, err)
+		}
+	}
+	if got, err := evalBinary(t, FDIV, Float32Value(1), Float32Value(4)); err != nil || got.AsFloat32() != 0.25 {
+		t.Errorf("1 / 4: expected 0.25, got %v, %v", got, err)
+	}
+}
+
+func TestDivisionByZero(t *testing.T) {
+	// TRY 17 catches the IDIV, the handler halts with the Error value
+	code := join([]byte{byte(TRY), 0, 17}, pushValue(Int32Value(1)), pushValue(Int32Value(0)), []byte{byte(IDIV), byte(HALT), byte(HALT)})
+	program := &bytecode.Program{
+		Functions: []bytecode.Function{{Name: "main", IsMain: true, ReturnType: ValueVoid}},
+		Code:      code,
+	}
+	machine, err := NewVmFromProgram(program, Options{MaxInstructions: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer machine.Close()
+	if err := machine.Run(); err != nil {
+		t.Fatalf("Expected the division to be caught, got %v", err)
+	}
+	if caught, err := machine.Heap.GetStructField(machine.pop().Ptr(), "code"); err != nil || int32(caught.Raw()) != CodeDivisionByZero {
+		t.Errorf("Expected the code %d, got %v, %v", CodeDivisionByZero, caught, err)
+	}
+
+	program.Code = join(pushValue(Float32Value(1)), pushValue(Float32Value(0)), []byte{byte(FDIV), byte(HALT)})
+	trapping, err := NewVmFromProgram(program, Options{TrapFloatDivision: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer trapping.Close()
+	if err := trapping.Run(); !errors.Is(err, ErrDivisionByZero) {
+		t.Errorf("Expected FDIV by zero to trap, got %v", err)
+	}
+}
+
+func TestArithmeticRejectsMixedKinds(t *testing.T) {
+	for _, op := range []Opcode{IADD, ISUB, IMUL, IDIV} {
+		if _, err := evalBinary(t, op, Int32Value(1), Float32Value(1)); err == nil {
+			t.Errorf("Expected %v of an int and a float to fail", op)
+		}
+	}
+	for _, op := range []Opcode{FADD, FSUB, FMUL, FDIV} {
+		if _, err := evalBinary(t, op, Float32Value(1), Int32Value(1)); err == nil {
+			t.Errorf("Expected %v of a float and an int to fail", op)
+		}
+	}
+}
+
+func TestComparisonsMatchGo(t *testing.T) {
+	compare := map[Opcode]func(a, b int32) bool{
+		EQ: func(a, b int32) bool { return a == b },
+		NE: func(a, b int32) bool { return a != b },
+		LT: func(a, b int32) bool { return a < b },
+		LE: func(a, b int32) bool { return a <= b },
+		GT: func(a, b int32) bool { return a > b },
+		GE: func(a, b int32) bool { return a >= b },
+	}
+	for op, want := range compare {
+		checkInt32Op(t, op, func(a, b int32) (int32, bool) {
+			if want(a, b) {
+				return 1, true
+			}
+			return 0, true
+		})
+	}
+}
+
+// TestOldContainersSubtractingAreRefused checks that containers assembled
+// for the reversed order of ISUB don't run with the current one.
+func TestOldContainersSubtractingAreRefused(t *testing.T) {
+	code := join(pushValue(Int32Value(7)), pushValue(Int32Value(2)), []byte{byte(ISUB), byte(HALT)})
+	for _, version := range []uint16{1, bytecode.SubtractionOrderVersion - 1} {
+		program := &bytecode.Program{
+			Version:   version,
+			Functions: []bytecode.Function{{Name: "main", IsMain: true, ReturnType: ValueVoid}},
+			Code:      code,
+		}
+		if _, err := NewVmFromProgram(program, Options{}); err == nil || !strings.Contains(err.Error(), "assemble the program again") {
+			t.Errorf("Expected version %d to be refused, got %v", version, err)
+		}
+		// without a subtraction the order doesn't matter
+		program.Code = join(pushValue(Int32Value(7)), pushValue(Int32Value(2)), []byte{byte(IADD), byte(HALT)})
+		machine, err := NewVmFromProgram(program, Options{})
+		if err != nil {
+			t.Fatalf("Expected version %d to load, got %v", version, err)
+		}
+		machine.Close()
+	}
+	program := &bytecode.Program{
+		Version:   bytecode.SubtractionOrderVersion,
+		Functions: []bytecode.Function{{Name: "main", IsMain: true, ReturnType: ValueVoid}},
+		Code:      code,
+	}
+	machine, err := NewVmFromProgram(program, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer machine.Close()
+	if err := machine.Run(); err != nil || machine.pop().AsInt32() != 5 {
+		t.Errorf("Expected 7 - 2 to be 5, got %v", err)
+	}
+}
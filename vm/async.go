@@ -0,0 +1,87 @@
+package vm
+
+import (
+	"context"
+	"fmt"
+
+	. "github.com/AndreiAlbert/gvm/common"
+	"github.com/AndreiAlbert/gvm/heap"
+)
+
+// maxPendingCalls bounds the calls of async natives a program may have
+// started without awaiting them
+const maxPendingCalls = 1024
+
+// pendingCall is a call of an async native whose work runs on its own
+// goroutine. done is closed once result and err are set.
+type pendingCall struct {
+	native *boundNative
+	done   chan struct{}
+	result any
+	err    error
+}
+
+// startAsync calls the async native with args and runs the work it returns
+// on a goroutine, pushing the handle of the call
+func (v *VM) startAsync(native *boundNative, args []Value) {
+	if len(v.pending) >= maxPendingCalls {
+		v.failf("native %s: %d async calls are pending", native.Name, len(v.pending))
+	}
+	work, err := native.async(v, args)
+	if err != nil {
+		v.fail(fmt.Errorf("native %s: %w", native.Name, err))
+	}
+	call := &pendingCall{native: native, done: make(chan struct{})}
+	go func() {
+		defer close(call.done)
+		defer func() {
+			if r := recover(); r != nil {
+				call.err = fmt.Errorf("panic: %v", r)
+			}
+		}()
+		call.result, call.err = work()
+	}()
+	if v.pending == nil {
+		v.pending = make(map[int32]*pendingCall)
+	}
+	v.nextHandle++
+	v.pending[v.nextHandle] = call
+	v.push(Int32Value(v.nextHandle))
+}
+
+// await waits for the pending call whose handle is on top of the stack and
+// pushes its result. It blocks the whole interpreter: no other instruction
+// runs, and Pause and collections wait until it returns. Waiting stops with
+// the error of the context passed to RunContext once it is done.
+func (v *VM) await() {
+	handle := v.pop()
+	if handle.Kind() != ValueInt32 {
+		v.fail(fmt.Errorf("%w: awaiting %v, expected the int32 handle of a native call", heap.ErrTypeMismatch, handle.Kind()))
+	}
+	call, ok := v.pending[handle.AsInt32()]
+	if !ok {
+		v.failf("there is no pending native call %d", handle.AsInt32())
+	}
+	ctx := v.runContext
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	select {
+	case <-call.done:
+	case <-ctx.Done():
+		v.fail(ctx.Err())
+	}
+	delete(v.pending, handle.AsInt32())
+	native := call.native
+	if call.err != nil {
+		v.fail(fmt.Errorf("native %s: %w", native.Name, call.err))
+	}
+	result, err := v.Marshal(call.result)
+	if err != nil {
+		v.fail(fmt.Errorf("native %s: result: %w", native.Name, err))
+	}
+	if !v.nativeKind(native.ReturnType, result) {
+		v.failf("native %s returned %v, expected %v", native.Signature(), result.Kind(), native.ReturnType)
+	}
+	v.push(result)
+}
@@ -0,0 +1,112 @@
+package vm
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AndreiAlbert/gvm/bytecode"
+	. "github.com/AndreiAlbert/gvm/common"
+)
+
+func TestAsyncNatives(t *testing.T) {
+	program, err := bytecode.Decode(mustReadTestProgram(t, "testdata/async.gvmbc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	machine, err := NewVmFromProgram(program, Options{Stdout: &out, Natives: testNatives})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer machine.Close()
+	if err := machine.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(out.String(), `0("hello vm"`) || len(machine.pending) != 0 {
+		t.Errorf("output %q with %d calls pending", out.String(), len(machine.pending))
+	}
+
+	// a native registered synchronously doesn't bind to an async declaration
+	natives := map[string]Native{
+		"double": {Params: []ValueKind{ValueInt32}, Returns: ValueInt32, Func: testNatives["add"].Func},
+		"greet":  testNatives["greet"],
+	}
+	if _, err := NewVmFromProgram(program, Options{Natives: natives}); err == nil || !strings.Contains(err.Error(), "native async double(int32) -> int32 is declared by the program") {
+		t.Errorf("expected a sync native to be refused for an async declaration, got %v", err)
+	}
+}
+
+// asyncTestMachine loads the async test program with natives running double
+// as the work of the double calls and calling greet when greet is started.
+// Both get the same release channel.
+func asyncTestMachine(t *testing.T, double func(release chan struct{}) (any, error), greet func(release chan struct{})) *VM {
+	t.Helper()
+	program, err := bytecode.Decode(mustReadTestProgram(t, "testdata/async.gvmbc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	release := make(chan struct{})
+	natives := map[string]Native{
+		"double": {Params: []ValueKind{ValueInt32}, Returns: ValueInt32, Async: func(*VM, []Value) (func() (any, error), error) {
+			return func() (any, error) { return double(release) }, nil
+		}},
+		"greet": {Params: []ValueKind{ValueString}, Returns: ValueString, Async: func(*VM, []Value) (func() (any, error), error) {
+			greet(release)
+			return func() (any, error) { return "", nil }, nil
+		}},
+	}
+	machine, err := NewVmFromProgram(program, Options{Stdout: &bytes.Buffer{}, Natives: natives})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { machine.Close() })
+	return machine
+}
+
+func TestAsyncCallsOverlap(t *testing.T) {
+	// the first double only returns once the program has started greet
+	machine := asyncTestMachine(t, func(release chan struct{}) (any, error) {
+		<-release
+		return int32(8), nil
+	}, func(release chan struct{}) {
+		select {
+		case <-release:
+		default:
+			close(release)
+		}
+	})
+	done := make(chan error)
+	go func() { done <- machine.Run() }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("the program blocked on a call it didn't await")
+	}
+}
+
+func TestAwaitErrors(t *testing.T) {
+	failed := errors.New("unreachable host")
+	machine := asyncTestMachine(t, func(chan struct{}) (any, error) {
+		return nil, failed
+	}, func(chan struct{}) {})
+	if err := machine.Run(); !errors.Is(err, failed) {
+		t.Errorf("expected the error of the native, got %v", err)
+	}
+
+	machine = asyncTestMachine(t, func(release chan struct{}) (any, error) {
+		<-release
+		return int32(0), nil
+	}, func(chan struct{}) {})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := machine.RunContext(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected awaiting to stop with the context, got %v", err)
+	}
+}
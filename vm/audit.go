@@ -0,0 +1,110 @@
+package vm
+
+import (
+	"encoding/json"
+	"fmt"
+	. "github.com/AndreiAlbert/gvm/common"
+	"time"
+)
+
+// maxAuditString is the number of bytes of a string argument kept in audit
+// entries, longer strings are cut and their full length recorded
+const maxAuditString = 64
+
+// auditEntry is one line of the syscall audit log
+type auditEntry struct {
+	Time      string       `json:"time"`
+	Execution string       `json:"execution,omitempty"`
+	Ip        uint         `json:"ip"`
+	Syscall   string       `json:"syscall"`
+	Args      []auditValue `json:"args"`
+	Results   []auditValue `json:"results"`
+	Error     string       `json:"error,omitempty"`
+}
+
+// auditValue describes an argument or result. Pointers to strings also
+// carry the string, redacted to maxAuditString bytes.
+type auditValue struct {
+	Kind   string `json:"kind"`
+	Value  any    `json:"value"`
+	String string `json:"string,omitempty"`
+	// Length is the full length of a redacted string
+	Length int `json:"length,omitempty"`
+}
+
+// auditSystemCall executes call and writes an audit entry with the values
+// it consumed and produced, or the error it failed with.
+func (v *VM) auditSystemCall(call Systemcall) {
+	signature := syscallSignatures[call]
+	entry := auditEntry{
+		Time:      time.Now().UTC().Format(time.RFC3339Nano),
+		Execution: v.auditID,
+		Ip:        v.instructionStart,
+		Syscall:   call.String(),
+		Args:      v.auditValues(len(signature.Pops)),
+		Results:   []auditValue{},
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			if runtimeErr, ok := r.(*RuntimeError); ok {
+				entry.Error = runtimeErr.Err.Error()
+			} else {
+				entry.Error = fmt.Sprint(r)
+			}
+			v.writeAudit(entry)
+			panic(r)
+		}
+	}()
+	v.executeSystemCall(call)
+	entry.Results = v.auditValues(len(signature.Pushes))
+	if err := v.writeAudit(entry); err != nil {
+		// an audit log that silently drops entries is worse than none
+		v.fail(fmt.Errorf("audit log: %w", err))
+	}
+}
+
+func (v *VM) writeAudit(entry auditEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	_, err = v.auditLog.Write(append(line, '\n'))
+	return err
+}
+
+// auditValues describes the top n values of the operand stack, top first
+func (v *VM) auditValues(n int) []auditValue {
+	values := []auditValue{}
+	if len(v.CallStack) == 0 {
+		return values
+	}
+	stack := v.getCurrentFrame().LocalStack
+	for i := len(stack) - 1; i >= 0 && i >= len(stack)-n; i-- {
+		values = append(values, v.auditValue(stack[i]))
+	}
+	return values
+}
+
+func (v *VM) auditValue(value Value) auditValue {
+	av := auditValue{Kind: value.Kind().String()}
+	switch value.Kind() {
+	case ValueInt32:
+		av.Value = int32(value.Raw())
+	case ValueByte:
+		av.Value = byte(value.Raw())
+	case ValueFloat32:
+		av.Value = value.AsFloat32()
+	case ValuePtr:
+		av.Value = value.Ptr()
+		if s, err := v.Heap.LoadString(value.Ptr()); err == nil {
+			av.String = s
+			if len(s) > maxAuditString {
+				av.String = s[:maxAuditString]
+				av.Length = len(s)
+			}
+		}
+	default:
+		av.Value = value.Raw()
+	}
+	return av
+}
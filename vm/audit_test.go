@@ -0,0 +1,73 @@
+package vm
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestAuditLog(t *testing.T) {
+	data, err := testPrograms.ReadFile("testdata/strings.gvmbc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stdout, audit bytes.Buffer
+	opts := Options{Stdout: &stdout, AuditLog: &audit, AuditID: "run-1"}
+	if err := RunReader(bytes.NewReader(data), opts); err != nil {
+		t.Fatalf("Failed to run: %v", err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(audit.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("Expected 3 audit entries, got %d:\n%s", len(lines), audit.String())
+	}
+	var entries []auditEntry
+	for _, line := range lines {
+		var entry auditEntry
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("Invalid audit line %q: %v", line, err)
+		}
+		if entry.Execution != "run-1" || entry.Time == "" {
+			t.Errorf("Missing execution id or time in %q", line)
+		}
+		entries = append(entries, entry)
+	}
+
+	cat := entries[0]
+	if cat.Syscall != "STR_CAT" || len(cat.Args) != 2 || len(cat.Results) != 1 {
+		t.Fatalf("Unexpected str_cat entry: %+v", cat)
+	}
+	long := cat.Args[0]
+	if long.Length != 74 || len(long.String) != maxAuditString {
+		t.Errorf("Expected the long argument redacted to %d of 74 bytes, got %d of %d", maxAuditString, len(long.String), long.Length)
+	}
+	if cat.Args[1].String != "short" || cat.Args[1].Length != 0 {
+		t.Errorf("Expected the short argument in full, got %+v", cat.Args[1])
+	}
+	if entries[1].Syscall != "STR_LEN" || entries[1].Results[0].Value != float64(79) {
+		t.Errorf("Unexpected str_len entry: %+v", entries[1])
+	}
+	if entries[2].Syscall != "WRITE_BYTE" || entries[2].Args[0].Value != float64('!') || len(entries[2].Results) != 0 {
+		t.Errorf("Unexpected write_byte entry: %+v", entries[2])
+	}
+}
+
+func TestAuditLogRecordsFailures(t *testing.T) {
+	data, err := testPrograms.ReadFile("testdata/echo.gvmbc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var audit bytes.Buffer
+	err = RunReader(bytes.NewReader(data), Options{Stdin: strings.NewReader(""), Stdout: &bytes.Buffer{}, AuditLog: &audit})
+	if err == nil {
+		t.Fatal("Expected reading past the end of stdin to fail")
+	}
+	var entry auditEntry
+	if err := json.Unmarshal(bytes.TrimSpace(audit.Bytes()), &entry); err != nil {
+		t.Fatalf("Invalid audit log %q: %v", audit.String(), err)
+	}
+	if entry.Syscall != "READ_BYTE" || entry.Error == "" {
+		t.Errorf("Expected a failed read_byte entry, got %+v", entry)
+	}
+}
@@ -0,0 +1,94 @@
+package vm
+
+import (
+	"fmt"
+
+	. "github.com/AndreiAlbert/gvm/common"
+)
+
+// defaultCallbackDepth is the number of guest functions called by natives
+// that may run at once when Options.MaxCallbackDepth is zero
+const defaultCallbackDepth = 64
+
+// CallFunction calls the guest function name with args and runs it to
+// completion, returning its result, or the zero Value for a void function.
+// Natives call it to hand control back to the program, such as a sort
+// calling a comparator of the program. The call runs on top of the call
+// stack: what the function does is part of the run, it counts towards
+// Options.MaxInstructions and its own handlers catch its errors. An error
+// it doesn't catch is returned, with the call stack unwound to the native.
+func (v *VM) CallFunction(name string, args ...Value) (Value, error) {
+	for i, f := range v.functionList {
+		if f.Name == name {
+			return v.callback(i, args)
+		}
+	}
+	return Value{}, fmt.Errorf("no function %s", name)
+}
+
+// CallClosure is CallFunction for a function reference of the program, a
+// closure made by MAKECLOSURE and passed to the native. The captured values
+// come before args.
+func (v *VM) CallClosure(closure Value, args ...Value) (Value, error) {
+	index, captured, err := v.closureOf(closure)
+	if err != nil {
+		return Value{}, err
+	}
+	return v.callback(index, append(append([]Value(nil), captured...), args...))
+}
+
+// callback runs the function at index from a native
+func (v *VM) callback(index int, args []Value) (Value, error) {
+	f := v.functionList[index]
+	name := displayName(f)
+	if len(args) != int(f.ParamCount) {
+		return Value{}, fmt.Errorf("%s takes %d arguments, got %d", name, f.ParamCount, len(args))
+	}
+	limit := v.maxCallbackDepth
+	if limit == 0 {
+		limit = defaultCallbackDepth
+	}
+	if v.callbacks >= limit {
+		return Value{}, fmt.Errorf("%w: calling %s with %d callbacks running", ErrCallbackDepth, name, v.callbacks)
+	}
+
+	ip, instructionStart, wide, running := v.Ip, v.instructionStart, v.wide, v.Running
+	depth, handlers := len(v.CallStack), len(v.handlers)
+	v.callbacks++
+	defer func() {
+		v.callbacks--
+		v.Ip, v.instructionStart, v.wide, v.Running = ip, instructionStart, wide, running
+		v.CallStack = v.CallStack[:depth]
+		v.handlers = v.handlers[:handlers]
+	}()
+	v.Running = true
+	// the result is returned to a scratch frame on top of the frame of the
+	// native's caller
+	v.pushFrame(StackFrame{Locals: make(map[uint32]Value), ReturnAddress: ip})
+	v.pushFrame(f.newFrame(ip))
+	for _, arg := range args {
+		v.push(arg)
+	}
+	v.Ip = f.Address
+	for len(v.CallStack) > depth+1 {
+		if !v.Running {
+			return Value{}, fmt.Errorf("%s halted the program", name)
+		}
+		if v.safepoint.requested.Load() {
+			v.safepoint.park()
+		}
+		// handlers of the program below the native don't catch its errors:
+		// the native gets them
+		if err := v.stepRecovering(); err != nil && (len(v.handlers) == handlers || !v.catch(err)) {
+			return Value{}, fmt.Errorf("%s failed: %w", name, err)
+		}
+	}
+	stack := v.CallStack[depth].LocalStack
+	switch {
+	case f.ReturnType == ValueVoid:
+		return Value{}, nil
+	case len(stack) != 1:
+		return Value{}, fmt.Errorf("%s returned %d values", name, len(stack))
+	}
+	return stack[0], nil
+}
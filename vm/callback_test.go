@@ -0,0 +1,67 @@
+package vm
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/AndreiAlbert/gvm/bytecode"
+	. "github.com/AndreiAlbert/gvm/common"
+	"github.com/AndreiAlbert/gvm/heap"
+)
+
+func TestCallback(t *testing.T) {
+	program, err := bytecode.Decode(mustReadTestProgram(t, "testdata/callback.gvmbc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	machine, err := NewVmFromProgram(program, Options{Stdout: &out, Natives: testNatives})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer machine.Close()
+	if err := machine.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "345" {
+		t.Errorf("output %q, expected the array sorted by the guest comparator", out.String())
+	}
+	if machine.callbacks != 0 {
+		t.Errorf("%d callbacks left running", machine.callbacks)
+	}
+
+	frames := len(machine.CallStack)
+	result, err := machine.CallFunction("compare", Int32Value(2), Int32Value(5))
+	if err != nil || result != Int32Value(-3) {
+		t.Errorf("compare(2, 5) gave %v, %v", result, err)
+	}
+	if len(machine.CallStack) != frames {
+		t.Errorf("%d frames after the call, %d before", len(machine.CallStack), frames)
+	}
+	if _, err := machine.CallFunction("compare", Int32Value(2)); err == nil {
+		t.Error("expected a call with too few arguments to fail")
+	}
+	if _, err := machine.CallClosure(Int32Value(1)); !errors.Is(err, heap.ErrTypeMismatch) {
+		t.Errorf("expected calling a non-closure to fail, got %v", err)
+	}
+}
+
+func TestCallbackDepth(t *testing.T) {
+	program, err := bytecode.Decode(mustReadTestProgram(t, "testdata/callback.gvmbc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// sort calls main, which calls sort again
+	natives := map[string]Native{"sort": {Params: []ValueKind{ValuePtr, ValuePtr}, Returns: ValueVoid, Func: func(v *VM, args []Value) (Value, error) {
+		return v.CallFunction("main")
+	}}}
+	machine, err := NewVmFromProgram(program, Options{Natives: natives, MaxCallbackDepth: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer machine.Close()
+	if err := machine.Run(); !errors.Is(err, ErrCallbackDepth) {
+		t.Errorf("expected the callback depth to be exceeded, got %v", err)
+	}
+}
@@ -0,0 +1,77 @@
+package vm
+
+import (
+	"fmt"
+
+	. "github.com/AndreiAlbert/gvm/common"
+	"github.com/AndreiAlbert/gvm/heap"
+)
+
+// makeClosure pops the count values on top of the stack into the
+// environment of a closure of the function at index, and pushes the
+// closure. The captured values are the first parameters of the function.
+func (v *VM) makeClosure(index uint32, count int) {
+	if int(index) >= len(v.functionList) {
+		v.failf("function not found at index: %d", index)
+	}
+	if f := v.functionList[index]; int(f.ParamCount) < count {
+		v.failf("MAKECLOSURE captures %d values for %s, which takes %d parameters", count, displayName(f), f.ParamCount)
+	}
+	if stack := v.getCurrentFrame().LocalStack; len(stack) < count {
+		v.failf("MAKECLOSURE captures %d values, the stack holds %d", count, len(stack))
+	}
+	captured := make([]Value, count)
+	for i := count - 1; i >= 0; i-- {
+		captured[i] = v.pop()
+	}
+	ptr, err := v.Heap.AllocateClosure(index, captured)
+	if err != nil {
+		v.fail(err)
+	}
+	v.push(PtrValue(ptr))
+}
+
+// callClosure pops the closure on top of the stack and calls its function,
+// with the captured values followed by the arguments below the closure.
+func (v *VM) callClosure() {
+	index, captured, err := v.closureOf(v.pop())
+	if err != nil {
+		v.fail(err)
+	}
+	argCount := int(v.functionList[index].ParamCount) - len(captured)
+	if stack := v.getCurrentFrame().LocalStack; len(stack) < argCount {
+		v.failf("CALLCLOSURE needs %d arguments, the stack holds %d", argCount, len(stack))
+	}
+	args := make([]Value, argCount)
+	for i := argCount - 1; i >= 0; i-- {
+		args[i] = v.pop()
+	}
+	for _, value := range captured {
+		v.push(value)
+	}
+	for _, value := range args {
+		v.push(value)
+	}
+	v.call(index)
+}
+
+// closureOf returns the function index and the captured values of the
+// closure value refers to. Anything but a closure of a function taking the
+// captured values is a catchable type mismatch.
+func (v *VM) closureOf(value Value) (int, []Value, error) {
+	if value.Kind() != ValuePtr {
+		return 0, nil, fmt.Errorf("%w: calling a closure, got %v", heap.ErrTypeMismatch, value.Kind())
+	}
+	function, captured, err := v.Heap.LoadClosure(value.Ptr())
+	if err != nil {
+		return 0, nil, fmt.Errorf("calling a closure: %w", err)
+	}
+	if int(function) >= len(v.functionList) {
+		return 0, nil, fmt.Errorf("%w: closure of unknown function %d", heap.ErrTypeMismatch, function)
+	}
+	if f := v.functionList[function]; int(f.ParamCount) < len(captured) {
+		return 0, nil, fmt.Errorf("%w: closure of %s captures %d values, it takes %d parameters",
+			heap.ErrTypeMismatch, displayName(f), len(captured), f.ParamCount)
+	}
+	return int(function), captured, nil
+}
@@ -0,0 +1,343 @@
+package vm
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+
+	"github.com/AndreiAlbert/gvm/bytecode"
+	. "github.com/AndreiAlbert/gvm/common"
+	"github.com/AndreiAlbert/gvm/heap"
+)
+
+// coreMagic starts crash dump files
+var coreMagic = [4]byte{'G', 'V', 'M', 'C'}
+
+// coreVersion is the version of the crash dump format
+const coreVersion = 2
+
+// Core is the state of a VM stopped by a runtime error, as saved in a crash
+// dump: the call stack with the locals and operand stacks of every frame,
+// the TRY handlers and the heap. NewVmFromCore loads it back for post-mortem
+// debugging.
+type Core struct {
+	// Program is the file the program was loaded from, empty if unknown
+	Program string
+	// CodeHash is the SHA-256 of the code that was running
+	CodeHash [sha256.Size]byte
+	// Err is the error that stopped the program
+	Err string
+	// Trace names the functions on the call stack, innermost first
+	Trace []string
+	// Address is the address of the instruction that failed
+	Address      uint
+	Instructions uint64
+	frames       []coreFrame
+	handlers     []handler
+	blocks       []heap.Block
+	structNames  []string
+}
+
+// coreFrame is a frame of the call stack saved in a Core
+type coreFrame struct {
+	// function is the index of the function in FunctionList, -1 for the
+	// initial frame
+	function      int
+	returnAddress uint
+	locals        map[uint32]Value
+	stack         []Value
+}
+
+// Core saves the state of the VM after err stopped it. program is the file
+// the program was loaded from, recorded so gvm debug can find it. The failing
+// instruction may have popped its operands before failing: when the VM
+// records history, it is stepped back first so the core holds the stack the
+// instruction failed on.
+func (v *VM) Core(program string, err error) *Core {
+	address := v.instructionStart
+	if v.History() > 0 {
+		v.StepBack()
+		v.Running = false
+		address = v.Ip
+	}
+	c := &Core{
+		Program:      program,
+		CodeHash:     sha256.Sum256(v.Bytecode),
+		Trace:        v.backtraceNames(),
+		Address:      address,
+		Instructions: v.instructions,
+		handlers:     append([]handler(nil), v.handlers...),
+	}
+	if err != nil {
+		c.Err = err.Error()
+	}
+	for _, frame := range v.CallStack {
+		saved := coreFrame{
+			function:      -1,
+			returnAddress: frame.ReturnAddress,
+			locals:        make(map[uint32]Value, len(frame.Locals)),
+			stack:         append([]Value(nil), frame.LocalStack...),
+		}
+		for i := range v.functionList {
+			if frame.Function == &v.functionList[i] {
+				saved.function = i
+			}
+		}
+		for index, value := range frame.Locals {
+			saved.locals[index] = value
+		}
+		c.frames = append(c.frames, saved)
+	}
+	c.blocks, c.structNames = v.Heap.Snapshot()
+	return c
+}
+
+// WriteTo writes the core in the crash dump format.
+func (c *Core) WriteTo(w io.Writer) (int64, error) {
+	var b coreWriter
+	b.Write(coreMagic[:])
+	binary.Write(&b, binary.BigEndian, uint16(coreVersion))
+	b.str(c.Program)
+	b.Write(c.CodeHash[:])
+	b.str(c.Err)
+	b.u32(uint32(len(c.Trace)))
+	for _, name := range c.Trace {
+		b.str(name)
+	}
+	b.u64(uint64(c.Address))
+	b.u64(c.Instructions)
+	b.u32(uint32(len(c.frames)))
+	for _, frame := range c.frames {
+		b.u32(uint32(int32(frame.function)))
+		b.u64(uint64(frame.returnAddress))
+		indexes := make([]uint32, 0, len(frame.locals))
+		for index := range frame.locals {
+			indexes = append(indexes, index)
+		}
+		slices.Sort(indexes)
+		b.u32(uint32(len(indexes)))
+		for _, index := range indexes {
+			b.u32(index)
+			b.value(frame.locals[index])
+		}
+		b.u32(uint32(len(frame.stack)))
+		for _, value := range frame.stack {
+			b.value(value)
+		}
+	}
+	b.u32(uint32(len(c.handlers)))
+	for _, h := range c.handlers {
+		b.u64(uint64(h.address))
+		b.u32(uint32(h.frame))
+		b.u32(uint32(h.stack))
+	}
+	b.u32(uint32(len(c.structNames)))
+	for _, name := range c.structNames {
+		b.str(name)
+	}
+	b.u32(uint32(len(c.blocks)))
+	for _, block := range c.blocks {
+		b.u64(uint64(block.Address))
+		b.u32(uint32(len(block.Data)))
+		b.Write(block.Data)
+		b.u64(uint64(block.Site.Address))
+		b.str(block.Site.Function)
+		b.u32(block.Site.Line)
+	}
+	n, err := w.Write(b.Bytes())
+	return int64(n), err
+}
+
+type coreWriter struct {
+	bytes.Buffer
+}
+
+func (w *coreWriter) u32(n uint32) {
+	binary.Write(w, binary.BigEndian, n)
+}
+
+func (w *coreWriter) u64(n uint64) {
+	binary.Write(w, binary.BigEndian, n)
+}
+
+func (w *coreWriter) str(s string) {
+	w.u32(uint32(len(s)))
+	w.WriteString(s)
+}
+
+func (w *coreWriter) value(v Value) {
+	w.WriteByte(byte(v.Kind()))
+	w.u64(uint64(v.Ptr()))
+}
+
+// ReadCore reads a crash dump written by Core.WriteTo.
+func ReadCore(r io.Reader) (*Core, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < len(coreMagic)+2 || !bytes.Equal(data[:len(coreMagic)], coreMagic[:]) {
+		return nil, errors.New("not a gvm crash dump")
+	}
+	if version := binary.BigEndian.Uint16(data[len(coreMagic):]); version != coreVersion {
+		return nil, fmt.Errorf("crash dump version %d is not supported, expected %d", version, coreVersion)
+	}
+	d := &coreReader{data: data, pos: len(coreMagic) + 2}
+	c := &Core{Program: d.str()}
+	copy(c.CodeHash[:], d.bytes(sha256.Size))
+	c.Err = d.str()
+	for i := d.count(); i > 0; i-- {
+		c.Trace = append(c.Trace, d.str())
+	}
+	c.Address = uint(d.u64())
+	c.Instructions = d.u64()
+	for i := d.count(); i > 0; i-- {
+		frame := coreFrame{
+			function:      int(int32(d.u32())),
+			returnAddress: uint(d.u64()),
+			locals:        make(map[uint32]Value),
+		}
+		for j := d.count(); j > 0; j-- {
+			index := d.u32()
+			frame.locals[index] = d.value()
+		}
+		for j := d.count(); j > 0; j-- {
+			frame.stack = append(frame.stack, d.value())
+		}
+		c.frames = append(c.frames, frame)
+	}
+	for i := d.count(); i > 0; i-- {
+		c.handlers = append(c.handlers, handler{address: uint(d.u64()), frame: int(d.u32()), stack: int(d.u32())})
+	}
+	for i := d.count(); i > 0; i-- {
+		c.structNames = append(c.structNames, d.str())
+	}
+	for i := d.count(); i > 0; i-- {
+		block := heap.Block{Address: uintptr(d.u64())}
+		block.Data = d.bytes(int(d.u32()))
+		block.Site = heap.Site{Address: uint(d.u64()), Function: d.str(), Line: d.u32()}
+		c.blocks = append(c.blocks, block)
+	}
+	if d.err != nil {
+		return nil, fmt.Errorf("reading crash dump: %w", d.err)
+	}
+	return c, nil
+}
+
+// coreReader decodes a crash dump, remembering the first error
+type coreReader struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+func (r *coreReader) bytes(n int) []byte {
+	if r.err == nil && (n < 0 || n > len(r.data)-r.pos) {
+		r.err = io.ErrUnexpectedEOF
+	}
+	if r.err != nil {
+		return nil
+	}
+	r.pos += n
+	return r.data[r.pos-n : r.pos]
+}
+
+func (r *coreReader) u32() uint32 {
+	if b := r.bytes(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (r *coreReader) u64() uint64 {
+	if b := r.bytes(8); b != nil {
+		return binary.BigEndian.Uint64(b)
+	}
+	return 0
+}
+
+// count reads the length of a list, each element taking at least a byte
+func (r *coreReader) count() int {
+	n := r.u32()
+	if r.err == nil && uint64(n) > uint64(len(r.data)-r.pos) {
+		r.err = fmt.Errorf("list of %d elements in %d bytes", n, len(r.data)-r.pos)
+	}
+	if r.err != nil {
+		return 0
+	}
+	return int(n)
+}
+
+func (r *coreReader) str() string {
+	return string(r.bytes(int(r.u32())))
+}
+
+func (r *coreReader) value() Value {
+	kind := r.bytes(1)
+	payload := r.u64()
+	if kind == nil {
+		return Value{}
+	}
+	return NewValue(ValueKind(kind[0]), payload)
+}
+
+// NewVmFromCore creates a stopped VM holding the state saved in a crash
+// dump, to inspect it with a Debugger. program must be the program that
+// crashed: its code has to match the hash in the core. Ip is the address of
+// the instruction that failed.
+func NewVmFromCore(program *bytecode.Program, core *Core, opts Options) (*VM, error) {
+	if sha256.Sum256(program.Code) != core.CodeHash {
+		return nil, errors.New("the program doesn't match the crash dump, its code changed")
+	}
+	v, err := NewVmFromProgram(program, opts)
+	if err != nil {
+		return nil, err
+	}
+	v.Running = false
+	v.Ip = core.Address
+	v.instructionStart = core.Address
+	v.instructions = core.Instructions
+	v.CallStack = nil
+	for _, saved := range core.frames {
+		frame := StackFrame{
+			Locals:        make(map[uint32]Value, len(saved.locals)),
+			ReturnAddress: saved.returnAddress,
+			LocalStack:    append([]Value(nil), saved.stack...),
+		}
+		if saved.function >= len(v.functionList) {
+			return nil, fmt.Errorf("crash dump frame runs function %d of %d", saved.function, len(v.functionList))
+		} else if saved.function >= 0 {
+			frame.Function = &v.functionList[saved.function]
+		}
+		for index, value := range saved.locals {
+			frame.Locals[index] = value
+		}
+		v.CallStack = append(v.CallStack, frame)
+	}
+	if len(v.CallStack) == 0 {
+		return nil, errors.New("crash dump has no call stack")
+	}
+	for _, h := range core.handlers {
+		if h.frame < 0 || h.frame >= len(v.CallStack) {
+			return nil, fmt.Errorf("crash dump handler in frame %d of %d", h.frame, len(v.CallStack))
+		}
+	}
+	v.handlers = append([]handler(nil), core.handlers...)
+	structTypes := make([]StructType, len(core.structNames))
+	for i, name := range core.structNames {
+		structType, ok := v.structs[name]
+		if !ok {
+			return nil, fmt.Errorf("crash dump heap holds unknown struct %s", name)
+		}
+		structTypes[i] = structType
+	}
+	if err := v.Heap.Restore(core.blocks, structTypes); err != nil {
+		v.Close()
+		return nil, err
+	}
+	return v, nil
+}
@@ -0,0 +1,157 @@
+package vm
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/AndreiAlbert/gvm/bytecode"
+	. "github.com/AndreiAlbert/gvm/common"
+	"github.com/AndreiAlbert/gvm/heap"
+)
+
+func TestCoreRoundTrip(t *testing.T) {
+	program, err := bytecode.Open("testdata/crash.gvmbc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer program.Close()
+	machine, err := NewVmFromProgram(program, Options{Stdout: io.Discard, History: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer machine.Close()
+	runErr := machine.Run()
+	if runErr == nil {
+		t.Fatal("Expected the program to fail")
+	}
+	var buf bytes.Buffer
+	if _, err := machine.Core("testdata/crash.gvmbc", runErr).WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+
+	core, err := ReadCore(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if core.Program != "testdata/crash.gvmbc" || core.Err != runErr.Error() || len(core.Trace) != 2 || core.Trace[0] != "divide" {
+		t.Errorf("Expected the program, error and trace to be saved, got %q, %q, %v", core.Program, core.Err, core.Trace)
+	}
+	restored, err := NewVmFromCore(program, core, Options{Stdout: io.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Close()
+	if inst, _ := decodeInstruction(restored.Bytecode, restored.Ip); inst.Opcode != IDIV || restored.Running {
+		t.Fatalf("Expected a stopped VM at the failing IDIV, got %v", inst.Opcode)
+	}
+	if got := formatSlots(restored.getCurrentFrame().LocalStack, nil); got != "[int32:7 int32:0]" {
+		t.Errorf("Expected the operands IDIV failed on, got %s", got)
+	}
+	if len(restored.CallStack) != 2 || restored.CallStack[1].Function == nil || restored.CallStack[1].Function.Name != "divide" {
+		t.Fatalf("Expected main and divide on the call stack, got %v", restored.CallStack)
+	}
+	num, err := restored.Heap.GetStructField(restored.CallStack[0].Locals[0].Ptr(), "num")
+	if err != nil || num.AsInt32() != 7 {
+		t.Errorf("Expected the struct of main to be restored, got %v, %v", num, err)
+	}
+
+	other, err := bytecode.Open("testdata/calls.gvmbc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	if _, err := NewVmFromCore(other, core, Options{}); err == nil {
+		t.Error("Expected a core not to load with another program")
+	}
+	for _, n := range []int{0, 10, len(data) / 2, len(data) - 1} {
+		if _, err := ReadCore(bytes.NewReader(data[:n])); err == nil {
+			t.Errorf("Expected a core truncated to %d bytes to be refused", n)
+		}
+	}
+}
+
+func TestInspectRestoredHeap(t *testing.T) {
+	program, err := bytecode.Open("testdata/crash.gvmbc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer program.Close()
+	machine, err := NewVmFromProgram(program, Options{Stdout: io.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer machine.Close()
+	core := machine.Core("", machine.Run())
+	restored, err := NewVmFromCore(program, core, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Close()
+	h := restored.Heap
+	ratio := restored.CallStack[0].Locals[0].Ptr()
+	if object, ok := h.ObjectAt(ratio); !ok || object.Type != "Ratio" || object.Kind != ValueStruct {
+		t.Fatalf("Expected a Ratio at %d, got %+v", ratio, object)
+	}
+	if objects := h.Objects(); len(objects) != 1 || objects[0].Address != ratio {
+		t.Errorf("Expected the Ratio alone, got %+v", objects)
+	}
+	slots, err := h.Slots(ratio)
+	if err != nil || len(slots) != 2 || slots[0].Path != ".num" || slots[0].Value != Int32Value(7) {
+		t.Errorf("Expected the fields of the Ratio, got %+v, %v", slots, err)
+	}
+	found := h.Find(func(value Value) bool { return value == Int32Value(7) })
+	if len(found) != 1 || found[0].Object != ratio || found[0].Path != ".num" {
+		t.Errorf("Expected to find .num, got %+v", found)
+	}
+	if object, offset, ok := h.Containing(ratio + 6); !ok || object.Address != ratio || offset != 6 {
+		t.Errorf("Expected the address to be inside the Ratio, got %+v, %d", object, offset)
+	}
+}
+
+func TestAllocationSites(t *testing.T) {
+	program, err := bytecode.Open("testdata/sites.gvmbc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer program.Close()
+	machine, err := NewVmFromProgram(program, Options{Stdout: io.Discard, AllocationSites: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer machine.Close()
+	if err := machine.Run(); err != nil {
+		t.Fatal(err)
+	}
+	// the first array was freed, the second one leaked
+	locals := machine.getCurrentFrame().Locals
+	_, err = machine.Heap.GetArrayElement(locals[0].Ptr(), 0)
+	if !errors.Is(err, heap.ErrInvalidAddress) || !strings.Contains(err.Error(), "allocated at main line 4 (0000000b) and freed at main line 10") {
+		t.Fatalf("Expected the error to name the sites of the freed array, got %v", err)
+	}
+	leaked := locals[1].Ptr()
+	want := heap.Site{Address: 0x16, Function: "main", Line: 7}
+	if sites := machine.Heap.LiveSites(); len(sites) != 1 || sites[0].Site != want || sites[0].Blocks != 1 {
+		t.Errorf("Expected the second array to be the only live block, got %+v", sites)
+	}
+
+	var buf bytes.Buffer
+	if _, err := machine.Core("testdata/sites.gvmbc", nil).WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	core, err := ReadCore(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored, err := NewVmFromCore(program, core, Options{Stdout: io.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Close()
+	if site, ok := restored.Heap.AllocationSite(leaked); !ok || site != want {
+		t.Errorf("Expected the crash dump to keep the allocation site, got %v", site)
+	}
+}
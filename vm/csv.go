@@ -0,0 +1,64 @@
+package vm
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"strings"
+
+	. "github.com/AndreiAlbert/gvm/common"
+)
+
+// ErrMalformedCSV is the cause of the RuntimeError raised by CSV_PARSE for
+// text that isn't valid CSV, such as a quoted field that is never closed.
+var ErrMalformedCSV = errors.New("malformed CSV")
+
+// csvParse pops the text of CSV_PARSE and allocates an array with a row
+// per record, each an array of strings. Records may have different numbers
+// of fields.
+func (v *VM) csvParse() uintptr {
+	text, err := v.Heap.LoadString(v.pop().AsPtr())
+	if err != nil {
+		v.fail(err)
+	}
+	reader := csv.NewReader(strings.NewReader(text))
+	reader.FieldsPerRecord = -1
+	records, err := reader.ReadAll()
+	if err != nil {
+		v.fail(fmt.Errorf("%w: %v", ErrMalformedCSV, err))
+	}
+	rows, err := v.Heap.AllocateArray(ValuePtr, int32(len(records)))
+	if err != nil {
+		v.fail(err)
+	}
+	for i, record := range records {
+		if err := v.Heap.SetArrayElement(rows, int32(i), PtrValue(v.allocateStrings(record))); err != nil {
+			v.fail(err)
+		}
+	}
+	return rows
+}
+
+// csvWrite pops the rows of CSV_WRITE, an array of arrays of strings, and
+// writes them to stdout as CSV records, quoting the fields that need it
+func (v *VM) csvWrite() {
+	rows := v.pop().AsPtr()
+	count, err := v.Heap.ArrayLength(rows)
+	if err != nil {
+		v.fail(err)
+	}
+	writer := csv.NewWriter(v.stdout)
+	for i := int32(0); i < count; i++ {
+		row, err := v.Heap.GetArrayElement(rows, i)
+		if err != nil {
+			v.fail(err)
+		}
+		if err := writer.Write(v.loadStrings(row.Ptr())); err != nil {
+			v.fail(err)
+		}
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		v.fail(err)
+	}
+}
@@ -0,0 +1,103 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	. "github.com/AndreiAlbert/gvm/common"
+	"github.com/AndreiAlbert/gvm/heap"
+)
+
+// ErrMalformedTime is the cause of the RuntimeError raised by TIME_PARSE
+// for text that doesn't match the layout.
+var ErrMalformedTime = errors.New("malformed time")
+
+// now returns the time TIME_NOW_STRUCT pushes: the time of Options.Clock,
+// or the Unix epoch without a clock, so that runs are reproducible
+func (v *VM) now() time.Time {
+	if v.clock == nil {
+		return time.Unix(0, 0)
+	}
+	return v.clock()
+}
+
+// allocateDateTime allocates the DateTime holding t in UTC
+func (v *VM) allocateDateTime(t time.Time) uintptr {
+	t = t.UTC()
+	ptr, err := v.Heap.AllocateStruct(v.structs[DateTimeStructName])
+	if err != nil {
+		v.fail(err)
+	}
+	for _, field := range []struct {
+		name  string
+		value int
+	}{
+		{"year", t.Year()},
+		{"month", int(t.Month())},
+		{"day", t.Day()},
+		{"hour", t.Hour()},
+		{"minute", t.Minute()},
+		{"second", t.Second()},
+		{"millisecond", t.Nanosecond() / int(time.Millisecond)},
+	} {
+		if err := v.Heap.SetStructureField(ptr, field.name, Int32Value(int32(field.value))); err != nil {
+			v.fail(err)
+		}
+	}
+	return ptr
+}
+
+// loadDateTime reads the DateTime at ptr. Fields out of their range
+// normalize as with time.Date: month 13 is January of the next year.
+func (v *VM) loadDateTime(ptr uintptr) time.Time {
+	structType, err := v.Heap.StructTypeOf(ptr)
+	if err != nil {
+		v.fail(err)
+	}
+	if structType.Name != DateTimeStructName {
+		v.fail(fmt.Errorf("%w: expected a %s, got a %s", heap.ErrTypeMismatch, DateTimeStructName, structType.Name))
+	}
+	var fields [7]int
+	for i, field := range DateTimeStruct().Fields {
+		value, err := v.Heap.GetStructField(ptr, field.Name)
+		if err != nil {
+			v.fail(err)
+		}
+		fields[i] = int(value.AsInt32())
+	}
+	return time.Date(fields[0], time.Month(fields[1]), fields[2], fields[3], fields[4], fields[5], fields[6]*int(time.Millisecond), time.UTC)
+}
+
+// timeFormat pops the DateTime and the layout of TIME_FORMAT and allocates
+// the formatted string
+func (v *VM) timeFormat() uintptr {
+	layout, err := v.Heap.LoadString(v.pop().AsPtr())
+	if err != nil {
+		v.fail(err)
+	}
+	t := v.loadDateTime(v.pop().AsPtr())
+	ptr, err := v.Heap.AllocateString(t.Format(layout))
+	if err != nil {
+		v.fail(err)
+	}
+	return ptr
+}
+
+// timeParse pops the text and the layout of TIME_PARSE and allocates the
+// DateTime it denotes, converted to UTC
+func (v *VM) timeParse() uintptr {
+	layout, err := v.Heap.LoadString(v.pop().AsPtr())
+	if err != nil {
+		v.fail(err)
+	}
+	text, err := v.Heap.LoadString(v.pop().AsPtr())
+	if err != nil {
+		v.fail(err)
+	}
+	t, err := time.Parse(layout, text)
+	if err != nil {
+		v.fail(fmt.Errorf("%w: %v", ErrMalformedTime, err))
+	}
+	return v.allocateDateTime(t)
+}
@@ -0,0 +1,477 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/AndreiAlbert/gvm/bytecode"
+	. "github.com/AndreiAlbert/gvm/common"
+)
+
+// ErrNotRunning is returned when stepping a program that has stopped.
+var ErrNotRunning = errors.New("the program is not running")
+
+// Debugger drives a VM for gvm debug: it executes the program one
+// instruction at a time, stops at breakpoints and watchpoints and explains
+// instructions.
+type Debugger struct {
+	vm          *VM
+	breakpoints map[uint]*Breakpoint
+	watchpoints []*Watchpoint
+	nextWatch   int
+	labels      []bytecode.Label
+	enums       []bytecode.Enum
+	lines       []bytecode.LineEntry
+}
+
+// Breakpoint stops Continue before the instruction at Address executes.
+type Breakpoint struct {
+	Address uint
+	// Condition, if set, must hold for the breakpoint to stop the program
+	Condition *Expr
+	// Hits counts the times the breakpoint stopped the program
+	Hits int
+}
+
+// Watchpoint stops Continue after an instruction changed the value of
+// Expr. The heap locations the expression reads, such as the struct of
+// local0.count, are resolved when the watchpoint is set, so the same
+// object is watched from every function. Locals and stack values are
+// those of the frame the watchpoint was set in, which are only compared
+// while that frame executes.
+type Watchpoint struct {
+	ID   int
+	Expr *Expr
+	// value is the last value seen, or the error evaluating it gave
+	value string
+	// frame is the call stack index of the frame of a watchpoint on
+	// locals or stack values, -1 for one on the heap alone
+	frame int
+}
+
+// Stop is why Continue returned.
+type Stop struct {
+	// Breakpoint is the breakpoint reached, if any
+	Breakpoint *Breakpoint
+	// Watchpoint is the watchpoint whose value changed from Old to New,
+	// if any. New is empty when its frame returned and it was removed.
+	Watchpoint *Watchpoint
+	Old, New   string
+}
+
+func (s Stop) String() string {
+	switch {
+	case s.Breakpoint != nil && s.Breakpoint.Condition != nil:
+		return fmt.Sprintf("breakpoint at %08x, %s holds", s.Breakpoint.Address, s.Breakpoint.Condition)
+	case s.Breakpoint != nil:
+		return fmt.Sprintf("breakpoint at %08x", s.Breakpoint.Address)
+	case s.Watchpoint != nil && s.New == "":
+		return fmt.Sprintf("watchpoint %d on %s removed, its frame returned", s.Watchpoint.ID, s.Watchpoint.Expr)
+	case s.Watchpoint != nil:
+		return fmt.Sprintf("watchpoint %d: %s changed from %s to %s", s.Watchpoint.ID, s.Watchpoint.Expr, s.Old, s.New)
+	default:
+		return "the program has stopped"
+	}
+}
+
+// NewDebugger creates a debugger for a VM that hasn't started running.
+func NewDebugger(v *VM) *Debugger {
+	return &Debugger{vm: v, breakpoints: make(map[uint]*Breakpoint), nextWatch: 1}
+}
+
+// AddLabels makes the labels of the program usable as locations, see
+// Resolve.
+func (d *Debugger) AddLabels(labels []bytecode.Label) {
+	d.labels = append(d.labels, labels...)
+}
+
+// AddLines makes the source lines of the program usable as locations,
+// see Resolve.
+func (d *Debugger) AddLines(lines []bytecode.LineEntry) {
+	d.lines = append(d.lines, lines...)
+}
+
+// AddEnums makes the debugger print the values of enum fields and the enum
+// constants of instructions by name.
+func (d *Debugger) AddEnums(enums []bytecode.Enum) {
+	for _, enum := range enums {
+		// the constants are updated when a function is replaced
+		enum.Constants = slices.Clone(enum.Constants)
+		d.enums = append(d.enums, enum)
+	}
+}
+
+// Format formats the value of an expression as kind:value, followed by the
+// object a pointer points to, as printed by PRINT_ANY, or the name of the
+// enum member it holds when the expression reads a struct field declared
+// with an enum.
+func (d *Debugger) Format(e *Expr, value Value) string {
+	text := fmt.Sprintf("%v:%v", value.Kind(), value)
+	if value.Kind() == ValuePtr && value.Ptr() != 0 {
+		text += " " + d.vm.Heap.Format(value, d.vm.floatFormat)
+	}
+	if enum := d.enumOf(e.root); enum != nil && value.Kind() == ValueInt32 {
+		if member, ok := enum.MemberName(value.AsInt32()); ok {
+			text += fmt.Sprintf(" (%s.%s)", enum.Name, member)
+		}
+	}
+	return text
+}
+
+// enumOf returns the enum of the struct field node reads, nil if it isn't
+// such a field
+func (d *Debugger) enumOf(node exprNode) *bytecode.Enum {
+	field, ok := node.(fieldNode)
+	if !ok || len(d.enums) == 0 {
+		return nil
+	}
+	object, err := field.object.eval(d.vm)
+	if err != nil {
+		return nil
+	}
+	structType, err := d.vm.Heap.StructTypeOf(object.Ptr())
+	if err != nil {
+		return nil
+	}
+	name := structType.Name + "." + field.field
+	for i := range d.enums {
+		if slices.Contains(d.enums[i].Fields, name) {
+			return &d.enums[i]
+		}
+	}
+	return nil
+}
+
+// VM returns the machine being debugged.
+func (d *Debugger) VM() *VM {
+	return d.vm
+}
+
+// Step executes the next instruction. The error is the one that stopped
+// the program, as returned by Run.
+func (d *Debugger) Step() error {
+	if !d.vm.Running {
+		return ErrNotRunning
+	}
+	return d.vm.Step()
+}
+
+// StepBack undoes the last executed instruction, see VM.StepBack. The VM
+// must be created with Options.History set.
+func (d *Debugger) StepBack() error {
+	return d.vm.StepBack()
+}
+
+// Continue executes instructions until the program stops, reaches a
+// breakpoint whose condition holds or changes a watched value. The
+// instruction at Ip runs even if it has a breakpoint, so continuing from a
+// breakpoint moves on. A condition that fails to evaluate stops the
+// program at its breakpoint with the error.
+func (d *Debugger) Continue() (Stop, error) {
+	return d.runUntil(func() bool { return false })
+}
+
+// Next executes the next instruction, running a function it calls to its
+// return, and stops early like Continue. Anything else is a Step.
+func (d *Debugger) Next() (Stop, error) {
+	depth := len(d.vm.CallStack)
+	return d.runUntil(func() bool { return len(d.vm.CallStack) <= depth })
+}
+
+// Finish runs the current function until it returns to its caller, and
+// stops early like Continue. Finishing main runs the program to its end.
+func (d *Debugger) Finish() (Stop, error) {
+	depth := len(d.vm.CallStack)
+	return d.runUntil(func() bool { return len(d.vm.CallStack) < depth })
+}
+
+// Until runs until the instruction at address is next, in any frame, or
+// the current function returns, and stops early like Continue. Until the
+// address of a loop exit runs the rest of the loop.
+func (d *Debugger) Until(address uint) (Stop, error) {
+	depth := len(d.vm.CallStack)
+	return d.runUntil(func() bool { return d.vm.Ip == address || len(d.vm.CallStack) < depth })
+}
+
+// runUntil is Continue stopping when done holds after an instruction. The
+// Stop is zero when done stopped it.
+func (d *Debugger) runUntil(done func() bool) (Stop, error) {
+	for _, w := range d.watchpoints {
+		w.value = d.watchValue(w)
+	}
+	if err := d.Step(); err != nil {
+		return Stop{}, err
+	}
+	for d.vm.Running && !done() {
+		if stop, ok, err := d.check(); ok || err != nil {
+			return stop, err
+		}
+		if err := d.vm.Step(); err != nil {
+			return Stop{}, err
+		}
+	}
+	return Stop{}, nil
+}
+
+// check is run after every instruction Continue executes. It reports
+// whether a watchpoint or the breakpoint at Ip stops the program.
+func (d *Debugger) check() (Stop, bool, error) {
+	for i, w := range d.watchpoints {
+		if w.frame >= len(d.vm.CallStack) {
+			d.watchpoints = append(d.watchpoints[:i], d.watchpoints[i+1:]...)
+			return Stop{Watchpoint: w, Old: w.value}, true, nil
+		}
+		if w.frame >= 0 && w.frame != len(d.vm.CallStack)-1 {
+			continue
+		}
+		if value := d.watchValue(w); value != w.value {
+			old := w.value
+			w.value = value
+			return Stop{Watchpoint: w, Old: old, New: value}, true, nil
+		}
+	}
+	b := d.breakpoints[d.vm.Ip]
+	if b == nil {
+		return Stop{}, false, nil
+	}
+	if b.Condition != nil {
+		holds, err := b.Condition.Holds(d.vm)
+		if err != nil {
+			return Stop{Breakpoint: b}, true, fmt.Errorf("condition of the breakpoint at %08x: %w", b.Address, err)
+		}
+		if !holds {
+			return Stop{}, false, nil
+		}
+	}
+	b.Hits++
+	return Stop{Breakpoint: b}, true, nil
+}
+
+// SetBreakpoint stops Continue before the instruction at address executes.
+func (d *Debugger) SetBreakpoint(address uint) {
+	d.breakpoints[address] = &Breakpoint{Address: address}
+}
+
+// SetConditionalBreakpoint stops Continue before the instruction at
+// address executes when condition, a debugger expression, holds.
+func (d *Debugger) SetConditionalBreakpoint(address uint, condition string) error {
+	expr, err := ParseExpr(condition)
+	if err != nil {
+		return err
+	}
+	d.breakpoints[address] = &Breakpoint{Address: address, Condition: expr}
+	return nil
+}
+
+// ClearBreakpoint removes the breakpoint at address.
+func (d *Debugger) ClearBreakpoint(address uint) {
+	delete(d.breakpoints, address)
+}
+
+// Breakpoints returns the breakpoints, by address.
+func (d *Debugger) Breakpoints() []Breakpoint {
+	breakpoints := make([]Breakpoint, 0, len(d.breakpoints))
+	for _, b := range d.breakpoints {
+		breakpoints = append(breakpoints, *b)
+	}
+	slices.SortFunc(breakpoints, func(a, b Breakpoint) int { return int(a.Address) - int(b.Address) })
+	return breakpoints
+}
+
+// Watch sets a watchpoint on a debugger expression.
+func (d *Debugger) Watch(expression string) (*Watchpoint, error) {
+	expr, err := ParseExpr(expression)
+	if err != nil {
+		return nil, err
+	}
+	root, err := pinHeapAccess(expr.root, d.vm)
+	if err != nil {
+		return nil, err
+	}
+	w := &Watchpoint{ID: d.nextWatch, Expr: &Expr{source: expr.source, root: root}, frame: -1}
+	if readsFrame(root) {
+		w.frame = len(d.vm.CallStack) - 1
+	}
+	w.value = d.watchValue(w)
+	d.nextWatch++
+	d.watchpoints = append(d.watchpoints, w)
+	return w, nil
+}
+
+// Unwatch removes the watchpoint with the id, reporting whether there was
+// one.
+func (d *Debugger) Unwatch(id int) bool {
+	for i, w := range d.watchpoints {
+		if w.ID == id {
+			d.watchpoints = append(d.watchpoints[:i], d.watchpoints[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Watchpoints returns the watchpoints, in the order they were set.
+func (d *Debugger) Watchpoints() []Watchpoint {
+	watchpoints := make([]Watchpoint, len(d.watchpoints))
+	for i, w := range d.watchpoints {
+		watchpoints[i] = *w
+	}
+	return watchpoints
+}
+
+// Value returns the last value of the watched expression seen, or why it
+// couldn't be evaluated.
+func (w Watchpoint) Value() string {
+	return w.value
+}
+
+func (d *Debugger) watchValue(w *Watchpoint) string {
+	value, err := w.Expr.Eval(d.vm)
+	if err != nil {
+		return "<" + err.Error() + ">"
+	}
+	return d.Format(w.Expr, value)
+}
+
+// Resolve returns the address of a location: an address in decimal or 0x
+// hex, a function name, a label, or :line for the first instruction of a
+// source line. A label declared by several functions is named
+// function.label. A line without instructions, such as a blank one,
+// resolves to the next line that has some.
+func (d *Debugger) Resolve(location string) (uint, error) {
+	if address, err := strconv.ParseUint(location, 0, 64); err == nil {
+		return uint(address), nil
+	}
+	if text, ok := strings.CutPrefix(location, ":"); ok {
+		line, err := strconv.ParseUint(text, 10, 32)
+		if err != nil {
+			return 0, fmt.Errorf("invalid line %q", text)
+		}
+		return d.lineAddress(uint32(line))
+	}
+	for _, f := range d.vm.functionList {
+		if f.Name == location {
+			return f.Address, nil
+		}
+	}
+	function, label, qualified := strings.Cut(location, ".")
+	if !qualified {
+		label = location
+	}
+	var matches []uint
+	for _, l := range d.labels {
+		if l.Name == label && (!qualified || d.functionAt(uint(l.Address)) == function) {
+			matches = append(matches, uint(l.Address))
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return 0, fmt.Errorf("%q is neither an address, a function nor a label", location)
+	case 1:
+		return matches[0], nil
+	default:
+		return 0, fmt.Errorf("several functions declare the label %s, name it function.%s", label, label)
+	}
+}
+
+// lineAddress returns the first instruction of the nearest line at or
+// after line that has instructions
+func (d *Debugger) lineAddress(line uint32) (uint, error) {
+	if len(d.lines) == 0 {
+		return 0, errors.New("the program has no source map, it was built without line information")
+	}
+	best, found := bytecode.LineEntry{}, false
+	for _, entry := range d.lines {
+		if entry.Line < line {
+			continue
+		}
+		if !found || entry.Line < best.Line || entry.Line == best.Line && entry.Address < best.Address {
+			best, found = entry, true
+		}
+	}
+	if !found {
+		return 0, fmt.Errorf("no instruction is at or after line %d", line)
+	}
+	return uint(best.Address), nil
+}
+
+// ReplaceFunction patches a new body for a function into the program, see
+// VM.ReplaceFunction, and replaces the labels, lines and enum constants of
+// the old body with those of the patch. Breakpoints stay at their addresses
+// in the old body.
+func (d *Debugger) ReplaceFunction(name string, patch *bytecode.Program) error {
+	var start, end uint
+	for _, f := range d.vm.functionList {
+		if f.Name == name {
+			start = f.Address
+		}
+	}
+	end = uint(len(d.vm.Bytecode))
+	for _, f := range d.vm.functionList {
+		if f.Address > start && f.Address < end {
+			end = f.Address
+		}
+	}
+	if err := d.vm.ReplaceFunction(name, patch); err != nil {
+		return err
+	}
+	labels := d.labels[:0]
+	for _, l := range d.labels {
+		if uint(l.Address) < start || uint(l.Address) >= end {
+			labels = append(labels, l)
+		}
+	}
+	d.labels = append(labels, patch.Labels...)
+	d.lines = append(slices.DeleteFunc(d.lines, func(entry bytecode.LineEntry) bool {
+		return uint(entry.Address) >= start && uint(entry.Address) < end
+	}), patch.Lines...)
+	for i := range d.enums {
+		enum := &d.enums[i]
+		enum.Constants = slices.DeleteFunc(enum.Constants, func(address uint32) bool {
+			return uint(address) >= start && uint(address) < end
+		})
+		for _, patched := range patch.Enums {
+			if patched.Name == enum.Name {
+				enum.Constants = append(enum.Constants, patched.Constants...)
+			}
+		}
+	}
+	return nil
+}
+
+// functionAt returns the name of the function whose body holds address
+func (d *Debugger) functionAt(address uint) string {
+	name := ""
+	best := uint(0)
+	for _, f := range d.vm.functionList {
+		if f.Address <= address && f.Address >= best {
+			name, best = f.Name, f.Address
+		}
+	}
+	return name
+}
+
+// Explain describes the instruction at Ip and models its effect on the
+// stack, without executing it.
+func (d *Debugger) Explain() (*Explanation, error) {
+	return d.vm.Explain(d.vm.Ip)
+}
+
+// Instruction disassembles the instruction at address.
+func (d *Debugger) Instruction(address uint) (string, error) {
+	if address >= uint(len(d.vm.Bytecode)) {
+		return "", fmt.Errorf("address %d is outside of the code", address)
+	}
+	dis := &disassembler{code: d.vm.Bytecode, pos: int(address), fieldNames: d.vm.fieldNames, constants: enumConstants(d.enums), pool: d.vm.constants}
+	text := dis.instruction()
+	if dis.err != nil {
+		return "", dis.err
+	}
+	if dis.note != "" {
+		text += " ; " + dis.note
+	}
+	return text, nil
+}
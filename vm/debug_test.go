@@ -0,0 +1,496 @@
+package vm
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/AndreiAlbert/gvm/bytecode"
+	. "github.com/AndreiAlbert/gvm/common"
+)
+
+func newTestDebugger(t *testing.T, code []byte) *Debugger {
+	t.Helper()
+	program := &bytecode.Program{
+		Functions: []bytecode.Function{{Name: "main", IsMain: true, ReturnType: ValueVoid}},
+		Code:      code,
+	}
+	machine, err := NewVmFromProgram(program, Options{Stdout: io.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { machine.Close() })
+	return NewDebugger(machine)
+}
+
+func TestDebuggerStepsAndStopsAtBreakpoints(t *testing.T) {
+	code := join(pushInt(2), pushInt(3), []byte{byte(IADD), byte(HALT)})
+	d := newTestDebugger(t, code)
+	if err := d.Step(); err != nil {
+		t.Fatal(err)
+	}
+	if d.VM().Ip != 6 || len(d.VM().getCurrentFrame().LocalStack) != 1 {
+		t.Fatalf("Expected one push executed, at %d with %v", d.VM().Ip, d.VM().getCurrentFrame().LocalStack)
+	}
+	d.SetBreakpoint(12)
+	stop, err := d.Continue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.VM().Ip != 12 || stop.Breakpoint == nil || stop.Breakpoint.Hits != 1 {
+		t.Fatalf("Expected to stop at the breakpoint at 12, stopped at %d: %v", d.VM().Ip, stop)
+	}
+	if _, err := d.Continue(); err != nil {
+		t.Fatal(err)
+	}
+	if d.VM().Running {
+		t.Fatal("Expected the program to run to the end past the breakpoint")
+	}
+	if err := d.Step(); !errors.Is(err, ErrNotRunning) {
+		t.Errorf("Expected stepping a stopped program to fail with ErrNotRunning, got %v", err)
+	}
+}
+
+func TestDebuggerStepReturnsRuntimeErrors(t *testing.T) {
+	d := newTestDebugger(t, []byte{byte(IADD)})
+	var runtimeErr *RuntimeError
+	if err := d.Step(); !errors.As(err, &runtimeErr) || d.VM().Running {
+		t.Fatalf("Expected a runtime error stopping the program, got %v", err)
+	}
+}
+
+func TestExplain(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup []byte
+		next  []byte
+		after string
+		fails string
+		then  string
+	}{
+		{"add", join(pushInt(2), pushInt(3)), []byte{byte(IADD)}, "[int32:a+b]", "", ""},
+		{"dup", pushInt(7), []byte{byte(DUP)}, "[int32:7 int32:7]", "", ""},
+		{"compare keeps the rest", join(pushInt(1), pushInt(2), pushInt(3)), []byte{byte(LT)}, "[int32:1 int32:a<b]", "", ""},
+		{"underflow", pushInt(1), []byte{byte(IADD)}, "", "stack underflow", ""},
+		{"mixed kinds", join(pushInt(1), pushFloat()), []byte{byte(IADD)}, "", "b to be int32, got float32", ""},
+		{"division by zero", join(pushInt(1), pushInt(0)), []byte{byte(IDIV)}, "", "division by zero", ""},
+		{"zero dividend", join(pushInt(0), pushInt(1)), []byte{byte(IDIV)}, "[int32:a/b]", "", ""},
+		{"min int by -1 wraps", join(pushInt(math.MinInt32), pushInt(-1)), []byte{byte(IDIV)}, "[int32:a/b]", "", ""},
+		{"unset local", nil, []byte{byte(LOAD), 0, 9}, "", "local 9 is not set", ""},
+		{"jump taken", pushInt(5), []byte{byte(IJE), 0, 0, 0, 0, 0, 5}, "[]", "", "x is 5: jumps to 0x00000000"},
+		{"jump not taken", pushInt(4), []byte{byte(IJE), 0, 0, 0, 0, 0, 5}, "[]", "", "x is 4: falls through"},
+		{"array load", nil, []byte{byte(LDELEM)}, "", "stack underflow: LDELEM needs 2 values", ""},
+		{"syscall", pushInt(65), []byte{byte(SYSCALL), 0, byte(WRITE_BYTE)}, "[]", "", ""},
+		{"syscall result", nil, []byte{byte(SYSCALL), 0, byte(READ_BYTE)}, "[byte:byte]", "", ""},
+		{"syscall kinds", pushInt(1), []byte{byte(SYSCALL), 0, byte(STR_LEN)}, "", "STR_LEN needs s to be ptr, got int32", ""},
+		{"syscall underflow", pushInt(1), []byte{byte(SYSCALL), 0, byte(BUF_GET_I32)}, "", "stack underflow: BUF_GET_I32 needs 3 values", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := newTestDebugger(t, join(tt.setup, tt.next, []byte{byte(HALT)}))
+			for d.VM().Ip < uint(len(tt.setup)) {
+				if err := d.Step(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			stackBefore := len(d.VM().getCurrentFrame().LocalStack)
+			e, err := d.Explain()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(d.VM().getCurrentFrame().LocalStack) != stackBefore || d.VM().Ip != uint(len(tt.setup)) {
+				t.Fatal("Expected explaining to leave the VM untouched")
+			}
+			var out bytes.Buffer
+			e.WriteTo(&out)
+			if tt.fails != "" {
+				if !strings.Contains(e.Problem, tt.fails) {
+					t.Errorf("Expected the problem %q, got %q", tt.fails, e.Problem)
+				}
+				return
+			}
+			if e.Problem != "" {
+				t.Errorf("Expected no problem, got %q", e.Problem)
+			}
+			if got := formatSlots(nil, e.After); got != tt.after {
+				t.Errorf("Expected the stack after to be %s, got %s\n%s", tt.after, got, out.String())
+			}
+			if !strings.Contains(e.Effect, tt.then) {
+				t.Errorf("Expected the effect %q, got %q", tt.then, e.Effect)
+			}
+		})
+	}
+}
+
+func TestExplainCallShowsTheStackAfterTheReturn(t *testing.T) {
+	program, err := bytecode.Open("testdata/calls.gvmbc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer program.Close()
+	machine, err := NewVmFromProgram(program, Options{Stdout: io.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer machine.Close()
+	d := NewDebugger(machine)
+	for {
+		inst, err := decodeInstruction(machine.Bytecode, machine.Ip)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if inst.Opcode == CALL {
+			break
+		}
+		if err := d.Step(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	e, err := d.Explain()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := formatSlots(nil, e.After); got != "[int32:result]" || !strings.Contains(e.Effect, "enters work") {
+		t.Errorf("Expected work to return an int32, got %s, %q", got, e.Effect)
+	}
+	if e.Operands[0] != "1 (work)" {
+		t.Errorf("Expected the operand to name the callee, got %q", e.Operands[0])
+	}
+}
+
+func TestExpressions(t *testing.T) {
+	d := newTestDebugger(t, []byte{byte(HALT)})
+	machine := d.VM()
+	array, err := machine.Heap.AllocateArray(ValueInt32, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := machine.Heap.SetArrayElement(array, 2, Int32Value(42)); err != nil {
+		t.Fatal(err)
+	}
+	frame := machine.getCurrentFrame()
+	frame.Locals[0] = Int32Value(150)
+	frame.Locals[1] = PtrValue(array)
+	frame.LocalStack = append(frame.LocalStack, Float32Value(1.5), Int32Value(7))
+	tests := []struct {
+		expr, want string
+	}{
+		{"local0 > 100", "int32:1"},
+		{"local0 > 100 && stack0 == 8", "int32:0"},
+		{"1 + 2 * 3", "int32:7"},
+		{"-(1 + 2) % 2", "int32:-1"},
+		{"2147483647 + 1", "int32:-2147483648"},
+		{"stack1 * 2", "float32:3"},
+		{"local1[2]", "int32:42"},
+		{"local1[stack0 - 5] / 2", "int32:21"},
+		{"!local0 || ip == 0", "int32:1"},
+	}
+	for _, test := range tests {
+		expr, err := ParseExpr(test.expr)
+		if err != nil {
+			t.Errorf("%s: %v", test.expr, err)
+			continue
+		}
+		value, err := expr.Eval(machine)
+		if err != nil {
+			t.Errorf("%s: %v", test.expr, err)
+		} else if got := value.Kind().String() + ":" + value.String(); got != test.want {
+			t.Errorf("%s = %s, want %s", test.expr, got, test.want)
+		}
+	}
+	for _, source := range []string{"local0 >", "(1", "1 2", "local0 $ 1", "locals"} {
+		if _, err := ParseExpr(source); err == nil {
+			t.Errorf("Expected %q not to parse", source)
+		}
+	}
+	for _, source := range []string{"local7", "stack5", "1 / 0", "local1[3]", "local0.count"} {
+		expr, err := ParseExpr(source)
+		if err != nil {
+			t.Fatalf("%s: %v", source, err)
+		}
+		if _, err := expr.Eval(machine); err == nil {
+			t.Errorf("Expected %q to fail to evaluate", source)
+		}
+	}
+}
+
+func TestCallPure(t *testing.T) {
+	double := join(pushInt(2), []byte{byte(IMUL), byte(RET)})
+	impure := join(pushInt(1), []byte{byte(SYSCALL), 0, 0}, pushInt(0), []byte{byte(RET)})
+	spinAt := 1 + len(double) + len(impure)
+	spin := []byte{byte(JMP), byte(spinAt >> 8), byte(spinAt)}
+	program := &bytecode.Program{
+		Functions: []bytecode.Function{
+			{Name: "main", IsMain: true, ReturnType: ValueVoid},
+			{Name: "double", Address: 1, ParamCount: 1, ReturnType: ValueInt32},
+			{Name: "impure", Address: uint32(1 + len(double)), ReturnType: ValueInt32},
+			{Name: "spin", Address: uint32(spinAt), ReturnType: ValueInt32},
+		},
+		Code: join([]byte{byte(HALT)}, double, impure, spin),
+	}
+	machine, err := NewVmFromProgram(program, Options{Stdout: io.Discard, History: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer machine.Close()
+	machine.getCurrentFrame().Locals[0] = Int32Value(20)
+	expr, err := ParseExpr("double(local0 + 1) + double(1)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, err := expr.Eval(machine)
+	if err != nil || value.AsInt32() != 44 {
+		t.Fatalf("Expected 44, got %v, %v", value, err)
+	}
+	if machine.Ip != 0 || len(machine.CallStack) != 1 || machine.Instructions() != 0 || machine.History() != 0 {
+		t.Errorf("Expected the call to leave the VM as it was, at %d with %d frames after %d instructions",
+			machine.Ip, len(machine.CallStack), machine.Instructions())
+	}
+	for _, source := range []string{"impure()", "spin()", "double()", "main()", "missing(1)"} {
+		expr, err := ParseExpr(source)
+		if err != nil {
+			t.Fatalf("%s: %v", source, err)
+		}
+		if _, err := expr.Eval(machine); err == nil {
+			t.Errorf("Expected %s to fail", source)
+		}
+	}
+}
+
+func newCallsDebugger(t *testing.T) *Debugger {
+	t.Helper()
+	program, err := bytecode.Open("testdata/calls.gvmbc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { program.Close() })
+	machine, err := NewVmFromProgram(program, Options{Stdout: io.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { machine.Close() })
+	d := NewDebugger(machine)
+	d.AddLabels(program.Labels)
+	d.AddLines(program.Lines)
+	return d
+}
+
+func TestConditionalBreakpoint(t *testing.T) {
+	d := newCallsDebugger(t)
+	loop, err := d.Resolve("loop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if qualified, err := d.Resolve("main.loop"); err != nil || qualified != loop {
+		t.Fatalf("Expected main.loop to be %08x, got %08x, %v", loop, qualified, err)
+	}
+	if _, err := d.Resolve("work.loop"); err == nil {
+		t.Error("Expected work.loop not to resolve")
+	}
+	if err := d.SetConditionalBreakpoint(loop, "local0 == 1"); err != nil {
+		t.Fatal(err)
+	}
+	stop, err := d.Continue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stop.Breakpoint == nil || d.VM().Ip != loop || d.VM().getCurrentFrame().Locals[0].AsInt32() != 1 {
+		t.Fatalf("Expected to stop at loop with local0 1, got %v at %08x", stop, d.VM().Ip)
+	}
+	if _, err := d.Continue(); err != nil || d.VM().Running {
+		t.Fatalf("Expected the program to run to the end, got %v", err)
+	}
+
+	d = newCallsDebugger(t)
+	if err := d.SetConditionalBreakpoint(loop, "local0 / 0"); err != nil {
+		t.Fatal(err)
+	}
+	if stop, err := d.Continue(); err == nil || stop.Breakpoint == nil {
+		t.Errorf("Expected a condition failing to evaluate to stop with its error, got %v", stop)
+	}
+}
+
+func TestNextFinishAndUntil(t *testing.T) {
+	d := newCallsDebugger(t)
+	machine := d.VM()
+	// line 8 of calls.asm is call work, 9 the store of its result
+	call, err := d.Resolve(":8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Until(call); err != nil || machine.Ip != call {
+		t.Fatalf("Expected to run until the call at %08x, at %08x: %v", call, machine.Ip, err)
+	}
+	if stop, err := d.Next(); err != nil || stop.Breakpoint != nil || len(machine.CallStack) != 1 {
+		t.Fatalf("Expected next to run work in main, %d frames: %v, %v", len(machine.CallStack), stop, err)
+	}
+	if store, err := d.Resolve(":9"); err != nil || machine.Ip != store {
+		t.Fatalf("Expected next to stop at line 9, at %08x: %v", machine.Ip, err)
+	}
+
+	work, err := d.Resolve("work")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Until(work); err != nil || machine.Ip != work || len(machine.CallStack) != 2 {
+		t.Fatalf("Expected to run until work, at %08x with %d frames: %v", machine.Ip, len(machine.CallStack), err)
+	}
+	if _, err := d.Finish(); err != nil || len(machine.CallStack) != 1 || len(machine.getCurrentFrame().LocalStack) != 1 {
+		t.Fatalf("Expected finish to return the result of work to main, got %v: %v", machine.getCurrentFrame().LocalStack, err)
+	}
+
+	// a breakpoint stops a run before its target
+	d.SetBreakpoint(work)
+	done, err := d.Resolve("done")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stop, err := d.Until(done); err != nil || stop.Breakpoint == nil || machine.Ip != work {
+		t.Fatalf("Expected to stop at the breakpoint in work, at %08x: %v, %v", machine.Ip, stop, err)
+	}
+	d.ClearBreakpoint(work)
+	if _, err := d.Until(done); err != nil || machine.Ip == done {
+		t.Fatalf("Expected until in work to stop when work returns, at %08x: %v", machine.Ip, err)
+	}
+	if _, err := d.Until(done); err != nil || machine.Ip != done || machine.getCurrentFrame().Locals[0].AsInt32() != 0 {
+		t.Fatalf("Expected to run the loop until done, at %08x: %v", machine.Ip, err)
+	}
+	if _, err := d.Finish(); err != nil || machine.Running {
+		t.Fatalf("Expected finishing main to end the program, got %v", err)
+	}
+
+	if blank, err := d.Resolve(":18"); err != nil || blank != work {
+		t.Errorf("Expected the line closing main to resolve to work at %08x, got %08x: %v", work, blank, err)
+	}
+	if _, err := d.Resolve(":100"); err == nil {
+		t.Error("Expected a line after the program not to resolve")
+	}
+}
+
+func TestWatchpoint(t *testing.T) {
+	d := newCallsDebugger(t)
+	w, err := d.Watch("local1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop, err := d.Continue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stop.Watchpoint != w || !strings.HasPrefix(stop.Old, "<") || stop.New != "int32:6" {
+		t.Fatalf("Expected local1 to change to 6, got %v", stop)
+	}
+	if len(d.VM().CallStack) != 1 {
+		t.Errorf("Expected the change to be seen in main, the frame of local1, not in work")
+	}
+	if !d.Unwatch(w.ID) || len(d.Watchpoints()) != 0 {
+		t.Error("Expected the watchpoint to be removed")
+	}
+
+	d = newCallsDebugger(t)
+	for len(d.VM().CallStack) == 1 {
+		if err := d.Step(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if w, err = d.Watch("local0"); err != nil {
+		t.Fatal(err)
+	}
+	stop, err = d.Continue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stop.Watchpoint != w || stop.New != "" || len(d.Watchpoints()) != 0 {
+		t.Errorf("Expected the watchpoint on a local of work to be removed when work returns, got %v", stop)
+	}
+}
+
+func TestStackKindsMatchTheOpcodeTable(t *testing.T) {
+	for op, k := range stackKinds {
+		info := opcodeTable[op]
+		if len(k.pops) != len(info.Pops) || len(k.pushes) != len(info.Pushes) {
+			t.Errorf("%v: the stack model pops %d and pushes %d, the table %v and %v", op, len(k.pops), len(k.pushes), info.Pops, info.Pushes)
+		}
+	}
+}
+
+// TestEnumNames checks the debugger names the members held by enum fields
+// and used as instruction operands.
+func TestEnumNames(t *testing.T) {
+	program, err := bytecode.Decode(mustReadTestProgram(t, "testdata/enum.gvmbc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	machine, err := NewVmFromProgram(program, Options{Stdout: io.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer machine.Close()
+	d := NewDebugger(machine)
+	d.AddLabels(program.Labels)
+	d.AddEnums(program.Enums)
+	done, err := d.Resolve("done")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.SetBreakpoint(done)
+	if _, err := d.Continue(); err != nil {
+		t.Fatal(err)
+	}
+	for source, want := range map[string]string{
+		"local0.color":     "int32:1 (Color.GREEN)",
+		"local0.level":     "int32:11 (Level.HIGH)",
+		"local0.level + 1": "int32:12",
+	} {
+		expr, err := ParseExpr(source)
+		if err != nil {
+			t.Fatal(err)
+		}
+		value, err := expr.Eval(machine)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := d.Format(expr, value); got != want {
+			t.Errorf("Expected %s to print %q, got %q", source, want, got)
+		}
+	}
+	push := program.Enums[0].Constants[0]
+	if text, err := d.Instruction(uint(push)); err != nil || text != "PUSH int32 Color.GREEN ; 1" {
+		t.Errorf("Expected the push of GREEN to be named, got %q (%v)", text, err)
+	}
+
+	var listing bytes.Buffer
+	if err := Disassemble(&listing, program); err != nil {
+		t.Fatal(err)
+	}
+	// the push and the IJE comparing with GREEN, and the push of HIGH
+	if strings.Count(listing.String(), "Color.GREEN") != 2 || !strings.Contains(listing.String(), "int32 Level.HIGH") {
+		t.Errorf("Expected the listing to name the enum constants:\n%s", listing.String())
+	}
+}
+
+func TestExplainChecksTheMaxStack(t *testing.T) {
+	program := &bytecode.Program{
+		Functions: []bytecode.Function{{Name: "main", IsMain: true, ReturnType: ValueVoid, MaxStack: 1}},
+		Code:      join(pushInt(1), pushInt(2), []byte{byte(HALT)}),
+	}
+	machine, err := NewVmFromProgram(program, Options{Stdout: io.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer machine.Close()
+	d := NewDebugger(machine)
+	if err := d.Step(); err != nil {
+		t.Fatal(err)
+	}
+	e, err := d.Explain()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(e.Problem, "exceeds the max stack 1 of main") {
+		t.Errorf("Expected the second push to outgrow the frame, got %q", e.Problem)
+	}
+}
@@ -0,0 +1,148 @@
+package vm
+
+import (
+	"fmt"
+
+	. "github.com/AndreiAlbert/gvm/common"
+)
+
+// maxCallInstructions bounds the instructions CallPure executes, so a
+// function that loops forever doesn't hang the debugger
+const maxCallInstructions = 1_000_000
+
+// impureOpcodes are the instructions a function called by CallPure may not
+// contain: they write to memory the function didn't allocate or interact
+// with the outside
+var impureOpcodes = map[Opcode]bool{
+	SYSCALL:      true,
+	STOREH:       true,
+	STELEM:       true,
+	STFIELD:      true,
+	STFIELD_NAME: true,
+	FREE:         true,
+}
+
+// CallPure calls the function name with args, runs it to completion and
+// returns its result, leaving the VM as it was: Ip, the call stack, the
+// handlers and the statistics are restored, and nothing is recorded
+// for StepBack. The function and the functions it calls may not contain
+// system calls, writes to the heap or frees, so calling it doesn't change
+// what the program does next. Objects it allocates stay in the heap.
+func (v *VM) CallPure(name string, args []Value) (Value, error) {
+	index := -1
+	for i, f := range v.functionList {
+		if f.Name == name {
+			index = i
+		}
+	}
+	if index < 0 {
+		return Value{}, fmt.Errorf("no function %s", name)
+	}
+	f := v.functionList[index]
+	if len(args) != int(f.ParamCount) {
+		return Value{}, fmt.Errorf("%s takes %d arguments, got %d", name, f.ParamCount, len(args))
+	}
+	if f.ReturnType == ValueVoid {
+		return Value{}, fmt.Errorf("%s returns no value", name)
+	}
+	if err := v.checkPure(index, make(map[int]bool)); err != nil {
+		return Value{}, err
+	}
+
+	ip, instructionStart, instructions := v.Ip, v.instructionStart, v.instructions
+	running, wide, history := v.Running, v.wide, v.history
+	depth, handlers, peakDepth := len(v.CallStack), len(v.handlers), v.peakDepth
+	defer func() {
+		v.peakDepth = peakDepth
+		v.Ip, v.instructionStart, v.instructions = ip, instructionStart, instructions
+		v.Running, v.wide, v.history = running, wide, history
+		v.CallStack = v.CallStack[:depth]
+		v.handlers = v.handlers[:handlers]
+	}()
+	v.history = nil
+	v.Running = true
+	// the result is returned to a scratch frame on top of the ones of the
+	// program
+	v.pushFrame(StackFrame{Locals: make(map[uint32]Value), ReturnAddress: ip})
+	v.pushFrame(StackFrame{Locals: make(map[uint32]Value), ReturnAddress: ip, Function: &v.functionList[index]})
+	for _, arg := range args {
+		v.push(arg)
+	}
+	v.Ip = f.Address
+	for executed := 0; len(v.CallStack) > depth+1; executed++ {
+		if executed == maxCallInstructions {
+			return Value{}, fmt.Errorf("%s did not return within %d instructions", name, maxCallInstructions)
+		}
+		// handlers of the program below the call don't catch its errors
+		if err := v.stepRecovering(); err != nil && (len(v.handlers) == handlers || !v.catch(err)) {
+			return Value{}, fmt.Errorf("%s failed: %w", name, err)
+		}
+	}
+	stack := v.CallStack[depth].LocalStack
+	if len(stack) != 1 {
+		return Value{}, fmt.Errorf("%s returned %d values", name, len(stack))
+	}
+	return stack[0], nil
+}
+
+// checkPure checks the body of the function at index and of the functions
+// it calls for impure instructions. A body runs up to the next function, a
+// function header or a HALT.
+func (v *VM) checkPure(index int, checked map[int]bool) error {
+	if checked[index] {
+		return nil
+	}
+	checked[index] = true
+	f := v.functionList[index]
+	end := uint(len(v.Bytecode))
+	for _, other := range v.functionList {
+		if other.Address > f.Address && other.Address < end {
+			end = other.Address
+		}
+	}
+	for address := f.Address; address < end; {
+		inst, err := decodeInstruction(v.Bytecode, address)
+		if err != nil {
+			return fmt.Errorf("%s: %w", displayName(f), err)
+		}
+		if inst.Opcode == FUNC || inst.Opcode == HALT {
+			return nil
+		}
+		if impureOpcodes[inst.Opcode] {
+			return fmt.Errorf("%s is not pure: %v at %08x", displayName(f), inst.Opcode, address)
+		}
+		if inst.Opcode == INVOKEINTERFACE {
+			// any struct's method of that name may run
+			for _, structType := range v.structs {
+				if callee, ok := structType.Methods[inst.Args[0].(string)]; ok {
+					if err := v.checkPure(int(callee), checked); err != nil {
+						return err
+					}
+				}
+			}
+		}
+		if isExtension(inst.Opcode) {
+			// the handler may do anything
+			return fmt.Errorf("%s is not pure: it runs extension %v at %08x", displayName(f), inst.Opcode, address)
+		}
+		if inst.Opcode == CALLNATIVE {
+			// the host function may do anything
+			return fmt.Errorf("%s is not pure: it calls a native at %08x", displayName(f), address)
+		}
+		if inst.Opcode == CALLCLOSURE {
+			// the closure isn't known before the function runs
+			return fmt.Errorf("%s is not pure: it calls a closure at %08x", displayName(f), address)
+		}
+		if inst.Opcode == CALL {
+			callee := int(inst.Args[0].(uint32))
+			if callee >= len(v.functionList) {
+				return fmt.Errorf("%s calls unknown function %d", displayName(f), callee)
+			}
+			if err := v.checkPure(callee, checked); err != nil {
+				return err
+			}
+		}
+		address = inst.Next
+	}
+	return nil
+}
@@ -0,0 +1,612 @@
+package vm
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+
+	. "github.com/AndreiAlbert/gvm/common"
+)
+
+// Expr is a debugger expression over the state of a paused VM, as used by
+// breakpoint conditions and watchpoints:
+//
+//	local0 > 100 && stack0 != 0
+//	local1.count        field of the struct local1 points to
+//	local2[3]           element of an array
+//	*0xc000012345       value stored in the heap block at an address
+//	area(local0, 2)     result of calling a pure guest function, see CallPure
+//
+// localN is the local at index N of the current frame, stackN the Nth
+// value from the top of its operand stack. ip, depth and instructions are
+// the address of the next instruction, the call depth and the number of
+// instructions executed. Arithmetic follows the VM: int32 wraps around,
+// mixing in a float32 gives a float32. Comparisons and the logical
+// operators give 1 or 0, and a condition holds when it isn't zero.
+type Expr struct {
+	source string
+	root   exprNode
+}
+
+// exprNode is a node of a parsed expression
+type exprNode interface {
+	eval(v *VM) (Value, error)
+}
+
+// ParseExpr parses a debugger expression.
+func ParseExpr(source string) (*Expr, error) {
+	tokens, err := lexExpr(source)
+	if err != nil {
+		return nil, err
+	}
+	p := &exprParser{tokens: tokens}
+	root, err := p.or()
+	if err == nil && p.pos < len(p.tokens) {
+		err = fmt.Errorf("unexpected %q", p.tokens[p.pos])
+	}
+	if err != nil {
+		return nil, fmt.Errorf("expression %q: %w", source, err)
+	}
+	return &Expr{source: source, root: root}, nil
+}
+
+func (e *Expr) String() string {
+	return e.source
+}
+
+// Eval evaluates the expression against the current frame of v.
+func (e *Expr) Eval(v *VM) (Value, error) {
+	return e.root.eval(v)
+}
+
+// Holds evaluates the expression as a condition.
+func (e *Expr) Holds(v *VM) (bool, error) {
+	value, err := e.Eval(v)
+	if err != nil {
+		return false, err
+	}
+	return truthy(value), nil
+}
+
+func lexExpr(source string) ([]string, error) {
+	var tokens []string
+	for i := 0; i < len(source); {
+		c := rune(source[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case unicode.IsLetter(c) || c == '_' || unicode.IsDigit(c):
+			start := i
+			for i < len(source) && (unicode.IsLetter(rune(source[i])) || unicode.IsDigit(rune(source[i])) || source[i] == '_' ||
+				source[i] == '.' && unicode.IsDigit(c)) {
+				i++
+			}
+			tokens = append(tokens, source[start:i])
+		default:
+			if i+1 < len(source) {
+				if two := source[i : i+2]; strings.Contains("== != <= >= && ||", two) {
+					tokens = append(tokens, two)
+					i += 2
+					continue
+				}
+			}
+			if !strings.ContainsRune("+-*/%<>!()[].,", c) {
+				return nil, fmt.Errorf("unexpected %q", c)
+			}
+			tokens = append(tokens, string(c))
+			i++
+		}
+	}
+	return tokens, nil
+}
+
+type exprParser struct {
+	tokens []string
+	pos    int
+}
+
+func (p *exprParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *exprParser) accept(ops ...string) (string, bool) {
+	for _, op := range ops {
+		if p.peek() == op {
+			p.pos++
+			return op, true
+		}
+	}
+	return "", false
+}
+
+// binary parses operands joined by ops, from left to right
+func (p *exprParser) binary(operand func() (exprNode, error), ops ...string) (exprNode, error) {
+	left, err := operand()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op, ok := p.accept(ops...)
+		if !ok {
+			return left, nil
+		}
+		right, err := operand()
+		if err != nil {
+			return nil, err
+		}
+		left = binaryNode{op, left, right}
+	}
+}
+
+func (p *exprParser) or() (exprNode, error) {
+	return p.binary(p.and, "||")
+}
+
+func (p *exprParser) and() (exprNode, error) {
+	return p.binary(p.comparison, "&&")
+}
+
+func (p *exprParser) comparison() (exprNode, error) {
+	return p.binary(p.sum, "==", "!=", "<=", ">=", "<", ">")
+}
+
+func (p *exprParser) sum() (exprNode, error) {
+	return p.binary(p.term, "+", "-")
+}
+
+func (p *exprParser) term() (exprNode, error) {
+	return p.binary(p.unary, "*", "/", "%")
+}
+
+func (p *exprParser) unary() (exprNode, error) {
+	if op, ok := p.accept("-", "!", "*"); ok {
+		operand, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return unaryNode{op, operand}, nil
+	}
+	return p.postfix()
+}
+
+func (p *exprParser) postfix() (exprNode, error) {
+	node, err := p.primary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		switch {
+		case p.peek() == ".":
+			p.pos++
+			field := p.peek()
+			if !isIdent(field) {
+				return nil, fmt.Errorf("expected a field name after %q", ".")
+			}
+			p.pos++
+			node = fieldNode{node, field}
+		case p.peek() == "[":
+			p.pos++
+			index, err := p.or()
+			if err != nil {
+				return nil, err
+			}
+			if _, ok := p.accept("]"); !ok {
+				return nil, fmt.Errorf("expected %q", "]")
+			}
+			node = indexNode{node, index}
+		default:
+			return node, nil
+		}
+	}
+}
+
+func (p *exprParser) primary() (exprNode, error) {
+	token := p.peek()
+	switch {
+	case token == "":
+		return nil, fmt.Errorf("unexpected end")
+	case token == "(":
+		p.pos++
+		node, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := p.accept(")"); !ok {
+			return nil, fmt.Errorf("expected %q", ")")
+		}
+		return node, nil
+	case unicode.IsDigit(rune(token[0])):
+		p.pos++
+		return parseNumber(token)
+	case isIdent(token) && p.pos+1 < len(p.tokens) && p.tokens[p.pos+1] == "(":
+		p.pos += 2
+		return p.call(token)
+	case isIdent(token):
+		p.pos++
+		return parseName(token)
+	}
+	return nil, fmt.Errorf("unexpected %q", token)
+}
+
+// call parses the arguments of a call to the function name, after its
+// opening parenthesis
+func (p *exprParser) call(name string) (exprNode, error) {
+	node := callNode{function: name}
+	if _, ok := p.accept(")"); ok {
+		return node, nil
+	}
+	for {
+		arg, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		node.args = append(node.args, arg)
+		if _, ok := p.accept(")"); ok {
+			return node, nil
+		}
+		if _, ok := p.accept(","); !ok {
+			return nil, fmt.Errorf("expected %q or %q in the arguments of %s", ",", ")", name)
+		}
+	}
+}
+
+func isIdent(token string) bool {
+	return token != "" && (unicode.IsLetter(rune(token[0])) || token[0] == '_')
+}
+
+// parseNumber parses an int32 or float32 literal. Integers beyond the
+// int32 range are heap addresses.
+func parseNumber(token string) (exprNode, error) {
+	if n, err := strconv.ParseInt(token, 0, 64); err == nil {
+		if n >= math.MinInt32 && n <= math.MaxInt32 {
+			return literalNode{Int32Value(int32(n))}, nil
+		}
+		return literalNode{PtrValue(uintptr(n))}, nil
+	}
+	if f, err := strconv.ParseFloat(token, 32); err == nil {
+		return literalNode{Float32Value(float32(f))}, nil
+	}
+	return nil, fmt.Errorf("invalid number %q", token)
+}
+
+func parseName(name string) (exprNode, error) {
+	switch name {
+	case "ip", "depth", "instructions":
+		return registerNode(name), nil
+	}
+	for _, prefix := range []string{"local", "stack"} {
+		if rest, ok := strings.CutPrefix(name, prefix); ok && rest != "" {
+			n, err := strconv.ParseUint(rest, 10, 32)
+			if err != nil {
+				break
+			}
+			if prefix == "local" {
+				return localNode(n), nil
+			}
+			return stackNode(n), nil
+		}
+	}
+	return nil, fmt.Errorf("unknown name %q, expected localN, stackN, ip, depth or instructions", name)
+}
+
+type literalNode struct{ value Value }
+
+func (n literalNode) eval(*VM) (Value, error) { return n.value, nil }
+
+type registerNode string
+
+func (n registerNode) eval(v *VM) (Value, error) {
+	switch n {
+	case "ip":
+		return Int32Value(int32(v.Ip)), nil
+	case "depth":
+		return Int32Value(int32(len(v.CallStack))), nil
+	default:
+		return Int32Value(int32(v.instructions)), nil
+	}
+}
+
+type localNode uint32
+
+func (n localNode) eval(v *VM) (Value, error) {
+	value, ok := v.getCurrentFrame().Locals[uint32(n)]
+	if !ok {
+		return Value{}, fmt.Errorf("local %d is not set", n)
+	}
+	return value, nil
+}
+
+type stackNode int
+
+func (n stackNode) eval(v *VM) (Value, error) {
+	stack := v.getCurrentFrame().LocalStack
+	if int(n) >= len(stack) {
+		return Value{}, fmt.Errorf("the stack holds %d values, there is no stack%d", len(stack), n)
+	}
+	return stack[len(stack)-1-int(n)], nil
+}
+
+type fieldNode struct {
+	object exprNode
+	field  string
+}
+
+func (n fieldNode) eval(v *VM) (Value, error) {
+	object, err := n.object.eval(v)
+	if err != nil {
+		return Value{}, err
+	}
+	value, err := v.Heap.GetStructField(object.Ptr(), n.field)
+	if err != nil {
+		return Value{}, err
+	}
+	return *value, nil
+}
+
+type indexNode struct {
+	array, index exprNode
+}
+
+func (n indexNode) eval(v *VM) (Value, error) {
+	array, err := n.array.eval(v)
+	if err != nil {
+		return Value{}, err
+	}
+	index, err := n.index.eval(v)
+	if err != nil {
+		return Value{}, err
+	}
+	if index.Kind() != ValueInt32 {
+		return Value{}, fmt.Errorf("array index is %v, not int32", index.Kind())
+	}
+	value, err := v.Heap.GetArrayElement(array.Ptr(), index.AsInt32())
+	if err != nil {
+		return Value{}, err
+	}
+	return *value, nil
+}
+
+type unaryNode struct {
+	op      string
+	operand exprNode
+}
+
+func (n unaryNode) eval(v *VM) (Value, error) {
+	value, err := n.operand.eval(v)
+	if err != nil {
+		return Value{}, err
+	}
+	switch n.op {
+	case "*":
+		loaded, err := v.Heap.LoadValue(value.Ptr())
+		if err != nil {
+			return Value{}, err
+		}
+		return *loaded, nil
+	case "!":
+		return boolValue(!truthy(value)), nil
+	default:
+		if value.Kind() == ValueFloat32 {
+			return Float32Value(-value.AsFloat32()), nil
+		}
+		i, _, err := exprNumber(value)
+		return Int32Value(int32(-i)), err
+	}
+}
+
+type callNode struct {
+	function string
+	args     []exprNode
+}
+
+func (n callNode) eval(v *VM) (Value, error) {
+	args := make([]Value, len(n.args))
+	for i, arg := range n.args {
+		value, err := arg.eval(v)
+		if err != nil {
+			return Value{}, err
+		}
+		args[i] = value
+	}
+	return v.CallPure(n.function, args)
+}
+
+type binaryNode struct {
+	op          string
+	left, right exprNode
+}
+
+func (n binaryNode) eval(v *VM) (Value, error) {
+	left, err := n.left.eval(v)
+	if err != nil {
+		return Value{}, err
+	}
+	// the logical operators short-circuit
+	if n.op == "&&" || n.op == "||" {
+		if truthy(left) == (n.op == "||") {
+			return boolValue(truthy(left)), nil
+		}
+		right, err := n.right.eval(v)
+		if err != nil {
+			return Value{}, err
+		}
+		return boolValue(truthy(right)), nil
+	}
+	right, err := n.right.eval(v)
+	if err != nil {
+		return Value{}, err
+	}
+	li, lf, err := exprNumber(left)
+	if err != nil {
+		return Value{}, err
+	}
+	ri, rf, err := exprNumber(right)
+	if err != nil {
+		return Value{}, err
+	}
+	float := left.Kind() == ValueFloat32 || right.Kind() == ValueFloat32
+	switch n.op {
+	case "==", "!=", "<", "<=", ">", ">=":
+		var cmp int
+		switch {
+		case float && lf < rf, !float && li < ri:
+			cmp = -1
+		case float && lf > rf, !float && li > ri:
+			cmp = 1
+		case float && lf != rf:
+			// NaN is neither less, greater nor equal
+			return boolValue(n.op == "!="), nil
+		}
+		switch n.op {
+		case "==":
+			return boolValue(cmp == 0), nil
+		case "!=":
+			return boolValue(cmp != 0), nil
+		case "<":
+			return boolValue(cmp < 0), nil
+		case "<=":
+			return boolValue(cmp <= 0), nil
+		case ">":
+			return boolValue(cmp > 0), nil
+		default:
+			return boolValue(cmp >= 0), nil
+		}
+	}
+	if float {
+		switch n.op {
+		case "+":
+			return Float32Value(float32(lf + rf)), nil
+		case "-":
+			return Float32Value(float32(lf - rf)), nil
+		case "*":
+			return Float32Value(float32(lf * rf)), nil
+		case "/":
+			return Float32Value(float32(lf / rf)), nil
+		}
+		return Value{}, fmt.Errorf("%% needs integers")
+	}
+	switch n.op {
+	case "+":
+		return Int32Value(int32(li + ri)), nil
+	case "-":
+		return Int32Value(int32(li - ri)), nil
+	case "*":
+		return Int32Value(int32(li * ri)), nil
+	}
+	if ri == 0 {
+		return Value{}, fmt.Errorf("division by zero")
+	}
+	if n.op == "/" {
+		return Int32Value(int32(li / ri)), nil
+	}
+	return Int32Value(int32(li % ri)), nil
+}
+
+// exprNumber returns a value as an integer and a float. Pointers are their
+// address.
+func exprNumber(value Value) (int64, float64, error) {
+	switch value.Kind() {
+	case ValueInt32:
+		return int64(value.AsInt32()), float64(value.AsInt32()), nil
+	case ValueFloat32:
+		return int64(value.AsFloat32()), float64(value.AsFloat32()), nil
+	case ValueByte:
+		return int64(value.AsByte()), float64(value.AsByte()), nil
+	case ValuePtr, ValueString, ValueArray, ValueStruct:
+		return int64(value.Ptr()), float64(value.Ptr()), nil
+	}
+	return 0, 0, fmt.Errorf("%v is not a number", value.Kind())
+}
+
+// truthy reports whether a condition holds: numbers and addresses that
+// aren't zero
+func truthy(value Value) bool {
+	i, f, err := exprNumber(value)
+	if value.Kind() == ValueFloat32 {
+		return f != 0
+	}
+	return err == nil && i != 0
+}
+
+func boolValue(b bool) Value {
+	if b {
+		return Int32Value(1)
+	}
+	return Int32Value(0)
+}
+
+// pinHeapAccess replaces the addresses the struct fields, array elements
+// and dereferences of node read by their current values, so the same heap
+// location is read whatever frame executes
+func pinHeapAccess(node exprNode, v *VM) (exprNode, error) {
+	pin := func(n exprNode) (exprNode, error) {
+		value, err := n.eval(v)
+		if err != nil {
+			return nil, err
+		}
+		return literalNode{value}, nil
+	}
+	var err error
+	switch n := node.(type) {
+	case fieldNode:
+		n.object, err = pin(n.object)
+		return n, err
+	case indexNode:
+		if n.array, err = pin(n.array); err != nil {
+			return nil, err
+		}
+		n.index, err = pin(n.index)
+		return n, err
+	case unaryNode:
+		if n.op == "*" {
+			n.operand, err = pin(n.operand)
+		} else {
+			n.operand, err = pinHeapAccess(n.operand, v)
+		}
+		return n, err
+	case binaryNode:
+		if n.left, err = pinHeapAccess(n.left, v); err != nil {
+			return nil, err
+		}
+		n.right, err = pinHeapAccess(n.right, v)
+		return n, err
+	case callNode:
+		args := make([]exprNode, len(n.args))
+		for i, arg := range n.args {
+			if args[i], err = pinHeapAccess(arg, v); err != nil {
+				return nil, err
+			}
+		}
+		n.args = args
+		return n, nil
+	}
+	return node, nil
+}
+
+// readsFrame reports whether node reads locals or the operand stack
+func readsFrame(node exprNode) bool {
+	switch n := node.(type) {
+	case localNode, stackNode:
+		return true
+	case fieldNode:
+		return readsFrame(n.object)
+	case indexNode:
+		return readsFrame(n.array) || readsFrame(n.index)
+	case unaryNode:
+		return readsFrame(n.operand)
+	case binaryNode:
+		return readsFrame(n.left) || readsFrame(n.right)
+	case callNode:
+		for _, arg := range n.args {
+			if readsFrame(arg) {
+				return true
+			}
+		}
+	}
+	return false
+}
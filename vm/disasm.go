@@ -0,0 +1,341 @@
+package vm
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/AndreiAlbert/gvm/bytecode"
+	. "github.com/AndreiAlbert/gvm/common"
+	"io"
+	"math"
+	"strings"
+)
+
+// listingBytes is the number of instruction bytes shown before the mnemonic
+const listingBytes = 8
+
+// disassembler walks a code section one instruction at a time
+type disassembler struct {
+	code       []byte
+	pos        int
+	err        error
+	fieldNames []string
+	functions  []bytecode.Function
+	// constants maps the addresses of instructions whose operand is an
+	// enum constant to the enum
+	constants map[uint32]*bytecode.Enum
+	// pool is the constant pool the pooled conditional jumps refer to
+	pool []uint32
+	// natives are the native declarations CALLNATIVE refers to
+	natives []bytecode.Native
+	// note annotates the current instruction, e.g. with a resolved name
+	note string
+}
+
+// Disassemble writes a listing of the program's code section, one
+// instruction per line with its address and encoded bytes. Function bodies
+// are labelled with their names and code with a source map is annotated
+// with the source line.
+func Disassemble(w io.Writer, program *bytecode.Program) error {
+	d := &disassembler{
+		code:      program.Code,
+		functions: program.Functions,
+		constants: enumConstants(program.Enums),
+		pool:      program.Constants,
+		natives:   program.Natives,
+	}
+	fieldIDs := make(map[string]bool)
+	for _, s := range program.Structs {
+		for _, field := range s.Fields {
+			if !fieldIDs[field.Name] {
+				fieldIDs[field.Name] = true
+				d.fieldNames = append(d.fieldNames, field.Name)
+			}
+		}
+	}
+	labels := make(map[uint32]string)
+	for i, f := range program.Functions {
+		name := f.Name
+		if name == "" {
+			name = fmt.Sprintf("func%d", i)
+		}
+		labels[f.Address] = name
+	}
+
+	fmt.Fprintf(w, "; gvm bytecode, container version %d, %d bytes of code\n", program.Version, len(program.Code))
+	lastLine := uint32(0)
+	for d.pos < len(d.code) {
+		start := d.pos
+		if label, ok := labels[uint32(start)]; ok {
+			fmt.Fprintf(w, "\n%s:\n", label)
+		}
+		d.note = ""
+		text := d.instruction()
+		if d.err != nil {
+			return fmt.Errorf("at address %d: %w", start, d.err)
+		}
+		encoded := d.code[start:d.pos]
+		hexBytes := make([]string, 0, listingBytes)
+		for i := 0; i < len(encoded) && i < listingBytes; i++ {
+			hexBytes = append(hexBytes, fmt.Sprintf("%02x", encoded[i]))
+		}
+		column := strings.Join(hexBytes, " ")
+		if len(encoded) > listingBytes {
+			column += " .."
+		}
+		var notes []string
+		if d.note != "" {
+			notes = append(notes, d.note)
+		}
+		if line, ok := program.LineFor(uint(start)); ok && line != lastLine {
+			notes = append(notes, fmt.Sprintf("line %d", line))
+			lastLine = line
+		}
+		if len(notes) > 0 {
+			text = fmt.Sprintf("%-32s ; %s", text, strings.Join(notes, ", "))
+		}
+		if _, err := fmt.Fprintf(w, "%08x  %-26s %s\n", start, column, text); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// enumConstants maps the addresses of the enum constants of enums to their
+// enum
+func enumConstants(enums []bytecode.Enum) map[uint32]*bytecode.Enum {
+	constants := make(map[uint32]*bytecode.Enum)
+	for i := range enums {
+		for _, address := range enums[i].Constants {
+			constants[address] = &enums[i]
+		}
+	}
+	return constants
+}
+
+// constant formats value, by its member name with the value as the note if
+// the instruction at start uses an enum constant
+func (d *disassembler) constant(start int, value int32) string {
+	if enum := d.constants[uint32(start)]; enum != nil {
+		if member, ok := enum.MemberName(value); ok {
+			d.note = fmt.Sprint(value)
+			return enum.Name + "." + member
+		}
+	}
+	return fmt.Sprint(value)
+}
+
+// instruction decodes the instruction at pos and formats it
+func (d *disassembler) instruction() string {
+	start := d.pos
+	opcode := Opcode(d.byte())
+	wide := false
+	if opcode == WIDE {
+		wide = true
+		opcode = Opcode(d.byte())
+		if !acceptsWide(opcode) {
+			d.fail(fmt.Errorf("WIDE prefix is not valid for %v", opcode))
+		}
+	}
+	name := opcode.String()
+	if wide {
+		name = "WIDE " + name
+	}
+	switch opcode {
+	case PUSH:
+		kind := ValueKind(d.byte())
+		switch kind {
+		case ValueInt32:
+			return fmt.Sprintf("%s int32 %s", name, d.constant(start, int32(d.uint32())))
+		case ValueFloat32:
+			return fmt.Sprintf("%s float32 %s", name, FloatFormat{}.Format(math.Float32frombits(d.uint32())))
+		case ValueByte:
+			return fmt.Sprintf("%s byte %d", name, d.byte())
+		default:
+			d.fail(fmt.Errorf("unsupported type in PUSH: %v", kind))
+		}
+	case STORE, LOAD:
+		return fmt.Sprintf("%s %d", name, d.operand(wide))
+	case JMP, TRY, FORITER:
+		return fmt.Sprintf("%s 0x%08x", name, d.operand(wide))
+	case CALL:
+		index := d.operand(wide)
+		if int(index) < len(d.functions) && d.functions[index].Name != "" {
+			d.note = d.functions[index].Name
+		}
+		return fmt.Sprintf("%s %d", name, index)
+	case CALLNATIVE:
+		index := d.operand(wide)
+		if int(index) < len(d.natives) {
+			d.note = d.natives[index].Signature()
+		}
+		return fmt.Sprintf("%s %d", name, index)
+	case MAKECLOSURE:
+		index := d.operand(wide)
+		if int(index) < len(d.functions) && d.functions[index].Name != "" {
+			d.note = d.functions[index].Name
+		}
+		return fmt.Sprintf("%s %d captures=%d", name, index, d.byte())
+	case IJE, IJNE:
+		addr := d.operand(wide)
+		return fmt.Sprintf("%s 0x%08x, %s", name, addr, d.constant(start, int32(d.uint32())))
+	case FJE, FJNE:
+		addr := d.operand(wide)
+		return fmt.Sprintf("%s 0x%08x, %s", name, addr, FloatFormat{}.Format(math.Float32frombits(d.uint32())))
+	case IJEC, IJNEC, FJEC, FJNEC:
+		addr := d.operand(wide)
+		index := d.byte()
+		if int(index) >= len(d.pool) {
+			return fmt.Sprintf("%s 0x%08x, constant %d", name, addr, index)
+		}
+		value := d.pool[index]
+		if opcode == FJEC || opcode == FJNEC {
+			d.note = fmt.Sprintf("constant %d", index)
+			return fmt.Sprintf("%s 0x%08x, %s", name, addr, FloatFormat{}.Format(math.Float32frombits(value)))
+		}
+		text := d.constant(start, int32(value))
+		d.note = fmt.Sprintf("constant %d", index)
+		return fmt.Sprintf("%s 0x%08x, %s", name, addr, text)
+	case STRALLOC:
+		length := int(d.uint16())
+		if d.need(length) {
+			s := string(d.code[d.pos : d.pos+length])
+			d.pos += length
+			return fmt.Sprintf("%s %q", name, s)
+		}
+	case NEWARR:
+		return fmt.Sprintf("%s %v", name, ValueKind(d.byte()))
+	case SYSCALL:
+		number := d.uint16()
+		if _, ok := syscallSignatures[Systemcall(number)]; ok && number <= 0xff {
+			return fmt.Sprintf("%s %v", name, Systemcall(number))
+		}
+		return fmt.Sprintf("%s %d", name, number)
+	case INVOKEINTERFACE:
+		method := d.string()
+		args := d.byte()
+		return fmt.Sprintf("%s %s args=%d returns=%v", name, method, args, ValueKind(d.byte()))
+	case CHECKCAST, INSTANCEOF:
+		return fmt.Sprintf("%s %v", name, d.typeRef())
+	case NEWSTRUCT, FLDGET_NAME, STFIELD_NAME:
+		return fmt.Sprintf("%s %s", name, d.string())
+	case FLDGET, STFIELD:
+		id := d.uint16()
+		if int(id) < len(d.fieldNames) {
+			d.note = d.fieldNames[id]
+		}
+		return fmt.Sprintf("%s %d", name, id)
+	case FUNC:
+		kind := Opcode(d.byte())
+		params := d.uint16()
+		returnType := ValueKind(d.byte())
+		if returnType == ValueStruct {
+			return fmt.Sprintf("%s %v params=%d returns=%s", name, kind, params, d.string())
+		}
+		return fmt.Sprintf("%s %v params=%d returns=%v", name, kind, params, returnType)
+	case DEFSTRUCT:
+		structName := d.string()
+		fieldCount := int(d.byte())
+		fields := make([]string, 0, fieldCount)
+		for i := 0; i < fieldCount && d.err == nil; i++ {
+			fieldName := d.string()
+			fieldType := ValueKind(d.byte())
+			if fieldType == ValueArray {
+				fields = append(fields, fmt.Sprintf("%s: [%v]", fieldName, ValueKind(d.byte())))
+			} else {
+				fields = append(fields, fmt.Sprintf("%s: %v", fieldName, fieldType))
+			}
+		}
+		return fmt.Sprintf("%s %s { %s }", name, structName, strings.Join(fields, ", "))
+	default:
+		if info, ok := lookupExtension(opcode); ok && len(info.Operands) > 0 {
+			operands := make([]string, len(info.Operands))
+			for i, operand := range info.Operands {
+				if arg := d.operandOf(operand.Type, false); operand.Type == OperandString {
+					operands[i] = fmt.Sprintf("%q", arg)
+				} else {
+					operands[i] = fmt.Sprint(arg)
+				}
+			}
+			return fmt.Sprintf("%s %s", name, strings.Join(operands, ", "))
+		}
+		return name
+	}
+	return name
+}
+
+func (d *disassembler) fail(err error) {
+	if d.err == nil {
+		d.err = err
+	}
+}
+
+func (d *disassembler) need(n int) bool {
+	if d.err != nil {
+		return false
+	}
+	if len(d.code)-d.pos < n {
+		d.fail(io.ErrUnexpectedEOF)
+		return false
+	}
+	return true
+}
+
+func (d *disassembler) byte() byte {
+	if !d.need(1) {
+		return 0
+	}
+	b := d.code[d.pos]
+	d.pos++
+	return b
+}
+
+func (d *disassembler) uint16() uint16 {
+	if !d.need(2) {
+		return 0
+	}
+	v := binary.BigEndian.Uint16(d.code[d.pos:])
+	d.pos += 2
+	return v
+}
+
+func (d *disassembler) uint32() uint32 {
+	if !d.need(4) {
+		return 0
+	}
+	v := binary.BigEndian.Uint32(d.code[d.pos:])
+	d.pos += 4
+	return v
+}
+
+func (d *disassembler) operand(wide bool) uint32 {
+	if wide {
+		return d.uint32()
+	}
+	return uint32(d.uint16())
+}
+
+func (d *disassembler) typeRef() typeRef {
+	t := typeRef{Kind: ValueKind(d.byte())}
+	switch t.Kind {
+	case ValueStruct:
+		t.Struct = d.string()
+	case ValueArray:
+		t.Element = ValueKind(d.byte())
+	}
+	return t
+}
+
+func (d *disassembler) string() string {
+	if d.err != nil {
+		return ""
+	}
+	for end := d.pos; end < len(d.code); end++ {
+		if d.code[end] == 0 {
+			s := string(d.code[d.pos:end])
+			d.pos = end + 1
+			return s
+		}
+	}
+	d.fail(io.ErrUnexpectedEOF)
+	return ""
+}
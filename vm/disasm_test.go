@@ -0,0 +1,61 @@
+package vm
+
+import (
+	"bytes"
+	"github.com/AndreiAlbert/gvm/bytecode"
+	. "github.com/AndreiAlbert/gvm/common"
+	"strings"
+	"testing"
+)
+
+func TestDisassemble(t *testing.T) {
+	code := []byte{
+		byte(FUNC), byte(FUNC_MAIN), 0, 0, byte(ValueVoid),
+		byte(PUSH), byte(ValueInt32), 0, 0, 0, 42,
+		byte(WIDE), byte(STORE), 0, 1, 0x11, 0x70,
+		byte(CALL), 0, 0,
+		byte(STFIELD), 0, 0,
+		byte(STRALLOC), 0, 2, 'h', 'i',
+		byte(SYSCALL), 0, byte(STR_LEN),
+		byte(SYSCALL), 0, 0xfe,
+		byte(HALT),
+	}
+	program := &bytecode.Program{
+		Version:   bytecode.Version,
+		Functions: []bytecode.Function{{Name: "main", Address: 5, IsMain: true}},
+		Structs:   []StructType{{Name: "Point", Fields: []StructField{{Name: "x", Type: ValueInt32}}}},
+		Code:      code,
+		Lines:     []bytecode.LineEntry{{Address: 5, Line: 3}},
+	}
+
+	var buf bytes.Buffer
+	if err := Disassemble(&buf, program); err != nil {
+		t.Fatalf("Failed to disassemble: %v", err)
+	}
+	listing := buf.String()
+	for _, want := range []string{
+		"FUNC FUNC_MAIN params=0 returns=void",
+		"\nmain:\n",
+		"00000005  01 00 00 00 00 2a",
+		"PUSH int32 42",
+		"; line 3",
+		"WIDE STORE 70000",
+		"CALL 0",
+		"; main",
+		"STFIELD 0",
+		"; x",
+		`STRALLOC "hi"`,
+		"SYSCALL STR_LEN",
+		"SYSCALL 254",
+		"HALT",
+	} {
+		if !strings.Contains(listing, want) {
+			t.Errorf("Listing is missing %q:\n%s", want, listing)
+		}
+	}
+
+	program.Code = code[:8]
+	if err := Disassemble(&buf, program); err == nil {
+		t.Error("Expected an error for a truncated instruction")
+	}
+}
@@ -0,0 +1,309 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	. "github.com/AndreiAlbert/gvm/common"
+	"github.com/AndreiAlbert/gvm/heap"
+)
+
+// maxErrorChain bounds the causes followed when loading an Error value,
+// a cause pointing back into its own chain would loop forever otherwise
+const maxErrorChain = 64
+
+// Codes of the Error values delivered to TRY handlers for failed heap
+// accesses, arithmetic, assertions, file mappings, frees of pinned blocks,
+// bad command-line options, malformed CSV and times. Programs should
+// pick non-negative codes for their own errors.
+const (
+	CodeInvalidAddress int32 = -1 - iota
+	CodeOutOfBounds
+	CodeTypeMismatch
+	CodeDivisionByZero
+	CodeAssertionFailed
+	CodeReadOnly
+	CodeFileAccess
+	CodePinned
+	CodeBadOption
+	CodeMalformedCSV
+	CodeMalformedTime
+)
+
+// ErrDivisionByZero is the cause of the RuntimeError raised by IDIV, and
+// by FDIV under Options.TrapFloatDivision, when the divisor is zero.
+var ErrDivisionByZero = errors.New("division by zero")
+
+// ErrFileAccess is the cause of the RuntimeError raised by MMAP_FILE when
+// mapping files is disabled, the path leaves Options.MapRoot or the file
+// can't be mapped.
+var ErrFileAccess = errors.New("file access denied")
+
+// AssertionError is the cause of the RuntimeError raised by a failing
+// ASSERT_EQ or ASSERT_NEAR. The values are printed as PRINT_ANY does.
+type AssertionError struct {
+	Expected string
+	Actual   string
+	// Tolerance is the difference ASSERT_NEAR allows, empty for ASSERT_EQ
+	Tolerance string
+	Function  string
+	// Line is the source line of the assertion, 0 when the program has no
+	// source map
+	Line uint32
+}
+
+func (e *AssertionError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "assertion failed in %s", e.Function)
+	if e.Line != 0 {
+		fmt.Fprintf(&b, " at line %d", e.Line)
+	}
+	fmt.Fprintf(&b, ": expected %s", e.Expected)
+	if e.Tolerance != "" {
+		fmt.Fprintf(&b, " within %s", e.Tolerance)
+	}
+	fmt.Fprintf(&b, ", got %s", e.Actual)
+	return b.String()
+}
+
+// handler is a TRY handler. An error caught by it unwinds the call stack
+// to frame and the frame's operand stack to stack values.
+type handler struct {
+	address uint
+	frame   int
+	stack   int
+}
+
+// GuestError is an Error value thrown by a program and not caught, it is
+// the cause of the RuntimeError returned by Run.
+type GuestError struct {
+	Code    int32
+	Message string
+	// Cause is the error this one wraps, nil if none
+	Cause *GuestError
+	// Backtrace names the functions on the call stack at the THROW,
+	// innermost first. Causes have no backtrace.
+	Backtrace []string
+	// value is the address of the thrown Error value
+	value uintptr
+}
+
+// Error formats the chain as "message (code n): cause (code m)".
+func (e *GuestError) Error() string {
+	var b strings.Builder
+	for cur := e; cur != nil; cur = cur.Cause {
+		if cur != e {
+			b.WriteString(": ")
+		}
+		fmt.Fprintf(&b, "%s (code %d)", cur.Message, cur.Code)
+	}
+	return b.String()
+}
+
+func (e *GuestError) Unwrap() error {
+	if e.Cause == nil {
+		return nil
+	}
+	return e.Cause
+}
+
+// defineBuiltinStruct registers a built-in struct, such as Error, unless
+// the program declares it. A declaration must match the built-in layout.
+func (v *VM) defineBuiltinStruct(builtin StructType, purpose string) error {
+	declared, ok := v.structs[builtin.Name]
+	if !ok {
+		v.defineStruct(builtin)
+		return nil
+	}
+	names := make([]string, len(builtin.Fields))
+	for i, field := range builtin.Fields {
+		names[i] = field.Name
+	}
+	last := len(names) - 1
+	mismatch := fmt.Errorf("struct %s is reserved for %s and must have fields %s and %s", builtin.Name, purpose, strings.Join(names[:last], ", "), names[last])
+	if len(declared.Fields) != len(builtin.Fields) {
+		return mismatch
+	}
+	for i, field := range builtin.Fields {
+		if declared.Fields[i].Name != field.Name || declared.Fields[i].Type != field.Type {
+			return mismatch
+		}
+	}
+	return nil
+}
+
+// defineBuiltinStructs registers the Error and DateTime structs
+func (v *VM) defineBuiltinStructs() error {
+	if err := v.defineBuiltinStruct(ErrorStruct(), "error values"); err != nil {
+		return err
+	}
+	return v.defineBuiltinStruct(DateTimeStruct(), "dates")
+}
+
+// newErrorValue allocates an Error value. A zero cause means none.
+func (v *VM) newErrorValue(code int32, message, cause uintptr) uintptr {
+	if _, err := v.Heap.LoadString(message); err != nil {
+		v.failf("error message must be a string: %v", err)
+	}
+	if cause != 0 && !v.isErrorValue(cause) {
+		v.failf("error cause must be an Error value")
+	}
+	ptr, err := v.Heap.AllocateStruct(v.structs[ErrorStructName])
+	if err != nil {
+		v.fail(err)
+	}
+	for _, field := range []struct {
+		name  string
+		value Value
+	}{
+		{"code", Int32Value(code)},
+		{"message", PtrValue(message)},
+		{"cause", PtrValue(cause)},
+	} {
+		if err := v.Heap.SetStructureField(ptr, field.name, field.value); err != nil {
+			v.fail(err)
+		}
+	}
+	return ptr
+}
+
+func (v *VM) isErrorValue(ptr uintptr) bool {
+	structType, err := v.Heap.StructTypeOf(ptr)
+	return err == nil && structType.Name == ErrorStructName
+}
+
+// loadGuestError reads the Error value at ptr and its causes.
+func (v *VM) loadGuestError(ptr uintptr) (*GuestError, error) {
+	var head, tail *GuestError
+	for depth := 0; ptr != 0; depth++ {
+		if depth == maxErrorChain {
+			return nil, fmt.Errorf("error chain longer than %d causes", maxErrorChain)
+		}
+		if !v.isErrorValue(ptr) {
+			return nil, errors.New("not an Error value")
+		}
+		code, err := v.Heap.GetStructField(ptr, "code")
+		if err != nil {
+			return nil, err
+		}
+		messagePtr, err := v.Heap.GetStructField(ptr, "message")
+		if err != nil {
+			return nil, err
+		}
+		message, err := v.Heap.LoadString(messagePtr.Ptr())
+		if err != nil {
+			return nil, fmt.Errorf("error message: %w", err)
+		}
+		cause, err := v.Heap.GetStructField(ptr, "cause")
+		if err != nil {
+			return nil, err
+		}
+		guestErr := &GuestError{Code: int32(code.Raw()), Message: message}
+		if head == nil {
+			head = guestErr
+		} else {
+			tail.Cause = guestErr
+		}
+		tail = guestErr
+		ptr = cause.Ptr()
+	}
+	return head, nil
+}
+
+// throw raises the Error value on top of the stack
+func (v *VM) throw() {
+	value := v.pop()
+	if value.Kind() != ValuePtr {
+		v.failf("THROW expects an Error value, got %v", value.Kind())
+	}
+	guestErr, err := v.loadGuestError(value.Ptr())
+	if err != nil {
+		v.failf("THROW expects an Error value: %v", err)
+	}
+	guestErr.Backtrace = v.backtraceNames()
+	guestErr.value = value.Ptr()
+	v.fail(guestErr)
+}
+
+// catchable returns the Error value or the code of the Error value that
+// a TRY handler receives for err. Limits, cancellation and faults of the
+// interpreter can't be caught.
+func catchable(err error) (value uintptr, code int32, ok bool) {
+	var guestErr *GuestError
+	var typeErr *TypeError
+	var assertErr *AssertionError
+	switch {
+	case errors.As(err, &guestErr):
+		return guestErr.value, 0, true
+	case errors.Is(err, heap.ErrInvalidAddress):
+		return 0, CodeInvalidAddress, true
+	case errors.Is(err, heap.ErrOutOfBounds):
+		return 0, CodeOutOfBounds, true
+	case errors.Is(err, heap.ErrTypeMismatch), errors.As(err, &typeErr):
+		return 0, CodeTypeMismatch, true
+	case errors.Is(err, ErrDivisionByZero):
+		return 0, CodeDivisionByZero, true
+	case errors.Is(err, heap.ErrReadOnly):
+		return 0, CodeReadOnly, true
+	case errors.Is(err, ErrFileAccess):
+		return 0, CodeFileAccess, true
+	case errors.Is(err, heap.ErrPinned):
+		return 0, CodePinned, true
+	case errors.Is(err, ErrBadOption):
+		return 0, CodeBadOption, true
+	case errors.Is(err, ErrMalformedCSV):
+		return 0, CodeMalformedCSV, true
+	case errors.Is(err, ErrMalformedTime):
+		return 0, CodeMalformedTime, true
+	case errors.As(err, &assertErr):
+		return 0, CodeAssertionFailed, true
+	}
+	return 0, 0, false
+}
+
+// catch delivers err to the innermost TRY handler: the stack is unwound
+// to the TRY, the Error value pushed and execution continues at the
+// handler. It reports false if err isn't caught.
+func (v *VM) catch(err *RuntimeError) bool {
+	if len(v.handlers) == 0 {
+		return false
+	}
+	value, code, ok := catchable(err.Err)
+	if !ok {
+		return false
+	}
+	if value == 0 {
+		// the error value needs heap space, an allocation failing here
+		// leaves the original error uncaught
+		message, allocErr := v.Heap.AllocateString(err.Err.Error())
+		if allocErr != nil {
+			return false
+		}
+		value, allocErr = v.Heap.AllocateStruct(v.structs[ErrorStructName])
+		if allocErr != nil {
+			return false
+		}
+		v.Heap.SetStructureField(value, "code", Int32Value(code))
+		v.Heap.SetStructureField(value, "message", PtrValue(message))
+	}
+	h := v.handlers[len(v.handlers)-1]
+	v.popHandler()
+	for len(v.CallStack) > h.frame+1 {
+		v.popFrame()
+	}
+	for len(v.getCurrentFrame().LocalStack) > h.stack {
+		v.pop()
+	}
+	v.push(PtrValue(value))
+	v.wide = false
+	v.Ip = h.address
+	return true
+}
+
+// dropHandlers removes the handlers of frames that have returned
+func (v *VM) dropHandlers() {
+	for len(v.handlers) > 0 && v.handlers[len(v.handlers)-1].frame >= len(v.CallStack) {
+		v.popHandler()
+	}
+}
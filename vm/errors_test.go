@@ -0,0 +1,147 @@
+package vm
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/AndreiAlbert/gvm/bytecode"
+	. "github.com/AndreiAlbert/gvm/common"
+	"github.com/AndreiAlbert/gvm/heap"
+)
+
+func TestThrowReturnsGuestError(t *testing.T) {
+	err := RunReader(bytes.NewReader(mustReadTestProgram(t, "testdata/throw.gvmbc")), Options{})
+	var guestErr *GuestError
+	if !errors.As(err, &guestErr) {
+		t.Fatalf("Expected a guest error, got %v", err)
+	}
+	if guestErr.Code != 7 || guestErr.Message != "cannot load config" {
+		t.Errorf("Unexpected error: %+v", guestErr)
+	}
+	if guestErr.Cause == nil || guestErr.Cause.Code != 2 || guestErr.Cause.Message != "file not found" {
+		t.Errorf("Unexpected cause: %+v", guestErr.Cause)
+	}
+	if want := []string{"loadconfig", "main"}; !reflect.DeepEqual(guestErr.Backtrace, want) {
+		t.Errorf("Expected backtrace %v, got %v", want, guestErr.Backtrace)
+	}
+	if want := "cannot load config (code 7): file not found (code 2)"; guestErr.Error() != want {
+		t.Errorf("Expected %q, got %q", want, guestErr.Error())
+	}
+	if !errors.Is(err, guestErr.Cause) {
+		t.Error("Expected the cause to be in the error chain")
+	}
+}
+
+func TestThrowRejectsOtherValues(t *testing.T) {
+	program, err := bytecode.Decode(mustReadTestProgram(t, "testdata/throw.gvmbc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	machine, err := NewVmFromProgram(program, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer machine.Close()
+
+	strPtr, err := machine.Heap.AllocateString("not an error")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, value := range []Value{Int32Value(1), PtrValue(strPtr)} {
+		machine.push(value)
+		err := catchRuntimeError(machine.throw)
+		var guestErr *GuestError
+		if err == nil || errors.As(err, &guestErr) {
+			t.Errorf("Expected throwing %v to fail, got %v", value.Kind(), err)
+		}
+	}
+}
+
+func TestErrorStructMustMatch(t *testing.T) {
+	program := &bytecode.Program{
+		Functions: []bytecode.Function{{Name: "main", IsMain: true, ReturnType: ValueVoid}},
+		Structs:   []StructType{{Name: ErrorStructName, Fields: []StructField{{Name: "code", Type: ValueInt32}}}},
+		Code:      []byte{byte(RET)},
+	}
+	if _, err := NewVmFromProgram(program, Options{}); err == nil {
+		t.Error("Expected a mismatching Error struct to be rejected")
+	}
+}
+
+func TestTryCatchesErrors(t *testing.T) {
+	var out bytes.Buffer
+	err := RunReader(bytes.NewReader(mustReadTestProgram(t, "testdata/catch.gvmbc")), Options{Stdout: &out})
+	// the thrown error carries code 7, the failed access CodeOutOfBounds
+	if out.String() != "70" {
+		t.Errorf("Expected output %q, got %q", "70", out.String())
+	}
+	// the last access is outside of any TRY
+	if !errors.Is(err, heap.ErrOutOfBounds) {
+		t.Errorf("Expected an uncaught out of bounds error, got %v", err)
+	}
+}
+
+func TestHandlersEndWithTheirFunction(t *testing.T) {
+	// main calls f, which installs a handler and returns without ENDTRY,
+	// then main fails
+	f := []byte{byte(TRY), 0, 0, byte(PUSH), byte(ValueInt32), 0, 0, 0, 0, byte(RET)}
+	main := join(pushInt(0), []byte{byte(FREE)})
+	main = join([]byte{byte(CALL), 0, 1}, main)
+	program := &bytecode.Program{
+		Functions: []bytecode.Function{
+			{Name: "main", IsMain: true, ReturnType: ValueVoid, Address: uint32(len(f))},
+			{Name: "f", ReturnType: ValueInt32},
+		},
+		Code: join(f, main),
+	}
+	machine, err := NewVmFromProgram(program, Options{MaxInstructions: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer machine.Close()
+	err = machine.Run()
+	var typeErr *TypeError
+	if !errors.As(err, &typeErr) {
+		t.Errorf("Expected the type error to be uncaught, got %v", err)
+	}
+}
+
+func TestEndTryWithoutTry(t *testing.T) {
+	if err := runCode(t, []byte{byte(ENDTRY)}); err == nil {
+		t.Error("Expected ENDTRY without TRY to fail")
+	}
+}
+
+func TestLimitsAreNotCaught(t *testing.T) {
+	// TRY 0 jumps back to itself on every caught error
+	if err := runCode(t, []byte{byte(TRY), 0, 0, byte(JMP), 0, 3}); !errors.Is(err, ErrInstructionLimit) {
+		t.Errorf("Expected the instruction limit to end the program, got %v", err)
+	}
+}
+
+// catchRuntimeError runs f and returns the runtime error it failed with
+func catchRuntimeError(f func()) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = r.(*RuntimeError)
+		}
+	}()
+	f()
+	return nil
+}
+
+func TestCheckcastAndInstanceof(t *testing.T) {
+	var out bytes.Buffer
+	err := RunReader(bytes.NewReader(mustReadTestProgram(t, "testdata/typecheck.gvmbc")), Options{Stdout: &out})
+	// instanceof Point, Pair, int32[] and string, the caught CHECKCAST
+	// failure (code -3 + 54), then a CHECKCAST that passed
+	if out.String() != "101131" {
+		t.Errorf("Expected output %q, got %q", "101131", out.String())
+	}
+	// the last CHECKCAST is outside of any TRY
+	if !errors.Is(err, heap.ErrTypeMismatch) {
+		t.Errorf("Expected an uncaught type mismatch, got %v", err)
+	}
+}
@@ -0,0 +1,364 @@
+package vm
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"strings"
+
+	. "github.com/AndreiAlbert/gvm/common"
+)
+
+// decodedInstruction is an instruction decoded following its opcode table
+// entry
+type decodedInstruction struct {
+	Opcode Opcode
+	Wide   bool
+	// Args holds a value per operand of the table entry: uint32 for
+	// bytes, u16 and indexes, int32, float32, ValueKind, Value, typeRef,
+	// and string for strings, byte strings and field lists
+	Args []any
+	// Next is the address of the following instruction
+	Next uint
+}
+
+// decodeInstruction decodes the instruction at address
+func decodeInstruction(code []byte, address uint) (decodedInstruction, error) {
+	if address >= uint(len(code)) {
+		return decodedInstruction{}, fmt.Errorf("address %d is outside of the code", address)
+	}
+	d := &disassembler{code: code, pos: int(address)}
+	inst := decodedInstruction{Opcode: Opcode(d.byte())}
+	if inst.Opcode == WIDE {
+		inst.Wide = true
+		inst.Opcode = Opcode(d.byte())
+		if d.err == nil && !acceptsWide(inst.Opcode) {
+			return inst, fmt.Errorf("WIDE prefix is not valid for %v", inst.Opcode)
+		}
+	}
+	info, ok := LookupOpcode(inst.Opcode)
+	if !ok {
+		return inst, fmt.Errorf("unknown opcode %d", byte(inst.Opcode))
+	}
+	for _, operand := range info.Operands {
+		inst.Args = append(inst.Args, d.operandOf(operand.Type, inst.Wide))
+	}
+	if inst.Opcode == FUNC && len(inst.Args) == 3 && inst.Args[2] == ValueStruct {
+		d.string()
+	}
+	if d.err != nil {
+		return inst, fmt.Errorf("at address %d: %w", address, d.err)
+	}
+	inst.Next = uint(d.pos)
+	return inst, nil
+}
+
+// operandOf decodes an operand of type t
+func (d *disassembler) operandOf(t OperandType, wide bool) any {
+	switch t {
+	case OperandByte:
+		return uint32(d.byte())
+	case OperandU16:
+		return uint32(d.uint16())
+	case OperandInt32:
+		return int32(d.uint32())
+	case OperandFloat32:
+		return math.Float32frombits(d.uint32())
+	case OperandIndex:
+		return d.operand(wide)
+	case OperandKind:
+		return ValueKind(d.byte())
+	case OperandValue:
+		switch kind := ValueKind(d.byte()); kind {
+		case ValueInt32, ValueFloat32:
+			return NewValue(kind, uint64(d.uint32()))
+		case ValueByte:
+			return ByteValue(d.byte())
+		default:
+			d.fail(fmt.Errorf("unsupported type in PUSH: %v", kind))
+			return Value{}
+		}
+	case OperandString:
+		return d.string()
+	case OperandBytes:
+		length := int(d.uint16())
+		if !d.need(length) {
+			return ""
+		}
+		d.pos += length
+		return string(d.code[d.pos-length : d.pos])
+	case OperandTypeRef:
+		return d.typeRef()
+	default:
+		var fields []string
+		count := int(d.byte())
+		for i := 0; i < count && d.err == nil; i++ {
+			name := d.string()
+			kind := ValueKind(d.byte())
+			if kind == ValueArray {
+				fields = append(fields, fmt.Sprintf("%s: [%v]", name, ValueKind(d.byte())))
+			} else {
+				fields = append(fields, fmt.Sprintf("%s: %v", name, kind))
+			}
+		}
+		return strings.Join(fields, ", ")
+	}
+}
+
+// Explanation describes an instruction and what executing it next would do
+// to the operand stack of the current frame.
+type Explanation struct {
+	Address uint
+	Info    OpcodeInfo
+	Wide    bool
+	// Operands are the decoded operands of Info.Operands, formatted
+	Operands []string
+	// Stack is the stack effect of the instruction, for SYSCALL the
+	// signature of the system call
+	Stack string
+	// Before is the operand stack, bottom first
+	Before []Value
+	// After is the modelled stack once the instruction executed. For
+	// instructions that leave the frame, such as RET, it is the stack of
+	// the frame execution continues in.
+	After []StackSlot
+	// Effect describes where execution continues and other effects beyond
+	// the stack
+	Effect string
+	// Problem is why the instruction will fail, empty unless the model
+	// predicts a failure
+	Problem string
+}
+
+// Explain decodes the instruction at address and models its effect on the
+// current operand stack as if it executed next, without executing it.
+func (v *VM) Explain(address uint) (*Explanation, error) {
+	inst, err := decodeInstruction(v.Bytecode, address)
+	if err != nil {
+		return nil, err
+	}
+	info, _ := LookupOpcode(inst.Opcode)
+	e := &Explanation{Address: address, Info: info, Wide: inst.Wide, Stack: info.StackEffect()}
+	if inst.Opcode == SYSCALL {
+		if signature, ok := Systemcall(inst.Args[0].(uint32)).Signature(); ok && inst.Args[0].(uint32) <= 0xff {
+			e.Stack = signature.String()
+		}
+	}
+	frame := v.getCurrentFrame()
+	e.Before = append([]Value(nil), frame.LocalStack...)
+	for i, arg := range inst.Args {
+		e.Operands = append(e.Operands, v.formatOperand(e.Info.Operands[i], inst.Opcode, arg))
+	}
+	effect := v.modelStack(inst, frame.LocalStack)
+	e.Problem = effect.problem
+	if e.Problem != "" && len(e.Before) < len(effect.pops) {
+		return e, nil
+	}
+	for _, value := range frame.LocalStack[:len(frame.LocalStack)-len(effect.pops)] {
+		e.After = append(e.After, knownSlot(value))
+	}
+	e.After = append(e.After, effect.pushes...)
+	e.Effect = v.explainControl(inst, frame, e)
+	return e, nil
+}
+
+// formatOperand formats arg, naming what it refers to where the VM knows
+func (v *VM) formatOperand(operand Operand, op Opcode, arg any) string {
+	text := fmt.Sprint(arg)
+	switch arg := arg.(type) {
+	case uint32:
+		if operand.Name == "address" {
+			return fmt.Sprintf("0x%08x", arg)
+		}
+		switch op {
+		case CALL, MAKECLOSURE:
+			if operand.Name == "function" && int(arg) < len(v.functionList) && v.functionList[arg].Name != "" {
+				text += " (" + v.functionList[arg].Name + ")"
+			}
+		case SYSCALL:
+			text += " (" + Systemcall(arg).String() + ")"
+		case CALLNATIVE:
+			if int(arg) < len(v.natives) {
+				text += " (" + v.natives[arg].Name + ")"
+			}
+		case FLDGET, STFIELD:
+			if int(arg) < len(v.fieldNames) {
+				text += " (" + v.fieldNames[arg] + ")"
+			}
+		case LOAD, STORE:
+			if value, ok := v.getCurrentFrame().Locals[arg]; ok {
+				text += fmt.Sprintf(" (holds %v:%v)", value.Kind(), value)
+			}
+		case IJEC, IJNEC, FJEC, FJNEC:
+			if value, ok := v.poolConstant(op, arg); operand.Name == "constant" && ok {
+				text += fmt.Sprintf(" (%v:%v)", value.Kind(), value)
+			}
+		}
+	case Value:
+		text = fmt.Sprintf("%v %v", arg.Kind(), arg)
+	case string:
+		if operand.Type != OperandFields {
+			text = fmt.Sprintf("%q", arg)
+		}
+	}
+	return text
+}
+
+// poolConstant returns the constant pool entry at index as the value the
+// pooled conditional jump op compares with
+func (v *VM) poolConstant(op Opcode, index uint32) (Value, bool) {
+	if int(index) >= len(v.constants) {
+		return Value{}, false
+	}
+	if op == IJEC || op == IJNEC {
+		return Int32Value(int32(v.constants[index])), true
+	}
+	return Float32Value(math.Float32frombits(v.constants[index])), true
+}
+
+// explainControl describes where execution continues after inst and
+// adjusts the modelled stack of instructions that leave the frame
+func (v *VM) explainControl(inst decodedInstruction, frame *StackFrame, e *Explanation) string {
+	switch inst.Opcode {
+	case HALT:
+		return "stops the program"
+	case JMP:
+		return fmt.Sprintf("continues at 0x%08x", inst.Args[0])
+	case IJE, IJNE, FJE, FJNE, IJEC, IJNEC, FJEC, FJNEC:
+		target := fmt.Sprintf("0x%08x", inst.Args[0])
+		if e.Problem != "" {
+			return "jumps to " + target + " or falls through"
+		}
+		x := frame.LocalStack[len(frame.LocalStack)-1]
+		var value Value
+		switch inst.Opcode {
+		case IJE, IJNE:
+			value = Int32Value(inst.Args[1].(int32))
+		case FJE, FJNE:
+			value = Float32Value(inst.Args[1].(float32))
+		default:
+			value, _ = v.poolConstant(inst.Opcode, inst.Args[1].(uint32))
+		}
+		var equal bool
+		if value.Kind() == ValueInt32 {
+			equal = x.AsInt32() == value.AsInt32()
+		} else {
+			equal = x.AsFloat32() == value.AsFloat32()
+		}
+		switch inst.Opcode {
+		case IJNE, FJNE, IJNEC, FJNEC:
+			equal = !equal
+		}
+		if equal {
+			return fmt.Sprintf("x is %v: jumps to %s", x, target)
+		}
+		return fmt.Sprintf("x is %v: falls through to 0x%08x", x, inst.Next)
+	case CALL:
+		if e.Problem != "" {
+			return ""
+		}
+		callee := v.functionList[inst.Args[0].(uint32)]
+		return fmt.Sprintf("enters %s at 0x%08x with %d arguments on its stack, the stack shown is the one after it returns", displayName(callee), callee.Address, callee.ParamCount)
+	case INVOKEINTERFACE:
+		if e.Problem != "" {
+			return ""
+		}
+		receiver := frame.LocalStack[len(frame.LocalStack)-1-int(inst.Args[1].(uint32))]
+		structType, err := v.Heap.StructTypeOf(receiver.Ptr())
+		if err != nil {
+			return "fails, the receiver is not a struct: " + err.Error()
+		}
+		index, ok := v.structs[structType.Name].Methods[inst.Args[0].(string)]
+		if !ok {
+			return fmt.Sprintf("fails, %s has no method %s", structType.Name, inst.Args[0])
+		}
+		callee := v.functionList[index]
+		return fmt.Sprintf("enters %s at 0x%08x, the stack shown is the one after it returns", callee.Name, callee.Address)
+	case CALLCLOSURE:
+		if e.Problem != "" {
+			return ""
+		}
+		index, captured, _ := v.closureOf(frame.LocalStack[len(frame.LocalStack)-1])
+		callee := v.functionList[index]
+		return fmt.Sprintf("enters %s at 0x%08x with %d captured values and %d arguments on its stack, the stack shown is the one after it returns",
+			displayName(callee), callee.Address, len(captured), int(callee.ParamCount)-len(captured))
+	case RET, RETV:
+		if frame.ReturnAddress == 0xFFFFFFFF || len(v.CallStack) < 2 {
+			e.After = nil
+			return "returns from main, stopping the program"
+		}
+		caller := v.CallStack[len(v.CallStack)-2]
+		e.After = nil
+		for _, value := range caller.LocalStack {
+			e.After = append(e.After, knownSlot(value))
+		}
+		if inst.Opcode == RET && len(frame.LocalStack) > 0 {
+			e.After = append(e.After, knownSlot(frame.LocalStack[len(frame.LocalStack)-1]))
+		}
+		return fmt.Sprintf("returns to the caller at 0x%08x", frame.ReturnAddress)
+	case THROW:
+		e.After = nil
+		if len(v.handlers) == 0 {
+			return "raises the error, stopping the program"
+		}
+		return fmt.Sprintf("raises the error, continuing at the handler at 0x%08x", v.handlers[len(v.handlers)-1].address)
+	case TRY:
+		return fmt.Sprintf("installs a handler at 0x%08x", inst.Args[0])
+	case FORITER:
+		if e.Problem != "" {
+			return ""
+		}
+		if len(e.After) < len(frame.LocalStack) {
+			return fmt.Sprintf("the iteration is over: continues at 0x%08x", inst.Args[0])
+		}
+		return fmt.Sprintf("pushes the next element, falls through to 0x%08x", inst.Next)
+	case STORE:
+		return fmt.Sprintf("sets local %d", inst.Args[0])
+	}
+	return ""
+}
+
+func displayName(f FunctionSignature) string {
+	if f.Name == "" {
+		return "function"
+	}
+	return f.Name
+}
+
+// WriteTo writes the explanation as shown by the explain command of gvm
+// debug.
+func (e *Explanation) WriteTo(w io.Writer) (int64, error) {
+	var b strings.Builder
+	name := e.Info.Name
+	if e.Wide {
+		name = "WIDE " + name
+	}
+	fmt.Fprintf(&b, "%08x  %s\n", e.Address, name)
+	for i, operand := range e.Info.Operands {
+		fmt.Fprintf(&b, "  %-8s %s\n", operand.Name+":", e.Operands[i])
+	}
+	fmt.Fprintf(&b, "  %s\n", e.Info.Summary)
+	fmt.Fprintf(&b, "  Stack:   %s\n", e.Stack)
+	fmt.Fprintf(&b, "  Before:  %s\n", formatSlots(e.Before, nil))
+	if e.Problem != "" {
+		fmt.Fprintf(&b, "  Fails:   %s\n", e.Problem)
+	} else {
+		fmt.Fprintf(&b, "  After:   %s\n", formatSlots(nil, e.After))
+	}
+	if e.Effect != "" {
+		fmt.Fprintf(&b, "  Then:    %s\n", e.Effect)
+	}
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+func formatSlots(values []Value, slots []StackSlot) string {
+	var parts []string
+	for _, value := range values {
+		parts = append(parts, knownSlot(value).String())
+	}
+	for _, slot := range slots {
+		parts = append(parts, slot.String())
+	}
+	return "[" + strings.Join(parts, " ") + "]"
+}
@@ -0,0 +1,144 @@
+package vm
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	. "github.com/AndreiAlbert/gvm/common"
+)
+
+// FirstExtension to LastExtension are the opcodes reserved for extensions:
+// instructions defined outside of the core table with DefineExtension and
+// run by the handlers of Options.Extensions.
+const (
+	FirstExtension Opcode = 0xE0
+	LastExtension  Opcode = 0xFF
+)
+
+// Extension runs an instruction of the extension range. It gets the
+// operands of the instruction, decoded as in listings, and the values it
+// pops, as many as its definition lists in Pops, the deepest first. It
+// returns the values to push, as many as Pushes lists. An error stops the
+// program, unless TRY catches it.
+type Extension func(v *VM, operands []any, args []Value) ([]Value, error)
+
+var (
+	extensionsMu sync.RWMutex
+	extensions   [LastExtension - FirstExtension + 1]*OpcodeInfo
+)
+
+// isExtension reports whether op is in the extension range
+func isExtension(op Opcode) bool {
+	return op >= FirstExtension && op <= LastExtension
+}
+
+// DefineExtension adds the instruction info describes to the instruction
+// set: the assembler then accepts its mnemonic, encoding the operands in
+// the order info lists them, and listings, Explain and the other decoders
+// of the code know it. info.Opcode must be in the extension range and not
+// defined yet, and the mnemonic must not be taken. Operands are integers,
+// floats, kinds or strings; extensions don't take a WIDE prefix.
+// Definitions are process-wide and are meant to be made at init time.
+func DefineExtension(info OpcodeInfo) error {
+	if !isExtension(info.Opcode) {
+		return fmt.Errorf("opcode %#x is outside of the extension range %#x-%#x", byte(info.Opcode), byte(FirstExtension), byte(LastExtension))
+	}
+	if info.Name == "" || info.Mnemonic == "" {
+		return fmt.Errorf("extension %#x needs a name and a mnemonic", byte(info.Opcode))
+	}
+	if info.Wide {
+		return fmt.Errorf("extension %s: extensions can't be widened", info.Name)
+	}
+	for _, operand := range info.Operands {
+		switch operand.Type {
+		case OperandByte, OperandU16, OperandInt32, OperandFloat32, OperandIndex, OperandKind, OperandString:
+		default:
+			return fmt.Errorf("extension %s: operand %s of type %v is not supported", info.Name, operand.Name, operand.Type)
+		}
+	}
+	if existing, ok := LookupMnemonic(info.Mnemonic); ok {
+		return fmt.Errorf("extension %s: mnemonic %s is taken by %s", info.Name, info.Mnemonic, existing.Name)
+	}
+	extensionsMu.Lock()
+	defer extensionsMu.Unlock()
+	slot := &extensions[info.Opcode-FirstExtension]
+	if *slot != nil {
+		return fmt.Errorf("extension %s: opcode %#x is defined as %s", info.Name, byte(info.Opcode), (*slot).Name)
+	}
+	info.Mnemonic = strings.ToLower(info.Mnemonic)
+	*slot = &info
+	return nil
+}
+
+// Extensions returns the description of every extension defined, in opcode
+// order.
+func Extensions() []OpcodeInfo {
+	extensionsMu.RLock()
+	defer extensionsMu.RUnlock()
+	var defined []OpcodeInfo
+	for _, info := range extensions {
+		if info != nil {
+			defined = append(defined, *info)
+		}
+	}
+	return defined
+}
+
+// lookupExtension returns the definition of the extension op
+func lookupExtension(op Opcode) (OpcodeInfo, bool) {
+	if !isExtension(op) {
+		return OpcodeInfo{}, false
+	}
+	extensionsMu.RLock()
+	defer extensionsMu.RUnlock()
+	if info := extensions[op-FirstExtension]; info != nil {
+		return *info, true
+	}
+	return OpcodeInfo{}, false
+}
+
+// lookupExtensionMnemonic returns the definition of the extension written
+// or named name, ignoring case
+func lookupExtensionMnemonic(name string) (OpcodeInfo, bool) {
+	extensionsMu.RLock()
+	defer extensionsMu.RUnlock()
+	for _, info := range extensions {
+		if info != nil && (info.Mnemonic == strings.ToLower(name) || strings.EqualFold(info.Name, name)) {
+			return *info, true
+		}
+	}
+	return OpcodeInfo{}, false
+}
+
+// executeExtension runs the extension instruction whose opcode was just
+// read with its handler
+func (v *VM) executeExtension(op Opcode) {
+	inst, err := decodeInstruction(v.Bytecode, v.instructionStart)
+	if err != nil {
+		v.fail(err)
+	}
+	info, _ := lookupExtension(op)
+	handler, ok := v.extensions[op]
+	if !ok {
+		v.failf("no handler for extension %s", info.Name)
+	}
+	v.Ip = inst.Next
+	if stack := v.getCurrentFrame().LocalStack; len(stack) < len(info.Pops) {
+		v.failf("%s needs %d values, the stack holds %d", info.Name, len(info.Pops), len(stack))
+	}
+	args := make([]Value, len(info.Pops))
+	for i := len(args) - 1; i >= 0; i-- {
+		args[i] = v.pop()
+	}
+	results, err := handler(v, inst.Args, args)
+	if err != nil {
+		v.fail(fmt.Errorf("%s: %w", info.Name, err))
+	}
+	if len(results) != len(info.Pushes) {
+		v.failf("%s returned %d values, it pushes %d", info.Name, len(results), len(info.Pushes))
+	}
+	for _, result := range results {
+		v.push(result)
+	}
+}
@@ -0,0 +1,117 @@
+package vm
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/AndreiAlbert/gvm/bytecode"
+	. "github.com/AndreiAlbert/gvm/common"
+)
+
+// IMAXK pushes the greatest of the value it pops and its operand
+const IMAXK Opcode = 0xE0
+
+func init() {
+	err := DefineExtension(OpcodeInfo{
+		Opcode:   IMAXK,
+		Name:     "IMAXK",
+		Mnemonic: "imaxk",
+		Operands: operands(Operand{"bound", OperandInt32}),
+		Pops:     values("x"),
+		Pushes:   values("max"),
+		Summary:  "Push the greatest of x and bound.",
+	})
+	if err != nil {
+		panic(err)
+	}
+}
+
+func imaxk(v *VM, operands []any, args []Value) ([]Value, error) {
+	bound := operands[0].(int32)
+	if x := args[0].AsInt32(); x > bound {
+		return []Value{args[0]}, nil
+	}
+	return []Value{Int32Value(bound)}, nil
+}
+
+func extensionProgram(x int32) *bytecode.Program {
+	return &bytecode.Program{
+		Functions: []bytecode.Function{{Name: "main", IsMain: true, ReturnType: ValueVoid}},
+		Code: []byte{
+			byte(PUSH), byte(ValueInt32), byte(x >> 24), byte(x >> 16), byte(x >> 8), byte(x),
+			byte(IMAXK), 0, 0, 0, 5,
+			byte(HALT),
+		},
+	}
+}
+
+func TestExtensions(t *testing.T) {
+	for x, want := range map[int32]int32{2: 5, 9: 9} {
+		machine, err := NewVmFromProgram(extensionProgram(x), Options{Extensions: map[Opcode]Extension{IMAXK: imaxk}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := machine.Run(); err != nil {
+			t.Fatal(err)
+		}
+		if stack := machine.getCurrentFrame().LocalStack; len(stack) != 1 || stack[0].AsInt32() != want {
+			t.Errorf("imaxk 5 of %d left %v, expected %d", x, stack, want)
+		}
+		machine.Close()
+	}
+
+	failed := errors.New("extension failure")
+	machine, err := NewVmFromProgram(extensionProgram(1), Options{Extensions: map[Opcode]Extension{IMAXK: func(*VM, []any, []Value) ([]Value, error) {
+		return nil, failed
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer machine.Close()
+	if err := machine.Run(); !errors.Is(err, failed) {
+		t.Errorf("expected the error of the handler, got %v", err)
+	}
+
+	machine, err = NewVmFromProgram(extensionProgram(1), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer machine.Close()
+	if err := machine.Run(); err == nil || !strings.Contains(err.Error(), "no handler for extension IMAXK") {
+		t.Errorf("expected a missing handler to fail, got %v", err)
+	}
+
+	if IMAXK.String() != "IMAXK" {
+		t.Errorf("String() = %q", IMAXK.String())
+	}
+	var listing bytes.Buffer
+	if err := Disassemble(&listing, extensionProgram(1)); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(listing.String(), "IMAXK 5") {
+		t.Errorf("expected the listing to show IMAXK 5, got\n%s", listing.String())
+	}
+}
+
+func TestDefineExtension(t *testing.T) {
+	cases := []struct {
+		info OpcodeInfo
+		err  string
+	}{
+		{OpcodeInfo{Opcode: HALT, Name: "MINE", Mnemonic: "mine"}, "outside of the extension range"},
+		{OpcodeInfo{Opcode: 0xE1, Name: "MINE"}, "needs a name and a mnemonic"},
+		{OpcodeInfo{Opcode: 0xE1, Name: "MINE", Mnemonic: "push"}, "mnemonic push is taken by PUSH"},
+		{OpcodeInfo{Opcode: IMAXK, Name: "MINE", Mnemonic: "mine"}, "is defined as IMAXK"},
+		{OpcodeInfo{Opcode: 0xE1, Name: "MINE", Mnemonic: "mine", Operands: operands(Operand{"fields", OperandFields})}, "is not supported"},
+	}
+	for _, c := range cases {
+		if err := DefineExtension(c.info); err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("DefineExtension(%s %#x): expected %q, got %v", c.info.Mnemonic, byte(c.info.Opcode), c.err, err)
+		}
+	}
+	if defined := Extensions(); len(defined) != 1 || defined[0].Opcode != IMAXK {
+		t.Errorf("Extensions() = %+v", defined)
+	}
+}
@@ -0,0 +1,59 @@
+package vm
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// ProfileWeight selects the cost folded stacks are weighted by.
+type ProfileWeight int
+
+const (
+	// WeightInstructions counts executed instructions, which is exact and
+	// the same on every run.
+	WeightInstructions ProfileWeight = iota
+	// WeightTime uses nanoseconds of wall time.
+	WeightTime
+)
+
+// WriteFoldedStacks writes the profile collected with Options.Profile in
+// the folded stack format read by flamegraph.pl, inferno and speedscope:
+// one line per distinct call stack, outermost function first, followed by
+// its weight.
+func (v *VM) WriteFoldedStacks(w io.Writer, weight ProfileWeight) error {
+	if v.profile == nil {
+		return errNoProfile
+	}
+	folded := make(map[string]int64)
+	for _, sample := range v.profile.samples {
+		names := make([]string, len(sample.stack))
+		for i, addr := range sample.stack {
+			f, ok := v.profile.functionAt(addr)
+			name := f.Name
+			if !ok || name == "" {
+				name = "?"
+			}
+			// stacks are leaf first, folded lines are root first
+			names[len(names)-1-i] = name
+		}
+		key := strings.Join(names, ";")
+		if weight == WeightTime {
+			folded[key] += sample.nanos
+		} else {
+			folded[key] += sample.instructions
+		}
+	}
+	stacks := make([]string, 0, len(folded))
+	for key := range folded {
+		stacks = append(stacks, key)
+	}
+	sort.Strings(stacks)
+	for _, key := range stacks {
+		if _, err := fmt.Fprintf(w, "%s %d\n", key, folded[key]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,196 @@
+package vm
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/AndreiAlbert/gvm/bytecode"
+)
+
+// MutationKind is a way Mutate damages a container.
+type MutationKind int
+
+const (
+	// MutateOpcode replaces the opcode of an instruction with a random
+	// byte.
+	MutateOpcode MutationKind = iota
+	// MutateOperand overwrites the operand of an instruction with an
+	// extreme or random value.
+	MutateOperand
+	// MutateTruncate cuts the container short.
+	MutateTruncate
+	// MutateBits flips random bits anywhere in the container, including
+	// the header and the function and struct tables.
+	MutateBits
+
+	mutationKinds
+)
+
+func (k MutationKind) String() string {
+	switch k {
+	case MutateOpcode:
+		return "opcode"
+	case MutateOperand:
+		return "operand"
+	case MutateTruncate:
+		return "truncate"
+	case MutateBits:
+		return "bits"
+	default:
+		return fmt.Sprintf("MutationKind(%d)", int(k))
+	}
+}
+
+// extremeOperands are written over operands by MutateOperand, with random
+// bytes as the last resort
+var extremeOperands = [][]byte{
+	{0x00, 0x00, 0x00, 0x00},
+	{0xff, 0xff, 0xff, 0xff},
+	{0x7f, 0xff, 0xff, 0xff},
+	{0x80, 0x00, 0x00, 0x00},
+	{0x00, 0x00, 0x00, 0x01},
+}
+
+// Mutate returns a damaged copy of the valid container data and the kind of
+// damage done. Mutations of the code section land on instruction
+// boundaries so they hit the decoder of the VM rather than the container
+// loader alone.
+func Mutate(data []byte, rng *rand.Rand) ([]byte, MutationKind, error) {
+	program, err := bytecode.Decode(data)
+	if err != nil {
+		return nil, 0, err
+	}
+	kind := MutationKind(rng.Intn(int(mutationKinds)))
+	starts := instructionStarts(program.Code)
+	if len(starts) == 0 && (kind == MutateOpcode || kind == MutateOperand) {
+		kind = MutateBits
+	}
+	switch kind {
+	case MutateOpcode, MutateOperand:
+		code := bytes.Clone(program.Code)
+		i := rng.Intn(len(starts))
+		start := starts[i]
+		end := len(code)
+		if i+1 < len(starts) {
+			end = starts[i+1]
+		}
+		if kind == MutateOpcode || end-start < 2 {
+			kind = MutateOpcode
+			code[start] = byte(rng.Intn(256))
+		} else {
+			operand := code[start+1 : end]
+			if n := rng.Intn(len(extremeOperands) + 1); n < len(extremeOperands) {
+				copy(operand, extremeOperands[n])
+			} else {
+				rng.Read(operand)
+			}
+		}
+		program.Code = code
+		var buf bytes.Buffer
+		if err := bytecode.Encode(&buf, program); err != nil {
+			return nil, 0, err
+		}
+		return buf.Bytes(), kind, nil
+	case MutateTruncate:
+		return bytes.Clone(data[:rng.Intn(len(data))]), kind, nil
+	default:
+		mutated := bytes.Clone(data)
+		for n := 1 + rng.Intn(4); n > 0; n-- {
+			mutated[rng.Intn(len(mutated))] ^= 1 << rng.Intn(8)
+		}
+		return mutated, kind, nil
+	}
+}
+
+// instructionStarts returns the address of every instruction of code up to
+// the first one that doesn't decode
+func instructionStarts(code []byte) []int {
+	d := &disassembler{code: code}
+	var starts []int
+	for d.pos < len(code) {
+		start := d.pos
+		d.instruction()
+		if d.err != nil {
+			break
+		}
+		starts = append(starts, start)
+	}
+	return starts
+}
+
+// ProbeOutcome is how far Probe got with a container.
+type ProbeOutcome int
+
+const (
+	// ProbeRejected means the loader refused the container.
+	ProbeRejected ProbeOutcome = iota
+	// ProbeFailed means the program stopped with a runtime error.
+	ProbeFailed
+	// ProbeCompleted means the program ran to the end.
+	ProbeCompleted
+	// ProbeCrashed means a panic escaped the loader or the VM.
+	ProbeCrashed
+)
+
+func (o ProbeOutcome) String() string {
+	switch o {
+	case ProbeRejected:
+		return "rejected"
+	case ProbeFailed:
+		return "failed"
+	case ProbeCompleted:
+		return "completed"
+	case ProbeCrashed:
+		return "crashed"
+	default:
+		return fmt.Sprintf("ProbeOutcome(%d)", int(o))
+	}
+}
+
+// Limits of the programs run by Probe, which keep damaged programs from
+// looping or allocating for long
+const (
+	probeInstructions = 100_000
+	probeHeapBytes    = 1 << 20
+	probeTimeout      = 5 * time.Second
+)
+
+// Probe loads and runs an untrusted container under tight limits, with no
+// input and its output discarded. The returned error is the reason the
+// container was rejected or failed, or the panic and its stack for
+// ProbeCrashed: every outcome but ProbeCrashed is graceful.
+func Probe(data []byte) (outcome ProbeOutcome, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			outcome = ProbeCrashed
+			err = fmt.Errorf("panic: %v\n%s", r, debug.Stack())
+		}
+	}()
+	program, err := bytecode.Decode(data)
+	if err != nil {
+		return ProbeRejected, err
+	}
+	opts := Options{
+		Stdin:           strings.NewReader(""),
+		Stdout:          io.Discard,
+		MaxInstructions: probeInstructions,
+		MaxHeapBytes:    probeHeapBytes,
+	}
+	machine, err := NewVmFromProgram(program, opts)
+	if err != nil {
+		return ProbeRejected, err
+	}
+	defer machine.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), probeTimeout)
+	defer cancel()
+	if err := machine.RunContext(ctx); err != nil {
+		return ProbeFailed, err
+	}
+	return ProbeCompleted, nil
+}
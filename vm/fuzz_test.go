@@ -0,0 +1,79 @@
+package vm
+
+import (
+	"bytes"
+	"math/rand"
+	"path/filepath"
+	"testing"
+)
+
+func testContainers(t testing.TB) [][]byte {
+	paths, err := filepath.Glob("testdata/*.gvmbc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var containers [][]byte
+	for _, path := range paths {
+		containers = append(containers, mustReadTestProgram(t, path))
+	}
+	return containers
+}
+
+func TestMutatedProgramsFailGracefully(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	kinds := make(map[MutationKind]int)
+	for _, data := range testContainers(t) {
+		for i := 0; i < 100; i++ {
+			variant, kind, err := Mutate(data, rng)
+			if err != nil {
+				t.Fatal(err)
+			}
+			kinds[kind]++
+			if outcome, err := Probe(variant); outcome == ProbeCrashed {
+				t.Fatalf("%v mutation %x crashed: %v", kind, variant, err)
+			}
+		}
+	}
+	for kind := MutationKind(0); kind < mutationKinds; kind++ {
+		if kinds[kind] == 0 {
+			t.Errorf("Expected some %v mutations", kind)
+		}
+	}
+}
+
+func TestMutateKeepsTheOriginal(t *testing.T) {
+	data := mustReadTestProgram(t, "testdata/calls.gvmbc")
+	original := bytes.Clone(data)
+	rng := rand.New(rand.NewSource(2))
+	for i := 0; i < 50; i++ {
+		variant, kind, err := Mutate(data, rng)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if kind == MutateTruncate && len(variant) >= len(data) {
+			t.Errorf("Expected a truncation to shorten the container, got %d of %d bytes", len(variant), len(data))
+		}
+	}
+	if !bytes.Equal(data, original) {
+		t.Error("Expected Mutate not to modify its input")
+	}
+}
+
+// FuzzProbe asserts that no container, however damaged, crashes the loader
+// or the VM. Seed it further with gvm fuzzcorpus.
+func FuzzProbe(f *testing.F) {
+	rng := rand.New(rand.NewSource(1))
+	for _, data := range testContainers(f) {
+		f.Add(data)
+		for i := 0; i < 4; i++ {
+			if variant, _, err := Mutate(data, rng); err == nil {
+				f.Add(variant)
+			}
+		}
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		if outcome, err := Probe(data); outcome == ProbeCrashed {
+			t.Fatal(err)
+		}
+	})
+}
@@ -0,0 +1,220 @@
+package vm
+
+import (
+	"errors"
+	"time"
+
+	. "github.com/AndreiAlbert/gvm/common"
+)
+
+// DefaultGCPercent is how much, in percent, the live heap grows past what
+// the previous full collection left before the next one runs, when
+// Options.GCPercent is 0
+const DefaultGCPercent = 100
+
+// DefaultGCYoungBytes is the size of the young generation when
+// Options.GCYoungBytes is 0: the bytes allocated between two minor
+// collections
+const DefaultGCYoungBytes = 1 << 20
+
+// DefaultGCGrowth is the factor the young generation grows by when
+// Options.GCGrowth is 0
+const DefaultGCGrowth = 2
+
+// gcMinimumHeap is the live heap size below which full collections don't
+// run on their own
+const gcMinimumHeap = 4 << 20
+
+// GC_HINT modes
+const (
+	gcHintYoung = 0
+	gcHintFull  = 1
+)
+
+// ErrCollectInCallback is returned by Collect while a native is running:
+// the values it holds aren't roots the collector sees.
+var ErrCollectInCallback = errors.New("collecting the heap while a native is running")
+
+// collector decides when Options.GC collects the heap
+type collector struct {
+	// trigger is the live heap size that starts the next full collection,
+	// never below minimum. A negative percent never starts one.
+	trigger, minimum uintptr
+	percent          int
+	// young is the number of bytes allocated since the previous collection
+	// that starts a minor one, allocatedAt the total allocated then. young
+	// grows by growth after minor collections that keep most of it, and is
+	// reset to youngBytes by full collections.
+	young, youngBytes uintptr
+	growth            float64
+	allocatedAt       uint64
+	// hint is the collection GC_HINT asked for, hinted whether there is one
+	hint   int32
+	hinted bool
+	// concurrent marks the heap on a goroutine of its own for the full
+	// collections the trigger starts
+	concurrent bool
+}
+
+// newCollector returns the collector of the tuning options, see Options.GC
+func newCollector(opts Options) *collector {
+	c := &collector{trigger: gcMinimumHeap, minimum: gcMinimumHeap, percent: opts.GCPercent, youngBytes: opts.GCYoungBytes, growth: opts.GCGrowth, concurrent: opts.GCConcurrent}
+	if c.percent == 0 {
+		c.percent = DefaultGCPercent
+	}
+	if c.youngBytes == 0 {
+		c.youngBytes = DefaultGCYoungBytes
+	}
+	if c.growth == 0 {
+		c.growth = DefaultGCGrowth
+	}
+	c.growth = max(c.growth, 1)
+	c.young = c.youngBytes
+	return c
+}
+
+// gcPauses sums the time the collections stopped the program, and keeps
+// the longest
+type gcPauses struct {
+	total, longest time.Duration
+}
+
+// note records a collection that took pause
+func (p *gcPauses) note(pause time.Duration) {
+	p.total += pause
+	p.longest = max(p.longest, pause)
+}
+
+// collectIfDue collects the heap between two instructions when GC_HINT
+// asked for it, or once the live heap grew past the trigger for a full
+// collection, or the young generation filled up for a minor one. With
+// Options.GCConcurrent, the full collections of the trigger only start
+// marking there, and sweep at the first instruction boundary after the
+// marker is done. Collections wait while natives run, their Go variables
+// may hold the only pointers to blocks.
+func (v *VM) collectIfDue() {
+	if v.gc == nil || v.callbacks > 0 {
+		return
+	}
+	c := v.gc
+	var err error
+	switch {
+	case v.Heap.Marking():
+		// other collections wait for this one
+		if !v.Heap.MarkDone() {
+			return
+		}
+		start := time.Now()
+		err = v.Heap.FinishMark()
+		v.gcPauses.note(time.Since(start))
+		v.collectedFull()
+	case c.hinted && c.hint == gcHintFull:
+		err = v.Collect()
+	case c.percent >= 0 && v.Heap.Allocated() >= c.trigger:
+		if !c.concurrent {
+			err = v.Collect()
+			break
+		}
+		start := time.Now()
+		v.Heap.StartMark(v.roots())
+		v.gcPauses.note(time.Since(start))
+	case c.hinted, v.Heap.TotalAllocated()-c.allocatedAt >= uint64(c.young):
+		err = v.collectYoung()
+	default:
+		return
+	}
+	if err != nil {
+		v.fail(err)
+	}
+}
+
+// Collect frees the heap blocks the program can no longer reach and
+// compacts the heap, see heap.Heap.Collect. The roots are the values on
+// the stacks and in the locals of the call stack, those StepBack may
+// restore, the soft limit handler and the pinned blocks: hosts pin the
+// objects they keep. Options.GC runs it when the heap grows, calling it
+// is allowed with or without the option, but not from a native. A
+// concurrent mark in progress is abandoned for it.
+func (v *VM) Collect() error {
+	if v.callbacks > 0 {
+		return ErrCollectInCallback
+	}
+	start := time.Now()
+	err := v.Heap.Collect(v.roots())
+	v.gcPauses.note(time.Since(start))
+	v.collectedFull()
+	return err
+}
+
+// collectedFull sets the next full collection and resets the young
+// generation after one
+func (v *VM) collectedFull() {
+	c := v.gc
+	if c == nil {
+		return
+	}
+	c.hinted = false
+	c.allocatedAt = v.Heap.TotalAllocated()
+	c.young = c.youngBytes
+	live := v.Heap.Allocated()
+	c.trigger = max(c.minimum, live+live*uintptr(max(c.percent, 0))/100)
+}
+
+// collectYoung frees the unreachable blocks of the young generation, see
+// heap.Heap.CollectYoung, and grows the generation when most of it
+// survived: the program keeps what it allocates, collecting it sooner only
+// costs pauses.
+func (v *VM) collectYoung() error {
+	c := v.gc
+	before, promoted := v.Heap.TotalAllocated()-c.allocatedAt, v.Heap.GCStats().PromotedBytes
+	start := time.Now()
+	err := v.Heap.CollectYoung(v.roots())
+	v.gcPauses.note(time.Since(start))
+	c.hinted = false
+	c.allocatedAt = v.Heap.TotalAllocated()
+	if survived := v.Heap.GCStats().PromotedBytes - promoted; survived > before/2 {
+		c.young = uintptr(float64(c.young) * c.growth)
+	}
+	return err
+}
+
+// gcHint executes GC_HINT: mode 0 asks for a minor collection, 1 for a full
+// one, at the next instruction boundary. Without Options.GC there is no
+// collector to ask and the hint is ignored.
+func (v *VM) gcHint(mode int32) {
+	if mode != gcHintYoung && mode != gcHintFull {
+		v.failf("%v: mode must be 0 (young) or 1 (full), got %d", GC_HINT, mode)
+	}
+	if v.gc == nil {
+		return
+	}
+	if !v.gc.hinted || mode == gcHintFull {
+		v.gc.hint = mode
+	}
+	v.gc.hinted = true
+}
+
+// roots returns the values of the VM that may point to heap blocks
+func (v *VM) roots() []Value {
+	roots := []Value{v.softLimitHandler}
+	for _, frame := range v.CallStack {
+		roots = appendFrameValues(roots, frame)
+	}
+	if v.history != nil {
+		for _, entry := range v.history.entries {
+			for _, c := range entry.changes {
+				roots = append(roots, c.value)
+				roots = appendFrameValues(roots, c.dropped)
+			}
+		}
+	}
+	return roots
+}
+
+func appendFrameValues(values []Value, frame StackFrame) []Value {
+	values = append(values, frame.LocalStack...)
+	for _, value := range frame.Locals {
+		values = append(values, value)
+	}
+	return values
+}
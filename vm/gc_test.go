@@ -0,0 +1,406 @@
+package vm
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/AndreiAlbert/gvm/bytecode"
+	. "github.com/AndreiAlbert/gvm/common"
+	"github.com/AndreiAlbert/gvm/heap"
+)
+
+// TestCollectingRunsProgramsAlike runs every test program collecting the
+// heap before each instruction, with full collections, then with minor
+// ones after every allocation, then marking concurrently all along. A root
+// or a write barrier the collector misses frees a block the program still
+// uses, which changes its output or fails it.
+func TestCollectingRunsProgramsAlike(t *testing.T) {
+	paths, err := filepath.Glob("testdata/*.gvmbc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	modes := []string{"without collections", "collecting", "collecting the young", "marking concurrently"}
+	for _, path := range paths {
+		program, err := bytecode.Decode(mustReadTestProgram(t, path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var results [4]string
+		for i := range modes {
+			var stdout bytes.Buffer
+			opts := Options{Stdin: strings.NewReader("in"), Stdout: &stdout, MaxInstructions: 1 << 16, Natives: testNatives, GC: i > 0}
+			switch i {
+			case 2:
+				opts.GCYoungBytes, opts.GCGrowth, opts.GCPercent = 1, 1, -1
+			case 3:
+				opts.GCYoungBytes, opts.GCConcurrent = 1<<30, true
+			}
+			machine, err := NewVmFromProgram(program, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if i == 3 {
+				machine.gc.trigger, machine.gc.minimum = 0, 0
+			}
+			for machine.Running && err == nil {
+				if i == 1 {
+					if err := machine.Collect(); err != nil {
+						t.Fatalf("%s: %v", path, err)
+					}
+				}
+				err = machine.Step()
+			}
+			results[i] = fmt.Sprintf("%q, %v", stdout.String(), err)
+			machine.Close()
+		}
+		for i := 1; i < len(modes); i++ {
+			if results[i] != results[0] {
+				t.Errorf("%s: %s gave %s, %s %s", path, modes[i], results[i], modes[0], results[0])
+			}
+		}
+	}
+}
+
+func TestGCBoundsTheHeapOfGarbage(t *testing.T) {
+	program, err := bytecode.Decode(mustReadTestProgram(t, "testdata/gc.gvmbc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var peaks [3]uintptr
+	for i := range peaks {
+		collect := i > 0
+		var stdout bytes.Buffer
+		machine, err := NewVmFromProgram(program, Options{Stdout: &stdout, GC: collect, GCConcurrent: i == 2})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if collect {
+			machine.gc.trigger, machine.gc.minimum = 4096, 4096
+		}
+		if err := machine.Run(); err != nil {
+			t.Fatal(err)
+		}
+		if stdout.String() != "11" {
+			t.Errorf("Expected the closure, the struct it captured and the kept string to survive, got %q", stdout.String())
+		}
+		peaks[i] = machine.Heap.Peak()
+		if collect && machine.Heap.GCStats().Collections == 0 {
+			t.Error("Expected the garbage to be collected")
+		}
+		machine.Close()
+	}
+	for _, peak := range peaks[1:] {
+		if peak >= peaks[0]/2 {
+			t.Errorf("Expected collections to keep the heap below %d bytes, it reached %d", peaks[0]/2, peak)
+		}
+	}
+}
+
+func TestCollectFollowsEveryReference(t *testing.T) {
+	h := heap.NewHeap()
+	mustString := func(s string) uintptr {
+		ptr, err := h.AllocateString(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ptr
+	}
+	fromArray, fromStruct, fromClosure, fromCell := mustString("array"), mustString("struct"), mustString("closure"), mustString("cell")
+	viewed, pinned, garbage := mustString("viewed string"), mustString("pinned"), mustString("garbage")
+	left, right := mustString(strings.Repeat("l", 1024)), mustString(strings.Repeat("r", 1024))
+
+	array, _ := h.AllocateArray(ValueString, 2)
+	if err := h.SetArrayElement(array, 1, NewValue(ValueString, uint64(fromArray))); err != nil {
+		t.Fatal(err)
+	}
+	slice, _ := h.AllocateArrayView(array, 1, 1)
+	cloned, _ := h.AllocateArray(ValueInt32, 1)
+	clone, _ := h.CloneArray(cloned)
+	shape := StructType{Name: "Label", Fields: []StructField{{Name: "text", Type: ValueString}}, Size: 8}
+	label, _ := h.AllocateStruct(shape)
+	if err := h.SetStructureField(label, "text", NewValue(ValueString, uint64(fromStruct))); err != nil {
+		t.Fatal(err)
+	}
+	closure, _ := h.AllocateClosure(0, []Value{Int32Value(1), NewValue(ValueString, uint64(fromClosure))})
+	cell, _ := h.Allocate(9)
+	if err := h.StoreValue(cell, PtrValue(fromCell)); err != nil {
+		t.Fatal(err)
+	}
+	view, _ := h.AllocateStringView(viewed, 0, 6)
+	rope, err := h.Concat(left, right)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Pin(pinned); err != nil {
+		t.Fatal(err)
+	}
+
+	roots := []Value{NewValue(ValueArray, uint64(slice)), NewValue(ValueArray, uint64(clone)), PtrValue(label), PtrValue(closure), PtrValue(cell), NewValue(ValueString, uint64(view)), NewValue(ValueString, uint64(rope)), Int32Value(int32(garbage))}
+	if err := h.Collect(roots); err != nil {
+		t.Fatal(err)
+	}
+	for name, ptr := range map[string]uintptr{"array": array, "array element": fromArray, "cloned array": cloned, "struct field": fromStruct, "captured value": fromClosure, "stored pointer": fromCell, "viewed string": viewed, "pinned string": pinned, "rope left": left, "rope right": right} {
+		if _, live := h.Memory[ptr]; !live {
+			t.Errorf("Expected the %s to be kept", name)
+		}
+	}
+	if _, live := h.Memory[garbage]; live {
+		t.Error("Expected the unreachable string to be collected, an int32 root isn't a pointer")
+	}
+	if s, err := h.LoadString(view); err != nil || s != "viewed" {
+		t.Errorf("Expected the view to read %q, got %q, %v", "viewed", s, err)
+	}
+	if stats := h.GCStats(); stats.Collections != 1 || stats.Collected != 1 {
+		t.Errorf("Expected one collection freeing one block, got %+v", stats)
+	}
+}
+
+// TestCompactionReleasesSparseArenas frees most blocks of many arenas and
+// checks that the survivors move together and keep their contents.
+func TestCompactionReleasesSparseArenas(t *testing.T) {
+	arenas := heap.NewArenaAllocator(heap.GoAllocator, 4096)
+	h := heap.NewHeapWithAllocator(arenas)
+	var roots []Value
+	var kept []uintptr
+	for i := 0; i < 5000; i++ {
+		ptr, err := h.AllocateString(fmt.Sprintf("string %04d of the test", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i%10 == 0 {
+			roots = append(roots, NewValue(ValueString, uint64(ptr)))
+			kept = append(kept, ptr)
+		}
+	}
+	before := arenas.Stats()
+	if err := h.Collect(roots); err != nil {
+		t.Fatal(err)
+	}
+	after := arenas.Stats()
+	if after.Arenas > before.Arenas/4 || after.Released == 0 {
+		t.Errorf("Expected compaction to release most of the %d arenas, %d are left", before.Arenas, after.Arenas)
+	}
+	if after.Live != h.Allocated() {
+		t.Errorf("Expected the arenas to hold the %d live bytes, they hold %d", h.Allocated(), after.Live)
+	}
+	if stats := h.GCStats(); stats.Moved == 0 || stats.Collected != 4500 {
+		t.Errorf("Expected 4500 blocks collected and survivors moved, got %+v", stats)
+	}
+	for i, ptr := range kept {
+		if s, err := h.LoadString(ptr); err != nil || s != fmt.Sprintf("string %04d of the test", 10*i) {
+			t.Errorf("Expected string %d to keep its address and contents, got %q, %v", 10*i, s, err)
+		}
+	}
+	if err := h.Release(); err != nil {
+		t.Fatal(err)
+	}
+	if stats := arenas.Stats(); stats.Arenas != 0 {
+		t.Errorf("Expected Release to give back every arena, %d are left", stats.Arenas)
+	}
+}
+
+// TestCollectYoungKeepsWhatOldBlocksReference checks that a minor
+// collection frees the unreachable young blocks only, and keeps those an
+// old block references through the write barrier.
+func TestCollectYoungKeepsWhatOldBlocksReference(t *testing.T) {
+	h := heap.NewHeap()
+	array, _ := h.AllocateArray(ValueString, 1)
+	cell, _ := h.Allocate(9)
+	unreachableOld, _ := h.AllocateString("unreachable old")
+	if err := h.Collect([]Value{NewValue(ValueArray, uint64(array)), PtrValue(cell), NewValue(ValueString, uint64(unreachableOld))}); err != nil {
+		t.Fatal(err)
+	}
+	young, _ := h.AllocateString("young")
+	stored, _ := h.AllocateString("stored")
+	garbage, _ := h.AllocateString("garbage")
+	if err := h.SetArrayElement(array, 0, NewValue(ValueString, uint64(young))); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.StoreValue(cell, PtrValue(stored)); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.CollectYoung(nil); err != nil {
+		t.Fatal(err)
+	}
+	for name, ptr := range map[string]uintptr{"old array": array, "old string": unreachableOld, "young string the array holds": young, "young string the cell holds": stored} {
+		if _, live := h.Memory[ptr]; !live {
+			t.Errorf("Expected the %s to be kept", name)
+		}
+	}
+	if _, live := h.Memory[garbage]; live {
+		t.Error("Expected the unreachable young string to be collected")
+	}
+	if stats := h.GCStats(); stats.MinorCollections != 1 || stats.Collected != 1 {
+		t.Errorf("Expected one minor collection freeing one block, got %+v", stats)
+	}
+
+	// the string was promoted, only a full collection frees old blocks
+	if err := h.Collect([]Value{NewValue(ValueArray, uint64(array))}); err != nil {
+		t.Fatal(err)
+	}
+	if _, live := h.Memory[unreachableOld]; live {
+		t.Error("Expected a full collection to free the unreachable old string")
+	}
+	if s, err := h.LoadString(young); err != nil || s != "young" {
+		t.Errorf("Expected the promoted string to survive, got %q, %v", s, err)
+	}
+}
+
+func TestGCTuning(t *testing.T) {
+	program, err := bytecode.Decode(mustReadTestProgram(t, "testdata/gc.gvmbc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stdout bytes.Buffer
+	machine, err := NewVmFromProgram(program, Options{Stdout: &stdout, GC: true, GCYoungBytes: 4096, GCPercent: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer machine.Close()
+	if err := machine.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if stdout.String() != "11" {
+		t.Errorf("Expected the closure, the struct it captured and the kept string to survive, got %q", stdout.String())
+	}
+	usage := machine.Usage()
+	if usage.GCMinorCollections == 0 || usage.GCCollections != 0 {
+		t.Errorf("Expected minor collections only, none full, got %+v", usage)
+	}
+	if usage.GCPauseTotal <= 0 || usage.GCPauseMax > usage.GCPauseTotal {
+		t.Errorf("Expected the pauses to be measured, got %v total, %v max", usage.GCPauseTotal, usage.GCPauseMax)
+	}
+	var report bytes.Buffer
+	if err := usage.WriteReport(&report); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"gc collections", "0 full, ", "gc pauses"} {
+		if !strings.Contains(report.String(), want) {
+			t.Errorf("Expected %q in the report:\n%s", want, report.String())
+		}
+	}
+}
+
+func TestGCHint(t *testing.T) {
+	program, err := bytecode.Decode(mustReadTestProgram(t, "testdata/gc.gvmbc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		gc          bool
+		mode        int32
+		full, minor uint64
+	}{
+		{true, 0, 0, 1},
+		{true, 1, 1, 0},
+		{false, 1, 0, 0},
+	} {
+		machine, err := NewVmFromProgram(program, Options{GC: tc.gc})
+		if err != nil {
+			t.Fatal(err)
+		}
+		machine.push(Int32Value(tc.mode))
+		machine.executeSystemCall(GC_HINT)
+		machine.collectIfDue()
+		if stats := machine.Heap.GCStats(); stats.Collections != tc.full || stats.MinorCollections != tc.minor {
+			t.Errorf("Expected GC_HINT %d with GC %v to run %d full and %d minor collections, got %+v", tc.mode, tc.gc, tc.full, tc.minor, stats)
+		}
+		machine.Close()
+	}
+	machine, err := NewVmFromProgram(program, Options{GC: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer machine.Close()
+	machine.push(Int32Value(2))
+	if err := catchRuntimeError(func() { machine.executeSystemCall(GC_HINT) }); err == nil {
+		t.Error("Expected an unknown GC_HINT mode to fail")
+	}
+}
+
+// TestConcurrentMarkKeepsWhatTheProgramMoves moves references around while
+// the marker runs: out of a block it may not have scanned yet into blocks
+// allocated since, which it never scans, then frees the block they came
+// from. The write barrier must find them all the same.
+func TestConcurrentMarkKeepsWhatTheProgramMoves(t *testing.T) {
+	for round := 0; round < 20; round++ {
+		h := heap.NewHeap()
+		// enough blocks for the marker to still be running while the program
+		// moves the references
+		filler, _ := h.AllocateArray(ValueString, 2000)
+		for i := int32(0); i < 2000; i++ {
+			s, _ := h.AllocateString("filler")
+			h.SetArrayElement(filler, i, NewValue(ValueString, uint64(s)))
+		}
+		holder, _ := h.AllocateArray(ValueString, 2)
+		overwritten, _ := h.AllocateString("overwritten")
+		freedWith, _ := h.AllocateString("freed with its holder")
+		h.SetArrayElement(holder, 0, NewValue(ValueString, uint64(overwritten)))
+		h.SetArrayElement(holder, 1, NewValue(ValueString, uint64(freedWith)))
+		cell, _ := h.Allocate(9)
+		h.StoreValue(cell, PtrValue(holder))
+		garbage, _ := h.AllocateString("garbage")
+
+		h.StartMark([]Value{PtrValue(cell), NewValue(ValueArray, uint64(filler))})
+		moved, _ := h.AllocateArray(ValueString, 2)
+		replacement, _ := h.AllocateString("replacement")
+		if err := h.SetArrayElement(moved, 0, NewValue(ValueString, uint64(overwritten))); err != nil {
+			t.Fatal(err)
+		}
+		if err := h.SetArrayElement(holder, 0, NewValue(ValueString, uint64(replacement))); err != nil {
+			t.Fatal(err)
+		}
+		if err := h.SetArrayElement(moved, 1, NewValue(ValueString, uint64(freedWith))); err != nil {
+			t.Fatal(err)
+		}
+		if err := h.StoreValue(cell, PtrValue(moved)); err != nil {
+			t.Fatal(err)
+		}
+		if err := h.Free(holder); err != nil {
+			t.Fatal(err)
+		}
+		if err := h.FinishMark(); err != nil {
+			t.Fatal(err)
+		}
+
+		for name, ptr := range map[string]uintptr{"overwritten string": overwritten, "string of the freed array": freedWith, "replacement": replacement, "array allocated while marking": moved} {
+			if _, live := h.Memory[ptr]; !live {
+				t.Fatalf("Expected the %s to be kept", name)
+			}
+		}
+		if _, live := h.Memory[garbage]; live {
+			t.Fatal("Expected the unreachable string to be collected")
+		}
+		if h.Marking() {
+			t.Fatal("Expected the mark to be over")
+		}
+		h.Release()
+	}
+}
+
+func TestConcurrentGCPausesAtInstructionBoundaries(t *testing.T) {
+	program, err := bytecode.Decode(mustReadTestProgram(t, "testdata/gc.gvmbc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stdout bytes.Buffer
+	machine, err := NewVmFromProgram(program, Options{Stdout: &stdout, GC: true, GCConcurrent: true, GCYoungBytes: 1 << 30})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer machine.Close()
+	machine.gc.trigger, machine.gc.minimum = 4096, 4096
+	if err := machine.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if stdout.String() != "11" {
+		t.Errorf("Expected the closure, the struct it captured and the kept string to survive, got %q", stdout.String())
+	}
+	if usage := machine.Usage(); usage.GCCollections == 0 || usage.GCMinorCollections != 0 {
+		t.Errorf("Expected full collections only, got %+v", usage)
+	}
+	// a collection that never finished is abandoned by Close
+}
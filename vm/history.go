@@ -0,0 +1,177 @@
+package vm
+
+import (
+	"errors"
+
+	. "github.com/AndreiAlbert/gvm/common"
+)
+
+// ErrNoHistory is returned by StepBack when no executed instruction is
+// left to undo.
+var ErrNoHistory = errors.New("no more history to step back through")
+
+// changeKind is a kind of change an instruction makes to the VM state
+type changeKind byte
+
+const (
+	changePush changeKind = iota
+	changePop
+	changeLocal
+	changeAddFrame
+	changeDropFrame
+	changeAddHandler
+	changeDropHandler
+)
+
+// change is one change to the VM state, with what it takes to undo it
+type change struct {
+	kind changeKind
+	// frame is the index of the frame of a push, pop or local change
+	frame int
+	// value is the popped value or the previous value of a local
+	value    Value
+	local    uint32
+	hadLocal bool
+	// dropped is a frame removed from the call stack
+	dropped StackFrame
+	// handler is a handler removed from the handler stack
+	handler handler
+}
+
+// historyEntry is the state an instruction started from and the changes it
+// made, in order
+type historyEntry struct {
+	ip, instructionStart uint
+	instructions         uint64
+	running, wide        bool
+	changes              []change
+}
+
+// history is a ring buffer of the last instructions executed, so the VM
+// can step back through them. The changes are recorded as deltas: values
+// pushed and popped, locals set, frames and handlers added and removed.
+// Heap contents and I/O are not recorded.
+type history struct {
+	entries []historyEntry
+	// next is the slot the next instruction is recorded in, count the
+	// number of entries that can be undone
+	next, count int
+	current     *historyEntry
+}
+
+func newHistory(size int) *history {
+	return &history{entries: make([]historyEntry, size)}
+}
+
+// begin starts the entry of an instruction, replacing the oldest one when
+// the buffer is full
+func (h *history) begin(v *VM) {
+	entry := &h.entries[h.next]
+	*entry = historyEntry{
+		ip:               v.Ip,
+		instructionStart: v.instructionStart,
+		instructions:     v.instructions,
+		running:          v.Running,
+		wide:             v.wide,
+		changes:          entry.changes[:0],
+	}
+	h.current = entry
+	h.next = (h.next + 1) % len(h.entries)
+	if h.count < len(h.entries) {
+		h.count++
+	}
+}
+
+// record adds a change to the entry of the instruction executing
+func (v *VM) record(c change) {
+	if v.history != nil && v.history.current != nil {
+		v.history.current.changes = append(v.history.current.changes, c)
+	}
+}
+
+// History returns the number of executed instructions StepBack can undo.
+func (v *VM) History() int {
+	if v.history == nil {
+		return 0
+	}
+	return v.history.count
+}
+
+// StepBack undoes the last executed instruction, restoring the operand
+// stacks, locals, call stack, handlers and Ip from before it, and a program
+// stopped by it runs again. The heap isn't rewound: objects keep their
+// latest contents. Options.History sets how many instructions can be
+// undone.
+func (v *VM) StepBack() error {
+	h := v.history
+	if h == nil || h.count == 0 {
+		return ErrNoHistory
+	}
+	h.next = (h.next - 1 + len(h.entries)) % len(h.entries)
+	h.count--
+	entry := &h.entries[h.next]
+	h.current = nil
+	for i := len(entry.changes) - 1; i >= 0; i-- {
+		c := entry.changes[i]
+		switch c.kind {
+		case changePush:
+			frame := &v.CallStack[c.frame]
+			frame.LocalStack = frame.LocalStack[:len(frame.LocalStack)-1]
+		case changePop:
+			frame := &v.CallStack[c.frame]
+			frame.LocalStack = append(frame.LocalStack, c.value)
+		case changeLocal:
+			if c.hadLocal {
+				v.CallStack[c.frame].Locals[c.local] = c.value
+			} else {
+				delete(v.CallStack[c.frame].Locals, c.local)
+			}
+		case changeAddFrame:
+			v.CallStack = v.CallStack[:len(v.CallStack)-1]
+		case changeDropFrame:
+			v.CallStack = append(v.CallStack, c.dropped)
+		case changeAddHandler:
+			v.handlers = v.handlers[:len(v.handlers)-1]
+		case changeDropHandler:
+			v.handlers = append(v.handlers, c.handler)
+		}
+	}
+	entry.changes = entry.changes[:0]
+	v.Ip = entry.ip
+	v.instructionStart = entry.instructionStart
+	v.instructions = entry.instructions
+	v.Running = entry.running
+	v.wide = entry.wide
+	return nil
+}
+
+// pushFrame adds a frame to the call stack
+func (v *VM) pushFrame(frame StackFrame) {
+	v.CallStack = append(v.CallStack, frame)
+	v.record(change{kind: changeAddFrame})
+	v.notePeakDepth()
+}
+
+// popFrame removes the frame on top of the call stack
+func (v *VM) popFrame() {
+	v.record(change{kind: changeDropFrame, dropped: v.CallStack[len(v.CallStack)-1]})
+	v.CallStack = v.CallStack[:len(v.CallStack)-1]
+}
+
+// setLocal sets the local at index of the current frame
+func (v *VM) setLocal(index uint32, value Value) {
+	frame := v.getCurrentFrame()
+	old, had := frame.Locals[index]
+	v.record(change{kind: changeLocal, frame: len(v.CallStack) - 1, local: index, value: old, hadLocal: had})
+	frame.Locals[index] = value
+}
+
+func (v *VM) pushHandler(h handler) {
+	v.handlers = append(v.handlers, h)
+	v.record(change{kind: changeAddHandler})
+}
+
+func (v *VM) popHandler() {
+	v.record(change{kind: changeDropHandler, handler: v.handlers[len(v.handlers)-1]})
+	v.handlers = v.handlers[:len(v.handlers)-1]
+}
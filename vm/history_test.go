@@ -0,0 +1,101 @@
+package vm
+
+import (
+	"errors"
+	"io"
+	"maps"
+	"reflect"
+	"testing"
+
+	"github.com/AndreiAlbert/gvm/bytecode"
+	. "github.com/AndreiAlbert/gvm/common"
+)
+
+// vmState is a copy of the state StepBack restores
+type vmState struct {
+	Ip           uint
+	Running      bool
+	Instructions uint64
+	Frames       []StackFrame
+	Handlers     []handler
+}
+
+func snapshot(v *VM) vmState {
+	// empty and nil slices are the same state
+	state := vmState{Ip: v.Ip, Running: v.Running, Instructions: v.instructions, Handlers: append([]handler(nil), v.handlers...)}
+	for _, frame := range v.CallStack {
+		frame.LocalStack = append([]Value(nil), frame.LocalStack...)
+		frame.Locals = maps.Clone(frame.Locals)
+		state.Frames = append(state.Frames, frame)
+	}
+	return state
+}
+
+func TestStepBackRestoresEveryState(t *testing.T) {
+	for _, name := range []string{"testdata/calls.gvmbc", "testdata/catch.gvmbc"} {
+		t.Run(name, func(t *testing.T) {
+			program, err := bytecode.Open(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer program.Close()
+			machine, err := NewVmFromProgram(program, Options{Stdout: io.Discard, History: 1000})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer machine.Close()
+			var states []vmState
+			for machine.Running {
+				states = append(states, snapshot(machine))
+				machine.Step()
+			}
+			final := snapshot(machine)
+			if machine.History() != len(states) {
+				t.Fatalf("Expected %d instructions of history, got %d", len(states), machine.History())
+			}
+			for i := len(states) - 1; i >= 0; i-- {
+				if err := machine.StepBack(); err != nil {
+					t.Fatal(err)
+				}
+				if got := snapshot(machine); !reflect.DeepEqual(got, states[i]) {
+					t.Fatalf("Stepping back to instruction %d: expected\n%+v\ngot\n%+v", i, states[i], got)
+				}
+			}
+			if err := machine.StepBack(); !errors.Is(err, ErrNoHistory) {
+				t.Errorf("Expected ErrNoHistory at the start, got %v", err)
+			}
+			// running again from the start ends the same way
+			for machine.Running {
+				machine.Step()
+			}
+			if got := snapshot(machine); !reflect.DeepEqual(got.Frames, final.Frames) || got.Ip != final.Ip {
+				t.Errorf("Expected the replay to end as the run did")
+			}
+		})
+	}
+}
+
+func TestHistoryKeepsTheLastInstructions(t *testing.T) {
+	code := join(pushInt(1), pushInt(2), pushInt(3), pushInt(4), []byte{byte(HALT)})
+	program := &bytecode.Program{
+		Functions: []bytecode.Function{{Name: "main", IsMain: true, ReturnType: ValueVoid}},
+		Code:      code,
+	}
+	machine, err := NewVmFromProgram(program, Options{History: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer machine.Close()
+	for i := 0; i < 4; i++ {
+		machine.Step()
+	}
+	if machine.StepBack() != nil || machine.StepBack() != nil {
+		t.Fatal("Expected two instructions to step back over")
+	}
+	if err := machine.StepBack(); !errors.Is(err, ErrNoHistory) {
+		t.Fatalf("Expected the history to hold two instructions, got %v", err)
+	}
+	if machine.Ip != 12 || len(machine.getCurrentFrame().LocalStack) != 2 {
+		t.Errorf("Expected to be back at the third push, at %d with %v", machine.Ip, machine.getCurrentFrame().LocalStack)
+	}
+}
@@ -0,0 +1,53 @@
+package vm
+
+import (
+	"fmt"
+	"strings"
+
+	. "github.com/AndreiAlbert/gvm/common"
+	"github.com/AndreiAlbert/gvm/heap"
+)
+
+// bindMethods records the methods of the structs: the function Type.method
+// is the method named method of the struct Type. Methods maps the method
+// names to the index of the function in FunctionList, which hot reloading
+// keeps.
+func (v *VM) bindMethods() {
+	for i, f := range v.functionList {
+		typeName, method, ok := strings.Cut(f.Name, ".")
+		structType, known := v.structs[typeName]
+		if !ok || !known || method == "" {
+			continue
+		}
+		structType.Methods[method] = uint(i)
+	}
+}
+
+// resolveMethod returns the index of the function implementing method for
+// the receiver below the argCount arguments on top of the stack. The method
+// must take the receiver and argCount arguments and return returnType, a
+// receiver without it is a catchable type mismatch.
+func (v *VM) resolveMethod(method string, argCount int, returnType ValueKind) int {
+	stack := v.getCurrentFrame().LocalStack
+	if len(stack) <= argCount {
+		v.failf("INVOKEINTERFACE needs a receiver and %d arguments, the stack holds %d values", argCount, len(stack))
+	}
+	receiver := stack[len(stack)-1-argCount]
+	if receiver.Kind() != ValuePtr {
+		v.fail(fmt.Errorf("%w: calling method %s on %v", heap.ErrTypeMismatch, method, receiver.Kind()))
+	}
+	structType, err := v.Heap.StructTypeOf(receiver.Ptr())
+	if err != nil {
+		v.fail(fmt.Errorf("calling method %s: %w", method, err))
+	}
+	index, ok := v.structs[structType.Name].Methods[method]
+	if !ok {
+		v.fail(fmt.Errorf("%w: %s has no method %s", heap.ErrTypeMismatch, structType.Name, method))
+	}
+	f := v.functionList[index]
+	if int(f.ParamCount) != argCount+1 || f.ReturnType != returnType {
+		v.fail(fmt.Errorf("%w: %s takes %d arguments and returns %v, called with %d returning %v",
+			heap.ErrTypeMismatch, f.Name, f.ParamCount-1, f.ReturnType, argCount, returnType))
+	}
+	return int(index)
+}
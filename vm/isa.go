@@ -0,0 +1,274 @@
+package vm
+
+import "strings"
+
+// OperandType is the encoding of an instruction operand.
+type OperandType int
+
+const (
+	// OperandByte is one byte.
+	OperandByte OperandType = iota
+	// OperandU16 is a big-endian uint16.
+	OperandU16
+	// OperandInt32 is a big-endian int32.
+	OperandInt32
+	// OperandFloat32 is a big-endian IEEE 754 float32.
+	OperandFloat32
+	// OperandIndex is a big-endian uint16, or uint32 after a WIDE prefix.
+	OperandIndex
+	// OperandKind is a ValueKind byte.
+	OperandKind
+	// OperandValue is a ValueKind byte, then 4 bytes for int32 and float32
+	// or 1 byte for byte.
+	OperandValue
+	// OperandString is a NUL-terminated string.
+	OperandString
+	// OperandBytes is a uint16 length followed by as many bytes.
+	OperandBytes
+	// OperandFields is a field count byte followed by the fields, each a
+	// NUL-terminated name and a ValueKind byte, arrays followed by the
+	// element kind.
+	OperandFields
+	// OperandTypeRef is a ValueKind byte, a struct followed by the
+	// NUL-terminated struct name and an array by its element kind.
+	OperandTypeRef
+)
+
+// Size returns the number of bytes of the operand, 0 if it varies.
+func (t OperandType) Size(wide bool) int {
+	switch t {
+	case OperandByte, OperandKind:
+		return 1
+	case OperandU16:
+		return 2
+	case OperandInt32, OperandFloat32:
+		return 4
+	case OperandIndex:
+		if wide {
+			return 4
+		}
+		return 2
+	default:
+		return 0
+	}
+}
+
+func (t OperandType) String() string {
+	switch t {
+	case OperandByte:
+		return "u8"
+	case OperandU16:
+		return "u16"
+	case OperandInt32:
+		return "i32"
+	case OperandFloat32:
+		return "f32"
+	case OperandIndex:
+		return "u16|u32"
+	case OperandKind:
+		return "kind"
+	case OperandValue:
+		return "kind+value"
+	case OperandString:
+		return "cstring"
+	case OperandBytes:
+		return "u16+bytes"
+	case OperandFields:
+		return "fields"
+	case OperandTypeRef:
+		return "kind+type"
+	default:
+		return "unknown"
+	}
+}
+
+// Operand is an operand of an instruction as encoded after the opcode.
+type Operand struct {
+	Name string
+	Type OperandType
+}
+
+// OpcodeInfo documents an instruction. The table of them is the reference
+// for opcode names, WIDE support and the generated specification.
+type OpcodeInfo struct {
+	Opcode Opcode
+	Name   string
+	// Mnemonic is the assembler instruction, empty for opcodes the
+	// assembler emits on its own such as function headers.
+	Mnemonic string
+	Operands []Operand
+	// Wide reports whether the index operand can be widened by WIDE.
+	Wide bool
+	// Pops and Pushes are the stack effect, each listed from the bottom of
+	// the stack to the top.
+	Pops    []string
+	Pushes  []string
+	Summary string
+	// Deprecated, when set, says what to use instead of the instruction.
+	// gvm check flags its uses.
+	Deprecated string
+}
+
+// Operands shared by several instructions
+var (
+	indexOperand    = Operand{"index", OperandIndex}
+	addressOperand  = Operand{"address", OperandIndex}
+	constantOperand = Operand{"constant", OperandByte}
+)
+
+func operands(ops ...Operand) []Operand { return ops }
+
+func values(names ...string) []string { return names }
+
+// opcodeTable is indexed by opcode.
+var opcodeTable = [...]OpcodeInfo{
+	HALT: {Name: "HALT", Mnemonic: "halt", Summary: "Stop the program."},
+	PUSH: {Name: "PUSH", Mnemonic: "push", Operands: operands(Operand{"value", OperandValue}), Pushes: values("value"),
+		Summary: "Push a literal: `push int32 5`, `push float32 1.5` or `push byte 65`."},
+	POP:  {Name: "POP", Mnemonic: "pop", Pops: values("value"), Summary: "Discard the top of the stack."},
+	IADD: {Name: "IADD", Mnemonic: "iadd", Pops: values("a", "b"), Pushes: values("a+b"), Summary: "Add two int32s, wrapping around on overflow."},
+	ISUB: {Name: "ISUB", Mnemonic: "isub", Pops: values("a", "b"), Pushes: values("a-b"), Summary: "Subtract two int32s, wrapping around on overflow."},
+	IMUL: {Name: "IMUL", Mnemonic: "imul", Pops: values("a", "b"), Pushes: values("a*b"), Summary: "Multiply two int32s, wrapping around on overflow."},
+	IDIV: {Name: "IDIV", Mnemonic: "idiv", Pops: values("a", "b"), Pushes: values("a/b"),
+		Summary: "Divide two int32s, truncating towards zero. MinInt32/-1 wraps around to MinInt32. Dividing by zero raises an error that TRY can catch."},
+	FADD: {Name: "FADD", Mnemonic: "fadd", Pops: values("a", "b"), Pushes: values("a+b"), Summary: "Add two float32s."},
+	FSUB: {Name: "FSUB", Mnemonic: "fsub", Pops: values("a", "b"), Pushes: values("a-b"), Summary: "Subtract two float32s."},
+	FMUL: {Name: "FMUL", Mnemonic: "fmul", Pops: values("a", "b"), Pushes: values("a*b"), Summary: "Multiply two float32s."},
+	FDIV: {Name: "FDIV", Mnemonic: "fdiv", Pops: values("a", "b"), Pushes: values("a/b"),
+		Summary: "Divide two float32s. Dividing by zero gives ±Inf or NaN, or raises an error under Options.TrapFloatDivision."},
+	JMP: {Name: "JMP", Mnemonic: "jmp", Operands: operands(addressOperand), Wide: true, Summary: "Continue at address."},
+	IJNE: {Name: "IJNE", Mnemonic: "ijne", Operands: operands(addressOperand, Operand{"value", OperandInt32}), Wide: true, Pops: values("x"),
+		Summary: "Continue at address if the int32 x differs from value."},
+	IJE: {Name: "IJE", Mnemonic: "ije", Operands: operands(addressOperand, Operand{"value", OperandInt32}), Wide: true, Pops: values("x"),
+		Summary: "Continue at address if the int32 x equals value."},
+	FJNE: {Name: "FJNE", Mnemonic: "fjne", Operands: operands(addressOperand, Operand{"value", OperandFloat32}), Wide: true, Pops: values("x"),
+		Summary: "Continue at address if the float32 x differs from value."},
+	FJE: {Name: "FJE", Mnemonic: "fje", Operands: operands(addressOperand, Operand{"value", OperandFloat32}), Wide: true, Pops: values("x"),
+		Summary: "Continue at address if the float32 x equals value."},
+	EQ:    {Name: "EQ", Mnemonic: "eq", Pops: values("a", "b"), Pushes: values("a==b"), Summary: "Push 1 if a equals b, 0 otherwise."},
+	NE:    {Name: "NE", Mnemonic: "ne", Pops: values("a", "b"), Pushes: values("a!=b"), Summary: "Push 1 if a differs from b, 0 otherwise."},
+	LT:    {Name: "LT", Mnemonic: "lt", Pops: values("a", "b"), Pushes: values("a<b"), Summary: "Push 1 if a is less than b, 0 otherwise."},
+	GT:    {Name: "GT", Mnemonic: "gt", Pops: values("a", "b"), Pushes: values("a>b"), Summary: "Push 1 if a is greater than b, 0 otherwise."},
+	GE:    {Name: "GE", Mnemonic: "ge", Pops: values("a", "b"), Pushes: values("a>=b"), Summary: "Push 1 if a is greater than or equal to b, 0 otherwise."},
+	LE:    {Name: "LE", Mnemonic: "le", Pops: values("a", "b"), Pushes: values("a<=b"), Summary: "Push 1 if a is less than or equal to b, 0 otherwise."},
+	LOAD:  {Name: "LOAD", Mnemonic: "load", Operands: operands(indexOperand), Wide: true, Pushes: values("value"), Summary: "Push the local at index."},
+	STORE: {Name: "STORE", Mnemonic: "store", Operands: operands(indexOperand), Wide: true, Pops: values("value"), Summary: "Pop the top of the stack into the local at index."},
+	CALL: {Name: "CALL", Mnemonic: "call", Operands: operands(Operand{"function", OperandIndex}), Wide: true, Pops: values("args..."), Pushes: values("result"),
+		Summary: "Call the function at index in the function table. Its arguments become the callee's stack, a non-void callee pushes its result on return."},
+	RET: {Name: "RET", Mnemonic: "ret", Pops: values("value"),
+		Summary: "Return the top of the stack to the caller, checking it against the return type. Returning from main stops the program."},
+	RETV:   {Name: "RETV", Mnemonic: "retv", Summary: "Return from a void function."},
+	ALLOC:  {Name: "ALLOC", Mnemonic: "alloc", Pops: values("size"), Pushes: values("ptr"), Summary: "Allocate a heap block of size bytes."},
+	FREE:   {Name: "FREE", Mnemonic: "free", Pops: values("ptr"), Summary: "Free the heap block, string, array or struct at ptr."},
+	LOADH:  {Name: "LOADH", Mnemonic: "loadh", Pops: values("ptr"), Pushes: values("value"), Summary: "Load the value stored in the heap block at ptr."},
+	STOREH: {Name: "STOREH", Mnemonic: "storeh", Pops: values("ptr", "value"), Summary: "Store an int32, float32 or pointer into the heap block at ptr."},
+	DUP:    {Name: "DUP", Mnemonic: "dup", Pops: values("value"), Pushes: values("value", "value"), Summary: "Duplicate the top of the stack."},
+	STRALLOC: {Name: "STRALLOC", Mnemonic: "stralloc", Operands: operands(Operand{"text", OperandBytes}), Pushes: values("string"),
+		Summary: "Allocate a string holding text."},
+	SYSCALL: {Name: "SYSCALL", Mnemonic: "syscall", Operands: operands(Operand{"number", OperandU16}), Pops: values("args..."), Pushes: values("results..."),
+		Summary: "Run a system call, see the System Calls section."},
+	NEWARR: {Name: "NEWARR", Mnemonic: "newarr", Operands: operands(Operand{"element", OperandKind}), Pops: values("length"), Pushes: values("array"),
+		Summary: "Allocate a zeroed array of length elements."},
+	LDELEM: {Name: "LDELEM", Mnemonic: "ldelem", Pops: values("array", "index"), Pushes: values("value"), Summary: "Load the array element at index. Out of bounds it fails, unless the VM is set to clamp the index or read a zero value."},
+	STELEM: {Name: "STELEM", Mnemonic: "stelem", Pops: values("array", "index", "value"), Summary: "Store value as the array element at index."},
+	FUNC: {Name: "FUNC", Operands: operands(Operand{"kind", OperandByte}, Operand{"params", OperandU16}, Operand{"returns", OperandKind}),
+		Summary: "Function header emitted for a func declaration, skipped when executed. kind is FUNC_NORMAL or FUNC_MAIN, a struct return kind is followed by the struct name."},
+	FUNC_NORMAL: {Name: "FUNC_NORMAL", Summary: "Marks a FUNC header of an ordinary function."},
+	FUNC_MAIN:   {Name: "FUNC_MAIN", Summary: "Marks the FUNC header of main."},
+	DEFSTRUCT: {Name: "DEFSTRUCT", Operands: operands(Operand{"name", OperandString}, Operand{"fields", OperandFields}),
+		Summary: "Struct definition of raw bytecode streams. Containers carry them in their struct section instead."},
+	NEWSTRUCT: {Name: "NEWSTRUCT", Mnemonic: "newstruct", Operands: operands(Operand{"type", OperandString}), Pushes: values("struct"),
+		Summary: "Allocate a zeroed struct of the named type."},
+	FLDGET_NAME: {Name: "FLDGET_NAME", Operands: operands(Operand{"field", OperandString}), Pops: values("struct"), Pushes: values("value"),
+		Summary: "Legacy FLDGET with the field name inline."},
+	STFIELD_NAME: {Name: "STFIELD_NAME", Operands: operands(Operand{"field", OperandString}), Pops: values("struct", "value"),
+		Summary: "Legacy STFIELD with the field name inline."},
+	FLDGET: {Name: "FLDGET", Mnemonic: "fldget", Operands: operands(Operand{"field", OperandU16}), Pops: values("struct"), Pushes: values("value"),
+		Summary: "Load a struct field, by its program-wide field id."},
+	STFIELD: {Name: "STFIELD", Mnemonic: "stfield", Operands: operands(Operand{"field", OperandU16}), Pops: values("struct", "value"),
+		Summary: "Store value into a struct field, by its program-wide field id."},
+	WIDE: {Name: "WIDE", Operands: operands(Operand{"opcode", OperandByte}),
+		Summary: "Prefix making the index or address operand of the next instruction 4 bytes. The assembler adds it where needed."},
+	THROW: {Name: "THROW", Mnemonic: "throw", Pops: values("error"),
+		Summary: "Raise the Error value, unwinding to the innermost handler or stopping the program."},
+	TRY: {Name: "TRY", Mnemonic: "try", Operands: operands(addressOperand), Wide: true,
+		Summary: "Install a handler at address for errors raised until the matching ENDTRY. The handler starts with the Error on the stack."},
+	ENDTRY: {Name: "ENDTRY", Mnemonic: "endtry", Summary: "Remove the innermost handler, which must belong to the current function."},
+	CHECKCAST: {Name: "CHECKCAST", Mnemonic: "checkcast", Operands: operands(Operand{"type", OperandTypeRef}), Pops: values("ptr"), Pushes: values("ptr"),
+		Summary: "Check that ptr refers to a struct of the named type, an array of the element kind or a string: `checkcast Point`, `checkcast int32[]`. Anything else is a catchable type mismatch."},
+	INSTANCEOF: {Name: "INSTANCEOF", Mnemonic: "instanceof", Operands: operands(Operand{"type", OperandTypeRef}), Pops: values("ptr"), Pushes: values("is"),
+		Summary: "Push 1 if ptr refers to an object of the type, as CHECKCAST checks, 0 otherwise."},
+	INVOKEINTERFACE: {Name: "INVOKEINTERFACE", Mnemonic: "invokeinterface",
+		Operands: operands(Operand{"method", OperandString}, Operand{"args", OperandByte}, Operand{"returns", OperandKind}),
+		Pops:     values("receiver", "args..."), Pushes: values("result"),
+		Summary: "Call the method of the receiver's struct type: `invokeinterface Shape.area` runs Square.area for a Square. The method gets the receiver and the arguments on its stack, a receiver without a matching method is a catchable type mismatch."},
+	MAKECLOSURE: {Name: "MAKECLOSURE", Mnemonic: "makeclosure",
+		Operands: operands(Operand{"function", OperandIndex}, Operand{"captures", OperandByte}), Wide: true,
+		Pops: values("captured..."), Pushes: values("closure"),
+		Summary: "Allocate a closure of the function at index whose environment holds the captures values on top of the stack. They are copied: capture a struct or an array to share state between calls."},
+	CALLCLOSURE: {Name: "CALLCLOSURE", Mnemonic: "callclosure", Pops: values("args...", "closure"), Pushes: values("result"),
+		Summary: "Call the closure's function with its captured values followed by the arguments on its stack. The function's parameters are the captured values and then the arguments, a value that isn't a closure is a catchable type mismatch."},
+	FORITER: {Name: "FORITER", Mnemonic: "foriter", Operands: operands(addressOperand), Wide: true,
+		Pops: values("iterable", "cursor"), Pushes: values("iterable", "next", "element"),
+		Summary: "Advance an iteration over an array or a string, started with the cursor 0: push the iterable, the next cursor and the element at cursor, or continue at address once there is none left. Strings yield the code points of their runes."},
+	IJEC: {Name: "IJEC", Operands: operands(addressOperand, constantOperand), Wide: true, Pops: values("x"),
+		Summary: "Continue at address if the int32 x equals the constant pool entry at constant. Emitted by the assembler in place of IJE when it shrinks the program."},
+	IJNEC: {Name: "IJNEC", Operands: operands(addressOperand, constantOperand), Wide: true, Pops: values("x"),
+		Summary: "Continue at address if the int32 x differs from the constant pool entry at constant. Emitted by the assembler in place of IJNE when it shrinks the program."},
+	FJEC: {Name: "FJEC", Operands: operands(addressOperand, constantOperand), Wide: true, Pops: values("x"),
+		Summary: "Continue at address if the float32 x equals the constant pool entry at constant. Emitted by the assembler in place of FJE when it shrinks the program."},
+	FJNEC: {Name: "FJNEC", Operands: operands(addressOperand, constantOperand), Wide: true, Pops: values("x"),
+		Summary: "Continue at address if the float32 x differs from the constant pool entry at constant. Emitted by the assembler in place of FJNE when it shrinks the program."},
+	CALLNATIVE: {Name: "CALLNATIVE", Operands: operands(Operand{"native", OperandIndex}), Wide: true, Pops: values("args..."), Pushes: values("result"),
+		Summary: "Call the host function at index in the natives table, emitted by the assembler for a `call` of a `native func`. The arguments are checked against its declaration, a non-void native pushes its result. An async native pushes the handle of its pending call instead."},
+	AWAIT: {Name: "AWAIT", Mnemonic: "await", Pops: values("handle"), Pushes: values("result"),
+		Summary: "Wait until the pending call of an async native the handle refers to is over and push its result. The whole interpreter is blocked meanwhile: no other instruction runs and Pause waits, while other pending calls go on. A handle is awaited once, an error of the native is thrown."},
+	SLICE: {Name: "SLICE", Mnemonic: "slice", Pops: values("array", "offset", "length"), Pushes: values("view"),
+		Summary: "Push a view of the length elements of the array or view at offset, without copying them. The view is used like an array, its bounds are checked against the view, and writes through it change the array."},
+	ARR_CLONE: {Name: "ARR_CLONE", Mnemonic: "arr_clone", Pops: values("array"), Pushes: values("clone"),
+		Summary: "Push a copy of the array, view or clone that shares the elements of the array until either is written to. The first write copies them, so a write to one is never seen by the other. A view is copied right away."},
+}
+
+var opcodesByMnemonic = make(map[string]*OpcodeInfo)
+
+func init() {
+	for op := range opcodeTable {
+		info := &opcodeTable[op]
+		info.Opcode = Opcode(op)
+		if info.Mnemonic != "" {
+			opcodesByMnemonic[info.Mnemonic] = info
+		}
+	}
+}
+
+// Opcodes returns the description of every opcode, in opcode order.
+func Opcodes() []OpcodeInfo {
+	return append([]OpcodeInfo(nil), opcodeTable[:]...)
+}
+
+// LookupOpcode returns the description of op, an extension included.
+func LookupOpcode(op Opcode) (OpcodeInfo, bool) {
+	if int(op) >= len(opcodeTable) {
+		return lookupExtension(op)
+	}
+	return opcodeTable[op], true
+}
+
+// LookupMnemonic returns the description of the instruction written name
+// in assembly, or named name in listings, ignoring case.
+func LookupMnemonic(name string) (OpcodeInfo, bool) {
+	if info, ok := opcodesByMnemonic[strings.ToLower(name)]; ok {
+		return *info, true
+	}
+	for _, info := range opcodeTable {
+		if strings.EqualFold(info.Name, name) {
+			return info, true
+		}
+	}
+	return lookupExtensionMnemonic(name)
+}
+
+// acceptsWide reports whether op may follow a WIDE prefix
+func acceptsWide(op Opcode) bool {
+	return int(op) < len(opcodeTable) && opcodeTable[op].Wide
+}
@@ -0,0 +1,82 @@
+package vm
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestOpcodeTableIsComplete(t *testing.T) {
+	for i, info := range Opcodes() {
+		if info.Opcode != Opcode(i) || info.Name == "" || info.Summary == "" {
+			t.Errorf("Opcode %d has an incomplete entry: %+v", i, info)
+		}
+		if info.Wide != (len(info.Operands) > 0 && info.Operands[0].Type == OperandIndex) {
+			t.Errorf("%v: expected WIDE support exactly when the first operand is an index", info.Name)
+		}
+	}
+	if name := Opcode(len(Opcodes())).String(); !strings.HasPrefix(name, "UNKNOWN_OPCODE") {
+		t.Errorf("Expected opcodes past the table to be unknown, got %s", name)
+	}
+}
+
+func TestLookupMnemonic(t *testing.T) {
+	for _, name := range []string{"ije", "IJE"} {
+		if info, ok := LookupMnemonic(name); !ok || info.Opcode != IJE {
+			t.Errorf("Expected %s to be IJE, got %v, %v", name, info.Name, ok)
+		}
+	}
+	// opcodes without a mnemonic are found by name
+	if info, ok := LookupMnemonic("wide"); !ok || info.Opcode != WIDE {
+		t.Errorf("Expected wide to be WIDE, got %v, %v", info.Name, ok)
+	}
+	if _, ok := LookupMnemonic("nop"); ok {
+		t.Error("Expected nop to be unknown")
+	}
+}
+
+func TestEncodingDiagram(t *testing.T) {
+	info, _ := LookupOpcode(STORE)
+	want := "+------+-------------+\n| 0x17 |  index:u16  |\n+------+-------------+"
+	if got := info.Encoding(false); got != want {
+		t.Errorf("Expected\n%s\ngot\n%s", want, got)
+	}
+	if wide := info.Encoding(true); !strings.Contains(wide, "| 0x2e | 0x17 |") || !strings.Contains(wide, "index:u32") {
+		t.Errorf("Expected the WIDE prefix and a 4 byte index, got\n%s", wide)
+	}
+}
+
+func TestWriteSpec(t *testing.T) {
+	for _, format := range []string{SpecMarkdown, SpecHTML} {
+		var buf bytes.Buffer
+		if err := WriteSpec(&buf, format); err != nil {
+			t.Fatal(err)
+		}
+		spec := buf.String()
+		for _, info := range Opcodes() {
+			if !strings.Contains(spec, info.Name) {
+				t.Errorf("Expected the %s spec to document %s", format, info.Name)
+			}
+		}
+	}
+	var buf bytes.Buffer
+	if err := WriteSpec(&buf, "pdf"); err == nil {
+		t.Error("Expected an unknown format to fail")
+	}
+}
+
+func TestWriteHelp(t *testing.T) {
+	info, _ := LookupMnemonic("idiv")
+	var buf bytes.Buffer
+	if err := info.WriteHelp(&buf); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"idiv (opcode 0x06)", "a, b → a/b", "| 0x06 |"} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("Expected the help to contain %q, got\n%s", want, buf.String())
+		}
+	}
+	if strings.Contains(buf.String(), "WIDE") {
+		t.Error("Expected no WIDE encoding for idiv")
+	}
+}
@@ -0,0 +1,42 @@
+package vm
+
+import (
+	"fmt"
+
+	. "github.com/AndreiAlbert/gvm/common"
+	"github.com/AndreiAlbert/gvm/heap"
+)
+
+// nextElement returns the element at the cursor of an iteration over
+// iterable and the cursor after it, or ok false when the iteration is
+// over, see heap.Next. The errors are catchable.
+func (v *VM) nextElement(iterable, cursor Value) (element Value, next int32, ok bool, err error) {
+	switch iterable.Kind() {
+	case ValuePtr, ValueString, ValueArray:
+	default:
+		return Value{}, 0, false, fmt.Errorf("%w: iterating over %v, expected an array or a string", heap.ErrTypeMismatch, iterable.Kind())
+	}
+	if cursor.Kind() != ValueInt32 {
+		return Value{}, 0, false, fmt.Errorf("%w: iteration cursor is %v, expected int32", heap.ErrTypeMismatch, cursor.Kind())
+	}
+	return v.Heap.Next(iterable.Ptr(), cursor.AsInt32())
+}
+
+// forIter advances the iteration whose iterable and cursor are on top of
+// the stack. It pushes the iterable, the next cursor and the element, or
+// pops both and reports false when the iteration is over.
+func (v *VM) forIter() bool {
+	cursor := v.pop()
+	iterable := v.pop()
+	element, next, ok, err := v.nextElement(iterable, cursor)
+	if err != nil {
+		v.fail(fmt.Errorf("FORITER: %w", err))
+	}
+	if !ok {
+		return false
+	}
+	v.push(iterable)
+	v.push(Int32Value(next))
+	v.push(element)
+	return true
+}
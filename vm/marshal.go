@@ -0,0 +1,288 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"unicode"
+	"unicode/utf8"
+
+	. "github.com/AndreiAlbert/gvm/common"
+	"github.com/AndreiAlbert/gvm/heap"
+)
+
+// maxMarshalDepth bounds how deep Marshal and Unmarshal follow pointers,
+// slices and structs, so that cyclic data fails instead of recursing forever
+const maxMarshalDepth = 64
+
+// Marshal copies a Go value to the heap and returns the guest value holding
+// it, for natives returning data to the program:
+//   - int32 and float32 become int32 and float32 values
+//   - strings are allocated as heap strings
+//   - slices become arrays, of int32, float32 or string elements for the
+//     slices of those types and of pointers for any other element type
+//   - structs become a struct of the program named like the Go type. Each
+//     exported field is stored in the field its gvm tag names, or by
+//     default the field of its name with the first letter lowercased. A tag
+//     of "-" skips the field.
+//   - pointers store what they point to, nil pointers become nil
+func (v *VM) Marshal(value any) (Value, error) {
+	return v.marshal(reflect.ValueOf(value), 0)
+}
+
+// Unmarshal copies the guest value into the Go value out points to,
+// following the rules of Marshal the other way around. Pointer fields and
+// elements are allocated, nil ones left nil.
+func (v *VM) Unmarshal(value Value, out any) error {
+	target := reflect.ValueOf(out)
+	if target.Kind() != reflect.Pointer || target.IsNil() {
+		return errors.New("unmarshal needs a non-nil pointer")
+	}
+	return v.unmarshal(value, target.Elem(), 0)
+}
+
+func (v *VM) marshal(value reflect.Value, depth int) (Value, error) {
+	if depth > maxMarshalDepth {
+		return Value{}, fmt.Errorf("marshal: nested deeper than %d", maxMarshalDepth)
+	}
+	switch value.Kind() {
+	case reflect.Int32:
+		return Int32Value(int32(value.Int())), nil
+	case reflect.Float32:
+		return Float32Value(float32(value.Float())), nil
+	case reflect.String:
+		ptr, err := v.Heap.AllocateString(value.String())
+		return PtrValue(ptr), err
+	case reflect.Slice:
+		return v.marshalSlice(value, depth)
+	case reflect.Struct:
+		return v.marshalStruct(value, depth)
+	case reflect.Pointer:
+		if value.IsNil() {
+			return PtrValue(0), nil
+		}
+		return v.marshal(value.Elem(), depth+1)
+	case reflect.Invalid:
+		return Value{}, fmt.Errorf("%w: can't marshal nil", heap.ErrTypeMismatch)
+	}
+	return Value{}, fmt.Errorf("%w: can't marshal %v", heap.ErrTypeMismatch, value.Type())
+}
+
+func (v *VM) marshalSlice(value reflect.Value, depth int) (Value, error) {
+	if value.Len() > math.MaxInt32 {
+		return Value{}, fmt.Errorf("%w: %d elements", heap.ErrOutOfBounds, value.Len())
+	}
+	kind := elementKind(value.Type().Elem())
+	array, err := v.Heap.AllocateArray(kind, int32(value.Len()))
+	if err != nil {
+		return Value{}, err
+	}
+	for i := 0; i < value.Len(); i++ {
+		element, err := v.marshal(value.Index(i), depth+1)
+		if err != nil {
+			return Value{}, fmt.Errorf("element %d: %w", i, err)
+		}
+		if err := v.Heap.SetArrayElement(array, int32(i), withKind(kind, element)); err != nil {
+			return Value{}, fmt.Errorf("element %d: %w", i, err)
+		}
+	}
+	return PtrValue(array), nil
+}
+
+func (v *VM) marshalStruct(value reflect.Value, depth int) (Value, error) {
+	name := value.Type().Name()
+	structType, ok := v.structs[name]
+	if !ok {
+		return Value{}, fmt.Errorf("%w: the program has no struct %s", heap.ErrTypeMismatch, name)
+	}
+	ptr, err := v.Heap.AllocateStruct(structType)
+	if err != nil {
+		return Value{}, err
+	}
+	for i := 0; i < value.NumField(); i++ {
+		fieldName := guestFieldName(value.Type().Field(i))
+		if fieldName == "" {
+			continue
+		}
+		field, ok := structField(structType, fieldName)
+		if !ok {
+			return Value{}, fmt.Errorf("%w: struct %s has no field %s", heap.ErrTypeMismatch, name, fieldName)
+		}
+		fieldValue, err := v.marshal(value.Field(i), depth+1)
+		if err != nil {
+			return Value{}, fmt.Errorf("field %s: %w", fieldName, err)
+		}
+		if err := v.Heap.SetStructureField(ptr, fieldName, withKind(field.Type, fieldValue)); err != nil {
+			return Value{}, err
+		}
+	}
+	return PtrValue(ptr), nil
+}
+
+func (v *VM) unmarshal(value Value, target reflect.Value, depth int) error {
+	if depth > maxMarshalDepth {
+		return fmt.Errorf("unmarshal: nested deeper than %d", maxMarshalDepth)
+	}
+	switch target.Kind() {
+	case reflect.Int32:
+		if value.Kind() != ValueInt32 {
+			return fmt.Errorf("%w: expected int32, got %v", heap.ErrTypeMismatch, value.Kind())
+		}
+		target.SetInt(int64(value.AsInt32()))
+	case reflect.Float32:
+		if value.Kind() != ValueFloat32 {
+			return fmt.Errorf("%w: expected float32, got %v", heap.ErrTypeMismatch, value.Kind())
+		}
+		target.SetFloat(float64(value.AsFloat32()))
+	case reflect.String:
+		ptr, err := v.object(value, ValueString)
+		if err != nil {
+			return err
+		}
+		s, err := v.Heap.LoadString(ptr)
+		if err != nil {
+			return err
+		}
+		target.SetString(s)
+	case reflect.Slice:
+		ptr, err := v.object(value, ValueArray)
+		if err != nil {
+			return err
+		}
+		length, err := v.Heap.ArrayLength(ptr)
+		if err != nil {
+			return err
+		}
+		slice := reflect.MakeSlice(target.Type(), int(length), int(length))
+		for i := int32(0); i < length; i++ {
+			element, err := v.Heap.GetArrayElement(ptr, i)
+			if err != nil {
+				return err
+			}
+			if err := v.unmarshal(*element, slice.Index(int(i)), depth+1); err != nil {
+				return fmt.Errorf("element %d: %w", i, err)
+			}
+		}
+		target.Set(slice)
+	case reflect.Struct:
+		return v.unmarshalStruct(value, target, depth)
+	case reflect.Pointer:
+		if isHeapPointer(value) && value.Ptr() == 0 {
+			target.Set(reflect.Zero(target.Type()))
+			return nil
+		}
+		pointee := reflect.New(target.Type().Elem())
+		if err := v.unmarshal(value, pointee.Elem(), depth+1); err != nil {
+			return err
+		}
+		target.Set(pointee)
+	default:
+		return fmt.Errorf("%w: can't unmarshal into %v", heap.ErrTypeMismatch, target.Type())
+	}
+	return nil
+}
+
+func (v *VM) unmarshalStruct(value Value, target reflect.Value, depth int) error {
+	ptr, err := v.object(value, ValueStruct)
+	if err != nil {
+		return err
+	}
+	structType, err := v.Heap.StructTypeOf(ptr)
+	if err != nil {
+		return err
+	}
+	if name := target.Type().Name(); structType.Name != name {
+		return fmt.Errorf("%w: expected struct %s, got %s", heap.ErrTypeMismatch, name, structType.Name)
+	}
+	for i := 0; i < target.NumField(); i++ {
+		fieldName := guestFieldName(target.Type().Field(i))
+		if fieldName == "" {
+			continue
+		}
+		fieldValue, err := v.Heap.GetStructField(ptr, fieldName)
+		if err != nil {
+			return err
+		}
+		if err := v.unmarshal(*fieldValue, target.Field(i), depth+1); err != nil {
+			return fmt.Errorf("field %s: %w", fieldName, err)
+		}
+	}
+	return nil
+}
+
+// object returns the pointer value holds, checking that it refers to an
+// object of kind
+func (v *VM) object(value Value, kind ValueKind) (uintptr, error) {
+	if !isHeapPointer(value) {
+		return 0, fmt.Errorf("%w: expected a pointer to a %v, got %v", heap.ErrTypeMismatch, kind, value.Kind())
+	}
+	objectKind, err := v.Heap.ObjectKind(value.Ptr())
+	if err != nil {
+		return 0, err
+	}
+	if objectKind != kind {
+		return 0, fmt.Errorf("%w: expected a pointer to a %v, got a pointer to a %v", heap.ErrTypeMismatch, kind, objectKind)
+	}
+	return value.Ptr(), nil
+}
+
+// guestFieldName is the name of the guest field a Go struct field maps to,
+// "" for fields that are skipped
+func guestFieldName(field reflect.StructField) string {
+	if !field.IsExported() {
+		return ""
+	}
+	if tag, ok := field.Tag.Lookup("gvm"); ok {
+		if tag == "-" {
+			return ""
+		}
+		return tag
+	}
+	first, size := utf8.DecodeRuneInString(field.Name)
+	return string(unicode.ToLower(first)) + field.Name[size:]
+}
+
+func structField(structType StructType, name string) (StructField, bool) {
+	for _, field := range structType.Fields {
+		if field.Name == name {
+			return field, true
+		}
+	}
+	return StructField{}, false
+}
+
+// elementKind is the element kind of the arrays slices of t are marshaled to
+func elementKind(t reflect.Type) ValueKind {
+	switch t.Kind() {
+	case reflect.Int32:
+		return ValueInt32
+	case reflect.Float32:
+		return ValueFloat32
+	case reflect.String:
+		return ValueString
+	}
+	return ValuePtr
+}
+
+// withKind retags a pointer as the string, array or struct a field or
+// element is declared to hold; other values are returned as they are
+func withKind(kind ValueKind, value Value) Value {
+	switch kind {
+	case ValueString, ValueArray, ValueStruct:
+		if isHeapPointer(value) {
+			return NewValue(kind, uint64(value.Ptr()))
+		}
+	}
+	return value
+}
+
+// isHeapPointer reports whether value is a pointer, whichever kind of
+// object it is tagged with
+func isHeapPointer(value Value) bool {
+	switch value.Kind() {
+	case ValuePtr, ValueString, ValueArray, ValueStruct:
+		return true
+	}
+	return false
+}
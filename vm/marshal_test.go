@@ -0,0 +1,84 @@
+package vm
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/AndreiAlbert/gvm/bytecode"
+	. "github.com/AndreiAlbert/gvm/common"
+	"github.com/AndreiAlbert/gvm/heap"
+)
+
+type Player struct {
+	Name   string
+	Scores []int32
+	Speed  float32 `gvm:"velocity"`
+	Next   *Player
+	Notes  string `gvm:"-"`
+	secret int32
+}
+
+func TestMarshal(t *testing.T) {
+	int32Kind := ValueInt32
+	program := &bytecode.Program{
+		Functions: []bytecode.Function{{Name: "main", IsMain: true, ReturnType: ValueVoid}},
+		Structs: []StructType{{Name: "Player", Fields: []StructField{
+			{Name: "name", Type: ValueString},
+			{Name: "scores", Type: ValueArray, ArrayType: &int32Kind},
+			{Name: "velocity", Type: ValueFloat32},
+			{Name: "next", Type: ValuePtr},
+		}}},
+		Code: []byte{byte(HALT)},
+	}
+	machine, err := NewVmFromProgram(program, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer machine.Close()
+
+	player := Player{Name: "ada", Scores: []int32{3, 1, 4}, Speed: 1.5, Next: &Player{Name: "bob"}, Notes: "kept out", secret: 7}
+	value, err := machine.Marshal(player)
+	if err != nil {
+		t.Fatal(err)
+	}
+	name, err := machine.Heap.GetStructField(value.AsPtr(), "name")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s, err := machine.Heap.LoadString(name.Ptr()); err != nil || s != "ada" {
+		t.Errorf("name field holds %q, %v", s, err)
+	}
+
+	var back Player
+	if err := machine.Unmarshal(value, &back); err != nil {
+		t.Fatal(err)
+	}
+	want := Player{Name: "ada", Scores: []int32{3, 1, 4}, Speed: 1.5, Next: &Player{Name: "bob", Scores: []int32{}}}
+	if !reflect.DeepEqual(back, want) {
+		t.Errorf("unmarshaled %+v, expected %+v", back, want)
+	}
+
+	names, err := machine.Marshal([]string{"x", "yz"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var backNames []string
+	if err := machine.Unmarshal(names, &backNames); err != nil || !reflect.DeepEqual(backNames, []string{"x", "yz"}) {
+		t.Errorf("unmarshaled %q, %v", backNames, err)
+	}
+
+	type Unknown struct{ X int32 }
+	if _, err := machine.Marshal(Unknown{}); !errors.Is(err, heap.ErrTypeMismatch) {
+		t.Errorf("expected a struct the program doesn't declare to fail, got %v", err)
+	}
+	var n int32
+	if err := machine.Unmarshal(names, &n); !errors.Is(err, heap.ErrTypeMismatch) {
+		t.Errorf("expected an array unmarshaled into an int32 to fail, got %v", err)
+	}
+	var wrong struct{ Name string }
+	if err := machine.Unmarshal(value, &wrong); err == nil || !strings.Contains(err.Error(), "expected struct") {
+		t.Errorf("expected a struct of another name to fail, got %v", err)
+	}
+}
@@ -0,0 +1,60 @@
+package vm
+
+import (
+	"fmt"
+	"path/filepath"
+)
+
+// Modes of MMAP_FILE
+const (
+	// MapReadOnly maps the file shared, writes to the array fail with
+	// heap.ErrReadOnly
+	MapReadOnly int32 = iota
+	// MapCopyOnWrite maps the file privately, writes to the array stay in
+	// the VM
+	MapCopyOnWrite
+)
+
+// mapGuestFile maps the file name under the map root as a byte array
+func (v *VM) mapGuestFile(name string, mode int32) (uintptr, error) {
+	if mode != MapReadOnly && mode != MapCopyOnWrite {
+		return 0, fmt.Errorf("%w: mode must be 0 (read-only) or 1 (copy-on-write), got %d", ErrFileAccess, mode)
+	}
+	path, err := resolveMapPath(v.mapRoot, name)
+	if err != nil {
+		return 0, err
+	}
+	data, release, err := mapFile(path, mode == MapCopyOnWrite)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %w", ErrFileAccess, err)
+	}
+	ptr, err := v.Heap.AllocateMappedArray(data, mode == MapReadOnly, release)
+	if err != nil && release != nil {
+		release()
+	}
+	return ptr, err
+}
+
+// resolveMapPath returns the file the guest path name refers to, which must
+// be under root once symbolic links are followed
+func resolveMapPath(root, name string) (string, error) {
+	if root == "" {
+		return "", fmt.Errorf("%w: mapping files is disabled, there is no map root", ErrFileAccess)
+	}
+	name = filepath.FromSlash(name)
+	if !filepath.IsLocal(name) {
+		return "", fmt.Errorf("%w: %q is not a path inside the map root", ErrFileAccess, name)
+	}
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return "", fmt.Errorf("%w: %w", ErrFileAccess, err)
+	}
+	path, err := filepath.EvalSymlinks(filepath.Join(realRoot, name))
+	if err != nil {
+		return "", fmt.Errorf("%w: %w", ErrFileAccess, err)
+	}
+	if rel, err := filepath.Rel(realRoot, path); err != nil || !filepath.IsLocal(rel) {
+		return "", fmt.Errorf("%w: %q leads outside of the map root", ErrFileAccess, name)
+	}
+	return path, nil
+}
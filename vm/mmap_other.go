@@ -0,0 +1,15 @@
+//go:build !unix
+
+package vm
+
+import "os"
+
+// mapFile reads the file at path, there is no mapping outside of unix. The
+// copy can always be written to.
+func mapFile(path string, private bool) ([]byte, func() error, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, nil, nil
+}
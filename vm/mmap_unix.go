@@ -0,0 +1,35 @@
+//go:build unix
+
+package vm
+
+import (
+	"os"
+	"syscall"
+)
+
+// mapFile maps the file at path into memory. A private mapping can be
+// written to, without the writes reaching the file.
+func mapFile(path string, private bool) ([]byte, func() error, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+	size := int(info.Size())
+	if size == 0 {
+		return []byte{}, nil, nil
+	}
+	prot, flags := syscall.PROT_READ, syscall.MAP_SHARED
+	if private {
+		prot, flags = syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_PRIVATE
+	}
+	data, err := syscall.Mmap(int(f.Fd()), 0, size, prot, flags)
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, func() error { return syscall.Munmap(data) }, nil
+}
@@ -0,0 +1,143 @@
+package vm
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/AndreiAlbert/gvm/bytecode"
+	. "github.com/AndreiAlbert/gvm/common"
+	"github.com/AndreiAlbert/gvm/heap"
+)
+
+// Native is a host function programs call through a `native func`
+// declaration of their .natives section. Options.Natives registers them by
+// name, the VM binds every declaration of the program to the native of its
+// name when it loads it and refuses to load it if the signatures differ.
+type Native struct {
+	// Params are the kinds of the arguments: ValueInt32, ValueFloat32,
+	// ValueString for a pointer to a string and ValuePtr for any pointer,
+	// such as a struct.
+	Params []ValueKind
+	// Returns is the kind of the result, ValueVoid for none.
+	Returns ValueKind
+	// Func receives the arguments, first parameter first, and returns the
+	// result, which is ignored for void natives. v.Unmarshal and
+	// v.Marshal convert strings, arrays and structs. An error stops the
+	// program.
+	Func func(v *VM, args []Value) (Value, error)
+	// Async, set instead of Func, registers a native the program declares
+	// as `native async func`. It is called with the arguments like Func and
+	// returns the work of the call, which runs on its own goroutine while
+	// the program goes on, until it awaits the call. The work must not use
+	// the VM: it gets what it needs from the arguments beforehand and
+	// returns a Go value, converted with v.Marshal once the call is
+	// awaited. Its error is thrown by AWAIT.
+	Async func(v *VM, args []Value) (work func() (any, error), err error)
+	// Deterministic marks a native whose result and output depend only on
+	// its arguments, so Options.Deterministic lets programs call it.
+	Deterministic bool
+}
+
+// boundNative is a native declaration of the program and the host function
+// it was bound to
+type boundNative struct {
+	bytecode.Native
+	fn    func(v *VM, args []Value) (Value, error)
+	async func(v *VM, args []Value) (func() (any, error), error)
+}
+
+// signature formats the native as the program declares it
+func (n Native) signature(name string) string {
+	declared := bytecode.Native{Name: name, Params: n.Params, ReturnType: n.Returns, Async: n.Async != nil}
+	return declared.Signature()
+}
+
+// bindNatives binds the native declarations of the program to the registered
+// natives. A declaration must have a native of its name with the same
+// parameter and result kinds.
+func (v *VM) bindNatives(declared []bytecode.Native, registered map[string]Native) error {
+	var problems []string
+	for _, decl := range declared {
+		if decl.Async && decl.ReturnType == ValueVoid {
+			problems = append(problems, fmt.Sprintf("native %s is async and returns nothing to await", decl.Signature()))
+			continue
+		}
+		native, ok := registered[decl.Name]
+		if !ok || (native.Func == nil && native.Async == nil) {
+			problems = append(problems, fmt.Sprintf("native %s is not registered", decl.Signature()))
+			continue
+		}
+		if native.signature(decl.Name) != decl.Signature() {
+			problems = append(problems, fmt.Sprintf("native %s is declared by the program, the host registers %s", decl.Signature(), native.signature(decl.Name)))
+			continue
+		}
+		v.natives = append(v.natives, boundNative{decl, native.Func, native.Async})
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("cannot bind natives: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// callNative runs the native at index with the arguments on top of the
+// stack, pushing its result unless it is void, or starts the call of an
+// async native and pushes its handle
+func (v *VM) callNative(index int) {
+	if index >= len(v.natives) {
+		v.failf("native not found at index: %d", index)
+	}
+	native := v.natives[index]
+	argCount := len(native.Params)
+	if stack := v.getCurrentFrame().LocalStack; len(stack) < argCount {
+		v.failf("native %s needs %d arguments, the stack holds %d", native.Name, argCount, len(stack))
+	}
+	args := make([]Value, argCount)
+	for i := argCount - 1; i >= 0; i-- {
+		args[i] = v.pop()
+		if !v.nativeKind(native.Params[i], args[i]) {
+			v.fail(fmt.Errorf("%w: argument %d of native %s is %v, expected %v", heap.ErrTypeMismatch, i+1, native.Signature(), args[i].Kind(), native.Params[i]))
+		}
+	}
+	if native.Async {
+		v.startAsync(&native, args)
+		return
+	}
+	result, err := native.fn(v, args)
+	if err != nil {
+		v.fail(fmt.Errorf("native %s: %w", native.Name, err))
+	}
+	if native.ReturnType == ValueVoid {
+		return
+	}
+	if !v.nativeKind(native.ReturnType, result) {
+		v.failf("native %s returned %v, expected %v", native.Signature(), result.Kind(), native.ReturnType)
+	}
+	v.push(result)
+}
+
+// stackKind is the kind of the values of a native parameter or result on
+// the stack
+func stackKind(kind ValueKind) ValueKind {
+	if kind == ValueString {
+		return ValuePtr
+	}
+	return kind
+}
+
+// nativeKind reports whether value is of the kind of a native parameter or
+// result: strings are pointers to a string, ValuePtr accepts any pointer,
+// including those loaded from string and array fields
+func (v *VM) nativeKind(kind ValueKind, value Value) bool {
+	switch kind {
+	case ValueString:
+		if !isHeapPointer(value) {
+			return false
+		}
+		objectKind, err := v.Heap.ObjectKind(value.Ptr())
+		return err == nil && objectKind == ValueString
+	case ValuePtr:
+		return isHeapPointer(value)
+	default:
+		return value.Kind() == kind
+	}
+}
@@ -0,0 +1,207 @@
+package vm
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/AndreiAlbert/gvm/bytecode"
+	. "github.com/AndreiAlbert/gvm/common"
+	"github.com/AndreiAlbert/gvm/heap"
+)
+
+// testNatives are the natives the test programs declare
+var testNatives = map[string]Native{
+	"add": {
+		Params:  []ValueKind{ValueInt32, ValueInt32},
+		Returns: ValueInt32,
+		Func: func(v *VM, args []Value) (Value, error) {
+			return Int32Value(args[0].AsInt32() + args[1].AsInt32()), nil
+		},
+		Deterministic: true,
+	},
+	"sort": {
+		Params:  []ValueKind{ValuePtr, ValuePtr},
+		Returns: ValueVoid,
+		Func: func(v *VM, args []Value) (Value, error) {
+			var xs []int32
+			if err := v.Unmarshal(args[0], &xs); err != nil {
+				return Value{}, err
+			}
+			var failed error
+			sort.SliceStable(xs, func(i, j int) bool {
+				result, err := v.CallClosure(args[1], Int32Value(xs[i]), Int32Value(xs[j]))
+				if err != nil {
+					failed = err
+					return false
+				}
+				return result.AsInt32() < 0
+			})
+			if failed != nil {
+				return Value{}, failed
+			}
+			for i, x := range xs {
+				if err := v.Heap.SetArrayElement(args[0].Ptr(), int32(i), Int32Value(x)); err != nil {
+					return Value{}, err
+				}
+			}
+			return Value{}, nil
+		},
+		Deterministic: true,
+	},
+	"double": {
+		Params:  []ValueKind{ValueInt32},
+		Returns: ValueInt32,
+		Async: func(v *VM, args []Value) (func() (any, error), error) {
+			x := args[0].AsInt32()
+			return func() (any, error) { return 2 * x, nil }, nil
+		},
+		Deterministic: true,
+	},
+	"greet": {
+		Params:  []ValueKind{ValueString},
+		Returns: ValueString,
+		Async: func(v *VM, args []Value) (func() (any, error), error) {
+			var name string
+			if err := v.Unmarshal(args[0], &name); err != nil {
+				return nil, err
+			}
+			return func() (any, error) { return "hello " + name, nil }, nil
+		},
+		Deterministic: true,
+	},
+	"say": {
+		Params:  []ValueKind{ValueString},
+		Returns: ValueVoid,
+		Func: func(v *VM, args []Value) (Value, error) {
+			s, err := v.Heap.LoadString(args[0].AsPtr())
+			if err != nil {
+				return Value{}, err
+			}
+			_, err = v.stdout.Write([]byte(s))
+			return Value{}, err
+		},
+		Deterministic: true,
+	},
+}
+
+func TestNatives(t *testing.T) {
+	program, err := bytecode.Decode(mustReadTestProgram(t, "testdata/natives.gvmbc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(program.Natives) != 2 || program.Natives[0].Signature() != "add(int32, int32) -> int32" {
+		t.Fatalf("natives: %+v", program.Natives)
+	}
+	var out bytes.Buffer
+	machine, err := NewVmFromProgram(program, Options{Stdout: &out, Natives: testNatives})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := machine.Run(); err != nil {
+		t.Fatal(err)
+	}
+	machine.Close()
+	if out.String() != "native" {
+		t.Errorf("output %q, expected %q", out.String(), "native")
+	}
+
+	_, err = NewVmFromProgram(program, Options{Natives: map[string]Native{"add": testNatives["add"]}})
+	if err == nil || !strings.Contains(err.Error(), "native say(string) -> void is not registered") {
+		t.Errorf("expected an unregistered native to be refused, got %v", err)
+	}
+
+	mismatched := map[string]Native{"add": testNatives["add"], "say": testNatives["say"]}
+	mismatched["say"] = Native{Params: []ValueKind{ValueInt32}, Returns: ValueVoid, Func: testNatives["say"].Func}
+	_, err = NewVmFromProgram(program, Options{Natives: mismatched})
+	if err == nil || !strings.Contains(err.Error(), "the host registers say(int32) -> void") {
+		t.Errorf("expected a signature mismatch to be refused, got %v", err)
+	}
+}
+
+func TestNativeErrors(t *testing.T) {
+	program, err := bytecode.Decode(mustReadTestProgram(t, "testdata/natives.gvmbc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	failed := errors.New("host failure")
+	natives := map[string]Native{
+		"add": testNatives["add"],
+		"say": {Params: []ValueKind{ValueString}, Returns: ValueVoid, Func: func(*VM, []Value) (Value, error) {
+			return Value{}, failed
+		}},
+	}
+	machine, err := NewVmFromProgram(program, Options{Natives: natives})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer machine.Close()
+	if err := machine.Run(); !errors.Is(err, failed) {
+		t.Errorf("expected the error of the native, got %v", err)
+	}
+
+	// add returning a float where the program expects int32
+	natives["add"] = Native{Params: []ValueKind{ValueInt32, ValueInt32}, Returns: ValueInt32, Func: func(*VM, []Value) (Value, error) {
+		return Float32Value(42), nil
+	}}
+	machine, err = NewVmFromProgram(program, Options{Natives: natives})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer machine.Close()
+	if err := machine.Run(); err == nil || !strings.Contains(err.Error(), "returned float32, expected int32") {
+		t.Errorf("expected the result kind to be checked, got %v", err)
+	}
+}
+
+func TestPinning(t *testing.T) {
+	program, err := bytecode.Decode(mustReadTestProgram(t, "testdata/loop.gvmbc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var logs bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&logs, nil))
+	machine, err := NewVmFromProgram(program, Options{MaxInstructions: 5000, PinWarnInstructions: 2000, Logger: logger})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer machine.Close()
+	ptr, err := machine.Heap.AllocateString("held by a native")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := machine.Pin(ptr); err != nil {
+		t.Fatal(err)
+	}
+	if err := machine.Pin(ptr); err != nil {
+		t.Fatal(err)
+	}
+	if err := machine.Run(); !errors.Is(err, ErrInstructionLimit) {
+		t.Fatalf("Expected the instruction limit to stop the program, got %v", err)
+	}
+	if n := strings.Count(logs.String(), "object pinned for a long time"); n != 1 {
+		t.Errorf("Expected one warning for the long held pin, got:\n%s", logs.String())
+	}
+	if pinned := machine.Pinned(); len(pinned) != 1 || pinned[0].Address != ptr || pinned[0].Pins != 2 || pinned[0].Since != 0 {
+		t.Errorf("Expected the string to be pinned twice since the start, got %+v", pinned)
+	}
+
+	err = machine.Heap.Free(ptr)
+	if _, code, ok := catchable(err); !errors.Is(err, heap.ErrPinned) || !ok || code != CodePinned {
+		t.Fatalf("Expected freeing the pinned string to fail with code %d, got %v", CodePinned, err)
+	}
+	machine.Unpin(ptr)
+	machine.Unpin(ptr)
+	if len(machine.Pinned()) != 0 {
+		t.Errorf("Expected no pins left, got %+v", machine.Pinned())
+	}
+	if err := machine.Unpin(ptr); err == nil {
+		t.Error("Expected unpinning an unpinned string to fail")
+	}
+	if err := machine.Heap.Free(ptr); err != nil {
+		t.Errorf("Expected the unpinned string to be freed, got %v", err)
+	}
+}
@@ -2,6 +2,7 @@ package vm
 
 import "fmt"
 
+// Opcode is the first byte of every instruction.
 type Opcode byte
 
 const (
@@ -47,101 +48,37 @@ const (
 	FUNC_MAIN
 	DEFSTRUCT
 	NEWSTRUCT
+	FLDGET_NAME  // legacy: field referenced by inline name
+	STFIELD_NAME // legacy: field referenced by inline name
 	FLDGET
 	STFIELD
+	WIDE            // prefix: the next instruction's address/index operand is 4 bytes
+	THROW           // raise the Error value on top of the stack
+	TRY             // install a handler at the operand address for errors raised until ENDTRY
+	ENDTRY          // remove the innermost handler
+	CHECKCAST       // fail unless the pointer on top of the stack refers to the operand type
+	INSTANCEOF      // test whether a pointer refers to the operand type
+	INVOKEINTERFACE // call a method by name on the struct below the arguments
+	MAKECLOSURE     // capture values into the environment of a closure of a function
+	CALLCLOSURE     // call the closure on top of the stack
+	FORITER         // push the next element of an iteration or jump once it is over
+	IJEC            // IJE comparing against a constant of the pool
+	IJNEC           // IJNE comparing against a constant of the pool
+	FJEC            // FJE comparing against a constant of the pool
+	FJNEC           // FJNE comparing against a constant of the pool
+	CALLNATIVE      // call a host function declared in the .natives section
+	AWAIT           // wait for the pending call of an async native, blocking the interpreter
+	SLICE           // create a view of part of an array
+	ARR_CLONE       // copy an array lazily, sharing it until a write
 )
 
+// String returns the opcode name.
 func (op Opcode) String() string {
-	switch op {
-	case HALT:
-		return "HALT"
-	case PUSH:
-		return "PUSH"
-	case POP:
-		return "POP"
-	case IADD:
-		return "IADD"
-	case ISUB:
-		return "ISUB"
-	case IMUL:
-		return "IMUL"
-	case IDIV:
-		return "IDIV"
-	case FADD:
-		return "FADD"
-	case FSUB:
-		return "FSUB"
-	case FMUL:
-		return "FMUL"
-	case FDIV:
-		return "FDIV"
-	case JMP:
-		return "JMP"
-	case IJNE:
-		return "IJNE"
-	case IJE:
-		return "IJE"
-	case FJNE:
-		return "FJNE"
-	case FJE:
-		return "FJE"
-	case EQ:
-		return "EQ"
-	case NE:
-		return "NE"
-	case LT:
-		return "LT"
-	case GT:
-		return "GT"
-	case GE:
-		return "GE"
-	case LE:
-		return "LE"
-	case LOAD:
-		return "LOAD"
-	case STORE:
-		return "STORE"
-	case CALL:
-		return "CALL"
-	case RET:
-		return "RET"
-	case RETV:
-		return "RETV"
-	case ALLOC:
-		return "ALLOC"
-	case FREE:
-		return "FREE"
-	case LOADH:
-		return "LOADH"
-	case STOREH:
-		return "STOREH"
-	case DUP:
-		return "DUP"
-	case STRALLOC:
-		return "STRALLOC"
-	case SYSCALL:
-		return "SYSCALL"
-	case NEWARR:
-		return "NEWARR"
-	case LDELEM:
-		return "LDELEM"
-	case STELEM:
-		return "STELEM"
-	case FUNC:
-		return "FUNC"
-	case FUNC_NORMAL:
-		return "FUNC_NORMAL"
-	case FUNC_MAIN:
-		return "FUNC_MAIN"
-	case DEFSTRUCT:
-		return "DEFSTRUCT"
-	case NEWSTRUCT:
-		return "NEWSTRUCT"
-	case FLDGET:
-		return "FLDGET"
-	case STFIELD:
-		return "STFIELD"
-	default:
-		return fmt.Sprintf("UNKNOWN_OPCODE(%d)", op)
+	if int(op) < len(opcodeTable) {
+		return opcodeTable[op].Name
 	}
+	if info, ok := lookupExtension(op); ok {
+		return info.Name
+	}
+	return fmt.Sprintf("UNKNOWN_OPCODE(%d)", op)
 }
@@ -0,0 +1,340 @@
+package vm
+
+import (
+	"embed"
+	"errors"
+	"fmt"
+	"github.com/AndreiAlbert/gvm/bytecode"
+	"github.com/AndreiAlbert/gvm/common"
+	"github.com/AndreiAlbert/gvm/heap"
+	"io"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Options configures a VM created by NewVmFromProgram. The zero value runs
+// the program against the process' standard streams.
+type Options struct {
+	// Stdin is read by READ_BYTE. It defaults to os.Stdin.
+	Stdin io.Reader
+	// Stdout receives WRITE_BYTE output. It defaults to os.Stdout.
+	Stdout io.Writer
+	// Env holds the variables read by GET_ENV. The program doesn't see the
+	// environment of the process, only these.
+	Env map[string]string
+	// Args are the command-line arguments of the program, returned by
+	// ARGV.
+	Args []string
+	// Clock is read by TIME_NOW_STRUCT. Without it the program sees the
+	// Unix epoch, so that its runs are reproducible.
+	Clock func() time.Time
+	// Trace, if set, receives one line per executed instruction.
+	Trace io.Writer
+	// AuditLog, if set, receives a JSON line for every system call with its
+	// arguments, results and errors. Long strings are redacted.
+	AuditLog io.Writer
+	// AuditID is copied into every audit entry and log record to tell
+	// executions sharing a log apart.
+	AuditID string
+	// Logger receives the records of LOG_DEBUG to LOG_ERROR, apart from
+	// Stdout. It defaults to slog.Default().
+	Logger *slog.Logger
+	// Profile collects the instructions and time spent at every address
+	// and call stack, see VM.WriteProfile.
+	Profile bool
+	// MaxInstructions stops the program with ErrInstructionLimit after
+	// that many instructions. Zero means no limit.
+	MaxInstructions uint64
+	// SoftInstructions is a warning before MaxInstructions: once the
+	// program ran that many instructions, OnSoftLimit is called and then
+	// the guest function registered with ON_SOFT_LIMIT, so the program
+	// can save its work before the hard limit stops it. Both run once,
+	// their instructions count against MaxInstructions. Zero means no
+	// soft limit.
+	SoftInstructions uint64
+	// OnSoftLimit is called on the goroutine running the program, between
+	// two instructions, when it reaches SoftInstructions. It may call
+	// guest functions with CallFunction.
+	OnSoftLimit func(v *VM)
+	// YieldInterval is how many instructions run between the automatic
+	// calls of runtime.Gosched, so a VM busy in a loop leaves room to the
+	// other goroutines of the process, such as the VMs of a server. Zero
+	// means DefaultYieldInterval.
+	YieldInterval uint64
+	// MaxHeapBytes caps the live heap size, see heap.Heap.Limit.
+	MaxHeapBytes uintptr
+	// PinWarnInstructions logs a warning to Logger for every block pinned
+	// with VM.Pin that many instructions ago and still pinned, a native
+	// likely to have forgotten to unpin it. The check runs every 1024
+	// instructions. Zero means no warnings.
+	PinWarnInstructions uint64
+	// AllocationSites records the instruction, function and source line
+	// that allocated every heap block, and that freed it. Heap reports
+	// list the live blocks by site, crash dumps keep the sites, and
+	// accesses to freed blocks fail with both sites. It slows down
+	// allocations, so it is meant for debugging.
+	AllocationSites bool
+	// FloatFormat is used by PRINT_FLOAT and traces to print floats. The
+	// zero value prints the shortest text that reads back the same float.
+	FloatFormat common.FloatFormat
+	// TrapFloatDivision makes FDIV by zero fail with ErrDivisionByZero, as
+	// IDIV does. By default it follows IEEE 754 and gives ±Inf, or NaN for
+	// 0/0.
+	TrapFloatDivision bool
+	// OutOfBoundsReads is what LDELEM does with an index outside of the
+	// array. The default, BoundsTrap, fails with heap.ErrOutOfBounds.
+	// Stores out of bounds always fail.
+	OutOfBoundsReads BoundsPolicy
+	// Allocator provides the heap blocks. It defaults to
+	// heap.DefaultAllocator.
+	Allocator heap.Allocator
+	// GC frees the heap blocks the program can no longer reach, between
+	// two instructions. Minor collections free the young blocks, those
+	// allocated since the previous collection, every GCYoungBytes
+	// allocated. Full collections free any block whenever the live heap
+	// grew by GCPercent since the previous one and holds more than 4 MiB,
+	// see VM.Collect. The blocks are then carved out of the arenas of a
+	// heap.ArenaAllocator taken from Allocator, which full collections
+	// compact, releasing the arenas they empty. FREE still frees a block at
+	// once, and programs may ask for a collection with GC_HINT.
+	GC bool
+	// GCYoungBytes is the size of the young generation, DefaultGCYoungBytes
+	// if 0. After a minor collection that kept more than half of it, it
+	// grows by GCGrowth, DefaultGCGrowth if 0 and never below 1, until the
+	// next full collection.
+	GCYoungBytes uintptr
+	GCGrowth     float64
+	// GCPercent is how much, in percent, the live heap grows past what the
+	// previous full collection left before the next one, DefaultGCPercent
+	// if 0. A negative GCPercent leaves full collections to GC_HINT and
+	// VM.Collect.
+	GCPercent int
+	// GCConcurrent marks the heap for the full collections GCPercent starts
+	// on a goroutine of its own, while the program goes on, see
+	// heap.Heap.StartMark. The program only stops at an instruction
+	// boundary to shade its roots, then at the first one after the marker
+	// is done to sweep, so large heaps don't pause it for their whole mark.
+	// Minor collections wait for the mark to end.
+	GCConcurrent bool
+	// History is the number of executed instructions kept so StepBack can
+	// undo them. Zero keeps none.
+	History int
+	// Deterministic refuses the options that let the program see the host,
+	// so its output depends only on its bytecode and its input: creating the
+	// VM fails with ErrNondeterministic if Clock is set, Env holds any
+	// variable, MapRoot is set or a native isn't marked Deterministic.
+	Deterministic bool
+	// Natives are the host functions programs may declare in their
+	// .natives section, by name.
+	Natives map[string]Native
+	// MaxCallbackDepth bounds how many calls of guest functions by natives,
+	// see VM.CallFunction, may be running at once. Zero means
+	// defaultCallbackDepth.
+	MaxCallbackDepth int
+	// MapRoot is the directory MMAP_FILE maps files from. Guest paths are
+	// relative to it and may not lead outside of it, through symbolic links
+	// either. Empty, the default, disables MMAP_FILE.
+	MapRoot string
+	// Extensions are the handlers of the instructions defined with
+	// DefineExtension, by opcode. An extension without one fails when it
+	// runs.
+	Extensions map[Opcode]Extension
+}
+
+// BoundsPolicy selects what LDELEM reads at an index outside of the array.
+type BoundsPolicy int
+
+const (
+	// BoundsTrap fails with heap.ErrOutOfBounds, which TRY can catch.
+	BoundsTrap BoundsPolicy = iota
+	// BoundsClamp reads the first element for negative indices and the
+	// last one for indices past the end. Reads of an empty array still
+	// trap, there is no element to clamp to.
+	BoundsClamp
+	// BoundsDefault reads the zero value of the element kind: 0, 0.0 or
+	// a nil pointer.
+	BoundsDefault
+)
+
+func (p BoundsPolicy) String() string {
+	switch p {
+	case BoundsTrap:
+		return "trap"
+	case BoundsClamp:
+		return "clamp"
+	case BoundsDefault:
+		return "default"
+	default:
+		return fmt.Sprintf("BoundsPolicy(%d)", int(p))
+	}
+}
+
+// ParseBoundsPolicy parses trap, clamp or default.
+func ParseBoundsPolicy(s string) (BoundsPolicy, error) {
+	for _, policy := range []BoundsPolicy{BoundsTrap, BoundsClamp, BoundsDefault} {
+		if s == policy.String() {
+			return policy, nil
+		}
+	}
+	return BoundsTrap, fmt.Errorf("invalid out of bounds policy %q: expected trap, clamp or default", s)
+}
+
+// contextCheckInterval is how many instructions run between checks of the
+// context passed to RunContext
+const contextCheckInterval = 1024
+
+// DefaultYieldInterval is the Options.YieldInterval of VMs that don't set
+// one.
+const DefaultYieldInterval = 1 << 16
+
+// ErrInstructionLimit is the cause of the RuntimeError returned when a
+// program runs past Options.MaxInstructions.
+var ErrInstructionLimit = errors.New("instruction limit exceeded")
+
+// ErrNondeterministic is returned when Options.Deterministic is set along
+// with an option that lets the program see the host.
+var ErrNondeterministic = errors.New("not allowed in a deterministic run")
+
+// ErrCallbackDepth is the error of a native calling a guest function while
+// Options.MaxCallbackDepth calls of natives into guest functions are
+// running.
+var ErrCallbackDepth = errors.New("callback depth exceeded")
+
+// ErrInterpreterFault is the cause of RuntimeErrors raised by a fault of
+// the interpreter, such as an index out of range on malformed code, rather
+// than by a check of the instruction.
+var ErrInterpreterFault = errors.New("interpreter fault")
+
+// RuntimeError reports an invalid operation performed by a running program.
+type RuntimeError struct {
+	// Ip is the address of the failing instruction in the code section.
+	Ip  uint
+	Err error
+}
+
+func (e *RuntimeError) Error() string {
+	return fmt.Sprintf("runtime error at address %d: %v", e.Ip, e.Err)
+}
+
+func (e *RuntimeError) Unwrap() error {
+	return e.Err
+}
+
+func (v *VM) configure(opts Options) error {
+	if opts.Deterministic {
+		if err := opts.checkDeterministic(); err != nil {
+			return err
+		}
+	}
+	v.stdin = opts.Stdin
+	if v.stdin == nil {
+		v.stdin = os.Stdin
+	}
+	v.stdout = opts.Stdout
+	if v.stdout == nil {
+		v.stdout = os.Stdout
+	}
+	v.env = opts.Env
+	v.args = opts.Args
+	v.clock = opts.Clock
+	v.mapRoot = opts.MapRoot
+	v.trace = opts.Trace
+	v.auditLog = opts.AuditLog
+	v.auditID = opts.AuditID
+	v.logger = opts.Logger
+	if v.logger == nil {
+		v.logger = slog.Default()
+	}
+	v.maxInstructions = opts.MaxInstructions
+	v.softInstructions = opts.SoftInstructions
+	v.onSoftLimit = opts.OnSoftLimit
+	v.yieldInterval = opts.YieldInterval
+	if v.yieldInterval == 0 {
+		v.yieldInterval = DefaultYieldInterval
+	}
+	v.maxCallbackDepth = opts.MaxCallbackDepth
+	v.extensions = opts.Extensions
+	if opts.GC {
+		allocator := opts.Allocator
+		if allocator == nil {
+			allocator = heap.DefaultAllocator
+		}
+		v.Heap = heap.NewHeapWithAllocator(heap.NewArenaAllocator(allocator, 0))
+		v.gc = newCollector(opts)
+	} else if opts.Allocator != nil {
+		v.Heap = heap.NewHeapWithAllocator(opts.Allocator)
+	}
+	v.Heap.Limit = opts.MaxHeapBytes
+	v.pinWarnInstructions = opts.PinWarnInstructions
+	if opts.AllocationSites {
+		v.Heap.CurrentSite = v.allocationSite
+	}
+	v.floatFormat = opts.FloatFormat
+	v.trapFloatDivision = opts.TrapFloatDivision
+	v.outOfBoundsReads = opts.OutOfBoundsReads
+	if opts.History > 0 {
+		v.history = newHistory(opts.History)
+	}
+	return nil
+}
+
+// checkDeterministic fails for the options that let the program see more
+// than its bytecode and input
+func (opts Options) checkDeterministic() error {
+	if opts.Clock != nil {
+		return fmt.Errorf("Clock: %w", ErrNondeterministic)
+	}
+	if len(opts.Env) > 0 {
+		return fmt.Errorf("Env: %w", ErrNondeterministic)
+	}
+	if opts.MapRoot != "" {
+		return fmt.Errorf("MapRoot: %w", ErrNondeterministic)
+	}
+	var natives []string
+	for name, native := range opts.Natives {
+		if !native.Deterministic {
+			natives = append(natives, name)
+		}
+	}
+	if len(natives) > 0 {
+		sort.Strings(natives)
+		return fmt.Errorf("natives %s: %w", strings.Join(natives, ", "), ErrNondeterministic)
+	}
+	return nil
+}
+
+// RunReader reads a container from r and runs it to completion.
+func RunReader(r io.Reader, opts Options) error {
+	program, err := bytecode.Read(r)
+	if err != nil {
+		return err
+	}
+	vm, err := NewVmFromProgram(program, opts)
+	if err != nil {
+		return err
+	}
+	defer vm.Close()
+	return vm.Run()
+}
+
+// RunEmbedded runs the container stored at path in fsys, so hosts can ship
+// compiled programs inside their binary:
+//
+//	//go:embed programs/*.gvmbc
+//	var programs embed.FS
+//
+//	err := vm.RunEmbedded(programs, "programs/hello.gvmbc", vm.Options{})
+func RunEmbedded(fsys embed.FS, path string, opts Options) error {
+	f, err := fsys.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := RunReader(f, opts); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,207 @@
+package vm
+
+import (
+	"bytes"
+	"context"
+	"embed"
+	"errors"
+	"github.com/AndreiAlbert/gvm/bytecode"
+	"github.com/AndreiAlbert/gvm/common"
+	"github.com/AndreiAlbert/gvm/heap"
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+//go:embed testdata/*.gvmbc
+var testPrograms embed.FS
+
+func TestRunEmbedded(t *testing.T) {
+	var stdout bytes.Buffer
+	err := RunEmbedded(testPrograms, "testdata/hello.gvmbc", Options{Stdout: &stdout})
+	if err != nil {
+		t.Fatalf("Failed to run: %v", err)
+	}
+	if stdout.String() != "Hi\n" {
+		t.Errorf("Expected output %q, got %q", "Hi\n", stdout.String())
+	}
+
+	if err := RunEmbedded(testPrograms, "testdata/missing.gvmbc", Options{}); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Expected not-exist error, got %v", err)
+	}
+}
+
+func TestRunReaderUsesStdin(t *testing.T) {
+	data, err := testPrograms.ReadFile("testdata/echo.gvmbc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stdout bytes.Buffer
+	opts := Options{Stdin: strings.NewReader("ok"), Stdout: &stdout}
+	if err := RunReader(bytes.NewReader(data), opts); err != nil {
+		t.Fatalf("Failed to run: %v", err)
+	}
+	if stdout.String() != "ok" {
+		t.Errorf("Expected output %q, got %q", "ok", stdout.String())
+	}
+}
+
+func TestRunReturnsRuntimeError(t *testing.T) {
+	data, err := testPrograms.ReadFile("testdata/divzero.gvmbc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = RunReader(bytes.NewReader(data), Options{})
+	var runtimeErr *RuntimeError
+	if !errors.As(err, &runtimeErr) {
+		t.Fatalf("Expected a runtime error, got %v", err)
+	}
+	if !errors.Is(runtimeErr, ErrDivisionByZero) {
+		t.Errorf("Unexpected error: %v", runtimeErr)
+	}
+
+	if err := RunReader(strings.NewReader("not bytecode"), Options{}); err == nil {
+		t.Error("Expected an error for invalid bytecode")
+	}
+}
+
+func TestRunEnforcesLimits(t *testing.T) {
+	var trace bytes.Buffer
+	opts := Options{MaxInstructions: 100, Trace: &trace}
+	err := RunEmbedded(testPrograms, "testdata/loop.gvmbc", opts)
+	if !errors.Is(err, ErrInstructionLimit) {
+		t.Fatalf("Expected the instruction limit to stop the program, got %v", err)
+	}
+	if lines := strings.Count(trace.String(), "\n"); lines != 100 {
+		t.Errorf("Expected 100 trace lines, got %d", lines)
+	}
+	if !strings.Contains(trace.String(), "JMP") {
+		t.Errorf("Unexpected trace:\n%s", trace.String())
+	}
+
+	err = RunEmbedded(testPrograms, "testdata/bigarray.gvmbc", Options{MaxHeapBytes: 1000})
+	if !errors.Is(err, heap.ErrLimitExceeded) {
+		t.Errorf("Expected the heap limit to stop the program, got %v", err)
+	}
+	if err := RunEmbedded(testPrograms, "testdata/bigarray.gvmbc", Options{MaxHeapBytes: 8000}); err != nil {
+		t.Errorf("Expected the program to fit in the heap limit, got %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	data, err := testPrograms.ReadFile("testdata/loop.gvmbc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	program, err := bytecode.Decode(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	machine, err := NewVmFromProgram(program, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer machine.Close()
+	if err := machine.RunContext(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected the canceled context to stop the program, got %v", err)
+	}
+}
+
+func TestFreeReturnsBlocksToTheLimit(t *testing.T) {
+	h := heap.NewHeap()
+	h.Limit = 16
+	for i := 0; i < 4; i++ {
+		ptr, err := h.Allocate(10)
+		if err != nil {
+			t.Fatalf("Allocation %d failed: %v", i, err)
+		}
+		if err := h.Free(ptr); err != nil {
+			t.Fatalf("Failed to free block %d: %v", i, err)
+		}
+	}
+	if h.Allocated() != 0 {
+		t.Errorf("Expected no live bytes, got %d", h.Allocated())
+	}
+}
+
+func TestDeterministicRefusesHostOptions(t *testing.T) {
+	program, err := bytecode.Decode(mustReadTestProgram(t, "testdata/hello.gvmbc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		opts    Options
+		refused bool
+	}{
+		{"input only", Options{Stdin: strings.NewReader("in"), MaxInstructions: 100}, false},
+		{"empty environment", Options{Env: map[string]string{}}, false},
+		{"environment", Options{Env: map[string]string{"KEY": "value"}}, true},
+		{"map root", Options{MapRoot: "testdata"}, true},
+		{"clock", Options{Clock: time.Now}, true},
+		{"deterministic natives", Options{Natives: testNatives}, false},
+		{"native", Options{Natives: map[string]Native{"now": {Returns: common.ValueInt32}}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.opts.Stdout, tt.opts.Deterministic = &bytes.Buffer{}, true
+			machine, err := NewVmFromProgram(program, tt.opts)
+			if err == nil {
+				machine.Close()
+			}
+			if refused := errors.Is(err, ErrNondeterministic); refused != tt.refused {
+				t.Errorf("Expected refusal %v, got error %v", tt.refused, err)
+			}
+		})
+	}
+}
+
+func TestSoftInstructionLimit(t *testing.T) {
+	var stdout bytes.Buffer
+	var warnedAt uint64
+	warnings := 0
+	opts := Options{Stdout: &stdout, MaxInstructions: 1000, SoftInstructions: 900, OnSoftLimit: func(v *VM) {
+		warnings++
+		warnedAt = v.instructions
+	}}
+	data, err := testPrograms.ReadFile("testdata/softlimit.gvmbc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	program, err := bytecode.Decode(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	machine, err := NewVmFromProgram(program, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer machine.Close()
+	if err := machine.Run(); !errors.Is(err, ErrInstructionLimit) {
+		t.Fatalf("Expected the hard limit to stop the program, got %v", err)
+	}
+	if warnings != 1 || warnedAt != 900 || !machine.SoftLimitReached() {
+		t.Errorf("Expected one warning at 900 instructions, got %d at %d", warnings, warnedAt)
+	}
+	if stdout.String() != "100" {
+		t.Errorf("Expected the handler to print the 100 instructions left, got %q", stdout.String())
+	}
+}
+
+func TestYieldInterval(t *testing.T) {
+	// with a single P, the goroutine only runs when the VM yields
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(1))
+	ran := make(chan struct{})
+	go close(ran)
+	err := RunEmbedded(testPrograms, "testdata/loop.gvmbc", Options{MaxInstructions: 100, YieldInterval: 10})
+	if !errors.Is(err, ErrInstructionLimit) {
+		t.Fatalf("Expected the instruction limit to stop the program, got %v", err)
+	}
+	select {
+	case <-ran:
+	default:
+		t.Error("Expected the VM to yield every 10 instructions")
+	}
+}
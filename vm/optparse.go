@@ -0,0 +1,113 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	. "github.com/AndreiAlbert/gvm/common"
+)
+
+// ErrBadOption is the cause of the RuntimeError raised by OPT_PARSE for an
+// option the spec doesn't declare, or one missing its value.
+var ErrBadOption = errors.New("bad command-line option")
+
+// optionSpec is an option declared in the spec of OPT_PARSE. Options with
+// a value are declared as name=default, flags as name.
+type optionSpec struct {
+	name     string
+	hasValue bool
+	value    string
+}
+
+// parseOptionSpec parses the spec of OPT_PARSE, the options separated by
+// spaces
+func parseOptionSpec(spec string) ([]optionSpec, error) {
+	var options []optionSpec
+	seen := make(map[string]bool)
+	for _, field := range strings.Fields(spec) {
+		name, value, hasValue := strings.Cut(field, "=")
+		name = strings.TrimLeft(name, "-")
+		if name == "" {
+			return nil, fmt.Errorf("option %q has no name", field)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("option %s is declared twice", name)
+		}
+		seen[name] = true
+		options = append(options, optionSpec{name, hasValue, value})
+	}
+	return options, nil
+}
+
+// parseOptions parses args the way the flag package of Go does: -name and
+// --name set a flag, -name value and -name=value an option with a value.
+// Options end at the first argument that isn't one, or after --. It
+// returns the value of every option of the spec, in its order, "1" for the
+// flags given and "" for the others, then the remaining arguments.
+func parseOptions(options []optionSpec, args []string) (values []string, rest []string, err error) {
+	values = make([]string, len(options))
+	index := make(map[string]int)
+	for i, option := range options {
+		values[i] = option.value
+		index[option.name] = i
+	}
+	for len(args) > 0 {
+		arg := args[0]
+		if arg == "--" {
+			return values, args[1:], nil
+		}
+		if len(arg) < 2 || arg[0] != '-' {
+			break
+		}
+		args = args[1:]
+		name, value, hasValue := strings.Cut(strings.TrimPrefix(arg[1:], "-"), "=")
+		i, ok := index[name]
+		if !ok {
+			return nil, nil, fmt.Errorf("%w: %s is not an option", ErrBadOption, arg)
+		}
+		switch {
+		case !options[i].hasValue && hasValue:
+			return nil, nil, fmt.Errorf("%w: -%s is a flag and takes no value", ErrBadOption, name)
+		case !options[i].hasValue:
+			value = "1"
+		case !hasValue && len(args) == 0:
+			return nil, nil, fmt.Errorf("%w: -%s needs a value", ErrBadOption, name)
+		case !hasValue:
+			value, args = args[0], args[1:]
+		}
+		values[i] = value
+	}
+	return values, args, nil
+}
+
+// optParse pops the arguments of OPT_PARSE, an array of strings and the
+// spec, and allocates the array of the option values followed by the array
+// of the remaining arguments
+func (v *VM) optParse() uintptr {
+	spec, err := v.Heap.LoadString(v.pop().AsPtr())
+	if err != nil {
+		v.fail(err)
+	}
+	options, err := parseOptionSpec(spec)
+	if err != nil {
+		v.failf("OPT_PARSE: %v", err)
+	}
+	args := v.loadStrings(v.pop().AsPtr())
+	values, rest, err := parseOptions(options, args)
+	if err != nil {
+		v.fail(err)
+	}
+	result, err := v.Heap.AllocateArray(ValuePtr, int32(len(values)+1))
+	if err != nil {
+		v.fail(err)
+	}
+	for i, value := range values {
+		v.setStringElement(result, int32(i), value)
+	}
+	restPtr := v.allocateStrings(rest)
+	if err := v.Heap.SetArrayElement(result, int32(len(values)), PtrValue(restPtr)); err != nil {
+		v.fail(err)
+	}
+	return result
+}
@@ -0,0 +1,110 @@
+package vm
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// safepoint parks the run loop between instructions while a host paused
+// the VM. The loop only loads requested on every instruction, the rest is
+// guarded by mu.
+type safepoint struct {
+	requested atomic.Bool
+	mu        sync.Mutex
+	// running reports that Run is executing instructions
+	running bool
+	paused  bool
+	// parked is closed once the loop stopped for the pause, nil when it
+	// did or doesn't have to
+	parked chan struct{}
+	// resume is closed by Resume
+	resume chan struct{}
+}
+
+// Pause stops the VM at the next instruction boundary and returns once it
+// is stopped. Until Resume is called, the stack, locals and heap can be
+// inspected from any goroutine, and a VM that isn't running doesn't start:
+// Run blocks before its first instruction. A paused VM stays paused when its
+// context is done. Pause doesn't affect Step, with which the host executes
+// instructions itself. Pausing a paused VM does nothing.
+func (v *VM) Pause() {
+	s := &v.safepoint
+	s.mu.Lock()
+	if s.paused {
+		parked := s.parked
+		s.mu.Unlock()
+		if parked != nil {
+			<-parked
+		}
+		return
+	}
+	s.paused = true
+	s.resume = make(chan struct{})
+	if !s.running {
+		s.mu.Unlock()
+		return
+	}
+	parked := make(chan struct{})
+	s.parked = parked
+	s.requested.Store(true)
+	s.mu.Unlock()
+	<-parked
+}
+
+// Resume lets a paused VM continue. Resuming a VM that isn't paused does
+// nothing.
+func (v *VM) Resume() {
+	s := &v.safepoint
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.paused {
+		return
+	}
+	s.paused = false
+	close(s.resume)
+}
+
+// Paused reports whether the VM is paused.
+func (v *VM) Paused() bool {
+	s := &v.safepoint
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.paused
+}
+
+// enter marks the run loop as executing, parking first if the VM is paused
+func (s *safepoint) enter() {
+	s.mu.Lock()
+	s.running = true
+	s.mu.Unlock()
+	s.park()
+}
+
+// leave marks the run loop as done, which releases a Pause waiting for it
+func (s *safepoint) leave() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.running = false
+	s.requested.Store(false)
+	if s.parked != nil {
+		close(s.parked)
+		s.parked = nil
+	}
+}
+
+// park blocks the run loop until Resume if the VM is paused
+func (s *safepoint) park() {
+	s.mu.Lock()
+	if !s.paused {
+		s.mu.Unlock()
+		return
+	}
+	s.requested.Store(false)
+	if s.parked != nil {
+		close(s.parked)
+		s.parked = nil
+	}
+	resume := s.resume
+	s.mu.Unlock()
+	<-resume
+}
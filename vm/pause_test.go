@@ -0,0 +1,79 @@
+package vm
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/AndreiAlbert/gvm/bytecode"
+	. "github.com/AndreiAlbert/gvm/common"
+)
+
+func TestPauseResume(t *testing.T) {
+	// main counts local 0 up forever
+	code := join([]byte{byte(HALT)}, pushInt(0), []byte{byte(STORE), 0, 0},
+		[]byte{byte(LOAD), 0, 0}, pushInt(1), []byte{byte(IADD), byte(STORE), 0, 0, byte(JMP), 0, 10})
+	program := &bytecode.Program{
+		Functions: []bytecode.Function{{Name: "main", Address: 1, IsMain: true, ReturnType: ValueVoid}},
+		Code:      code,
+	}
+	machine, err := NewVmFromProgram(program, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer machine.Close()
+
+	// a VM paused before it runs doesn't start
+	machine.Pause()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- machine.RunContext(ctx) }()
+	time.Sleep(10 * time.Millisecond)
+	if n := machine.Instructions(); n != 0 {
+		t.Fatalf("Expected the paused VM not to start, it executed %d instructions", n)
+	}
+	machine.Resume()
+	waitForInstructions(machine, 1000)
+
+	machine.Pause()
+	if !machine.Paused() {
+		t.Error("Expected the VM to report it is paused")
+	}
+	n := machine.Instructions()
+	counter := machine.getCurrentFrame().Locals[0]
+	time.Sleep(10 * time.Millisecond)
+	if machine.Instructions() != n || machine.getCurrentFrame().Locals[0] != counter {
+		t.Errorf("Expected the paused VM to stay at instruction %d", n)
+	}
+	if counter.AsInt32() == 0 {
+		t.Errorf("Expected the counter to have advanced, got %v", counter)
+	}
+	machine.Resume()
+	waitForInstructions(machine, n+1000)
+
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected the canceled context to stop the program, got %v", err)
+	}
+	// pausing a VM that stopped returns at once
+	machine.Pause()
+	machine.Resume()
+	if machine.Paused() {
+		t.Error("Expected the VM not to be paused after Resume")
+	}
+}
+
+// waitForInstructions lets the running VM execute at least n instructions,
+// pausing it to read the count
+func waitForInstructions(machine *VM, n uint64) {
+	for {
+		machine.Pause()
+		executed := machine.Instructions()
+		machine.Resume()
+		if executed >= n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
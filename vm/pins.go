@@ -0,0 +1,80 @@
+package vm
+
+import (
+	"context"
+	"log/slog"
+	"sort"
+)
+
+// PinnedObject is a heap block pinned by the host.
+type PinnedObject struct {
+	Address uintptr
+	// Pins is the number of Pin calls not undone yet
+	Pins int
+	// Since is the instruction count when the block was first pinned
+	Since uint64
+}
+
+// pinRecord is when a block was pinned and whether its pin was reported as
+// long held
+type pinRecord struct {
+	since  uint64
+	warned bool
+}
+
+// Pin keeps the heap block at ptr alive until as many Unpin calls, for
+// natives holding on to a guest object across calls: the program freeing
+// it fails with heap.ErrPinned, which TRY handlers receive with code -8.
+// Pins held longer than Options.PinWarnInstructions are logged.
+func (v *VM) Pin(ptr uintptr) error {
+	if err := v.Heap.Pin(ptr); err != nil {
+		return err
+	}
+	if _, ok := v.pinned[ptr]; !ok {
+		if v.pinned == nil {
+			v.pinned = make(map[uintptr]*pinRecord)
+		}
+		v.pinned[ptr] = &pinRecord{since: v.instructions}
+	}
+	return nil
+}
+
+// Unpin undoes a Pin of the heap block at ptr.
+func (v *VM) Unpin(ptr uintptr) error {
+	if err := v.Heap.Unpin(ptr); err != nil {
+		return err
+	}
+	if v.Heap.Pins(ptr) == 0 {
+		delete(v.pinned, ptr)
+	}
+	return nil
+}
+
+// Pinned returns the pinned blocks, pinned the longest first. Blocks
+// still pinned when the program stopped are the pins natives leaked.
+func (v *VM) Pinned() []PinnedObject {
+	objects := make([]PinnedObject, 0, len(v.pinned))
+	for ptr, record := range v.pinned {
+		objects = append(objects, PinnedObject{Address: ptr, Pins: v.Heap.Pins(ptr), Since: record.since})
+	}
+	sort.Slice(objects, func(i, j int) bool {
+		if objects[i].Since != objects[j].Since {
+			return objects[i].Since < objects[j].Since
+		}
+		return objects[i].Address < objects[j].Address
+	})
+	return objects
+}
+
+// checkPins logs a warning, once per pin, for the blocks pinned for more
+// than pinWarnInstructions instructions
+func (v *VM) checkPins() {
+	for ptr, record := range v.pinned {
+		if record.warned || v.instructions-record.since < v.pinWarnInstructions {
+			continue
+		}
+		record.warned = true
+		v.logger.LogAttrs(context.Background(), slog.LevelWarn, "object pinned for a long time", slog.String("vm", v.auditID),
+			slog.Uint64("address", uint64(ptr)), slog.Uint64("instructions", v.instructions-record.since))
+	}
+}
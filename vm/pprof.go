@@ -0,0 +1,245 @@
+package vm
+
+import (
+	"compress/gzip"
+	"errors"
+	"io"
+	"time"
+)
+
+// errNoProfile is returned when writing a profile of a VM created without
+// Options.Profile
+var errNoProfile = errors.New("profiling is not enabled for this VM")
+
+// WriteProfile writes the instruction and time profile collected with
+// Options.Profile as a gzipped pprof protobuf, readable by go tool pprof.
+// Filename names the source file the program was assembled from, it is
+// shown next to the source map lines.
+func (v *VM) WriteProfile(w io.Writer, filename string) error {
+	if v.profile == nil {
+		return errNoProfile
+	}
+	zw := gzip.NewWriter(w)
+	if _, err := zw.Write(v.profile.encode(filename)); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// Field numbers of profile.proto, see
+// https://github.com/google/pprof/blob/main/proto/profile.proto
+const (
+	pbProfileSampleType        = 1
+	pbProfileSample            = 2
+	pbProfileMapping           = 3
+	pbProfileLocation          = 4
+	pbProfileFunction          = 5
+	pbProfileStringTable       = 6
+	pbProfileTimeNanos         = 9
+	pbProfileDurationNanos     = 10
+	pbProfileDefaultSampleType = 14
+
+	pbValueTypeType = 1
+	pbValueTypeUnit = 2
+
+	pbMappingID             = 1
+	pbMappingMemoryLimit    = 3
+	pbMappingFilename       = 5
+	pbMappingHasFunctions   = 7
+	pbMappingHasFilenames   = 8
+	pbMappingHasLineNumbers = 9
+
+	pbSampleLocationID = 1
+	pbSampleValue      = 2
+
+	pbLocationID      = 1
+	pbLocationMapping = 2
+	pbLocationAddress = 3
+	pbLocationLine    = 4
+
+	pbLineFunctionID = 1
+	pbLineLine       = 2
+
+	pbFunctionID         = 1
+	pbFunctionName       = 2
+	pbFunctionSystemName = 3
+	pbFunctionFilename   = 4
+	pbFunctionStartLine  = 5
+)
+
+// pprofEncoder builds a profile message, interning strings and the
+// locations and functions the samples refer to.
+type pprofEncoder struct {
+	p         *profiler
+	out       protoBuffer
+	strings   []string
+	stringIDs map[string]int64
+	locations map[uint]uint64
+	functions map[uint]uint64
+}
+
+func (p *profiler) encode(filename string) []byte {
+	e := &pprofEncoder{
+		p:         p,
+		stringIDs: make(map[string]int64),
+		locations: make(map[uint]uint64),
+		functions: make(map[uint]uint64),
+	}
+	e.str("")
+	e.valueType(pbProfileSampleType, "instructions", "count")
+	e.valueType(pbProfileSampleType, "time", "nanoseconds")
+
+	// a single mapping spanning the code section, all symbols are resolved
+	// so pprof never looks for the binary
+	var mapping protoBuffer
+	mapping.uint64(pbMappingID, 1)
+	mapping.uint64(pbMappingMemoryLimit, uint64(len(p.program.Code)))
+	mapping.int64(pbMappingFilename, e.str(filename))
+	mapping.uint64(pbMappingHasFunctions, 1)
+	mapping.uint64(pbMappingHasFilenames, 1)
+	mapping.uint64(pbMappingHasLineNumbers, 1)
+	e.out.message(pbProfileMapping, &mapping)
+
+	var total int64
+	for _, sample := range p.sortedSamples() {
+		var msg protoBuffer
+		ids := make([]uint64, len(sample.stack))
+		for i, addr := range sample.stack {
+			ids[i] = e.location(addr, filename)
+		}
+		msg.packedUint64(pbSampleLocationID, ids)
+		msg.packedUint64(pbSampleValue, []uint64{uint64(sample.instructions), uint64(sample.nanos)})
+		e.out.message(pbProfileSample, &msg)
+		total += sample.nanos
+	}
+
+	e.out.int64(pbProfileTimeNanos, time.Now().UnixNano())
+	e.out.int64(pbProfileDurationNanos, total)
+	e.out.int64(pbProfileDefaultSampleType, e.str("instructions"))
+	// the string table goes last, once every string has been interned
+	for _, s := range e.strings {
+		e.out.string(pbProfileStringTable, s)
+	}
+	return e.out.data
+}
+
+func (e *pprofEncoder) str(s string) int64 {
+	if id, ok := e.stringIDs[s]; ok {
+		return id
+	}
+	id := int64(len(e.strings))
+	e.strings = append(e.strings, s)
+	e.stringIDs[s] = id
+	return id
+}
+
+func (e *pprofEncoder) valueType(field int, typ, unit string) {
+	var msg protoBuffer
+	msg.int64(pbValueTypeType, e.str(typ))
+	msg.int64(pbValueTypeUnit, e.str(unit))
+	e.out.message(field, &msg)
+}
+
+// location interns the location of the instruction at addr
+func (e *pprofEncoder) location(addr uint, filename string) uint64 {
+	if id, ok := e.locations[addr]; ok {
+		return id
+	}
+	id := uint64(len(e.locations) + 1)
+	e.locations[addr] = id
+
+	var line protoBuffer
+	line.uint64(pbLineFunctionID, e.function(addr, filename))
+	if n, ok := e.p.program.LineFor(addr); ok {
+		line.int64(pbLineLine, int64(n))
+	}
+	var msg protoBuffer
+	msg.uint64(pbLocationID, id)
+	msg.uint64(pbLocationMapping, 1)
+	msg.uint64(pbLocationAddress, uint64(addr))
+	msg.message(pbLocationLine, &line)
+	e.out.message(pbProfileLocation, &msg)
+	return id
+}
+
+// function interns the function containing addr
+func (e *pprofEncoder) function(addr uint, filename string) uint64 {
+	f, ok := e.p.functionAt(addr)
+	name := f.Name
+	if !ok || name == "" {
+		name = "?"
+	}
+	if id, ok := e.functions[f.Address]; ok {
+		return id
+	}
+	id := uint64(len(e.functions) + 1)
+	e.functions[f.Address] = id
+
+	var msg protoBuffer
+	msg.uint64(pbFunctionID, id)
+	msg.int64(pbFunctionName, e.str(name))
+	msg.int64(pbFunctionSystemName, e.str(name))
+	msg.int64(pbFunctionFilename, e.str(filename))
+	if n, ok := e.p.program.LineFor(f.Address); ok {
+		msg.int64(pbFunctionStartLine, int64(n))
+	}
+	e.out.message(pbProfileFunction, &msg)
+	return id
+}
+
+// protoBuffer appends protobuf wire format fields. Zero scalars are
+// skipped, as proto3 does.
+type protoBuffer struct {
+	data []byte
+}
+
+const (
+	wireVarint = 0
+	wireBytes  = 2
+)
+
+func (b *protoBuffer) varint(x uint64) {
+	for x >= 0x80 {
+		b.data = append(b.data, byte(x)|0x80)
+		x >>= 7
+	}
+	b.data = append(b.data, byte(x))
+}
+
+func (b *protoBuffer) key(field, wire int) {
+	b.varint(uint64(field)<<3 | uint64(wire))
+}
+
+func (b *protoBuffer) uint64(field int, x uint64) {
+	if x == 0 {
+		return
+	}
+	b.key(field, wireVarint)
+	b.varint(x)
+}
+
+func (b *protoBuffer) int64(field int, x int64) {
+	b.uint64(field, uint64(x))
+}
+
+func (b *protoBuffer) packedUint64(field int, xs []uint64) {
+	var packed protoBuffer
+	for _, x := range xs {
+		packed.varint(x)
+	}
+	b.message(field, &packed)
+}
+
+func (b *protoBuffer) bytes(field int, data []byte) {
+	b.key(field, wireBytes)
+	b.varint(uint64(len(data)))
+	b.data = append(b.data, data...)
+}
+
+func (b *protoBuffer) string(field int, s string) {
+	b.bytes(field, []byte(s))
+}
+
+func (b *protoBuffer) message(field int, msg *protoBuffer) {
+	b.bytes(field, msg.data)
+}
@@ -0,0 +1,128 @@
+package vm
+
+import (
+	"encoding/binary"
+	"sort"
+	"time"
+
+	"github.com/AndreiAlbert/gvm/bytecode"
+)
+
+// profiler attributes executed instructions and the time they took to the
+// guest call stack they ran in.
+type profiler struct {
+	program *bytecode.Program
+	// functions is the function table sorted by address
+	functions []FunctionSignature
+	samples   map[profileKey]*profileSample
+	// callers encodes the call sites of the current call stack, it is
+	// rebuilt whenever the depth changes
+	callers string
+	depth   int
+	current *profileSample
+	last    time.Time
+}
+
+type profileKey struct {
+	addr    uint
+	callers string
+}
+
+// profileSample is the cost of one instruction address under one call
+// stack. Stack lists the instruction first, then the CALL of every caller.
+type profileSample struct {
+	stack        []uint
+	instructions int64
+	nanos        int64
+}
+
+func newProfiler(program *bytecode.Program, functions []FunctionSignature) *profiler {
+	sorted := append([]FunctionSignature(nil), functions...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Address < sorted[j].Address })
+	return &profiler{
+		program:   program,
+		functions: sorted,
+		samples:   make(map[profileKey]*profileSample),
+		depth:     -1,
+	}
+}
+
+// record charges the time since the previous call to the previous
+// instruction and counts the instruction about to execute.
+func (p *profiler) record(v *VM) {
+	now := time.Now()
+	if p.current != nil {
+		p.current.nanos += now.Sub(p.last).Nanoseconds()
+	}
+	p.last = now
+	if len(v.CallStack) != p.depth {
+		p.depth = len(v.CallStack)
+		p.callers = encodeCallers(v.CallStack)
+	}
+	key := profileKey{addr: v.instructionStart, callers: p.callers}
+	sample := p.samples[key]
+	if sample == nil {
+		sample = &profileSample{stack: decodeCallers(v.instructionStart, p.callers)}
+		p.samples[key] = sample
+	}
+	sample.instructions++
+	p.current = sample
+}
+
+// stop charges the last instruction when the program stops running
+func (p *profiler) stop() {
+	if p.current != nil {
+		p.current.nanos += time.Since(p.last).Nanoseconds()
+		p.current = nil
+	}
+	p.depth = -1
+}
+
+// encodeCallers packs the address of the CALL instruction of every frame
+// but the initial one, innermost first
+func encodeCallers(frames []StackFrame) string {
+	buf := make([]byte, 0, 4*len(frames))
+	for i := len(frames) - 1; i > 0; i-- {
+		// the return address follows the CALL, any byte of the CALL maps
+		// to its line and function
+		buf = binary.BigEndian.AppendUint32(buf, uint32(frames[i].ReturnAddress-1))
+	}
+	return string(buf)
+}
+
+func decodeCallers(addr uint, callers string) []uint {
+	stack := []uint{addr}
+	for i := 0; i+4 <= len(callers); i += 4 {
+		stack = append(stack, uint(binary.BigEndian.Uint32([]byte(callers[i:i+4]))))
+	}
+	return stack
+}
+
+// functionAt returns the function whose body contains addr
+func (p *profiler) functionAt(addr uint) (FunctionSignature, bool) {
+	i := sort.Search(len(p.functions), func(i int) bool {
+		return p.functions[i].Address > addr
+	})
+	if i == 0 {
+		return FunctionSignature{}, false
+	}
+	return p.functions[i-1], true
+}
+
+// sortedSamples returns the samples ordered by stack, so output is stable
+func (p *profiler) sortedSamples() []*profileSample {
+	samples := make([]*profileSample, 0, len(p.samples))
+	for _, sample := range p.samples {
+		samples = append(samples, sample)
+	}
+	sort.Slice(samples, func(i, j int) bool {
+		a, b := samples[i].stack, samples[j].stack
+		for k := 0; k < len(a) && k < len(b); k++ {
+			if a[k] != b[k] {
+				return a[k] < b[k]
+			}
+		}
+		return len(a) < len(b)
+	})
+	return samples
+}
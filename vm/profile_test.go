@@ -0,0 +1,141 @@
+package vm
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"io"
+	"testing"
+
+	"github.com/AndreiAlbert/gvm/bytecode"
+)
+
+func runProfiled(t *testing.T, path string) *VM {
+	t.Helper()
+	program, err := bytecode.Decode(mustReadTestProgram(t, path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	machine, err := NewVmFromProgram(program, Options{Stdout: &bytes.Buffer{}, Profile: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { machine.Close() })
+	if err := machine.Run(); err != nil {
+		t.Fatalf("Failed to run: %v", err)
+	}
+	return machine
+}
+
+func TestProfileSamples(t *testing.T) {
+	machine := runProfiled(t, "testdata/calls.gvmbc")
+	var total int64
+	inWork := int64(0)
+	for _, sample := range machine.profile.samples {
+		total += sample.instructions
+		if f, _ := machine.profile.functionAt(sample.stack[0]); f.Name == "work" {
+			inWork += sample.instructions
+			if len(sample.stack) != 2 {
+				t.Errorf("Expected work samples to have main as caller, got stack %v", sample.stack)
+			}
+			if caller, _ := machine.profile.functionAt(sample.stack[1]); caller.Name != "main" {
+				t.Errorf("Expected caller main, got %q", caller.Name)
+			}
+		}
+	}
+	if uint64(total) != machine.Instructions() {
+		t.Errorf("Expected samples to add up to %d instructions, got %d", machine.Instructions(), total)
+	}
+	// work runs 6 instructions for each of the 3 iterations
+	if inWork != 18 {
+		t.Errorf("Expected 18 instructions in work, got %d", inWork)
+	}
+}
+
+func TestWriteProfile(t *testing.T) {
+	machine := runProfiled(t, "testdata/calls.gvmbc")
+	var out bytes.Buffer
+	if err := machine.WriteProfile(&out, "calls.asm"); err != nil {
+		t.Fatal(err)
+	}
+	zr, err := gzip.NewReader(&out)
+	if err != nil {
+		t.Fatalf("Profile is not gzipped: %v", err)
+	}
+	data, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	strs := profileStrings(t, data)
+	if len(strs) == 0 || strs[0] != "" {
+		t.Fatalf("String table must start with the empty string, got %q", strs)
+	}
+	for _, want := range []string{"main", "work", "calls.asm", "instructions", "nanoseconds"} {
+		found := false
+		for _, s := range strs {
+			found = found || s == want
+		}
+		if !found {
+			t.Errorf("Expected %q in the string table %q", want, strs)
+		}
+	}
+
+	program, err := bytecode.Decode(mustReadTestProgram(t, "testdata/calls.gvmbc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	unprofiled, err := NewVmFromProgram(program, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := unprofiled.WriteProfile(io.Discard, ""); err == nil {
+		t.Error("Expected an error without profiling enabled")
+	}
+}
+
+func mustReadTestProgram(t testing.TB, path string) []byte {
+	t.Helper()
+	data, err := testPrograms.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// profileStrings returns the string table of an encoded profile
+func profileStrings(t *testing.T, data []byte) []string {
+	var strs []string
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		data = data[n:]
+		switch key & 7 {
+		case 0:
+			_, n = binary.Uvarint(data)
+			data = data[n:]
+		case 2:
+			size, n := binary.Uvarint(data)
+			data = data[n:]
+			if key>>3 == 6 {
+				strs = append(strs, string(data[:size]))
+			}
+			data = data[size:]
+		default:
+			t.Fatalf("Unexpected wire type %d", key&7)
+		}
+	}
+	return strs
+}
+
+func TestWriteFoldedStacks(t *testing.T) {
+	machine := runProfiled(t, "testdata/calls.gvmbc")
+	var out bytes.Buffer
+	if err := machine.WriteFoldedStacks(&out, WeightInstructions); err != nil {
+		t.Fatal(err)
+	}
+	// main runs 2 setup instructions, 9 per iteration and 4 to check the
+	// counter and return
+	want := "main 33\nmain;work 18\n"
+	if out.String() != want {
+		t.Errorf("Expected folded stacks %q, got %q", want, out.String())
+	}
+}
@@ -0,0 +1,140 @@
+package vm
+
+import (
+	"maps"
+	"slices"
+	"sort"
+
+	"github.com/AndreiAlbert/gvm/bytecode"
+	. "github.com/AndreiAlbert/gvm/common"
+)
+
+// ProgramInfo is a read-only snapshot of the metadata of the program a VM
+// runs, for debuggers, profilers and other tools. Its methods return
+// copies, so changing what they return changes neither the snapshot nor the
+// VM.
+type ProgramInfo struct {
+	functions  []FunctionSignature
+	structs    map[string]StructType
+	fieldNames []string
+	constants  []uint32
+	lines      []bytecode.LineEntry
+}
+
+// Program returns the metadata of the program as it is now. Loading the
+// error struct and replacing functions change the metadata of the VM, not
+// snapshots taken before. Like the rest of the VM's state, it is read while
+// the program isn't running, such as when it is paused.
+func (v *VM) Program() *ProgramInfo {
+	info := &ProgramInfo{
+		functions:  slices.Clone(v.functionList),
+		structs:    make(map[string]StructType, len(v.structs)),
+		fieldNames: slices.Clone(v.fieldNames),
+		constants:  slices.Clone(v.constants),
+		lines:      slices.Clone(v.lines),
+	}
+	for name, structType := range v.structs {
+		info.structs[name] = cloneStruct(structType)
+	}
+	return info
+}
+
+// Functions returns the signatures of the functions in declaration order,
+// the order CALL operands index.
+func (p *ProgramInfo) Functions() []FunctionSignature {
+	return slices.Clone(p.functions)
+}
+
+// Function returns the signature of the function at index in declaration
+// order.
+func (p *ProgramInfo) Function(index int) (FunctionSignature, bool) {
+	if index < 0 || index >= len(p.functions) {
+		return FunctionSignature{}, false
+	}
+	return p.functions[index], true
+}
+
+// LookupFunction returns the signature of the function called name.
+func (p *ProgramInfo) LookupFunction(name string) (FunctionSignature, bool) {
+	for _, f := range p.functions {
+		if f.Name == name {
+			return f, true
+		}
+	}
+	return FunctionSignature{}, false
+}
+
+// FunctionAt returns the signature of the function whose code holds
+// address, false for addresses before the first function.
+func (p *ProgramInfo) FunctionAt(address uint) (FunctionSignature, bool) {
+	var found FunctionSignature
+	ok := false
+	for _, f := range p.functions {
+		if f.Address <= address && (!ok || f.Address > found.Address) {
+			found, ok = f, true
+		}
+	}
+	return found, ok
+}
+
+// Structs returns the struct types by name, including the built-in Error
+// struct.
+func (p *ProgramInfo) Structs() []StructType {
+	structs := make([]StructType, 0, len(p.structs))
+	for _, structType := range p.structs {
+		structs = append(structs, cloneStruct(structType))
+	}
+	sort.Slice(structs, func(i, j int) bool { return structs[i].Name < structs[j].Name })
+	return structs
+}
+
+// Struct returns the struct type called name.
+func (p *ProgramInfo) Struct(name string) (StructType, bool) {
+	structType, ok := p.structs[name]
+	if !ok {
+		return StructType{}, false
+	}
+	return cloneStruct(structType), true
+}
+
+// FieldName returns the name of the field id FLDGET and STFIELD refer to.
+func (p *ProgramInfo) FieldName(id uint16) (string, bool) {
+	if int(id) >= len(p.fieldNames) {
+		return "", false
+	}
+	return p.fieldNames[id], true
+}
+
+// Constants returns the constant pool of the pooled conditional jumps.
+func (p *ProgramInfo) Constants() []uint32 {
+	return slices.Clone(p.constants)
+}
+
+// Lines returns the source map, sorted by address, empty if the program
+// was stripped.
+func (p *ProgramInfo) Lines() []bytecode.LineEntry {
+	return slices.Clone(p.lines)
+}
+
+// SourceLine returns the source line of the instruction at address, false
+// when the program has no source map.
+func (p *ProgramInfo) SourceLine(address uint) (uint32, bool) {
+	i := sort.Search(len(p.lines), func(i int) bool { return uint(p.lines[i].Address) > address })
+	if i == 0 {
+		return 0, false
+	}
+	return p.lines[i-1].Line, true
+}
+
+// cloneStruct copies structType along with its fields and methods
+func cloneStruct(structType StructType) StructType {
+	structType.Fields = slices.Clone(structType.Fields)
+	for i, field := range structType.Fields {
+		if field.ArrayType != nil {
+			kind := *field.ArrayType
+			structType.Fields[i].ArrayType = &kind
+		}
+	}
+	structType.Methods = maps.Clone(structType.Methods)
+	return structType
+}
@@ -0,0 +1,71 @@
+package vm
+
+import (
+	"testing"
+
+	"github.com/AndreiAlbert/gvm/bytecode"
+	. "github.com/AndreiAlbert/gvm/common"
+)
+
+func TestProgramInfo(t *testing.T) {
+	container, err := bytecode.Decode(mustReadTestProgram(t, "testdata/shapes.gvmbc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	machine, err := NewVmFromProgram(container, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer machine.Close()
+	program := machine.Program()
+
+	functions := program.Functions()
+	if len(functions) != len(container.Functions) {
+		t.Fatalf("Expected %d functions, got %d", len(container.Functions), len(functions))
+	}
+	for i, f := range container.Functions {
+		if functions[i].Name != f.Name || functions[i].Address != uint(f.Address) {
+			t.Errorf("function %d is %s at %d, expected %s at %d", i, functions[i].Name, functions[i].Address, f.Name, f.Address)
+		}
+		if at, ok := program.FunctionAt(uint(f.Address)); !ok || at.Name != f.Name {
+			t.Errorf("FunctionAt(%d) = %s, %v, expected %s", f.Address, at.Name, ok, f.Name)
+		}
+	}
+	functions[0].Name = "changed"
+	if f, _ := program.Function(0); f.Name == "changed" || machine.functionList[0].Name == "changed" {
+		t.Error("changing the returned functions changed the program")
+	}
+	if _, ok := program.LookupFunction("Square.area"); !ok {
+		t.Error("expected to find Square.area")
+	}
+
+	square, ok := program.Struct("Square")
+	if !ok {
+		t.Fatal("expected the Square struct")
+	}
+	square.Fields[0].Name = "changed"
+	square.Methods["changed"] = 0
+	if again, _ := program.Struct("Square"); again.Fields[0].Name == "changed" || len(again.Methods) != 2 {
+		t.Error("changing the returned struct changed the snapshot")
+	}
+	if machine.structs["Square"].Fields[0].Name == "changed" {
+		t.Error("changing the returned struct changed the VM")
+	}
+	if _, ok := program.Struct(ErrorStructName); !ok {
+		t.Error("expected the built-in Error struct")
+	}
+	field := machine.structs["Square"].Fields[0]
+	if name, ok := program.FieldName(field.ID); !ok || name != field.Name {
+		t.Errorf("FieldName(%d) = %q, %v, expected %q", field.ID, name, ok, field.Name)
+	}
+
+	if lines := program.Lines(); len(lines) != len(container.Lines) {
+		t.Errorf("Expected %d source map entries, got %d", len(container.Lines), len(lines))
+	}
+	if len(container.Lines) > 0 {
+		first := container.Lines[0]
+		if line, ok := program.SourceLine(uint(first.Address)); !ok || line != first.Line {
+			t.Errorf("SourceLine(%d) = %d, %v, expected %d", first.Address, line, ok, first.Line)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package vm
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/AndreiAlbert/gvm/bytecode"
+	. "github.com/AndreiAlbert/gvm/common"
+)
+
+// ReplaceFunction patches a new body for the function name into the running
+// program. The patch is a program assembled with the code of the function
+// alone, laid out at the end of the current code, as Assembler.AssembleFunction
+// returns for the base len(v.Bytecode). Its function and struct tables must
+// match the ones the VM runs: only bodies can change, not signatures, the
+// functions declared or the structs.
+//
+// The code is appended and the function table points name at its new body,
+// so calls made from then on run it. Frames already executing the function
+// finish in the old body.
+func (v *VM) ReplaceFunction(name string, patch *bytecode.Program) error {
+	index := -1
+	for i, f := range v.functionList {
+		if f.Name == name {
+			index = i
+		}
+	}
+	if index < 0 {
+		return fmt.Errorf("no function %s in the running program", name)
+	}
+	if err := v.checkPatchTables(patch); err != nil {
+		return fmt.Errorf("cannot replace %s: %w", name, err)
+	}
+	base := uint(len(v.Bytecode))
+	address := uint(patch.Functions[index].Address)
+	if address < base || address > base+uint(len(patch.Code)) {
+		return fmt.Errorf("cannot replace %s: the patch was not assembled for address %d", name, base)
+	}
+	// the code may be a read-only mapping of the container, so the patched
+	// code is always a copy
+	code := make([]byte, 0, len(v.Bytecode)+len(patch.Code))
+	code = append(code, v.Bytecode...)
+	v.Bytecode = append(code, patch.Code...)
+	// the old body keeps its lines for the frames still executing it
+	v.lines = append(slices.Clip(v.lines), patch.Lines...)
+	signature := v.functionList[index]
+	signature.Address = address
+	v.functionList[index] = signature
+	v.functions[address] = signature
+	return nil
+}
+
+// checkPatchTables checks that a patch declares the functions and structs of
+// the running program
+func (v *VM) checkPatchTables(patch *bytecode.Program) error {
+	if len(patch.Constants) > 0 {
+		return fmt.Errorf("the patch uses a constant pool, its conditional jumps must carry their values")
+	}
+	if len(patch.Functions) != len(v.functionList) {
+		return fmt.Errorf("the program declares %d functions, the patch %d", len(v.functionList), len(patch.Functions))
+	}
+	for i, f := range patch.Functions {
+		old := v.functionList[i]
+		if f.Name != old.Name || f.ParamCount != old.ParamCount || f.ReturnType != old.ReturnType ||
+			f.ReturnStructName != old.ReturnStructName || f.IsMain != old.isMain {
+			return fmt.Errorf("the signature of function %d (%s) changed", i, displayName(old))
+		}
+	}
+	// field ids follow the first appearance of the names in the struct
+	// table, the same numbering must come out of the patch
+	fieldIDs := make(map[string]uint16)
+	for _, structType := range patch.Structs {
+		old, ok := v.structs[structType.Name]
+		if !ok || !sameFields(old.Fields, structType.Fields) {
+			return fmt.Errorf("struct %s changed", structType.Name)
+		}
+		for _, field := range structType.Fields {
+			if _, ok := fieldIDs[field.Name]; !ok {
+				fieldIDs[field.Name] = uint16(len(fieldIDs))
+			}
+			if fieldIDs[field.Name] != v.fieldIDs[field.Name] {
+				return fmt.Errorf("the structs are declared in a different order")
+			}
+		}
+	}
+	return nil
+}
+
+func sameFields(a, b []StructField) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Name != b[i].Name || a[i].Type != b[i].Type || (a[i].ArrayType == nil) != (b[i].ArrayType == nil) ||
+			(a[i].ArrayType != nil && *a[i].ArrayType != *b[i].ArrayType) {
+			return false
+		}
+	}
+	return true
+}
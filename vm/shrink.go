@@ -0,0 +1,278 @@
+package vm
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/AndreiAlbert/gvm/bytecode"
+)
+
+// placedInstruction is a decoded instruction and its address
+type placedInstruction struct {
+	decodedInstruction
+	Address uint
+}
+
+// codeSpan is the code of a function: its FUNC header and body, up to the
+// header of the function after it
+type codeSpan struct {
+	Start, End uint
+}
+
+// decodeCode decodes the code section, one instruction after the other
+func decodeCode(code []byte) ([]placedInstruction, error) {
+	var insts []placedInstruction
+	for address := uint(0); address < uint(len(code)); {
+		inst, err := decodeInstruction(code, address)
+		if err != nil {
+			return nil, err
+		}
+		insts = append(insts, placedInstruction{inst, address})
+		address = inst.Next
+	}
+	return insts, nil
+}
+
+// functionSpans returns the span of the code of each function. Code before
+// the first function, such as struct definitions, belongs to none.
+func functionSpans(program *bytecode.Program, insts []placedInstruction) []codeSpan {
+	headers := make(map[uint]uint)
+	for _, inst := range insts {
+		if inst.Opcode == FUNC {
+			headers[inst.Next] = inst.Address
+		}
+	}
+	spans := make([]codeSpan, len(program.Functions))
+	starts := make([]uint, 0, len(program.Functions))
+	for i, f := range program.Functions {
+		start := uint(f.Address)
+		if header, ok := headers[start]; ok {
+			start = header
+		}
+		spans[i].Start = start
+		starts = append(starts, start)
+	}
+	sort.Slice(starts, func(i, j int) bool { return starts[i] < starts[j] })
+	for i := range spans {
+		spans[i].End = uint(len(program.Code))
+		if next := sort.Search(len(starts), func(j int) bool { return starts[j] > spans[i].Start }); next < len(starts) {
+			spans[i].End = starts[next]
+		}
+	}
+	return spans
+}
+
+// CallGraph returns, for each function of program, the functions it refers
+// to by index in the function table: the callees of its CALLs, the
+// functions of its closures and, as the receiver is only known at run time,
+// every method an INVOKEINTERFACE may dispatch to.
+func CallGraph(program *bytecode.Program) ([][]int, error) {
+	insts, err := decodeCode(program.Code)
+	if err != nil {
+		return nil, err
+	}
+	methods := make(map[string][]int)
+	structs := make(map[string]bool)
+	for _, s := range program.Structs {
+		structs[s.Name] = true
+	}
+	for i, f := range program.Functions {
+		if typeName, method, ok := strings.Cut(f.Name, "."); ok && structs[typeName] {
+			methods[method] = append(methods[method], i)
+		}
+	}
+	spans := functionSpans(program, insts)
+	graph := make([][]int, len(program.Functions))
+	for i, span := range spans {
+		seen := make(map[int]bool)
+		refer := func(callee int) {
+			if !seen[callee] {
+				seen[callee] = true
+				graph[i] = append(graph[i], callee)
+			}
+		}
+		for _, inst := range insts {
+			if inst.Address < span.Start || inst.Address >= span.End {
+				continue
+			}
+			switch inst.Opcode {
+			case CALL, MAKECLOSURE:
+				callee := int(inst.Args[0].(uint32))
+				if callee >= len(program.Functions) {
+					return nil, fmt.Errorf("at address %d: function not found at index: %d", inst.Address, callee)
+				}
+				refer(callee)
+			case INVOKEINTERFACE:
+				for _, callee := range methods[inst.Args[0].(string)] {
+					refer(callee)
+				}
+			}
+		}
+		sort.Ints(graph[i])
+	}
+	return graph, nil
+}
+
+// Reachable reports which functions of program can run: main, the functions
+// named by roots and those they refer to, following the call graph.
+func Reachable(program *bytecode.Program, roots ...string) ([]bool, error) {
+	graph, err := CallGraph(program)
+	if err != nil {
+		return nil, err
+	}
+	reachable := make([]bool, len(program.Functions))
+	var pending []int
+	for i, f := range program.Functions {
+		if f.IsMain {
+			pending = append(pending, i)
+		}
+	}
+	for _, root := range roots {
+		found := false
+		for i, f := range program.Functions {
+			if f.Name == root {
+				pending, found = append(pending, i), true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("no function named %s", root)
+		}
+	}
+	for len(pending) > 0 {
+		i := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		if reachable[i] {
+			continue
+		}
+		reachable[i] = true
+		pending = append(pending, graph[i]...)
+	}
+	return reachable, nil
+}
+
+// Shrink returns a copy of program without the functions that can't run,
+// as Reachable finds them for roots, and the constant pool entries only
+// they used. The code after a removed function moves up: jumps, function
+// indexes, the function table, the source map, the labels and the enum
+// constants are updated to match. Operands keep their size, a WIDE prefix
+// stays where it is no longer needed.
+func Shrink(program *bytecode.Program, roots ...string) (*bytecode.Program, error) {
+	reachable, err := Reachable(program, roots...)
+	if err != nil {
+		return nil, err
+	}
+	insts, err := decodeCode(program.Code)
+	if err != nil {
+		return nil, err
+	}
+	spans := functionSpans(program, insts)
+	var removed []codeSpan
+	index := make([]int, len(program.Functions))
+	shrunk := &bytecode.Program{Version: program.Version, Structs: program.Structs, BuildInfo: program.BuildInfo, Natives: program.Natives}
+	for i, f := range program.Functions {
+		if !reachable[i] {
+			index[i] = -1
+			removed = append(removed, spans[i])
+			continue
+		}
+		index[i] = len(shrunk.Functions)
+		shrunk.Functions = append(shrunk.Functions, f)
+	}
+	sort.Slice(removed, func(i, j int) bool { return removed[i].Start < removed[j].Start })
+	// relocate returns where the code at address moves, ok is false for
+	// code that is removed
+	relocate := func(address uint) (uint, bool) {
+		shift := uint(0)
+		for _, span := range removed {
+			if address >= span.End {
+				shift += span.End - span.Start
+			} else if address >= span.Start {
+				return 0, false
+			}
+		}
+		return address - shift, true
+	}
+
+	shrunk.Code = make([]byte, 0, len(program.Code))
+	constants := make(map[uint32]uint32)
+	for _, inst := range insts {
+		at, ok := relocate(inst.Address)
+		if !ok {
+			continue
+		}
+		encoded := append([]byte(nil), program.Code[inst.Address:inst.Next]...)
+		info, _ := LookupOpcode(inst.Opcode)
+		offset := 1
+		if inst.Wide {
+			offset = 2
+		}
+		for j, operand := range info.Operands {
+			var value uint32
+			switch {
+			case operand == addressOperand:
+				target, ok := relocate(uint(inst.Args[j].(uint32)))
+				if !ok {
+					return nil, fmt.Errorf("at address %d: %v jumps into a removed function", inst.Address, inst.Opcode)
+				}
+				value = uint32(target)
+			case operand.Name == "function" && (inst.Opcode == CALL || inst.Opcode == MAKECLOSURE):
+				value = uint32(index[inst.Args[j].(uint32)])
+			case operand == constantOperand:
+				old := inst.Args[j].(uint32)
+				if int(old) >= len(program.Constants) {
+					return nil, fmt.Errorf("at address %d: constant %d is not in the pool", inst.Address, old)
+				}
+				pooled, ok := constants[old]
+				if !ok {
+					pooled = uint32(len(shrunk.Constants))
+					constants[old] = pooled
+					shrunk.Constants = append(shrunk.Constants, program.Constants[old])
+				}
+				encoded[offset] = byte(pooled)
+				offset += operand.Type.Size(inst.Wide)
+				continue
+			default:
+				offset += operand.Type.Size(inst.Wide)
+				continue
+			}
+			if inst.Wide {
+				binary.BigEndian.PutUint32(encoded[offset:], value)
+			} else {
+				binary.BigEndian.PutUint16(encoded[offset:], uint16(value))
+			}
+			offset += operand.Type.Size(inst.Wide)
+		}
+		if uint(len(shrunk.Code)) != at {
+			return nil, fmt.Errorf("at address %d: relocated to %d, expected %d", inst.Address, len(shrunk.Code), at)
+		}
+		shrunk.Code = append(shrunk.Code, encoded...)
+	}
+
+	for i := range shrunk.Functions {
+		at, _ := relocate(uint(shrunk.Functions[i].Address))
+		shrunk.Functions[i].Address = uint32(at)
+	}
+	for _, line := range program.Lines {
+		if at, ok := relocate(uint(line.Address)); ok {
+			shrunk.Lines = append(shrunk.Lines, bytecode.LineEntry{Address: uint32(at), Line: line.Line})
+		}
+	}
+	for _, label := range program.Labels {
+		if at, ok := relocate(uint(label.Address)); ok {
+			shrunk.Labels = append(shrunk.Labels, bytecode.Label{Address: uint32(at), Name: label.Name})
+		}
+	}
+	shrunk.Enums = make([]bytecode.Enum, len(program.Enums))
+	for i, enum := range program.Enums {
+		shrunk.Enums[i] = enum
+		shrunk.Enums[i].Constants = nil
+		for _, address := range enum.Constants {
+			if at, ok := relocate(uint(address)); ok {
+				shrunk.Enums[i].Constants = append(shrunk.Enums[i].Constants, uint32(at))
+			}
+		}
+	}
+	return shrunk, nil
+}
@@ -0,0 +1,92 @@
+package vm
+
+import (
+	"bytes"
+	"slices"
+	"testing"
+
+	"github.com/AndreiAlbert/gvm/bytecode"
+)
+
+func functionNames(program *bytecode.Program) []string {
+	var names []string
+	for _, f := range program.Functions {
+		names = append(names, f.Name)
+	}
+	return names
+}
+
+func runOutput(t *testing.T, program *bytecode.Program) string {
+	t.Helper()
+	var out bytes.Buffer
+	machine, err := NewVmFromProgram(program, Options{Stdout: &out})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer machine.Close()
+	if err := machine.Run(); err != nil {
+		t.Fatal(err)
+	}
+	return out.String()
+}
+
+func TestShrink(t *testing.T) {
+	program, err := bytecode.Decode(mustReadTestProgram(t, "testdata/shrink.gvmbc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	graph, err := CallGraph(program)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// unusedCaller calls unused, main reaches both area methods through
+	// INVOKEINTERFACE and add through its closure
+	if !slices.Equal(graph[1], []int{0}) {
+		t.Errorf("Expected unusedCaller to call unused, got %v", graph[1])
+	}
+	if main := graph[len(graph)-1]; !slices.Equal(main, []int{2, 4, 5, 6, 7}) {
+		t.Errorf("Expected main to refer to Square.area, Rect.area, digit, countdown and add, got %v", main)
+	}
+
+	shrunk, err := Shrink(program)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"Square.area", "Rect.area", "digit", "countdown", "add", "main"}
+	if names := functionNames(shrunk); !slices.Equal(names, want) {
+		t.Errorf("Expected functions %v, got %v", want, names)
+	}
+	if !slices.Equal(shrunk.Constants, []uint32{0}) {
+		t.Errorf("Expected the pool to keep 0 only, got %v", shrunk.Constants)
+	}
+	if len(shrunk.Code) >= len(program.Code) {
+		t.Errorf("Expected less code than %d bytes, got %d", len(program.Code), len(shrunk.Code))
+	}
+	for _, line := range shrunk.Lines {
+		if line.Address >= uint32(len(shrunk.Code)) {
+			t.Errorf("Source map entry %+v is outside of the code", line)
+		}
+	}
+	data, err := bytecode.EncodeBytes(shrunk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := bytecode.Decode(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := runOutput(t, decoded), runOutput(t, program); got != want {
+		t.Errorf("Expected the shrunk program to print %q, got %q", want, got)
+	}
+
+	kept, err := Shrink(program, "unusedCaller")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := functionNames(kept); !slices.Contains(names, "unused") || slices.Contains(names, "Square.perimeter") {
+		t.Errorf("Expected unusedCaller to keep unused only, got %v", names)
+	}
+	if _, err := Shrink(program, "missing"); err == nil {
+		t.Error("Expected an error for an unknown root")
+	}
+}
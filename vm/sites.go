@@ -0,0 +1,14 @@
+package vm
+
+import "github.com/AndreiAlbert/gvm/heap"
+
+// allocationSite is the heap.Heap.CurrentSite of VMs tracking allocation
+// sites: the instruction executing, which allocates or frees
+func (v *VM) allocationSite() heap.Site {
+	site := heap.Site{Address: v.instructionStart, Function: "main"}
+	if len(v.CallStack) > 0 {
+		site.Function = v.frameFunctionName(len(v.CallStack) - 1)
+	}
+	site.Line, _ = v.sourceLine(v.instructionStart)
+	return site
+}
@@ -0,0 +1,55 @@
+package vm
+
+import (
+	"fmt"
+	"math"
+
+	. "github.com/AndreiAlbert/gvm/common"
+	"github.com/AndreiAlbert/gvm/heap"
+)
+
+// setSoftLimitHandler registers the closure ON_SOFT_LIMIT popped, the null
+// pointer removes the handler
+func (v *VM) setSoftLimitHandler(closure Value) {
+	if closure.Kind() == ValuePtr && closure.Ptr() == 0 {
+		v.softLimitHandler = Value{}
+		return
+	}
+	index, captured, err := v.closureOf(closure)
+	if err != nil {
+		v.fail(err)
+	}
+	if f := v.functionList[index]; int(f.ParamCount)-len(captured) != 1 || f.ReturnType != ValueVoid {
+		v.fail(fmt.Errorf("%w: the soft limit handler %s must take one int32 and return nothing", heap.ErrTypeMismatch, displayName(f)))
+	}
+	v.softLimitHandler = closure
+}
+
+// checkSoftLimit runs the hooks of the soft limit once the program reached
+// it: Options.OnSoftLimit, then the guest's handler, with the instructions
+// left before the hard limit
+func (v *VM) checkSoftLimit() {
+	if v.softInstructions == 0 || v.softLimitReached || v.instructions < v.softInstructions {
+		return
+	}
+	v.softLimitReached = true
+	if v.onSoftLimit != nil {
+		v.onSoftLimit(v)
+	}
+	if v.softLimitHandler == (Value{}) {
+		return
+	}
+	remaining := int32(math.MaxInt32)
+	if v.maxInstructions > 0 {
+		remaining = int32(min(v.maxInstructions-min(v.instructions, v.maxInstructions), math.MaxInt32))
+	}
+	if _, err := v.CallClosure(v.softLimitHandler, Int32Value(remaining)); err != nil {
+		v.fail(fmt.Errorf("soft limit handler: %w", err))
+	}
+}
+
+// SoftLimitReached reports whether the program ran past
+// Options.SoftInstructions.
+func (v *VM) SoftLimitReached() bool {
+	return v.softLimitReached
+}
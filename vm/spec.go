@@ -0,0 +1,205 @@
+package vm
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"strings"
+	"text/tabwriter"
+)
+
+// Syntax returns how the instruction is written: its mnemonic, or its name
+// for opcodes the assembler emits on its own, followed by the operands.
+func (info OpcodeInfo) Syntax() string {
+	words := []string{info.Mnemonic}
+	if info.Mnemonic == "" {
+		words[0] = info.Name
+	}
+	for _, operand := range info.Operands {
+		words = append(words, operand.Name)
+	}
+	return strings.Join(words, " ")
+}
+
+// StackEffect returns the stack effect as "a, b → a+b".
+func (info OpcodeInfo) StackEffect() string {
+	if len(info.Pops) == 0 && len(info.Pushes) == 0 {
+		return "no change"
+	}
+	return strings.TrimSpace(strings.Join(info.Pops, ", ") + " → " + strings.Join(info.Pushes, ", "))
+}
+
+// Encoding returns a diagram of the bytes of the instruction, with its
+// index operand widened when wide is set.
+func (info OpcodeInfo) Encoding(wide bool) string {
+	type cell struct {
+		label string
+		bytes int
+	}
+	var cells []cell
+	if wide {
+		cells = append(cells, cell{fmt.Sprintf("0x%02x", byte(WIDE)), 1})
+	}
+	cells = append(cells, cell{fmt.Sprintf("0x%02x", byte(info.Opcode)), 1})
+	for _, operand := range info.Operands {
+		size := operand.Type.Size(wide)
+		typeName := operand.Type.String()
+		if operand.Type == OperandIndex {
+			typeName = "u16"
+			if wide {
+				typeName = "u32"
+			}
+		}
+		label := operand.Name + ":" + typeName
+		if size == 0 {
+			// variable length, drawn as two bytes
+			label += "..."
+			size = 2
+		}
+		cells = append(cells, cell{label, size})
+	}
+	var border, middle strings.Builder
+	border.WriteByte('+')
+	middle.WriteByte('|')
+	for _, c := range cells {
+		width := max(c.bytes*7-1, len(c.label)+2)
+		border.WriteString(strings.Repeat("-", width) + "+")
+		pad := width - len(c.label)
+		middle.WriteString(strings.Repeat(" ", pad/2) + c.label + strings.Repeat(" ", pad-pad/2) + "|")
+	}
+	return border.String() + "\n" + middle.String() + "\n" + border.String()
+}
+
+// WriteHelp writes the description of the instruction as shown by gvm help.
+func (info OpcodeInfo) WriteHelp(w io.Writer) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s (opcode 0x%02x)\n\n", info.Syntax(), byte(info.Opcode))
+	fmt.Fprintf(&b, "  %s\n\n", info.Summary)
+	if info.Deprecated != "" {
+		fmt.Fprintf(&b, "  Deprecated: %s\n\n", info.Deprecated)
+	}
+	fmt.Fprintf(&b, "  Stack:    %s\n", info.StackEffect())
+	if info.Mnemonic == "" {
+		fmt.Fprintf(&b, "  Emitted by the assembler, there is no mnemonic for it.\n")
+	}
+	b.WriteString("  Encoding:\n")
+	writeIndented(&b, info.Encoding(false), "    ")
+	if info.Wide {
+		b.WriteString("  With WIDE:\n")
+		writeIndented(&b, info.Encoding(true), "    ")
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func writeIndented(b *strings.Builder, text, indent string) {
+	for _, line := range strings.Split(text, "\n") {
+		b.WriteString(indent + line + "\n")
+	}
+}
+
+// WriteHelpIndex writes the list of instructions shown by gvm help without
+// a mnemonic.
+func WriteHelpIndex(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	for _, info := range opcodeTable {
+		if info.Mnemonic != "" {
+			summary, _, _ := strings.Cut(info.Summary, ". ")
+			fmt.Fprintf(tw, "  %s\t%s\n", info.Mnemonic, strings.TrimSuffix(summary, "."))
+		}
+	}
+	return tw.Flush()
+}
+
+// Spec formats accepted by WriteSpec
+const (
+	SpecMarkdown = "markdown"
+	SpecHTML     = "html"
+)
+
+// WriteSpec writes the instruction set reference generated from the opcode
+// table, in the SpecMarkdown or SpecHTML format.
+func WriteSpec(w io.Writer, format string) error {
+	switch format {
+	case SpecMarkdown:
+		return writeMarkdownSpec(w)
+	case SpecHTML:
+		return specTemplate.Execute(w, struct {
+			Intro   string
+			Opcodes []OpcodeInfo
+		}{specIntro, opcodeTable[:]})
+	default:
+		return fmt.Errorf("unknown spec format %q, expected %s or %s", format, SpecMarkdown, SpecHTML)
+	}
+}
+
+const specIntro = "Generated from the opcode table of the VM by `gvm spec`. " +
+	"Stack effects list the values from the bottom of the stack to the top, so in `a, b → a-b` b is on top. " +
+	"Operands are big-endian. The WIDE prefix makes the index or address operand of the instructions that accept it 4 bytes."
+
+func writeMarkdownSpec(w io.Writer) error {
+	var b strings.Builder
+	b.WriteString("# GVM Instruction Set\n\n" + specIntro + "\n\n")
+	b.WriteString("| Opcode | Instruction | Stack |\n|---|---|---|\n")
+	for _, info := range opcodeTable {
+		fmt.Fprintf(&b, "| 0x%02x | [`%s`](#%s) | `%s` |\n", byte(info.Opcode), info.Syntax(), strings.ToLower(info.Name), info.StackEffect())
+	}
+	for _, info := range opcodeTable {
+		fmt.Fprintf(&b, "\n## %s\n\n`%s`\n\n%s\n\nStack: `%s`\n\n", info.Name, info.Syntax(), info.Summary, info.StackEffect())
+		if info.Mnemonic == "" {
+			b.WriteString("Emitted by the assembler, there is no mnemonic for it.\n\n")
+		}
+		b.WriteString("```\n" + info.Encoding(false) + "\n```\n")
+		if info.Wide {
+			b.WriteString("\nWith WIDE:\n\n```\n" + info.Encoding(true) + "\n```\n")
+		}
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// prose escapes text for HTML, setting the parts quoted in backticks as
+// code
+func prose(text string) template.HTML {
+	parts := strings.Split(template.HTMLEscapeString(text), "`")
+	for i := 1; i < len(parts); i += 2 {
+		parts[i] = "<code>" + parts[i] + "</code>"
+	}
+	return template.HTML(strings.Join(parts, ""))
+}
+
+var specFuncs = template.FuncMap{
+	"prose": prose,
+	"hex":   func(op Opcode) string { return fmt.Sprintf("0x%02x", byte(op)) },
+}
+
+var specTemplate = template.Must(template.New("spec").Funcs(specFuncs).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>GVM Instruction Set</title>
+<style>
+body { font-family: sans-serif; max-width: 50em; margin: auto; }
+table { border-collapse: collapse; }
+td, th { border: 1px solid #ccc; padding: 0.2em 0.5em; text-align: left; }
+</style>
+</head>
+<body>
+<h1>GVM Instruction Set</h1>
+<p>{{prose .Intro}}</p>
+<table>
+<tr><th>Opcode</th><th>Instruction</th><th>Stack</th></tr>
+{{range .Opcodes}}<tr><td>{{hex .Opcode}}</td><td><a href="#{{.Name}}"><code>{{.Syntax}}</code></a></td><td><code>{{.StackEffect}}</code></td></tr>
+{{end}}</table>
+{{range .Opcodes}}
+<h2 id="{{.Name}}">{{.Name}}</h2>
+<p><code>{{.Syntax}}</code></p>
+<p>{{prose .Summary}}</p>
+<p>Stack: <code>{{.StackEffect}}</code></p>
+{{if not .Mnemonic}}<p>Emitted by the assembler, there is no mnemonic for it.</p>
+{{end}}<pre>{{.Encoding false}}</pre>
+{{if .Wide}}<p>With WIDE:</p>
+<pre>{{.Encoding true}}</pre>
+{{end}}{{end}}</body>
+</html>
+`))
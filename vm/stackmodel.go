@@ -0,0 +1,309 @@
+package vm
+
+import (
+	"fmt"
+
+	. "github.com/AndreiAlbert/gvm/common"
+)
+
+// anyKind stands for a value of any kind in the stack model
+const anyKind ValueKind = 0xff
+
+func kinds(k ...ValueKind) []ValueKind { return k }
+
+// stackKinds are the kinds of the values each instruction pops and pushes,
+// in the order of Pops and Pushes of its opcode table entry. Instructions
+// missing here pop and push values of any kind.
+var stackKinds = map[Opcode]struct{ pops, pushes []ValueKind }{
+	IADD:       {kinds(ValueInt32, ValueInt32), kinds(ValueInt32)},
+	ISUB:       {kinds(ValueInt32, ValueInt32), kinds(ValueInt32)},
+	IMUL:       {kinds(ValueInt32, ValueInt32), kinds(ValueInt32)},
+	IDIV:       {kinds(ValueInt32, ValueInt32), kinds(ValueInt32)},
+	FADD:       {kinds(ValueFloat32, ValueFloat32), kinds(ValueFloat32)},
+	FSUB:       {kinds(ValueFloat32, ValueFloat32), kinds(ValueFloat32)},
+	FMUL:       {kinds(ValueFloat32, ValueFloat32), kinds(ValueFloat32)},
+	FDIV:       {kinds(ValueFloat32, ValueFloat32), kinds(ValueFloat32)},
+	IJE:        {kinds(ValueInt32), nil},
+	IJNE:       {kinds(ValueInt32), nil},
+	FJE:        {kinds(ValueFloat32), nil},
+	FJNE:       {kinds(ValueFloat32), nil},
+	IJEC:       {kinds(ValueInt32), nil},
+	IJNEC:      {kinds(ValueInt32), nil},
+	FJEC:       {kinds(ValueFloat32), nil},
+	FJNEC:      {kinds(ValueFloat32), nil},
+	EQ:         {kinds(anyKind, anyKind), kinds(ValueInt32)},
+	NE:         {kinds(anyKind, anyKind), kinds(ValueInt32)},
+	LT:         {kinds(anyKind, anyKind), kinds(ValueInt32)},
+	GT:         {kinds(anyKind, anyKind), kinds(ValueInt32)},
+	GE:         {kinds(anyKind, anyKind), kinds(ValueInt32)},
+	LE:         {kinds(anyKind, anyKind), kinds(ValueInt32)},
+	ALLOC:      {kinds(ValueInt32), kinds(ValuePtr)},
+	FREE:       {kinds(ValuePtr), nil},
+	LOADH:      {kinds(ValuePtr), kinds(anyKind)},
+	STOREH:     {kinds(ValuePtr, anyKind), nil},
+	STRALLOC:   {nil, kinds(ValuePtr)},
+	NEWARR:     {kinds(ValueInt32), kinds(ValuePtr)},
+	LDELEM:     {kinds(ValuePtr, ValueInt32), kinds(anyKind)},
+	SLICE:      {kinds(ValuePtr, ValueInt32, ValueInt32), kinds(ValuePtr)},
+	ARR_CLONE:  {kinds(ValuePtr), kinds(ValuePtr)},
+	STELEM:     {kinds(ValuePtr, ValueInt32, anyKind), nil},
+	NEWSTRUCT:  {nil, kinds(ValuePtr)},
+	FLDGET:     {kinds(ValuePtr), kinds(anyKind)},
+	STFIELD:    {kinds(ValuePtr, anyKind), nil},
+	THROW:      {kinds(ValuePtr), nil},
+	CHECKCAST:  {kinds(ValuePtr), kinds(ValuePtr)},
+	INSTANCEOF: {kinds(ValuePtr), kinds(ValueInt32)},
+}
+
+// StackSlot is an entry of a modelled operand stack. Values the
+// instruction leaves in place or copies are known, the ones it computes
+// only by kind and by their name in the stack effect.
+type StackSlot struct {
+	Value Value
+	Known bool
+	// Kind is the kind of a computed value, AnyKind reports that the
+	// model can't tell
+	Kind    ValueKind
+	AnyKind bool
+	Name    string
+}
+
+func knownSlot(value Value) StackSlot {
+	return StackSlot{Value: value, Known: true, Kind: value.Kind()}
+}
+
+func (s StackSlot) String() string {
+	switch {
+	case s.Known:
+		return fmt.Sprintf("%v:%v", s.Value.Kind(), s.Value)
+	case s.AnyKind:
+		return "?:" + s.Name
+	default:
+		return fmt.Sprintf("%v:%s", s.Kind, s.Name)
+	}
+}
+
+// stackEffect is the modelled effect of an instruction on the operand
+// stack of the current frame
+type stackEffect struct {
+	pops   []ValueKind
+	pushes []StackSlot
+	// problem is why the instruction will fail, if the model can tell
+	problem string
+	// operation and popNames name the instruction and the values it pops
+	// in problems when they aren't those of its opcode table entry, as
+	// for system calls
+	operation string
+	popNames  []string
+}
+
+// modelStack returns the effect of the decoded instruction on stack, the
+// operand stack of the current frame, as a verifier would track it: by
+// count and kind, with the values that are only moved or copied known.
+func (v *VM) modelStack(inst decodedInstruction, stack []Value) stackEffect {
+	info, _ := LookupOpcode(inst.Opcode)
+	effect := stackEffect{operation: inst.Opcode.String(), popNames: info.Pops}
+	if k, ok := stackKinds[inst.Opcode]; ok {
+		effect.pops = k.pops
+		for i, name := range info.Pushes {
+			effect.pushes = append(effect.pushes, computedSlot(k.pushes[i], name))
+		}
+	} else {
+		for range info.Pops {
+			effect.pops = append(effect.pops, anyKind)
+		}
+		for _, name := range info.Pushes {
+			effect.pushes = append(effect.pushes, computedSlot(anyKind, name))
+		}
+	}
+	switch inst.Opcode {
+	case PUSH:
+		effect.pushes = []StackSlot{knownSlot(inst.Args[0].(Value))}
+	case DUP:
+		if len(stack) > 0 {
+			top := knownSlot(stack[len(stack)-1])
+			effect.pushes = []StackSlot{top, top}
+		}
+	case LOAD:
+		index := inst.Args[0].(uint32)
+		value, ok := v.getCurrentFrame().Locals[index]
+		if !ok {
+			effect.problem = fmt.Sprintf("local %d is not set", index)
+			effect.pushes = nil
+		} else {
+			effect.pushes = []StackSlot{knownSlot(value)}
+		}
+	case CALL:
+		index := inst.Args[0].(uint32)
+		if int(index) >= len(v.functionList) {
+			effect.problem = fmt.Sprintf("there is no function %d", index)
+			return effect
+		}
+		callee := v.functionList[index]
+		effect.pops = anyKinds(int(callee.ParamCount))
+		effect.pushes = resultSlots(callee.ReturnType)
+	case INVOKEINTERFACE:
+		effect.pops = anyKinds(int(inst.Args[1].(uint32)) + 1)
+		effect.pops[0] = ValuePtr
+		effect.pushes = resultSlots(inst.Args[2].(ValueKind))
+	case MAKECLOSURE:
+		index := inst.Args[0].(uint32)
+		if int(index) >= len(v.functionList) {
+			effect.problem = fmt.Sprintf("there is no function %d", index)
+			return effect
+		}
+		effect.pops = anyKinds(int(inst.Args[1].(uint32)))
+		effect.pushes = []StackSlot{computedSlot(ValuePtr, "closure")}
+	case CALLCLOSURE:
+		if len(stack) == 0 {
+			break
+		}
+		index, captured, err := v.closureOf(stack[len(stack)-1])
+		if err != nil {
+			effect.problem = err.Error()
+			return effect
+		}
+		callee := v.functionList[index]
+		// the arguments, then the closure
+		effect.pops = anyKinds(int(callee.ParamCount) - len(captured) + 1)
+		effect.pushes = resultSlots(callee.ReturnType)
+	case SYSCALL:
+		number := inst.Args[0].(uint32)
+		signature, ok := syscallSignatures[Systemcall(number)]
+		if number > 0xff || !ok {
+			effect.problem = fmt.Sprintf("there is no system call %d", number)
+			return effect
+		}
+		effect.operation = Systemcall(number).String()
+		effect.pops, effect.popNames = nil, nil
+		for _, slot := range signature.Pops {
+			effect.pops = append(effect.pops, slot.kind())
+			effect.popNames = append(effect.popNames, slot.Name)
+		}
+		effect.pushes = append([]StackSlot(nil), signature.Pushes...)
+	case CALLNATIVE:
+		index := inst.Args[0].(uint32)
+		if int(index) >= len(v.natives) {
+			effect.problem = fmt.Sprintf("there is no native %d", index)
+			return effect
+		}
+		native := v.natives[index]
+		// strings are pointers on the stack
+		effect.pops = nil
+		for _, kind := range native.Params {
+			effect.pops = append(effect.pops, stackKind(kind))
+		}
+		effect.pushes = resultSlots(stackKind(native.ReturnType))
+		if native.Async {
+			effect.pushes = []StackSlot{computedSlot(ValueInt32, "handle")}
+		}
+	case AWAIT:
+		effect.pops = kinds(ValueInt32)
+		if len(stack) == 0 || stack[len(stack)-1].Kind() != ValueInt32 {
+			break
+		}
+		if call, ok := v.pending[stack[len(stack)-1].AsInt32()]; ok {
+			effect.pushes = resultSlots(stackKind(call.native.ReturnType))
+		} else {
+			effect.problem = fmt.Sprintf("there is no pending native call %d", stack[len(stack)-1].AsInt32())
+		}
+	case IJEC, IJNEC, FJEC, FJNEC:
+		if index := inst.Args[1].(uint32); int(index) >= len(v.constants) {
+			effect.problem = fmt.Sprintf("constant %d outside of the constant pool of %d entries", index, len(v.constants))
+		}
+	case FORITER:
+		effect.pops = kinds(anyKind, ValueInt32)
+		effect.pushes = nil
+		if len(stack) < 2 {
+			break
+		}
+		iterable := stack[len(stack)-2]
+		element, next, ok, err := v.nextElement(iterable, stack[len(stack)-1])
+		if err != nil {
+			effect.problem = err.Error()
+		} else if ok {
+			effect.pushes = []StackSlot{knownSlot(iterable), knownSlot(Int32Value(next)), knownSlot(element)}
+		}
+	case CHECKCAST:
+		if len(stack) > 0 {
+			top := stack[len(stack)-1]
+			effect.pushes = []StackSlot{knownSlot(top)}
+			if err := v.checkType(top, inst.Args[0].(typeRef)); err != nil {
+				effect.problem = err.Error()
+			}
+		}
+	case IDIV, FDIV:
+		// b, the divisor, is on top. MinInt32 / -1 wraps and isn't a
+		// problem.
+		if len(stack) >= 2 && isZero(stack[len(stack)-1]) && (inst.Opcode == IDIV || v.trapFloatDivision) {
+			effect.problem = "division by zero"
+		}
+	}
+	if len(stack) < len(effect.pops) {
+		effect.problem = fmt.Sprintf("stack underflow: %s needs %d values, the stack holds %d", effect.operation, len(effect.pops), len(stack))
+		return effect
+	}
+	if effect.problem == "" {
+		operands := stack[len(stack)-len(effect.pops):]
+		for i, kind := range effect.pops {
+			if kind != anyKind && operands[i].Kind() != kind {
+				effect.problem = fmt.Sprintf("%s needs %s to be %v, got %v", effect.operation, effect.popNames[i], kind, operands[i].Kind())
+				break
+			}
+		}
+	}
+	// a verifier rejects code outgrowing the frame size of the assembler
+	if f := v.frameFunction(len(v.CallStack) - 1); effect.problem == "" && f != nil && f.MaxStack > 0 {
+		if depth := len(stack) - len(effect.pops) + len(effect.pushes); depth > int(f.MaxStack) {
+			effect.problem = fmt.Sprintf("stack of %d values exceeds the max stack %d of %s", depth, f.MaxStack, v.frameFunctionName(len(v.CallStack)-1))
+		}
+	}
+	return effect
+}
+
+// anyKinds returns n values of any kind
+func anyKinds(n int) []ValueKind {
+	k := make([]ValueKind, n)
+	for i := range k {
+		k[i] = anyKind
+	}
+	return k
+}
+
+// resultSlots returns what a call of a function returning returnType
+// pushes
+func resultSlots(returnType ValueKind) []StackSlot {
+	switch returnType {
+	case ValueVoid:
+		return nil
+	case ValueStruct:
+		return []StackSlot{computedSlot(ValuePtr, "result")}
+	default:
+		return []StackSlot{computedSlot(returnType, "result")}
+	}
+}
+
+func computedSlot(kind ValueKind, name string) StackSlot {
+	if kind == anyKind {
+		return StackSlot{AnyKind: true, Name: name}
+	}
+	return StackSlot{Kind: kind, Name: name}
+}
+
+// kind returns the kind of a computed slot, anyKind if it can be any
+func (s StackSlot) kind() ValueKind {
+	if s.AnyKind {
+		return anyKind
+	}
+	return s.Kind
+}
+
+func isZero(value Value) bool {
+	switch value.Kind() {
+	case ValueInt32:
+		return value.AsInt32() == 0
+	case ValueFloat32:
+		return value.AsFloat32() == 0
+	}
+	return false
+}
@@ -1,11 +1,19 @@
 package vm
 
 import (
-	"log"
-	"os"
-	"stack_vm/common"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"github.com/AndreiAlbert/gvm/common"
+	"io"
+	"log/slog"
+	"math"
+	"runtime"
+	"sort"
+	"strings"
 )
 
+// Systemcall numbers the host services available through SYSCALL.
 type Systemcall byte
 
 const (
@@ -14,31 +22,239 @@ const (
 	STR_EQUALS
 	WRITE_BYTE
 	READ_BYTE
+	BACKTRACE
+	ERR_NEW
+	ERR_WRAP
+	SUBSTR_VIEW
+	STR_SET_BYTE
+	PRINT_FLOAT
+	GC_HINT
+	GET_ENV
+	COUNTER_INC
+	PRINT_ANY
+	LOG_DEBUG
+	LOG_INFO
+	LOG_WARN
+	LOG_ERROR
+	ASSERT_EQ
+	ASSERT_NEAR
+	BUILD_INFO
+	BUF_GET_I32
+	BUF_GET_F32
+	BUF_PUT_I32
+	BUF_PUT_F32
+	MMAP_FILE
+	ON_SOFT_LIMIT
+	YIELD_HOST
+	ARGV
+	OPT_PARSE
+	CSV_PARSE
+	CSV_WRITE
+	TIME_NOW_STRUCT
+	TIME_FORMAT
+	TIME_PARSE
 )
 
+// String returns the system call name.
+func (call Systemcall) String() string {
+	switch call {
+	case STR_LEN:
+		return "STR_LEN"
+	case STR_CAT:
+		return "STR_CAT"
+	case STR_EQUALS:
+		return "STR_EQUALS"
+	case WRITE_BYTE:
+		return "WRITE_BYTE"
+	case READ_BYTE:
+		return "READ_BYTE"
+	case BACKTRACE:
+		return "BACKTRACE"
+	case ERR_NEW:
+		return "ERR_NEW"
+	case ERR_WRAP:
+		return "ERR_WRAP"
+	case SUBSTR_VIEW:
+		return "SUBSTR_VIEW"
+	case STR_SET_BYTE:
+		return "STR_SET_BYTE"
+	case PRINT_FLOAT:
+		return "PRINT_FLOAT"
+	case GC_HINT:
+		return "GC_HINT"
+	case GET_ENV:
+		return "GET_ENV"
+	case COUNTER_INC:
+		return "COUNTER_INC"
+	case PRINT_ANY:
+		return "PRINT_ANY"
+	case LOG_DEBUG:
+		return "LOG_DEBUG"
+	case LOG_INFO:
+		return "LOG_INFO"
+	case LOG_WARN:
+		return "LOG_WARN"
+	case LOG_ERROR:
+		return "LOG_ERROR"
+	case ASSERT_EQ:
+		return "ASSERT_EQ"
+	case ASSERT_NEAR:
+		return "ASSERT_NEAR"
+	case BUILD_INFO:
+		return "BUILD_INFO"
+	case BUF_GET_I32:
+		return "BUF_GET_I32"
+	case BUF_GET_F32:
+		return "BUF_GET_F32"
+	case BUF_PUT_I32:
+		return "BUF_PUT_I32"
+	case BUF_PUT_F32:
+		return "BUF_PUT_F32"
+	case MMAP_FILE:
+		return "MMAP_FILE"
+	case ON_SOFT_LIMIT:
+		return "ON_SOFT_LIMIT"
+	case YIELD_HOST:
+		return "YIELD_HOST"
+	case ARGV:
+		return "ARGV"
+	case OPT_PARSE:
+		return "OPT_PARSE"
+	case CSV_PARSE:
+		return "CSV_PARSE"
+	case CSV_WRITE:
+		return "CSV_WRITE"
+	case TIME_NOW_STRUCT:
+		return "TIME_NOW_STRUCT"
+	case TIME_FORMAT:
+		return "TIME_FORMAT"
+	case TIME_PARSE:
+		return "TIME_PARSE"
+	default:
+		return fmt.Sprintf("UNKNOWN_SYSCALL(%d)", byte(call))
+	}
+}
+
+// SyscallSignature is the stack effect of a system call: the values it pops
+// and pushes, from the bottom of the stack to the top, by kind and name.
+type SyscallSignature struct {
+	Pops, Pushes []StackSlot
+}
+
+// String returns the signature as "ptr:s, int32:offset → ptr:view", ? for
+// values of any kind.
+func (s SyscallSignature) String() string {
+	if len(s.Pops) == 0 && len(s.Pushes) == 0 {
+		return "no change"
+	}
+	var pops, pushes []string
+	for _, slot := range s.Pops {
+		pops = append(pops, slot.String())
+	}
+	for _, slot := range s.Pushes {
+		pushes = append(pushes, slot.String())
+	}
+	return strings.TrimSpace(strings.Join(pops, ", ") + " → " + strings.Join(pushes, ", "))
+}
+
+func slots(s ...StackSlot) []StackSlot { return s }
+
+func ptrSlot(name string) StackSlot     { return computedSlot(common.ValuePtr, name) }
+func int32Slot(name string) StackSlot   { return computedSlot(common.ValueInt32, name) }
+func float32Slot(name string) StackSlot { return computedSlot(common.ValueFloat32, name) }
+func anySlot(name string) StackSlot     { return computedSlot(anyKind, name) }
+
+// syscallSignatures are the stack effects of the system calls. Strings,
+// arrays and closures are pointers on the stack.
+var syscallSignatures = map[Systemcall]SyscallSignature{
+	STR_LEN:         {slots(ptrSlot("s")), slots(int32Slot("length"))},
+	STR_CAT:         {slots(ptrSlot("right"), ptrSlot("left")), slots(ptrSlot("left+right"))},
+	STR_EQUALS:      {slots(ptrSlot("a"), ptrSlot("b")), slots(int32Slot("a==b"))},
+	WRITE_BYTE:      {slots(anySlot("byte")), nil},
+	READ_BYTE:       {nil, slots(computedSlot(common.ValueByte, "byte"))},
+	BACKTRACE:       {nil, slots(ptrSlot("names"))},
+	ERR_NEW:         {slots(int32Slot("code"), ptrSlot("message")), slots(ptrSlot("error"))},
+	ERR_WRAP:        {slots(ptrSlot("cause"), int32Slot("code"), ptrSlot("message")), slots(ptrSlot("error"))},
+	SUBSTR_VIEW:     {slots(ptrSlot("s"), int32Slot("offset"), int32Slot("length")), slots(ptrSlot("view"))},
+	STR_SET_BYTE:    {slots(ptrSlot("s"), int32Slot("index"), anySlot("byte")), slots(ptrSlot("written"))},
+	PRINT_FLOAT:     {slots(float32Slot("x")), nil},
+	GC_HINT:         {slots(int32Slot("mode")), nil},
+	GET_ENV:         {slots(ptrSlot("name")), slots(ptrSlot("value"))},
+	COUNTER_INC:     {slots(int32Slot("id")), nil},
+	PRINT_ANY:       {slots(anySlot("value")), nil},
+	LOG_DEBUG:       {slots(ptrSlot("message")), nil},
+	LOG_INFO:        {slots(ptrSlot("message")), nil},
+	LOG_WARN:        {slots(ptrSlot("message")), nil},
+	LOG_ERROR:       {slots(ptrSlot("message")), nil},
+	ASSERT_EQ:       {slots(anySlot("expected"), anySlot("actual")), nil},
+	ASSERT_NEAR:     {slots(float32Slot("expected"), float32Slot("actual"), float32Slot("tolerance")), nil},
+	BUILD_INFO:      {nil, slots(ptrSlot("info"))},
+	BUF_GET_I32:     {slots(ptrSlot("buffer"), int32Slot("offset"), int32Slot("order")), slots(int32Slot("value"))},
+	BUF_GET_F32:     {slots(ptrSlot("buffer"), int32Slot("offset"), int32Slot("order")), slots(float32Slot("value"))},
+	BUF_PUT_I32:     {slots(ptrSlot("buffer"), int32Slot("offset"), int32Slot("value"), int32Slot("order")), nil},
+	BUF_PUT_F32:     {slots(ptrSlot("buffer"), int32Slot("offset"), float32Slot("value"), int32Slot("order")), nil},
+	MMAP_FILE:       {slots(ptrSlot("path"), int32Slot("mode")), slots(ptrSlot("bytes"))},
+	ON_SOFT_LIMIT:   {slots(ptrSlot("handler")), nil},
+	YIELD_HOST:      {nil, nil},
+	ARGV:            {nil, slots(ptrSlot("args"))},
+	OPT_PARSE:       {slots(ptrSlot("args"), ptrSlot("spec")), slots(ptrSlot("options"))},
+	CSV_PARSE:       {slots(ptrSlot("text")), slots(ptrSlot("rows"))},
+	CSV_WRITE:       {slots(ptrSlot("rows")), nil},
+	TIME_NOW_STRUCT: {nil, slots(ptrSlot("now"))},
+	TIME_FORMAT:     {slots(ptrSlot("time"), ptrSlot("layout")), slots(ptrSlot("text"))},
+	TIME_PARSE:      {slots(ptrSlot("text"), ptrSlot("layout")), slots(ptrSlot("time"))},
+}
+
+// Signature returns the stack effect of the system call, ok is false for a
+// number that isn't a system call.
+func (call Systemcall) Signature() (signature SyscallSignature, ok bool) {
+	signature, ok = syscallSignatures[call]
+	return signature, ok
+}
+
+// Arity returns how many values the system call pops and pushes, ok is
+// false for a number that isn't a system call.
+func (call Systemcall) Arity() (in, out int, ok bool) {
+	signature, ok := syscallSignatures[call]
+	return len(signature.Pops), len(signature.Pushes), ok
+}
+
+// SyscallCounts returns how often each system call was executed.
+func (v *VM) SyscallCounts() map[Systemcall]uint64 {
+	counts := make(map[Systemcall]uint64)
+	for call, count := range v.syscallCounts {
+		if count > 0 {
+			counts[Systemcall(call)] = count
+		}
+	}
+	return counts
+}
+
+// Counters returns the counters incremented by COUNTER_INC, by id.
+func (v *VM) Counters() map[int32]uint64 {
+	counters := make(map[int32]uint64, len(v.counters))
+	for id, count := range v.counters {
+		counters[id] = count
+	}
+	return counters
+}
+
 func (v *VM) executeSystemCall(call Systemcall) {
+	v.syscallCounts[call]++
 	switch call {
 	case STR_LEN:
 		strPtr := v.pop().AsPtr()
-		str, err := v.Heap.LoadString(strPtr)
+		length, err := v.Heap.StringLength(strPtr)
 		if err != nil {
-			log.Fatal(err)
+			v.fail(err)
 		}
-		v.push(common.Int32Value(int32(len(str))))
+		v.push(common.Int32Value(length))
 	case STR_CAT:
 		str1Ptr := v.pop().AsPtr()
 		str2Ptr := v.pop().AsPtr()
-		str1, err1 := v.Heap.LoadString(str1Ptr)
-		str2, err2 := v.Heap.LoadString(str2Ptr)
-		if err1 != nil {
-			log.Fatal(err1)
-		}
-		if err2 != nil {
-			log.Fatal(err2)
-		}
-		ptr, err := v.Heap.AllocateString(str1 + str2)
+		ptr, err := v.Heap.Concat(str1Ptr, str2Ptr)
 		if err != nil {
-			log.Fatal(err)
+			v.fail(err)
 		}
 		v.push(common.PtrValue(ptr))
 	case STR_EQUALS:
@@ -47,10 +263,10 @@ func (v *VM) executeSystemCall(call Systemcall) {
 		str1, err1 := v.Heap.LoadString(str1Ptr)
 		str2, err2 := v.Heap.LoadString(str2Ptr)
 		if err1 != nil {
-			log.Fatal(err1)
+			v.fail(err1)
 		}
 		if err2 != nil {
-			log.Fatal(err2)
+			v.fail(err2)
 		}
 		if str1 == str2 {
 			v.push(common.Int32Value(1))
@@ -60,23 +276,332 @@ func (v *VM) executeSystemCall(call Systemcall) {
 	case WRITE_BYTE:
 		value := v.pop()
 		var byteValue byte
-		if value.Kind == common.ValueByte {
+		if value.Kind() == common.ValueByte {
 			byteValue = value.AsByte()
-		} else if value.Kind == common.ValueInt32 {
+		} else if value.Kind() == common.ValueInt32 {
 			byteValue = byte(value.AsInt32() & 0xFF)
 		} else {
-			log.Fatal("WRITE_BYTE expects a byte or int32 value")
+			v.failf("WRITE_BYTE expects a byte or int32 value")
 		}
-		_, err := os.Stdout.Write([]byte{byteValue})
+		_, err := v.stdout.Write([]byte{byteValue})
 		if err != nil {
-			log.Fatal(err)
+			v.fail(err)
 		}
 	case READ_BYTE:
 		var buffer [1]byte
-		_, err := os.Stdin.Read(buffer[:])
+		_, err := v.stdin.Read(buffer[:])
 		if err != nil {
-			log.Fatal(err)
+			v.fail(err)
 		}
 		v.push(common.ByteValue(buffer[0]))
+	case BACKTRACE:
+		v.push(common.PtrValue(v.backtrace()))
+	case ERR_NEW:
+		message := v.pop().AsPtr()
+		code := v.pop().AsInt32()
+		v.push(common.PtrValue(v.newErrorValue(code, message, 0)))
+	case ERR_WRAP:
+		message := v.pop().AsPtr()
+		code := v.pop().AsInt32()
+		cause := v.pop().AsPtr()
+		if cause == 0 {
+			v.failf("ERR_WRAP needs an Error value to wrap")
+		}
+		v.push(common.PtrValue(v.newErrorValue(code, message, cause)))
+	case SUBSTR_VIEW:
+		length := v.pop().AsInt32()
+		offset := v.pop().AsInt32()
+		strPtr := v.pop().AsPtr()
+		ptr, err := v.Heap.AllocateStringView(strPtr, offset, length)
+		if err != nil {
+			v.fail(err)
+		}
+		v.push(common.PtrValue(ptr))
+	case STR_SET_BYTE:
+		value := v.pop()
+		index := v.pop().AsInt32()
+		strPtr := v.pop().AsPtr()
+		var byteValue byte
+		if value.Kind() == common.ValueInt32 {
+			byteValue = byte(value.AsInt32())
+		} else {
+			byteValue = value.AsByte()
+		}
+		ptr, err := v.Heap.SetStringByte(strPtr, index, byteValue)
+		if err != nil {
+			v.fail(err)
+		}
+		v.push(common.PtrValue(ptr))
+	case PRINT_FLOAT:
+		text := v.floatFormat.Format(v.pop().AsFloat32())
+		if _, err := io.WriteString(v.stdout, text); err != nil {
+			v.fail(err)
+		}
+	case GC_HINT:
+		v.gcHint(v.pop().AsInt32())
+	case GET_ENV:
+		name, err := v.Heap.LoadString(v.pop().AsPtr())
+		if err != nil {
+			v.fail(err)
+		}
+		ptr, err := v.Heap.AllocateString(v.env[name])
+		if err != nil {
+			v.fail(err)
+		}
+		v.push(common.PtrValue(ptr))
+	case COUNTER_INC:
+		id := v.pop().AsInt32()
+		if v.counters == nil {
+			v.counters = make(map[int32]uint64)
+		}
+		v.counters[id]++
+	case PRINT_ANY:
+		if _, err := io.WriteString(v.stdout, v.Heap.Format(v.pop(), v.floatFormat)); err != nil {
+			v.fail(err)
+		}
+	case LOG_DEBUG, LOG_INFO, LOG_WARN, LOG_ERROR:
+		message, err := v.Heap.LoadString(v.pop().AsPtr())
+		if err != nil {
+			v.fail(err)
+		}
+		v.log(logLevels[call-LOG_DEBUG], message)
+	case ASSERT_EQ:
+		actual := v.pop()
+		expected := v.pop()
+		if !v.equalValues(expected, actual) {
+			v.fail(v.assertionError(expected, actual, ""))
+		}
+	case ASSERT_NEAR:
+		tolerance := v.pop().AsFloat32()
+		actual := v.pop().AsFloat32()
+		expected := v.pop().AsFloat32()
+		// NaN is near nothing
+		if !(math.Abs(float64(actual)-float64(expected)) <= float64(tolerance)) {
+			v.fail(v.assertionError(common.Float32Value(expected), common.Float32Value(actual), v.floatFormat.Format(tolerance)))
+		}
+	case BUILD_INFO:
+		text := ""
+		if v.buildInfo != nil {
+			text = v.buildInfo.String()
+		}
+		ptr, err := v.Heap.AllocateString(text)
+		if err != nil {
+			v.fail(err)
+		}
+		v.push(common.PtrValue(ptr))
+	case BUF_GET_I32, BUF_GET_F32:
+		order := v.bufferOrder(call)
+		offset := v.pop().AsInt32()
+		buffer := v.pop().AsPtr()
+		kind := common.ValueInt32
+		if call == BUF_GET_F32 {
+			kind = common.ValueFloat32
+		}
+		value, err := v.Heap.BufferGet(buffer, offset, kind, order)
+		if err != nil {
+			v.fail(err)
+		}
+		v.push(value)
+	case BUF_PUT_I32, BUF_PUT_F32:
+		order := v.bufferOrder(call)
+		value := v.pop()
+		offset := v.pop().AsInt32()
+		buffer := v.pop().AsPtr()
+		want := common.ValueInt32
+		if call == BUF_PUT_F32 {
+			want = common.ValueFloat32
+		}
+		if value.Kind() != want {
+			v.failf("%v expects a %v value, got %v", call, want, value.Kind())
+		}
+		if err := v.Heap.BufferPut(buffer, offset, value, order); err != nil {
+			v.fail(err)
+		}
+	case MMAP_FILE:
+		mode := v.pop().AsInt32()
+		name, err := v.Heap.LoadString(v.pop().AsPtr())
+		if err != nil {
+			v.fail(err)
+		}
+		ptr, err := v.mapGuestFile(name, mode)
+		if err != nil {
+			v.fail(err)
+		}
+		v.push(common.PtrValue(ptr))
+	case ON_SOFT_LIMIT:
+		v.setSoftLimitHandler(v.pop())
+	case YIELD_HOST:
+		runtime.Gosched()
+	case ARGV:
+		v.push(common.PtrValue(v.allocateStrings(v.args)))
+	case OPT_PARSE:
+		v.push(common.PtrValue(v.optParse()))
+	case CSV_PARSE:
+		v.push(common.PtrValue(v.csvParse()))
+	case CSV_WRITE:
+		v.csvWrite()
+	case TIME_NOW_STRUCT:
+		v.push(common.PtrValue(v.allocateDateTime(v.now())))
+	case TIME_FORMAT:
+		v.push(common.PtrValue(v.timeFormat()))
+	case TIME_PARSE:
+		v.push(common.PtrValue(v.timeParse()))
+	default:
+		v.failf("unknown system call %d", byte(call))
+	}
+}
+
+// bufferOrder pops the byte order of a BUF_GET or BUF_PUT: 0 for little
+// endian, 1 for big endian
+func (v *VM) bufferOrder(call Systemcall) binary.ByteOrder {
+	switch order := v.pop().AsInt32(); order {
+	case 0:
+		return binary.LittleEndian
+	case 1:
+		return binary.BigEndian
+	default:
+		v.failf("%v: byte order must be 0 (little endian) or 1 (big endian), got %d", call, order)
+		return nil
+	}
+}
+
+// logLevels are the levels of LOG_DEBUG to LOG_ERROR
+var logLevels = [...]slog.Level{slog.LevelDebug, slog.LevelInfo, slog.LevelWarn, slog.LevelError}
+
+// log writes a record of the program to the host's logger with the VM id
+// and the address of the system call
+func (v *VM) log(level slog.Level, message string) {
+	ctx := context.Background()
+	if !v.logger.Enabled(ctx, level) {
+		return
+	}
+	v.logger.LogAttrs(ctx, level, message, slog.String("vm", v.auditID), slog.Uint64("ip", uint64(v.instructionStart)))
+}
+
+// equalValues reports whether ASSERT_EQ holds: the values have the same
+// kind and are equal, objects in the heap being compared by what they hold
+func (v *VM) equalValues(a, b common.Value) bool {
+	if a.Kind() != b.Kind() {
+		return false
+	}
+	switch a.Kind() {
+	case common.ValuePtr, common.ValueString, common.ValueArray, common.ValueStruct:
+		return a == b || v.Heap.Format(a, common.FloatFormat{}) == v.Heap.Format(b, common.FloatFormat{})
+	}
+	return a == b
+}
+
+// assertionError describes a failed assertion at the current instruction.
+// Values of different kinds are printed with their kind.
+func (v *VM) assertionError(expected, actual common.Value, tolerance string) *AssertionError {
+	format := func(value common.Value) string {
+		text := v.Heap.Format(value, v.floatFormat)
+		if expected.Kind() != actual.Kind() {
+			text = fmt.Sprintf("%v:%s", value.Kind(), text)
+		}
+		return text
+	}
+	err := &AssertionError{
+		Expected:  format(expected),
+		Actual:    format(actual),
+		Tolerance: tolerance,
+		Function:  v.frameFunctionName(len(v.CallStack) - 1),
+	}
+	err.Line, _ = v.sourceLine(v.instructionStart)
+	return err
+}
+
+// sourceLine returns the source line of the instruction at address, false
+// when the program has no source map
+func (v *VM) sourceLine(address uint) (uint32, bool) {
+	i := sort.Search(len(v.lines), func(i int) bool { return uint(v.lines[i].Address) > address })
+	if i == 0 {
+		return 0, false
+	}
+	return v.lines[i-1].Line, true
+}
+
+// backtrace allocates an array with the name of the function of every
+// frame, innermost first
+func (v *VM) backtrace() uintptr {
+	return v.allocateStrings(v.backtraceNames())
+}
+
+// loadStrings reads the array of strings at ptr
+func (v *VM) loadStrings(ptr uintptr) []string {
+	length, err := v.Heap.ArrayLength(ptr)
+	if err != nil {
+		v.fail(err)
+	}
+	strs := make([]string, length)
+	for i := range strs {
+		element, err := v.Heap.GetArrayElement(ptr, int32(i))
+		if err != nil {
+			v.fail(err)
+		}
+		if strs[i], err = v.Heap.LoadString(element.Ptr()); err != nil {
+			v.fail(err)
+		}
+	}
+	return strs
+}
+
+// allocateStrings allocates an array of strings holding strs
+func (v *VM) allocateStrings(strs []string) uintptr {
+	ptr, err := v.Heap.AllocateArray(common.ValuePtr, int32(len(strs)))
+	if err != nil {
+		v.fail(err)
+	}
+	for i, s := range strs {
+		v.setStringElement(ptr, int32(i), s)
+	}
+	return ptr
+}
+
+// setStringElement allocates s and stores it at index of the array at ptr
+func (v *VM) setStringElement(ptr uintptr, index int32, s string) {
+	str, err := v.Heap.AllocateString(s)
+	if err != nil {
+		v.fail(err)
+	}
+	if err := v.Heap.SetArrayElement(ptr, index, common.PtrValue(str)); err != nil {
+		v.fail(err)
+	}
+}
+
+func (v *VM) backtraceNames() []string {
+	names := make([]string, 0, len(v.CallStack))
+	for i := len(v.CallStack) - 1; i >= 0; i-- {
+		names = append(names, v.frameFunctionName(i))
+	}
+	return names
+}
+
+// frameFunction returns the function executing in frame i, nil when it is
+// the initial frame of a program without main. The initial frame runs
+// main.
+func (v *VM) frameFunction(i int) *FunctionSignature {
+	if f := v.CallStack[i].Function; f != nil {
+		return f
+	}
+	for j := range v.functionList {
+		if v.functionList[j].isMain {
+			return &v.functionList[j]
+		}
+	}
+	return nil
+}
+
+// frameFunctionName names the function executing in frame i, programs
+// without names report function addresses.
+func (v *VM) frameFunctionName(i int) string {
+	f := v.frameFunction(i)
+	switch {
+	case f == nil:
+		return "main"
+	case f.Name == "":
+		return fmt.Sprintf("func@%d", f.Address)
+	default:
+		return f.Name
 	}
 }
@@ -0,0 +1,790 @@
+package vm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AndreiAlbert/gvm/bytecode"
+	. "github.com/AndreiAlbert/gvm/common"
+	"github.com/AndreiAlbert/gvm/heap"
+)
+
+func TestBacktrace(t *testing.T) {
+	program, err := bytecode.Decode(mustReadTestProgram(t, "testdata/calls.gvmbc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	machine, err := NewVmFromProgram(program, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer machine.Close()
+	// as if main had called work
+	machine.PushFrame(0)
+	machine.getCurrentFrame().Function = &machine.functionList[1]
+
+	arrayPtr := machine.backtrace()
+	for i, want := range []string{"work", "main"} {
+		element, err := machine.Heap.GetArrayElement(arrayPtr, int32(i))
+		if err != nil {
+			t.Fatalf("Failed to load frame %d: %v", i, err)
+		}
+		name, err := machine.Heap.LoadString(element.AsPtr())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if name != want {
+			t.Errorf("Expected frame %d to be %q, got %q", i, want, name)
+		}
+	}
+	if _, err := machine.Heap.GetArrayElement(arrayPtr, 2); err == nil {
+		t.Error("Expected the backtrace to have two frames")
+	}
+}
+
+func TestStringViews(t *testing.T) {
+	program, err := bytecode.Decode(mustReadTestProgram(t, "testdata/strings.gvmbc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	machine, err := NewVmFromProgram(program, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer machine.Close()
+	call := func(call Systemcall, args ...Value) Value {
+		t.Helper()
+		for _, arg := range args {
+			machine.push(arg)
+		}
+		if err := catchRuntimeError(func() { machine.executeSystemCall(call) }); err != nil {
+			t.Fatalf("%v failed: %v", call, err)
+		}
+		return machine.pop()
+	}
+	load := func(value Value) string {
+		t.Helper()
+		s, err := machine.Heap.LoadString(value.AsPtr())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+
+	basePtr, err := machine.Heap.AllocateString("hello world")
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := PtrValue(basePtr)
+	allocated := machine.Heap.TotalAllocated()
+	world := call(SUBSTR_VIEW, base, Int32Value(6), Int32Value(5))
+	orl := call(SUBSTR_VIEW, world, Int32Value(1), Int32Value(3))
+	if load(world) != "world" || load(orl) != "orl" {
+		t.Fatalf("Unexpected views %q and %q", load(world), load(orl))
+	}
+	// a view is a fixed size header whatever its length
+	if grown := machine.Heap.TotalAllocated() - allocated; grown > 64 {
+		t.Errorf("Expected views not to copy the string, heap grew by %d bytes", grown)
+	}
+	if n := call(STR_LEN, world).AsInt32(); n != 5 {
+		t.Errorf("Expected STR_LEN of the view to be 5, got %d", n)
+	}
+
+	// writes copy the view, and the string views point into
+	upper := call(STR_SET_BYTE, orl, Int32Value(0), ByteValue('O'))
+	if upper == orl || load(upper) != "Orl" || load(orl) != "orl" {
+		t.Errorf("Expected a copy, got %q with the view now %q", load(upper), load(orl))
+	}
+	hello := call(STR_SET_BYTE, base, Int32Value(0), Int32Value('H'))
+	if hello == base || load(hello) != "Hello world" || load(world) != "world" {
+		t.Errorf("Expected a copy of the viewed string, got %q", load(hello))
+	}
+	// without views a string is written in place
+	if again := call(STR_SET_BYTE, hello, Int32Value(6), ByteValue('W')); again != hello || load(hello) != "Hello World" {
+		t.Errorf("Expected the write in place, got %q", load(again))
+	}
+
+	machine.push(base)
+	machine.push(Int32Value(8))
+	machine.push(Int32Value(5))
+	err = catchRuntimeError(func() { machine.executeSystemCall(SUBSTR_VIEW) })
+	if !errors.Is(err, heap.ErrOutOfBounds) {
+		t.Errorf("Expected a view past the end to fail, got %v", err)
+	}
+}
+
+func TestGetEnv(t *testing.T) {
+	program, err := bytecode.Decode(mustReadTestProgram(t, "testdata/strings.gvmbc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	machine, err := NewVmFromProgram(program, Options{Env: map[string]string{"NAME": "ada"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer machine.Close()
+	for name, want := range map[string]string{"NAME": "ada", "HOME": ""} {
+		namePtr, err := machine.Heap.AllocateString(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		machine.push(PtrValue(namePtr))
+		if err := catchRuntimeError(func() { machine.executeSystemCall(GET_ENV) }); err != nil {
+			t.Fatalf("GET_ENV %s failed: %v", name, err)
+		}
+		value, err := machine.Heap.LoadString(machine.pop().AsPtr())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if value != want {
+			t.Errorf("Expected %s to be %q, got %q", name, want, value)
+		}
+	}
+}
+
+func TestPrintAny(t *testing.T) {
+	program, err := bytecode.Decode(mustReadTestProgram(t, "testdata/strings.gvmbc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	machine, err := NewVmFromProgram(program, Options{Stdout: &out})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer machine.Close()
+	h := machine.Heap
+	node := StructType{Name: "Node", Size: 4 + 8 + 8, Fields: []StructField{
+		{Name: "value", Type: ValueInt32},
+		{Name: "label", Type: ValuePtr, Offset: 4},
+		{Name: "next", Type: ValuePtr, Offset: 12},
+	}}
+	first, err := h.AllocateStruct(node)
+	if err != nil {
+		t.Fatal(err)
+	}
+	label, err := h.AllocateString(`say "hi"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.SetStructureField(first, "value", Int32Value(1))
+	h.SetStructureField(first, "label", PtrValue(label))
+	// a list that loops back to its head
+	h.SetStructureField(first, "next", PtrValue(first))
+	numbers, err := h.AllocateArray(ValueFloat32, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.SetArrayElement(numbers, 0, Float32Value(1.5))
+	h.SetArrayElement(numbers, 1, Float32Value(-2))
+
+	for _, test := range []struct {
+		value Value
+		want  string
+	}{
+		{Int32Value(-7), "-7"},
+		{PtrValue(0), "nil"},
+		{PtrValue(numbers), "[1.5, -2]"},
+		{PtrValue(first), `Node{value: 1, label: "say \"hi\"", next: ...}`},
+	} {
+		out.Reset()
+		machine.push(test.value)
+		if err := catchRuntimeError(func() { machine.executeSystemCall(PRINT_ANY) }); err != nil {
+			t.Fatal(err)
+		}
+		if out.String() != test.want {
+			t.Errorf("Expected %s, got %s", test.want, out.String())
+		}
+	}
+}
+
+func TestConcatenationBuildsRopes(t *testing.T) {
+	program, err := bytecode.Decode(mustReadTestProgram(t, "testdata/strings.gvmbc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	machine, err := NewVmFromProgram(program, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer machine.Close()
+	concat := func(left, right Value) Value {
+		t.Helper()
+		// STR_CAT appends the second operand to the one on top
+		machine.push(right)
+		machine.push(left)
+		if err := catchRuntimeError(func() { machine.executeSystemCall(STR_CAT) }); err != nil {
+			t.Fatal(err)
+		}
+		return machine.pop()
+	}
+
+	chunk := strings.Repeat("0123456789", 100)
+	chunkPtr, err := machine.Heap.AllocateString(chunk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const pieces = 1000
+	log := PtrValue(chunkPtr)
+	for i := 1; i < pieces; i++ {
+		log = concat(log, PtrValue(chunkPtr))
+	}
+	if !machine.Heap.IsRope(log.AsPtr()) {
+		t.Error("Expected a long concatenation to be a rope")
+	}
+	machine.push(log)
+	machine.executeSystemCall(STR_LEN)
+	if n := machine.pop().AsInt32(); n != pieces*int32(len(chunk)) {
+		t.Errorf("Expected length %d, got %d", pieces*len(chunk), n)
+	}
+	s, err := machine.Heap.LoadString(log.AsPtr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s != strings.Repeat(chunk, pieces) {
+		t.Error("Unexpected rope contents")
+	}
+
+	// ropes are strings to every other syscall
+	short, err := machine.Heap.AllocateString("!")
+	if err != nil {
+		t.Fatal(err)
+	}
+	machine.push(log)
+	machine.push(Int32Value(int32(len(s) - 3)))
+	machine.push(Int32Value(3))
+	machine.executeSystemCall(SUBSTR_VIEW)
+	tail, err := machine.Heap.LoadString(machine.pop().AsPtr())
+	if err != nil || tail != "789" {
+		t.Errorf("Expected a view of the rope to read %q, got %q, %v", "789", tail, err)
+	}
+	written := concat(log, PtrValue(short))
+	machine.push(written)
+	machine.push(Int32Value(0))
+	machine.push(ByteValue('X'))
+	machine.executeSystemCall(STR_SET_BYTE)
+	if first, _ := machine.Heap.LoadString(machine.pop().AsPtr()); first[0] != 'X' {
+		t.Error("Expected the write to go to a copy of the rope")
+	}
+	if again, _ := machine.Heap.LoadString(log.AsPtr()); again != s {
+		t.Error("Expected the rope to keep its contents after a write to a copy")
+	}
+
+	// freeing a piece invalidates ropes that have not been read yet
+	fresh := concat(PtrValue(chunkPtr), PtrValue(chunkPtr))
+	if err := machine.Heap.Free(chunkPtr); err != nil {
+		t.Fatal(err)
+	}
+	// the freed address may be reused by the flattened copy itself
+	if _, err := machine.Heap.LoadString(fresh.AsPtr()); err == nil {
+		t.Errorf("Expected reading a rope of a freed string to fail, got %v", err)
+	}
+}
+
+func TestPrintFloat(t *testing.T) {
+	program, err := bytecode.Decode(mustReadTestProgram(t, "testdata/strings.gvmbc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		format FloatFormat
+		want   string
+	}{
+		{FloatFormat{}, "0.1"},
+		{FloatFormat{Verb: 'f', Precision: 2}, "0.10"},
+		{FloatFormat{Verb: 'e', Precision: 1}, "1.0e-01"},
+	} {
+		var stdout bytes.Buffer
+		machine, err := NewVmFromProgram(program, Options{Stdout: &stdout, FloatFormat: tc.format})
+		if err != nil {
+			t.Fatal(err)
+		}
+		machine.push(Float32Value(0.1))
+		if err := catchRuntimeError(func() { machine.executeSystemCall(PRINT_FLOAT) }); err != nil {
+			t.Fatal(err)
+		}
+		machine.Close()
+		if stdout.String() != tc.want {
+			t.Errorf("Expected %v to print %q, got %q", tc.format, tc.want, stdout.String())
+		}
+	}
+}
+
+// TestAppendsAllocateLinearly appends n and 2n pieces to a string. Copying
+// the string, even once in a while, would allocate about four times as much
+// for twice the pieces.
+func TestAppendsAllocateLinearly(t *testing.T) {
+	program, err := bytecode.Decode(mustReadTestProgram(t, "testdata/strings.gvmbc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendPieces := func(pieces int) uint64 {
+		t.Helper()
+		machine, err := NewVmFromProgram(program, Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer machine.Close()
+		s, err := machine.Heap.AllocateString(strings.Repeat("0123456789", 200))
+		if err != nil {
+			t.Fatal(err)
+		}
+		piece, err := machine.Heap.AllocateString(strings.Repeat("-", 100))
+		if err != nil {
+			t.Fatal(err)
+		}
+		before := machine.Heap.TotalAllocated()
+		for i := 0; i < pieces; i++ {
+			machine.push(PtrValue(piece))
+			machine.push(PtrValue(s))
+			if err := catchRuntimeError(func() { machine.executeSystemCall(STR_CAT) }); err != nil {
+				t.Fatal(err)
+			}
+			s = machine.pop().AsPtr()
+		}
+		return machine.Heap.TotalAllocated() - before
+	}
+	for _, n := range []int{1000, 2000} {
+		once, twice := appendPieces(n), appendPieces(2*n)
+		if twice > 5*once/2 {
+			t.Errorf("Expected %d appends to allocate about twice as much as %d, got %d and %d bytes", 2*n, n, twice, once)
+		}
+	}
+}
+
+func TestLogSyscalls(t *testing.T) {
+	program, err := bytecode.Decode(mustReadTestProgram(t, "testdata/strings.gvmbc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out, records bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&records, &slog.HandlerOptions{Level: slog.LevelInfo}))
+	machine, err := NewVmFromProgram(program, Options{Stdout: &out, Logger: logger, AuditID: "vm-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer machine.Close()
+	for _, call := range []Systemcall{LOG_DEBUG, LOG_WARN} {
+		message, err := machine.Heap.AllocateString("disk " + call.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		machine.push(PtrValue(message))
+		if err := catchRuntimeError(func() { machine.executeSystemCall(call) }); err != nil {
+			t.Fatalf("%v failed: %v", call, err)
+		}
+	}
+	if out.Len() != 0 {
+		t.Errorf("Expected no output, got %q", out.String())
+	}
+	// the debug record is below the level of the logger
+	lines := strings.Split(strings.TrimSpace(records.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("Expected one record, got %q", records.String())
+	}
+	var record struct {
+		Level string
+		Msg   string
+		VM    string
+		IP    *uint
+	}
+	if err := json.Unmarshal([]byte(lines[0]), &record); err != nil {
+		t.Fatal(err)
+	}
+	if record.Level != "WARN" || record.Msg != "disk LOG_WARN" || record.VM != "vm-1" || record.IP == nil {
+		t.Errorf("Unexpected record %s", lines[0])
+	}
+}
+
+func TestAssertions(t *testing.T) {
+	program, err := bytecode.Decode(mustReadTestProgram(t, "testdata/assert.gvmbc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	machine, err := NewVmFromProgram(program, Options{Stdout: &out})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer machine.Close()
+	runErr := machine.Run()
+	// equal strings pass, arrays of different lengths are caught with
+	// code -5
+	if out.String() != "0" {
+		t.Errorf("Expected the failed array assertion to be caught, got %q", out.String())
+	}
+	var assertErr *AssertionError
+	if !errors.As(runErr, &assertErr) {
+		t.Fatalf("Expected an AssertionError, got %v", runErr)
+	}
+	if assertErr.Line != 27 || assertErr.Function != "main" || assertErr.Expected != "int32:4" || assertErr.Actual != "float32:4" {
+		t.Errorf("Unexpected assertion failure %+v", assertErr)
+	}
+
+	// a struct is compared by its fields, ASSERT_NEAR with its tolerance
+	point := StructType{Name: "Point", Fields: []StructField{{Name: "x", Type: ValueInt32}}}
+	machine.defineStruct(point)
+	a, _ := machine.Heap.AllocateStruct(machine.structs["Point"])
+	b, _ := machine.Heap.AllocateStruct(machine.structs["Point"])
+	if !machine.equalValues(PtrValue(a), PtrValue(b)) {
+		t.Error("Expected structs with equal fields to be equal")
+	}
+	machine.Heap.SetStructureField(b, "x", Int32Value(1))
+	if machine.equalValues(PtrValue(a), PtrValue(b)) {
+		t.Error("Expected structs with different fields to differ")
+	}
+	machine.Running = true
+	for _, value := range []float32{1, 1.25, 0.1} {
+		machine.push(Float32Value(value))
+	}
+	err = catchRuntimeError(func() { machine.executeSystemCall(ASSERT_NEAR) })
+	if !errors.As(err, &assertErr) || !strings.Contains(err.Error(), "expected 1 within 0.1, got 1.25") {
+		t.Errorf("Expected ASSERT_NEAR to fail with the tolerance, got %v", err)
+	}
+}
+
+func TestBuildInfoSyscall(t *testing.T) {
+	program, err := bytecode.Decode(mustReadTestProgram(t, "testdata/hello.gvmbc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, info := range []*bytecode.BuildInfo{nil, {Toolchain: "gvm v1.0.0 (go1.22.1)"}} {
+		program.BuildInfo = info
+		machine, err := NewVmFromProgram(program, Options{Stdout: io.Discard})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := catchRuntimeError(func() { machine.executeSystemCall(BUILD_INFO) }); err != nil {
+			t.Fatal(err)
+		}
+		text, err := machine.Heap.LoadString(machine.pop().AsPtr())
+		if err != nil {
+			t.Fatal(err)
+		}
+		// containers without build info report an empty string
+		want := ""
+		if info != nil {
+			want = info.String()
+		}
+		if text != want {
+			t.Errorf("Expected the build info %q, got %q", want, text)
+		}
+		machine.Close()
+	}
+}
+
+func TestBufferSyscalls(t *testing.T) {
+	program, err := bytecode.Decode(mustReadTestProgram(t, "testdata/buffer.gvmbc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	machine, err := NewVmFromProgram(program, Options{Stdout: &out})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer machine.Close()
+	if err := machine.Run(); err != nil {
+		t.Fatal(err)
+	}
+	// the low byte of 258 written big endian, its bytes read little endian,
+	// 1.5 read back and read as a big endian int32, then the code of the
+	// read past the end
+	if want := "2 33619968 1.5 49215 -2"; out.String() != want {
+		t.Errorf("Expected output %q, got %q", want, out.String())
+	}
+
+	run := func(call Systemcall, args ...Value) error {
+		for _, arg := range args {
+			machine.push(arg)
+		}
+		return catchRuntimeError(func() { machine.executeSystemCall(call) })
+	}
+	buffer := machine.CallStack[0].Locals[0]
+	clonePtr, err := machine.Heap.CloneArray(buffer.Ptr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := run(BUF_PUT_I32, PtrValue(clonePtr), Int32Value(0), Int32Value(-1), Int32Value(0)); err != nil {
+		t.Fatal(err)
+	}
+	if element, err := machine.Heap.GetArrayElement(buffer.Ptr(), 0); err != nil || element.AsByte() != 0 {
+		t.Errorf("Expected the write to the clone not to reach the buffer, got %v, %v", element, err)
+	}
+	if err := run(BUF_GET_I32, buffer, Int32Value(0), Int32Value(2)); err == nil || !strings.Contains(err.Error(), "byte order") {
+		t.Errorf("Expected byte order 2 to fail, got %v", err)
+	}
+	if err := run(BUF_PUT_F32, buffer, Int32Value(0), Int32Value(1), Int32Value(0)); err == nil {
+		t.Error("Expected BUF_PUT_F32 of an int32 to fail")
+	}
+	ints, err := machine.Heap.AllocateArray(ValueInt32, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := run(BUF_GET_I32, PtrValue(ints), Int32Value(0), Int32Value(0)); !errors.Is(err, heap.ErrTypeMismatch) {
+		t.Errorf("Expected reading an int32 array as a buffer to fail, got %v", err)
+	}
+}
+
+func TestMapFile(t *testing.T) {
+	root := t.TempDir()
+	path := filepath.Join(root, "data.bin")
+	if err := os.WriteFile(path, []byte{0, 0, 1, 2, 'x'}, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	program, err := bytecode.Decode(mustReadTestProgram(t, "testdata/strings.gvmbc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	newMachine := func(root string) *VM {
+		machine, err := NewVmFromProgram(program, Options{MapRoot: root})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { machine.Close() })
+		return machine
+	}
+	mapFile := func(machine *VM, name string, mode int32) (uintptr, error) {
+		namePtr, err := machine.Heap.AllocateString(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		machine.push(PtrValue(namePtr))
+		machine.push(Int32Value(mode))
+		if err := catchRuntimeError(func() { machine.executeSystemCall(MMAP_FILE) }); err != nil {
+			return 0, err
+		}
+		return machine.pop().AsPtr(), nil
+	}
+
+	if _, err := mapFile(newMachine(""), "data.bin", MapReadOnly); !errors.Is(err, ErrFileAccess) {
+		t.Errorf("Expected mapping without a map root to fail, got %v", err)
+	}
+	machine := newMachine(root)
+	for _, name := range []string{"../data.bin", "/etc/passwd", "missing.bin"} {
+		if _, err := mapFile(machine, name, MapReadOnly); !errors.Is(err, ErrFileAccess) {
+			t.Errorf("Expected mapping %q to fail, got %v", name, err)
+		}
+	}
+	outside := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(outside, []byte("secret"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(root, "link")); err == nil {
+		if _, err := mapFile(machine, "link", MapReadOnly); !errors.Is(err, ErrFileAccess) {
+			t.Errorf("Expected a link out of the map root to fail, got %v", err)
+		}
+	}
+
+	readOnly, err := mapFile(machine, "data.bin", MapReadOnly)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := machine.Heap.ArrayLength(readOnly); err != nil || n != 5 {
+		t.Errorf("Expected 5 bytes, got %d, %v", n, err)
+	}
+	if value, err := machine.Heap.BufferGet(readOnly, 0, ValueInt32, binary.BigEndian); err != nil || value.AsInt32() != 258 {
+		t.Errorf("Expected 258 at 0, got %v, %v", value, err)
+	}
+	if err := machine.Heap.SetArrayElement(readOnly, 4, ByteValue('y')); !errors.Is(err, heap.ErrReadOnly) {
+		t.Errorf("Expected a write to the read-only mapping to fail, got %v", err)
+	}
+
+	private, err := mapFile(machine, "data.bin", MapCopyOnWrite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := machine.Heap.SetArrayElement(private, 4, ByteValue('y')); err != nil {
+		t.Fatal(err)
+	}
+	if element, err := machine.Heap.GetArrayElement(private, 4); err != nil || element.AsByte() != 'y' {
+		t.Errorf("Expected the write to read back, got %v, %v", element, err)
+	}
+	for _, ptr := range []uintptr{readOnly, private} {
+		if err := machine.Heap.Free(ptr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if data, err := os.ReadFile(path); err != nil || data[4] != 'x' {
+		t.Errorf("Expected the file not to change, got %q, %v", data, err)
+	}
+}
+
+func TestSyscallSignatures(t *testing.T) {
+	for call := STR_LEN; call <= TIME_PARSE; call++ {
+		if _, ok := call.Signature(); !ok {
+			t.Errorf("Expected a signature for %v", call)
+		}
+	}
+	if _, ok := Systemcall(TIME_PARSE + 1).Signature(); ok {
+		t.Error("Expected no signature past the last system call")
+	}
+	signature, _ := SUBSTR_VIEW.Signature()
+	if got, want := signature.String(), "ptr:s, int32:offset, int32:length → ptr:view"; got != want {
+		t.Errorf("Expected %q, got %q", want, got)
+	}
+	signature, _ = ASSERT_EQ.Signature()
+	if got, want := signature.String(), "?:expected, ?:actual →"; got != want {
+		t.Errorf("Expected %q, got %q", want, got)
+	}
+	d := newTestDebugger(t, join([]byte{byte(SYSCALL), 0, byte(GET_ENV)}, []byte{byte(HALT)}))
+	e, err := d.Explain()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	e.WriteTo(&out)
+	if !strings.Contains(out.String(), "Stack:   ptr:name → ptr:value") {
+		t.Errorf("Expected the explanation to show the signature of GET_ENV, got\n%s", out.String())
+	}
+}
+
+func TestOptParse(t *testing.T) {
+	program, err := bytecode.Decode(mustReadTestProgram(t, "testdata/optparse.gvmbc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		args  []string
+		want  string
+		fails string
+	}{
+		{nil, `["", "10", "", []]`, ""},
+		{[]string{"-v", "-name=ada", "--count", "3", "in.txt", "-x"}, `["1", "3", "ada", ["in.txt", "-x"]]`, ""},
+		{[]string{"-count=", "--", "-v"}, `["", "", "", ["-v"]]`, ""},
+		{[]string{"-", "-v"}, `["", "10", "", ["-", "-v"]]`, ""},
+		{[]string{"-y"}, "", "-y is not an option"},
+		{[]string{"-v=1"}, "", "-v is a flag and takes no value"},
+		{[]string{"-name"}, "", "-name needs a value"},
+	} {
+		var out bytes.Buffer
+		machine, err := NewVmFromProgram(program, Options{Stdout: &out, Args: tc.args})
+		if err != nil {
+			t.Fatal(err)
+		}
+		runErr := machine.Run()
+		machine.Close()
+		if tc.fails != "" {
+			if _, code, _ := catchable(runErr); code != CodeBadOption || !strings.Contains(runErr.Error(), tc.fails) {
+				t.Errorf("Expected %q to fail with %q and code %d, got %v", tc.args, tc.fails, CodeBadOption, runErr)
+			}
+			continue
+		}
+		if runErr != nil {
+			t.Fatalf("Parsing %q failed: %v", tc.args, runErr)
+		}
+		if out.String() != tc.want {
+			t.Errorf("Expected %q to parse as %s, got %s", tc.args, tc.want, out.String())
+		}
+	}
+}
+
+func TestCSVSyscalls(t *testing.T) {
+	program, err := bytecode.Decode(mustReadTestProgram(t, "testdata/csv.gvmbc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	machine, err := NewVmFromProgram(program, Options{Stdout: &out})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer machine.Close()
+	if err := machine.Run(); err != nil {
+		t.Fatal(err)
+	}
+	want := `[["name", "city"], ["ada", "London, UK"], ["say \"hi\"", ""]]` + "\n" +
+		"name,city\nada,\"London, UK\"\n\"say \"\"hi\"\"\",\n"
+	if out.String() != want {
+		t.Errorf("Expected\n%s\ngot\n%s", want, out.String())
+	}
+	textPtr, err := machine.Heap.AllocateString("a,\"b\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	machine.push(PtrValue(textPtr))
+	err = catchRuntimeError(func() { machine.executeSystemCall(CSV_PARSE) })
+	if _, code, _ := catchable(err); code != CodeMalformedCSV {
+		t.Errorf("Expected an unclosed quote to fail with code %d, got %v", CodeMalformedCSV, err)
+	}
+	rows, err := machine.Heap.AllocateArray(ValuePtr, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	row, err := machine.Heap.AllocateArray(ValueInt32, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := machine.Heap.SetArrayElement(rows, 0, PtrValue(row)); err != nil {
+		t.Fatal(err)
+	}
+	machine.push(PtrValue(rows))
+	if err := catchRuntimeError(func() { machine.executeSystemCall(CSV_WRITE) }); err == nil {
+		t.Error("Expected CSV_WRITE of a row of int32s to fail")
+	}
+}
+
+func TestDateTimeSyscalls(t *testing.T) {
+	program, err := bytecode.Decode(mustReadTestProgram(t, "testdata/datetime.gvmbc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		clock func() time.Time
+		year  string
+	}{
+		{nil, "1970"},
+		{func() time.Time { return time.Date(2031, 12, 31, 23, 0, 0, 0, time.FixedZone("", -2*3600)) }, "2032"},
+	} {
+		var out bytes.Buffer
+		machine, err := NewVmFromProgram(program, Options{Stdout: &out, Clock: tc.clock})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := machine.Run(); err != nil {
+			t.Fatal(err)
+		}
+		want := "DateTime{year: 2024, month: 2, day: 28, hour: 21, minute: 30, second: 0, millisecond: 0}\n" +
+			`"Fri 1 Mar 2024 21:30"` + "\n" + tc.year
+		if out.String() != want {
+			t.Errorf("Expected\n%s\ngot\n%s", want, out.String())
+		}
+		machine.Close()
+	}
+	machine, err := NewVmFromProgram(program, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer machine.Close()
+	for _, s := range []string{"yesterday", "2006-01-02"} {
+		ptr, err := machine.Heap.AllocateString(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		machine.push(PtrValue(ptr))
+	}
+	err = catchRuntimeError(func() { machine.executeSystemCall(TIME_PARSE) })
+	if _, code, _ := catchable(err); code != CodeMalformedTime {
+		t.Errorf("Expected parsing a bad date to fail with code %d, got %v", CodeMalformedTime, err)
+	}
+	layout, err := machine.Heap.AllocateString("2006")
+	if err != nil {
+		t.Fatal(err)
+	}
+	errPtr := machine.newErrorValue(1, layout, 0)
+	machine.push(PtrValue(errPtr))
+	machine.push(PtrValue(layout))
+	err = catchRuntimeError(func() { machine.executeSystemCall(TIME_FORMAT) })
+	if !errors.Is(err, heap.ErrTypeMismatch) {
+		t.Errorf("Expected formatting an Error to be a type mismatch, got %v", err)
+	}
+}
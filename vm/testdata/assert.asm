@@ -0,0 +1,28 @@
+.text
+    func main() -> void {
+        push int32 3
+        push int32 3
+        syscall assert_eq
+        stralloc "gvm"
+        stralloc "gvm"
+        syscall assert_eq
+        push float32 1.5
+        push float32 1.52
+        push float32 0.05
+        syscall assert_near
+        try caught
+        push int32 2
+        newarr int32
+        push int32 1
+        newarr int32
+        syscall assert_eq
+        endtry
+    caught:
+        fldget "code"
+        push int32 53
+        iadd
+        syscall write_byte
+        push int32 4
+        push float32 4.0
+        syscall assert_eq
+    }
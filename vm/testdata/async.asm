@@ -0,0 +1,26 @@
+.natives
+    native async func double(x: int32) -> int32
+    native async func greet(name: string) -> string
+
+.text
+    func main() -> void {
+        push int32 20
+        call double
+        store 0
+        stralloc "vm"
+        call greet
+        store 1
+        push int32 4
+        call double
+        await
+        push int32 40
+        iadd
+        syscall write_byte
+        load 0
+        await
+        syscall write_byte
+        load 1
+        await
+        syscall print_any
+        halt
+    }
@@ -0,0 +1,6 @@
+.text
+    func main() -> void {
+        push int32 1000
+        newarr int32
+        pop
+    }
@@ -0,0 +1,53 @@
+.text
+    func main() -> void {
+        push int32 8
+        newarr byte
+        store 0
+        load 0
+        push int32 0
+        push int32 258
+        push int32 1        ; big endian
+        syscall buf_put_i32
+        load 0
+        push int32 3
+        ldelem
+        syscall print_any
+        push int32 32
+        syscall write_byte
+        load 0
+        push int32 0
+        push int32 0        ; little endian
+        syscall buf_get_i32
+        syscall print_any
+        push int32 32
+        syscall write_byte
+        load 0
+        push int32 4
+        push float32 1.5
+        push int32 0
+        syscall buf_put_f32
+        load 0
+        push int32 4
+        push int32 0
+        syscall buf_get_f32
+        syscall print_any
+        push int32 32
+        syscall write_byte
+        load 0
+        push int32 4
+        push int32 1
+        syscall buf_get_i32
+        syscall print_any
+        push int32 32
+        syscall write_byte
+        try bounds
+        load 0
+        push int32 6
+        push int32 0
+        syscall buf_get_i32
+        endtry
+    bounds:
+        fldget "code"
+        syscall print_any
+        halt
+    }
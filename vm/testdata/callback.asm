@@ -0,0 +1,45 @@
+.natives
+    native func sort(xs: Array, compare: Closure) -> void
+
+.text
+    func compare(a: int32, b: int32) -> int32 {
+        store 1
+        store 0
+        load 0
+        load 1
+        isub
+        ret
+    }
+    func main() -> void {
+        push int32 3
+        newarr int32
+        store 0
+        load 0
+        push int32 0
+        push int32 53
+        stelem
+        load 0
+        push int32 1
+        push int32 51
+        stelem
+        load 0
+        push int32 2
+        push int32 52
+        stelem
+        load 0
+        makeclosure compare 0
+        call sort
+        load 0
+        push int32 0
+        ldelem
+        syscall write_byte
+        load 0
+        push int32 1
+        ldelem
+        syscall write_byte
+        load 0
+        push int32 2
+        ldelem
+        syscall write_byte
+        halt
+    }
@@ -0,0 +1,26 @@
+.text
+    func main() -> void {
+        push int32 3
+        store 0
+    loop:
+        load 0
+        ije done 0
+        call work
+        store 1
+        load 0
+        push int32 1
+        isub
+        store 0
+        jmp loop
+    done:
+        push int32 0
+        ret
+    }
+    func work() -> int32 {
+        push int32 1
+        push int32 2
+        iadd
+        push int32 3
+        iadd
+        ret
+    }
@@ -0,0 +1,37 @@
+.text
+    func main() -> void {
+        try config
+        call loadconfig
+        endtry
+    config:
+        fldget "code"
+        push int32 48
+        iadd
+        syscall write_byte
+        try bounds
+        push int32 2
+        newarr int32
+        push int32 5
+        ldelem
+        endtry
+    bounds:
+        fldget "code"
+        push int32 50
+        iadd
+        syscall write_byte
+        push int32 1
+        newarr int32
+        push int32 3
+        ldelem
+    }
+    func loadconfig() -> int32 {
+        push int32 2
+        stralloc "file not found"
+        syscall err_new
+        push int32 7
+        stralloc "cannot load config"
+        syscall err_wrap
+        throw
+        push int32 0
+        ret
+    }
@@ -0,0 +1,44 @@
+.text
+    func main() -> void {
+        push int32 3
+        newarr int32
+        store 0
+        load 0
+        push int32 0
+        push int32 1
+        stelem
+        load 0
+        push int32 1
+        push int32 2
+        stelem
+        load 0
+        push int32 2
+        push int32 3
+        stelem
+        load 0
+        arr_clone
+        store 1
+        load 1
+        arr_clone
+        store 2
+        load 1
+        push int32 0
+        push int32 10
+        stelem
+        load 0
+        push int32 1
+        push int32 20
+        stelem
+        load 0
+        syscall print_any
+        load 1
+        syscall print_any
+        load 2
+        syscall print_any
+        load 0
+        arr_clone
+        store 3
+        load 3
+        syscall print_any
+        halt
+    }
@@ -0,0 +1,59 @@
+.structs
+    struct Counter {
+        n: int32
+    }
+
+.text
+    func add(base: int32, x: int32) -> int32 {
+        store 1
+        store 0
+        load 0
+        load 1
+        iadd
+        ret
+    }
+    func bump(counter: Counter, step: int32) -> int32 {
+        store 1
+        store 0
+        load 0
+        load 0
+        fldget "n"
+        load 1
+        iadd
+        stfield "n"
+        load 0
+        fldget "n"
+        ret
+    }
+    func main() -> void {
+        push int32 48
+        makeclosure add 1
+        store 0
+        push int32 1
+        load 0
+        callclosure
+        syscall write_byte
+        newstruct Counter
+        makeclosure bump 1
+        store 1
+        push int32 50
+        load 1
+        callclosure
+        syscall write_byte
+        push int32 1
+        load 1
+        callclosure
+        syscall write_byte
+        try notclosure
+        push int32 1
+        push int32 7
+        callclosure
+        endtry
+    notclosure:
+        fldget "code"
+        push int32 54
+        iadd
+        syscall write_byte
+        push int32 0
+        ret
+    }
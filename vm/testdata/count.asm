@@ -0,0 +1,14 @@
+.text
+    func main() -> void {
+        push int32 10000
+        store 0
+    loop:
+        load 0
+        ije done 0
+        load 0
+        push int32 1
+        isub
+        store 0
+        jmp loop
+    done:
+    }
@@ -0,0 +1,31 @@
+.structs
+    struct Ratio {
+        num: int32
+        den: int32
+    }
+
+.text
+    func divide(num: int32, den: int32) -> int32 {
+        store 1
+        store 0
+        load 0
+        load 1
+        idiv
+        ret
+    }
+
+    func main() -> void {
+        newstruct Ratio
+        dup
+        push int32 7
+        stfield "num"
+        store 0
+        load 0
+        fldget "num"
+        load 0
+        fldget "den"
+        call divide
+        store 1
+        push int32 0
+        ret
+    }
@@ -0,0 +1,12 @@
+.text
+    func main() -> void {
+        stralloc "name,city\nada,\"London, UK\"\n\"say \"\"hi\"\"\",\n"
+        syscall csv_parse
+        store 0
+        load 0
+        syscall print_any
+        push int32 10
+        syscall write_byte
+        load 0
+        syscall csv_write
+    }
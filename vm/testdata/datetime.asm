@@ -0,0 +1,26 @@
+.text
+    func main() -> void {
+        stralloc "2024-02-28T23:30:00+02:00"
+        stralloc "2006-01-02T15:04:05Z07:00"
+        syscall time_parse
+        store 0
+        load 0
+        syscall print_any
+        push int32 10
+        syscall write_byte
+        load 0
+        load 0
+        fldget "day"
+        push int32 2
+        iadd
+        stfield "day"
+        load 0
+        stralloc "Mon 2 Jan 2006 15:04"
+        syscall time_format
+        syscall print_any
+        push int32 10
+        syscall write_byte
+        syscall time_now_struct
+        fldget "year"
+        syscall print_any
+    }
@@ -0,0 +1,6 @@
+.text
+    func main() -> void {
+        push int32 7
+        push int32 0
+        idiv
+    }
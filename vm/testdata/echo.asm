@@ -0,0 +1,7 @@
+.text
+    func main() -> void {
+        syscall read_byte
+        syscall write_byte
+        syscall read_byte
+        syscall write_byte
+    }
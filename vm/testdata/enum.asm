@@ -0,0 +1,37 @@
+.enum Color { RED GREEN BLUE }
+.enum Level { LOW: 10, HIGH }
+
+.structs
+    struct Light {
+        color: Color
+        level: Level
+    }
+
+.text
+    func main() -> void {
+        newstruct Light
+        dup
+        push int32 Color.GREEN
+        stfield "color"
+        dup
+        push int32 HIGH
+        stfield "level"
+        store 0
+        load 0
+        fldget "color"
+        ije green Color.GREEN
+        push int32 78
+        syscall write_byte
+        jmp done
+    green:
+        push int32 71
+        syscall write_byte
+    done:
+        load 0
+        fldget "level"
+        push int32 48
+        iadd
+        syscall write_byte
+        push int32 0
+        ret
+    }
@@ -0,0 +1,49 @@
+.structs
+    struct Digit {
+        n: int32
+    }
+
+.text
+    func digit(d: Digit) -> int32 {
+        store 0
+        load 0
+        fldget "n"
+        ret
+    }
+    func main() -> void {
+        newstruct Digit
+        dup
+        push int32 49
+        stfield "n"
+        makeclosure digit 1
+        store 1
+        stralloc "kept"
+        store 2
+        push int32 1
+        store 0
+    build:
+        load 0
+        ije done 200
+        stralloc "garbage left behind by every iteration, "
+        stralloc "concatenated into a string nothing references"
+        syscall str_cat
+        pop
+        push int32 64
+        newarr int32
+        pop
+        load 0
+        push int32 1
+        iadd
+        store 0
+        jmp build
+    done:
+        load 1
+        callclosure
+        syscall write_byte
+        load 2
+        stralloc "kept"
+        syscall str_equals
+        push int32 48
+        iadd
+        syscall write_byte
+    }
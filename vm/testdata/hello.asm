@@ -0,0 +1,9 @@
+.text
+    func main() -> void {
+        push byte 72
+        syscall write_byte
+        push byte 105
+        syscall write_byte
+        push byte 10
+        syscall write_byte
+    }
@@ -0,0 +1,40 @@
+.text
+    func main() -> void {
+        push int32 3
+        newarr int32
+        dup
+        push int32 0
+        push int32 49
+        stelem
+        dup
+        push int32 1
+        push int32 50
+        stelem
+        dup
+        push int32 2
+        push int32 51
+        stelem
+        push int32 0
+    digits:
+        foriter count
+        syscall write_byte
+        jmp digits
+    count:
+        push int32 48
+        store 0
+        stralloc "héllo"
+        push int32 0
+    runes:
+        foriter done
+        pop
+        load 0
+        push int32 1
+        iadd
+        store 0
+        jmp runes
+    done:
+        load 0
+        syscall write_byte
+        push int32 0
+        ret
+    }
@@ -0,0 +1,24 @@
+.text
+    func main() -> void {
+        push int32 5000
+        newarr int32
+        store 0
+        load 0
+        push int32 1022
+        push int32 52
+        stelem
+        load 0
+        push int32 4999
+        push int32 55
+        stelem
+        load 0
+        push int32 1022
+        ldelem
+        syscall write_byte
+        load 0
+        push int32 4999
+        ldelem
+        syscall write_byte
+        push int32 0
+        ret
+    }
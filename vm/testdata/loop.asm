@@ -0,0 +1,5 @@
+.text
+    func main() -> void {
+    loop:
+        jmp loop
+    }
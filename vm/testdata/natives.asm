@@ -0,0 +1,18 @@
+.natives
+    native func add(a: int32, b: int32) -> int32
+    native func say(s: string) -> void
+
+.text
+    func main() -> void {
+        push int32 40
+        push int32 2
+        call add
+        ijne bad 42
+        stralloc "native"
+        call say
+        halt
+    bad:
+        push int32 33
+        syscall write_byte
+        halt
+    }
@@ -0,0 +1,7 @@
+.text
+    func main() -> void {
+        syscall argv
+        stralloc "v count=10 name="
+        syscall opt_parse
+        syscall print_any
+    }
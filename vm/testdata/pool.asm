@@ -0,0 +1,70 @@
+.text
+    func main() -> void {
+        push int32 3
+        store 0
+    loop1:
+        load 0
+        push int32 48
+        iadd
+        syscall write_byte
+        load 0
+        push int32 1
+        isub
+        dup
+        store 0
+        ijne loop1 0
+        push int32 1
+        store 0
+    loop2:
+        load 0
+        push int32 48
+        iadd
+        syscall write_byte
+        load 0
+        push int32 1
+        isub
+        dup
+        store 0
+        ijne loop2 0
+        push int32 2
+        store 0
+    loop3:
+        load 0
+        push int32 48
+        iadd
+        syscall write_byte
+        load 0
+        push int32 1
+        isub
+        dup
+        store 0
+        ijne loop3 0
+        push int32 1
+        store 0
+    loop4:
+        load 0
+        push int32 48
+        iadd
+        syscall write_byte
+        load 0
+        push int32 1
+        isub
+        dup
+        store 0
+        ijne loop4 0
+        push int32 4
+        store 0
+    loop5:
+        load 0
+        push int32 48
+        iadd
+        syscall write_byte
+        load 0
+        push int32 1
+        isub
+        dup
+        store 0
+        ijne loop5 0
+        push int32 0
+        ret
+    }
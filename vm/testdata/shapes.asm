@@ -0,0 +1,90 @@
+.structs
+    struct Square {
+        side: int32
+    }
+    struct Rect {
+        w: int32
+        h: int32
+    }
+    interface Shape {
+        area() -> int32
+        scale(factor: int32) -> int32
+    }
+
+.text
+    func Square.area() -> int32 {
+        fldget "side"
+        store 0
+        load 0
+        load 0
+        imul
+        ret
+    }
+    func Square.scale(factor: int32) -> int32 {
+        store 1
+        store 0
+        load 0
+        load 0
+        fldget "side"
+        load 1
+        imul
+        stfield "side"
+        load 0
+        fldget "side"
+        ret
+    }
+    func Rect.area() -> int32 {
+        dup
+        fldget "w"
+        store 0
+        fldget "h"
+        load 0
+        imul
+        ret
+    }
+    func main() -> void {
+        newstruct Square
+        dup
+        push int32 2
+        stfield "side"
+        store 0
+        newstruct Rect
+        dup
+        push int32 1
+        stfield "w"
+        dup
+        push int32 3
+        stfield "h"
+        store 1
+        load 0
+        invokeinterface Shape.area
+        push int32 48
+        iadd
+        syscall write_byte
+        load 1
+        invokeinterface Shape.area
+        push int32 48
+        iadd
+        syscall write_byte
+        load 0
+        push int32 2
+        invokeinterface Shape.scale
+        store 2
+        load 0
+        invokeinterface Shape.area
+        push int32 48
+        iadd
+        syscall write_byte
+        try nomethod
+        load 1
+        push int32 2
+        invokeinterface Shape.scale
+        endtry
+    nomethod:
+        fldget "code"
+        push int32 54
+        iadd
+        syscall write_byte
+        push int32 0
+        ret
+    }
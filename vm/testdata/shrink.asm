@@ -0,0 +1,122 @@
+.structs
+    struct Square {
+        side: int32
+    }
+    struct Rect {
+        w: int32
+        h: int32
+    }
+    interface Shape {
+        area() -> int32
+    }
+
+.text
+    func unused(x: int32) -> int32 {
+        store 0
+        load 0
+        ijne a 7
+    a:
+        load 0
+        ijne b 7
+    b:
+        load 0
+        ijne c 7
+    c:
+        load 0
+        ijne d 7
+    d:
+        load 0
+        ijne e 7
+    e:
+        load 0
+        ret
+    }
+    func unusedCaller() -> int32 {
+        push int32 1
+        call unused
+        ret
+    }
+    func Square.area() -> int32 {
+        fldget "side"
+        dup
+        imul
+        ret
+    }
+    func Square.perimeter() -> int32 {
+        fldget "side"
+        push int32 4
+        imul
+        ret
+    }
+    func Rect.area() -> int32 {
+        dup
+        fldget "w"
+        store 0
+        fldget "h"
+        load 0
+        imul
+        ret
+    }
+    func digit(x: int32) -> int32 {
+        dup
+        push int32 48
+        iadd
+        syscall write_byte
+        ret
+    }
+    func countdown(n: int32) -> int32 {
+        store 0
+    again:
+        load 0
+        call digit
+        pop
+        load 0
+        push int32 1
+        isub
+        dup
+        store 0
+        ijne again 0
+        load 0
+        ijne skip1 0
+    skip1:
+        load 0
+        ijne skip2 0
+    skip2:
+        load 0
+        ijne skip3 0
+    skip3:
+        load 0
+        ijne skip4 0
+    skip4:
+        load 0
+        ret
+    }
+    func add(base: int32, x: int32) -> int32 {
+        store 1
+        store 0
+        load 0
+        load 1
+        iadd
+        ret
+    }
+    func main() -> void {
+        push int32 3
+        call countdown
+        pop
+        push int32 48
+        makeclosure add 1
+        store 0
+        push int32 5
+        load 0
+        callclosure
+        syscall write_byte
+        newstruct Square
+        dup
+        push int32 3
+        stfield "side"
+        invokeinterface Shape.area
+        call digit
+        pop
+        push int32 0
+        ret
+    }
@@ -0,0 +1,12 @@
+.text
+    func main() -> void {
+        push int32 4
+        newarr int32
+        store 0
+        push int32 8
+        newarr int32
+        store 1
+        load 0
+        free
+        halt
+    }
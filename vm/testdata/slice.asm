@@ -0,0 +1,50 @@
+.text
+    func main() -> void {
+        push int32 5
+        newarr int32
+        store 0
+        push int32 0
+        store 1
+    fill:
+        load 1
+        push int32 5
+        eq
+        ijne filled 0
+        load 0
+        load 1
+        load 1
+        stelem
+        load 1
+        push int32 1
+        iadd
+        store 1
+        jmp fill
+    filled:
+        load 0
+        push int32 1
+        push int32 3
+        slice
+        store 2
+        load 2
+        syscall print_any
+        load 2
+        push int32 0
+        push int32 10
+        stelem
+        load 2
+        push int32 1
+        push int32 2
+        slice
+        syscall print_any
+        load 0
+        syscall print_any
+        try bounds
+        load 2
+        push int32 3
+        ldelem
+        endtry
+    bounds:
+        fldget "code"
+        syscall print_any
+        halt
+    }
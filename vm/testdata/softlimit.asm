@@ -0,0 +1,17 @@
+.text
+    func checkpoint(remaining: int32) -> void {
+        syscall print_any
+        retv
+    }
+    func main() -> void {
+        makeclosure checkpoint 0
+        syscall on_soft_limit
+        push int32 0
+        store 0
+    loop:
+        load 0
+        push int32 1
+        iadd
+        store 0
+        jmp loop
+    }
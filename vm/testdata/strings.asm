@@ -0,0 +1,9 @@
+.text
+    func main() -> void {
+        stralloc "short"
+        stralloc "this string is much longer than the sixty four bytes kept in audit entries"
+        syscall str_cat
+        syscall str_len
+        push byte 33
+        syscall write_byte
+    }
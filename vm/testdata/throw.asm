@@ -0,0 +1,18 @@
+.text
+    func main() -> void {
+        call loadconfig
+        store 0
+        push int32 0
+        ret
+    }
+    func loadconfig() -> int32 {
+        push int32 2
+        stralloc "file not found"
+        syscall err_new
+        push int32 7
+        stralloc "cannot load config"
+        syscall err_wrap
+        throw
+        push int32 0
+        ret
+    }
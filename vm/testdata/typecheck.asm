@@ -0,0 +1,49 @@
+.structs
+    struct Point {
+        x: int32
+    }
+    struct Pair {
+        a: int32
+    }
+
+.text
+    func main() -> void {
+        newstruct Point
+        instanceof Point
+        push int32 48
+        iadd
+        syscall write_byte
+        newstruct Point
+        instanceof Pair
+        push int32 48
+        iadd
+        syscall write_byte
+        push int32 2
+        newarr int32
+        instanceof int32[]
+        push int32 48
+        iadd
+        syscall write_byte
+        stralloc "hi"
+        instanceof string
+        push int32 48
+        iadd
+        syscall write_byte
+        try mismatch
+        newstruct Pair
+        checkcast Point
+        endtry
+    mismatch:
+        fldget "code"
+        push int32 54
+        iadd
+        syscall write_byte
+        newstruct Point
+        checkcast Point
+        instanceof Point
+        push int32 48
+        iadd
+        syscall write_byte
+        newstruct Point
+        checkcast int32[]
+    }
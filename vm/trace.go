@@ -0,0 +1,97 @@
+package vm
+
+import (
+	"fmt"
+	"strings"
+
+	. "github.com/AndreiAlbert/gvm/common"
+)
+
+// traceStackValues is the number of values from the top of the operand
+// stack shown in a trace line
+const traceStackValues = 4
+
+// pendingTrace is the trace line of the executing instruction, written
+// once the instruction completed and its stack effect is known
+type pendingTrace struct {
+	pending bool
+	head    string
+	depth   int
+	// before is a copy of the operand stack before the instruction
+	before []Value
+}
+
+// traceInstruction starts the trace line of the instruction about to
+// execute with its address, name and the call depth, and saves the operand
+// stack for finishTrace.
+func (v *VM) traceInstruction(opcode Opcode) {
+	if v.traceLine.pending {
+		// a native running guest code: the instruction calling it is
+		// written without its effect, before the instructions it runs
+		fmt.Fprintf(v.trace, "%s  [%s]\n", v.traceLine.head, formatStack(v.traceLine.before, len(v.traceLine.before), v.floatFormat))
+	}
+	name := opcode.String()
+	if opcode == WIDE && int(v.Ip) < len(v.Bytecode) {
+		name += " " + Opcode(v.Bytecode[v.Ip]).String()
+	}
+	v.traceLine.pending = true
+	v.traceLine.head = fmt.Sprintf("%08x  %-12s depth=%d", v.instructionStart, name, len(v.CallStack))
+	v.traceLine.depth = len(v.CallStack)
+	v.traceLine.before = append(v.traceLine.before[:0], v.operandStack()...)
+}
+
+// finishTrace writes the trace line of the instruction that just executed
+// with its stack effect: the values it popped and those it pushed, such as
+// [.., 3, 4] -> [.., 7] for an IADD. An instruction leaving the stack alone
+// shows its top, one entering or leaving a function the top of the stack
+// of the new frame, and a failing one the stack it started from.
+func (v *VM) finishTrace(failed bool) {
+	if !v.traceLine.pending {
+		return
+	}
+	v.traceLine.pending = false
+	before, after := v.traceLine.before, v.operandStack()
+	var effect string
+	switch {
+	case failed:
+		effect = fmt.Sprintf("[%s] -> failed", formatStack(before, len(before), v.floatFormat))
+	case len(v.CallStack) != v.traceLine.depth:
+		effect = fmt.Sprintf("[%s] -> depth=%d [%s]", formatStack(before, len(before), v.floatFormat), len(v.CallStack), formatStack(after, len(after), v.floatFormat))
+	default:
+		kept := 0
+		for kept < len(before) && kept < len(after) && before[kept] == after[kept] {
+			kept++
+		}
+		if kept == len(before) && kept == len(after) {
+			effect = fmt.Sprintf("[%s]", formatStack(before, len(before), v.floatFormat))
+		} else {
+			effect = fmt.Sprintf("[%s] -> [%s]", formatStack(before, len(before)-kept, v.floatFormat), formatStack(after, len(after)-kept, v.floatFormat))
+		}
+	}
+	fmt.Fprintf(v.trace, "%s  %s\n", v.traceLine.head, effect)
+}
+
+// operandStack returns the operand stack of the current frame
+func (v *VM) operandStack() []Value {
+	if len(v.CallStack) == 0 {
+		return nil
+	}
+	return v.getCurrentFrame().LocalStack
+}
+
+// formatStack formats the top count values of the stack, at most
+// traceStackValues of them, with .. standing for the values below
+func formatStack(stack []Value, count int, format FloatFormat) string {
+	var text strings.Builder
+	count = min(count, traceStackValues)
+	if count < len(stack) {
+		text.WriteString("..")
+	}
+	for _, value := range stack[len(stack)-count:] {
+		if text.Len() > 0 {
+			text.WriteString(", ")
+		}
+		fmt.Fprintf(&text, "%v:%s", value.Kind(), value.Format(format))
+	}
+	return text.String()
+}
@@ -0,0 +1,47 @@
+package vm
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/AndreiAlbert/gvm/bytecode"
+	. "github.com/AndreiAlbert/gvm/common"
+)
+
+func TestTraceStackEffects(t *testing.T) {
+	code := append(append(append(pushInt(9), pushInt(3)...), pushInt(4)...), byte(IADD))
+	code = append(append(append(code, byte(DUP)), pushInt(0)...), byte(IDIV))
+	program := &bytecode.Program{
+		Functions: []bytecode.Function{{Name: "main", IsMain: true, ReturnType: ValueVoid}},
+		Code:      code,
+	}
+	var trace bytes.Buffer
+	machine, err := NewVmFromProgram(program, Options{Stdout: io.Discard, Trace: &trace})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer machine.Close()
+	if err := machine.Run(); err == nil {
+		t.Fatal("Expected the division by zero to stop the program")
+	}
+	lines := strings.Split(strings.TrimSuffix(trace.String(), "\n"), "\n")
+	want := []string{
+		"[] -> [int32:9]",
+		"[..] -> [.., int32:3]",
+		"[..] -> [.., int32:4]",
+		"[.., int32:3, int32:4] -> [.., int32:7]",
+		"[..] -> [.., int32:7]",
+		"[..] -> [.., int32:0]",
+		"[int32:9, int32:7, int32:7, int32:0] -> failed",
+	}
+	if len(lines) != len(want) {
+		t.Fatalf("Expected %d trace lines, got:\n%s", len(want), trace.String())
+	}
+	for i, line := range lines {
+		if !strings.HasSuffix(line, "  "+want[i]) {
+			t.Errorf("Expected line %d to end with %q, got %q", i, want[i], line)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ExecutionPoint is where a run of a program stands: the instruction it
+// executes next, or how it stopped.
+type ExecutionPoint struct {
+	Address  uint
+	Opcode   Opcode
+	Function string
+	// Line is the source line of the instruction, 0 without a source map
+	Line  uint32
+	Depth int
+	// Done is set once the program stopped, with the error it failed
+	// with, if any
+	Done bool
+	Err  error
+}
+
+func (p ExecutionPoint) String() string {
+	if p.Done {
+		if p.Err != nil {
+			return fmt.Sprintf("failed: %v", p.Err)
+		}
+		return "halted"
+	}
+	return fmt.Sprintf("%s line %d (%08x %v, depth %d)", p.Function, p.Line, p.Address, p.Opcode, p.Depth)
+}
+
+// sameLine reports whether p and q execute the same source line of the
+// same function call, or both stopped the same way
+func (p ExecutionPoint) sameLine(q ExecutionPoint) bool {
+	if p.Done || q.Done {
+		return p.Done && q.Done && errorString(p.Err) == errorString(q.Err)
+	}
+	return p.Function == q.Function && p.Line == q.Line && p.Depth == q.Depth
+}
+
+func errorString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+// Divergence is where two runs of versions of a program stopped executing
+// the same source lines.
+type Divergence struct {
+	// Lines is the number of source lines both runs executed before they
+	// diverged, Last the last of them
+	Lines int
+	Last  ExecutionPoint
+	// A and B are where each run went instead
+	A, B ExecutionPoint
+}
+
+// ErrNoSourceMap is returned by DiffExecutions for a program without
+// source map.
+var ErrNoSourceMap = errors.New("program has no source map")
+
+// DiffExecutions runs a and b, two versions of the same program assembled
+// from sources with the same line numbers, such as before and after an
+// optimization, in lockstep by source line: whichever instructions a line
+// assembled to, both runs must go through the same lines of the same
+// functions in the same order. It returns the first line where they don't,
+// or nil if both ran the same lines and stopped the same way. The programs
+// run to completion, or to the first divergence, so a and b should be
+// created with an instruction limit.
+func DiffExecutions(a, b *VM) (*Divergence, error) {
+	for _, v := range []*VM{a, b} {
+		if len(v.lines) == 0 {
+			return nil, ErrNoSourceMap
+		}
+	}
+	diff := &Divergence{}
+	pointA, pointB := a.executionPoint(nil), b.executionPoint(nil)
+	for {
+		if !pointA.sameLine(pointB) {
+			diff.A, diff.B = pointA, pointB
+			return diff, nil
+		}
+		if pointA.Done {
+			return nil, nil
+		}
+		diff.Lines++
+		diff.Last = pointA
+		pointA, pointB = a.runLine(pointA), b.runLine(pointB)
+	}
+}
+
+// runLine executes the instructions of the source line the VM is at, from
+// point, and returns where the program stands after them
+func (v *VM) runLine(point ExecutionPoint) ExecutionPoint {
+	for {
+		if err := v.Step(); err != nil || !v.Running {
+			return v.executionPoint(err)
+		}
+		if next := v.executionPoint(nil); !next.sameLine(point) {
+			return next
+		}
+	}
+}
+
+// executionPoint returns where the program stands, which failed with err
+// if it isn't nil
+func (v *VM) executionPoint(err error) ExecutionPoint {
+	if err != nil || !v.Running {
+		return ExecutionPoint{Done: true, Err: err}
+	}
+	point := ExecutionPoint{Address: v.Ip, Depth: len(v.CallStack)}
+	if v.Ip < uint(len(v.Bytecode)) {
+		point.Opcode = Opcode(v.Bytecode[v.Ip])
+	}
+	if len(v.CallStack) > 0 {
+		point.Function = v.frameFunctionName(len(v.CallStack) - 1)
+	}
+	point.Line, _ = v.sourceLine(v.Ip)
+	return point
+}
@@ -0,0 +1,51 @@
+package vm
+
+import (
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/AndreiAlbert/gvm/bytecode"
+	. "github.com/AndreiAlbert/gvm/common"
+)
+
+func TestDiffExecutions(t *testing.T) {
+	newMachine := func(code []byte, lines ...bytecode.LineEntry) *VM {
+		program := &bytecode.Program{
+			Functions: []bytecode.Function{{Name: "main", IsMain: true, ReturnType: ValueVoid}},
+			Code:      code,
+			Lines:     lines,
+		}
+		machine, err := NewVmFromProgram(program, Options{Stdout: io.Discard, MaxInstructions: 100})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { machine.Close() })
+		return machine
+	}
+	// push 1, push 2, iadd, halt on lines 1 to 4, and the same with the
+	// addition folded into a push 3 on line 1
+	unfolded := func() *VM {
+		code := append(append(pushInt(1), pushInt(2)...), byte(IADD), byte(HALT))
+		return newMachine(code, bytecode.LineEntry{Address: 0, Line: 1}, bytecode.LineEntry{Address: 6, Line: 2},
+			bytecode.LineEntry{Address: 12, Line: 3}, bytecode.LineEntry{Address: 13, Line: 4})
+	}
+	folded := newMachine(append(pushInt(3), byte(HALT)), bytecode.LineEntry{Address: 0, Line: 1}, bytecode.LineEntry{Address: 6, Line: 4})
+
+	diff, err := DiffExecutions(unfolded(), unfolded())
+	if err != nil || diff != nil {
+		t.Fatalf("Expected identical runs, got %+v, %v", diff, err)
+	}
+	diff, err = DiffExecutions(unfolded(), folded)
+	if err != nil || diff == nil {
+		t.Fatalf("Expected the runs to diverge, got %v", err)
+	}
+	if diff.Lines != 1 || diff.Last.Line != 1 || diff.A.Line != 2 || diff.A.Opcode != PUSH || diff.B.Line != 4 || diff.B.Opcode != HALT {
+		t.Errorf("Unexpected divergence: %+v", diff)
+	}
+
+	stripped := newMachine(append(pushInt(3), byte(HALT)))
+	if _, err := DiffExecutions(unfolded(), stripped); !errors.Is(err, ErrNoSourceMap) {
+		t.Errorf("Expected ErrNoSourceMap, got %v", err)
+	}
+}
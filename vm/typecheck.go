@@ -0,0 +1,82 @@
+package vm
+
+import (
+	"fmt"
+
+	. "github.com/AndreiAlbert/gvm/common"
+	"github.com/AndreiAlbert/gvm/heap"
+)
+
+// typeRef is the type operand of CHECKCAST and INSTANCEOF
+type typeRef struct {
+	Kind ValueKind
+	// Element is the element kind of an array type
+	Element ValueKind
+	// Struct is the name of a struct type
+	Struct string
+}
+
+// String formats the type as the assembler writes it
+func (t typeRef) String() string {
+	switch t.Kind {
+	case ValueStruct:
+		return t.Struct
+	case ValueArray:
+		return t.Element.String() + "[]"
+	default:
+		return t.Kind.String()
+	}
+}
+
+// extractTypeRef reads a type operand
+func (v *VM) extractTypeRef() typeRef {
+	t := typeRef{Kind: ValueKind(v.getByte())}
+	switch t.Kind {
+	case ValueStruct:
+		t.Struct = v.extractString()
+	case ValueArray:
+		t.Element = ValueKind(v.getByte())
+	}
+	return t
+}
+
+// checkType returns why value doesn't refer to an object of type t, nil if
+// it does. The error wraps heap.ErrTypeMismatch or heap.ErrInvalidAddress,
+// so a TRY handler can catch it.
+func (v *VM) checkType(value Value, t typeRef) error {
+	switch value.Kind() {
+	case ValuePtr, ValueString, ValueArray, ValueStruct:
+	default:
+		return fmt.Errorf("%w: expected a pointer to %v, got %v", heap.ErrTypeMismatch, t, value.Kind())
+	}
+	got, err := v.objectType(value.Ptr())
+	if err != nil {
+		return err
+	}
+	if got != t {
+		return fmt.Errorf("%w: expected %v, got %v", heap.ErrTypeMismatch, t, got)
+	}
+	return nil
+}
+
+// objectType returns the type of the heap object at ptr
+func (v *VM) objectType(ptr uintptr) (typeRef, error) {
+	kind, err := v.Heap.ObjectKind(ptr)
+	if err != nil {
+		return typeRef{}, err
+	}
+	t := typeRef{Kind: kind}
+	switch kind {
+	case ValueStruct:
+		structType, err := v.Heap.StructTypeOf(ptr)
+		if err != nil {
+			return typeRef{}, err
+		}
+		t.Struct = structType.Name
+	case ValueArray:
+		if t.Element, err = v.Heap.ArrayElementKind(ptr); err != nil {
+			return typeRef{}, err
+		}
+	}
+	return t, nil
+}
@@ -0,0 +1,103 @@
+package vm
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/AndreiAlbert/gvm/heap"
+)
+
+// Usage summarizes the resources a program used.
+type Usage struct {
+	Instructions  uint64 `json:"instructions"`
+	PeakCallDepth int    `json:"peak_call_depth"`
+	// PeakHeapBytes is the largest size the live heap reached
+	PeakHeapBytes uint64 `json:"peak_heap_bytes"`
+	// HeapBytesAllocated sums all allocations, including freed blocks
+	HeapBytesAllocated uint64 `json:"heap_bytes_allocated"`
+	Allocations        uint64 `json:"allocations"`
+	// HeapSizeClasses count the heap blocks by size class, see
+	// heap.Heap.SizeClasses
+	HeapSizeClasses []heap.SizeClass `json:"heap_size_classes,omitempty"`
+	// HeapFragmentation estimates the share of memory a size class
+	// allocator would waste on the live blocks, see heap.Heap.Fragmentation
+	HeapFragmentation float64 `json:"heap_fragmentation"`
+	// Syscalls counts the executed system calls by name
+	Syscalls map[string]uint64 `json:"syscalls,omitempty"`
+	// GCCollections and GCMinorCollections count the full and the minor
+	// collections, GCCollectedBytes the size of the blocks they freed and
+	// GCPauseTotal and GCPauseMax the time the program stood still for them
+	GCCollections      uint64        `json:"gc_collections,omitempty"`
+	GCMinorCollections uint64        `json:"gc_minor_collections,omitempty"`
+	GCCollectedBytes   uint64        `json:"gc_collected_bytes,omitempty"`
+	GCPauseTotal       time.Duration `json:"gc_pause_total_ns,omitempty"`
+	GCPauseMax         time.Duration `json:"gc_pause_max_ns,omitempty"`
+	WallTime           time.Duration `json:"wall_time_ns"`
+}
+
+func (v *VM) notePeakDepth() {
+	if len(v.CallStack) > v.peakDepth {
+		v.peakDepth = len(v.CallStack)
+	}
+}
+
+// Usage returns the resources used by the program so far. The initial
+// frame counts towards the call depth, so a program that calls nothing has
+// a depth of 1.
+func (v *VM) Usage() Usage {
+	usage := Usage{
+		Instructions:       v.instructions,
+		PeakCallDepth:      v.peakDepth,
+		PeakHeapBytes:      uint64(v.Heap.Peak()),
+		HeapBytesAllocated: v.Heap.TotalAllocated(),
+		Allocations:        v.Heap.Allocations(),
+		HeapSizeClasses:    v.Heap.SizeClasses(),
+		HeapFragmentation:  v.Heap.Fragmentation(),
+		GCCollections:      v.Heap.GCStats().Collections,
+		GCMinorCollections: v.Heap.GCStats().MinorCollections,
+		GCCollectedBytes:   v.Heap.GCStats().CollectedBytes,
+		GCPauseTotal:       v.gcPauses.total,
+		GCPauseMax:         v.gcPauses.longest,
+		WallTime:           v.wallTime,
+	}
+	for call, count := range v.SyscallCounts() {
+		if usage.Syscalls == nil {
+			usage.Syscalls = make(map[string]uint64)
+		}
+		usage.Syscalls[call.String()] = count
+	}
+	return usage
+}
+
+// WriteReport writes the usage as an aligned, human readable table.
+func (u Usage) WriteReport(w io.Writer) error {
+	rows := [][2]string{
+		{"instructions", fmt.Sprint(u.Instructions)},
+		{"peak call depth", fmt.Sprint(u.PeakCallDepth)},
+		{"peak heap", fmt.Sprintf("%d bytes", u.PeakHeapBytes)},
+		{"heap allocated", fmt.Sprintf("%d bytes in %d allocations", u.HeapBytesAllocated, u.Allocations)},
+		{"heap fragmentation", fmt.Sprintf("%.1f%%", 100*u.HeapFragmentation)},
+	}
+	names := make([]string, 0, len(u.Syscalls))
+	for name := range u.Syscalls {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		rows = append(rows, [2]string{"syscall " + name, fmt.Sprint(u.Syscalls[name])})
+	}
+	if u.GCCollections+u.GCMinorCollections > 0 {
+		rows = append(rows,
+			[2]string{"gc collections", fmt.Sprintf("%d full, %d minor, %d bytes freed", u.GCCollections, u.GCMinorCollections, u.GCCollectedBytes)},
+			[2]string{"gc pauses", fmt.Sprintf("%v total, %v max", u.GCPauseTotal, u.GCPauseMax)})
+	}
+	rows = append(rows, [2]string{"wall time", u.WallTime.String()})
+	for _, row := range rows {
+		if _, err := fmt.Fprintf(w, "%-22s %s\n", row[0], row[1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
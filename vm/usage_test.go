@@ -0,0 +1,77 @@
+package vm
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/AndreiAlbert/gvm/bytecode"
+)
+
+func TestUsage(t *testing.T) {
+	data, err := testPrograms.ReadFile("testdata/strings.gvmbc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	program, err := bytecode.Decode(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	machine, err := NewVmFromProgram(program, Options{Stdout: &bytes.Buffer{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer machine.Close()
+	if err := machine.Run(); err != nil {
+		t.Fatalf("Failed to run: %v", err)
+	}
+
+	usage := machine.Usage()
+	if usage.Instructions != 7 || usage.PeakCallDepth != 1 || usage.Allocations != 3 {
+		t.Errorf("Unexpected usage: %+v", usage)
+	}
+	if usage.PeakHeapBytes == 0 || usage.PeakHeapBytes != usage.HeapBytesAllocated {
+		t.Errorf("Expected the peak heap to equal the allocated bytes, got %+v", usage)
+	}
+	if usage.Syscalls["STR_CAT"] != 1 || usage.Syscalls["WRITE_BYTE"] != 1 {
+		t.Errorf("Unexpected syscall counts: %v", usage.Syscalls)
+	}
+	if usage.WallTime <= 0 {
+		t.Errorf("Expected a wall time, got %v", usage.WallTime)
+	}
+
+	var allocations, live uint64
+	var liveBytes uintptr
+	for _, class := range usage.HeapSizeClasses {
+		allocations += class.Allocations
+		live += class.Live
+		liveBytes += class.LiveBytes
+		if class.Live > 0 && class.LiveBytes > uintptr(class.Live)*class.Size {
+			t.Errorf("Expected the blocks of class %d to fit it, got %+v", class.Size, class)
+		}
+	}
+	if allocations != 3 || live != uint64(len(machine.Heap.Memory)) || liveBytes != machine.Heap.Allocated() {
+		t.Errorf("Expected the size classes to count every block, got %+v", usage.HeapSizeClasses)
+	}
+	if usage.HeapFragmentation <= 0 || usage.HeapFragmentation >= 1 {
+		t.Errorf("Expected a fragmentation between 0 and 1, got %v", usage.HeapFragmentation)
+	}
+
+	var report bytes.Buffer
+	if err := usage.WriteReport(&report); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"instructions           7\n", "peak call depth        1\n", "syscall STR_LEN        1\n", "in 3 allocations", "heap fragmentation"} {
+		if !strings.Contains(report.String(), want) {
+			t.Errorf("Expected %q in report:\n%s", want, report.String())
+		}
+	}
+
+	report.Reset()
+	if err := machine.Heap.WriteReport(&report); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(report.String(), "size class") || !strings.Contains(report.String(), "fragmentation") {
+		t.Errorf("Unexpected heap report:\n%s", report.String())
+	}
+}
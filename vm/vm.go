@@ -1,58 +1,173 @@
+// Package vm implements the stack-based interpreter that executes GVM
+// bytecode.
 package vm
 
 import (
+	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"github.com/AndreiAlbert/gvm/bytecode"
+	. "github.com/AndreiAlbert/gvm/common"
+	"github.com/AndreiAlbert/gvm/heap"
+	"io"
 	"log"
+	"log/slog"
 	"math"
-	. "stack_vm/common"
-	"stack_vm/heap"
+	"runtime"
 	"strings"
+	"time"
 )
 
+// FunctionSignature is an entry of the function table.
 type FunctionSignature struct {
+	Name             string
 	Address          uint
 	ParamCount       uint16
 	ReturnType       ValueKind
 	isMain           bool
 	ReturnStructName string
+	// MaxStack and MaxLocals size the frames of the function, see
+	// bytecode.Function. Zero MaxStack is unknown.
+	MaxStack  uint16
+	MaxLocals uint16
 }
 
+// StackFrame holds the locals and operand stack of one function call.
 type StackFrame struct {
-	Locals        map[uint16]Value
+	Locals        map[uint32]Value
 	ReturnAddress uint
 	LocalStack    []Value
+	// Function is the signature of the function executing in this frame,
+	// nil for the initial frame.
+	Function *FunctionSignature
 }
 
+// VM executes bytecode. Ip is the address of the next instruction.
 type VM struct {
 	Ip        uint
 	Bytecode  []byte
 	Running   bool
+	wide      bool // set by a WIDE prefix for the next instruction
 	CallStack []StackFrame
 	Heap      *heap.Heap
-	Functions map[uint]FunctionSignature
-	Structs   map[string]StructType
+	// the metadata of the program, which Program exposes read-only since
+	// loading structs and replacing functions change it
+	constants []uint32 // the constant pool of the program
+	functions map[uint]FunctionSignature
+	// functionList holds the signatures in declaration order. CALL
+	// operands index into it.
+	functionList []FunctionSignature
+	structs      map[string]StructType
+	// fieldNames maps the field ids used by FLDGET/STFIELD back to names.
+	fieldNames []string
+	fieldIDs   map[string]uint16
+	stdin      io.Reader
+	stdout     io.Writer
+	env        map[string]string
+	args       []string
+	clock      func() time.Time
+	mapRoot    string
+	trace      io.Writer
+	traceLine  pendingTrace
+	auditLog   io.Writer
+	auditID    string
+	logger     *slog.Logger
+	// instructions counts executed instructions against maxInstructions
+	instructions    uint64
+	maxInstructions uint64
+	// softInstructions is the soft limit, whose hooks run once when
+	// softLimitReached is set
+	softInstructions uint64
+	softLimitReached bool
+	onSoftLimit      func(*VM)
+	// softLimitHandler is the closure registered with ON_SOFT_LIMIT, the
+	// zero Value if there is none
+	softLimitHandler Value
+	// yieldInterval is how many instructions run between calls of
+	// runtime.Gosched
+	yieldInterval uint64
+	// pinned are the blocks pinned by the host, checked against
+	// pinWarnInstructions
+	pinned              map[uintptr]*pinRecord
+	pinWarnInstructions uint64
+	syscallCounts       [256]uint64
+	// counters holds the counters of COUNTER_INC by id
+	counters map[int32]uint64
+	// peakDepth is the deepest the call stack has been
+	peakDepth int
+	// wallTime is the time spent in Run and RunContext
+	wallTime time.Duration
+	profile  *profiler
+	// lines is the source map of the program, sorted by address
+	lines []bytecode.LineEntry
+	// buildInfo is what BUILD_INFO reports, nil if the container has none
+	buildInfo *bytecode.BuildInfo
+	// natives are the native declarations of the program bound to host
+	// functions, by CALLNATIVE index
+	natives []boundNative
+	// extensions are the handlers of the extension instructions
+	extensions map[Opcode]Extension
+	// callbacks is the number of guest functions called by natives that
+	// are running, bounded by maxCallbackDepth
+	callbacks        int
+	maxCallbackDepth int
+	// pending are the calls of async natives that weren't awaited yet, by
+	// handle
+	pending    map[int32]*pendingCall
+	nextHandle int32
+	// runContext is the context of the running RunContext, which AWAIT
+	// stops waiting for
+	runContext context.Context
+	// instructionStart is the address of the instruction being executed,
+	// reported in runtime errors
+	instructionStart uint
+	// handlers are the active TRY handlers, innermost last
+	handlers    []handler
+	floatFormat FloatFormat
+	// trapFloatDivision makes FDIV by zero fail instead of giving an
+	// infinity or NaN
+	trapFloatDivision bool
+	// outOfBoundsReads is what LDELEM reads outside of an array
+	outOfBoundsReads BoundsPolicy
+	// history records executed instructions for StepBack, nil unless
+	// Options.History is set
+	history *history
+	// gc runs the collections of Options.GC, nil without it
+	gc       *collector
+	gcPauses gcPauses
+	// safepoint parks Run for Pause
+	safepoint safepoint
 }
 
+// String formats the signature for debugging.
 func (f FunctionSignature) String() string {
 	var str strings.Builder
 	if f.isMain {
 		str.WriteString("Found main function\n")
 	}
+	if f.Name != "" {
+		fmt.Fprintf(&str, "Name: %s\n", f.Name)
+	}
 	fmt.Fprintf(&str, "Number of arguments: %d\n", f.ParamCount)
 	fmt.Fprintf(&str, "Address of the body: %d\n", f.Address)
 	fmt.Fprintf(&str, "Return type: %v\n", f.ReturnType)
 	return str.String()
 }
 
+// NewVm creates a VM for a raw bytecode stream, recovering the function and
+// struct tables by scanning it.
 func NewVm(bytecode []byte) *VM {
 	vm := &VM{
 		Ip:        0,
 		Bytecode:  bytecode,
 		Running:   true,
 		Heap:      heap.NewHeap(),
-		Functions: make(map[uint]FunctionSignature),
-		Structs:   make(map[string]StructType),
+		functions: make(map[uint]FunctionSignature),
+		structs:   make(map[string]StructType),
+	}
+	if err := vm.configure(Options{}); err != nil {
+		log.Fatal(err)
 	}
 	vm.buildFunctionTable()
 	hasStrucs := false
@@ -64,10 +179,135 @@ func NewVm(bytecode []byte) *VM {
 	if hasStrucs {
 		vm.buildStructsTable()
 	}
+	if err := vm.defineBuiltinStructs(); err != nil {
+		log.Fatal(err)
+	}
 	vm.PushFrame(0xFFFFFFFF)
 	return vm
 }
 
+// NewVmFromProgram creates a VM for a decoded container. The function and
+// struct tables are taken from the container header, the code section is
+// executed in place without being scanned or copied.
+func NewVmFromProgram(program *bytecode.Program, opts Options) (*VM, error) {
+	vm := &VM{
+		Ip:        0,
+		Bytecode:  program.Code,
+		constants: program.Constants,
+		lines:     program.Lines,
+		buildInfo: program.BuildInfo,
+		Running:   true,
+		Heap:      heap.NewHeap(),
+		functions: make(map[uint]FunctionSignature),
+		structs:   make(map[string]StructType),
+	}
+	if err := vm.configure(opts); err != nil {
+		return nil, err
+	}
+	foundMain := false
+	for _, f := range program.Functions {
+		if uint(f.Address) > uint(len(program.Code)) {
+			return nil, fmt.Errorf("function address %d outside of code section", f.Address)
+		}
+		signature := FunctionSignature{
+			Name:             f.Name,
+			Address:          uint(f.Address),
+			ParamCount:       f.ParamCount,
+			ReturnType:       f.ReturnType,
+			ReturnStructName: f.ReturnStructName,
+			isMain:           f.IsMain,
+			MaxStack:         f.MaxStack,
+			MaxLocals:        f.MaxLocals,
+		}
+		if f.IsMain && foundMain {
+			return nil, errors.New("multiple main functions")
+		} else if f.IsMain && f.ReturnType != ValueVoid {
+			return nil, errors.New("main function should always be void")
+		} else if f.IsMain {
+			vm.Ip = signature.Address
+			foundMain = true
+		}
+		vm.functions[signature.Address] = signature
+		vm.functionList = append(vm.functionList, signature)
+	}
+	if !foundMain {
+		return nil, errors.New("no main function found")
+	}
+	if err := checkSubtractionOrder(program); err != nil {
+		return nil, err
+	}
+	for _, structType := range program.Structs {
+		for _, field := range structType.Fields {
+			switch field.Type {
+			case ValueInt32, ValueFloat32, ValuePtr, ValueString, ValueArray, ValueStruct:
+			default:
+				return nil, fmt.Errorf("field %s.%s has unsupported type %v", structType.Name, field.Name, field.Type)
+			}
+		}
+		vm.defineStruct(structType)
+	}
+	if err := vm.defineBuiltinStructs(); err != nil {
+		return nil, err
+	}
+	vm.bindMethods()
+	if err := vm.bindNatives(program.Natives, opts.Natives); err != nil {
+		return nil, err
+	}
+	if opts.Profile {
+		vm.profile = newProfiler(program, vm.functionList)
+	}
+	vm.PushFrame(0xFFFFFFFF)
+	// main runs in the initial frame
+	main := vm.functions[vm.Ip]
+	vm.CallStack[0].Locals = make(map[uint32]Value, main.MaxLocals)
+	vm.CallStack[0].LocalStack = make([]Value, 0, main.MaxStack)
+	return vm, nil
+}
+
+// newFrame returns an empty frame for a call of the function returning to
+// returnAddress, its locals and stack allocated at the size the function
+// needs when known
+func (signature *FunctionSignature) newFrame(returnAddress uint) StackFrame {
+	return StackFrame{
+		Locals:        make(map[uint32]Value, signature.MaxLocals),
+		ReturnAddress: returnAddress,
+		LocalStack:    make([]Value, 0, signature.MaxStack),
+		Function:      signature,
+	}
+}
+
+// call enters the function at index in FunctionList, moving its arguments
+// to the stack of the new frame
+func (v *VM) call(index int) {
+	signature := v.functionList[index]
+	var args []Value
+	for i := 0; i < int(signature.ParamCount); i++ {
+		args = append(args, v.pop())
+	}
+	v.pushFrame(v.functionList[index].newFrame(v.Ip))
+	for i := len(args) - 1; i >= 0; i-- {
+		v.push(args[i])
+	}
+	v.Ip = signature.Address
+}
+
+// checkSubtractionOrder refuses containers assembled before ISUB took its
+// subtrahend from the top of the stack, when their code subtracts: they
+// would silently compute other results than they used to. Programs built
+// in memory have no version and are not checked.
+func checkSubtractionOrder(program *bytecode.Program) error {
+	if program.Version == 0 || program.Version >= bytecode.SubtractionOrderVersion {
+		return nil
+	}
+	// malformed code is left to fail when it runs
+	for _, start := range instructionStarts(program.Code) {
+		if Opcode(program.Code[start]) == ISUB {
+			return fmt.Errorf("container version %d subtracts with the operands of isub reversed, assemble the program again", program.Version)
+		}
+	}
+	return nil
+}
+
 func (v *VM) extractString() string {
 	start := v.Ip
 	for v.Bytecode[v.Ip] != 0 {
@@ -115,7 +355,8 @@ func (v *VM) buildFunctionTable() {
 				foundMain = true
 				signature.isMain = true
 			}
-			v.Functions[signature.Address] = signature
+			v.functions[signature.Address] = signature
+			v.functionList = append(v.functionList, signature)
 		} else {
 			ip++
 		}
@@ -128,64 +369,84 @@ func (v *VM) buildFunctionTable() {
 
 func (v *VM) buildStructsTable() {
 	ip := uint(0)
-	for ip < uint(len(v.Bytecode)) {
-		if v.Bytecode[ip] == byte(DEFSTRUCT) {
+	// struct definitions form a prefix of the bytecode
+	for ip < uint(len(v.Bytecode)) && v.Bytecode[ip] == byte(DEFSTRUCT) {
+		ip++
+		start := ip
+		for v.Bytecode[ip] != 0 {
 			ip++
+		}
+		structName := string(v.Bytecode[start:ip])
+		ip++
+		fieldsNumber := uint8(v.Bytecode[ip])
+		ip++
+		fields := make([]StructField, fieldsNumber)
+		for i := 0; i < int(fieldsNumber); i++ {
 			start := ip
 			for v.Bytecode[ip] != 0 {
 				ip++
 			}
-			currentOffset := uint(0)
-			structName := string(v.Bytecode[start:ip])
+			fieldName := string(v.Bytecode[start:ip])
 			ip++
-			fieldsNumber := uint8(v.Bytecode[ip])
+			fieldType := ValueKind(v.Bytecode[ip])
 			ip++
-			fields := make([]StructField, fieldsNumber)
-			for i := 0; i < int(fieldsNumber); i++ {
-				start := ip
-				for v.Bytecode[ip] != 0 {
-					ip++
-				}
-				fieldName := string(v.Bytecode[start:ip])
-				ip++
-				fieldType := ValueKind(v.Bytecode[ip])
-				ip++
 
-				var arrayType *ValueKind
+			var arrayType *ValueKind
 
-				if fieldType == ValueArray {
-					elemType := ValueKind(v.Bytecode[ip])
-					arrayType = &elemType
-					ip++
-				}
-
-				fields[i] = StructField{
-					Name:      fieldName,
-					Type:      fieldType,
-					Offset:    currentOffset,
-					ArrayType: arrayType,
-				}
-				currentOffset += uint(heap.GetElementSize(fieldType))
+			if fieldType == ValueArray {
+				elemType := ValueKind(v.Bytecode[ip])
+				arrayType = &elemType
+				ip++
 			}
-			structType := StructType{
-				Name:    structName,
-				Fields:  fields,
-				Size:    currentOffset,
-				Methods: make(map[string]uint),
+
+			fields[i] = StructField{
+				Name:      fieldName,
+				Type:      fieldType,
+				ArrayType: arrayType,
 			}
-			v.Structs[structName] = structType
-		} else {
-			ip++
 		}
+		v.defineStruct(StructType{
+			Name:    structName,
+			Fields:  fields,
+			Methods: make(map[string]uint),
+		})
+	}
+}
+
+// defineStruct lays out the fields of a struct, assigns the program-wide
+// field ids used by FLDGET/STFIELD and registers the type.
+func (v *VM) defineStruct(structType StructType) {
+	if v.fieldIDs == nil {
+		v.fieldIDs = make(map[string]uint16)
+	}
+	currentOffset := uint(0)
+	fields := make([]StructField, len(structType.Fields))
+	for i, field := range structType.Fields {
+		fieldID, ok := v.fieldIDs[field.Name]
+		if !ok {
+			fieldID = uint16(len(v.fieldNames))
+			v.fieldIDs[field.Name] = fieldID
+			v.fieldNames = append(v.fieldNames, field.Name)
+		}
+		field.ID = fieldID
+		field.Offset = currentOffset
+		fields[i] = field
+		currentOffset += uint(heap.GetElementSize(field.Type))
+	}
+	structType.Fields = fields
+	structType.Size = currentOffset
+	if structType.Methods == nil {
+		structType.Methods = make(map[string]uint)
 	}
+	v.structs[structType.Name] = structType
 }
 
+// PushFrame pushes an empty frame that returns to returnAddress.
 func (v *VM) PushFrame(returnAddress uint) {
-	frame := StackFrame{
-		Locals:        make(map[uint16]Value),
+	v.pushFrame(StackFrame{
+		Locals:        make(map[uint32]Value),
 		ReturnAddress: returnAddress,
-	}
-	v.CallStack = append(v.CallStack, frame)
+	})
 }
 
 func (v *VM) getCurrentFrame() *StackFrame {
@@ -205,44 +466,240 @@ func (v *VM) extractUInt16() uint16 {
 	return value
 }
 
+// comparand reads the value operand of a conditional jump, the 4-byte
+// immediate or, for the pooled forms, the constant pool entry its index
+// byte refers to.
+func (v *VM) comparand(pooled bool) uint32 {
+	if !pooled {
+		return v.extractUInt32()
+	}
+	index := v.getByte()
+	if int(index) >= len(v.constants) {
+		v.failf("constant %d outside of the constant pool of %d entries", index, len(v.constants))
+	}
+	return v.constants[index]
+}
+
+// extractOperand reads an address or index operand, which is 4 bytes wide
+// when the instruction carries a WIDE prefix and 2 bytes otherwise.
+func (v *VM) extractOperand() uint32 {
+	if v.wide {
+		v.wide = false
+		return v.extractUInt32()
+	}
+	return uint32(v.extractUInt16())
+}
+
 func (v *VM) getByte() byte {
 	b := v.Bytecode[v.Ip]
 	v.Ip++
 	return b
 }
 
-func (v *VM) Run() {
-	// reader := bufio.NewReader(os.Stdin)
+// Run executes instructions until the program halts. An invalid operation
+// stops the program and is returned as a *RuntimeError.
+func (v *VM) Run() error {
+	return v.RunContext(context.Background())
+}
+
+// RunContext is like Run but also stops the program once ctx is done, with
+// the context's error as the cause of the returned RuntimeError.
+func (v *VM) RunContext(ctx context.Context) error {
+	v.safepoint.enter()
+	defer v.safepoint.leave()
+	v.runContext = ctx
+	defer func() { v.runContext = nil }()
+	start := time.Now()
+	defer func() {
+		v.wallTime += time.Since(start)
+		if v.profile != nil {
+			v.profile.stop()
+		}
+	}()
+	for {
+		err := v.runInstructions(ctx)
+		if err == nil {
+			return nil
+		}
+		if !v.catch(err) {
+			v.Running = false
+			return err
+		}
+	}
+}
+
+// runInstructions executes instructions until the program halts or fails.
+func (v *VM) runInstructions(ctx context.Context) (err *RuntimeError) {
+	defer func() {
+		if r := recover(); r != nil {
+			v.finishTrace(true)
+			err = v.asRuntimeError(r)
+		}
+	}()
 	for v.Running {
-		// reader.ReadString('\n')
-		opcode := v.getByte()
-		v.execute(Opcode(opcode))
+		if v.safepoint.requested.Load() {
+			v.safepoint.park()
+		}
+		v.step(ctx)
+	}
+	return nil
+}
+
+// step executes the instruction at Ip.
+func (v *VM) step(ctx context.Context) {
+	v.collectIfDue()
+	v.checkSoftLimit()
+	if v.history != nil {
+		v.history.begin(v)
+	}
+	v.instructionStart = v.Ip
+	if v.Ip >= uint(len(v.Bytecode)) {
+		v.failf("execution ran past the end of the code")
+	}
+	if v.maxInstructions > 0 && v.instructions >= v.maxInstructions {
+		v.fail(ErrInstructionLimit)
+	}
+	if v.instructions%contextCheckInterval == 0 {
+		if err := ctx.Err(); err != nil {
+			v.fail(err)
+		}
+		if v.pinWarnInstructions > 0 && len(v.pinned) > 0 {
+			v.checkPins()
+		}
+	}
+	if v.instructions%v.yieldInterval == 0 && v.instructions > 0 {
+		runtime.Gosched()
+	}
+	opcode := Opcode(v.getByte())
+	if v.trace != nil {
+		v.traceInstruction(opcode)
+	}
+	if v.profile != nil {
+		v.profile.record(v)
+	}
+	v.execute(opcode)
+	if v.trace != nil {
+		v.finishTrace(false)
+	}
+	v.instructions++
+}
+
+// Step executes a single instruction. Like Run, an error the program
+// doesn't catch stops it and is returned as a *RuntimeError.
+func (v *VM) Step() error {
+	err := v.stepRecovering()
+	if err != nil && !v.catch(err) {
+		v.Running = false
+		return err
+	}
+	return nil
+}
+
+func (v *VM) stepRecovering() (err *RuntimeError) {
+	defer func() {
+		if r := recover(); r != nil {
+			v.finishTrace(true)
+			err = v.asRuntimeError(r)
+		}
+	}()
+	if v.Running {
+		v.step(context.Background())
+	}
+	return nil
+}
+
+// Close releases the memory of the program's heap. The VM can't be run
+// afterwards.
+func (v *VM) Close() error {
+	v.Running = false
+	return v.Heap.Release()
+}
+
+// Instructions returns the number of instructions executed so far.
+func (v *VM) Instructions() uint64 {
+	return v.instructions
+}
+
+// asRuntimeError converts a panic raised while executing an instruction
+// into the error returned by Run. Besides failures raised with fail, that
+// covers type errors of the value accessors and faults of the interpreter
+// itself on malformed code, which must never take down the host.
+func (v *VM) asRuntimeError(r any) *RuntimeError {
+	switch r := r.(type) {
+	case *RuntimeError:
+		return r
+	case *TypeError:
+		return &RuntimeError{Ip: v.instructionStart, Err: r}
+	case error:
+		return &RuntimeError{Ip: v.instructionStart, Err: fmt.Errorf("%w: %w", ErrInterpreterFault, r)}
+	default:
+		return &RuntimeError{Ip: v.instructionStart, Err: fmt.Errorf("%w: %v", ErrInterpreterFault, r)}
 	}
 }
 
+// fail aborts the running program with err. It unwinds to Run, which
+// returns it as a *RuntimeError.
+func (v *VM) fail(err error) {
+	panic(&RuntimeError{Ip: v.instructionStart, Err: err})
+}
+
+func (v *VM) failf(format string, args ...any) {
+	v.fail(fmt.Errorf(format, args...))
+}
+
 func (v *VM) push(value Value) {
 	if len(v.CallStack) == 0 {
-		log.Fatal("call stack empty")
+		v.failf("call stack empty")
 	}
 	currentFrameIdx := len(v.CallStack) - 1
 	currentFrame := &v.CallStack[currentFrameIdx]
 	currentFrame.LocalStack = append(currentFrame.LocalStack, value)
+	v.record(change{kind: changePush, frame: currentFrameIdx})
 }
 
 func (v *VM) pop() Value {
 	if len(v.CallStack) == 0 {
-		log.Fatalf("call stack empty")
+		v.failf("call stack empty")
 	}
 	currentFrameIdx := len(v.CallStack) - 1
 	currentFrame := &v.CallStack[currentFrameIdx]
 	if len(currentFrame.LocalStack) == 0 {
-		log.Fatal("local stack empty")
+		v.failf("local stack empty")
 	}
 	value := currentFrame.LocalStack[len(currentFrame.LocalStack)-1]
 	currentFrame.LocalStack = currentFrame.LocalStack[:len(currentFrame.LocalStack)-1]
+	v.record(change{kind: changePop, frame: currentFrameIdx, value: value})
 	return value
 }
 
+// loadElement reads the element of the array at index, applying the out of
+// bounds policy to indices outside of it
+func (v *VM) loadElement(arrayPtr uintptr, index int32) Value {
+	if v.outOfBoundsReads != BoundsTrap {
+		length, err := v.Heap.ArrayLength(arrayPtr)
+		if err != nil {
+			v.fail(err)
+		}
+		if index < 0 || index >= length {
+			switch v.outOfBoundsReads {
+			case BoundsClamp:
+				index = max(0, min(index, length-1))
+			case BoundsDefault:
+				kind, err := v.Heap.ArrayElementKind(arrayPtr)
+				if err != nil {
+					v.fail(err)
+				}
+				return NewValue(kind, 0)
+			}
+		}
+	}
+	value, err := v.Heap.GetArrayElement(arrayPtr, index)
+	if err != nil {
+		v.fail(err)
+	}
+	return *value
+}
+
 func (v *VM) debugState(opcode Opcode) {
 	fmt.Println("========================================")
 	fmt.Printf(" DEBUG STATE\n")
@@ -251,13 +708,13 @@ func (v *VM) debugState(opcode Opcode) {
 	fmt.Printf("  Opcode: %v\n\n", opcode)
 	fmt.Println("========================================")
 	fmt.Printf("Functions table:\n")
-	for _, f := range v.Functions {
+	for _, f := range v.functions {
 		fmt.Println(f)
 	}
 	fmt.Println("========================================")
 	fmt.Println()
 	fmt.Printf("Structs table:\n")
-	for name, s := range v.Structs {
+	for name, s := range v.structs {
 		fmt.Printf("Struct %s:\n", name)
 		fmt.Printf("  Size: %d bytes\n", s.Size)
 		fmt.Printf("  Fields:\n")
@@ -266,8 +723,8 @@ func (v *VM) debugState(opcode Opcode) {
 				field.Name, field.Type, field.Offset)
 		}
 		fmt.Printf("  Methods:\n")
-		for methodName, addr := range s.Methods {
-			fmt.Printf("    %s: address=%d\n", methodName, addr)
+		for methodName, index := range s.Methods {
+			fmt.Printf("    %s: function %d\n", methodName, index)
 		}
 		fmt.Println()
 	}
@@ -324,15 +781,15 @@ func (v *VM) execute(opcode Opcode) {
 		switch ValueKind(typeTag) {
 		case ValueInt32:
 			bits := v.extractUInt32()
-			val = Value{Kind: ValueInt32, Raw: bits}
+			val = NewValue(ValueInt32, uint64(bits))
 		case ValueFloat32:
 			bits := v.extractUInt32()
-			val = Value{Kind: ValueFloat32, Raw: bits}
+			val = NewValue(ValueFloat32, uint64(bits))
 		case ValueByte:
 			bits := uint32(v.getByte())
-			val = Value{Kind: ValueByte, Raw: bits}
+			val = NewValue(ValueByte, uint64(bits))
 		default:
-			log.Fatalf("Unsupported type in PUSH: %v", ValueKind(typeTag))
+			v.failf("Unsupported type in PUSH: %v", ValueKind(typeTag))
 		}
 		v.push(val)
 	case POP:
@@ -341,8 +798,8 @@ func (v *VM) execute(opcode Opcode) {
 	case IADD:
 		v1 := v.pop()
 		v2 := v.pop()
-		if v1.Kind != ValueInt32 || v2.Kind != ValueInt32 {
-			log.Fatalf("Values need to be int32")
+		if v1.Kind() != ValueInt32 || v2.Kind() != ValueInt32 {
+			v.failf("Values need to be int32")
 		}
 		result := v1.AsInt32() + v2.AsInt32()
 		value := Int32Value(result)
@@ -350,38 +807,41 @@ func (v *VM) execute(opcode Opcode) {
 	case ISUB:
 		v1 := v.pop()
 		v2 := v.pop()
-		if v1.Kind != ValueInt32 || v2.Kind != ValueInt32 {
-			log.Fatalf("Values need to be int32")
+		if v1.Kind() != ValueInt32 || v2.Kind() != ValueInt32 {
+			v.failf("Values need to be int32")
 		}
-		result := v1.AsInt32() - v2.AsInt32()
+		// the subtrahend is on top, as for FSUB
+		result := v2.AsInt32() - v1.AsInt32()
 		value := Int32Value(result)
 		v.push(value)
 	case IMUL:
 		v1 := v.pop()
 		v2 := v.pop()
-		if v1.Kind != ValueInt32 || v2.Kind != ValueInt32 {
-			log.Fatalf("Values need to be int32")
+		if v1.Kind() != ValueInt32 || v2.Kind() != ValueInt32 {
+			v.failf("Values need to be int32")
 		}
 		result := v1.AsInt32() * v2.AsInt32()
 		value := Int32Value(result)
 		v.push(value)
 	case IDIV:
-		v1 := v.pop()
-		v2 := v.pop()
-		if v1.Kind != ValueInt32 || v2.Kind != ValueInt32 {
-			log.Fatalf("Values need to be int32")
+		// the divisor is on top, as for FDIV
+		divisor := v.pop()
+		dividend := v.pop()
+		if divisor.Kind() != ValueInt32 || dividend.Kind() != ValueInt32 {
+			v.failf("Values need to be int32")
 		}
-		if v1.AsInt32() == 0 {
-			log.Fatal("Division by zero")
+		if divisor.AsInt32() == 0 {
+			v.fail(ErrDivisionByZero)
 		}
-		result := v2.AsInt32() / v1.AsInt32()
+		// MinInt32 / -1 wraps around to MinInt32, like IMUL by -1
+		result := dividend.AsInt32() / divisor.AsInt32()
 		value := Int32Value(result)
 		v.push(value)
 	case FADD:
 		v1 := v.pop()
 		v2 := v.pop()
-		if v1.Kind != ValueFloat32 || v2.Kind != ValueFloat32 {
-			log.Fatal("Values need to be float32")
+		if v1.Kind() != ValueFloat32 || v2.Kind() != ValueFloat32 {
+			v.failf("Values need to be float32")
 		}
 		result := v1.AsFloat32() + v2.AsFloat32()
 		value := Float32Value(result)
@@ -389,8 +849,8 @@ func (v *VM) execute(opcode Opcode) {
 	case FSUB:
 		v1 := v.pop()
 		v2 := v.pop()
-		if v1.Kind != ValueFloat32 || v2.Kind != ValueFloat32 {
-			log.Fatal("Values need to be float32")
+		if v1.Kind() != ValueFloat32 || v2.Kind() != ValueFloat32 {
+			v.failf("Values need to be float32")
 		}
 		result := v2.AsFloat32() - v1.AsFloat32()
 		value := Float32Value(result)
@@ -398,123 +858,127 @@ func (v *VM) execute(opcode Opcode) {
 	case FMUL:
 		v1 := v.pop()
 		v2 := v.pop()
-		if v1.Kind != ValueFloat32 || v2.Kind != ValueFloat32 {
-			log.Fatal("Values need to be float32")
+		if v1.Kind() != ValueFloat32 || v2.Kind() != ValueFloat32 {
+			v.failf("Values need to be float32")
 		}
 		result := v1.AsFloat32() * v2.AsFloat32()
 		value := Float32Value(result)
 		v.push(value)
 	case FDIV:
-		v1 := v.pop()
-		v2 := v.pop()
-		if v1.Kind != ValueFloat32 || v2.Kind != ValueFloat32 {
-			log.Fatal("Values need to be float32")
+		divisor := v.pop()
+		dividend := v.pop()
+		if divisor.Kind() != ValueFloat32 || dividend.Kind() != ValueFloat32 {
+			v.failf("Values need to be float32")
 		}
-		if v1.AsFloat32() == 0 {
-			log.Fatal("Division by zero")
+		if divisor.AsFloat32() == 0 && v.trapFloatDivision {
+			v.fail(ErrDivisionByZero)
 		}
-		result := v2.AsFloat32() / v1.AsFloat32()
+		result := dividend.AsFloat32() / divisor.AsFloat32()
 		value := Float32Value(result)
 		v.push(value)
 	case JMP:
-		addr := uint(v.extractUInt16())
+		addr := uint(v.extractOperand())
 		v.Ip = uint(addr)
+	case FORITER:
+		addr := uint(v.extractOperand())
+		if !v.forIter() {
+			v.Ip = addr
+		}
 	// jump to an addr if top of stack not equal to value
-	case IJNE:
-		addr := uint(v.extractUInt16())
+	case IJNE, IJNEC:
+		addr := uint(v.extractOperand())
 		if addr >= uint(len(v.Bytecode)) {
-			log.Fatalf("Invalid address: %d", addr)
+			v.failf("Invalid address: %d", addr)
 		}
-		value := int32(v.extractUInt32())
+		value := int32(v.comparand(opcode == IJNEC))
 		topOfStack := v.pop()
-		if topOfStack.Kind != ValueInt32 {
-			log.Fatal("should be an int32")
+		if topOfStack.Kind() != ValueInt32 {
+			v.failf("should be an int32")
 		}
 		if value != topOfStack.AsInt32() {
 			v.Ip = addr
 		}
-	case IJE:
-		addr := uint(v.extractUInt16())
+	case IJE, IJEC:
+		addr := uint(v.extractOperand())
 		if addr >= uint(len(v.Bytecode)) {
-			log.Fatalf("Invalid address: %d", addr)
+			v.failf("Invalid address: %d", addr)
 		}
-		value := int32(v.extractUInt32())
+		value := int32(v.comparand(opcode == IJEC))
 		topOfStack := v.pop()
-		if topOfStack.Kind != ValueInt32 {
-			log.Fatal("Should be an int32")
+		if topOfStack.Kind() != ValueInt32 {
+			v.failf("Should be an int32")
 		}
 		if value == topOfStack.AsInt32() {
 			v.Ip = addr
 		}
-	case FJNE:
-		addr := uint(v.extractUInt16())
+	case FJNE, FJNEC:
+		addr := uint(v.extractOperand())
 		if addr >= uint(len(v.Bytecode)) {
-			log.Fatalf("Invalid address: %d\n", addr)
+			v.failf("Invalid address: %d", addr)
 		}
-		value := math.Float32frombits(v.extractUInt32())
+		value := math.Float32frombits(v.comparand(opcode == FJNEC))
 		topOfStack := v.pop()
-		if topOfStack.Kind != ValueFloat32 {
-			log.Fatal("Should be a float32")
+		if topOfStack.Kind() != ValueFloat32 {
+			v.failf("Should be a float32")
 		}
 		if value != topOfStack.AsFloat32() {
 			v.Ip = addr
 		}
-	case FJE:
-		addr := uint(v.extractUInt16())
+	case FJE, FJEC:
+		addr := uint(v.extractOperand())
 		if addr >= uint(len(v.Bytecode)) {
-			log.Fatalf("Invalid address: %d\n", addr)
+			v.failf("Invalid address: %d", addr)
 		}
-		value := math.Float32frombits(v.extractUInt32())
+		value := math.Float32frombits(v.comparand(opcode == FJEC))
 		topOfStack := v.pop()
-		if topOfStack.Kind != ValueFloat32 {
-			log.Fatal("Should be a float32")
+		if topOfStack.Kind() != ValueFloat32 {
+			v.failf("Should be a float32")
 		}
 		if value == topOfStack.AsFloat32() {
 			v.Ip = addr
 		}
 	// store top of the stack to an address
 	case STORE:
-		addr := v.extractUInt16()
+		addr := v.extractOperand()
 		topOfStack := v.pop()
-		currentFrame := v.getCurrentFrame()
-		currentFrame.Locals[addr] = topOfStack
+		v.setLocal(addr, topOfStack)
 	// load value from addr on top of the stack
 	case LOAD:
-		addr := v.extractUInt16()
+		addr := v.extractOperand()
 		currentFrame := v.getCurrentFrame()
 		value, ok := currentFrame.Locals[addr]
 		if !ok {
-			log.Fatalf("Local variable at address %d not found", addr)
+			v.failf("Local variable at address %d not found", addr)
 		}
 		v.push(value)
 	//call to an address
 	case CALL:
-		calleAddr := uint(v.extractUInt16())
-		signature, exists := v.Functions[calleAddr]
-		if !exists {
-			log.Fatalf("function not found at address: %d\n", calleAddr)
-		}
-		var args []Value
-		for i := 0; i < int(signature.ParamCount); i++ {
-			args = append(args, v.pop())
-		}
-		returnAddress := v.Ip
-		frame := StackFrame{
-			Locals:        make(map[uint16]Value),
-			ReturnAddress: returnAddress,
+		funcIndex := v.extractOperand()
+		if int(funcIndex) >= len(v.functionList) {
+			v.failf("function not found at index: %d", funcIndex)
 		}
-		v.CallStack = append(v.CallStack, frame)
-		for i := len(args) - 1; i >= 0; i-- {
-			v.push(args[i])
-		}
-		v.Ip = calleAddr
+		v.call(int(funcIndex))
+	case INVOKEINTERFACE:
+		method := v.extractString()
+		argCount := int(v.getByte())
+		returnType := ValueKind(v.getByte())
+		v.call(v.resolveMethod(method, argCount, returnType))
+	case MAKECLOSURE:
+		index := v.extractOperand()
+		v.makeClosure(index, int(v.getByte()))
+	case CALLCLOSURE:
+		v.callClosure()
+	case CALLNATIVE:
+		v.callNative(int(v.extractOperand()))
+	case AWAIT:
+		v.await()
 	case RET:
 		if len(v.CallStack) == 0 {
-			log.Fatal("Cannot RET: callstack empty")
+			v.failf("Cannot RET: callstack empty")
 		}
 		calleeFrame := v.getCurrentFrame()
 		if len(calleeFrame.LocalStack) == 0 {
-			log.Fatal("Cannot RET: local stack empty")
+			v.failf("Cannot RET: local stack empty")
 		}
 		returnValue := calleeFrame.LocalStack[len(calleeFrame.LocalStack)-1]
 		// Check for sentinel value (program termination)
@@ -526,55 +990,52 @@ func (v *VM) execute(opcode Opcode) {
 		var foundCallee bool
 		var calleeReturnType ValueKind
 		var calleeReturnStructName string
-		currentFuncStart := v.Ip - 1
-		for addr, sig := range v.Functions {
-			if currentFuncStart >= addr && currentFuncStart < uint(len(v.Bytecode)) {
-				calleeReturnType = sig.ReturnType
-				calleeReturnStructName = sig.ReturnStructName
-				foundCallee = true
-				break
-			}
+		if calleeFrame.Function != nil {
+			calleeReturnType = calleeFrame.Function.ReturnType
+			calleeReturnStructName = calleeFrame.Function.ReturnStructName
+			foundCallee = true
 		}
 		// --- Return type checking ---
 		if foundCallee {
 			// Check if return value matches expected type
-			if calleeReturnType != returnValue.Kind {
+			if calleeReturnType != returnValue.Kind() {
 				// Special case for struct returns
-				if calleeReturnType == ValueStruct && returnValue.Kind == ValuePtr {
+				if calleeReturnType == ValueStruct && returnValue.Kind() == ValuePtr {
 					// Verify the struct type matches
 					mem, exists := v.Heap.Memory[returnValue.AsPtr()]
 					if !exists || ValueKind(mem[0]) != ValueStruct {
-						log.Fatalf("Return type mismatch: expected struct %s, got %v",
-							calleeReturnStructName, returnValue.Kind)
+						v.failf("Return type mismatch: expected struct %s, got %v",
+							calleeReturnStructName, returnValue.Kind())
 					}
 				} else {
 					// Regular type mismatch
-					log.Fatalf("Return type mismatch: function has return type %v, but returning %v",
-						calleeReturnType, returnValue.Kind)
+					v.failf("Return type mismatch: function has return type %v, but returning %v",
+						calleeReturnType, returnValue.Kind())
 				}
 			} else {
-				fmt.Printf("Return value type check passed: %v\n", returnValue.Kind)
+				fmt.Printf("Return value type check passed: %v\n", returnValue.Kind())
 			}
 		} else {
 			fmt.Printf("Warning: Could not determine current function for return type checking\n")
 		}
 		// This is to find the function we are returning TO (the caller)
-		v.CallStack = v.CallStack[:len(v.CallStack)-1]
+		v.popFrame()
+		v.dropHandlers()
 		if len(v.CallStack) == 0 {
-			log.Fatal("Cannot RET: callstack empty after popping frame")
+			v.failf("Cannot RET: callstack empty after popping frame")
 		}
 		// Push return value onto caller's stack
-		callerFrame := v.getCurrentFrame()
-		callerFrame.LocalStack = append(callerFrame.LocalStack, returnValue)
+		v.push(returnValue)
 		// Set IP to return address
 		v.Ip = calleeFrame.ReturnAddress
 	// return to callee frame without a return value (return void)
 	case RETV:
 		if len(v.CallStack) == 0 {
-			log.Fatal("CANNOT RETV: callstack empty")
+			v.failf("CANNOT RETV: callstack empty")
 		}
-		calleeFrame := v.getCurrentFrame()
-		v.CallStack = v.CallStack[:len(v.CallStack)-1]
+		calleeFrame := *v.getCurrentFrame()
+		v.popFrame()
+		v.dropHandlers()
 		v.Ip = calleeFrame.ReturnAddress
 	case EQ:
 		v1 := v.pop()
@@ -611,7 +1072,7 @@ func (v *VM) execute(opcode Opcode) {
 	case GT:
 		v1 := v.pop()
 		v2 := v.pop()
-		if !v2.Lesser(v1) {
+		if v1.Lesser(v2) {
 			v.push(Int32Value(1))
 		} else {
 			v.push(Int32Value(0))
@@ -626,26 +1087,29 @@ func (v *VM) execute(opcode Opcode) {
 		}
 	case ALLOC:
 		topOfStack := v.pop()
-		if topOfStack.Kind != ValueInt32 {
-			log.Fatalf("size should be an integer")
+		if topOfStack.Kind() != ValueInt32 {
+			v.failf("size should be an integer")
+		}
+		if topOfStack.AsInt32() < 0 {
+			v.failf("negative allocation size %d", topOfStack.AsInt32())
 		}
 		bytes := uintptr(topOfStack.AsInt32())
 		ptr, err := v.Heap.Allocate(bytes)
 		if err != nil {
-			log.Fatal(err)
+			v.fail(err)
 		}
 		v.push(PtrValue(ptr))
 	case FREE:
 		ptr := v.pop().AsPtr()
 		err := v.Heap.Free(ptr)
 		if err != nil {
-			log.Fatal(err)
+			v.fail(err)
 		}
 	case LOADH:
 		ptr := v.pop().AsPtr()
 		value, err := v.Heap.LoadValue(ptr)
 		if err != nil {
-			log.Fatal(err)
+			v.fail(err)
 		}
 		v.push(*value)
 	case STOREH:
@@ -653,7 +1117,7 @@ func (v *VM) execute(opcode Opcode) {
 		ptr := v.pop().AsPtr()
 		err := v.Heap.StoreValue(ptr, value)
 		if err != nil {
-			log.Fatal(err)
+			v.fail(err)
 		}
 	case DUP:
 		topOfStack := v.pop()
@@ -665,7 +1129,7 @@ func (v *VM) execute(opcode Opcode) {
 		v.Ip += uint(length)
 		ptr, err := v.Heap.AllocateString(data)
 		if err != nil {
-			log.Fatal(err)
+			v.fail(err)
 		}
 		v.push(PtrValue(ptr))
 	case NEWARR:
@@ -673,56 +1137,131 @@ func (v *VM) execute(opcode Opcode) {
 		length := v.pop().AsInt32()
 		ptr, err := v.Heap.AllocateArray(elementKind, length)
 		if err != nil {
-			log.Fatal(err)
+			v.fail(err)
 		}
 		v.push(PtrValue(ptr))
 	case LDELEM:
 		index := v.pop().AsInt32()
 		arrayPtr := v.pop().AsPtr()
-		value, err := v.Heap.GetArrayElement(arrayPtr, index)
+		v.push(v.loadElement(arrayPtr, index))
+	case SLICE:
+		length := v.pop().AsInt32()
+		offset := v.pop().AsInt32()
+		arrayPtr := v.pop().AsPtr()
+		view, err := v.Heap.AllocateArrayView(arrayPtr, offset, length)
 		if err != nil {
-			log.Fatal(err)
+			v.fail(err)
 		}
-		v.push(*value)
+		v.push(PtrValue(view))
+	case ARR_CLONE:
+		clone, err := v.Heap.CloneArray(v.pop().AsPtr())
+		if err != nil {
+			v.fail(err)
+		}
+		v.push(PtrValue(clone))
 	case STELEM:
 		value := v.pop()
 		index := v.pop().AsInt32()
 		arrayPtr := v.pop().AsPtr()
 		err := v.Heap.SetArrayElement(arrayPtr, index, value)
 		if err != nil {
-			log.Fatal(err)
+			v.fail(err)
 		}
 	case SYSCALL:
-		call := Systemcall(v.extractUInt16())
-		v.executeSystemCall(call)
+		number := v.extractUInt16()
+		if number > math.MaxUint8 {
+			v.failf("unknown system call %d", number)
+		}
+		call := Systemcall(number)
+		if v.auditLog != nil {
+			v.auditSystemCall(call)
+		} else {
+			v.executeSystemCall(call)
+		}
 	case NEWSTRUCT:
 		typeName := v.extractString()
-		structType, ok := v.Structs[typeName]
+		structType, ok := v.structs[typeName]
 		if !ok {
-			log.Fatalf("Unkown struct type: %s", typeName)
+			v.failf("Unkown struct type: %s", typeName)
 		}
 		ptr, err := v.Heap.AllocateStruct(structType)
 		if err != nil {
-			log.Fatal(err)
+			v.fail(err)
 		}
 		v.push(PtrValue(ptr))
 	case FLDGET:
+		fieldID := v.extractUInt16()
+		structPtr := v.pop().AsPtr()
+		value, err := v.Heap.GetStructFieldByID(structPtr, fieldID)
+		if err != nil {
+			v.fail(err)
+		}
+		v.push(*value)
+	case STFIELD:
+		fieldID := v.extractUInt16()
+		value := v.pop()
+		structPtr := v.pop().AsPtr()
+		err := v.Heap.SetStructFieldByID(structPtr, fieldID, value)
+		if err != nil {
+			v.fail(err)
+		}
+	// legacy encodings that carry the field name inline
+	case FLDGET_NAME:
 		fieldName := v.extractString()
 		structPtr := v.pop().AsPtr()
 		value, err := v.Heap.GetStructField(structPtr, fieldName)
 		if err != nil {
-			log.Fatal(err)
+			v.fail(err)
 		}
 		v.push(*value)
-	case STFIELD:
+	case STFIELD_NAME:
 		value := v.pop()
 		structPtr := v.pop().AsPtr()
 		fieldName := v.extractString()
 		err := v.Heap.SetStructureField(structPtr, fieldName, value)
 		if err != nil {
-			log.Fatal(err)
+			v.fail(err)
 		}
+	case THROW:
+		v.throw()
+	case TRY:
+		address := v.extractOperand()
+		v.pushHandler(handler{
+			address: uint(address),
+			frame:   len(v.CallStack) - 1,
+			stack:   len(v.getCurrentFrame().LocalStack),
+		})
+	case ENDTRY:
+		if len(v.handlers) == 0 || v.handlers[len(v.handlers)-1].frame != len(v.CallStack)-1 {
+			v.failf("ENDTRY without a TRY in the same function")
+		}
+		v.popHandler()
+	case CHECKCAST:
+		t := v.extractTypeRef()
+		value := v.pop()
+		if err := v.checkType(value, t); err != nil {
+			v.fail(fmt.Errorf("CHECKCAST: %w", err))
+		}
+		v.push(value)
+	case INSTANCEOF:
+		t := v.extractTypeRef()
+		if v.checkType(v.pop(), t) == nil {
+			v.push(Int32Value(1))
+		} else {
+			v.push(Int32Value(0))
+		}
+	case WIDE:
+		next := Opcode(v.getByte())
+		if !acceptsWide(next) {
+			v.failf("WIDE prefix is not valid for %v", next)
+		}
+		v.wide = true
+		v.execute(next)
 	case FUNC:
 		v.Ip += 5
+	default:
+		if isExtension(opcode) {
+			v.executeExtension(opcode)
+		}
 	}
 }
@@ -1 +1,339 @@
 package vm
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/AndreiAlbert/gvm/bytecode"
+	. "github.com/AndreiAlbert/gvm/common"
+	"github.com/AndreiAlbert/gvm/heap"
+)
+
+// BenchmarkRun runs a counting loop, which spends its time moving values
+// between the operand stack and the locals.
+func BenchmarkRun(b *testing.B) {
+	program, err := bytecode.Decode(mustReadTestProgram(b, "testdata/count.gvmbc"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		machine, err := NewVmFromProgram(program, Options{})
+		if err != nil {
+			b.Fatal(err)
+		}
+		if err := machine.Run(); err != nil {
+			b.Fatal(err)
+		}
+		machine.Close()
+	}
+}
+
+// TestHeapBlocksAreBigEndian checks the bytes of heap objects, which must not
+// depend on the host so that they can be saved and loaded elsewhere.
+func TestHeapBlocksAreBigEndian(t *testing.T) {
+	program, err := bytecode.Decode(mustReadTestProgram(t, "testdata/strings.gvmbc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	machine, err := NewVmFromProgram(program, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer machine.Close()
+	h := machine.Heap
+
+	str, err := h.AllocateString("ab")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []byte{byte(ValueString), 0, 0, 0, 2, 'a', 'b'}; !bytes.Equal(h.Memory[str], want) {
+		t.Errorf("Expected string block % x, got % x", want, h.Memory[str])
+	}
+
+	array, err := h.AllocateArray(ValueFloat32, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := h.SetArrayElement(array, 1, Float32Value(1)); err != nil {
+		t.Fatal(err)
+	}
+	want := []byte{byte(ValueArray), byte(ValueFloat32), 0, 0, 0, 2, 0, 0, 0, 0, 0x3f, 0x80, 0, 0}
+	if !bytes.Equal(h.Memory[array], want) {
+		t.Errorf("Expected array block % x, got % x", want, h.Memory[array])
+	}
+
+	errorValue, err := h.AllocateStruct(machine.structs[ErrorStructName])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := h.SetStructureField(errorValue, "code", Int32Value(-2)); err != nil {
+		t.Fatal(err)
+	}
+	// the tag and type index come before the fields, code is the first
+	mem := h.Memory[errorValue]
+	if mem[0] != byte(ValueStruct) || !bytes.Equal(mem[5:9], []byte{0xff, 0xff, 0xff, 0xfe}) {
+		t.Errorf("Unexpected struct block % x", mem)
+	}
+	code, err := h.GetStructField(errorValue, "code")
+	if err != nil || code.AsInt32() != -2 {
+		t.Errorf("Expected code -2 to read back, got %v, %v", code, err)
+	}
+}
+
+// TestPointerFieldsTakeEightBytes checks that layouts don't depend on the
+// size of host pointers, so 32- and 64-bit hosts agree on them.
+func TestPointerFieldsTakeEightBytes(t *testing.T) {
+	program, err := bytecode.Decode(mustReadTestProgram(t, "testdata/strings.gvmbc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	machine, err := NewVmFromProgram(program, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer machine.Close()
+
+	errorType := machine.structs[ErrorStructName]
+	for i, want := range []uint{0, 4, 12} {
+		if offset := errorType.Fields[i].Offset; offset != want {
+			t.Errorf("Expected field %s at offset %d, got %d", errorType.Fields[i].Name, want, offset)
+		}
+	}
+	if errorType.Size != 20 {
+		t.Errorf("Expected Error to take 20 bytes, got %d", errorType.Size)
+	}
+
+	h := machine.Heap
+	array, err := h.AllocateArray(ValuePtr, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := h.SetArrayElement(array, 0, PtrValue(0x01020304)); err != nil {
+		t.Fatal(err)
+	}
+	want := []byte{byte(ValueArray), byte(ValuePtr), 0, 0, 0, 1, 0, 0, 0, 0, 1, 2, 3, 4}
+	if !bytes.Equal(h.Memory[array], want) {
+		t.Errorf("Expected array block % x, got % x", want, h.Memory[array])
+	}
+}
+
+// TestInvokeInterface runs methods of two structs through the same
+// interface call.
+func TestInvokeInterface(t *testing.T) {
+	program, err := bytecode.Decode(mustReadTestProgram(t, "testdata/shapes.gvmbc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	machine, err := NewVmFromProgram(program, Options{Stdout: &out})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer machine.Close()
+	if methods := machine.structs["Square"].Methods; len(methods) != 2 {
+		t.Errorf("Expected Square to have area and scale, got %v", methods)
+	}
+	if err := machine.Run(); err != nil {
+		t.Fatal(err)
+	}
+	// the areas of a 2x2 square and a 1x3 rectangle, the area of the square
+	// scaled by 2 ('0'+16), then the caught call of the method Rect lacks
+	if want := "43@3"; out.String() != want {
+		t.Errorf("Expected output %q, got %q", want, out.String())
+	}
+}
+
+// TestClosures calls closures capturing a number and a struct, whose
+// changes the next call sees.
+func TestClosures(t *testing.T) {
+	program, err := bytecode.Decode(mustReadTestProgram(t, "testdata/closures.gvmbc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	machine, err := NewVmFromProgram(program, Options{Stdout: &out})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer machine.Close()
+	if err := machine.Run(); err != nil {
+		t.Fatal(err)
+	}
+	// 48+1, the counter bumped by 50 and then by 1, then the caught call of
+	// an int32
+	if want := "1233"; out.String() != want {
+		t.Errorf("Expected output %q, got %q", want, out.String())
+	}
+}
+
+func TestForIter(t *testing.T) {
+	program, err := bytecode.Decode(mustReadTestProgram(t, "testdata/iterate.gvmbc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	machine, err := NewVmFromProgram(program, Options{Stdout: &out})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer machine.Close()
+	if err := machine.Run(); err != nil {
+		t.Fatal(err)
+	}
+	// the elements of the array, then the count of the runes of "héllo"
+	if want := "1235"; out.String() != want {
+		t.Errorf("Expected output %q, got %q", want, out.String())
+	}
+}
+
+func TestArrayViews(t *testing.T) {
+	program, err := bytecode.Decode(mustReadTestProgram(t, "testdata/slice.gvmbc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	machine, err := NewVmFromProgram(program, Options{Stdout: &out})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer machine.Close()
+	if err := machine.Run(); err != nil {
+		t.Fatal(err)
+	}
+	// the view of 1..3, a view of that view, the array written through the
+	// first view and the code of the read past the end of the view
+	if want := "[1, 2, 3][2, 3][0, 10, 2, 3, 4]-2"; out.String() != want {
+		t.Errorf("Expected output %q, got %q", want, out.String())
+	}
+	view := machine.CallStack[0].Locals[2].Ptr()
+	if object, ok := machine.Heap.ObjectAt(view); !ok || !machine.Heap.IsArrayView(view) || object.Type != "int32[] view" {
+		t.Errorf("Expected an int32 array view, got %+v", object)
+	}
+	if _, err := machine.Heap.AllocateArrayView(view, 2, 2); !errors.Is(err, heap.ErrOutOfBounds) {
+		t.Errorf("Expected a view past the end of the view to fail, got %v", err)
+	}
+}
+
+func TestArrayClones(t *testing.T) {
+	program, err := bytecode.Decode(mustReadTestProgram(t, "testdata/clone.gvmbc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	machine, err := NewVmFromProgram(program, Options{Stdout: &out})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer machine.Close()
+	if err := machine.Run(); err != nil {
+		t.Fatal(err)
+	}
+	// the array written after cloning it, the clone written to, the clone
+	// of that clone taken before the write and a clone of the array
+	if want := "[1, 20, 3][10, 2, 3][1, 2, 3][1, 20, 3]"; out.String() != want {
+		t.Errorf("Expected output %q, got %q", want, out.String())
+	}
+	locals := machine.CallStack[0].Locals
+	for i, want := range []bool{false, false, false, true} {
+		if got := machine.Heap.IsArrayClone(locals[uint32(i)].Ptr()); got != want {
+			t.Errorf("Expected IsArrayClone of local %d to be %v", i, want)
+		}
+	}
+	clone := locals[3].Ptr()
+	if object, ok := machine.Heap.ObjectAt(clone); !ok || object.Type != "int32[] clone" {
+		t.Errorf("Expected an int32 array clone, got %+v", object)
+	}
+	// freeing the array leaves the clone its own elements
+	if err := machine.Heap.Free(locals[0].Ptr()); err != nil {
+		t.Fatal(err)
+	}
+	if element, err := machine.Heap.GetArrayElement(clone, 1); err != nil || element.AsInt32() != 20 {
+		t.Errorf("Expected the clone to keep 20 at index 1, got %v, %v", element, err)
+	}
+}
+
+func TestConstantPool(t *testing.T) {
+	program, err := bytecode.Decode(mustReadTestProgram(t, "testdata/pool.gvmbc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the five loops compare against 0, pooled once
+	if len(program.Constants) != 1 || program.Constants[0] != 0 {
+		t.Fatalf("Expected a pool holding 0, got %v", program.Constants)
+	}
+	var out bytes.Buffer
+	machine, err := NewVmFromProgram(program, Options{Stdout: &out})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer machine.Close()
+	if err := machine.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if want := "32112114321"; out.String() != want {
+		t.Errorf("Expected output %q, got %q", want, out.String())
+	}
+
+	program.Constants = nil
+	machine, err = NewVmFromProgram(program, Options{Stdout: io.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer machine.Close()
+	if err := machine.Run(); err == nil || !strings.Contains(err.Error(), "outside of the constant pool") {
+		t.Errorf("Expected running without the pool to fail, got %v", err)
+	}
+}
+
+func TestOutOfBoundsReads(t *testing.T) {
+	// reads index of an array holding 0, 0, 9
+	program := func(index int32) *bytecode.Program {
+		code := join(pushValue(Int32Value(3)), []byte{byte(NEWARR), byte(ValueInt32), byte(DUP)},
+			pushValue(Int32Value(2)), pushValue(Int32Value(9)), []byte{byte(STELEM)},
+			pushValue(Int32Value(index)), []byte{byte(LDELEM), byte(HALT)})
+		return &bytecode.Program{
+			Functions: []bytecode.Function{{Name: "main", IsMain: true, ReturnType: ValueVoid}},
+			Code:      code,
+		}
+	}
+	cases := []struct {
+		policy BoundsPolicy
+		index  int32
+		want   int32
+	}{
+		{BoundsClamp, 5, 9},
+		{BoundsClamp, -1, 0},
+		{BoundsClamp, 2, 9},
+		{BoundsDefault, 3, 0},
+		{BoundsDefault, 2, 9},
+	}
+	for _, c := range cases {
+		machine, err := NewVmFromProgram(program(c.index), Options{OutOfBoundsReads: c.policy})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := machine.Run(); err != nil {
+			t.Fatalf("%v of index %d: %v", c.policy, c.index, err)
+		}
+		if got := machine.pop(); got.Kind() != ValueInt32 || got.AsInt32() != c.want {
+			t.Errorf("%v of index %d read %v, expected %d", c.policy, c.index, got, c.want)
+		}
+		machine.Close()
+	}
+
+	machine, err := NewVmFromProgram(program(3), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer machine.Close()
+	if err := machine.Run(); !errors.Is(err, heap.ErrOutOfBounds) {
+		t.Errorf("Expected the read to trap by default, got %v", err)
+	}
+	if _, err := ParseBoundsPolicy("wrap"); err == nil {
+		t.Error("Expected an unknown policy to be refused")
+	}
+}
@@ -0,0 +1,25 @@
+// gvm.js loads gvm.wasm and exposes the assembler and VM:
+//
+//   <script src="wasm_exec.js"></script>
+//   <script src="gvm.js"></script>
+//   const gvm = await loadGvm("gvm.wasm");
+//   const { output, error } = gvm.run(source, stdin);
+//
+// wasm_exec.js ships with Go, copy it from "$(go env GOROOT)/lib/wasm".
+async function loadGvm(url) {
+  const go = new Go();
+  const response = fetch(url);
+  const { instance } = WebAssembly.instantiateStreaming
+    ? await WebAssembly.instantiateStreaming(response, go.importObject)
+    : await WebAssembly.instantiate(await (await response).arrayBuffer(), go.importObject);
+  // run never resolves while the Go side waits for calls
+  go.run(instance);
+  return {
+    run: (source, stdin = "") => globalThis.gvmRun(source, stdin),
+    disassemble: (source) => globalThis.gvmDisassemble(source),
+  };
+}
+
+if (typeof module !== "undefined") {
+  module.exports = { loadGvm };
+}
@@ -0,0 +1,81 @@
+//go:build js && wasm
+
+// Command wasm exposes the assembler and the VM to JavaScript. Build it with
+//
+//	GOOS=js GOARCH=wasm go build -o gvm.wasm ./wasm
+//
+// and load it through gvm.js, which wraps the functions registered here.
+package main
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"syscall/js"
+
+	"github.com/AndreiAlbert/gvm/asm"
+	"github.com/AndreiAlbert/gvm/vm"
+)
+
+// maxInstructions bounds a run, so that a program that never halts stops
+// with an error instead of hanging the page
+const maxInstructions = 10_000_000
+
+// result converts the outcome of a call into the object handed to JS
+func result(output string, err error) map[string]any {
+	r := map[string]any{"output": output, "error": nil}
+	if err != nil {
+		r["error"] = err.Error()
+	}
+	return r
+}
+
+// run assembles source and executes it with stdin as its input:
+// gvmRun(source, stdin) -> {output, error}
+func run(this js.Value, args []js.Value) any {
+	if len(args) < 1 {
+		return result("", errors.New("usage: gvmRun(source, stdin)"))
+	}
+	stdin := ""
+	if len(args) > 1 && args[1].Type() == js.TypeString {
+		stdin = args[1].String()
+	}
+	program, err := asm.NewAssembler(args[0].String()).Assemble()
+	if err != nil {
+		return result("", err)
+	}
+	var stdout bytes.Buffer
+	machine, err := vm.NewVmFromProgram(program, vm.Options{
+		Stdin:           strings.NewReader(stdin),
+		Stdout:          &stdout,
+		MaxInstructions: maxInstructions,
+	})
+	if err != nil {
+		return result("", err)
+	}
+	defer machine.Close()
+	err = machine.Run()
+	return result(stdout.String(), err)
+}
+
+// disassemble assembles source and returns its listing:
+// gvmDisassemble(source) -> {output, error}
+func disassemble(this js.Value, args []js.Value) any {
+	if len(args) < 1 {
+		return result("", errors.New("usage: gvmDisassemble(source)"))
+	}
+	program, err := asm.NewAssembler(args[0].String()).Assemble()
+	if err != nil {
+		return result("", err)
+	}
+	var listing strings.Builder
+	err = vm.Disassemble(&listing, program)
+	return result(listing.String(), err)
+}
+
+func main() {
+	js.Global().Set("gvmRun", js.FuncOf(run))
+	js.Global().Set("gvmDisassemble", js.FuncOf(disassemble))
+	// keep the Go runtime alive so the functions stay callable
+	select {}
+}